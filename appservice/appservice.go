@@ -69,10 +69,10 @@ func NewInternalAPI(
 	// Wrap application services in a type that relates the application service and
 	// a sync.Cond object that can be used to notify workers when there are new
 	// events to be sent out.
-	workerStates := make([]types.ApplicationServiceWorkerState, len(base.Cfg.Derived.ApplicationServices))
+	workerStates := make([]*types.ApplicationServiceWorkerState, len(base.Cfg.Derived.ApplicationServices))
 	for i, appservice := range base.Cfg.Derived.ApplicationServices {
 		m := sync.Mutex{}
-		ws := types.ApplicationServiceWorkerState{
+		ws := &types.ApplicationServiceWorkerState{
 			AppService: appservice,
 			Cond:       sync.NewCond(&m),
 		}
@@ -105,6 +105,23 @@ func NewInternalAPI(
 		}
 	}
 
+	// Only consume ephemeral events if any of the ASes want them, as per MSC2409.
+	var ephemeralWorkerStates []*types.ApplicationServiceWorkerState
+	for _, ws := range workerStates {
+		if ws.AppService.PushEphemeral && ws.AppService.URL != "" {
+			ephemeralWorkerStates = append(ephemeralWorkerStates, ws)
+		}
+	}
+	if len(ephemeralWorkerStates) > 0 {
+		eduConsumer := consumers.NewOutputEDUConsumer(
+			base.ProcessContext, base.Cfg, consumer, appserviceDB,
+			rsAPI, ephemeralWorkerStates,
+		)
+		if err := eduConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start appservice EDU consumer")
+		}
+	}
+
 	// Create application service transaction workers
 	if err := workers.SetupTransactionWorkers(client, appserviceDB, workerStates); err != nil {
 		logrus.WithError(err).Panicf("failed to start app service transaction workers")
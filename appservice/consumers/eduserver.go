@@ -0,0 +1,252 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	userAPI "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputEDUConsumer consumes ephemeral events that originated in the EDU
+// server and the user API, and queues them for the application services
+// which have opted in to receiving them with MSC2409.
+type OutputEDUConsumer struct {
+	typingConsumer       *internal.ContinualConsumer
+	sendToDeviceConsumer *internal.ContinualConsumer
+	receiptConsumer      *internal.ContinualConsumer
+	presenceConsumer     *internal.ContinualConsumer
+	rsAPI                api.RoomserverInternalAPI
+	typingCache          *cache.EDUCache
+	workerStates         []*types.ApplicationServiceWorkerState
+}
+
+// NewOutputEDUConsumer creates a new OutputEDUConsumer. Call Start() to begin
+// consuming from the EDU server and the user API. Only the application
+// services which want ephemeral events are given to the consumer.
+func NewOutputEDUConsumer(
+	process *process.ProcessContext,
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	appserviceDB storage.Database,
+	rsAPI api.RoomserverInternalAPI,
+	workerStates []*types.ApplicationServiceWorkerState,
+) *OutputEDUConsumer {
+	c := &OutputEDUConsumer{
+		typingConsumer: &internal.ContinualConsumer{
+			Process:        process,
+			ComponentName:  "appservice/eduserver/typing",
+			Topic:          cfg.Global.Kafka.TopicFor(config.TopicOutputTypingEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: appserviceDB,
+		},
+		sendToDeviceConsumer: &internal.ContinualConsumer{
+			Process:        process,
+			ComponentName:  "appservice/eduserver/sendtodevice",
+			Topic:          cfg.Global.Kafka.TopicFor(config.TopicOutputSendToDeviceEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: appserviceDB,
+		},
+		receiptConsumer: &internal.ContinualConsumer{
+			Process:        process,
+			ComponentName:  "appservice/eduserver/receipt",
+			Topic:          cfg.Global.Kafka.TopicFor(config.TopicOutputReceiptEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: appserviceDB,
+		},
+		presenceConsumer: &internal.ContinualConsumer{
+			Process:        process,
+			ComponentName:  "appservice/userapi/presence",
+			Topic:          cfg.Global.Kafka.TopicFor(config.TopicOutputPresenceEvent),
+			Consumer:       kafkaConsumer,
+			PartitionStore: appserviceDB,
+		},
+		rsAPI:        rsAPI,
+		typingCache:  cache.New(),
+		workerStates: workerStates,
+	}
+	c.typingConsumer.ProcessMessage = c.onTypingEvent
+	c.sendToDeviceConsumer.ProcessMessage = c.onSendToDeviceEvent
+	c.receiptConsumer.ProcessMessage = c.onReceiptEvent
+	c.presenceConsumer.ProcessMessage = c.onPresenceEvent
+
+	return c
+}
+
+// Start consuming from the EDU server and the user API
+func (c *OutputEDUConsumer) Start() error {
+	// Tell the application services when users stop typing because their
+	// typing notification timed out.
+	c.typingCache.SetTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
+		c.sendTyping(context.TODO(), roomID)
+	})
+	if err := c.typingConsumer.Start(); err != nil {
+		return fmt.Errorf("c.typingConsumer.Start: %w", err)
+	}
+	if err := c.sendToDeviceConsumer.Start(); err != nil {
+		return fmt.Errorf("c.sendToDeviceConsumer.Start: %w", err)
+	}
+	if err := c.receiptConsumer.Start(); err != nil {
+		return fmt.Errorf("c.receiptConsumer.Start: %w", err)
+	}
+	if err := c.presenceConsumer.Start(); err != nil {
+		return fmt.Errorf("c.presenceConsumer.Start: %w", err)
+	}
+	return nil
+}
+
+func (c *OutputEDUConsumer) onTypingEvent(msg *sarama.ConsumerMessage) error {
+	var output eduAPI.OutputTypingEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		log.WithError(err).Errorf("eduserver output log: message parse failed (expected typing)")
+		return nil
+	}
+
+	if output.Event.Typing {
+		c.typingCache.AddTypingUser(output.Event.UserID, output.Event.RoomID, output.ExpireTime)
+	} else {
+		c.typingCache.RemoveUser(output.Event.UserID, output.Event.RoomID)
+	}
+	c.sendTyping(context.TODO(), output.Event.RoomID)
+	return nil
+}
+
+// sendTyping queues an m.typing event with the users which are currently
+// typing in the room.
+func (c *OutputEDUConsumer) sendTyping(ctx context.Context, roomID string) {
+	userIDs := c.typingCache.GetTypingUsers(roomID)
+	if userIDs == nil {
+		userIDs = []string{}
+	}
+	content, err := json.Marshal(map[string]interface{}{
+		"user_ids": userIDs,
+	})
+	if err != nil {
+		log.WithError(err).Error("failed to marshal typing content")
+		return
+	}
+	c.notifyInterestedInRoom(ctx, roomID, types.EphemeralEvent{
+		Type:    gomatrixserverlib.MTyping,
+		RoomID:  roomID,
+		Content: content,
+	})
+}
+
+func (c *OutputEDUConsumer) onReceiptEvent(msg *sarama.ConsumerMessage) error {
+	var output eduAPI.OutputReceiptEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		log.WithError(err).Errorf("eduserver output log: message parse failed (expected receipt)")
+		return nil
+	}
+	if output.Type != "m.read" {
+		// Private read receipts are only sent to the user who set them.
+		return nil
+	}
+
+	content, err := json.Marshal(map[string]map[string]eduAPI.ReceiptMRead{
+		output.EventID: {
+			output.Type: {
+				User: map[string]eduAPI.ReceiptTS{
+					output.UserID: {TS: output.Timestamp},
+				},
+			},
+		},
+	})
+	if err != nil {
+		log.WithError(err).Error("failed to marshal receipt content")
+		return nil
+	}
+	c.notifyInterestedInRoom(context.TODO(), output.RoomID, types.EphemeralEvent{
+		Type:    gomatrixserverlib.MReceipt,
+		RoomID:  output.RoomID,
+		Content: content,
+	})
+	return nil
+}
+
+func (c *OutputEDUConsumer) onSendToDeviceEvent(msg *sarama.ConsumerMessage) error {
+	var output eduAPI.OutputSendToDeviceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		log.WithError(err).Errorf("eduserver output log: message parse failed (expected send-to-device)")
+		return nil
+	}
+
+	event := types.EphemeralEvent{
+		Type:       output.Type,
+		Sender:     output.Sender,
+		ToUserID:   output.UserID,
+		ToDeviceID: output.DeviceID,
+		Content:    output.Content,
+	}
+	for _, ws := range c.workerStates {
+		if ws.AppService.IsInterestedInUserID(output.UserID) {
+			ws.NotifyNewEphemeralEvents(event)
+		}
+	}
+	return nil
+}
+
+func (c *OutputEDUConsumer) onPresenceEvent(msg *sarama.ConsumerMessage) error {
+	var output userAPI.Presence
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		log.WithError(err).Errorf("user API presence output log: message parse failed")
+		return nil
+	}
+
+	content, err := json.Marshal(struct {
+		Presence      string  `json:"presence"`
+		StatusMsg     *string `json:"status_msg,omitempty"`
+		LastActiveAgo int64   `json:"last_active_ago"`
+	}{output.Presence, output.StatusMsg, time.Since(output.LastActiveTS.Time()).Milliseconds()})
+	if err != nil {
+		log.WithError(err).Error("failed to marshal presence content")
+		return nil
+	}
+	event := types.EphemeralEvent{
+		Type:    "m.presence",
+		Sender:  output.UserID,
+		Content: content,
+	}
+	for _, ws := range c.workerStates {
+		if ws.AppService.IsInterestedInUserID(output.UserID) {
+			ws.NotifyNewEphemeralEvents(event)
+		}
+	}
+	return nil
+}
+
+// notifyInterestedInRoom queues the ephemeral event for all of the
+// application services which are interested in the room.
+func (c *OutputEDUConsumer) notifyInterestedInRoom(ctx context.Context, roomID string, event types.EphemeralEvent) {
+	for _, ws := range c.workerStates {
+		if appserviceIsInterestedInRoom(ctx, c.rsAPI, roomID, ws.AppService) {
+			ws.NotifyNewEphemeralEvents(event)
+		}
+	}
+}
@@ -36,7 +36,7 @@ type OutputRoomEventConsumer struct {
 	asDB               storage.Database
 	rsAPI              api.RoomserverInternalAPI
 	serverName         string
-	workerStates       []types.ApplicationServiceWorkerState
+	workerStates       []*types.ApplicationServiceWorkerState
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call
@@ -47,7 +47,7 @@ func NewOutputRoomEventConsumer(
 	kafkaConsumer sarama.Consumer,
 	appserviceDB storage.Database,
 	rsAPI api.RoomserverInternalAPI,
-	workerStates []types.ApplicationServiceWorkerState,
+	workerStates []*types.ApplicationServiceWorkerState,
 ) *OutputRoomEventConsumer {
 	consumer := internal.ContinualConsumer{
 		Process:        process,
@@ -124,22 +124,22 @@ func (s *OutputRoomEventConsumer) filterRoomserverEvents(
 	return nil
 }
 
-// appserviceJoinedAtEvent returns a boolean depending on whether a given
-// appservice has membership at the time a given event was created.
-func (s *OutputRoomEventConsumer) appserviceJoinedAtEvent(ctx context.Context, event *gomatrixserverlib.HeaderedEvent, appservice config.ApplicationService) bool {
+// appserviceJoinedToRoom returns a boolean depending on whether a given
+// appservice has any users joined to the given room.
+func appserviceJoinedToRoom(ctx context.Context, rsAPI api.RoomserverInternalAPI, roomID string, appservice config.ApplicationService) bool {
 	// TODO: This is only checking the current room state, not the state at
 	// the event in question. Pretty sure this is what Synapse does too, but
 	// until we have a lighter way of checking the state before the event that
 	// doesn't involve state res, then this is probably OK.
 	membershipReq := &api.QueryMembershipsForRoomRequest{
-		RoomID:     event.RoomID(),
+		RoomID:     roomID,
 		JoinedOnly: true,
 	}
 	membershipRes := &api.QueryMembershipsForRoomResponse{}
 
 	// XXX: This could potentially race if the state for the event is not known yet
 	// e.g. the event came over federation but we do not have the full state persisted.
-	if err := s.rsAPI.QueryMembershipsForRoom(ctx, membershipReq, membershipRes); err == nil {
+	if err := rsAPI.QueryMembershipsForRoom(ctx, membershipReq, membershipRes); err == nil {
 		for _, ev := range membershipRes.JoinEvents {
 			var membership gomatrixserverlib.MemberContent
 			if err = json.Unmarshal(ev.Content, &membership); err != nil || ev.StateKey == nil {
@@ -151,7 +151,7 @@ func (s *OutputRoomEventConsumer) appserviceJoinedAtEvent(ctx context.Context, e
 		}
 	} else {
 		log.WithFields(log.Fields{
-			"room_id": event.RoomID(),
+			"room_id": roomID,
 		}).WithError(err).Errorf("Unable to get membership for room")
 	}
 	return false
@@ -168,9 +168,8 @@ func (s *OutputRoomEventConsumer) appserviceIsInterestedInEvent(ctx context.Cont
 		return false
 	}
 
-	// Check Room ID and Sender of the event
-	if appservice.IsInterestedInUserID(event.Sender()) ||
-		appservice.IsInterestedInRoomID(event.RoomID()) {
+	// Check the sender of the event
+	if appservice.IsInterestedInUserID(event.Sender()) {
 		return true
 	}
 
@@ -180,10 +179,21 @@ func (s *OutputRoomEventConsumer) appserviceIsInterestedInEvent(ctx context.Cont
 		}
 	}
 
-	// Check all known room aliases of the room the event came from
-	queryReq := api.GetAliasesForRoomIDRequest{RoomID: event.RoomID()}
+	return appserviceIsInterestedInRoom(ctx, s.rsAPI, event.RoomID(), appservice)
+}
+
+// appserviceIsInterestedInRoom returns a boolean depending on whether a given
+// room falls within one of a given application service's namespaces, either by
+// its room ID, one of its aliases or one of its members.
+func appserviceIsInterestedInRoom(ctx context.Context, rsAPI api.RoomserverInternalAPI, roomID string, appservice config.ApplicationService) bool {
+	if appservice.IsInterestedInRoomID(roomID) {
+		return true
+	}
+
+	// Check all known room aliases of the room
+	queryReq := api.GetAliasesForRoomIDRequest{RoomID: roomID}
 	var queryRes api.GetAliasesForRoomIDResponse
-	if err := s.rsAPI.GetAliasesForRoomID(ctx, &queryReq, &queryRes); err == nil {
+	if err := rsAPI.GetAliasesForRoomID(ctx, &queryReq, &queryRes); err == nil {
 		for _, alias := range queryRes.Aliases {
 			if appservice.IsInterestedInRoomAlias(alias) {
 				return true
@@ -191,10 +201,10 @@ func (s *OutputRoomEventConsumer) appserviceIsInterestedInEvent(ctx context.Cont
 		}
 	} else {
 		log.WithFields(log.Fields{
-			"room_id": event.RoomID(),
+			"room_id": roomID,
 		}).WithError(err).Errorf("Unable to get aliases for room")
 	}
 
 	// Check if any of the members in the room match the appservice
-	return s.appserviceJoinedAtEvent(ctx, event, appservice)
+	return appserviceJoinedToRoom(ctx, rsAPI, roomID, appservice)
 }
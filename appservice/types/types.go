@@ -13,6 +13,7 @@
 package types
 
 import (
+	"encoding/json"
 	"sync"
 
 	"github.com/matrix-org/dendrite/setup/config"
@@ -34,6 +35,19 @@ type ApplicationServiceWorkerState struct {
 	EventsReady bool
 	// Backoff exponent (2^x secs). Max 6, aka 64s.
 	Backoff int
+	// Ephemeral events ready to be sent, protected by Cond.L
+	ephemeralEvents []EphemeralEvent
+}
+
+// EphemeralEvent is an ephemeral event as sent to application services in
+// the "ephemeral" field of a transaction, as per MSC2409.
+type EphemeralEvent struct {
+	Type       string          `json:"type"`
+	RoomID     string          `json:"room_id,omitempty"`
+	Sender     string          `json:"sender,omitempty"`
+	ToUserID   string          `json:"to_user_id,omitempty"`
+	ToDeviceID string          `json:"to_device_id,omitempty"`
+	Content    json.RawMessage `json:"content"`
 }
 
 // NotifyNewEvents wakes up all waiting goroutines, notifying that events remain
@@ -45,11 +59,35 @@ func (a *ApplicationServiceWorkerState) NotifyNewEvents() {
 	a.Cond.L.Unlock()
 }
 
+// NotifyNewEphemeralEvents queues ephemeral events to be sent to the
+// application service and wakes up all waiting goroutines.
+func (a *ApplicationServiceWorkerState) NotifyNewEphemeralEvents(events ...EphemeralEvent) {
+	a.Cond.L.Lock()
+	a.ephemeralEvents = append(a.ephemeralEvents, events...)
+	a.EventsReady = true
+	a.Cond.Broadcast()
+	a.Cond.L.Unlock()
+}
+
+// TakeEphemeralEvents removes up to limit queued ephemeral events from the
+// queue and returns them.
+func (a *ApplicationServiceWorkerState) TakeEphemeralEvents(limit int) []EphemeralEvent {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	if limit > len(a.ephemeralEvents) {
+		limit = len(a.ephemeralEvents)
+	}
+	events := a.ephemeralEvents[:limit:limit]
+	a.ephemeralEvents = a.ephemeralEvents[limit:]
+	return events
+}
+
 // FinishEventProcessing marks all events of this worker as being sent to the
-// application service.
+// application service. Ephemeral events which were queued in the meantime
+// will still be sent.
 func (a *ApplicationServiceWorkerState) FinishEventProcessing() {
 	a.Cond.L.Lock()
-	a.EventsReady = false
+	a.EventsReady = len(a.ephemeralEvents) > 0
 	a.Cond.L.Unlock()
 }
 
@@ -44,7 +44,7 @@ var (
 func SetupTransactionWorkers(
 	client *http.Client,
 	appserviceDB storage.Database,
-	workerStates []types.ApplicationServiceWorkerState,
+	workerStates []*types.ApplicationServiceWorkerState,
 ) error {
 	// Create a worker that handles transmitting events to a single homeserver
 	for _, workerState := range workerStates {
@@ -58,7 +58,7 @@ func SetupTransactionWorkers(
 
 // worker is a goroutine that sends any queued events to the application service
 // it is given.
-func worker(client *http.Client, db storage.Database, ws types.ApplicationServiceWorkerState) {
+func worker(client *http.Client, db storage.Database, ws *types.ApplicationServiceWorkerState) {
 	log.WithFields(log.Fields{
 		"appservice": ws.AppService.ID,
 	}).Info("Starting application service")
@@ -76,19 +76,34 @@ func worker(client *http.Client, db storage.Database, ws types.ApplicationServic
 		ws.NotifyNewEvents()
 	}
 
+	// The transaction currently being sent. This is kept until it has been
+	// sent successfully, so that retries are sent with the same transaction ID
+	// and contents and the application service can deduplicate them.
+	var transactionJSON []byte
+	var txnID, maxEventID int
+	var eventsRemaining bool
+
 	// Loop forever and keep waiting for more events to send
 	for {
 		// Wait for more events if we've sent all the events in the database
 		ws.WaitForNewEvents()
 
-		// Batch events up into a transaction
-		transactionJSON, txnID, maxEventID, eventsRemaining, err := createTransaction(ctx, db, ws.AppService.ID)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"appservice": ws.AppService.ID,
-			}).WithError(err).Fatal("appservice worker unable to create transaction")
+		if transactionJSON == nil {
+			// Batch events up into a transaction
+			ephemeral := ws.TakeEphemeralEvents(transactionBatchSize)
+			transactionJSON, txnID, maxEventID, eventsRemaining, err = createTransaction(ctx, db, ws.AppService.ID, ephemeral)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"appservice": ws.AppService.ID,
+				}).WithError(err).Fatal("appservice worker unable to create transaction")
 
-			return
+				return
+			}
+			if transactionJSON == nil {
+				// There was nothing to send
+				ws.FinishEventProcessing()
+				continue
+			}
 		}
 
 		// Send the events off to the application service
@@ -99,9 +114,10 @@ func worker(client *http.Client, db storage.Database, ws types.ApplicationServic
 				"appservice": ws.AppService.ID,
 			}).WithError(err).Error("unable to send event")
 			// Backoff
-			backoff(&ws, err)
+			backoff(ws, err)
 			continue
 		}
+		transactionJSON = nil
 
 		// We sent successfully, hooray!
 		ws.Backoff = 0
@@ -143,12 +159,23 @@ func backoff(ws *types.ApplicationServiceWorkerState, err error) {
 	time.Sleep(backoffSeconds)
 }
 
+// applicationServiceTransaction is the body of a transaction sent to an
+// application service. It is the same as
+// gomatrixserverlib.ApplicationServiceTransaction but also includes ephemeral
+// events, as per MSC2409.
+type applicationServiceTransaction struct {
+	Events    []gomatrixserverlib.ClientEvent `json:"events"`
+	Ephemeral []types.EphemeralEvent          `json:"ephemeral,omitempty"`
+}
+
 // createTransaction takes in a slice of AS events, stores them in an AS
-// transaction, and JSON-encodes the results.
+// transaction along with the given ephemeral events, and JSON-encodes the
+// results. Returns a nil transactionJSON if there is nothing to send.
 func createTransaction(
 	ctx context.Context,
 	db storage.Database,
 	appserviceID string,
+	ephemeral []types.EphemeralEvent,
 ) (
 	transactionJSON []byte,
 	txnID, maxID int,
@@ -164,6 +191,9 @@ func createTransaction(
 
 		return
 	}
+	if len(events) == 0 && len(ephemeral) == 0 {
+		return
+	}
 
 	// Check if these events do not already have a transaction ID
 	if txnID == -1 {
@@ -185,8 +215,12 @@ func createTransaction(
 	}
 
 	// Create a transaction and store the events inside
-	transaction := gomatrixserverlib.ApplicationServiceTransaction{
-		Events: gomatrixserverlib.HeaderedToClientEvents(ev, gomatrixserverlib.FormatAll),
+	transaction := applicationServiceTransaction{
+		Events:    gomatrixserverlib.HeaderedToClientEvents(ev, gomatrixserverlib.FormatAll),
+		Ephemeral: ephemeral,
+	}
+	if transaction.Events == nil {
+		transaction.Events = []gomatrixserverlib.ClientEvent{}
 	}
 
 	transactionJSON, err = json.Marshal(transaction)
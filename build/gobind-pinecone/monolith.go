@@ -313,6 +313,7 @@ func (m *DendriteMonolith) Start() {
 		Client:    conn.CreateClient(base, m.PineconeQUIC),
 		FedClient: federation,
 		KeyRing:   keyRing,
+		Caches:    base.Caches,
 
 		AppserviceAPI:          asAPI,
 		EDUInternalAPI:         eduInputAPI,
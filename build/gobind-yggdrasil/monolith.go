@@ -154,6 +154,7 @@ func (m *DendriteMonolith) Start() {
 		Client:    ygg.CreateClient(base),
 		FedClient: federation,
 		KeyRing:   keyRing,
+		Caches:    base.Caches,
 
 		AppserviceAPI:       asAPI,
 		EDUInternalAPI:      eduInputAPI,
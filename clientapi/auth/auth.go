@@ -64,6 +64,8 @@ func VerifyUserFromRequest(
 	err = userAPI.QueryAccessToken(req.Context(), &api.QueryAccessTokenRequest{
 		AccessToken:      token,
 		AppServiceUserID: req.URL.Query().Get("user_id"),
+		RemoteAddr:       req.RemoteAddr,
+		UserAgent:        req.UserAgent(),
 	}, &res)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccessToken failed")
@@ -78,6 +80,18 @@ func VerifyUserFromRequest(
 			}
 		}
 	}
+	if res.Expired {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.ExpiredToken("Access token has expired"),
+		}
+	}
+	if res.Revoked {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.RevokedToken("Access token has been revoked"),
+		}
+	}
 	if res.Device == nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusUnauthorized,
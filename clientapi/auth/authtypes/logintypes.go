@@ -6,8 +6,14 @@ type LoginType string
 // The relevant login types implemented in Dendrite
 const (
 	LoginTypePassword           = "m.login.password"
+	LoginTypeToken              = "m.login.token"
+	LoginTypeSSO                = "m.login.sso"
+	LoginTypeCAS                = "m.login.cas"
 	LoginTypeDummy              = "m.login.dummy"
 	LoginTypeSharedSecret       = "org.matrix.login.shared_secret"
 	LoginTypeRecaptcha          = "m.login.recaptcha"
+	LoginTypeEmail              = "m.login.email.identity"
+	LoginTypeTerms              = "m.login.terms"
+	LoginTypeRegistrationToken  = "m.login.registration_token"
 	LoginTypeApplicationService = "m.login.application_service"
 )
@@ -0,0 +1,165 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// CASProvider validates service tickets issued by a Central Authentication
+// Service server. See https://apereo.github.io/cas/6.3.x/protocol/CAS-Protocol-Specification.html
+type CASProvider struct {
+	cfg    *config.CAS
+	client *http.Client
+}
+
+// CASUser is a user who has logged in with CAS.
+type CASUser struct {
+	Username string
+	// The attributes which the CAS server released for the user. An
+	// attribute can have several values.
+	Attributes map[string][]string
+}
+
+type casServiceResponse struct {
+	Success *struct {
+		User       string `xml:"user"`
+		Attributes struct {
+			Values []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"attributes"`
+	} `xml:"authenticationSuccess"`
+	Failure *struct {
+		Code    string `xml:"code,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"authenticationFailure"`
+}
+
+// NewCASProvider creates a new CASProvider.
+func NewCASProvider(cfg *config.CAS, client *http.Client) *CASProvider {
+	return &CASProvider{
+		cfg:    cfg,
+		client: client,
+	}
+}
+
+// LoginURL returns the URL of the CAS server that the user should be sent
+// to in order to log in. The CAS server sends the user back to the service
+// URL with a service ticket.
+func (p *CASProvider) LoginURL(service string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(p.cfg.ServerURL, "/") + "/login")
+	if err != nil {
+		return "", fmt.Errorf("url.Parse: %w", err)
+	}
+	q := u.Query()
+	q.Set("service", service)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// ValidateTicket asks the CAS server whether the service ticket was issued
+// for the service URL, and returns the user who it was issued to.
+func (p *CASProvider) ValidateTicket(ctx context.Context, service, ticket string) (*CASUser, error) {
+	u, err := url.Parse(strings.TrimSuffix(p.cfg.ServerURL, "/") + "/serviceValidate")
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+	q := u.Query()
+	q.Set("service", service)
+	q.Set("ticket", ticket)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("ticket validation failed: %w", err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("ticket validation failed: %w", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ticket validation failed: %s returned HTTP %d", u.Redacted(), res.StatusCode)
+	}
+	return parseCASServiceResponse(body)
+}
+
+func parseCASServiceResponse(body []byte) (*CASUser, error) {
+	var res casServiceResponse
+	if err := xml.Unmarshal(body, &res); err != nil {
+		return nil, fmt.Errorf("CAS service response is malformed: %w", err)
+	}
+	if res.Failure != nil {
+		return nil, fmt.Errorf("CAS server rejected the ticket: %s %s", res.Failure.Code, strings.TrimSpace(res.Failure.Message))
+	}
+	if res.Success == nil || strings.TrimSpace(res.Success.User) == "" {
+		return nil, fmt.Errorf("CAS service response did not contain a user")
+	}
+	user := &CASUser{
+		Username:   strings.TrimSpace(res.Success.User),
+		Attributes: make(map[string][]string),
+	}
+	for _, v := range res.Success.Attributes.Values {
+		user.Attributes[v.XMLName.Local] = append(user.Attributes[v.XMLName.Local], strings.TrimSpace(v.Value))
+	}
+	return user, nil
+}
+
+// HasRequiredAttributes returns true if the user has all of the attributes
+// which are required in order to log in.
+func (p *CASProvider) HasRequiredAttributes(user *CASUser) bool {
+	for name, required := range p.cfg.RequiredAttributes {
+		values, ok := user.Attributes[name]
+		if !ok {
+			return false
+		}
+		if required == "" {
+			continue
+		}
+		found := false
+		for _, v := range values {
+			if v == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Attribute returns the first value of the user's attribute, or an empty
+// string if the user doesn't have it.
+func (u *CASUser) Attribute(name string) string {
+	if values := u.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestValidateCASTicket(t *testing.T) {
+	const service = "https://example.com/_matrix/client/r0/login/cas/ticket?session=abc"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/cas/serviceValidate" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		q := req.URL.Query()
+		if q.Get("service") != service || q.Get("ticket") != "ST-1" {
+			_, _ = w.Write([]byte(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+    <cas:authenticationFailure code="INVALID_TICKET">Ticket not recognized</cas:authenticationFailure>
+</cas:serviceResponse>`))
+			return
+		}
+		_, _ = w.Write([]byte(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+    <cas:authenticationSuccess>
+        <cas:user>alice</cas:user>
+        <cas:attributes>
+            <cas:displayName>Alice Smith</cas:displayName>
+            <cas:memberOf>students</cas:memberOf>
+            <cas:memberOf>staff</cas:memberOf>
+        </cas:attributes>
+    </cas:authenticationSuccess>
+</cas:serviceResponse>`))
+	}))
+	defer srv.Close()
+
+	cfg := &config.CAS{ServerURL: srv.URL + "/cas/"}
+	p := NewCASProvider(cfg, srv.Client())
+	if _, err := p.ValidateTicket(context.Background(), service, "ST-2"); err == nil {
+		t.Errorf("validated an unknown ticket")
+	}
+	user, err := p.ValidateTicket(context.Background(), service, "ST-1")
+	if err != nil {
+		t.Fatalf("ValidateTicket failed: %s", err)
+	}
+	if user.Username != "alice" || user.Attribute("displayName") != "Alice Smith" || len(user.Attributes["memberOf"]) != 2 {
+		t.Errorf("got user %+v", user)
+	}
+
+	for _, tc := range []struct {
+		required map[string]string
+		want     bool
+	}{
+		{required: nil, want: true},
+		{required: map[string]string{"memberOf": "staff"}, want: true},
+		{required: map[string]string{"memberOf": ""}, want: true},
+		{required: map[string]string{"memberOf": "admins"}, want: false},
+		{required: map[string]string{"memberOf": "staff", "email": ""}, want: false},
+	} {
+		cfg.RequiredAttributes = tc.required
+		if got := p.HasRequiredAttributes(user); got != tc.want {
+			t.Errorf("required attributes %v: got %v, want %v", tc.required, got, tc.want)
+		}
+	}
+}
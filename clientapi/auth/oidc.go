@@ -0,0 +1,386 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256" // registers crypto.SHA256
+	_ "crypto/sha512" // registers crypto.SHA384 and crypto.SHA512
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// idTokenClockSkew is how far the clocks of the provider and this server
+// may disagree when checking the lifetime of an ID token.
+const idTokenClockSkew = time.Minute
+
+// OIDCProvider performs the authorization code flow against an OpenID
+// Connect provider. See https://openid.net/specs/openid-connect-core-1_0.html
+type OIDCProvider struct {
+	cfg    *config.OIDCProvider
+	client *http.Client
+
+	sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IDToken string `json:"id_token"`
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+type idTokenHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// NewOIDCProvider creates a new OIDCProvider. The provider's configuration
+// is discovered the first time that it is needed.
+func NewOIDCProvider(cfg *config.OIDCProvider, client *http.Client) *OIDCProvider {
+	return &OIDCProvider{
+		cfg:    cfg,
+		client: client,
+		keys:   make(map[string]crypto.PublicKey),
+	}
+}
+
+// AuthorizationURL returns the URL of the provider that the user should be
+// sent to in order to log in.
+func (p *OIDCProvider) AuthorizationURL(ctx context.Context, callbackURL, state, nonce string) (string, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("url.Parse: %w", err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", callbackURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// Exchange swaps the authorization code that the provider returned to the
+// callback for an ID token, and returns the claims of the ID token once it
+// has been verified.
+func (p *OIDCProvider) Exchange(ctx context.Context, callbackURL, code, nonce string) (map[string]interface{}, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", callbackURL)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	var tokenRes oidcTokenResponse
+	if err = p.doJSON(req, &tokenRes); err != nil {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	if tokenRes.IDToken == "" {
+		return nil, fmt.Errorf("token response did not contain an ID token")
+	}
+	return p.verifyIDToken(ctx, tokenRes.IDToken, nonce, time.Now())
+}
+
+// verifyIDToken checks the signature of the ID token against the keys of
+// the provider, and that the token was issued by the provider to us for
+// this login attempt. It returns the claims of the token.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, rawIDToken, nonce string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("ID token is malformed")
+	}
+	var header idTokenHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("ID token header is malformed: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("ID token signature is malformed: %w", err)
+	}
+	key, err := p.publicKey(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	if err = verifyJWTSignature(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err = decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("ID token claims are malformed: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != p.cfg.Issuer {
+		return nil, fmt.Errorf("ID token was issued by %q, not %q", iss, p.cfg.Issuer)
+	}
+	if !idTokenHasAudience(claims["aud"], p.cfg.ClientID) {
+		return nil, fmt.Errorf("ID token was not issued to this client")
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("ID token has no expiry")
+	}
+	if now.Add(-idTokenClockSkew).After(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("ID token has expired")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match")
+	}
+	return claims, nil
+}
+
+func idTokenHasAudience(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported ID token signing algorithm %q", alg)
+	}
+	h := hash.New()
+	_, _ = h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' {
+			return fmt.Errorf("ID token signing algorithm %q does not match the key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, digest, signature); err != nil {
+			return fmt.Errorf("ID token signature is invalid: %w", err)
+		}
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(signature) != 2*size {
+			return fmt.Errorf("ID token signing algorithm %q does not match the key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return fmt.Errorf("ID token signature is invalid")
+		}
+	default:
+		return fmt.Errorf("unsupported ID token signing key")
+	}
+	return nil
+}
+
+// discover fetches the configuration of the provider, or returns it from
+// the cache if it has already been fetched.
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	discoveryURL := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	var discovery oidcDiscovery
+	if err = p.doJSON(req, &discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+	if discovery.Issuer != p.cfg.Issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, not %q", discovery.Issuer, p.cfg.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC discovery did not return the required endpoints")
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// publicKey returns the signing key of the provider with the given key ID.
+// The keys are fetched again if the key ID is not known, in case the
+// provider has rotated its keys.
+func (p *OIDCProvider) publicKey(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	discovery, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.Lock()
+	defer p.Unlock()
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = p.doJSON(req, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC signing keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	p.keys = keys
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown ID token signing key %q", keyID)
+	}
+	return key, nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA exponent is too large")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exponent.Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("EC point is not on the curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+	}
+}
+
+func (p *OIDCProvider) doJSON(req *http.Request, v interface{}) error {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d", req.URL.Redacted(), res.StatusCode)
+	}
+	return json.Unmarshal(body, v)
+}
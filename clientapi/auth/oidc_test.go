@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestVerifyIDToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey failed: %s", err)
+	}
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(oidcDiscovery{
+				Issuer:                srv.URL,
+				AuthorizationEndpoint: srv.URL + "/authorize",
+				TokenEndpoint:         srv.URL + "/token",
+				JWKSURI:               srv.URL + "/jwks",
+			})
+		case "/jwks":
+			_ = json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {{
+				KeyType: "RSA",
+				KeyID:   "key1",
+				N:       base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:       base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	p := NewOIDCProvider(&config.OIDCProvider{Issuer: srv.URL, ClientID: "dendrite"}, srv.Client())
+	now := time.Now()
+	sign := func(kid string, claims map[string]interface{}) string {
+		header, _ := json.Marshal(idTokenHeader{Algorithm: "RS256", KeyID: kid})
+		payload, _ := json.Marshal(claims)
+		signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("rsa.SignPKCS1v15 failed: %s", err)
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": srv.URL, "aud": "dendrite", "exp": now.Add(time.Minute).Unix(),
+			"nonce": "nonce", "preferred_username": "alice",
+		}
+		for k, v := range overrides {
+			c[k] = v
+		}
+		return c
+	}
+
+	valid := sign("key1", claims(nil))
+	other := sign("key1", claims(map[string]interface{}{"preferred_username": "bob"}))
+	validParts, otherParts := strings.Split(valid, "."), strings.Split(other, ".")
+	got, err := p.verifyIDToken(context.Background(), valid, "nonce", now)
+	if err != nil {
+		t.Fatalf("valid ID token was rejected: %s", err)
+	}
+	if got["preferred_username"] != "alice" {
+		t.Errorf("got preferred_username %v, want alice", got["preferred_username"])
+	}
+
+	for name, token := range map[string]string{
+		"wrong issuer":    sign("key1", claims(map[string]interface{}{"iss": "https://evil.com"})),
+		"wrong audience":  sign("key1", claims(map[string]interface{}{"aud": []string{"someone-else"}})),
+		"expired":         sign("key1", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+		"wrong nonce":     sign("key1", claims(map[string]interface{}{"nonce": "other"})),
+		"unknown key":     sign("key2", claims(nil)),
+		"tampered claims": validParts[0] + "." + otherParts[1] + "." + validParts[2],
+		"unsigned":        base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{}`)) + ".",
+	} {
+		if _, err := p.verifyIDToken(context.Background(), token, "nonce", now); err == nil {
+			t.Errorf("%s: ID token was accepted, want rejected", name)
+		}
+	}
+}
@@ -71,6 +71,10 @@ type Login struct {
 	// Thus a pointer is needed to differentiate between the two
 	InitialDisplayName *string `json:"initial_device_display_name"`
 	DeviceID           *string `json:"device_id"`
+
+	// Whether the client supports refresh tokens, in which case the access
+	// token expires and a refresh token is issued along with it.
+	RefreshToken bool `json:"refresh_token"`
 }
 
 // Username returns the user localpart/user_id in this request, if it exists.
@@ -58,6 +58,12 @@ func BadJSON(msg string) *MatrixError {
 	return &MatrixError{"M_BAD_JSON", msg}
 }
 
+// TooLarge is an error when the client sends an event or request which is
+// bigger than the server allows.
+func TooLarge(msg string) *MatrixError {
+	return &MatrixError{"M_TOO_LARGE", msg}
+}
+
 // NotJSON is an error when the client supplies something that is not JSON
 // to a JSON endpoint.
 func NotJSON(msg string) *MatrixError {
@@ -81,6 +87,21 @@ func InvalidArgumentValue(msg string) *MatrixError {
 	return &MatrixError{"M_INVALID_ARGUMENT_VALUE", msg}
 }
 
+// MissingParam is an error when a required parameter is missing from the request.
+func MissingParam(msg string) *MatrixError {
+	return &MatrixError{"M_MISSING_PARAM", msg}
+}
+
+// InvalidParam is an error when a parameter in the request has an invalid value.
+func InvalidParam(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_PARAM", msg}
+}
+
+// InvalidSignature is an error when a signature in the request is missing or doesn't verify.
+func InvalidSignature(msg string) *MatrixError {
+	return &MatrixError{"M_INVALID_SIGNATURE", msg}
+}
+
 // MissingToken is an error when the client tries to access a resource which
 // requires authentication without supplying credentials.
 func MissingToken(msg string) *MatrixError {
@@ -125,6 +146,18 @@ func GuestAccessForbidden(msg string) *MatrixError {
 	return &MatrixError{"M_GUEST_ACCESS_FORBIDDEN", msg}
 }
 
+// NotYetUploaded is an error when the client tries to download media whose
+// content hasn't been uploaded yet.
+func NotYetUploaded(msg string) *MatrixError {
+	return &MatrixError{"M_NOT_YET_UPLOADED", msg}
+}
+
+// CannotOverwriteMedia is an error when the client tries to upload the content
+// of media which has already been uploaded.
+func CannotOverwriteMedia(msg string) *MatrixError {
+	return &MatrixError{"M_CANNOT_OVERWRITE_MEDIA", msg}
+}
+
 type IncompatibleRoomVersionError struct {
 	RoomVersion string `json:"room_version"`
 	Error       string `json:"error"`
@@ -141,6 +174,12 @@ func IncompatibleRoomVersion(roomVersion gomatrixserverlib.RoomVersion) *Incompa
 	}
 }
 
+// BadAlias is an error when the client tries to set a room alias which
+// doesn't point at the room.
+func BadAlias(msg string) *MatrixError {
+	return &MatrixError{"M_BAD_ALIAS", msg}
+}
+
 // UnsupportedRoomVersion is an error which is returned when the client
 // requests a room with a version that is unsupported.
 func UnsupportedRoomVersion(msg string) *MatrixError {
@@ -161,6 +200,46 @@ func LimitExceeded(msg string, retryAfterMS int64) *LimitExceededError {
 	}
 }
 
+// SoftLogoutError is an unknown token error which tells the client that it
+// can log in again without losing its data, e.g. using its refresh token.
+type SoftLogoutError struct {
+	MatrixError
+	SoftLogout bool `json:"soft_logout"`
+}
+
+// ExpiredToken is an error when the client's access token has expired.
+func ExpiredToken(msg string) *SoftLogoutError {
+	return &SoftLogoutError{
+		MatrixError: MatrixError{"M_UNKNOWN_TOKEN", msg},
+		SoftLogout:  true,
+	}
+}
+
+// RevokedToken is an error when the client's access token has been revoked,
+// but the user can log in again.
+func RevokedToken(msg string) *SoftLogoutError {
+	return &SoftLogoutError{
+		MatrixError: MatrixError{"M_UNKNOWN_TOKEN", msg},
+		SoftLogout:  true,
+	}
+}
+
+// WrongBackupVersionError is an error when the client tries to upload keys to a
+// key backup version which isn't the current one.
+type WrongBackupVersionError struct {
+	MatrixError
+	CurrentVersion string `json:"current_version"`
+}
+
+// WrongBackupVersion is an error when the client tries to upload keys to a key
+// backup version which isn't the current one.
+func WrongBackupVersion(currentVersion string) *WrongBackupVersionError {
+	return &WrongBackupVersionError{
+		MatrixError:    MatrixError{"M_WRONG_ROOM_KEYS_VERSION", "Wrong backup version."},
+		CurrentVersion: currentVersion,
+	}
+}
+
 // NotTrusted is an error which is returned when the client asks the server to
 // proxy a request (e.g. 3PID association) to a server that isn't trusted
 func NotTrusted(serverName string) *MatrixError {
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -26,6 +27,7 @@ import (
 	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/util"
 )
@@ -101,6 +103,13 @@ func SaveAccountData(
 		}
 	}
 
+	if dataType == "m.push_rules" {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Unable to set push rules, use /pushrules instead"),
+		}
+	}
+
 	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("ioutil.ReadAll failed")
@@ -114,6 +123,26 @@ func SaveAccountData(
 		}
 	}
 
+	if dataType == "m.ignored_user_list" && roomID == "" {
+		var ignored struct {
+			IgnoredUsers map[string]json.RawMessage `json:"ignored_users"`
+		}
+		if err = json.Unmarshal(body, &ignored); err != nil || ignored.IgnoredUsers == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("ignored_users must be an object"),
+			}
+		}
+		for ignoredUserID := range ignored.IgnoredUsers {
+			if _, _, err = gomatrixserverlib.SplitID('@', ignoredUserID); err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("Invalid user ID " + ignoredUserID),
+				}
+			}
+		}
+	}
+
 	dataReq := api.InputAccountDataRequest{
 		UserID:      userID,
 		DataType:    dataType,
@@ -139,8 +168,9 @@ func SaveAccountData(
 }
 
 type readMarkerJSON struct {
-	FullyRead string `json:"m.fully_read"`
-	Read      string `json:"m.read"`
+	FullyRead   string `json:"m.fully_read"`
+	Read        string `json:"m.read"`
+	ReadPrivate string `json:"m.read.private"`
 }
 
 type fullyReadEvent struct {
@@ -194,9 +224,19 @@ func SaveReadMarker(
 		return jsonerror.InternalServerError()
 	}
 
-	// Handle the read receipt that may be included in the read marker
-	if r.Read != "" {
-		return SetReceipt(req, eduAPI, device, roomID, "m.read", r.Read)
+	// Handle the read receipts that may be included in the read marker
+	timestamp := gomatrixserverlib.AsTimestamp(time.Now())
+	for receiptType, eventID := range map[string]string{
+		"m.read":         r.Read,
+		"m.read.private": r.ReadPrivate,
+	} {
+		if eventID == "" {
+			continue
+		}
+		if err := eduserverAPI.SendReceipt(req.Context(), eduAPI, device.UserID, roomID, eventID, receiptType, timestamp); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("eduserverAPI.SendReceipt failed")
+			return util.ErrorResponse(err)
+		}
 	}
 
 	return util.JSONResponse{
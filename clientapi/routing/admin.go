@@ -0,0 +1,249 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type adminRoomStorageResponse struct {
+	RoomID     string `json:"room_id"`
+	EventCount int64  `json:"event_count"`
+	SizeBytes  int64  `json:"size_bytes"`
+}
+
+// checkAdmin returns a 403 response if the device doesn't belong to a server
+// admin, or nil if it does.
+func checkAdmin(cfg *config.ClientAPI, device *api.Device) *util.JSONResponse {
+	if !cfg.IsAdmin(device.UserID) {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You must be a server admin to use this endpoint"),
+		}
+	}
+	return nil
+}
+
+// GetAdminRoomStorage implements GET /admin/rooms/{roomID}/storage
+func GetAdminRoomStorage(
+	req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	device *api.Device, roomID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+
+	var queryRes roomserverAPI.QueryRoomStorageUsageResponse
+	err := rsAPI.QueryRoomStorageUsage(req.Context(), &roomserverAPI.QueryRoomStorageUsageRequest{
+		RoomID: roomID,
+	}, &queryRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomStorageUsage failed")
+		return jsonerror.InternalServerError()
+	}
+	if !queryRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room not found"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminRoomStorageResponse{
+			RoomID:     roomID,
+			EventCount: queryRes.EventCount,
+			SizeBytes:  queryRes.SizeBytes,
+		},
+	}
+}
+
+type adminEvacuateRoomRequest struct {
+	Forget bool `json:"forget"`
+	Block  bool `json:"block"`
+}
+
+type adminEvacuateRoomResponse struct {
+	Affected []string `json:"affected"`
+}
+
+// AdminEvacuateRoom implements POST /admin/rooms/{roomID}/evacuate
+func AdminEvacuateRoom(
+	req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	device *api.Device, roomID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+	var r adminEvacuateRoomRequest
+	if req.ContentLength != 0 {
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+	}
+
+	var performRes roomserverAPI.PerformAdminEvacuateRoomResponse
+	err := rsAPI.PerformAdminEvacuateRoom(req.Context(), &roomserverAPI.PerformAdminEvacuateRoomRequest{
+		RoomID: roomID,
+		Forget: r.Forget,
+		Block:  r.Block,
+	}, &performRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformAdminEvacuateRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if performRes.Error != nil {
+		return performRes.Error.JSONResponse()
+	}
+	affected := performRes.Affected
+	if affected == nil {
+		affected = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminEvacuateRoomResponse{Affected: affected},
+	}
+}
+
+type adminBlockRoomRequest struct {
+	Block *bool `json:"block"`
+}
+
+type adminBlockRoomResponse struct {
+	Block bool `json:"block"`
+}
+
+// AdminBlockRoom implements POST /admin/rooms/{roomID}/block
+func AdminBlockRoom(
+	req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	device *api.Device, roomID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+	var r adminBlockRoomRequest
+	if req.ContentLength != 0 {
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+	}
+	// Block the room unless the admin explicitly asked to unblock it.
+	block := r.Block == nil || *r.Block
+
+	var performRes roomserverAPI.PerformAdminBlockRoomResponse
+	err := rsAPI.PerformAdminBlockRoom(req.Context(), &roomserverAPI.PerformAdminBlockRoomRequest{
+		RoomID: roomID,
+		Block:  block,
+	}, &performRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformAdminBlockRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if performRes.Error != nil {
+		return performRes.Error.JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminBlockRoomResponse{Block: block},
+	}
+}
+
+type adminPurgeHistoryRequest struct {
+	PurgeUpToEventID string                      `json:"purge_up_to_event_id"`
+	PurgeUpToTS      gomatrixserverlib.Timestamp `json:"purge_up_to_ts"`
+}
+
+type adminPurgeHistoryResponse struct {
+	PurgeID string `json:"purge_id"`
+}
+
+type adminPurgeHistoryStatusResponse struct {
+	Status       string `json:"status"`
+	PurgedEvents int    `json:"purged_events"`
+	Error        string `json:"error,omitempty"`
+}
+
+// AdminPurgeHistory implements POST /admin/purge_history/{roomID}
+func AdminPurgeHistory(
+	req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	device *api.Device, roomID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+	var r adminPurgeHistoryRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	var performRes roomserverAPI.PerformPurgeHistoryResponse
+	err := rsAPI.PerformPurgeHistory(req.Context(), &roomserverAPI.PerformPurgeHistoryRequest{
+		RoomID:        roomID,
+		BeforeEventID: r.PurgeUpToEventID,
+		BeforeTS:      r.PurgeUpToTS,
+	}, &performRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformPurgeHistory failed")
+		return jsonerror.InternalServerError()
+	}
+	if performRes.Error != nil {
+		return performRes.Error.JSONResponse()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminPurgeHistoryResponse{PurgeID: performRes.PurgeID},
+	}
+}
+
+// GetAdminPurgeHistoryStatus implements GET /admin/purge_history_status/{purgeID}
+func GetAdminPurgeHistoryStatus(
+	req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	device *api.Device, purgeID string,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+
+	var queryRes roomserverAPI.QueryPurgeHistoryStatusResponse
+	err := rsAPI.QueryPurgeHistoryStatus(req.Context(), &roomserverAPI.QueryPurgeHistoryStatusRequest{
+		PurgeID: purgeID,
+	}, &queryRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryPurgeHistoryStatus failed")
+		return jsonerror.InternalServerError()
+	}
+	if !queryRes.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Purge not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminPurgeHistoryStatusResponse{
+			Status:       queryRes.Status,
+			PurgedEvents: queryRes.PurgedEvents,
+			Error:        queryRes.Error,
+		},
+	}
+}
@@ -18,7 +18,9 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/util"
 )
@@ -44,16 +46,22 @@ type connectionInfo struct {
 
 // GetAdminWhois implements GET /admin/whois/{userId}
 func GetAdminWhois(
-	req *http.Request, userAPI api.UserInternalAPI, device *api.Device,
-	userID string,
+	req *http.Request, userAPI api.UserInternalAPI, cfg *config.ClientAPI,
+	device *api.Device, userID string,
 ) util.JSONResponse {
-	if userID != device.UserID {
-		// TODO: Still allow if user is admin
+	// Users can look themselves up, but only admins can look up other users.
+	if userID != device.UserID && !cfg.IsAdmin(device.UserID) {
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
 			JSON: jsonerror.Forbidden("userID does not match the current user"),
 		}
 	}
+	if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("userID must belong to this server"),
+		}
+	}
 
 	var queryRes api.QueryDevicesResponse
 	err := userAPI.QueryDevices(req.Context(), &api.QueryDevicesRequest{
@@ -63,20 +71,39 @@ func GetAdminWhois(
 		util.GetLogger(req.Context()).WithError(err).Error("GetAdminWhois failed to query user devices")
 		return jsonerror.InternalServerError()
 	}
+	var connRes api.QueryDeviceConnectionsResponse
+	err = userAPI.QueryDeviceConnections(req.Context(), &api.QueryDeviceConnectionsRequest{
+		UserID: userID,
+	}, &connRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("GetAdminWhois failed to query device connections")
+		return jsonerror.InternalServerError()
+	}
 
+	// We don't track sessions separately from devices, so each device has a
+	// single session.
 	devices := make(map[string]deviceInfo)
 	for _, device := range queryRes.Devices {
-		connInfo := connectionInfo{
-			IP:        device.LastSeenIP,
-			LastSeen:  device.LastSeenTS,
-			UserAgent: device.UserAgent,
+		var connections []connectionInfo
+		for _, conn := range connRes.Devices[device.ID] {
+			connections = append(connections, connectionInfo{
+				IP:        conn.IP,
+				LastSeen:  conn.LastSeenTS,
+				UserAgent: conn.UserAgent,
+			})
+		}
+		if len(connections) == 0 {
+			// The device hasn't made any requests since connections started
+			// being recorded, or they have all been pruned.
+			connections = append(connections, connectionInfo{
+				IP:        device.LastSeenIP,
+				LastSeen:  device.LastSeenTS,
+				UserAgent: device.UserAgent,
+			})
 		}
-		dev, ok := devices[device.ID]
-		if !ok {
-			dev.Sessions = []sessionInfo{{}}
+		devices[device.ID] = deviceInfo{
+			Sessions: []sessionInfo{{Connections: connections}},
 		}
-		dev.Sessions[0].Connections = append(dev.Sessions[0].Connections, connInfo)
-		devices[device.ID] = dev
 	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
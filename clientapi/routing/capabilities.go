@@ -19,14 +19,33 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 
 	"github.com/matrix-org/util"
 )
 
+type capabilitiesResponse struct {
+	Capabilities capabilities `json:"capabilities"`
+}
+
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-capabilities
+type capabilities struct {
+	ChangePassword  capability                                         `json:"m.change_password"`
+	RoomVersions    roomserverAPI.QueryRoomVersionCapabilitiesResponse `json:"m.room_versions"`
+	SetDisplayName  capability                                         `json:"m.set_displayname"`
+	SetAvatarURL    capability                                         `json:"m.set_avatar_url"`
+	ThreePIDChanges capability                                         `json:"m.3pid_changes"`
+}
+
+type capability struct {
+	Enabled bool `json:"enabled"`
+}
+
 // GetCapabilities returns information about the server's supported feature set
-// and other relevant capabilities to an authenticated user.
+// and other relevant capabilities to an authenticated user. The changes which
+// users may make to their accounts come from the config.
 func GetCapabilities(
-	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
+	req *http.Request, cfg *config.ClientAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
 ) util.JSONResponse {
 	roomVersionsQueryReq := roomserverAPI.QueryRoomVersionCapabilitiesRequest{}
 	roomVersionsQueryRes := roomserverAPI.QueryRoomVersionCapabilitiesResponse{}
@@ -39,17 +58,16 @@ func GetCapabilities(
 		return jsonerror.InternalServerError()
 	}
 
-	response := map[string]interface{}{
-		"capabilities": map[string]interface{}{
-			"m.change_password": map[string]bool{
-				"enabled": true,
-			},
-			"m.room_versions": roomVersionsQueryRes,
-		},
-	}
-
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: response,
+		JSON: capabilitiesResponse{
+			Capabilities: capabilities{
+				ChangePassword:  capability{cfg.UserChanges.Password},
+				RoomVersions:    roomVersionsQueryRes,
+				SetDisplayName:  capability{cfg.UserChanges.DisplayName},
+				SetAvatarURL:    capability{cfg.UserChanges.AvatarURL},
+				ThreePIDChanges: capability{cfg.UserChanges.ThreePIDs},
+			},
+		},
 	}
 }
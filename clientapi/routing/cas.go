@@ -0,0 +1,137 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+// casServiceURL returns the service URL which the CAS server sends the user
+// back to with a service ticket. It identifies the SSO session, so that the
+// ticket can only be used to complete that session.
+func casServiceURL(cfg *config.ClientAPI, state string) (string, error) {
+	u, err := url.Parse(cfg.CAS.TicketURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("session", state)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// CASRedirect implements GET /login/cas/redirect
+func CASRedirect(
+	w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI, provider *auth.CASProvider,
+) *util.JSONResponse {
+	redirectURL := req.URL.Query().Get("redirectUrl")
+	if redirectURL == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("missing redirectUrl"),
+		}
+	}
+	if !isRedirectURLAllowed(cfg.CAS.AllowedRedirectURLs, redirectURL) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("redirectUrl is not allowed"),
+		}
+	}
+	state, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	service, err := casServiceURL(cfg, state)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("casServiceURL failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	loginURL, err := provider.LoginURL(service)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.LoginURL failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	startSSOSession(w, state, cfg.CAS.TicketURL, ssoSession{
+		redirectURL: redirectURL,
+		expires:     time.Now().Add(ssoSessionLifetime),
+	})
+	http.Redirect(w, req, loginURL, http.StatusFound)
+	return nil
+}
+
+// CASTicket implements GET /login/cas/ticket, which the CAS server redirects
+// the user to once they have logged in. The service ticket is validated with
+// the CAS server, and the user is mapped to a Matrix account and sent back to
+// the client with a login token.
+func CASTicket(
+	w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI, provider *auth.CASProvider,
+	accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+) *util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+	state := query.Get("session")
+	session, resErr := takeSSOSession(w, req, state)
+	if resErr != nil {
+		return resErr
+	}
+	service, err := casServiceURL(cfg, state)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("casServiceURL failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	user, err := provider.ValidateTicket(ctx, service, query.Get("ticket"))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("Failed to validate CAS ticket")
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("failed to verify CAS login"),
+		}
+	}
+	if !provider.HasRequiredAttributes(user) {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("this CAS user is not allowed to log in"),
+		}
+	}
+	localpart := user.Username
+	if cfg.CAS.LocalpartAttribute != "" {
+		localpart = user.Attribute(cfg.CAS.LocalpartAttribute)
+	}
+
+	account, resErr := getOrCreateSSOAccount(
+		req, cfg, accountDB, userAPI, cfg.CAS.CreateAccounts, "cas:"+cfg.CAS.ServerURL, user.Username,
+		localpart, user.Attribute(cfg.CAS.DisplayNameAttribute),
+	)
+	if resErr != nil {
+		return resErr
+	}
+	return completeSSO(w, req, userAPI, account, session.redirectURL)
+}
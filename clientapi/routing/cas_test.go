@@ -0,0 +1,85 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestCASTicketLinksAccounts(t *testing.T) {
+	// The CAS username is given by the ticket, and the uid attribute, which
+	// is used as the localpart, is chosen by the CAS user.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		uids := map[string]string{"ST-mallory": "alice", "ST-bob": "bob", "ST-bob-renamed": "alice"}
+		users := map[string]string{"ST-mallory": "mallory", "ST-bob": "bob", "ST-bob-renamed": "bob"}
+		ticket := req.URL.Query().Get("ticket")
+		_, _ = w.Write([]byte(`<cas:serviceResponse xmlns:cas="http://www.yale.edu/tp/cas">
+    <cas:authenticationSuccess>
+        <cas:user>` + users[ticket] + `</cas:user>
+        <cas:attributes><cas:uid>` + uids[ticket] + `</cas:uid></cas:attributes>
+    </cas:authenticationSuccess>
+</cas:serviceResponse>`))
+	}))
+	defer srv.Close()
+
+	cfg := &config.ClientAPI{
+		Matrix:  &config.Global{ServerName: "localhost"},
+		Derived: &config.Derived{},
+	}
+	cfg.Derived.ExclusiveApplicationServicesUsernameRegexp = regexp.MustCompile("^$")
+	cfg.CAS = config.CAS{
+		Enabled:            true,
+		ServerURL:          srv.URL + "/cas",
+		TicketURL:          "https://example.com/_matrix/client/r0/login/cas/ticket",
+		CreateAccounts:     true,
+		LocalpartAttribute: "uid",
+	}
+	provider := auth.NewCASProvider(&cfg.CAS, srv.Client())
+	accountDB := &testSSOAccountDB{
+		accounts: map[string]*userapi.Account{
+			"alice": {UserID: "@alice:localhost", Localpart: "alice"},
+		},
+		links: map[string]string{},
+	}
+	userAPI := &testSSOUserAPI{db: accountDB}
+
+	for _, tc := range []struct {
+		ticket   string
+		wantCode int
+	}{
+		// A CAS user can't log into an existing account by naming it.
+		{"ST-mallory", http.StatusForbidden},
+		{"ST-bob", http.StatusFound},
+		// Once linked, the CAS user logs into their account even if the
+		// attribute changes.
+		{"ST-bob-renamed", http.StatusFound},
+	} {
+		state := tc.ticket + "-session"
+		startSSOSession(httptest.NewRecorder(), state, cfg.CAS.TicketURL, ssoSession{
+			redirectURL: "https://app.example.com/",
+			expires:     time.Now().Add(time.Minute),
+		})
+		req := httptest.NewRequest(http.MethodGet, "/login/cas/ticket?session="+state+"&ticket="+tc.ticket, nil)
+		req.AddCookie(&http.Cookie{Name: ssoSessionCookie, Value: state})
+		w := httptest.NewRecorder()
+		code := http.StatusFound
+		if resErr := CASTicket(w, req, cfg, provider, accountDB, userAPI); resErr != nil {
+			code = resErr.Code
+		}
+		if code != tc.wantCode {
+			t.Errorf("%s: got status %d, want %d", tc.ticket, code, tc.wantCode)
+		}
+	}
+	if got := accountDB.links["cas:"+cfg.CAS.ServerURL+" bob"]; got != "bob" {
+		t.Errorf("expected CAS user bob to be linked to bob, got %q", got)
+	}
+	if got := accountDB.links["cas:"+cfg.CAS.ServerURL+" mallory"]; got != "" {
+		t.Errorf("expected CAS user mallory not to be linked, got %q", got)
+	}
+}
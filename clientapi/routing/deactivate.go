@@ -6,9 +6,13 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 // Deactivate handles POST requests to /account/deactivate
@@ -16,7 +20,9 @@ func Deactivate(
 	req *http.Request,
 	userInteractiveAuth *auth.UserInteractive,
 	userAPI api.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
 	deviceAPI *api.Device,
+	cfg *config.ClientAPI,
 ) util.JSONResponse {
 	ctx := req.Context()
 	defer req.Body.Close() // nolint:errcheck
@@ -33,23 +39,66 @@ func Deactivate(
 		return *errRes
 	}
 
-	localpart, _, err := gomatrixserverlib.SplitID('@', login.User)
+	// The user must have authenticated as themselves, not as some other
+	// account that they know the password of.
+	localpart, err := userutil.ParseUsernameParam(login.Username(), &cfg.Matrix.ServerName)
 	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.InvalidUsername(err.Error()),
+		}
+	}
+	deviceLocalpart, _, err := gomatrixserverlib.SplitID('@', deviceAPI.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
+	if localpart != deviceLocalpart {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Authenticated as a different user to the one being deactivated"),
+		}
+	}
 
 	var res api.PerformAccountDeactivationResponse
 	err = userAPI.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
 		Localpart: localpart,
+		Erase:     gjson.GetBytes(bodyBytes, "erase").Bool(),
 	}, &res)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountDeactivation failed")
 		return jsonerror.InternalServerError()
 	}
 
+	// Leave all of the rooms that the user is joined to, and reject their
+	// invites. The account can no longer be used, so failing to leave one
+	// room shouldn't stop us from leaving the others.
+	for _, membership := range []string{gomatrixserverlib.Join, gomatrixserverlib.Invite} {
+		var roomsRes roomserverAPI.QueryRoomsForUserResponse
+		if err = rsAPI.QueryRoomsForUser(ctx, &roomserverAPI.QueryRoomsForUserRequest{
+			UserID:         deviceAPI.UserID,
+			WantMembership: membership,
+		}, &roomsRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomsForUser failed")
+			return jsonerror.InternalServerError()
+		}
+		for _, roomID := range roomsRes.RoomIDs {
+			if err = rsAPI.PerformLeave(ctx, &roomserverAPI.PerformLeaveRequest{
+				RoomID: roomID,
+				UserID: deviceAPI.UserID,
+			}, &roomserverAPI.PerformLeaveResponse{}); err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("Failed to leave room of deactivated user")
+			}
+		}
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: struct {
+			IDServerUnbindResult string `json:"id_server_unbind_result"`
+		}{
+			// We don't ask identity servers to unbind the user's 3PIDs.
+			IDServerUnbindResult: "no-support",
+		},
 	}
 }
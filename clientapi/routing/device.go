@@ -15,6 +15,8 @@
 package routing
 
 import (
+	"context"
+	"encoding/json"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -99,7 +101,9 @@ func GetDevicesByLocalpart(
 		return jsonerror.InternalServerError()
 	}
 
-	res := devicesJSON{}
+	res := devicesJSON{
+		Devices: []deviceJSON{},
+	}
 
 	for _, dev := range queryRes.Devices {
 		res.Devices = append(res.Devices, deviceJSON{
@@ -143,7 +147,7 @@ func UpdateDeviceByID(
 	if !performRes.DeviceExists {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
-			JSON: jsonerror.Forbidden("device does not exist"),
+			JSON: jsonerror.NotFound("device does not exist"),
 		}
 	}
 	if performRes.Forbidden {
@@ -173,26 +177,10 @@ func DeleteDeviceById(
 			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
 		}
 	}
-	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
-	if errRes != nil {
+	if errRes := verifyDeviceDeletion(ctx, userInteractiveAuth, bodyBytes, device); errRes != nil {
 		return *errRes
 	}
 
-	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
-	if err != nil {
-		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
-		return jsonerror.InternalServerError()
-	}
-
-	// make sure that the access token being used matches the login creds used for user interactive auth, else
-	// 1 compromised access token could be used to logout all devices.
-	if login.Username() != localpart && login.Username() != device.UserID {
-		return util.JSONResponse{
-			Code: 403,
-			JSON: jsonerror.Forbidden("Cannot delete another user's device"),
-		}
-	}
-
 	var res api.PerformDeviceDeletionResponse
 	if err := userAPI.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
 		UserID:    device.UserID,
@@ -210,24 +198,39 @@ func DeleteDeviceById(
 
 // DeleteDevices handles POST requests to /delete_devices
 func DeleteDevices(
-	req *http.Request, userAPI api.UserInternalAPI, device *api.Device,
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, userAPI api.UserInternalAPI, device *api.Device,
 ) util.JSONResponse {
 	ctx := req.Context()
+	defer req.Body.Close() // nolint: errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
 	payload := devicesDeleteJSON{}
-
-	if resErr := httputil.UnmarshalJSONRequest(req, &payload); resErr != nil {
-		return *resErr
+	if err = json.Unmarshal(bodyBytes, &payload); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	if errRes := verifyDeviceDeletion(ctx, userInteractiveAuth, bodyBytes, device); errRes != nil {
+		return *errRes
 	}
 
-	defer req.Body.Close() // nolint: errcheck
-
-	var res api.PerformDeviceDeletionResponse
-	if err := userAPI.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
-		UserID:    device.UserID,
-		DeviceIDs: payload.Devices,
-	}, &res); err != nil {
-		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformDeviceDeletion failed")
-		return jsonerror.InternalServerError()
+	// An empty list of device IDs would delete every device, including the
+	// one making this request.
+	if len(payload.Devices) > 0 {
+		var res api.PerformDeviceDeletionResponse
+		if err := userAPI.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
+			UserID:    device.UserID,
+			DeviceIDs: payload.Devices,
+		}, &res); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("userAPI.PerformDeviceDeletion failed")
+			return jsonerror.InternalServerError()
+		}
 	}
 
 	return util.JSONResponse{
@@ -236,6 +239,34 @@ func DeleteDevices(
 	}
 }
 
+// verifyDeviceDeletion makes the user re-authenticate with their password
+// before deleting devices, and checks that they authenticated as themselves.
+func verifyDeviceDeletion(
+	ctx context.Context, userInteractiveAuth *auth.UserInteractive, bodyBytes []byte, device *api.Device,
+) *util.JSONResponse {
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return errRes
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		jsonErr := jsonerror.InternalServerError()
+		return &jsonErr
+	}
+
+	// make sure that the access token being used matches the login creds used for user interactive auth, else
+	// 1 compromised access token could be used to logout all devices.
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return &util.JSONResponse{
+			Code: 403,
+			JSON: jsonerror.Forbidden("Cannot delete another user's device"),
+		}
+	}
+	return nil
+}
+
 // stripIPPort converts strings like "[::1]:12345" to "::1"
 func stripIPPort(addr string) string {
 	ip := net.ParseIP(addr)
@@ -0,0 +1,63 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+type deviceDeletionUserAPI struct {
+	api.UserInternalAPI
+	deleted [][]string
+}
+
+func (u *deviceDeletionUserAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
+	u.deleted = append(u.deleted, req.DeviceIDs)
+	return nil
+}
+
+func TestDeleteDevicesRequiresAuth(t *testing.T) {
+	cfg := &config.ClientAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	uia := auth.NewUserInteractive(func(ctx context.Context, localpart, password string) (*api.Account, error) {
+		if password != "secret" {
+			return nil, fmt.Errorf("wrong password")
+		}
+		return &api.Account{Localpart: localpart, ServerName: "localhost", UserID: "@" + localpart + ":localhost"}, nil
+	}, cfg)
+	device := &api.Device{ID: "PHONE", UserID: "@alice:localhost"}
+	passwordAuth := func(user string) string {
+		return `"auth": {"type": "m.login.password", "identifier": {"type": "m.id.user", "user": "` + user + `"}, "password": "secret"}`
+	}
+
+	for _, tc := range []struct {
+		body    string
+		code    int
+		deleted [][]string
+	}{
+		// no auth gets the UIA flows back
+		{`{"devices": ["LAPTOP"]}`, http.StatusUnauthorized, nil},
+		// authenticating as someone else isn't enough
+		{`{"devices": ["LAPTOP"], ` + passwordAuth("bob") + `}`, http.StatusForbidden, nil},
+		{`{"devices": ["LAPTOP"], ` + passwordAuth("alice") + `}`, http.StatusOK, [][]string{{"LAPTOP"}}},
+		// an empty list doesn't delete every device
+		{`{"devices": [], ` + passwordAuth("alice") + `}`, http.StatusOK, nil},
+	} {
+		userAPI := &deviceDeletionUserAPI{}
+		req := httptest.NewRequest(http.MethodPost, "/delete_devices", strings.NewReader(tc.body))
+		res := DeleteDevices(req, uia, userAPI, device)
+		if res.Code != tc.code {
+			t.Errorf("%s: got HTTP %d, want %d", tc.body, res.Code, tc.code)
+		}
+		if !reflect.DeepEqual(userAPI.deleted, tc.deleted) {
+			t.Errorf("%s: deleted devices %v, want %v", tc.body, userAPI.deleted, tc.deleted)
+		}
+	}
+}
@@ -15,12 +15,16 @@
 package routing
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/eventutil"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -113,7 +117,6 @@ func DirectoryRoom(
 }
 
 // SetLocalAlias implements PUT /directory/room/{roomAlias}
-// TODO: Check if the user has the power level to set an alias
 func SetLocalAlias(
 	req *http.Request,
 	device *api.Device,
@@ -138,25 +141,8 @@ func SetLocalAlias(
 
 	// Check that the alias does not fall within an exclusive namespace of an
 	// application service
-	// TODO: This code should eventually be refactored with:
-	// 1. The new method for checking for things matching an AS's namespace
-	// 2. Using an overall Regex object for all AS's just like we did for usernames
-
-	for _, appservice := range cfg.Derived.ApplicationServices {
-		// Don't prevent AS from creating aliases in its own namespace
-		// Note that Dendrite uses SenderLocalpart as UserID for AS users
-		if device.UserID != appservice.SenderLocalpart {
-			if aliasNamespaces, ok := appservice.NamespaceMap["aliases"]; ok {
-				for _, namespace := range aliasNamespaces {
-					if namespace.Exclusive && namespace.RegexpObject.MatchString(alias) {
-						return util.JSONResponse{
-							Code: http.StatusBadRequest,
-							JSON: jsonerror.ASExclusive("Alias is reserved by an application service"),
-						}
-					}
-				}
-			}
-		}
+	if resErr := checkAliasNotReserved(cfg, device, alias); resErr != nil {
+		return *resErr
 	}
 
 	var r struct {
@@ -165,6 +151,31 @@ func SetLocalAlias(
 	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
 		return *resErr
 	}
+	if r.RoomID == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("Missing room_id"),
+		}
+	}
+
+	// Only members of the room may point an alias at it, although application
+	// services can manage the aliases in their namespaces without joining.
+	if device.AppserviceID == "" {
+		var membershipRes roomserverAPI.QueryMembershipForUserResponse
+		if err = aliasAPI.QueryMembershipForUser(req.Context(), &roomserverAPI.QueryMembershipForUserRequest{
+			RoomID: r.RoomID,
+			UserID: device.UserID,
+		}, &membershipRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.QueryMembershipForUser failed")
+			return jsonerror.InternalServerError()
+		}
+		if !membershipRes.IsInRoom {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You must be joined to the room to create an alias for it"),
+			}
+		}
+	}
 
 	queryReq := roomserverAPI.SetRoomAliasRequest{
 		UserID: device.UserID,
@@ -190,32 +201,69 @@ func SetLocalAlias(
 	}
 }
 
+// checkAliasNotReserved returns an M_EXCLUSIVE error response if the alias
+// falls within an exclusive namespace of an application service. Application
+// services may create aliases in their own namespaces.
+func checkAliasNotReserved(
+	cfg *config.ClientAPI,
+	device *api.Device,
+	alias string,
+) *util.JSONResponse {
+	for _, appservice := range cfg.Derived.ApplicationServices {
+		if device.AppserviceID == appservice.ID {
+			continue
+		}
+		if appservice.OwnsNamespaceCoveringRoomAlias(alias) {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.ASExclusive("Alias is reserved by an application service"),
+			}
+		}
+	}
+	return nil
+}
+
 // RemoveLocalAlias implements DELETE /directory/room/{roomAlias}
 func RemoveLocalAlias(
 	req *http.Request,
 	device *api.Device,
 	alias string,
+	cfg *config.ClientAPI,
 	aliasAPI roomserverAPI.RoomserverInternalAPI,
 ) util.JSONResponse {
+	ctx := req.Context()
+	roomIDRes := roomserverAPI.GetRoomIDForAliasResponse{}
+	if err := aliasAPI.GetRoomIDForAlias(ctx, &roomserverAPI.GetRoomIDForAliasRequest{
+		Alias: alias,
+	}, &roomIDRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("aliasAPI.GetRoomIDForAlias failed")
+		return jsonerror.InternalServerError()
+	}
 
 	creatorQueryReq := roomserverAPI.GetCreatorIDForAliasRequest{
 		Alias: alias,
 	}
 	var creatorQueryRes roomserverAPI.GetCreatorIDForAliasResponse
-	if err := aliasAPI.GetCreatorIDForAlias(req.Context(), &creatorQueryReq, &creatorQueryRes); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.GetCreatorIDForAlias failed")
+	if err := aliasAPI.GetCreatorIDForAlias(ctx, &creatorQueryReq, &creatorQueryRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("aliasAPI.GetCreatorIDForAlias failed")
 		return jsonerror.InternalServerError()
 	}
 
-	if creatorQueryRes.UserID == "" {
+	if roomIDRes.RoomID == "" || creatorQueryRes.UserID == "" {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("Alias does not exist"),
 		}
 	}
 
-	if creatorQueryRes.UserID != device.UserID {
-		// TODO: Still allow deletion if user is admin
+	// The creator of an alias can always delete it. Otherwise the user needs
+	// to be allowed to change the canonical alias of the room.
+	stateRes, err := currentAliasState(ctx, aliasAPI, roomIDRes.RoomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("currentAliasState failed")
+		return jsonerror.InternalServerError()
+	}
+	if creatorQueryRes.UserID != device.UserID && !canChangeCanonicalAlias(stateRes, device.UserID) {
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
 			JSON: jsonerror.Forbidden("You do not have permission to delete this alias"),
@@ -227,17 +275,174 @@ func RemoveLocalAlias(
 		UserID: device.UserID,
 	}
 	var queryRes roomserverAPI.RemoveRoomAliasResponse
-	if err := aliasAPI.RemoveRoomAlias(req.Context(), &queryReq, &queryRes); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("aliasAPI.RemoveRoomAlias failed")
+	if err = aliasAPI.RemoveRoomAlias(ctx, &queryReq, &queryRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("aliasAPI.RemoveRoomAlias failed")
 		return jsonerror.InternalServerError()
 	}
 
+	// The alias no longer exists, so it mustn't stay in the canonical alias
+	// event of the room. Failing to update that isn't fatal, as the alias has
+	// already been removed.
+	if err = removeCanonicalAlias(req, device, cfg, aliasAPI, roomIDRes.RoomID, alias, stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("Failed to remove the alias from the canonical alias event")
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
 	}
 }
 
+type roomAliasesResponse struct {
+	Aliases []string `json:"aliases"`
+}
+
+// GetAliases implements GET /rooms/{roomID}/aliases
+func GetAliases(
+	req *http.Request,
+	device *api.Device,
+	roomID string,
+	aliasAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	stateRes, err := currentAliasState(ctx, aliasAPI, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("currentAliasState failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// The aliases are visible to the members of the room, or to anyone if
+	// the history of the room is world readable.
+	worldReadable := false
+	if ev := stateRes.StateEvents[historyVisibilityTuple]; ev != nil {
+		var content eventutil.HistoryVisibilityContent
+		worldReadable = json.Unmarshal(ev.Content(), &content) == nil && content.HistoryVisibility == "world_readable"
+	}
+	if !worldReadable {
+		var membershipRes roomserverAPI.QueryMembershipForUserResponse
+		if err = aliasAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+			RoomID: roomID,
+			UserID: device.UserID,
+		}, &membershipRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("aliasAPI.QueryMembershipForUser failed")
+			return jsonerror.InternalServerError()
+		}
+		if !membershipRes.IsInRoom {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You aren't a member of the room and it isn't world readable"),
+			}
+		}
+	}
+
+	var aliasesRes roomserverAPI.GetAliasesForRoomIDResponse
+	if err = aliasAPI.GetAliasesForRoomID(ctx, &roomserverAPI.GetAliasesForRoomIDRequest{
+		RoomID: roomID,
+	}, &aliasesRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("aliasAPI.GetAliasesForRoomID failed")
+		return jsonerror.InternalServerError()
+	}
+	aliases := aliasesRes.Aliases
+	if aliases == nil {
+		aliases = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: roomAliasesResponse{Aliases: aliases},
+	}
+}
+
+var (
+	canonicalAliasTuple    = gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}
+	powerLevelsTuple       = gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}
+	historyVisibilityTuple = gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""}
+)
+
+// currentAliasState returns the state events of the room which control who can
+// see and manage its aliases.
+func currentAliasState(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) (*roomserverAPI.QueryCurrentStateResponse, error) {
+	var stateRes roomserverAPI.QueryCurrentStateResponse
+	if err := rsAPI.QueryCurrentState(ctx, &roomserverAPI.QueryCurrentStateRequest{
+		RoomID:      roomID,
+		StateTuples: []gomatrixserverlib.StateKeyTuple{canonicalAliasTuple, powerLevelsTuple, historyVisibilityTuple},
+	}, &stateRes); err != nil {
+		return nil, fmt.Errorf("rsAPI.QueryCurrentState: %w", err)
+	}
+	return &stateRes, nil
+}
+
+// canChangeCanonicalAlias returns whether the power levels of the room allow
+// the user to send m.room.canonical_alias events.
+func canChangeCanonicalAlias(stateRes *roomserverAPI.QueryCurrentStateResponse, userID string) bool {
+	ev := stateRes.StateEvents[powerLevelsTuple]
+	if ev == nil {
+		return false
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(ev.Event)
+	if err != nil {
+		return false
+	}
+	return powerLevels.UserLevel(userID) >= powerLevels.EventLevel(gomatrixserverlib.MRoomCanonicalAlias, true)
+}
+
+// removeCanonicalAlias sends a new m.room.canonical_alias event without the
+// alias, if the current one refers to it.
+func removeCanonicalAlias(
+	req *http.Request, device *api.Device, cfg *config.ClientAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI, roomID, alias string,
+	stateRes *roomserverAPI.QueryCurrentStateResponse,
+) error {
+	ev := stateRes.StateEvents[canonicalAliasTuple]
+	if ev == nil {
+		return nil
+	}
+	var content eventutil.CanonicalAliasContent
+	if err := json.Unmarshal(ev.Content(), &content); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	changed := false
+	if content.Alias == alias {
+		content.Alias = ""
+		changed = true
+	}
+	altAliases := make([]string, 0, len(content.AltAliases))
+	for _, altAlias := range content.AltAliases {
+		if altAlias == alias {
+			changed = true
+			continue
+		}
+		altAliases = append(altAliases, altAlias)
+	}
+	if !changed {
+		return nil
+	}
+	content.AltAliases = altAliases
+
+	stateKey := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   device.UserID,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomCanonicalAlias,
+		StateKey: &stateKey,
+	}
+	if err := builder.SetContent(content); err != nil {
+		return fmt.Errorf("builder.SetContent: %w", err)
+	}
+	event, err := eventutil.QueryAndBuildEvent(req.Context(), &builder, cfg.Matrix, time.Now(), rsAPI, nil)
+	if err != nil {
+		return fmt.Errorf("eventutil.QueryAndBuildEvent: %w", err)
+	}
+	if err = roomserverAPI.SendEvents(
+		req.Context(), rsAPI, roomserverAPI.KindNew,
+		[]*gomatrixserverlib.HeaderedEvent{event}, cfg.Matrix.ServerName, nil,
+	); err != nil {
+		return fmt.Errorf("roomserverAPI.SendEvents: %w", err)
+	}
+	return nil
+}
+
 type roomVisibility struct {
 	Visibility string `json:"visibility"`
 }
@@ -63,11 +63,18 @@ func GetPostPublicRooms(
 	serverName := gomatrixserverlib.ServerName(request.Server)
 
 	if serverName != "" && serverName != cfg.Matrix.ServerName {
-		res, err := federation.GetPublicRooms(req.Context(), serverName, int(request.Limit), request.Since, false, "")
+		limit := int(request.Limit)
+		if limit <= 0 {
+			limit = 50
+		}
+		res, err := federation.GetPublicRooms(req.Context(), serverName, limit, request.Since, false, "")
 		if err != nil {
 			util.GetLogger(req.Context()).WithError(err).Error("failed to get public rooms")
 			return jsonerror.InternalServerError()
 		}
+		// The request to the remote server can't carry the search term, so
+		// filter the rooms that it returns instead.
+		res.Chunk = filterRooms(res.Chunk, request.Filter.SearchTerms)
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: res,
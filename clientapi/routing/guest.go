@@ -0,0 +1,53 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// checkNotGuest returns a 403 response if the device belongs to a guest
+// account, or nil if it doesn't.
+func checkNotGuest(device *api.Device) *util.JSONResponse {
+	if device.AccountType == api.AccountTypeGuest {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests cannot use this endpoint"),
+		}
+	}
+	return nil
+}
+
+// checkGuestCanSendEvent returns a 403 response if the device belongs to a
+// guest account and the event isn't one that guests may send. Guests can
+// send message events, but the only state they may change is their own
+// membership, e.g. to set a display name.
+func checkGuestCanSendEvent(device *api.Device, eventType string, stateKey *string) *util.JSONResponse {
+	if device.AccountType != api.AccountTypeGuest || stateKey == nil {
+		return nil
+	}
+	if eventType == gomatrixserverlib.MRoomMember && *stateKey == device.UserID {
+		return nil
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.GuestAccessForbidden("Guests cannot send this state event"),
+	}
+}
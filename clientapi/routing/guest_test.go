@@ -0,0 +1,30 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestCheckGuestCanSendEvent(t *testing.T) {
+	guest := &api.Device{UserID: "@1:localhost", AccountType: api.AccountTypeGuest}
+	user := &api.Device{UserID: "@alice:localhost", AccountType: api.AccountTypeUser}
+	ownKey, otherKey, emptyKey := guest.UserID, "@bob:localhost", ""
+	for _, tc := range []struct {
+		device    *api.Device
+		eventType string
+		stateKey  *string
+		allowed   bool
+	}{
+		{guest, "m.room.message", nil, true},
+		{guest, "m.room.member", &ownKey, true},
+		{guest, "m.room.member", &otherKey, false},
+		{guest, "m.room.name", &emptyKey, false},
+		{user, "m.room.name", &emptyKey, true},
+	} {
+		resErr := checkGuestCanSendEvent(tc.device, tc.eventType, tc.stateKey)
+		if allowed := resErr == nil; allowed != tc.allowed {
+			t.Errorf("%s sending %s: got allowed %v, want %v", tc.device.UserID, tc.eventType, allowed, tc.allowed)
+		}
+	}
+}
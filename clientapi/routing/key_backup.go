@@ -0,0 +1,354 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type keyBackupVersion struct {
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+}
+
+type keyBackupVersionCreateResponse struct {
+	Version string `json:"version"`
+}
+
+type keyBackupVersionResponse struct {
+	Algorithm string          `json:"algorithm"`
+	AuthData  json.RawMessage `json:"auth_data"`
+	Count     int64           `json:"count"`
+	ETag      string          `json:"etag"`
+	Version   string          `json:"version"`
+}
+
+type keyBackupSessionRequest struct {
+	Rooms map[string]struct {
+		Sessions map[string]userapi.KeyBackupSession `json:"sessions"`
+	} `json:"rooms"`
+}
+
+type keyBackupSessionResponse struct {
+	Count int64  `json:"count"`
+	ETag  string `json:"etag"`
+}
+
+// CreateKeyBackupVersion implements POST /room_keys/version
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-room-keys-version
+func CreateKeyBackupVersion(req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device) util.JSONResponse {
+	var kb keyBackupVersion
+	if resErr := httputil.UnmarshalJSONRequest(req, &kb); resErr != nil {
+		return *resErr
+	}
+	if kb.Algorithm == "" || len(kb.AuthData) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("algorithm and auth_data must be specified"),
+		}
+	}
+	var performKeyBackupResp userapi.PerformKeyBackupResponse
+	if err := userAPI.PerformKeyBackup(req.Context(), &userapi.PerformKeyBackupRequest{
+		UserID:    device.UserID,
+		Algorithm: kb.Algorithm,
+		AuthData:  kb.AuthData,
+	}, &performKeyBackupResp); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: keyBackupVersionCreateResponse{
+			Version: performKeyBackupResp.Version,
+		},
+	}
+}
+
+// KeyBackupVersion implements GET /room_keys/version and GET /room_keys/version/{version}
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-room-keys-version
+func KeyBackupVersion(req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, version string) util.JSONResponse {
+	var queryResp userapi.QueryKeyBackupResponse
+	if err := userAPI.QueryKeyBackup(req.Context(), &userapi.QueryKeyBackupRequest{
+		UserID:  device.UserID,
+		Version: version,
+	}, &queryResp); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	if !queryResp.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown backup version"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: keyBackupVersionResponse{
+			Algorithm: queryResp.Algorithm,
+			AuthData:  queryResp.AuthData,
+			Count:     queryResp.Count,
+			ETag:      queryResp.ETag,
+			Version:   queryResp.Version,
+		},
+	}
+}
+
+// ModifyKeyBackupVersionAuthData implements PUT /room_keys/version/{version}
+// https://matrix.org/docs/spec/client_server/r0.6.1#put-matrix-client-r0-room-keys-version-version
+func ModifyKeyBackupVersionAuthData(req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, version string) util.JSONResponse {
+	var kb struct {
+		keyBackupVersion
+		Version string `json:"version"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &kb); resErr != nil {
+		return *resErr
+	}
+	if kb.Version != "" && kb.Version != version {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("version in body does not match the version in the path"),
+		}
+	}
+	var performKeyBackupResp userapi.PerformKeyBackupResponse
+	if err := userAPI.PerformKeyBackup(req.Context(), &userapi.PerformKeyBackupRequest{
+		UserID:    device.UserID,
+		Version:   version,
+		Algorithm: kb.Algorithm,
+		AuthData:  kb.AuthData,
+	}, &performKeyBackupResp); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	if !performKeyBackupResp.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown backup version"),
+		}
+	}
+	if performKeyBackupResp.BadInput {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("The algorithm of a backup version can't be changed"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// DeleteKeyBackupVersion implements DELETE /room_keys/version/{version}
+// https://matrix.org/docs/spec/client_server/r0.6.1#delete-matrix-client-r0-room-keys-version-version
+func DeleteKeyBackupVersion(req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, version string) util.JSONResponse {
+	var performKeyBackupResp userapi.PerformKeyBackupResponse
+	if err := userAPI.PerformKeyBackup(req.Context(), &userapi.PerformKeyBackupRequest{
+		UserID:       device.UserID,
+		Version:      version,
+		DeleteBackup: true,
+	}, &performKeyBackupResp); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	if !performKeyBackupResp.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown backup version"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// UploadBackupKeys implements PUT /room_keys/keys, PUT /room_keys/keys/{roomID} and
+// PUT /room_keys/keys/{roomID}/{sessionID}. The keys in the request are in the form
+// for the path, i.e. all rooms, the sessions in the room or a single session.
+// https://matrix.org/docs/spec/client_server/r0.6.1#put-matrix-client-r0-room-keys-keys
+func UploadBackupKeys(req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, roomID, sessionID string) util.JSONResponse {
+	version := req.URL.Query().Get("version")
+	if version == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("version must be specified"),
+		}
+	}
+	keys := make(map[string]map[string]userapi.KeyBackupSession)
+	switch {
+	case roomID == "":
+		var r keyBackupSessionRequest
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		for roomID, room := range r.Rooms {
+			keys[roomID] = room.Sessions
+		}
+	case sessionID == "":
+		var r struct {
+			Sessions map[string]userapi.KeyBackupSession `json:"sessions"`
+		}
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		keys[roomID] = r.Sessions
+	default:
+		var r userapi.KeyBackupSession
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return *resErr
+		}
+		keys[roomID] = map[string]userapi.KeyBackupSession{sessionID: r}
+	}
+
+	var performKeyBackupResp userapi.PerformKeyBackupResponse
+	if err := userAPI.PerformKeyBackup(req.Context(), &userapi.PerformKeyBackupRequest{
+		UserID:  device.UserID,
+		Version: version,
+		Keys:    keys,
+	}, &performKeyBackupResp); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	if !performKeyBackupResp.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown backup version"),
+		}
+	}
+	if performKeyBackupResp.WrongVersion {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.WrongBackupVersion(performKeyBackupResp.Version),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: keyBackupSessionResponse{
+			Count: performKeyBackupResp.KeyCount,
+			ETag:  performKeyBackupResp.KeyETag,
+		},
+	}
+}
+
+// GetBackupKeys implements GET /room_keys/keys, GET /room_keys/keys/{roomID} and
+// GET /room_keys/keys/{roomID}/{sessionID}
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-room-keys-keys
+func GetBackupKeys(req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, roomID, sessionID string) util.JSONResponse {
+	version := req.URL.Query().Get("version")
+	if version == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("version must be specified"),
+		}
+	}
+	var queryResp userapi.QueryKeyBackupResponse
+	if err := userAPI.QueryKeyBackup(req.Context(), &userapi.QueryKeyBackupRequest{
+		UserID:           device.UserID,
+		Version:          version,
+		ReturnKeys:       true,
+		KeysForRoomID:    roomID,
+		KeysForSessionID: sessionID,
+	}, &queryResp); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	if !queryResp.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown backup version"),
+		}
+	}
+
+	switch {
+	case roomID == "":
+		rooms := make(map[string]interface{}, len(queryResp.Keys))
+		for roomID, sessions := range queryResp.Keys {
+			rooms[roomID] = map[string]interface{}{
+				"sessions": sessions,
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]interface{}{
+				"rooms": rooms,
+			},
+		}
+	case sessionID == "":
+		sessions := queryResp.Keys[roomID]
+		if sessions == nil {
+			sessions = make(map[string]userapi.KeyBackupSession)
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]interface{}{
+				"sessions": sessions,
+			},
+		}
+	default:
+		session, ok := queryResp.Keys[roomID][sessionID]
+		if !ok {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("Unknown backup session"),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: session,
+		}
+	}
+}
+
+// DeleteBackupKeys implements DELETE /room_keys/keys, DELETE /room_keys/keys/{roomID} and
+// DELETE /room_keys/keys/{roomID}/{sessionID}
+// https://matrix.org/docs/spec/client_server/r0.6.1#delete-matrix-client-r0-room-keys-keys
+func DeleteBackupKeys(req *http.Request, userAPI userapi.UserInternalAPI, device *userapi.Device, roomID, sessionID string) util.JSONResponse {
+	version := req.URL.Query().Get("version")
+	if version == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("version must be specified"),
+		}
+	}
+	var performKeyBackupResp userapi.PerformKeyBackupResponse
+	if err := userAPI.PerformKeyBackup(req.Context(), &userapi.PerformKeyBackupRequest{
+		UserID:     device.UserID,
+		Version:    version,
+		DeleteKeys: true,
+		RoomID:     roomID,
+		SessionID:  sessionID,
+	}, &performKeyBackupResp); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformKeyBackup failed")
+		return jsonerror.InternalServerError()
+	}
+	if !performKeyBackupResp.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown backup version"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: keyBackupSessionResponse{
+			Count: performKeyBackupResp.KeyCount,
+			ETag:  performKeyBackupResp.KeyETag,
+		},
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type crossSigningRequest struct {
+	MasterKey      *api.CrossSigningKey `json:"master_key,omitempty"`
+	SelfSigningKey *api.CrossSigningKey `json:"self_signing_key,omitempty"`
+	UserSigningKey *api.CrossSigningKey `json:"user_signing_key,omitempty"`
+}
+
+// UploadCrossSigningDeviceKeys implements POST /keys/device_signing/upload
+func UploadCrossSigningDeviceKeys(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive,
+	keyserverAPI api.KeyInternalAPI, device *userapi.Device,
+) util.JSONResponse {
+	ctx := req.Context()
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	// make sure that the access token being used matches the login creds used for user interactive auth
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Cannot upload cross-signing keys for another user"),
+		}
+	}
+
+	var r crossSigningRequest
+	if err = json.Unmarshal(bodyBytes, &r); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	uploadReq := &api.PerformUploadDeviceKeysRequest{
+		UserID: device.UserID,
+		Keys:   make(map[api.CrossSigningKeyPurpose]api.CrossSigningKey),
+	}
+	for purpose, key := range map[api.CrossSigningKeyPurpose]*api.CrossSigningKey{
+		api.CrossSigningKeyPurposeMaster:      r.MasterKey,
+		api.CrossSigningKeyPurposeSelfSigning: r.SelfSigningKey,
+		api.CrossSigningKeyPurposeUserSigning: r.UserSigningKey,
+	} {
+		if key != nil {
+			uploadReq.Keys[purpose] = *key
+		}
+	}
+	uploadRes := &api.PerformUploadDeviceKeysResponse{}
+	keyserverAPI.PerformUploadDeviceKeys(ctx, uploadReq, uploadRes)
+	if err := uploadRes.Error; err != nil {
+		switch {
+		case err.IsInvalidSignature:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidSignature(err.Error()),
+			}
+		case err.IsMissingParam:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingParam(err.Error()),
+			}
+		case err.IsInvalidParam:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam(err.Error()),
+			}
+		default:
+			util.GetLogger(ctx).WithError(err).Error("Failed to PerformUploadDeviceKeys")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// UploadCrossSigningSignatures implements POST /keys/signatures/upload
+func UploadCrossSigningSignatures(req *http.Request, keyserverAPI api.KeyInternalAPI, device *userapi.Device) util.JSONResponse {
+	var r map[string]map[string]json.RawMessage
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	uploadRes := &api.PerformUploadSignaturesResponse{}
+	keyserverAPI.PerformUploadSignatures(req.Context(), &api.PerformUploadSignaturesRequest{
+		UserID:     device.UserID,
+		Signatures: r,
+	}, uploadRes)
+	if uploadRes.Error != nil {
+		util.GetLogger(req.Context()).WithError(uploadRes.Error).Error("Failed to PerformUploadSignatures")
+		return jsonerror.InternalServerError()
+	}
+
+	failures := make(map[string]map[string]*jsonerror.MatrixError)
+	for userID, forUser := range uploadRes.Failures {
+		failures[userID] = make(map[string]*jsonerror.MatrixError)
+		for keyID, err := range forUser {
+			switch {
+			case err.IsInvalidSignature:
+				failures[userID][keyID] = jsonerror.InvalidSignature(err.Error())
+			case err.IsInvalidParam, err.IsMissingParam:
+				failures[userID][keyID] = jsonerror.InvalidParam(err.Error())
+			default:
+				failures[userID][keyID] = jsonerror.Unknown(err.Error())
+			}
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Failures map[string]map[string]*jsonerror.MatrixError `json:"failures"`
+		}{failures},
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// KnockRoomByIDOrAlias implements the MSC2403 /knock API. Only rooms which
+// this server is in can be knocked on so far.
+func KnockRoomByIDOrAlias(
+	req *http.Request,
+	device *api.Device,
+	cfg *config.ClientAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	roomIDOrAlias string,
+) util.JSONResponse {
+	roomID := roomIDOrAlias
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		var aliasRes roomserverAPI.GetRoomIDForAliasResponse
+		if err := rsAPI.GetRoomIDForAlias(req.Context(), &roomserverAPI.GetRoomIDForAliasRequest{
+			Alias:              roomIDOrAlias,
+			IncludeAppservices: true,
+		}, &aliasRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+			return jsonerror.InternalServerError()
+		}
+		if aliasRes.RoomID == "" {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound("Room alias " + roomIDOrAlias + " not found"),
+			}
+		}
+		roomID = aliasRes.RoomID
+	} else if !strings.HasPrefix(roomIDOrAlias, "!") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Invalid first character '" + roomIDOrAlias[:1] + "' for room ID or alias"),
+		}
+	}
+
+	// The reason is optional, so the body may be empty.
+	var body struct {
+		Reason string `json:"reason,omitempty"`
+	}
+	_ = httputil.UnmarshalJSONRequest(req, &body)
+
+	// We can only tell whether rooms that we are participating in are
+	// knockable.
+	var inRoomRes roomserverAPI.QueryServerJoinedToRoomResponse
+	if err := rsAPI.QueryServerJoinedToRoom(req.Context(), &roomserverAPI.QueryServerJoinedToRoomRequest{
+		RoomID:     roomID,
+		ServerName: cfg.Matrix.ServerName,
+	}, &inRoomRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryServerJoinedToRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if !inRoomRes.RoomExists || !inRoomRes.IsInRoom {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Knocking on rooms which this server isn't in is not supported"),
+		}
+	}
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   device.UserID,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &device.UserID,
+	}
+	err := builder.SetContent(gomatrixserverlib.MemberContent{
+		Membership: auth.Knock,
+		Reason:     body.Reason,
+	})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
+		return jsonerror.InternalServerError()
+	}
+	var queryRes roomserverAPI.QueryLatestEventsAndStateResponse
+	event, err := eventutil.QueryAndBuildEvent(req.Context(), &builder, cfg.Matrix, time.Now(), rsAPI, &queryRes)
+	if err == eventutil.ErrRoomNoExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(err.Error()),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("eventutil.QueryAndBuildEvent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Check that the knock is allowed before sending it, since the roomserver
+	// would otherwise just reject it.
+	provider := gomatrixserverlib.NewAuthEvents(gomatrixserverlib.UnwrapEventHeaders(queryRes.StateEvents))
+	if err = auth.Allowed(event.Event, &provider); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not allowed to knock on this room"),
+		}
+	}
+
+	if err = roomserverAPI.SendEvents(
+		req.Context(), rsAPI,
+		roomserverAPI.KindNew,
+		[]*gomatrixserverlib.HeaderedEvent{event},
+		cfg.Matrix.ServerName,
+		nil,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("roomserverAPI.SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			RoomID string `json:"room_id"`
+		}{roomID},
+	}
+}
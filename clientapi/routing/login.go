@@ -15,10 +15,13 @@
 package routing
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
@@ -27,13 +30,16 @@ import (
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
 )
 
 type loginResponse struct {
-	UserID      string                       `json:"user_id"`
-	AccessToken string                       `json:"access_token"`
-	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
-	DeviceID    string                       `json:"device_id"`
+	UserID       string                       `json:"user_id"`
+	AccessToken  string                       `json:"access_token"`
+	HomeServer   gomatrixserverlib.ServerName `json:"home_server"`
+	DeviceID     string                       `json:"device_id"`
+	RefreshToken string                       `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64                        `json:"expires_in_ms,omitempty"`
 }
 
 type flows struct {
@@ -44,12 +50,23 @@ type flow struct {
 	Type string `json:"type"`
 }
 
-func passwordLogin() flows {
+func loginFlows(cfg *config.ClientAPI) flows {
 	f := flows{}
-	s := flow{
-		Type: "m.login.password",
+	f.Flows = append(f.Flows, flow{
+		Type: authtypes.LoginTypePassword,
+	}, flow{
+		Type: authtypes.LoginTypeToken,
+	})
+	if cfg.SSO.Enabled {
+		f.Flows = append(f.Flows, flow{
+			Type: authtypes.LoginTypeSSO,
+		})
+	}
+	if cfg.CAS.Enabled {
+		f.Flows = append(f.Flows, flow{
+			Type: authtypes.LoginTypeCAS,
+		})
 	}
-	f.Flows = append(f.Flows, s)
 	return f
 }
 
@@ -59,22 +76,35 @@ func Login(
 	cfg *config.ClientAPI,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
-		// TODO: support other forms of login other than password, depending on config options
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: passwordLogin(),
+			JSON: loginFlows(cfg),
 		}
 	} else if req.Method == http.MethodPost {
-		typePassword := auth.LoginTypePassword{
-			GetAccountByPassword: accountDB.GetAccountByPassword,
-			Config:               cfg,
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("ioutil.ReadAll failed")
+			return jsonerror.InternalServerError()
+		}
+		var loginType auth.Type
+		switch gjson.GetBytes(body, "type").Str {
+		case authtypes.LoginTypeToken:
+			loginType = &auth.LoginTypeToken{
+				UserAPI: userAPI,
+			}
+		default:
+			loginType = &auth.LoginTypePassword{
+				GetAccountByPassword: accountDB.GetAccountByPassword,
+				Config:               cfg,
+			}
 		}
-		r := typePassword.Request()
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		r := loginType.Request()
 		resErr := httputil.UnmarshalJSONRequest(req, r)
 		if resErr != nil {
 			return *resErr
 		}
-		login, authErr := typePassword.Login(req.Context(), r)
+		login, authErr := loginType.Login(req.Context(), r)
 		if authErr != nil {
 			return *authErr
 		}
@@ -103,6 +133,14 @@ func completeAuth(
 		return jsonerror.InternalServerError()
 	}
 
+	var refreshToken string
+	if login.RefreshToken {
+		if refreshToken, err = auth.GenerateAccessToken(); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("auth.GenerateAccessToken failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
 	var performRes userapi.PerformDeviceCreationResponse
 	err = userAPI.PerformDeviceCreation(ctx, &userapi.PerformDeviceCreationRequest{
 		DeviceDisplayName: login.InitialDisplayName,
@@ -111,6 +149,7 @@ func completeAuth(
 		Localpart:         localpart,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
+		RefreshToken:      refreshToken,
 	}, &performRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -122,10 +161,12 @@ func completeAuth(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: loginResponse{
-			UserID:      performRes.Device.UserID,
-			AccessToken: performRes.Device.AccessToken,
-			HomeServer:  serverName,
-			DeviceID:    performRes.Device.ID,
+			UserID:       performRes.Device.UserID,
+			AccessToken:  performRes.Device.AccessToken,
+			HomeServer:   serverName,
+			DeviceID:     performRes.Device.ID,
+			RefreshToken: refreshToken,
+			ExpiresInMS:  accessTokenExpiresInMS(performRes.Device),
 		},
 	}
 }
@@ -43,6 +43,9 @@ func SendBan(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
+	if resErr := checkNotGuest(device); resErr != nil {
+		return *resErr
+	}
 	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
@@ -96,6 +99,9 @@ func SendKick(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
+	if resErr := checkNotGuest(device); resErr != nil {
+		return *resErr
+	}
 	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
@@ -136,6 +142,9 @@ func SendUnban(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
+	if resErr := checkNotGuest(device); resErr != nil {
+		return *resErr
+	}
 	body, evTime, roomVer, reqErr := extractRequestData(req, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
@@ -171,6 +180,9 @@ func SendInvite(
 	roomID string, cfg *config.ClientAPI,
 	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 ) util.JSONResponse {
+	if resErr := checkNotGuest(device); resErr != nil {
+		return *resErr
+	}
 	body, evTime, _, reqErr := extractRequestData(req, roomID, rsAPI)
 	if reqErr != nil {
 		return *reqErr
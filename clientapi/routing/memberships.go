@@ -20,16 +20,10 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
-	"github.com/matrix-org/dendrite/setup/config"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
-	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
-type getMembershipResponse struct {
-	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
-}
-
 type getJoinedRoomsResponse struct {
 	JoinedRooms []string `json:"joined_rooms"`
 }
@@ -51,14 +45,16 @@ type databaseJoinedMember struct {
 	AvatarURL   string `json:"avatar_url"`
 }
 
-// GetMemberships implements GET /rooms/{roomId}/members
-func GetMemberships(
-	req *http.Request, device *userapi.Device, roomID string, joinedOnly bool,
-	_ *config.ClientAPI,
+// GetJoinedMembers implements GET /rooms/{roomId}/joined_members. Only users
+// who are joined to the room can see who else is joined. The roomserver only
+// looks up the join events, rather than all of the membership events, which
+// matters in large rooms where most members have left.
+func GetJoinedMembers(
+	req *http.Request, device *userapi.Device, roomID string,
 	rsAPI api.RoomserverInternalAPI,
 ) util.JSONResponse {
 	queryReq := api.QueryMembershipsForRoomRequest{
-		JoinedOnly: joinedOnly,
+		JoinedOnly: true,
 		RoomID:     roomID,
 		Sender:     device.UserID,
 	}
@@ -68,32 +64,30 @@ func GetMemberships(
 		return jsonerror.InternalServerError()
 	}
 
-	if !queryRes.HasBeenInRoom {
+	if !queryRes.IsInRoom {
 		return util.JSONResponse{
 			Code: http.StatusForbidden,
-			JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+			JSON: jsonerror.Forbidden("You aren't a member of the room."),
 		}
 	}
 
-	if joinedOnly {
-		var res getJoinedMembersResponse
-		res.Joined = make(map[string]joinedMember)
-		for _, ev := range queryRes.JoinEvents {
-			var content databaseJoinedMember
-			if err := json.Unmarshal(ev.Content, &content); err != nil {
-				util.GetLogger(req.Context()).WithError(err).Error("failed to unmarshal event content")
-				return jsonerror.InternalServerError()
-			}
-			res.Joined[ev.Sender] = joinedMember(content)
+	res := getJoinedMembersResponse{
+		Joined: make(map[string]joinedMember, len(queryRes.JoinEvents)),
+	}
+	for _, ev := range queryRes.JoinEvents {
+		if ev.StateKey == nil {
+			continue
 		}
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: res,
+		var content databaseJoinedMember
+		if err := json.Unmarshal(ev.Content, &content); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("failed to unmarshal event content")
+			return jsonerror.InternalServerError()
 		}
+		res.Joined[*ev.StateKey] = joinedMember(content)
 	}
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: getMembershipResponse{queryRes.JoinEvents},
+		JSON: res,
 	}
 }
 
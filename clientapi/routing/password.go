@@ -2,11 +2,14 @@ package routing
 
 import (
 	"net/http"
+	"regexp"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -25,8 +28,23 @@ type newPasswordAuth struct {
 	Type    string `json:"type"`
 	Session string `json:"session"`
 	auth.PasswordRequest
+	// Used when resetting the password with m.login.email.identity
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
+	// Deprecated in favour of threepid_creds, but still sent by some clients
+	ThreePIDCredsCamel threepid.Credentials `json:"threepidCreds"`
 }
 
+// passwordResetSubmitPath is where the tokens emailed to users who are
+// resetting their password are submitted.
+const passwordResetSubmitPath = "/_matrix/client/r0/account/password/email/submitToken"
+
+// validClientSecretRegex is the format of the client_secret which clients
+// generate for 3PID validation sessions.
+var validClientSecretRegex = regexp.MustCompile(`^[0-9a-zA-Z.=_\-]{1,255}$`)
+
+// Password implements POST /account/password. If the request isn't
+// authenticated then the user is resetting their password, and must prove
+// that they own an email address associated with their account.
 func Password(
 	req *http.Request,
 	userAPI userapi.UserInternalAPI,
@@ -34,6 +52,13 @@ func Password(
 	device *api.Device,
 	cfg *config.ClientAPI,
 ) util.JSONResponse {
+	if !cfg.UserChanges.Password {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Password changes are disabled on this server"),
+		}
+	}
+
 	// Check that the existing password is right.
 	var r newPasswordRequest
 	r.LogoutDevices = true
@@ -51,6 +76,10 @@ func Password(
 		sessionID = util.RandomString(sessionIDLength)
 	}
 
+	if device == nil {
+		return resetPassword(req, userAPI, accountDB, cfg, &r, sessionID)
+	}
+
 	// Require password auth to change the password.
 	if r.Auth.Type != authtypes.LoginTypePassword {
 		return util.JSONResponse{
@@ -125,3 +154,148 @@ func Password(
 		JSON: struct{}{},
 	}
 }
+
+// resetPassword changes the password of a user who isn't logged in, once
+// they have validated an email address associated with their account.
+func resetPassword(
+	req *http.Request,
+	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+	cfg *config.ClientAPI,
+	r *newPasswordRequest,
+	sessionID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	if r.Auth.Type != authtypes.LoginTypeEmail {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: newUserInteractiveResponse(
+				sessionID,
+				[]authtypes.Flow{
+					{
+						Stages: []authtypes.LoginType{authtypes.LoginTypeEmail},
+					},
+				},
+				nil,
+			),
+		}
+	}
+
+	// Check the new password strength before using up the email session.
+	if resErr := validatePassword(r.NewPassword); resErr != nil {
+		return *resErr
+	}
+
+	creds := r.Auth.ThreePIDCreds
+	if creds.SID == "" {
+		creds = r.Auth.ThreePIDCredsCamel
+	}
+	email, resErr := validatedEmail(ctx, userAPI, cfg, creds)
+	if resErr != nil {
+		return *resErr
+	}
+	AddCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
+
+	localpart, err := accountDB.GetLocalpartForThreePID(ctx, email, "email")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if localpart == "" {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Forbidden("The email address is not associated with an account"),
+		}
+	}
+
+	passwordRes := &userapi.PerformPasswordUpdateResponse{}
+	if err = userAPI.PerformPasswordUpdate(ctx, &userapi.PerformPasswordUpdateRequest{
+		Localpart: localpart,
+		Password:  r.NewPassword,
+	}, passwordRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("PerformPasswordUpdate failed")
+		return jsonerror.InternalServerError()
+	}
+	if !passwordRes.PasswordUpdated {
+		util.GetLogger(ctx).Error("Expected password to have been updated but wasn't")
+		return jsonerror.InternalServerError()
+	}
+
+	// The user isn't logged in on any device making this request, so log out
+	// every device if asked to.
+	if r.LogoutDevices {
+		logoutRes := &userapi.PerformDeviceDeletionResponse{}
+		if err = userAPI.PerformDeviceDeletion(ctx, &userapi.PerformDeviceDeletionRequest{
+			UserID:    userutil.MakeUserID(localpart, cfg.Matrix.ServerName),
+			DeviceIDs: nil,
+		}, logoutRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("PerformDeviceDeletion failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// RequestPasswordResetEmailToken implements POST /account/password/email/requestToken
+func RequestPasswordResetEmailToken(
+	req *http.Request,
+	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
+	cfg *config.ClientAPI,
+	emailLimits *emailRateLimits,
+) util.JSONResponse {
+	if !cfg.UserChanges.Password {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Password changes are disabled on this server"),
+		}
+	}
+
+	ctx := req.Context()
+	var body threepid.EmailAssociationRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if err := threepid.ValidateEmail(body.Email); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid email address"),
+		}
+	}
+	if !validClientSecretRegex.MatchString(body.Secret) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid client_secret"),
+		}
+	}
+
+	localpart, err := accountDB.GetLocalpartForThreePID(ctx, body.Email, "email")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if localpart == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{
+				ErrCode: "M_THREEPID_NOT_FOUND",
+				Err:     "The email address is not associated with an account",
+			},
+		}
+	}
+
+	return requestEmailValidation(ctx, userAPI, cfg, emailLimits, body, passwordResetSubmitPath, "Reset your password")
+}
+
+// SubmitPasswordResetEmailToken implements GET and POST /account/password/email/submitToken.
+func SubmitPasswordResetEmailToken(
+	w http.ResponseWriter, req *http.Request, userAPI userapi.UserInternalAPI,
+) *util.JSONResponse {
+	return submitEmailToken(w, req, userAPI,
+		"Your email address has been validated. You may now return to the application to reset your password.",
+	)
+}
@@ -31,6 +31,9 @@ func PeekRoomByIDOrAlias(
 	accountDB accounts.Database,
 	roomIDOrAlias string,
 ) util.JSONResponse {
+	if resErr := checkNotGuest(device); resErr != nil {
+		return *resErr
+	}
 	// if this is a remote roomIDOrAlias, we have to ask the roomserver (or federation sender?) to
 	// to call /peek and /state on the remote server.
 	// TODO: in future we could skip this if we know we're already participating in the room,
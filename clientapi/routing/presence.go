@@ -0,0 +1,92 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+type presenceRequest struct {
+	Presence  string  `json:"presence"`
+	StatusMsg *string `json:"status_msg,omitempty"`
+}
+
+// SetPresence implements PUT /presence/{userId}/status
+func SetPresence(
+	req *http.Request, userAPI api.UserInternalAPI, device *api.Device, userID string,
+) util.JSONResponse {
+	if userID != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("userID does not match the current user"),
+		}
+	}
+
+	var r presenceRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if !api.ValidPresence(r.Presence) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("unknown presence %q", r.Presence)),
+		}
+	}
+
+	var res api.PerformPresenceUpdateResponse
+	if err := userAPI.PerformPresenceUpdate(req.Context(), &api.PerformPresenceUpdateRequest{
+		UserID:    userID,
+		Presence:  r.Presence,
+		StatusMsg: r.StatusMsg,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformPresenceUpdate failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// GetPresence implements GET /presence/{userId}/status
+func GetPresence(
+	req *http.Request, userAPI api.UserInternalAPI, userID string,
+) util.JSONResponse {
+	var res api.QueryPresenceResponse
+	if err := userAPI.QueryPresence(req.Context(), &api.QueryPresenceRequest{
+		UserID: userID,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryPresence failed")
+		return jsonerror.InternalServerError()
+	}
+	if !res.Exists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("presence not found"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Presence.Content(),
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// profilePropagator sends new membership events to the rooms that users are
+// joined to when they change their profile. It runs in the background and is
+// rate limited, since users can be joined to a lot of rooms. Only one
+// propagation runs for each user: if they change their profile again, the
+// previous one is cancelled, since the new one sends their latest profile.
+type profilePropagator struct {
+	cfg       *config.ClientAPI
+	accountDB accounts.Database
+	rsAPI     api.RoomserverInternalAPI
+
+	sync.Mutex
+	inProgress map[string]*profilePropagation
+}
+
+type profilePropagation struct {
+	cancel context.CancelFunc
+}
+
+func newProfilePropagator(
+	cfg *config.ClientAPI, accountDB accounts.Database, rsAPI api.RoomserverInternalAPI,
+) *profilePropagator {
+	return &profilePropagator{
+		cfg:        cfg,
+		accountDB:  accountDB,
+		rsAPI:      rsAPI,
+		inProgress: make(map[string]*profilePropagation),
+	}
+}
+
+// propagate starts sending the user's current profile to the rooms that they
+// are joined to, if profile propagation is enabled. evTime is the time of the
+// profile change.
+func (p *profilePropagator) propagate(userID, localpart string, evTime time.Time) {
+	if !p.cfg.ProfilePropagation.Enabled {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	propagation := &profilePropagation{cancel: cancel}
+	p.Lock()
+	if previous, ok := p.inProgress[userID]; ok {
+		previous.cancel()
+	}
+	p.inProgress[userID] = propagation
+	p.Unlock()
+
+	go func() {
+		defer func() {
+			p.Lock()
+			if p.inProgress[userID] == propagation {
+				delete(p.inProgress, userID)
+			}
+			p.Unlock()
+			cancel()
+		}()
+		p.run(ctx, userID, localpart, evTime)
+	}()
+}
+
+func (p *profilePropagator) run(ctx context.Context, userID, localpart string, evTime time.Time) {
+	logger := logrus.WithField("user_id", userID)
+	start := time.Now()
+	profile, err := p.accountDB.GetProfileByLocalpart(ctx, localpart)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get profile to propagate")
+		return
+	}
+	var res api.QueryRoomsForUserResponse
+	if err = p.rsAPI.QueryRoomsForUser(ctx, &api.QueryRoomsForUserRequest{
+		UserID:         userID,
+		WantMembership: gomatrixserverlib.Join,
+	}, &res); err != nil {
+		logger.WithError(err).Error("Failed to get rooms to propagate profile to")
+		return
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(p.cfg.ProfilePropagation.RoomsPerSecond))
+	defer ticker.Stop()
+	for _, roomID := range res.RoomIDs {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// The user may have left the room since we started, in which case
+		// sending a join event would join them again.
+		var membershipRes api.QueryMembershipForUserResponse
+		if err = p.rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+			RoomID: roomID,
+			UserID: userID,
+		}, &membershipRes); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to query membership")
+			continue
+		}
+		if !membershipRes.IsInRoom {
+			continue
+		}
+
+		// Keep the events in order if the user changes their profile again,
+		// even if the change had an explicit timestamp.
+		events, err := buildMembershipEvents(
+			ctx, []string{roomID}, *profile, userID, p.cfg, evTime.Add(time.Since(start)), p.rsAPI,
+		)
+		if err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to build membership event")
+			continue
+		}
+		if err = api.SendEvents(ctx, p.rsAPI, api.KindNew, events, p.cfg.Matrix.ServerName, nil); err != nil {
+			logger.WithError(err).WithField("room_id", roomID).Error("Failed to send membership event")
+		}
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The maximum lengths of the identifiers of a pusher.
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-pushers-set
+const (
+	maxPushKeyLength = 512
+	maxAppIDLength   = 64
+)
+
+type pushersResponse struct {
+	Pushers []userapi.Pusher `json:"pushers"`
+}
+
+type setPusherRequest struct {
+	userapi.Pusher
+	Append bool `json:"append"`
+}
+
+// GetPushers implements GET /pushers
+func GetPushers(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	var queryRes userapi.QueryPushersResponse
+	if err := userAPI.QueryPushers(req.Context(), &userapi.QueryPushersRequest{
+		UserID: device.UserID,
+	}, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryPushers failed")
+		return jsonerror.InternalServerError()
+	}
+	pushers := queryRes.Pushers
+	if pushers == nil {
+		pushers = []userapi.Pusher{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: pushersResponse{pushers},
+	}
+}
+
+// SetPusher implements POST /pushers/set. A null kind removes the pusher.
+func SetPusher(
+	req *http.Request, device *userapi.Device, userAPI userapi.UserInternalAPI, accountDB accounts.Database,
+) util.JSONResponse {
+	var body setPusherRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if resErr := validatePusher(req, device, accountDB, &body.Pusher); resErr != nil {
+		return *resErr
+	}
+
+	if err := userAPI.PerformPusherSet(req.Context(), &userapi.PerformPusherSetRequest{
+		UserID: device.UserID,
+		Pusher: body.Pusher,
+		Append: body.Append,
+	}, &userapi.PerformPusherSetResponse{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformPusherSet failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// validatePusher checks that a pusher provided by the user has the fields its
+// kind requires. HTTP pushers must point at a push gateway, and the pushkey of
+// an email pusher must be one of the user's validated email addresses.
+func validatePusher(
+	req *http.Request, device *userapi.Device, accountDB accounts.Database, pusher *userapi.Pusher,
+) *util.JSONResponse {
+	if pusher.PushKey == "" || pusher.AppID == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("Missing pushkey or app_id"),
+		}
+	}
+	if len(pusher.PushKey) > maxPushKeyLength || len(pusher.AppID) > maxAppIDLength {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("pushkey or app_id is too long"),
+		}
+	}
+	if pusher.Kind == "" {
+		// The pusher is being removed, so nothing else is needed.
+		return nil
+	}
+	if pusher.AppDisplayName == "" || pusher.DeviceDisplayName == "" || pusher.Language == "" || pusher.Data == nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("Missing app_display_name, device_display_name, lang or data"),
+		}
+	}
+
+	switch pusher.Kind {
+	case userapi.HTTPPusherKind:
+		rawURL, _ := pusher.Data["url"].(string)
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Path != pushgateway.NotifyPath {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("data.url must be an HTTP URL ending with " + pushgateway.NotifyPath),
+			}
+		}
+	case userapi.EmailPusherKind:
+		localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		threepids, err := accountDB.GetThreePIDsForLocalpart(req.Context(), localpart)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetThreePIDsForLocalpart failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		for _, threepid := range threepids {
+			if threepid.Medium == "email" && threepid.Address == pusher.PushKey {
+				return nil
+			}
+		}
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("The pushkey of an email pusher must be one of your email addresses"),
+		}
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Unknown pusher kind"),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,442 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+// pushRuleAttrs are the attributes of a push rule which can be read and
+// changed on their own.
+const (
+	pushRuleAttrEnabled = "enabled"
+	pushRuleAttrActions = "actions"
+)
+
+// GetAllPushRules implements GET /pushrules/
+func GetAllPushRules(
+	ctx context.Context, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSets,
+	}
+}
+
+// GetPushRulesByScope implements GET /pushrules/{scope}/
+func GetPushRulesByScope(
+	ctx context.Context, scope string, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	ruleSet := pushRuleSetByScope(ruleSets, pushrules.Scope(scope))
+	if ruleSet == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule scope"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSet,
+	}
+}
+
+// GetPushRulesByKind implements GET /pushrules/{scope}/{kind}/
+func GetPushRulesByKind(
+	ctx context.Context, scope, kind string, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesByKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: *rules,
+	}
+}
+
+// GetPushRuleByRuleID implements GET /pushrules/{scope}/{kind}/{ruleID}
+func GetPushRuleByRuleID(
+	ctx context.Context, scope, kind, ruleID string, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesByKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndexByID(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: (*rules)[i],
+	}
+}
+
+// PutPushRuleByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleID}. New
+// rules are given the highest priority of their kind, unless the before or
+// after query parameters say otherwise.
+func PutPushRuleByRuleID(
+	ctx context.Context, scope, kind, ruleID, afterRuleID, beforeRuleID string, body io.Reader,
+	device *userapi.Device, userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	var newRule pushrules.Rule
+	if err := json.NewDecoder(body).Decode(&newRule); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(err.Error()),
+		}
+	}
+	newRule.RuleID = ruleID
+	newRule.Default = false
+	newRule.Enabled = true
+	if strings.HasPrefix(ruleID, ".") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Rule IDs starting with '.' are reserved for server-default rules"),
+		}
+	}
+	if resErr := validatePushRule(pushrules.Kind(kind), &newRule); resErr != nil {
+		return *resErr
+	}
+
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesByKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+
+	i := pushRuleIndexByID(*rules, ruleID)
+	if i >= 0 && afterRuleID == "" && beforeRuleID == "" {
+		// Replace the rule, keeping its priority.
+		(*rules)[i] = &newRule
+	} else {
+		if i >= 0 {
+			*rules = append((*rules)[:i], (*rules)[i+1:]...)
+		}
+		// User-defined rules always have a higher priority than the
+		// server-default rules, so they can't be placed amongst them.
+		insertAt := 0
+		relativeTo := beforeRuleID
+		if afterRuleID != "" {
+			relativeTo = afterRuleID
+		}
+		if relativeTo != "" {
+			j := pushRuleIndexByID(*rules, relativeTo)
+			if j < 0 {
+				return pushRuleNotFound()
+			}
+			if (*rules)[j].Default {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidParam("Can't place a rule relative to a server-default rule"),
+				}
+			}
+			insertAt = j
+			if afterRuleID != "" {
+				insertAt = j + 1
+			}
+		}
+		*rules = append((*rules)[:insertAt], append([]*pushrules.Rule{&newRule}, (*rules)[insertAt:]...)...)
+	}
+
+	if err = putPushRules(ctx, device.UserID, ruleSets, userAPI, syncProducer); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("putPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// DeletePushRuleByRuleID implements DELETE /pushrules/{scope}/{kind}/{ruleID}
+func DeletePushRuleByRuleID(
+	ctx context.Context, scope, kind, ruleID string,
+	device *userapi.Device, userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesByKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndexByID(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	if (*rules)[i].Default {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Server-default rules can't be deleted, only disabled"),
+		}
+	}
+	*rules = append((*rules)[:i], (*rules)[i+1:]...)
+
+	if err = putPushRules(ctx, device.UserID, ruleSets, userAPI, syncProducer); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("putPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// GetPushRuleAttrByRuleID implements GET /pushrules/{scope}/{kind}/{ruleID}/{attr}
+func GetPushRuleAttrByRuleID(
+	ctx context.Context, scope, kind, ruleID, attr string, device *userapi.Device, userAPI userapi.UserInternalAPI,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesByKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndexByID(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	rule := (*rules)[i]
+	switch attr {
+	case pushRuleAttrEnabled:
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				Enabled bool `json:"enabled"`
+			}{rule.Enabled},
+		}
+	case pushRuleAttrActions:
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				Actions []*pushrules.Action `json:"actions"`
+			}{rule.Actions},
+		}
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule attribute"),
+		}
+	}
+}
+
+// PutPushRuleAttrByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleID}/{attr}
+func PutPushRuleAttrByRuleID(
+	ctx context.Context, scope, kind, ruleID, attr string, body io.Reader,
+	device *userapi.Device, userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	var newAttrs struct {
+		Enabled *bool               `json:"enabled"`
+		Actions []*pushrules.Action `json:"actions"`
+	}
+	if err := json.NewDecoder(body).Decode(&newAttrs); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(err.Error()),
+		}
+	}
+
+	ruleSets, err := queryPushRules(ctx, device.UserID, userAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesByKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndexByID(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound()
+	}
+	rule := (*rules)[i]
+	switch attr {
+	case pushRuleAttrEnabled:
+		if newAttrs.Enabled == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingParam("Missing enabled"),
+			}
+		}
+		rule.Enabled = *newAttrs.Enabled
+	case pushRuleAttrActions:
+		if newAttrs.Actions == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingParam("Missing actions"),
+			}
+		}
+		rule.Actions = newAttrs.Actions
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule attribute"),
+		}
+	}
+
+	if err = putPushRules(ctx, device.UserID, ruleSets, userAPI, syncProducer); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("putPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// validatePushRule checks that a rule provided by the user has the fields
+// which are required for its kind.
+func validatePushRule(kind pushrules.Kind, rule *pushrules.Rule) *util.JSONResponse {
+	if len(rule.Actions) == 0 {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("Missing actions"),
+		}
+	}
+	var err string
+	switch kind {
+	case pushrules.OverrideKind, pushrules.UnderrideKind:
+		if rule.Conditions == nil {
+			err = "Missing conditions"
+		}
+		if rule.Pattern != "" {
+			err = "Only content rules can have a pattern"
+		}
+	case pushrules.ContentKind:
+		if rule.Pattern == "" {
+			err = "Missing pattern"
+		}
+		if len(rule.Conditions) > 0 {
+			err = "Content rules can't have conditions"
+		}
+	case pushrules.RoomKind, pushrules.SenderKind:
+		if rule.Pattern != "" || len(rule.Conditions) > 0 {
+			err = "Room and sender rules can't have a pattern or conditions"
+		}
+	}
+	if err != "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam(err),
+		}
+	}
+	return nil
+}
+
+func queryPushRules(ctx context.Context, userID string, userAPI userapi.UserInternalAPI) (*pushrules.AccountRuleSets, error) {
+	var res userapi.QueryPushRulesResponse
+	if err := userAPI.QueryPushRules(ctx, &userapi.QueryPushRulesRequest{UserID: userID}, &res); err != nil {
+		return nil, err
+	}
+	return res.RuleSets, nil
+}
+
+// putPushRules stores the push rules and tells the sync API, so that clients
+// see the m.push_rules account data change.
+func putPushRules(
+	ctx context.Context, userID string, ruleSets *pushrules.AccountRuleSets,
+	userAPI userapi.UserInternalAPI, syncProducer *producers.SyncAPIProducer,
+) error {
+	if err := userAPI.PerformPushRulesPut(ctx, &userapi.PerformPushRulesPutRequest{
+		UserID:   userID,
+		RuleSets: ruleSets,
+	}, &userapi.PerformPushRulesPutResponse{}); err != nil {
+		return err
+	}
+	return syncProducer.SendData(userID, "", "m.push_rules")
+}
+
+func pushRuleSetByScope(ruleSets *pushrules.AccountRuleSets, scope pushrules.Scope) *pushrules.RuleSet {
+	switch scope {
+	case pushrules.GlobalScope:
+		return &ruleSets.Global
+	default:
+		return nil
+	}
+}
+
+func pushRulesByKind(ruleSets *pushrules.AccountRuleSets, scope, kind string) (*[]*pushrules.Rule, *util.JSONResponse) {
+	ruleSet := pushRuleSetByScope(ruleSets, pushrules.Scope(scope))
+	if ruleSet == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule scope"),
+		}
+	}
+	rules := ruleSet.RuleSetByKind(pushrules.Kind(kind))
+	if rules == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unknown push rule kind"),
+		}
+	}
+	return rules, nil
+}
+
+func pushRuleIndexByID(rules []*pushrules.Rule, ruleID string) int {
+	for i, rule := range rules {
+		if rule.RuleID == ruleID {
+			return i
+		}
+	}
+	return -1
+}
+
+func pushRuleNotFound() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Push rule not found"),
+	}
+}
@@ -1,30 +1,57 @@
 package routing
 
 import (
+	"container/list"
+	"math"
 	"net/http"
 	"sync"
 	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/util"
 )
 
+// rateLimitClass is a kind of request which has its own rate limit, so that
+// e.g. logging in doesn't use up the allowance for sending messages.
+type rateLimitClass int
+
+const (
+	rateLimitGeneral rateLimitClass = iota
+	rateLimitLogin
+	rateLimitRegistration
+	rateLimitMessageSend
+)
+
 type rateLimits struct {
-	limits           map[string]chan struct{}
-	limitsMutex      sync.RWMutex
-	cleanMutex       sync.RWMutex
-	enabled          bool
-	requestThreshold int64
-	cooloffDuration  time.Duration
+	cfg     *config.ClientAPI
+	enabled bool
+	buckets map[rateLimitClass]*rateLimitBuckets
 }
 
-func newRateLimits(cfg *config.RateLimiting) *rateLimits {
+func newRateLimits(cfg *config.ClientAPI) *rateLimits {
+	rl := &cfg.RateLimiting
 	l := &rateLimits{
-		limits:           make(map[string]chan struct{}),
-		enabled:          cfg.Enabled,
-		requestThreshold: cfg.Threshold,
-		cooloffDuration:  time.Duration(cfg.CooloffMS) * time.Millisecond,
+		cfg:     cfg,
+		enabled: rl.Enabled,
+		buckets: make(map[rateLimitClass]*rateLimitBuckets),
+	}
+	general := config.RateLimit{Threshold: rl.Threshold, CooloffMS: rl.CooloffMS}
+	for class, limit := range map[rateLimitClass]config.RateLimit{
+		rateLimitGeneral:      general,
+		rateLimitLogin:        rl.Login,
+		rateLimitRegistration: rl.Registration,
+		rateLimitMessageSend:  rl.MessageSend,
+	} {
+		if limit.Threshold == 0 {
+			limit.Threshold = general.Threshold
+		}
+		if limit.CooloffMS == 0 {
+			limit.CooloffMS = general.CooloffMS
+		}
+		l.buckets[class] = newRateLimitBuckets(limit, int(rl.MaxEntries), time.Now)
 	}
 	if l.enabled {
 		go l.clean()
@@ -34,76 +61,190 @@ func newRateLimits(cfg *config.RateLimiting) *rateLimits {
 
 func (l *rateLimits) clean() {
 	for {
-		// On a 30 second interval, we'll take an exclusive write
-		// lock of the entire map and see if any of the channels are
-		// empty. If they are then we will close and delete them,
-		// freeing up memory.
+		// On a 30 second interval, forget about any callers who have been
+		// idle for long enough that they would have a full bucket again.
 		time.Sleep(time.Second * 30)
-		l.cleanMutex.Lock()
-		l.limitsMutex.Lock()
-		for k, c := range l.limits {
-			if len(c) == 0 {
-				close(c)
-				delete(l.limits, k)
-			}
+		for _, b := range l.buckets {
+			b.clean()
 		}
-		l.limitsMutex.Unlock()
-		l.cleanMutex.Unlock()
 	}
 }
 
-func (l *rateLimits) rateLimit(req *http.Request) *util.JSONResponse {
+// rateLimit returns an error response if the caller has made too many requests
+// of the given class recently, or nil if the request can go ahead. Requests are
+// limited by user if there is a device, or by IP address otherwise.
+func (l *rateLimits) rateLimit(req *http.Request, device *userapi.Device, class rateLimitClass) *util.JSONResponse {
 	// If rate limiting is disabled then do nothing.
 	if !l.enabled {
 		return nil
 	}
 
-	// Take a read lock out on the cleaner mutex. The cleaner expects to
-	// be able to take a write lock, which isn't possible while there are
-	// readers, so this has the effect of blocking the cleaner goroutine
-	// from doing its work until there are no requests in flight.
-	l.cleanMutex.RLock()
-	defer l.cleanMutex.RUnlock()
+	caller, exempt := l.caller(req, device)
+	if exempt {
+		return nil
+	}
+	if ok, retryAfter := l.buckets[class].take(caller); !ok {
+		// We hit the rate limit. Tell the client to back off.
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", retryAfter.Milliseconds()),
+		}
+	}
+	return nil
+}
+
+// caller returns the key to rate limit the request by, and whether the caller
+// is exempt from rate limiting altogether.
+func (l *rateLimits) caller(req *http.Request, device *userapi.Device) (string, bool) {
+	if device != nil {
+		if device.AppserviceID != "" {
+			return "", true
+		}
+		if l.cfg.RateLimiting.ExemptAdminUsers && l.cfg.IsAdmin(device.UserID) {
+			return "", true
+		}
+		return device.UserID, false
+	}
 
-	// First of all, work out if X-Forwarded-For was sent to us. If not
-	// then we'll just use the IP address of the caller.
+	// Application services can use their token on unauthenticated endpoints,
+	// e.g. to register users.
+	if token, err := auth.ExtractAccessToken(req); err == nil && l.cfg.Derived != nil {
+		for _, as := range l.cfg.Derived.ApplicationServices {
+			if as.ASToken == token {
+				return "", true
+			}
+		}
+	}
+
+	// Work out if X-Forwarded-For was sent to us. If not then we'll just
+	// use the IP address of the caller.
 	caller := req.RemoteAddr
 	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" {
 		caller = forwardedFor
 	}
+	return caller, false
+}
+
+// rateLimitBuckets is a set of token buckets, one for each caller. Each bucket
+// holds up to the threshold number of tokens, and is refilled at an even rate
+// over the cooloff period. At most maxEntries buckets are kept, forgetting the
+// least recently used first, so that lots of callers can't use up all of our
+// memory.
+type rateLimitBuckets struct {
+	mutex      sync.Mutex
+	capacity   float64
+	interval   time.Duration // for one token to be refilled
+	maxEntries int
+	entries    map[string]*list.Element
+	lru        *list.List // of *rateLimitBucket, most recently used first
+	now        func() time.Time
+}
+
+type rateLimitBucket struct {
+	caller   string
+	tokens   float64
+	lastUsed time.Time
+}
+
+func newRateLimitBuckets(limit config.RateLimit, maxEntries int, now func() time.Time) *rateLimitBuckets {
+	b := &rateLimitBuckets{
+		capacity:   float64(limit.Threshold),
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		now:        now,
+	}
+	if limit.Threshold > 0 {
+		b.interval = time.Duration(limit.CooloffMS) * time.Millisecond / time.Duration(limit.Threshold)
+	}
+	return b
+}
 
-	// Look up the caller's channel, if they have one.
-	l.limitsMutex.RLock()
-	rateLimit, ok := l.limits[caller]
-	l.limitsMutex.RUnlock()
+// take uses up one of the caller's tokens. If there are none left then it
+// returns false and how long it will be until there is one.
+func (b *rateLimitBuckets) take(caller string) (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.now()
 
-	// If the caller doesn't have a channel, create one and write it
-	// back to the map.
-	if !ok {
-		rateLimit = make(chan struct{}, l.requestThreshold)
+	var bucket *rateLimitBucket
+	if el, ok := b.entries[caller]; ok {
+		bucket = el.Value.(*rateLimitBucket)
+		b.lru.MoveToFront(el)
+		if b.interval > 0 {
+			refilled := float64(now.Sub(bucket.lastUsed)) / float64(b.interval)
+			bucket.tokens = math.Min(b.capacity, bucket.tokens+refilled)
+		} else {
+			bucket.tokens = b.capacity
+		}
+	} else {
+		bucket = &rateLimitBucket{caller: caller, tokens: b.capacity}
+		b.entries[caller] = b.lru.PushFront(bucket)
+		for b.lru.Len() > b.maxEntries {
+			b.remove(b.lru.Back())
+		}
+	}
+	bucket.lastUsed = now
 
-		l.limitsMutex.Lock()
-		l.limits[caller] = rateLimit
-		l.limitsMutex.Unlock()
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) * float64(b.interval))
 	}
+	bucket.tokens--
+	return true, 0
+}
 
-	// Check if the user has got free resource slots for this request.
-	// If they don't then we'll return an error.
-	select {
-	case rateLimit <- struct{}{}:
-	default:
-		// We hit the rate limit. Tell the client to back off.
+// clean forgets about callers who have been idle for long enough that their
+// bucket would be full again, since a new bucket is just the same.
+func (b *rateLimitBuckets) clean() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	idle := time.Duration(b.capacity * float64(b.interval))
+	now := b.now()
+	for el := b.lru.Back(); el != nil; el = b.lru.Back() {
+		if now.Sub(el.Value.(*rateLimitBucket).lastUsed) < idle {
+			break
+		}
+		b.remove(el)
+	}
+}
+
+func (b *rateLimitBuckets) remove(el *list.Element) {
+	b.lru.Remove(el)
+	delete(b.entries, el.Value.(*rateLimitBucket).caller)
+}
+
+// emailRateLimits limits how often emails can be sent to each address, so
+// that the homeserver can't be used to spam someone.
+type emailRateLimits struct {
+	lastSent        map[string]time.Time
+	mutex           sync.Mutex
+	cooloffDuration time.Duration
+}
+
+func newEmailRateLimits(cfg *config.Email) *emailRateLimits {
+	return &emailRateLimits{
+		lastSent:        make(map[string]time.Time),
+		cooloffDuration: time.Duration(cfg.SendCooloffMS) * time.Millisecond,
+	}
+}
+
+// rateLimit records that an email is being sent to the address, or returns
+// an error response if one was sent to it too recently.
+func (l *emailRateLimits) rateLimit(address string) *util.JSONResponse {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	for k, t := range l.lastSent {
+		if now.Sub(t) >= l.cooloffDuration {
+			delete(l.lastSent, k)
+		}
+	}
+	if t, ok := l.lastSent[address]; ok {
 		return &util.JSONResponse{
 			Code: http.StatusTooManyRequests,
-			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", l.cooloffDuration.Milliseconds()),
+			JSON: jsonerror.LimitExceeded("An email was sent to this address too recently", (l.cooloffDuration - now.Sub(t)).Milliseconds()),
 		}
 	}
-
-	// After the time interval, drain a resource from the rate limiting
-	// channel. This will free up space in the channel for new requests.
-	go func() {
-		<-time.After(l.cooloffDuration)
-		<-rateLimit
-	}()
+	l.lastSent[address] = now
 	return nil
 }
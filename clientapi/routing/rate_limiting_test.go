@@ -0,0 +1,110 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestRateLimitBuckets(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newRateLimitBuckets(config.RateLimit{Threshold: 2, CooloffMS: 1000}, 2, func() time.Time { return now })
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take("alice"); !ok {
+			t.Fatalf("request %d was rate limited, want allowed", i)
+		}
+	}
+	ok, retryAfter := b.take("alice")
+	if ok {
+		t.Fatalf("request over the threshold was allowed")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Errorf("got retry after %s, want 500ms", retryAfter)
+	}
+
+	// One token is refilled every cooloff / threshold.
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ = b.take("alice"); !ok {
+		t.Errorf("request after a token was refilled was rate limited")
+	}
+	if ok, _ = b.take("bob"); !ok {
+		t.Errorf("other callers have their own bucket, but bob was rate limited")
+	}
+
+	// Only maxEntries buckets are kept, forgetting the least recently used.
+	if ok, _ = b.take("charlie"); !ok {
+		t.Errorf("charlie was rate limited")
+	}
+	if _, found := b.entries["alice"]; found || b.lru.Len() != 2 {
+		t.Errorf("alice should have been forgotten, got %d entries", b.lru.Len())
+	}
+
+	// Idle callers whose buckets would be full again are cleaned up.
+	now = now.Add(999 * time.Millisecond)
+	b.clean()
+	if b.lru.Len() != 2 {
+		t.Errorf("got %d entries after cleaning too early, want 2", b.lru.Len())
+	}
+	now = now.Add(time.Millisecond)
+	b.clean()
+	if b.lru.Len() != 0 || len(b.entries) != 0 {
+		t.Errorf("got %d entries after cleaning, want 0", b.lru.Len())
+	}
+}
+
+func TestRateLimitsExemptions(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Derived:    &config.Derived{ApplicationServices: []config.ApplicationService{{ID: "bridge", ASToken: "as_token"}}},
+		AdminUsers: []string{"@admin:localhost"},
+	}
+	cfg.RateLimiting.Defaults()
+	cfg.RateLimiting.Threshold = 1
+	cfg.RateLimiting.Enabled = false // don't start the cleaner
+	l := newRateLimits(cfg)
+	l.enabled = true
+
+	limited := func(device *userapi.Device, token string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		// Make two requests, the second of which is over the threshold.
+		l.rateLimit(req, device, rateLimitGeneral)
+		return l.rateLimit(req, device, rateLimitGeneral) != nil
+	}
+	if !limited(&userapi.Device{UserID: "@alice:localhost"}, "") {
+		t.Errorf("user wasn't rate limited")
+	}
+	if !limited(nil, "") {
+		t.Errorf("unauthenticated request wasn't rate limited")
+	}
+	if limited(&userapi.Device{UserID: "@bridge:localhost", AppserviceID: "bridge"}, "") {
+		t.Errorf("appservice user was rate limited")
+	}
+	if limited(nil, "as_token") {
+		t.Errorf("unauthenticated request with an appservice token was rate limited")
+	}
+	if !limited(&userapi.Device{UserID: "@admin:localhost"}, "") {
+		t.Errorf("admin was exempt from rate limiting without exempt_admin_users")
+	}
+	l.cfg.RateLimiting.ExemptAdminUsers = true
+	if limited(&userapi.Device{UserID: "@admin:localhost"}, "") {
+		t.Errorf("admin was rate limited with exempt_admin_users")
+	}
+
+	// Login requests have their own limit.
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	l.rateLimit(req, nil, rateLimitGeneral)
+	if resErr := l.rateLimit(req, nil, rateLimitLogin); resErr != nil {
+		t.Errorf("login was rate limited by the general limit")
+	}
+	if resErr := l.rateLimit(req, nil, rateLimitGeneral); resErr == nil || resErr.Code != http.StatusTooManyRequests {
+		t.Errorf("got %+v, want a 429 response", resErr)
+	}
+}
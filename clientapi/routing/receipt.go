@@ -38,9 +38,9 @@ func SetReceipt(req *http.Request, eduAPI api.EDUServerInputAPI, device *userapi
 		"timestamp":   timestamp,
 	}).Debug("Setting receipt")
 
-	// currently only m.read is accepted
-	if receiptType != "m.read" {
-		return util.MessageResponse(400, fmt.Sprintf("receipt type must be m.read not '%s'", receiptType))
+	// m.read.private receipts are only visible to the user who sent them
+	if receiptType != "m.read" && receiptType != "m.read.private" {
+		return util.MessageResponse(400, fmt.Sprintf("receipt type must be m.read or m.read.private not '%s'", receiptType))
 	}
 
 	if err := api.SendReceipt(req.Context(), eduAPI, device.UserID, roomId, eventId, receiptType, timestamp); err != nil {
@@ -0,0 +1,98 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMS  int64  `json:"expires_in_ms"`
+}
+
+// Refresh implements POST /refresh, which swaps a refresh token for a new
+// access token and a new refresh token. Each refresh token can only be used
+// once.
+func Refresh(req *http.Request, userAPI userapi.UserInternalAPI) util.JSONResponse {
+	var r refreshRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.RefreshToken == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("'refresh_token' must be supplied."),
+		}
+	}
+
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+	refreshToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var res userapi.PerformTokenRefreshResponse
+	if err = userAPI.PerformTokenRefresh(req.Context(), &userapi.PerformTokenRefreshRequest{
+		RefreshToken:    r.RefreshToken,
+		NewAccessToken:  accessToken,
+		NewRefreshToken: refreshToken,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformTokenRefresh failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Device == nil {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.UnknownToken("Unknown or expired refresh token"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: refreshResponse{
+			AccessToken:  res.Device.AccessToken,
+			RefreshToken: refreshToken,
+			ExpiresInMS:  accessTokenExpiresInMS(res.Device),
+		},
+	}
+}
+
+// accessTokenExpiresInMS returns how long the device's access token is valid
+// for, or 0 if it never expires.
+func accessTokenExpiresInMS(device *userapi.Device) int64 {
+	if device.AccessTokenExpiresTS == 0 {
+		return 0
+	}
+	return device.AccessTokenExpiresTS - int64(gomatrixserverlib.AsTimestamp(time.Now()))
+}
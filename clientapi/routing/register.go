@@ -39,6 +39,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/threepid"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
@@ -71,11 +72,13 @@ func init() {
 	prometheus.MustRegister(amtRegUsers)
 }
 
-// sessionsDict keeps track of completed auth stages for each session.
+// sessionsDict keeps track of completed auth stages for each session, and
+// anything which the stages need to remember until the session is complete.
 // It shouldn't be passed by value because it contains a mutex.
 type sessionsDict struct {
 	sync.Mutex
 	sessions map[string][]authtypes.LoginType
+	data     map[string]map[authtypes.LoginType]interface{}
 }
 
 // GetCompletedStages returns the completed stages for a session.
@@ -90,9 +93,19 @@ func (d *sessionsDict) GetCompletedStages(sessionID string) []authtypes.LoginTyp
 	return make([]authtypes.LoginType, 0)
 }
 
+// GetStageData returns what an auth stage of a session remembered, or nil if
+// it didn't remember anything.
+func (d *sessionsDict) GetStageData(sessionID string, stage authtypes.LoginType) interface{} {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.data[sessionID][stage]
+}
+
 func newSessionsDict() *sessionsDict {
 	return &sessionsDict{
 		sessions: make(map[string][]authtypes.LoginType),
+		data:     make(map[string]map[authtypes.LoginType]interface{}),
 	}
 }
 
@@ -109,6 +122,18 @@ func AddCompletedSessionStage(sessionID string, stage authtypes.LoginType) {
 	sessions.sessions[sessionID] = append(sessions.sessions[sessionID], stage)
 }
 
+// SetSessionStageData remembers something which an auth stage of a session
+// needs once the session is complete, e.g. the email address it validated.
+func SetSessionStageData(sessionID string, stage authtypes.LoginType, data interface{}) {
+	sessions.Lock()
+	defer sessions.Unlock()
+
+	if sessions.data[sessionID] == nil {
+		sessions.data[sessionID] = make(map[authtypes.LoginType]interface{})
+	}
+	sessions.data[sessionID][stage] = data
+}
+
 var (
 	// TODO: Remove old sessions. Need to do so on a session-specific timeout.
 	// sessions stores the completed flow stages for all sessions. Referenced using their sessionID.
@@ -138,6 +163,9 @@ type registerRequest struct {
 	// Prevent this user from logging in
 	InhibitLogin eventutil.WeakBoolean `json:"inhibit_login"`
 
+	// Whether the client supports refresh tokens
+	RefreshToken bool `json:"refresh_token"`
+
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
@@ -150,6 +178,14 @@ type authDict struct {
 
 	// Recaptcha
 	Response string `json:"response"`
+
+	// Registration token
+	Token string `json:"token"`
+
+	// Email
+	ThreePIDCreds threepid.Credentials `json:"threepid_creds"`
+	// Deprecated in favour of threepid_creds, but still sent by some clients
+	ThreePIDCredsCamel threepid.Credentials `json:"threepidCreds"`
 	// TODO: Lots of custom keys depending on the type
 }
 
@@ -175,10 +211,12 @@ func newUserInteractiveResponse(
 
 // http://matrix.org/speculator/spec/HEAD/client_server/unstable.html#post-matrix-client-unstable-register
 type registerResponse struct {
-	UserID      string                       `json:"user_id"`
-	AccessToken string                       `json:"access_token,omitempty"`
-	HomeServer  gomatrixserverlib.ServerName `json:"home_server"`
-	DeviceID    string                       `json:"device_id,omitempty"`
+	UserID       string                       `json:"user_id"`
+	AccessToken  string                       `json:"access_token,omitempty"`
+	HomeServer   gomatrixserverlib.ServerName `json:"home_server"`
+	DeviceID     string                       `json:"device_id,omitempty"`
+	RefreshToken string                       `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64                        `json:"expires_in_ms,omitempty"`
 }
 
 // recaptchaResponse represents the HTTP response from a Google Recaptcha server
@@ -427,8 +465,19 @@ func validateApplicationService(
 		}
 	}
 
+	// Check that the user isn't in an exclusive namespace of another application service
+	for _, appservice := range cfg.Derived.ApplicationServices {
+		if appservice.ID != matchedApplicationService.ID && appservice.OwnsNamespaceCoveringUserId(userID) {
+			return "", &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.ASExclusive(fmt.Sprintf(
+					"Supplied username %s is reserved by application service ID: %s", username, appservice.ID)),
+			}
+		}
+	}
+
 	// Check this user does not fit multiple application service namespaces
-	if UsernameMatchesMultipleExclusiveNamespaces(cfg, userID) {
+	if UsernameMatchesMultipleExclusiveNamespaces(cfg, username) {
 		return "", &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.ASExclusive(fmt.Sprintf(
@@ -459,6 +508,12 @@ func Register(
 		return *resErr
 	}
 	if req.URL.Query().Get("kind") == "guest" {
+		if cfg.GuestsDisabled {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("Guest registration is disabled"),
+			}
+		}
 		return handleGuestRegistration(req, r, cfg, userAPI)
 	}
 
@@ -525,7 +580,7 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accessToken, accessTokenErr)
+	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI, accountDB, accessToken, accessTokenErr)
 }
 
 func handleGuestRegistration(
@@ -591,6 +646,7 @@ func handleRegistrationFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
 	accessToken string,
 	accessTokenErr error,
 ) util.JSONResponse {
@@ -601,7 +657,7 @@ func handleRegistrationFlow(
 	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
 
-	// TODO: email / msisdn auth types.
+	// TODO: msisdn auth type.
 
 	// Appservices are special and are not affected by disabled
 	// registration or user exclusivity. We'll go onto the appservice
@@ -632,7 +688,36 @@ func handleRegistrationFlow(
 		}
 	}
 
-	switch r.Auth.Type {
+	// Stages which the session has already completed don't need to be
+	// completed again, e.g. if the client is retrying with another username.
+	authType := r.Auth.Type
+	completed := sessions.GetCompletedStages(sessionID)
+	if stageCompleted(completed, authType) {
+		authType = ""
+	}
+
+	switch authType {
+	case authtypes.LoginTypeRegistrationToken, authtypes.LoginTypeRecaptcha,
+		authtypes.LoginTypeTerms, authtypes.LoginTypeEmail, authtypes.LoginTypeDummy:
+		if !isNextStage(completed, authType, cfg.Derived.Registration.Flows) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(fmt.Sprintf("%s isn't the next stage of any registration flow", authType)),
+			}
+		}
+	}
+
+	switch authType {
+	case authtypes.LoginTypeRegistrationToken:
+		if resErr := checkRegistrationToken(req.Context(), accountDB, r.Auth.Token); resErr != nil {
+			return *resErr
+		}
+
+		// Remember the token so that it can be used once the account is created.
+		// It's only counted as used then, so it must be checked again.
+		SetSessionStageData(sessionID, authtypes.LoginTypeRegistrationToken, r.Auth.Token)
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRegistrationToken)
+
 	case authtypes.LoginTypeRecaptcha:
 		// Check given captcha response
 		resErr := validateRecaptcha(cfg, r.Auth.Response, req.RemoteAddr)
@@ -643,6 +728,26 @@ func handleRegistrationFlow(
 		// Add Recaptcha to the list of completed registration stages
 		AddCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
 
+	case authtypes.LoginTypeTerms:
+		// The client only submits this stage once the user has accepted the
+		// policies in the params.
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeTerms)
+
+	case authtypes.LoginTypeEmail:
+		creds := r.Auth.ThreePIDCreds
+		if creds.SID == "" {
+			creds = r.Auth.ThreePIDCredsCamel
+		}
+		email, resErr := validatedEmail(req.Context(), userAPI, cfg, creds)
+		if resErr != nil {
+			return *resErr
+		}
+
+		// Remember the email address so that it can be associated with the
+		// account once it's created
+		SetSessionStageData(sessionID, authtypes.LoginTypeEmail, email)
+		AddCompletedSessionStage(sessionID, authtypes.LoginTypeEmail)
+
 	case authtypes.LoginTypeSharedSecret:
 		// Check shared secret against config
 		valid, err := isValidMacLogin(cfg, r.Username, r.Password, r.Admin, r.Auth.Mac)
@@ -677,7 +782,7 @@ func handleRegistrationFlow(
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
 	return checkAndCompleteFlow(sessions.GetCompletedStages(sessionID),
-		req, r, sessionID, cfg, userAPI)
+		req, r, sessionID, cfg, userAPI, accountDB)
 }
 
 // handleApplicationServiceRegistration handles the registration of an
@@ -719,7 +824,7 @@ func handleApplicationServiceRegistration(
 	// application service registration is entirely separate.
 	return completeRegistration(
 		req.Context(), userAPI, r.Username, "", appserviceID, req.RemoteAddr, req.UserAgent(),
-		r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+		r.InhibitLogin, r.RefreshToken, r.InitialDisplayName, r.DeviceID,
 	)
 }
 
@@ -733,13 +838,63 @@ func checkAndCompleteFlow(
 	sessionID string,
 	cfg *config.ClientAPI,
 	userAPI userapi.UserInternalAPI,
+	accountDB accounts.Database,
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
-		return completeRegistration(
+		email, _ := sessions.GetStageData(sessionID, authtypes.LoginTypeEmail).(string)
+		if email != "" {
+			localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), email, "email")
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+				return jsonerror.InternalServerError()
+			}
+			if localpart != "" {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.MatrixError{
+						ErrCode: "M_THREEPID_IN_USE",
+						Err:     accounts.Err3PIDInUse.Error(),
+					},
+				}
+			}
+		}
+		token, _ := sessions.GetStageData(sessionID, authtypes.LoginTypeRegistrationToken).(string)
+		if token != "" {
+			used, err := accountDB.UseRegistrationToken(req.Context(), token, time.Now().UnixNano()/int64(time.Millisecond))
+			if err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.UseRegistrationToken failed")
+				return jsonerror.InternalServerError()
+			}
+			if !used {
+				// The token was used up by other registrations, or deleted,
+				// since this session checked it.
+				if resErr := checkRegistrationToken(req.Context(), accountDB, token); resErr != nil {
+					return *resErr
+				}
+				return util.JSONResponse{
+					Code: http.StatusUnauthorized,
+					JSON: jsonerror.Forbidden("The registration token can't be used"),
+				}
+			}
+		}
+		res := completeRegistration(
 			req.Context(), userAPI, r.Username, r.Password, "", req.RemoteAddr, req.UserAgent(),
-			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+			r.InhibitLogin, r.RefreshToken, r.InitialDisplayName, r.DeviceID,
 		)
+		if token != "" && res.Code != http.StatusOK {
+			// The account wasn't created, so the token wasn't really used.
+			if err := accountDB.ReleaseRegistrationToken(req.Context(), token); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.ReleaseRegistrationToken failed")
+			}
+		}
+		if email != "" && res.Code == http.StatusOK {
+			if err := accountDB.SaveThreePIDAssociation(req.Context(), email, r.Username, "email"); err != nil {
+				// The account has been created, so don't fail the registration.
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveThreePIDAssociation failed")
+			}
+		}
+		return res
 	}
 
 	// There are still more stages to complete.
@@ -761,7 +916,7 @@ func completeRegistration(
 	ctx context.Context,
 	userAPI userapi.UserInternalAPI,
 	username, password, appserviceID, ipAddr, userAgent string,
-	inhibitLogin eventutil.WeakBoolean,
+	inhibitLogin eventutil.WeakBoolean, refreshToken bool,
 	displayName, deviceID *string,
 ) util.JSONResponse {
 	if username == "" {
@@ -822,6 +977,16 @@ func completeRegistration(
 		}
 	}
 
+	var refresh string
+	if refreshToken {
+		if refresh, err = auth.GenerateAccessToken(); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: jsonerror.Unknown("Failed to generate refresh token"),
+			}
+		}
+	}
+
 	var devRes userapi.PerformDeviceCreationResponse
 	err = userAPI.PerformDeviceCreation(ctx, &userapi.PerformDeviceCreationRequest{
 		Localpart:         username,
@@ -830,6 +995,7 @@ func completeRegistration(
 		DeviceID:          deviceID,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
+		RefreshToken:      refresh,
 	}, &devRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -841,10 +1007,12 @@ func completeRegistration(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: registerResponse{
-			UserID:      devRes.Device.UserID,
-			AccessToken: devRes.Device.AccessToken,
-			HomeServer:  accRes.Account.ServerName,
-			DeviceID:    devRes.Device.ID,
+			UserID:       devRes.Device.UserID,
+			AccessToken:  devRes.Device.AccessToken,
+			HomeServer:   accRes.Account.ServerName,
+			DeviceID:     devRes.Device.ID,
+			RefreshToken: refresh,
+			ExpiresInMS:  accessTokenExpiresInMS(devRes.Device),
 		},
 	}
 }
@@ -928,6 +1096,33 @@ func checkFlows(
 	return true
 }
 
+// stageCompleted returns true if the stage is one of the completed stages.
+func stageCompleted(completed []authtypes.LoginType, stage authtypes.LoginType) bool {
+	for _, s := range completed {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+// isNextStage returns true if the stage is the first one which hasn't been
+// completed in any of the flows, so that the stages of a flow are completed
+// in order.
+func isNextStage(completed []authtypes.LoginType, stage authtypes.LoginType, flows []authtypes.Flow) bool {
+	for _, flow := range flows {
+		for _, s := range flow.Stages {
+			if !stageCompleted(completed, s) {
+				if s == stage {
+					return true
+				}
+				break
+			}
+		}
+	}
+	return false
+}
+
 // checkFlowCompleted checks if a registration flow complies with any allowed flow
 // dictated by the server. Order of stages does not matter. A user may complete
 // extra stages as long as the required stages of at least one flow is met.
@@ -20,6 +20,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
 )
 
 var (
@@ -135,6 +136,26 @@ func TestFlowCheckingExtraneousIncorrectInput(t *testing.T) {
 	}
 }
 
+// Stages must be completed in the order of one of the flows.
+func TestFlowCheckingNextStage(t *testing.T) {
+	for _, tc := range []struct {
+		completed []authtypes.LoginType
+		stage     authtypes.LoginType
+		want      bool
+	}{
+		{nil, "stage1", true},
+		{nil, "stage2", false},
+		{[]authtypes.LoginType{"stage1"}, "stage2", true},
+		{[]authtypes.LoginType{"stage1"}, "stage3", true},
+		{[]authtypes.LoginType{"stage1"}, "stage4", false},
+		{[]authtypes.LoginType{"stage2"}, "stage3", false},
+	} {
+		if got := isNextStage(tc.completed, tc.stage, allowedFlows); got != tc.want {
+			t.Errorf("isNextStage(%v, %s): got %v, want %v", tc.completed, tc.stage, got, tc.want)
+		}
+	}
+}
+
 // Completed flows stages should always be a valid slice header.
 // TestEmptyCompletedFlows checks that sessionsDict returns a slice & not nil.
 func TestEmptyCompletedFlows(t *testing.T) {
@@ -208,3 +229,73 @@ func TestValidationOfApplicationServices(t *testing.T) {
 		t.Errorf("user_id should not have been valid: @_something_else:localhost")
 	}
 }
+
+// This method tests that application services can't register users or create
+// aliases within the exclusive namespaces of other application services, even
+// when their own namespaces overlap with them.
+func TestOverlappingApplicationServiceNamespaces(t *testing.T) {
+	namespace := func(regex string, exclusive bool) config.ApplicationServiceNamespace {
+		return config.ApplicationServiceNamespace{
+			Exclusive:    exclusive,
+			Regex:        regex,
+			RegexpObject: regexp.MustCompile(regex),
+		}
+	}
+	exclusiveAS := config.ApplicationService{
+		ID:              "ExclusiveAS",
+		ASToken:         "exclusive_token",
+		SenderLocalpart: "_irc_bot",
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users":   {namespace("@_irc_.*", true)},
+			"aliases": {namespace("#_irc_.*", true)},
+		},
+	}
+	overlappingAS := config.ApplicationService{
+		ID:              "OverlappingAS",
+		ASToken:         "overlapping_token",
+		SenderLocalpart: "_bridge_bot",
+		NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+			"users":   {namespace("@_.*", false)},
+			"aliases": {namespace("#_.*", false)},
+		},
+	}
+
+	fakeConfig := &config.Dendrite{}
+	fakeConfig.Defaults()
+	fakeConfig.Global.ServerName = "localhost"
+	fakeConfig.ClientAPI.Derived.ApplicationServices = []config.ApplicationService{exclusiveAS, overlappingAS}
+
+	for _, tc := range []struct {
+		username string
+		token    string
+		wantAS   string
+	}{
+		{"_irc_alice", "exclusive_token", "ExclusiveAS"},
+		{"_irc_alice", "overlapping_token", ""},
+		{"_bridge_alice", "overlapping_token", "OverlappingAS"},
+		{"_bridge_alice", "exclusive_token", ""},
+	} {
+		asID, resp := validateApplicationService(&fakeConfig.ClientAPI, tc.username, tc.token)
+		if asID != tc.wantAS || (resp == nil) != (tc.wantAS != "") {
+			t.Errorf("registering %s with %s: got AS %q, want %q", tc.username, tc.token, asID, tc.wantAS)
+		}
+	}
+
+	for _, tc := range []struct {
+		appserviceID string
+		alias        string
+		wantAllowed  bool
+	}{
+		{"ExclusiveAS", "#_irc_room:localhost", true},
+		{"OverlappingAS", "#_irc_room:localhost", false},
+		{"", "#_irc_room:localhost", false},
+		{"OverlappingAS", "#_bridge_room:localhost", true},
+		{"", "#room:localhost", true},
+	} {
+		device := &api.Device{UserID: "@someone:localhost", AppserviceID: tc.appserviceID}
+		resErr := checkAliasNotReserved(&fakeConfig.ClientAPI, device, tc.alias)
+		if allowed := resErr == nil; allowed != tc.wantAllowed {
+			t.Errorf("creating %s as %q: got allowed %v, want %v", tc.alias, tc.appserviceID, allowed, tc.wantAllowed)
+		}
+	}
+}
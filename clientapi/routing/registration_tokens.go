@@ -0,0 +1,280 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/rand"
+	"math/big"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+const (
+	registrationTokenChars         = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789._~-"
+	defaultRegistrationTokenLength = 16
+	maxRegistrationTokenLength     = 64
+)
+
+// validRegistrationTokenRegex is the format of registration tokens, as in MSC3231.
+var validRegistrationTokenRegex = regexp.MustCompile(`^[A-Za-z0-9._~\-]{1,64}$`)
+
+// registrationTokenProblem returns why the registration token can't be used,
+// or an empty string if it can.
+func registrationTokenProblem(token *api.RegistrationToken, nowMS int64) string {
+	switch {
+	case token == nil:
+		return "Unknown registration token"
+	case token.ExpiryTime != nil && *token.ExpiryTime <= nowMS:
+		return "The registration token has expired"
+	case token.UsesAllowed != nil && token.Completed >= *token.UsesAllowed:
+		return "The registration token has already been used as many times as it allows"
+	}
+	return ""
+}
+
+// checkRegistrationToken returns an error response if the registration token
+// can't be used to register.
+func checkRegistrationToken(ctx context.Context, accountDB accounts.Database, token string) *util.JSONResponse {
+	t, err := accountDB.GetRegistrationToken(ctx, token)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if problem := registrationTokenProblem(t, time.Now().UnixNano()/int64(time.Millisecond)); problem != "" {
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Forbidden(problem),
+		}
+	}
+	return nil
+}
+
+// RegistrationTokenValidity implements GET /v1/register/m.login.registration_token/validity
+func RegistrationTokenValidity(req *http.Request, accountDB accounts.Database, cfg *config.ClientAPI) util.JSONResponse {
+	if cfg.RegistrationDisabled || !cfg.RegistrationRequiresToken {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Registration tokens aren't used on this server"),
+		}
+	}
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("Missing token"),
+		}
+	}
+	t, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Valid bool `json:"valid"`
+		}{registrationTokenProblem(t, time.Now().UnixNano()/int64(time.Millisecond)) == ""},
+	}
+}
+
+type adminRegistrationToken struct {
+	Token       string `json:"token"`
+	UsesAllowed *int32 `json:"uses_allowed"`
+	Completed   int32  `json:"completed"`
+	ExpiryTime  *int64 `json:"expiry_time"`
+}
+
+func toAdminRegistrationToken(token *api.RegistrationToken) adminRegistrationToken {
+	return adminRegistrationToken{
+		Token:       token.Token,
+		UsesAllowed: token.UsesAllowed,
+		Completed:   token.Completed,
+		ExpiryTime:  token.ExpiryTime,
+	}
+}
+
+// GetAdminRegistrationTokens implements GET /admin/registration_tokens
+func GetAdminRegistrationTokens(
+	req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, device *api.Device,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+	tokens, err := accountDB.GetRegistrationTokens(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationTokens failed")
+		return jsonerror.InternalServerError()
+	}
+	res := struct {
+		RegistrationTokens []adminRegistrationToken `json:"registration_tokens"`
+	}{make([]adminRegistrationToken, 0, len(tokens))}
+	for i := range tokens {
+		res.RegistrationTokens = append(res.RegistrationTokens, toAdminRegistrationToken(&tokens[i]))
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+type adminCreateRegistrationTokenRequest struct {
+	// The token to create, or empty to generate one of Length characters
+	Token       string `json:"token"`
+	Length      int    `json:"length"`
+	UsesAllowed *int32 `json:"uses_allowed"`
+	ExpiryTime  *int64 `json:"expiry_time"`
+}
+
+// AdminCreateRegistrationToken implements POST /admin/registration_tokens/new
+func AdminCreateRegistrationToken(
+	req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, device *api.Device,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+	var r adminCreateRegistrationTokenRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Token != "" && !validRegistrationTokenRegex.MatchString(r.Token) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("token must consist of up to 64 of the characters A-Z, a-z, 0-9, '.', '_', '~' and '-'"),
+		}
+	}
+	if r.Length < 0 || r.Length > maxRegistrationTokenLength {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("length must be between 1 and 64"),
+		}
+	}
+	if r.UsesAllowed != nil && *r.UsesAllowed < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("uses_allowed must not be negative"),
+		}
+	}
+	if r.ExpiryTime != nil && *r.ExpiryTime <= time.Now().UnixNano()/int64(time.Millisecond) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("expiry_time must be in the future"),
+		}
+	}
+
+	token := &api.RegistrationToken{
+		Token:       r.Token,
+		UsesAllowed: r.UsesAllowed,
+		ExpiryTime:  r.ExpiryTime,
+	}
+	if token.Token == "" {
+		length := r.Length
+		if length == 0 {
+			length = defaultRegistrationTokenLength
+		}
+		var err error
+		if token.Token, err = generateRegistrationToken(length); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("generateRegistrationToken failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	created, err := accountDB.CreateRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.CreateRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if !created {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("The registration token already exists"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: toAdminRegistrationToken(token),
+	}
+}
+
+// GetAdminRegistrationToken implements GET /admin/registration_tokens/{token}
+func GetAdminRegistrationToken(
+	req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, device *api.Device, token string,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+	t, err := accountDB.GetRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if t == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Registration token not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: toAdminRegistrationToken(t),
+	}
+}
+
+// AdminDeleteRegistrationToken implements DELETE /admin/registration_tokens/{token}
+func AdminDeleteRegistrationToken(
+	req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, device *api.Device, token string,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+	deleted, err := accountDB.DeleteRegistrationToken(req.Context(), token)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.DeleteRegistrationToken failed")
+		return jsonerror.InternalServerError()
+	}
+	if !deleted {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Registration token not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// generateRegistrationToken returns a random registration token of the given
+// length.
+func generateRegistrationToken(length int) (string, error) {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(registrationTokenChars)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = registrationTokenChars[n.Int64()]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,101 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAdminRegistrationTokens(t *testing.T) {
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "localhost", bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS, config.DefaultLoginTokenLifetimeMS)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.ClientAPI.AdminUsers = []string{"@admin:localhost"}
+	cfg.ClientAPI.RegistrationRequiresToken = true
+	admin := &api.Device{UserID: "@admin:localhost"}
+	user := &api.Device{UserID: "@alice:localhost"}
+	create := func(device *api.Device, body string) (int, adminRegistrationToken) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/admin/registration_tokens/new", strings.NewReader(body))
+		res := AdminCreateRegistrationToken(req, &cfg.ClientAPI, accountDB, device)
+		token, _ := res.JSON.(adminRegistrationToken)
+		return res.Code, token
+	}
+	valid := func(token string) bool {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/v1/register/m.login.registration_token/validity?token="+token, nil)
+		res := RegistrationTokenValidity(req, accountDB, &cfg.ClientAPI)
+		if res.Code != http.StatusOK {
+			t.Fatalf("validity of %s: got HTTP %d", token, res.Code)
+		}
+		b, _ := json.Marshal(res.JSON)
+		return string(b) == `{"valid":true}`
+	}
+
+	if code, _ := create(user, `{}`); code != http.StatusForbidden {
+		t.Errorf("non-admin creating a token: got HTTP %d, want 403", code)
+	}
+	code, generated := create(admin, `{"length": 20}`)
+	if code != http.StatusOK || len(generated.Token) != 20 || !validRegistrationTokenRegex.MatchString(generated.Token) {
+		t.Errorf("generating a token: got HTTP %d with %+v", code, generated)
+	}
+	code, limited := create(admin, `{"token": "once", "uses_allowed": 1}`)
+	if code != http.StatusOK || limited.Token != "once" || limited.UsesAllowed == nil || *limited.UsesAllowed != 1 {
+		t.Errorf("creating a token: got HTTP %d with %+v", code, limited)
+	}
+	for _, body := range []string{
+		`{"token": "once"}`,
+		`{"token": "not valid"}`,
+		`{"uses_allowed": -1}`,
+		`{"expiry_time": 1}`,
+	} {
+		if code, _ := create(admin, body); code != http.StatusBadRequest {
+			t.Errorf("creating a token with %s: got HTTP %d, want 400", body, code)
+		}
+	}
+
+	if !valid("once") || valid("unknown") {
+		t.Errorf("got the wrong validity for the tokens")
+	}
+	if resErr := checkRegistrationToken(httptest.NewRequest(http.MethodGet, "/", nil).Context(), accountDB, "once"); resErr != nil {
+		t.Errorf("unused token was rejected: %+v", resErr.JSON)
+	}
+	if used, err := accountDB.UseRegistrationToken(httptest.NewRequest(http.MethodGet, "/", nil).Context(), "once", 0); err != nil || !used {
+		t.Fatalf("UseRegistrationToken: got %v, %v", used, err)
+	}
+	if valid("once") {
+		t.Errorf("token which has been used up is still valid")
+	}
+	resErr := checkRegistrationToken(httptest.NewRequest(http.MethodGet, "/", nil).Context(), accountDB, "once")
+	if resErr == nil || resErr.Code != http.StatusUnauthorized || !strings.Contains(resErr.JSON.(error).Error(), "as many times as it allows") {
+		t.Errorf("got %+v for a used up token, want it to be rejected", resErr)
+	}
+
+	list := GetAdminRegistrationTokens(httptest.NewRequest(http.MethodGet, "/admin/registration_tokens", nil), &cfg.ClientAPI, accountDB, admin)
+	b, _ := json.Marshal(list.JSON)
+	if list.Code != http.StatusOK || !strings.Contains(string(b), `"token":"once","uses_allowed":1,"completed":1`) {
+		t.Errorf("listing tokens: got HTTP %d with %s", list.Code, b)
+	}
+	req := httptest.NewRequest(http.MethodDelete, "/admin/registration_tokens/once", nil)
+	if res := AdminDeleteRegistrationToken(req, &cfg.ClientAPI, accountDB, user, "once"); res.Code != http.StatusForbidden {
+		t.Errorf("non-admin deleting a token: got HTTP %d, want 403", res.Code)
+	}
+	if res := AdminDeleteRegistrationToken(req, &cfg.ClientAPI, accountDB, admin, "once"); res.Code != http.StatusOK {
+		t.Errorf("deleting a token: got HTTP %d", res.Code)
+	}
+	if res := GetAdminRegistrationToken(req, &cfg.ClientAPI, accountDB, admin, "once"); res.Code != http.StatusNotFound {
+		t.Errorf("getting a deleted token: got HTTP %d, want 404", res.Code)
+	}
+}
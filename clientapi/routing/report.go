@@ -0,0 +1,200 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+const defaultEventReportsLimit = 100
+
+type reportEventRequest struct {
+	Reason string `json:"reason"`
+	Score  *int64 `json:"score"`
+}
+
+// ReportEvent implements POST /rooms/{roomID}/report/{eventID}
+func ReportEvent(
+	req *http.Request, device *api.Device, roomID, eventID string,
+	accountDB accounts.Database, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var r reportEventRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Score != nil && (*r.Score < -100 || *r.Score > 0) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("score must be between -100 and 0"),
+		}
+	}
+
+	// Users can only report events in rooms which they are in, and which the
+	// history visibility of the room allows them to see.
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("The event was not found or you are not in the room"),
+	}
+	var membershipRes roomserverAPI.QueryMembershipForUserResponse
+	err := rsAPI.QueryMembershipForUser(req.Context(), &roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if !membershipRes.IsInRoom {
+		return notFound
+	}
+
+	var eventsRes roomserverAPI.QueryEventsByIDResponse
+	err = rsAPI.QueryEventsByID(req.Context(), &roomserverAPI.QueryEventsByIDRequest{
+		EventIDs:          []string{eventID},
+		ExcludeSoftFailed: true,
+	}, &eventsRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryEventsByID failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(eventsRes.Events) == 0 || eventsRes.Events[0].RoomID() != roomID {
+		return notFound
+	}
+	visible, err := roomserverAPI.IsEventVisibleTo(req.Context(), rsAPI, device.UserID, true, eventsRes.Events[0])
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("roomserverAPI.IsEventVisibleTo failed")
+		return jsonerror.InternalServerError()
+	}
+	if !visible {
+		return notFound
+	}
+
+	// The event is stored with the report, since it may be purged before an
+	// admin gets round to looking at the report.
+	_, err = accountDB.InsertEventReport(req.Context(), &api.EventReport{
+		RoomID:     roomID,
+		EventID:    eventID,
+		UserID:     device.UserID,
+		Reason:     r.Reason,
+		Score:      r.Score,
+		EventJSON:  eventsRes.Events[0].JSON(),
+		ReceivedTS: time.Now().UnixNano() / int64(time.Millisecond),
+	})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.InsertEventReport failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+type adminEventReport struct {
+	ID         int64           `json:"id"`
+	RoomID     string          `json:"room_id"`
+	EventID    string          `json:"event_id"`
+	UserID     string          `json:"user_id"`
+	Reason     string          `json:"reason"`
+	Score      *int64          `json:"score"`
+	EventJSON  json.RawMessage `json:"event_json"`
+	ReceivedTS int64           `json:"received_ts"`
+}
+
+type adminEventReportsResponse struct {
+	EventReports []adminEventReport `json:"event_reports"`
+	// The offset of the next page, if there is one
+	NextToken *int64 `json:"next_token,omitempty"`
+	Total     int64  `json:"total"`
+}
+
+// GetAdminEventReports implements GET /admin/event_reports. Reports are
+// paginated with the from offset and limit, listed newest first unless dir
+// is "f", and can be filtered by room_id and by the reporting user_id.
+func GetAdminEventReports(
+	req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, device *api.Device,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+	query := req.URL.Query()
+	from, limit := int64(0), int64(defaultEventReportsLimit)
+	var err error
+	if s := query.Get("from"); s != "" {
+		if from, err = strconv.ParseInt(s, 10, 64); err != nil || from < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("from must be a non-negative integer"),
+			}
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		if limit, err = strconv.ParseInt(s, 10, 64); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("limit must be a positive integer"),
+			}
+		}
+	}
+	dir := query.Get("dir")
+	if dir != "" && dir != "b" && dir != "f" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("dir must be either 'b' or 'f'"),
+		}
+	}
+
+	reports, total, err := accountDB.GetEventReports(
+		req.Context(), query.Get("room_id"), query.Get("user_id"), from, limit, dir == "f",
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetEventReports failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminEventReportsResponse{
+		EventReports: make([]adminEventReport, 0, len(reports)),
+		Total:        total,
+	}
+	for _, r := range reports {
+		res.EventReports = append(res.EventReports, adminEventReport{
+			ID:         r.ID,
+			RoomID:     r.RoomID,
+			EventID:    r.EventID,
+			UserID:     r.UserID,
+			Reason:     r.Reason,
+			Score:      r.Score,
+			EventJSON:  r.EventJSON,
+			ReceivedTS: r.ReceivedTS,
+		})
+	}
+	if next := from + int64(len(reports)); next < total {
+		res.NextToken = &next
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
@@ -0,0 +1,113 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/test"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testReportRoomID = "!room:localhost"
+
+var testReportRoom = test.NewRoom(testReportRoomID)
+
+// testReportRoomserverAPI serves a single event, with the given current
+// members and the given state before the event.
+type testReportRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	event   *gomatrixserverlib.HeaderedEvent
+	members map[string]bool
+	state   []*gomatrixserverlib.HeaderedEvent
+}
+
+func (r *testReportRoomserverAPI) QueryMembershipForUser(
+	ctx context.Context, req *roomserverAPI.QueryMembershipForUserRequest, res *roomserverAPI.QueryMembershipForUserResponse,
+) error {
+	res.IsInRoom = r.members[req.UserID]
+	return nil
+}
+
+func (r *testReportRoomserverAPI) QueryEventsByID(
+	ctx context.Context, req *roomserverAPI.QueryEventsByIDRequest, res *roomserverAPI.QueryEventsByIDResponse,
+) error {
+	for _, eventID := range req.EventIDs {
+		if eventID == r.event.EventID() {
+			res.Events = append(res.Events, r.event)
+		}
+	}
+	return nil
+}
+
+func (r *testReportRoomserverAPI) QueryStateAfterEvents(
+	ctx context.Context, req *roomserverAPI.QueryStateAfterEventsRequest, res *roomserverAPI.QueryStateAfterEventsResponse,
+) error {
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	for _, ev := range r.state {
+		for _, tuple := range req.StateToFetch {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				res.StateEvents = append(res.StateEvents, ev)
+			}
+		}
+	}
+	return nil
+}
+
+type testReportAccountDB struct {
+	accounts.Database
+	reports []*userapi.EventReport
+}
+
+func (d *testReportAccountDB) InsertEventReport(ctx context.Context, report *userapi.EventReport) (int64, error) {
+	d.reports = append(d.reports, report)
+	return int64(len(d.reports)), nil
+}
+
+func TestReportEventChecksHistoryVisibility(t *testing.T) {
+	alice, bob, charlie := "@alice:localhost", "@bob:localhost", "@charlie:localhost"
+	emptyStateKey := ""
+	message := testReportRoom.CreateEvent(t, alice, "m.room.message", nil, map[string]string{"body": "hello"})
+	for _, tc := range []struct {
+		name       string
+		visibility string
+		userID     string
+		wantCode   int
+	}{
+		// Alice was joined when the event was sent, bob joined later and
+		// charlie has never joined.
+		{"joined history, joined at the event", "joined", alice, http.StatusOK},
+		{"joined history, joined after the event", "joined", bob, http.StatusNotFound},
+		{"shared history, joined after the event", "shared", bob, http.StatusOK},
+		{"world readable history, not in the room", "world_readable", charlie, http.StatusNotFound},
+	} {
+		rsAPI := &testReportRoomserverAPI{
+			event:   message,
+			members: map[string]bool{alice: true, bob: true},
+			state: []*gomatrixserverlib.HeaderedEvent{
+				testReportRoom.CreateEvent(t, alice, gomatrixserverlib.MRoomHistoryVisibility, &emptyStateKey, map[string]string{"history_visibility": tc.visibility}),
+				testReportRoom.CreateMemberEvent(t, alice, gomatrixserverlib.Join),
+			},
+		}
+		accountDB := &testReportAccountDB{}
+		req := httptest.NewRequest(http.MethodPost, "/rooms/"+testReportRoomID+"/report/"+message.EventID(), strings.NewReader(`{"reason":"spam"}`))
+		res := ReportEvent(req, &userapi.Device{UserID: tc.userID}, testReportRoomID, message.EventID(), accountDB, rsAPI)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got status %d, want %d", tc.name, res.Code, tc.wantCode)
+			continue
+		}
+		wantReports := 0
+		if res.Code == http.StatusOK {
+			wantReports = 1
+		}
+		if len(accountDB.reports) != wantReports {
+			t.Errorf("%s: got %d reports, want %d", tc.name, len(accountDB.reports), wantReports)
+		}
+	}
+}
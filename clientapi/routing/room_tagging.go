@@ -17,6 +17,7 @@ package routing
 import (
 	"encoding/json"
 	"net/http"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 
@@ -24,10 +25,24 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	"github.com/matrix-org/dendrite/userapi/api"
-	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/util"
 )
 
+// tagContent is the content of the m.tag room account data.
+type tagContent struct {
+	Tags map[string]tagProperties `json:"tags"`
+}
+
+// tagProperties are the properties of a tag. The order is a pointer, since
+// 0 is a valid order which must not be confused with not having one.
+type tagProperties struct {
+	Order *float64 `json:"order,omitempty"`
+}
+
+// tagsMutex serialises changes to tags, since each change reads the room's
+// tags and writes them back, and concurrent changes would otherwise lose tags.
+var tagsMutex sync.Mutex
+
 // GetTags implements GET /_matrix/client/r0/user/{userID}/rooms/{roomID}/tags
 func GetTags(
 	req *http.Request,
@@ -77,10 +92,19 @@ func PutTag(
 		}
 	}
 
-	var properties gomatrix.TagProperties
+	var properties tagProperties
 	if reqErr := httputil.UnmarshalJSONRequest(req, &properties); reqErr != nil {
 		return *reqErr
 	}
+	if properties.Order != nil && (*properties.Order < 0 || *properties.Order > 1) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("order must be between 0 and 1"),
+		}
+	}
+
+	tagsMutex.Lock()
+	defer tagsMutex.Unlock()
 
 	tagContent, err := obtainSavedTags(req, userID, roomID, userAPI)
 	if err != nil {
@@ -88,9 +112,6 @@ func PutTag(
 		return jsonerror.InternalServerError()
 	}
 
-	if tagContent.Tags == nil {
-		tagContent.Tags = make(map[string]gomatrix.TagProperties)
-	}
 	tagContent.Tags[tag] = properties
 
 	if err = saveTagData(req, userID, roomID, userAPI, tagContent); err != nil {
@@ -128,6 +149,9 @@ func DeleteTag(
 		}
 	}
 
+	tagsMutex.Lock()
+	defer tagsMutex.Unlock()
+
 	tagContent, err := obtainSavedTags(req, userID, roomID, userAPI)
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("obtainSavedTags failed")
@@ -168,7 +192,8 @@ func obtainSavedTags(
 	userID string,
 	roomID string,
 	userAPI api.UserInternalAPI,
-) (tags gomatrix.TagContent, err error) {
+) (tags tagContent, err error) {
+	tags.Tags = make(map[string]tagProperties)
 	dataReq := api.QueryAccountDataRequest{
 		UserID:   userID,
 		RoomID:   roomID,
@@ -186,6 +211,9 @@ func obtainSavedTags(
 	if err = json.Unmarshal(data, &tags); err != nil {
 		return
 	}
+	if tags.Tags == nil {
+		tags.Tags = make(map[string]tagProperties)
+	}
 	return tags, nil
 }
 
@@ -195,7 +223,7 @@ func saveTagData(
 	userID string,
 	roomID string,
 	userAPI api.UserInternalAPI,
-	Tag gomatrix.TagContent,
+	Tag tagContent,
 ) error {
 	newTagData, err := json.Marshal(Tag)
 	if err != nil {
@@ -0,0 +1,85 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+type tagsUserAPI struct {
+	api.UserInternalAPI
+	data map[string]json.RawMessage
+}
+
+func (u *tagsUserAPI) QueryAccountData(ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
+	res.RoomAccountData = map[string]map[string]json.RawMessage{req.RoomID: {}}
+	if data, ok := u.data[req.RoomID]; ok {
+		res.RoomAccountData[req.RoomID][req.DataType] = data
+	}
+	return nil
+}
+
+func (u *tagsUserAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
+	u.data[req.RoomID] = req.AccountData
+	return nil
+}
+
+type testSyncProducer struct {
+	sarama.SyncProducer
+	sent int
+}
+
+func (p *testSyncProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.sent++
+	return 0, 0, nil
+}
+
+func TestTags(t *testing.T) {
+	const roomID = "!room:localhost"
+	userAPI := &tagsUserAPI{data: map[string]json.RawMessage{}}
+	producer := &testSyncProducer{}
+	syncProducer := &producers.SyncAPIProducer{Producer: producer}
+	device := &api.Device{UserID: "@alice:localhost"}
+
+	for _, tc := range []struct {
+		tag  string
+		body string
+		code int
+	}{
+		{"m.favourite", `{"order": 0}`, http.StatusOK},
+		{"u.work", `{}`, http.StatusOK},
+		{"m.lowpriority", `{"order": 1.5}`, http.StatusBadRequest},
+		{"m.lowpriority", `{"order": -0.1}`, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest(http.MethodPut, "/tags/"+tc.tag, strings.NewReader(tc.body))
+		if res := PutTag(req, userAPI, device, device.UserID, roomID, tc.tag, syncProducer); res.Code != tc.code {
+			t.Errorf("PutTag(%s, %s): got HTTP %d, want %d", tc.tag, tc.body, res.Code, tc.code)
+		}
+	}
+	if got, want := string(userAPI.data[roomID]), `{"tags":{"m.favourite":{"order":0},"u.work":{}}}`; got != want {
+		t.Errorf("got tags %s, want %s", got, want)
+	}
+
+	req := httptest.NewRequest(http.MethodDelete, "/tags/m.favourite", nil)
+	if res := DeleteTag(req, userAPI, device, device.UserID, roomID, "m.favourite", syncProducer); res.Code != http.StatusOK {
+		t.Errorf("DeleteTag: got HTTP %d", res.Code)
+	}
+	if got, want := string(userAPI.data[roomID]), `{"tags":{"u.work":{}}}`; got != want {
+		t.Errorf("got tags %s, want %s", got, want)
+	}
+	if producer.sent != 3 {
+		t.Errorf("sent %d account data updates to the sync API, want 3", producer.sent)
+	}
+
+	res := GetTags(httptest.NewRequest(http.MethodGet, "/tags", nil), userAPI, device, device.UserID, "!other:localhost", syncProducer)
+	if j, _ := json.Marshal(res.JSON); string(j) != `{"tags":{}}` {
+		t.Errorf("got tags %s for a room without tags", j)
+	}
+}
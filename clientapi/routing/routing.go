@@ -15,16 +15,16 @@
 package routing
 
 import (
-	"encoding/json"
+	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/api"
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	clientutil "github.com/matrix-org/dendrite/clientapi/httputil"
-	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
@@ -37,6 +37,7 @@ import (
 	"github.com/matrix-org/dendrite/userapi/storage/accounts"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 )
 
 // Setup registers HTTP handlers with the given ServeMux. It also supplies the given http.Client
@@ -60,8 +61,18 @@ func Setup(
 	extRoomsProvider api.ExtraPublicRoomsProvider,
 	mscCfg *config.MSCs,
 ) {
-	rateLimits := newRateLimits(&cfg.RateLimiting)
+	rateLimits := newRateLimits(cfg)
+	emailLimits := newEmailRateLimits(&cfg.Email)
 	userInteractiveAuth := auth.NewUserInteractive(accountDB.GetAccountByPassword, cfg)
+	profilePropagator := newProfilePropagator(cfg, accountDB, rsAPI)
+
+	var serverNoticesDevice *userapi.Device
+	if cfg.ServerNotices.Enabled {
+		var err error
+		if serverNoticesDevice, err = serverNoticesSender(context.Background(), cfg, accountDB); err != nil {
+			logrus.WithError(err).Fatal("Failed to set up the server notices user")
+		}
+	}
 
 	unstableFeatures := make(map[string]bool)
 	for _, msc := range cfg.MSCs.MSCs {
@@ -89,6 +100,7 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux := publicAPIMux.PathPrefix("/r0").Subrouter()
+	v1mux := publicAPIMux.PathPrefix("/v1").Subrouter()
 	unstableMux := publicAPIMux.PathPrefix("/unstable").Subrouter()
 
 	r0mux.Handle("/createRoom",
@@ -98,7 +110,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/join/{roomIDOrAlias}",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -111,10 +123,27 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	if mscCfg.Enabled("msc2403") {
+		r0mux.Handle("/knock/{roomIDOrAlias}",
+			httputil.MakeAuthAPI("knock", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
+					return *r
+				}
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return KnockRoomByIDOrAlias(
+					req, device, cfg, rsAPI, vars["roomIDOrAlias"],
+				)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
+
 	if mscCfg.Enabled("msc2753") {
 		r0mux.Handle("/peek/{roomIDOrAlias}",
 			httputil.MakeAuthAPI(gomatrixserverlib.Peek, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-				if r := rateLimits.rateLimit(req); r != nil {
+				if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 					return *r
 				}
 				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -134,7 +163,7 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/join",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -148,7 +177,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/leave",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -182,7 +211,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/invite",
 		httputil.MakeAuthAPI("membership", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -212,6 +241,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device, rateLimitMessageSend); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -221,6 +253,9 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomID}/send/{eventType}/{txnID}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device, rateLimitMessageSend); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -230,16 +265,6 @@ func Setup(
 				nil, cfg, rsAPI, transactionsCache)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
-	r0mux.Handle("/rooms/{roomID}/event/{eventID}",
-		httputil.MakeAuthAPI("rooms_get_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
-			if err != nil {
-				return util.ErrorResponse(err)
-			}
-			return GetEvent(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI, federation)
-		}),
-	).Methods(http.MethodGet, http.MethodOptions)
-
 	r0mux.Handle("/rooms/{roomID}/state", httputil.MakeAuthAPI("room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
@@ -273,6 +298,9 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType:[^/]+/?}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device, rateLimitMessageSend); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -289,6 +317,9 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/state/{eventType}/{stateKey}",
 		httputil.MakeAuthAPI("send_message", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device, rateLimitMessageSend); r != nil {
+				return *r
+			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
@@ -299,14 +330,14 @@ func Setup(
 	).Methods(http.MethodPut, http.MethodOptions)
 
 	r0mux.Handle("/register", httputil.MakeExternalAPI("register", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.rateLimit(req); r != nil {
+		if r := rateLimits.rateLimit(req, nil, rateLimitRegistration); r != nil {
 			return *r
 		}
 		return Register(req, userAPI, accountDB, cfg)
 	})).Methods(http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/register/available", httputil.MakeExternalAPI("registerAvailable", func(req *http.Request) util.JSONResponse {
-		if r := rateLimits.rateLimit(req); r != nil {
+		if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
 			return *r
 		}
 		return RegisterAvailable(req, cfg, accountDB)
@@ -338,9 +369,18 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return RemoveLocalAlias(req, device, vars["roomAlias"], rsAPI)
+			return RemoveLocalAlias(req, device, vars["roomAlias"], cfg, rsAPI)
 		}),
 	).Methods(http.MethodDelete, http.MethodOptions)
+	r0mux.Handle("/rooms/{roomID}/aliases",
+		httputil.MakeAuthAPI("room_aliases", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetAliases(req, device, vars["roomID"], rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/directory/list/room/{roomID}",
 		httputil.MakeExternalAPI("directory_list", func(req *http.Request) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -380,7 +420,7 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/typing/{userID}",
 		httputil.MakeAuthAPI("rooms_typing", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -390,6 +430,19 @@ func Setup(
 			return SendTyping(req, device, vars["roomID"], vars["userID"], accountDB, eduAPI, rsAPI)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/rooms/{roomID}/report/{eventID}",
+		httputil.MakeAuthAPI("rooms_report", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ReportEvent(req, device, vars["roomID"], vars["eventID"], accountDB, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/rooms/{roomID}/redact/{eventID}",
 		httputil.MakeAuthAPI("rooms_redact", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -436,7 +489,7 @@ func Setup(
 
 	r0mux.Handle("/account/whoami",
 		httputil.MakeAuthAPI("whoami", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			return Whoami(req, device)
@@ -444,20 +497,46 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/account/password",
-		httputil.MakeAuthAPI("password", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+		httputil.MakeExternalAPI("password", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
 				return *r
 			}
+			// Users who aren't logged in can reset their password instead.
+			var device *userapi.Device
+			if _, err := auth.ExtractAccessToken(req); err == nil {
+				var resErr *util.JSONResponse
+				if device, resErr = auth.VerifyUserFromRequest(req, userAPI); resErr != nil {
+					return *resErr
+				}
+			}
 			return Password(req, userAPI, accountDB, device, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/account/password/email/requestToken",
+		httputil.MakeExternalAPI("password_request_token", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+				return *r
+			}
+			return RequestPasswordResetEmailToken(req, userAPI, accountDB, cfg, emailLimits)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/password/email/submitToken",
+		httputil.MakeHTMLAPI("password_submit_token", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+				return r
+			}
+			return SubmitPasswordResetEmailToken(w, req, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/account/deactivate",
 		httputil.MakeAuthAPI("deactivate", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
-			return Deactivate(req, userInteractiveAuth, userAPI, device)
+			return Deactivate(req, userInteractiveAuth, userAPI, rsAPI, device, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -465,13 +544,67 @@ func Setup(
 
 	r0mux.Handle("/login",
 		httputil.MakeExternalAPI("login", func(req *http.Request) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, nil, rateLimitLogin); r != nil {
 				return *r
 			}
 			return Login(req, accountDB, userAPI, cfg)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/refresh",
+		httputil.MakeExternalAPI("refresh", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, nil, rateLimitLogin); r != nil {
+				return *r
+			}
+			return Refresh(req, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	if cfg.SSO.Enabled {
+		oidcProvider := auth.NewOIDCProvider(&cfg.SSO.OIDC, &http.Client{Timeout: time.Second * 30})
+		r0mux.Handle("/login/sso/redirect",
+			httputil.MakeHTMLAPI("login_sso_redirect", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+					return r
+				}
+				return SSORedirect(w, req, cfg, oidcProvider)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		r0mux.Handle("/login/sso/callback",
+			httputil.MakeHTMLAPI("login_sso_callback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+					return r
+				}
+				return SSOCallback(w, req, cfg, oidcProvider, accountDB, userAPI)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		r0mux.Handle("/login/sso/fallback",
+			httputil.MakeHTMLAPI("login_sso_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				return SSOFallback(w, req, cfg)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+	}
+
+	if cfg.CAS.Enabled {
+		casProvider := auth.NewCASProvider(&cfg.CAS, &http.Client{Timeout: time.Second * 30})
+		r0mux.Handle("/login/cas/redirect",
+			httputil.MakeHTMLAPI("login_cas_redirect", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+					return r
+				}
+				return CASRedirect(w, req, cfg, casProvider)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		r0mux.Handle("/login/cas/ticket",
+			httputil.MakeHTMLAPI("login_cas_ticket", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+				if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+					return r
+				}
+				return CASTicket(w, req, cfg, casProvider, accountDB, userAPI)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+	}
+
 	r0mux.Handle("/auth/{authType}/fallback/web",
 		httputil.MakeHTMLAPI("auth_fallback", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
 			vars := mux.Vars(req)
@@ -480,24 +613,100 @@ func Setup(
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
 	r0mux.Handle("/pushrules/",
-		httputil.MakeExternalAPI("push_rules", func(req *http.Request) util.JSONResponse {
-			// TODO: Implement push rules API
-			res := json.RawMessage(`{
-					"global": {
-						"content": [],
-						"override": [],
-						"room": [],
-						"sender": [],
-						"underride": []
-					}
-				}`)
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: &res,
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetAllPushRules(req.Context(), device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRulesByScope(req.Context(), vars["scope"], device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRulesByKind(req.Context(), vars["scope"], vars["kind"], device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return GetPushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], device, userAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			query := req.URL.Query()
+			return PutPushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], query.Get("after"), query.Get("before"), req.Body, device, userAPI, syncProducer)
+		}),
+	).Methods(http.MethodPut)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeletePushRuleByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], device, userAPI, syncProducer)
+		}),
+	).Methods(http.MethodDelete)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr}",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPushRuleAttrByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], vars["attr"], device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushrules/{scope}/{kind}/{ruleID}/{attr}",
+		httputil.MakeAuthAPI("push_rules", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return PutPushRuleAttrByRuleID(req.Context(), vars["scope"], vars["kind"], vars["ruleID"], vars["attr"], req.Body, device, userAPI, syncProducer)
+		}),
+	).Methods(http.MethodPut)
+
+	r0mux.Handle("/pushers",
+		httputil.MakeAuthAPI("get_pushers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetPushers(req, device, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/pushers/set",
+		httputil.MakeAuthAPI("set_pushers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
+				return *r
+			}
+			return SetPusher(req, device, userAPI, accountDB)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	// Element user settings
 
 	r0mux.Handle("/profile/{userID}",
@@ -522,14 +731,14 @@ func Setup(
 
 	r0mux.Handle("/profile/{userID}/avatar_url",
 		httputil.MakeAuthAPI("profile_avatar_url", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SetAvatarURL(req, accountDB, device, vars["userID"], cfg, rsAPI)
+			return SetAvatarURL(req, accountDB, device, vars["userID"], cfg, profilePropagator)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	// Browsers use the OPTIONS HTTP method to check if the CORS policy allows
@@ -547,14 +756,14 @@ func Setup(
 
 	r0mux.Handle("/profile/{userID}/displayname",
 		httputil.MakeAuthAPI("profile_displayname", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return SetDisplayName(req, accountDB, device, vars["userID"], cfg, rsAPI)
+			return SetDisplayName(req, accountDB, device, vars["userID"], cfg, profilePropagator)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 	// Browsers use the OPTIONS HTTP method to check if the CORS policy allows
@@ -572,35 +781,107 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/account/3pid/add",
+		httputil.MakeAuthAPI("account_3pid_add", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Add3PID(req, userInteractiveAuth, userAPI, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/3pid/bind",
+		httputil.MakeAuthAPI("account_3pid_bind", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Bind3PID(req, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/3pid/unbind",
+		httputil.MakeAuthAPI("account_3pid_unbind", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Unbind3PID(req, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/3pid/delete",
+		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return Forget3PID(req, accountDB, device, cfg)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	unstableMux.Handle("/account/3pid/delete",
 		httputil.MakeAuthAPI("account_3pid", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return Forget3PID(req, accountDB)
+			return Forget3PID(req, accountDB, device, cfg)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	r0mux.Handle("/{path:(?:account/3pid|register)}/email/requestToken",
+	r0mux.Handle("/account/3pid/email/requestToken",
 		httputil.MakeExternalAPI("account_3pid_request_token", func(req *http.Request) util.JSONResponse {
-			return RequestEmailToken(req, accountDB, cfg)
+			if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+				return *r
+			}
+			return RequestEmailToken(req, userAPI, accountDB, cfg, emailLimits)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/account/3pid/email/submitToken",
+		httputil.MakeHTMLAPI("account_3pid_submit_token", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+				return r
+			}
+			return SubmitEmailToken(w, req, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
+	v1mux.Handle("/register/m.login.registration_token/validity",
+		httputil.MakeExternalAPI("registration_token_validity", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+				return *r
+			}
+			return RegistrationTokenValidity(req, accountDB, cfg)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/register/email/requestToken",
+		httputil.MakeExternalAPI("register_request_token", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+				return *r
+			}
+			return RequestRegistrationEmailToken(req, userAPI, accountDB, cfg, emailLimits)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	// Element logs get flooded unless this is handled
+	r0mux.Handle("/register/email/submitToken",
+		httputil.MakeHTMLAPI("register_submit_token", func(w http.ResponseWriter, req *http.Request) *util.JSONResponse {
+			if r := rateLimits.rateLimit(req, nil, rateLimitGeneral); r != nil {
+				return r
+			}
+			return SubmitRegistrationEmailToken(w, req, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/presence/{userID}/status",
-		httputil.MakeExternalAPI("presence", func(req *http.Request) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+		httputil.MakeAuthAPI("set_presence", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
-			// TODO: Set presence (probably the responsibility of a presence server not clientapi)
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: struct{}{},
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
 			}
+			return SetPresence(req, userAPI, device, vars["userID"])
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
 
+	r0mux.Handle("/presence/{userID}/status",
+		httputil.MakeAuthAPI("get_presence", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetPresence(req, userAPI, vars["userID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/voip/turnServer",
 		httputil.MakeAuthAPI("turn_server", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			return RequestTurnServer(req, device, cfg)
@@ -617,16 +898,6 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/initialSync",
-		httputil.MakeExternalAPI("rooms_initial_sync", func(req *http.Request) util.JSONResponse {
-			// TODO: Allow people to peek into rooms.
-			return util.JSONResponse{
-				Code: http.StatusForbidden,
-				JSON: jsonerror.GuestAccessForbidden("Guest access not implemented"),
-			}
-		}),
-	).Methods(http.MethodGet, http.MethodOptions)
-
 	r0mux.Handle("/user/{userID}/account_data/{type}",
 		httputil.MakeAuthAPI("user_account_data", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -673,13 +944,100 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetAdminWhois(req, userAPI, device, vars["userID"])
+			return GetAdminWhois(req, userAPI, cfg, device, vars["userID"])
+		}),
+	).Methods(http.MethodGet)
+
+	r0mux.Handle("/admin/rooms/{roomID}/storage",
+		httputil.MakeAuthAPI("admin_room_storage", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetAdminRoomStorage(req, cfg, rsAPI, device, vars["roomID"])
 		}),
 	).Methods(http.MethodGet)
 
+	r0mux.Handle("/admin/rooms/{roomID}/evacuate",
+		httputil.MakeAuthAPI("admin_evacuate_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminEvacuateRoom(req, cfg, rsAPI, device, vars["roomID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/admin/rooms/{roomID}/block",
+		httputil.MakeAuthAPI("admin_block_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminBlockRoom(req, cfg, rsAPI, device, vars["roomID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/admin/purge_history/{roomID}",
+		httputil.MakeAuthAPI("admin_purge_history", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return AdminPurgeHistory(req, cfg, rsAPI, device, vars["roomID"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/admin/purge_history_status/{purgeID}",
+		httputil.MakeAuthAPI("admin_purge_history_status", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetAdminPurgeHistoryStatus(req, cfg, rsAPI, device, vars["purgeID"])
+		}),
+	).Methods(http.MethodGet)
+
+	r0mux.Handle("/admin/registration_tokens",
+		httputil.MakeAuthAPI("admin_registration_tokens", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetAdminRegistrationTokens(req, cfg, accountDB, device)
+		}),
+	).Methods(http.MethodGet)
+
+	r0mux.Handle("/admin/registration_tokens/new",
+		httputil.MakeAuthAPI("admin_create_registration_token", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminCreateRegistrationToken(req, cfg, accountDB, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/admin/registration_tokens/{token}",
+		httputil.MakeAuthAPI("admin_registration_token", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			if req.Method == http.MethodDelete {
+				return AdminDeleteRegistrationToken(req, cfg, accountDB, device, vars["token"])
+			}
+			return GetAdminRegistrationToken(req, cfg, accountDB, device, vars["token"])
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	r0mux.Handle("/admin/event_reports",
+		httputil.MakeAuthAPI("admin_event_reports", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return GetAdminEventReports(req, cfg, accountDB, device)
+		}),
+	).Methods(http.MethodGet)
+
+	r0mux.Handle("/admin/send_server_notice",
+		httputil.MakeAuthAPI("admin_send_server_notice", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return SendServerNotice(req, cfg, device, serverNoticesDevice, accountDB, userAPI, rsAPI, asAPI, syncProducer)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/user/{userID}/openid/request_token",
 		httputil.MakeAuthAPI("openid_request_token", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -692,7 +1050,7 @@ func Setup(
 
 	r0mux.Handle("/user_directory/search",
 		httputil.MakeAuthAPI("userdirectory_search", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			postContent := struct {
@@ -715,29 +1073,19 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/members",
-		httputil.MakeAuthAPI("rooms_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
-			if err != nil {
-				return util.ErrorResponse(err)
-			}
-			return GetMemberships(req, device, vars["roomID"], false, cfg, rsAPI)
-		}),
-	).Methods(http.MethodGet, http.MethodOptions)
-
 	r0mux.Handle("/rooms/{roomID}/joined_members",
-		httputil.MakeAuthAPI("rooms_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		httputil.MakeAuthAPI("rooms_joined_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
-			return GetMemberships(req, device, vars["roomID"], true, cfg, rsAPI)
+			return GetJoinedMembers(req, device, vars["roomID"], rsAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/rooms/{roomID}/read_markers",
 		httputil.MakeAuthAPI("rooms_read_markers", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -750,7 +1098,7 @@ func Setup(
 
 	r0mux.Handle("/rooms/{roomID}/forget",
 		httputil.MakeAuthAPI("rooms_forget", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -761,6 +1109,19 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	r0mux.Handle("/rooms/{roomID}/upgrade",
+		httputil.MakeAuthAPI("rooms_upgrade", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UpgradeRoom(req, device, vars["roomID"], rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/devices",
 		httputil.MakeAuthAPI("get_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetDevicesByLocalpart(req, userAPI, device)
@@ -799,7 +1160,7 @@ func Setup(
 
 	r0mux.Handle("/delete_devices",
 		httputil.MakeAuthAPI("delete_devices", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return DeleteDevices(req, userAPI, device)
+			return DeleteDevices(req, userInteractiveAuth, userAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -814,14 +1175,6 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/initialSync",
-		httputil.MakeExternalAPI("initial_sync", func(req *http.Request) util.JSONResponse {
-			return util.JSONResponse{Code: http.StatusOK, JSON: map[string]interface{}{
-				"end": "",
-			}}
-		}),
-	).Methods(http.MethodGet, http.MethodOptions)
-
 	r0mux.Handle("/user/{userId}/rooms/{roomId}/tags",
 		httputil.MakeAuthAPI("get_tags", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -854,10 +1207,10 @@ func Setup(
 
 	r0mux.Handle("/capabilities",
 		httputil.MakeAuthAPI("capabilities", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
-			return GetCapabilities(req, rsAPI)
+			return GetCapabilities(req, cfg, rsAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
@@ -874,9 +1227,94 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/keys/query",
 		httputil.MakeAuthAPI("keys_query", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			return QueryKeys(req, keyAPI)
+			return QueryKeys(req, keyAPI, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
+	// Key Backup Versions (Metadata)
+
+	r0mux.Handle("/room_keys/version",
+		httputil.MakeAuthAPI("create_key_backup_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return CreateKeyBackupVersion(req, userAPI, device)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/room_keys/version",
+		httputil.MakeAuthAPI("get_latest_key_backup_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return KeyBackupVersion(req, userAPI, device, "")
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/room_keys/version/{version}",
+		httputil.MakeAuthAPI("get_key_backup_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return KeyBackupVersion(req, userAPI, device, vars["version"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+	r0mux.Handle("/room_keys/version/{version}",
+		httputil.MakeAuthAPI("put_key_backup_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ModifyKeyBackupVersionAuthData(req, userAPI, device, vars["version"])
+		}),
+	).Methods(http.MethodPut)
+	r0mux.Handle("/room_keys/version/{version}",
+		httputil.MakeAuthAPI("delete_key_backup_version", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return DeleteKeyBackupVersion(req, userAPI, device, vars["version"])
+		}),
+	).Methods(http.MethodDelete)
+
+	// Key Backup Sessions
+
+	for _, path := range []string{"/room_keys/keys", "/room_keys/keys/{roomID}", "/room_keys/keys/{roomID}/{sessionID}"} {
+		r0mux.Handle(path,
+			httputil.MakeAuthAPI("put_backup_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return UploadBackupKeys(req, userAPI, device, vars["roomID"], vars["sessionID"])
+			}),
+		).Methods(http.MethodPut)
+		r0mux.Handle(path,
+			httputil.MakeAuthAPI("get_backup_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return GetBackupKeys(req, userAPI, device, vars["roomID"], vars["sessionID"])
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		r0mux.Handle(path,
+			httputil.MakeAuthAPI("delete_backup_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+				if err != nil {
+					return util.ErrorResponse(err)
+				}
+				return DeleteBackupKeys(req, userAPI, device, vars["roomID"], vars["sessionID"])
+			}),
+		).Methods(http.MethodDelete)
+	}
+
+	// Cross-signing is still referred to by clients under /unstable, so register it on both.
+	for _, m := range []*mux.Router{r0mux, unstableMux} {
+		m.Handle("/keys/device_signing/upload",
+			httputil.MakeAuthAPI("keys_device_signing_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return UploadCrossSigningDeviceKeys(req, userInteractiveAuth, keyAPI, device)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+		m.Handle("/keys/signatures/upload",
+			httputil.MakeAuthAPI("keys_signatures_upload", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+				return UploadCrossSigningSignatures(req, keyAPI, device)
+			}),
+		).Methods(http.MethodPost, http.MethodOptions)
+	}
 	r0mux.Handle("/keys/claim",
 		httputil.MakeAuthAPI("keys_claim", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return ClaimKeys(req, keyAPI)
@@ -884,7 +1322,7 @@ func Setup(
 	).Methods(http.MethodPost, http.MethodOptions)
 	r0mux.Handle("/rooms/{roomId}/receipt/{receiptType}/{eventId}",
 		httputil.MakeAuthAPI(gomatrixserverlib.Join, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-			if r := rateLimits.rateLimit(req); r != nil {
+			if r := rateLimits.rateLimit(req, device, rateLimitGeneral); r != nil {
 				return *r
 			}
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -15,6 +15,8 @@
 package routing
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"sync"
 	"time"
@@ -73,6 +75,10 @@ func SendEvent(
 	rsAPI api.RoomserverInternalAPI,
 	txnCache *transactions.Cache,
 ) util.JSONResponse {
+	if resErr := checkGuestCanSendEvent(device, eventType, stateKey); resErr != nil {
+		return *resErr
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := rsAPI.QueryRoomVersionForRoom(req.Context(), &verReq, &verRes); err != nil {
@@ -123,6 +129,14 @@ func SendEvent(
 		cfg.Matrix.ServerName,
 		txnAndSessionID,
 	); err != nil {
+		// The roomserver may be configured with a lower size limit than
+		// the one checked when building the event.
+		if e, ok := err.(gomatrixserverlib.EventValidationError); ok && e.Code == gomatrixserverlib.EventValidationTooLarge {
+			return util.JSONResponse{
+				Code: http.StatusRequestEntityTooLarge,
+				JSON: jsonerror.TooLarge(e.Error()),
+			}
+		}
 		util.GetLogger(req.Context()).WithError(err).Error("SendEvents failed")
 		return jsonerror.InternalServerError()
 	}
@@ -173,6 +187,12 @@ func generateSendEvent(
 		}
 	}
 
+	if eventType == gomatrixserverlib.MRoomCanonicalAlias && stateKey != nil && *stateKey == "" {
+		if resErr = validateCanonicalAlias(req, r, roomID, cfg, rsAPI); resErr != nil {
+			return nil, resErr
+		}
+	}
+
 	// create the new event and set all the fields we can
 	builder := gomatrixserverlib.EventBuilder{
 		Sender:   userID,
@@ -203,7 +223,7 @@ func generateSendEvent(
 		if e.Code == gomatrixserverlib.EventValidationTooLarge {
 			return nil, &util.JSONResponse{
 				Code: http.StatusRequestEntityTooLarge,
-				JSON: jsonerror.BadJSON(e.Error()),
+				JSON: jsonerror.TooLarge(e.Error()),
 			}
 		}
 		return nil, &util.JSONResponse{
@@ -230,3 +250,55 @@ func generateSendEvent(
 	}
 	return e.Event, nil
 }
+
+// validateCanonicalAlias checks that the aliases in the content of an
+// m.room.canonical_alias event are valid, and that those on this server point
+// at the room. Aliases on other servers aren't checked.
+func validateCanonicalAlias(
+	req *http.Request, content map[string]interface{}, roomID string,
+	cfg *config.ClientAPI, rsAPI api.RoomserverInternalAPI,
+) *util.JSONResponse {
+	raw, err := json.Marshal(content)
+	if err != nil {
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	var aliasContent eventutil.CanonicalAliasContent
+	if err = json.Unmarshal(raw, &aliasContent); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The alias and alt_aliases must be strings"),
+		}
+	}
+	aliases := aliasContent.AltAliases
+	if aliasContent.Alias != "" {
+		aliases = append(aliases, aliasContent.Alias)
+	}
+	for _, alias := range aliases {
+		_, domain, err := gomatrixserverlib.SplitID('#', alias)
+		if err != nil {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam(fmt.Sprintf("Room alias %q must be in the form '#localpart:domain'", alias)),
+			}
+		}
+		if domain != cfg.Matrix.ServerName {
+			continue
+		}
+		var queryRes api.GetRoomIDForAliasResponse
+		if err = rsAPI.GetRoomIDForAlias(req.Context(), &api.GetRoomIDForAliasRequest{
+			Alias: alias,
+		}, &queryRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+		if queryRes.RoomID != roomID {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadAlias(fmt.Sprintf("Room alias %s does not point to the room", alias)),
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// testAliasAPI resolves #room:localhost to !room:localhost.
+type testAliasAPI struct {
+	api.RoomserverInternalAPITrace
+}
+
+func (a *testAliasAPI) GetRoomIDForAlias(
+	ctx context.Context, req *api.GetRoomIDForAliasRequest, res *api.GetRoomIDForAliasResponse,
+) error {
+	if req.Alias == "#room:localhost" {
+		res.RoomID = "!room:localhost"
+	}
+	return nil
+}
+
+func TestValidateCanonicalAlias(t *testing.T) {
+	cfg := &config.ClientAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	req := httptest.NewRequest(http.MethodPut, "/", nil)
+	testCases := []struct {
+		name     string
+		content  map[string]interface{}
+		wantCode int
+	}{
+		{"no aliases", map[string]interface{}{}, 0},
+		{"local alias", map[string]interface{}{"alias": "#room:localhost"}, 0},
+		{"remote alias", map[string]interface{}{"alt_aliases": []string{"#room:remote"}}, 0},
+		{"malformed alias", map[string]interface{}{"alias": "room"}, http.StatusBadRequest},
+		{"unknown alias", map[string]interface{}{"alias": "#other:localhost"}, http.StatusBadRequest},
+		{"unknown alt alias", map[string]interface{}{
+			"alias": "#room:localhost", "alt_aliases": []string{"#other:localhost"},
+		}, http.StatusBadRequest},
+	}
+	for _, tc := range testCases {
+		resErr := validateCanonicalAlias(req, tc.content, "!room:localhost", cfg, &testAliasAPI{})
+		if tc.wantCode == 0 && resErr != nil {
+			t.Errorf("%s: got error %+v, want none", tc.name, resErr.JSON)
+		} else if tc.wantCode != 0 && (resErr == nil || resErr.Code != tc.wantCode) {
+			t.Errorf("%s: got %+v, want code %d", tc.name, resErr, tc.wantCode)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// serverNoticeTag is the tag of the room which server notices are sent to a
+// user in, so that clients can show it specially.
+const serverNoticeTag = "m.server_notice"
+
+// serverNoticesMutex stops concurrent notices to the same user from creating
+// more than one room for them.
+var serverNoticesMutex sync.Mutex
+
+type sendServerNoticeRequest struct {
+	// The user to send the notice to, or all local users if empty
+	UserID  string                 `json:"user_id"`
+	Type    string                 `json:"type"`
+	Content map[string]interface{} `json:"content"`
+}
+
+type sendServerNoticeResponse struct {
+	EventID string `json:"event_id,omitempty"`
+	// The IDs of the notices sent to each user, if the notice was sent to
+	// all local users
+	EventIDs map[string]string `json:"event_ids,omitempty"`
+}
+
+// serverNoticesSender makes sure that the user which sends server notices
+// exists and has the configured profile, and returns a device for it.
+func serverNoticesSender(
+	ctx context.Context, cfg *config.ClientAPI, accountDB accounts.Database,
+) (*userapi.Device, error) {
+	localpart := cfg.ServerNotices.LocalPart
+	// The account has no password, so nobody can log in as it.
+	if _, err := accountDB.CreateAccount(ctx, localpart, "", ""); err != nil && !errors.Is(err, sqlutil.ErrUserExists) {
+		return nil, fmt.Errorf("accountDB.CreateAccount: %w", err)
+	}
+	if err := accountDB.SetDisplayName(ctx, localpart, cfg.ServerNotices.DisplayName); err != nil {
+		return nil, fmt.Errorf("accountDB.SetDisplayName: %w", err)
+	}
+	if err := accountDB.SetAvatarURL(ctx, localpart, cfg.ServerNotices.AvatarURL); err != nil {
+		return nil, fmt.Errorf("accountDB.SetAvatarURL: %w", err)
+	}
+	return &userapi.Device{
+		UserID: userutil.MakeUserID(localpart, cfg.Matrix.ServerName),
+	}, nil
+}
+
+// SendServerNotice implements POST /admin/send_server_notice, which sends the
+// notice to the user, or to every local user if no user ID is given, in their
+// server notice room. The room is created the first time a user is sent a
+// notice, and they are invited to it again if they have left it.
+func SendServerNotice(
+	req *http.Request, cfg *config.ClientAPI, device *userapi.Device, sender *userapi.Device,
+	accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	if resErr := checkAdmin(cfg, device); resErr != nil {
+		return *resErr
+	}
+	if sender == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Server notices are disabled on this server"),
+		}
+	}
+	ctx := req.Context()
+
+	var r sendServerNoticeRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Type == "" {
+		r.Type = "m.room.message"
+	}
+	if r.Content == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("Missing content"),
+		}
+	}
+	if r.Type == "m.room.message" {
+		msgtype, _ := r.Content["msgtype"].(string)
+		body, _ := r.Content["body"].(string)
+		if msgtype == "" || body == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingParam("The content of a message must have a msgtype and body"),
+			}
+		}
+	}
+
+	if r.UserID != "" {
+		_, domain, err := gomatrixserverlib.SplitID('@', r.UserID)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("Invalid user ID"),
+			}
+		}
+		if domain != cfg.Matrix.ServerName || r.UserID == sender.UserID {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam("Server notices can only be sent to local users"),
+			}
+		}
+		eventID, err := sendServerNotice(ctx, cfg, sender, r.UserID, r.Type, r.Content, accountDB, userAPI, rsAPI, asAPI, syncProducer)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("sendServerNotice failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: sendServerNoticeResponse{EventID: eventID},
+		}
+	}
+
+	localparts, err := accountDB.GetActiveLocalparts(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetActiveLocalparts failed")
+		return jsonerror.InternalServerError()
+	}
+	res := sendServerNoticeResponse{EventIDs: make(map[string]string, len(localparts))}
+	for _, localpart := range localparts {
+		userID := userutil.MakeUserID(localpart, cfg.Matrix.ServerName)
+		if userID == sender.UserID {
+			continue
+		}
+		// One user's notice failing shouldn't stop the others from being sent.
+		eventID, err := sendServerNotice(ctx, cfg, sender, userID, r.Type, r.Content, accountDB, userAPI, rsAPI, asAPI, syncProducer)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("user_id", userID).Error("sendServerNotice failed")
+			continue
+		}
+		res.EventIDs[userID] = eventID
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// sendServerNotice sends the event to the user in their server notice room,
+// creating the room or inviting them back to it first if needed.
+func sendServerNotice(
+	ctx context.Context, cfg *config.ClientAPI, sender *userapi.Device,
+	userID, eventType string, content map[string]interface{},
+	accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	syncProducer *producers.SyncAPIProducer,
+) (string, error) {
+	serverNoticesMutex.Lock()
+	defer serverNoticesMutex.Unlock()
+
+	roomID, membership, err := serverNoticeRoom(ctx, rsAPI, sender.UserID, userID)
+	if err != nil {
+		return "", err
+	}
+	switch membership {
+	case "":
+		if roomID, err = createServerNoticeRoom(ctx, cfg, sender, userID, accountDB, userAPI, rsAPI, asAPI, syncProducer); err != nil {
+			return "", err
+		}
+	case gomatrixserverlib.Leave:
+		inviteEvent, err := buildMembershipEvent(
+			ctx, userID, "", accountDB, sender, gomatrixserverlib.Invite,
+			roomID, false, cfg, time.Now(), rsAPI, asAPI,
+		)
+		if err != nil {
+			return "", fmt.Errorf("buildMembershipEvent: %w", err)
+		}
+		if err = roomserverAPI.SendInvite(ctx, rsAPI, inviteEvent, nil, cfg.Matrix.ServerName, nil); err != nil {
+			return "", fmt.Errorf("roomserverAPI.SendInvite: %w", err)
+		}
+	}
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender: sender.UserID,
+		RoomID: roomID,
+		Type:   eventType,
+	}
+	if err = builder.SetContent(content); err != nil {
+		return "", fmt.Errorf("builder.SetContent: %w", err)
+	}
+	ev, err := eventutil.QueryAndBuildEvent(ctx, &builder, cfg.Matrix, time.Now(), rsAPI, nil)
+	if err != nil {
+		return "", fmt.Errorf("eventutil.QueryAndBuildEvent: %w", err)
+	}
+	if err = roomserverAPI.SendEvents(
+		ctx, rsAPI, roomserverAPI.KindNew,
+		[]*gomatrixserverlib.HeaderedEvent{ev},
+		cfg.Matrix.ServerName, nil,
+	); err != nil {
+		return "", fmt.Errorf("roomserverAPI.SendEvents: %w", err)
+	}
+	return ev.EventID(), nil
+}
+
+// serverNoticeRoom returns the room which the sender of server notices shares
+// with the user, and the user's membership of it, or an empty membership if
+// they don't share one. The sender only ever joins server notice rooms.
+func serverNoticeRoom(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, senderID, userID string,
+) (roomID, membership string, err error) {
+	var senderRes roomserverAPI.QueryRoomsForUserResponse
+	if err = rsAPI.QueryRoomsForUser(ctx, &roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         senderID,
+		WantMembership: gomatrixserverlib.Join,
+	}, &senderRes); err != nil {
+		return "", "", fmt.Errorf("rsAPI.QueryRoomsForUser: %w", err)
+	}
+	senderRooms := make(map[string]bool, len(senderRes.RoomIDs))
+	for _, roomID := range senderRes.RoomIDs {
+		senderRooms[roomID] = true
+	}
+	for _, membership = range []string{gomatrixserverlib.Join, gomatrixserverlib.Invite, gomatrixserverlib.Leave} {
+		var userRes roomserverAPI.QueryRoomsForUserResponse
+		if err = rsAPI.QueryRoomsForUser(ctx, &roomserverAPI.QueryRoomsForUserRequest{
+			UserID:         userID,
+			WantMembership: membership,
+		}, &userRes); err != nil {
+			return "", "", fmt.Errorf("rsAPI.QueryRoomsForUser: %w", err)
+		}
+		for _, roomID = range userRes.RoomIDs {
+			if senderRooms[roomID] {
+				return roomID, membership, nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// createServerNoticeRoom creates a server notice room which the user is
+// invited to, and tags it for them. The user can't send events in the room.
+func createServerNoticeRoom(
+	ctx context.Context, cfg *config.ClientAPI, sender *userapi.Device, userID string,
+	accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
+	syncProducer *producers.SyncAPIProducer,
+) (string, error) {
+	r := createRoomRequest{
+		Invite:                    []string{userID},
+		Name:                      cfg.ServerNotices.RoomName,
+		Preset:                    presetPrivateChat,
+		CreationContent:           map[string]interface{}{"m.federate": false},
+		PowerLevelContentOverride: json.RawMessage(`{"users_default":-10}`),
+	}
+	if cfg.ServerNotices.AvatarURL != "" {
+		r.InitialState = append(r.InitialState, fledglingEvent{
+			Type:    "m.room.avatar",
+			Content: map[string]string{"url": cfg.ServerNotices.AvatarURL},
+		})
+	}
+	roomID := fmt.Sprintf("!%s:%s", util.RandomString(16), cfg.Matrix.ServerName)
+	if res := createRoom(ctx, r, sender, cfg, roomID, accountDB, rsAPI, asAPI, time.Now()); res.Code != http.StatusOK {
+		return "", fmt.Errorf("createRoom: %d %+v", res.Code, res.JSON)
+	}
+
+	tags, err := json.Marshal(gomatrix.TagContent{
+		Tags: map[string]gomatrix.TagProperties{serverNoticeTag: {}},
+	})
+	if err != nil {
+		return "", fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err = userAPI.InputAccountData(ctx, &userapi.InputAccountDataRequest{
+		UserID:      userID,
+		RoomID:      roomID,
+		DataType:    "m.tag",
+		AccountData: tags,
+	}, &userapi.InputAccountDataResponse{}); err != nil {
+		return "", fmt.Errorf("userAPI.InputAccountData: %w", err)
+	}
+	// TODO: user API should do this since it's account data
+	if err = syncProducer.SendData(userID, roomID, "m.tag"); err != nil {
+		logrus.WithError(err).Error("Failed to send m.tag account data update to syncapi")
+	}
+	return roomID, nil
+}
@@ -0,0 +1,50 @@
+package routing
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// testRoomsAPI returns the rooms which each user has each membership of.
+type testRoomsAPI struct {
+	api.RoomserverInternalAPITrace
+	rooms map[string]map[string][]string
+}
+
+func (a *testRoomsAPI) QueryRoomsForUser(
+	ctx context.Context, req *api.QueryRoomsForUserRequest, res *api.QueryRoomsForUserResponse,
+) error {
+	res.RoomIDs = a.rooms[req.UserID][req.WantMembership]
+	return nil
+}
+
+func TestServerNoticeRoom(t *testing.T) {
+	const sender = "@_server:localhost"
+	rsAPI := &testRoomsAPI{rooms: map[string]map[string][]string{
+		sender: {gomatrixserverlib.Join: {"!alice:localhost", "!bob:localhost"}},
+		"@alice:localhost": {
+			gomatrixserverlib.Join:  {"!other:localhost"},
+			gomatrixserverlib.Leave: {"!alice:localhost"},
+		},
+		"@bob:localhost":     {gomatrixserverlib.Invite: {"!bob:localhost"}},
+		"@charlie:localhost": {gomatrixserverlib.Join: {"!other:localhost"}},
+	}}
+	for _, tc := range []struct {
+		userID, wantRoomID, wantMembership string
+	}{
+		{"@alice:localhost", "!alice:localhost", gomatrixserverlib.Leave},
+		{"@bob:localhost", "!bob:localhost", gomatrixserverlib.Invite},
+		{"@charlie:localhost", "", ""},
+	} {
+		roomID, membership, err := serverNoticeRoom(context.Background(), rsAPI, sender, tc.userID)
+		if err != nil {
+			t.Fatalf("serverNoticeRoom failed: %s", err)
+		}
+		if roomID != tc.wantRoomID || membership != tc.wantMembership {
+			t.Errorf("%s: got room %q with membership %q, want %q with %q", tc.userID, roomID, membership, tc.wantRoomID, tc.wantMembership)
+		}
+	}
+}
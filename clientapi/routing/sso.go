@@ -0,0 +1,460 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/util"
+)
+
+const (
+	// ssoSessionCookie binds an SSO session to the browser that started it,
+	// so that the callback can't be completed in someone else's browser.
+	ssoSessionCookie = "dendrite_sso_session"
+	// ssoSessionLifetime is how long the user has to log in with the
+	// provider before the SSO session expires.
+	ssoSessionLifetime = 10 * time.Minute
+)
+
+type ssoSession struct {
+	redirectURL string
+	nonce       string
+	expires     time.Time
+}
+
+// ssoSessionsDict keeps track of the SSO logins which are in progress,
+// keyed by the OIDC state parameter.
+// It shouldn't be passed by value because it contains a mutex.
+type ssoSessionsDict struct {
+	sync.Mutex
+	sessions map[string]ssoSession
+}
+
+func newSSOSessionsDict() *ssoSessionsDict {
+	return &ssoSessionsDict{
+		sessions: make(map[string]ssoSession),
+	}
+}
+
+func (d *ssoSessionsDict) add(state string, session ssoSession) {
+	d.Lock()
+	defer d.Unlock()
+	now := time.Now()
+	for k, v := range d.sessions {
+		if now.After(v.expires) {
+			delete(d.sessions, k)
+		}
+	}
+	d.sessions[state] = session
+}
+
+// take removes and returns the SSO session, if it exists and hasn't expired.
+func (d *ssoSessionsDict) take(state string) (ssoSession, bool) {
+	d.Lock()
+	defer d.Unlock()
+	session, ok := d.sessions[state]
+	if !ok {
+		return ssoSession{}, false
+	}
+	delete(d.sessions, state)
+	return session, time.Now().Before(session.expires)
+}
+
+var ssoSessions = newSSOSessionsDict()
+
+// ssoFallbackTemplate is an HTML webpage template for logging in with SSO,
+// which web clients can embed or open in a popup. Once the user has logged
+// in, the login response is passed to window.onLogin if the page defines it,
+// or posted to the client which embedded or opened the page.
+const ssoFallbackTemplate = `
+<html>
+<head>
+<title>Log in</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+<script>
+var loginToken = {{.loginToken}};
+var clientOrigins = {{.clientOrigins}};
+function loginDone(response) {
+    if (window.onLogin) {
+        window.onLogin(response);
+        return;
+    }
+    var target = window.opener || (window.parent !== window ? window.parent : null);
+    if (target && target.postMessage) {
+        // The response contains an access token, so only allow the clients
+        // that SSO may redirect to to receive it.
+        for (var i = 0; i < clientOrigins.length; i++) {
+            target.postMessage(response, clientOrigins[i]);
+        }
+    }
+    document.getElementById("message").textContent =
+        "You may now close this window and return to the application.";
+}
+if (loginToken) {
+    var xhr = new XMLHttpRequest();
+    xhr.open("POST", {{.loginURL}});
+    xhr.setRequestHeader("Content-Type", "application/json");
+    xhr.onload = function() {
+        var response = JSON.parse(xhr.responseText);
+        if (xhr.status !== 200) {
+            document.getElementById("message").textContent =
+                "Login failed: " + (response.error || xhr.status);
+            return;
+        }
+        loginDone(response);
+    };
+    xhr.send(JSON.stringify({type: "m.login.token", token: loginToken}));
+}
+</script>
+</head>
+<body>
+    <div>
+        <p id="message">
+        {{if .loginToken}}Logging in&hellip;{{else}}<a href="{{.redirectURL}}">Log in with single sign-on</a>{{end}}
+        </p>
+    </div>
+</body>
+</html>
+`
+
+// ssoFallbackURL returns the public URL of the SSO fallback page, which is
+// alongside the SSO callback.
+func ssoFallbackURL(cfg *config.ClientAPI) string {
+	return strings.TrimSuffix(cfg.SSO.CallbackURL, "/callback") + "/fallback"
+}
+
+// isRedirectURLAllowed returns true if the client may be sent to the redirect
+// URL after SSO. It must have the same scheme and host as one of the allowed
+// URLs, and a path beneath the path of that allowed URL.
+func isRedirectURLAllowed(allowed []string, redirectURL string) bool {
+	u, err := url.Parse(redirectURL)
+	if err != nil || u.User != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	for _, a := range allowed {
+		au, err := url.Parse(a)
+		if err != nil {
+			continue
+		}
+		if !strings.EqualFold(u.Scheme, au.Scheme) || !strings.EqualFold(u.Host, au.Host) {
+			continue
+		}
+		if u.Path == au.Path || strings.HasPrefix(u.Path, strings.TrimSuffix(au.Path, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// SSORedirect implements GET /login/sso/redirect
+func SSORedirect(
+	w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI, provider *auth.OIDCProvider,
+) *util.JSONResponse {
+	redirectURL := req.URL.Query().Get("redirectUrl")
+	if redirectURL == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("missing redirectUrl"),
+		}
+	}
+	if redirectURL != ssoFallbackURL(cfg) && !isRedirectURLAllowed(cfg.SSO.AllowedRedirectURLs, redirectURL) {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("redirectUrl is not allowed"),
+		}
+	}
+	state, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	nonce, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	authURL, err := provider.AuthorizationURL(req.Context(), cfg.SSO.CallbackURL, state, nonce)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("provider.AuthorizationURL failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	startSSOSession(w, state, cfg.SSO.CallbackURL, ssoSession{
+		redirectURL: redirectURL,
+		nonce:       nonce,
+		expires:     time.Now().Add(ssoSessionLifetime),
+	})
+	http.Redirect(w, req, authURL, http.StatusFound)
+	return nil
+}
+
+// SSOCallback implements GET /login/sso/callback, which the provider
+// redirects the user to once they have logged in. The user is mapped to
+// a Matrix account and sent back to the client with a login token.
+func SSOCallback(
+	w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI, provider *auth.OIDCProvider,
+	accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+) *util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("SSO login failed: " + providerErr),
+		}
+	}
+	session, resErr := takeSSOSession(w, req, query.Get("state"))
+	if resErr != nil {
+		return resErr
+	}
+
+	claims, err := provider.Exchange(ctx, cfg.SSO.CallbackURL, query.Get("code"), session.nonce)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("Failed to verify SSO login")
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("failed to verify SSO login"),
+		}
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("SSO login did not provide a subject"),
+		}
+	}
+	localpart, _ := claims[cfg.SSO.OIDC.LocalpartClaim].(string)
+	displayName, _ := claims[cfg.SSO.OIDC.DisplayNameClaim].(string)
+	account, resErr := getOrCreateSSOAccount(
+		req, cfg, accountDB, userAPI, cfg.SSO.CreateAccounts, "oidc:"+cfg.SSO.OIDC.Issuer, subject, localpart, displayName,
+	)
+	if resErr != nil {
+		return resErr
+	}
+	return completeSSO(w, req, userAPI, account, session.redirectURL)
+}
+
+// getOrCreateSSOAccount returns the account which the user of the identity
+// provider is linked to. If they aren't linked to one yet then an account is
+// created for them with the localpart, and linked to them. Existing accounts
+// are never linked, as the localpart is chosen by the provider rather than
+// proving that the user owns the account.
+func getOrCreateSSOAccount(
+	req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+	createAccounts bool, authProvider, externalID, localpart, displayName string,
+) (*userapi.Account, *util.JSONResponse) {
+	ctx := req.Context()
+	linkedLocalpart, err := accountDB.GetLocalpartForExternalID(ctx, authProvider, externalID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetLocalpartForExternalID failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if linkedLocalpart == "" {
+		return createSSOAccount(req, cfg, accountDB, userAPI, createAccounts, authProvider, externalID, localpart, displayName)
+	}
+	account, err := accountDB.GetAccountByLocalpart(ctx, linkedLocalpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return account, nil
+}
+
+// startSSOSession stores the SSO session and binds it to the user's browser
+// with a cookie, which is sent back to the callback at callbackURL.
+func startSSOSession(w http.ResponseWriter, state, callbackURL string, session ssoSession) {
+	ssoSessions.add(state, session)
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoSessionCookie,
+		Value:    state,
+		Path:     "/_matrix/client",
+		MaxAge:   int(ssoSessionLifetime.Seconds()),
+		Secure:   strings.HasPrefix(callbackURL, "https://"),
+		HttpOnly: true,
+		// The provider redirects back to the callback with a top-level GET,
+		// which Lax cookies are still sent with.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// takeSSOSession removes and returns the SSO session, if it was started in
+// this browser and hasn't expired.
+func takeSSOSession(w http.ResponseWriter, req *http.Request, state string) (ssoSession, *util.JSONResponse) {
+	cookie, err := req.Cookie(ssoSessionCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		return ssoSession{}, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Forbidden("SSO session was not started in this browser"),
+		}
+	}
+	session, ok := ssoSessions.take(state)
+	if !ok {
+		return ssoSession{}, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Forbidden("SSO session is unknown or has expired"),
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   ssoSessionCookie,
+		Path:   "/_matrix/client",
+		MaxAge: -1,
+	})
+	return session, nil
+}
+
+// createSSOAccount creates an account for a user who has logged in with SSO
+// or CAS for the first time, if the server allows it, and links the user of
+// the identity provider to it.
+func createSSOAccount(
+	req *http.Request, cfg *config.ClientAPI, accountDB accounts.Database, userAPI userapi.UserInternalAPI,
+	createAccounts bool, authProvider, externalID, localpart, displayName string,
+) (*userapi.Account, *util.JSONResponse) {
+	ctx := req.Context()
+	if !createAccounts {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("there is no account for this SSO user"),
+		}
+	}
+	localpart = strings.ToLower(localpart)
+	if localpart == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("SSO login did not provide a username"),
+		}
+	}
+	if resErr := validateUsername(localpart); resErr != nil {
+		return nil, resErr
+	}
+	available, err := accountDB.CheckAccountAvailability(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.CheckAccountAvailability failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if !available {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("an account with this username already exists, and isn't linked to this SSO user"),
+		}
+	}
+	if UsernameMatchesExclusiveNamespaces(cfg, localpart) {
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.ASExclusive("This username is reserved by an application service."),
+		}
+	}
+	// The account is created without a password, so that it can only be
+	// logged into with SSO.
+	var accRes userapi.PerformAccountCreationResponse
+	err = userAPI.PerformAccountCreation(ctx, &userapi.PerformAccountCreationRequest{
+		Localpart:   localpart,
+		AccountType: userapi.AccountTypeUser,
+		OnConflict:  userapi.ConflictAbort,
+	}, &accRes)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformAccountCreation failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	amtRegUsers.Inc()
+
+	// The account is only linked once it has been created, so that the user
+	// can't be linked to an account which someone else created first.
+	if err = accountDB.SaveExternalID(ctx, authProvider, externalID, localpart); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.SaveExternalID failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+
+	if displayName != "" {
+		if err = accountDB.SetDisplayName(ctx, localpart, displayName); err != nil {
+			util.GetLogger(ctx).WithError(err).Warn("Failed to set display name of SSO user")
+		}
+	}
+	return accRes.Account, nil
+}
+
+// completeSSO issues a login token for the account and sends the user back
+// to the client, which exchanges the token for an access token using
+// m.login.token.
+func completeSSO(
+	w http.ResponseWriter, req *http.Request, userAPI userapi.UserInternalAPI,
+	account *userapi.Account, clientRedirectURL string,
+) *util.JSONResponse {
+	var tokenRes userapi.PerformLoginTokenCreationResponse
+	err := userAPI.PerformLoginTokenCreation(req.Context(), &userapi.PerformLoginTokenCreationRequest{
+		UserID: account.UserID,
+	}, &tokenRes)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformLoginTokenCreation failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	redirectURL, err := url.Parse(clientRedirectURL)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("url.Parse failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	q := redirectURL.Query()
+	q.Set("loginToken", tokenRes.Token)
+	redirectURL.RawQuery = q.Encode()
+	http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+	return nil
+}
+
+// SSOFallback implements GET /login/sso/fallback
+func SSOFallback(
+	w http.ResponseWriter, req *http.Request, cfg *config.ClientAPI,
+) *util.JSONResponse {
+	fallbackURL := ssoFallbackURL(cfg)
+	clientOrigins := []string{}
+	for _, allowed := range append([]string{fallbackURL}, cfg.SSO.AllowedRedirectURLs...) {
+		if u, err := url.Parse(allowed); err == nil {
+			clientOrigins = append(clientOrigins, u.Scheme+"://"+u.Host)
+		}
+	}
+	t := template.Must(template.New("response").Parse(ssoFallbackTemplate))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := t.Execute(w, map[string]interface{}{
+		"loginToken":    req.URL.Query().Get("loginToken"),
+		"loginURL":      strings.TrimSuffix(fallbackURL, "/sso/fallback"),
+		"redirectURL":   strings.TrimSuffix(fallbackURL, "/fallback") + "/redirect?redirectUrl=" + url.QueryEscape(fallbackURL),
+		"clientOrigins": clientOrigins,
+	}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("t.Execute failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package routing
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+)
+
+func TestIsRedirectURLAllowed(t *testing.T) {
+	allowed := []string{"https://app.example.com/", "https://example.com/client"}
+	for _, tc := range []struct {
+		redirectURL string
+		want        bool
+	}{
+		{"https://app.example.com/", true},
+		{"https://app.example.com/#/login", true},
+		{"https://APP.example.com/home?x=y", true},
+		{"https://example.com/client", true},
+		{"https://example.com/client/login", true},
+		{"https://example.com/clientevil", false},
+		{"https://example.com/", false},
+		{"http://app.example.com/", false},
+		{"https://app.example.com.evil.com/", false},
+		{"https://app.example.com@evil.com/", false},
+		{"https://user@app.example.com/", false},
+		{"//app.example.com/", false},
+		{"javascript://app.example.com/%0Aalert(1)", false},
+		{"/relative", false},
+	} {
+		if got := isRedirectURLAllowed(allowed, tc.redirectURL); got != tc.want {
+			t.Errorf("isRedirectURLAllowed(%q): got %v, want %v", tc.redirectURL, got, tc.want)
+		}
+	}
+}
+
+// testSSOAccountDB stores accounts and the users of identity providers which
+// are linked to them.
+type testSSOAccountDB struct {
+	accounts.Database
+	accounts map[string]*userapi.Account
+	links    map[string]string
+}
+
+func (d *testSSOAccountDB) GetLocalpartForExternalID(ctx context.Context, authProvider, externalID string) (string, error) {
+	return d.links[authProvider+" "+externalID], nil
+}
+
+func (d *testSSOAccountDB) SaveExternalID(ctx context.Context, authProvider, externalID, localpart string) error {
+	d.links[authProvider+" "+externalID] = localpart
+	return nil
+}
+
+func (d *testSSOAccountDB) GetAccountByLocalpart(ctx context.Context, localpart string) (*userapi.Account, error) {
+	account, ok := d.accounts[localpart]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return account, nil
+}
+
+func (d *testSSOAccountDB) CheckAccountAvailability(ctx context.Context, localpart string) (bool, error) {
+	_, ok := d.accounts[localpart]
+	return !ok, nil
+}
+
+type testSSOUserAPI struct {
+	userapi.UserInternalAPI
+	db *testSSOAccountDB
+}
+
+func (a *testSSOUserAPI) PerformAccountCreation(
+	ctx context.Context, req *userapi.PerformAccountCreationRequest, res *userapi.PerformAccountCreationResponse,
+) error {
+	res.Account = &userapi.Account{
+		UserID:    "@" + req.Localpart + ":localhost",
+		Localpart: req.Localpart,
+	}
+	a.db.accounts[req.Localpart] = res.Account
+	return nil
+}
+
+func (a *testSSOUserAPI) PerformLoginTokenCreation(
+	ctx context.Context, req *userapi.PerformLoginTokenCreationRequest, res *userapi.PerformLoginTokenCreationResponse,
+) error {
+	res.Token = "token"
+	return nil
+}
+
+func TestGetOrCreateSSOAccount(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix:  &config.Global{ServerName: "localhost"},
+		Derived: &config.Derived{},
+	}
+	cfg.Derived.ExclusiveApplicationServicesUsernameRegexp = regexp.MustCompile("^$")
+	accountDB := &testSSOAccountDB{
+		accounts: map[string]*userapi.Account{
+			"alice": {UserID: "@alice:localhost", Localpart: "alice"},
+		},
+		links: map[string]string{},
+	}
+	userAPI := &testSSOUserAPI{db: accountDB}
+	req := httptest.NewRequest(http.MethodGet, "/login/sso/callback", nil)
+	const provider = "oidc:https://accounts.example.com"
+
+	for _, tc := range []struct {
+		name           string
+		createAccounts bool
+		subject        string
+		localpart      string
+		wantLocalpart  string
+	}{
+		// The localpart claim of a new user mustn't log them into an existing account.
+		{"takeover", true, "mallory", "alice", ""},
+		{"not allowed to create", false, "bob", "bob", ""},
+		{"create", true, "bob", "Bob", "bob"},
+		// Once linked, the user logs into their account whatever the localpart claim says.
+		{"linked", false, "bob", "alice", "bob"},
+	} {
+		account, resErr := getOrCreateSSOAccount(
+			req, cfg, accountDB, userAPI, tc.createAccounts, provider, tc.subject, tc.localpart, "",
+		)
+		if tc.wantLocalpart == "" {
+			if resErr == nil || resErr.Code != http.StatusForbidden {
+				t.Errorf("%s: expected forbidden, got account %+v", tc.name, account)
+			}
+			continue
+		}
+		if resErr != nil {
+			t.Errorf("%s: got error %+v", tc.name, resErr.JSON)
+			continue
+		}
+		if account.Localpart != tc.wantLocalpart {
+			t.Errorf("%s: got account %q, want %q", tc.name, account.Localpart, tc.wantLocalpart)
+		}
+	}
+	if got := accountDB.links[provider+" mallory"]; got != "" {
+		t.Errorf("expected mallory not to be linked, got %q", got)
+	}
+}
@@ -15,8 +15,15 @@
 package routing
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
+	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -30,24 +37,42 @@ import (
 )
 
 type reqTokenResponse struct {
-	SID string `json:"sid"`
+	SID       string `json:"sid"`
+	SubmitURL string `json:"submit_url,omitempty"`
 }
 
 type threePIDsResponse struct {
 	ThreePIDs []authtypes.ThreePID `json:"threepids"`
 }
 
-// RequestEmailToken implements:
-//     POST /account/3pid/email/requestToken
-//     POST /register/email/requestToken
-func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *config.ClientAPI) util.JSONResponse {
+// threePIDSubmitPath is where the tokens emailed to users who are adding an
+// email address to their account are submitted.
+const threePIDSubmitPath = "/_matrix/client/r0/account/3pid/email/submitToken"
+
+// RequestEmailToken implements POST /account/3pid/email/requestToken
+func RequestEmailToken(
+	req *http.Request,
+	userAPI api.UserInternalAPI,
+	accountDB accounts.Database,
+	cfg *config.ClientAPI,
+	emailLimits *emailRateLimits,
+) util.JSONResponse {
 	var body threepid.EmailAssociationRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
-
-	var resp reqTokenResponse
-	var err error
+	if err := threepid.ValidateEmail(body.Email); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid email address"),
+		}
+	}
+	if !validClientSecretRegex.MatchString(body.Secret) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("Invalid client_secret"),
+		}
+	}
 
 	// Check if the 3PID is already in use locally
 	localpart, err := accountDB.GetLocalpartForThreePID(req.Context(), body.Email, "email")
@@ -55,32 +80,71 @@ func RequestEmailToken(req *http.Request, accountDB accounts.Database, cfg *conf
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
 		return jsonerror.InternalServerError()
 	}
-
 	if len(localpart) > 0 {
+		return threePIDInUse()
+	}
+
+	return requestEmailValidation(req.Context(), userAPI, cfg, emailLimits, body, threePIDSubmitPath, "Validate your email address")
+}
+
+// SubmitEmailToken implements GET and POST /account/3pid/email/submitToken.
+func SubmitEmailToken(
+	w http.ResponseWriter, req *http.Request, userAPI api.UserInternalAPI,
+) *util.JSONResponse {
+	return submitEmailToken(w, req, userAPI,
+		"Your email address has been validated. You may now return to the application to add it to your account.",
+	)
+}
+
+// registrationSubmitPath is where the tokens emailed to users who are
+// registering are submitted.
+const registrationSubmitPath = "/_matrix/client/r0/register/email/submitToken"
+
+// RequestRegistrationEmailToken implements POST /register/email/requestToken
+func RequestRegistrationEmailToken(
+	req *http.Request,
+	userAPI api.UserInternalAPI,
+	accountDB accounts.Database,
+	cfg *config.ClientAPI,
+	emailLimits *emailRateLimits,
+) util.JSONResponse {
+	ctx := req.Context()
+	var body threepid.EmailAssociationRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if err := threepid.ValidateEmail(body.Email); err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.MatrixError{
-				ErrCode: "M_THREEPID_IN_USE",
-				Err:     accounts.Err3PIDInUse.Error(),
-			},
+			JSON: jsonerror.InvalidParam("Invalid email address"),
 		}
 	}
-
-	resp.SID, err = threepid.CreateSession(req.Context(), body, cfg)
-	if err == threepid.ErrNotTrusted {
+	if !validClientSecretRegex.MatchString(body.Secret) {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
-			JSON: jsonerror.NotTrusted(body.IDServer),
+			JSON: jsonerror.InvalidParam("Invalid client_secret"),
 		}
-	} else if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("threepid.CreateSession failed")
-		return jsonerror.InternalServerError()
 	}
 
-	return util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: resp,
+	localpart, err := accountDB.GetLocalpartForThreePID(ctx, body.Email, "email")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
 	}
+	if localpart != "" {
+		return threePIDInUse()
+	}
+
+	return requestEmailValidation(ctx, userAPI, cfg, emailLimits, body, registrationSubmitPath, "Validate your email address")
+}
+
+// SubmitRegistrationEmailToken implements GET and POST /register/email/submitToken.
+func SubmitRegistrationEmailToken(
+	w http.ResponseWriter, req *http.Request, userAPI api.UserInternalAPI,
+) *util.JSONResponse {
+	return submitEmailToken(w, req, userAPI,
+		"Your email address has been validated. You may now return to the application to finish registering.",
+	)
 }
 
 // CheckAndSave3PIDAssociation implements POST /account/3pid
@@ -88,6 +152,9 @@ func CheckAndSave3PIDAssociation(
 	req *http.Request, accountDB accounts.Database, device *api.Device,
 	cfg *config.ClientAPI,
 ) util.JSONResponse {
+	if !cfg.UserChanges.ThreePIDs {
+		return threePIDChangesDisabled()
+	}
 	var body threepid.EmailAssociationCheckRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
@@ -115,29 +182,101 @@ func CheckAndSave3PIDAssociation(
 		}
 	}
 
+	// Save the association in the database
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if err = accountDB.SaveThreePIDAssociation(req.Context(), address, localpart, medium); err == accounts.Err3PIDInUse {
+		return threePIDInUse()
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountsDB.SaveThreePIDAssociation failed")
+		return jsonerror.InternalServerError()
+	}
+
 	if body.Bind {
-		// Publish the association on the identity server if requested
-		err = threepid.PublishAssociation(body.Creds, device.UserID, cfg)
-		if err == threepid.ErrNotTrusted {
-			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.NotTrusted(body.Creds.IDServer),
+		// Publish the association on the identity server if requested. If
+		// that fails then the association isn't kept, so that the client
+		// can try again.
+		if resErr := bindThreePID(req.Context(), accountDB, cfg, body.Creds, localpart, device.UserID); resErr != nil {
+			if err = accountDB.RemoveThreePIDAssociation(req.Context(), address, medium); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
 			}
-		} else if err != nil {
-			util.GetLogger(req.Context()).WithError(err).Error("threepid.PublishAssociation failed")
-			return jsonerror.InternalServerError()
+			return *resErr
 		}
 	}
 
-	// Save the association in the database
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+type add3PIDRequest struct {
+	SID    string `json:"sid"`
+	Secret string `json:"client_secret"`
+}
+
+// Add3PID implements POST /account/3pid/add, which adds an email address that
+// the user has validated with this server to their account.
+func Add3PID(
+	req *http.Request, userInteractiveAuth *auth.UserInteractive, userAPI api.UserInternalAPI,
+	accountDB accounts.Database, device *api.Device, cfg *config.ClientAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	if !cfg.UserChanges.ThreePIDs {
+		return threePIDChangesDisabled()
+	}
+	if !cfg.Email.Enabled {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("This server doesn't validate email addresses itself"),
+		}
+	}
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read: " + err.Error()),
+		}
+	}
+	var body add3PIDRequest
+	if err = json.Unmarshal(bodyBytes, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	// The user must re-authenticate as themselves, so that a stolen access
+	// token can't be used to add an email address and reset the password.
+	login, resErr := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	if resErr != nil {
+		return *resErr
+	}
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
 		return jsonerror.InternalServerError()
 	}
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Authenticated as a different user to the one adding the email address"),
+		}
+	}
 
-	if err = accountDB.SaveThreePIDAssociation(req.Context(), address, localpart, medium); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("accountsDB.SaveThreePIDAssociation failed")
+	email, resErr := validatedEmail(ctx, userAPI, cfg, threepid.Credentials{SID: body.SID, Secret: body.Secret})
+	if resErr != nil {
+		return *resErr
+	}
+	if err = accountDB.SaveThreePIDAssociation(ctx, email, localpart, "email"); err == accounts.Err3PIDInUse {
+		return threePIDInUse()
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.SaveThreePIDAssociation failed")
 		return jsonerror.InternalServerError()
 	}
 
@@ -147,6 +286,151 @@ func CheckAndSave3PIDAssociation(
 	}
 }
 
+// Bind3PID implements POST /account/3pid/bind
+func Bind3PID(
+	req *http.Request, accountDB accounts.Database, device *api.Device, cfg *config.ClientAPI,
+) util.JSONResponse {
+	var body threepid.Credentials
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	if body.IDServer == "" || body.SID == "" || body.Secret == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("id_server, sid and client_secret must all be supplied"),
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if resErr := bindThreePID(req.Context(), accountDB, cfg, body, localpart, device.UserID); resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+type unbind3PIDRequest struct {
+	IDServer string `json:"id_server"`
+	authtypes.ThreePID
+}
+
+type unbind3PIDResponse struct {
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// Unbind3PID implements POST /account/3pid/unbind
+func Unbind3PID(
+	req *http.Request, accountDB accounts.Database, device *api.Device, cfg *config.ClientAPI,
+) util.JSONResponse {
+	var body unbind3PIDRequest
+	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
+		return *reqErr
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	result, resErr := unbindThreePID(req.Context(), accountDB, cfg, localpart, device.UserID, body.IDServer, body.Medium, body.Address)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: unbind3PIDResponse{result},
+	}
+}
+
+// bindThreePID publishes the association between the validated third-party
+// identifier and the user on the identity server, and records that it has
+// done so, so that the association can be removed again later.
+func bindThreePID(
+	ctx context.Context, accountDB accounts.Database, cfg *config.ClientAPI,
+	creds threepid.Credentials, localpart, userID string,
+) *util.JSONResponse {
+	threePID, err := threepid.PublishAssociation(ctx, creds, userID, cfg)
+	if err == threepid.ErrNotTrusted {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotTrusted(creds.IDServer),
+		}
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("threepid.PublishAssociation failed")
+		return &util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to bind the third-party identifier on the identity server"),
+		}
+	}
+	if err = accountDB.SaveThreePIDIDServer(ctx, localpart, threePID.Medium, threePID.Address, creds.IDServer); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.SaveThreePIDIDServer failed")
+		// We wouldn't know to remove the association from the identity server
+		// later, so remove it now.
+		if err = threepid.UnpublishAssociation(ctx, creds.IDServer, userID, threePID.Medium, threePID.Address, cfg); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("threepid.UnpublishAssociation failed")
+		}
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
+
+// unbindThreePID removes the association between the third-party identifier
+// and the user from the identity server, or from all of the identity servers
+// which it was bound on if idServer is empty. Returns the id_server_unbind_result
+// for the client: "no-support" if an identity server doesn't support unbinding,
+// or we don't know of any identity servers to unbind from.
+// If an identity server can't be reached, it is still recorded as having the
+// association, so that the client can try again.
+func unbindThreePID(
+	ctx context.Context, accountDB accounts.Database, cfg *config.ClientAPI,
+	localpart, userID, idServer, medium, address string,
+) (string, *util.JSONResponse) {
+	idServers := []string{idServer}
+	if idServer == "" {
+		var err error
+		if idServers, err = accountDB.GetThreePIDIDServers(ctx, localpart, medium, address); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.GetThreePIDIDServers failed")
+			resErr := jsonerror.InternalServerError()
+			return "", &resErr
+		}
+		if len(idServers) == 0 {
+			return "no-support", nil
+		}
+	}
+
+	result := "success"
+	for _, server := range idServers {
+		err := threepid.UnpublishAssociation(ctx, server, userID, medium, address, cfg)
+		switch err {
+		case nil:
+		case threepid.ErrUnbindNotSupported:
+			result = "no-support"
+		case threepid.ErrNotTrusted:
+			return "", &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.NotTrusted(server),
+			}
+		default:
+			util.GetLogger(ctx).WithError(err).Error("threepid.UnpublishAssociation failed")
+			return "", &util.JSONResponse{
+				Code: http.StatusBadGateway,
+				JSON: jsonerror.Unknown("Failed to unbind the third-party identifier from the identity server " + server),
+			}
+		}
+		if err = accountDB.RemoveThreePIDIDServer(ctx, localpart, medium, address, server); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.RemoveThreePIDIDServer failed")
+			resErr := jsonerror.InternalServerError()
+			return "", &resErr
+		}
+	}
+	return result, nil
+}
+
 // GetAssociated3PIDs implements GET /account/3pid
 func GetAssociated3PIDs(
 	req *http.Request, accountDB accounts.Database, device *api.Device,
@@ -169,20 +453,220 @@ func GetAssociated3PIDs(
 	}
 }
 
-// Forget3PID implements POST /account/3pid/delete
-func Forget3PID(req *http.Request, accountDB accounts.Database) util.JSONResponse {
-	var body authtypes.ThreePID
+// Forget3PID implements POST /account/3pid/delete. The association is also
+// removed from identity servers, and it is only removed from the account once
+// that has been done, so that the client can try again if it fails.
+func Forget3PID(
+	req *http.Request, accountDB accounts.Database, device *api.Device, cfg *config.ClientAPI,
+) util.JSONResponse {
+	if !cfg.UserChanges.ThreePIDs {
+		return threePIDChangesDisabled()
+	}
+	var body unbind3PIDRequest
 	if reqErr := httputil.UnmarshalJSONRequest(req, &body); reqErr != nil {
 		return *reqErr
 	}
 
-	if err := accountDB.RemoveThreePIDAssociation(req.Context(), body.Address, body.Medium); err != nil {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	owner, err := accountDB.GetLocalpartForThreePID(req.Context(), body.Address, body.Medium)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetLocalpartForThreePID failed")
+		return jsonerror.InternalServerError()
+	}
+	if owner != localpart {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("The third-party identifier is not associated with your account"),
+		}
+	}
+
+	result, resErr := unbindThreePID(req.Context(), accountDB, cfg, localpart, device.UserID, body.IDServer, body.Medium, body.Address)
+	if resErr != nil {
+		return *resErr
+	}
+	if err = accountDB.RemoveThreePIDAssociation(req.Context(), body.Address, body.Medium); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
 		return jsonerror.InternalServerError()
 	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: struct{}{},
+		JSON: unbind3PIDResponse{result},
+	}
+}
+
+func threePIDInUse() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusBadRequest,
+		JSON: jsonerror.MatrixError{
+			ErrCode: "M_THREEPID_IN_USE",
+			Err:     accounts.Err3PIDInUse.Error(),
+		},
+	}
+}
+
+func threePIDChangesDisabled() util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("Third-party identifier changes are disabled on this server"),
+	}
+}
+
+// validatedEmail returns the email address which the client has validated,
+// either with this server or with an identity server, or an error response
+// if it hasn't validated one. Sessions with this server can only be used once.
+func validatedEmail(
+	ctx context.Context, userAPI api.UserInternalAPI, cfg *config.ClientAPI, creds threepid.Credentials,
+) (string, *util.JSONResponse) {
+	var email string
+	if cfg.Email.Enabled {
+		var res api.PerformEmailSessionConsumptionResponse
+		if err := userAPI.PerformEmailSessionConsumption(ctx, &api.PerformEmailSessionConsumptionRequest{
+			SessionID:    creds.SID,
+			ClientSecret: creds.Secret,
+		}, &res); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("userAPI.PerformEmailSessionConsumption failed")
+			resErr := jsonerror.InternalServerError()
+			return "", &resErr
+		}
+		email = res.Email
+	} else {
+		verified, address, medium, err := threepid.CheckAssociation(ctx, creds, cfg)
+		if err == threepid.ErrNotTrusted {
+			return "", &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.NotTrusted(creds.IDServer),
+			}
+		} else if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("threepid.CheckAssociation failed")
+			resErr := jsonerror.InternalServerError()
+			return "", &resErr
+		}
+		if verified && medium == "email" {
+			email = address
+		}
+	}
+	if email == "" {
+		return "", &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.Forbidden("The email address has not been validated"),
+		}
+	}
+	return email, nil
+}
+
+// requestEmailValidation starts a session to validate the email address. If
+// this server sends emails then it emails a link to submitPath, otherwise it
+// asks the identity server to send the email.
+func requestEmailValidation(
+	ctx context.Context,
+	userAPI api.UserInternalAPI,
+	cfg *config.ClientAPI,
+	emailLimits *emailRateLimits,
+	body threepid.EmailAssociationRequest,
+	submitPath, subject string,
+) util.JSONResponse {
+	if !cfg.Email.Enabled {
+		sid, err := threepid.CreateSession(ctx, body, cfg)
+		if err == threepid.ErrNotTrusted {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.NotTrusted(body.IDServer),
+			}
+		} else if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("threepid.CreateSession failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: reqTokenResponse{SID: sid},
+		}
+	}
+
+	var res api.PerformEmailSessionCreationResponse
+	if err := userAPI.PerformEmailSessionCreation(ctx, &api.PerformEmailSessionCreationRequest{
+		ClientSecret: body.Secret,
+		Email:        body.Email,
+		SendAttempt:  body.SendAttempt,
+		ExpiresAtMS:  time.Now().Add(time.Duration(cfg.Email.SessionLifetimeMS)*time.Millisecond).UnixNano() / int64(time.Millisecond),
+	}, &res); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.PerformEmailSessionCreation failed")
+		return jsonerror.InternalServerError()
+	}
+	submitURL := strings.TrimSuffix(cfg.Email.PublicBaseURL, "/") + submitPath
+	if res.Send {
+		if resErr := emailLimits.rateLimit(body.Email); resErr != nil {
+			return *resErr
+		}
+		link := submitURL + "?" + url.Values{
+			"sid":           {res.SessionID},
+			"client_secret": {body.Secret},
+			"token":         {res.Token},
+		}.Encode()
+		if err := threepid.SendValidationEmail(&cfg.Email, body.Email, subject, link); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("threepid.SendValidationEmail failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: reqTokenResponse{
+			SID:       res.SessionID,
+			SubmitURL: submitURL,
+		},
+	}
+}
+
+type submitTokenRequest struct {
+	SID          string `json:"sid"`
+	ClientSecret string `json:"client_secret"`
+	Token        string `json:"token"`
+}
+
+// submitEmailToken validates an email validation session with the token which
+// was emailed to the user. The link in the email opens the page with GET, and
+// clients which ask the user to enter the token POST it instead.
+func submitEmailToken(
+	w http.ResponseWriter, req *http.Request, userAPI api.UserInternalAPI, validatedMessage string,
+) *util.JSONResponse {
+	var r submitTokenRequest
+	if req.Method == http.MethodPost {
+		if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+			return resErr
+		}
+	} else {
+		query := req.URL.Query()
+		r.SID, r.ClientSecret, r.Token = query.Get("sid"), query.Get("client_secret"), query.Get("token")
+	}
+
+	var res api.PerformEmailSessionValidationResponse
+	if err := userAPI.PerformEmailSessionValidation(req.Context(), &api.PerformEmailSessionValidationRequest{
+		SessionID:    r.SID,
+		ClientSecret: r.ClientSecret,
+		Token:        r.Token,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformEmailSessionValidation failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	if req.Method == http.MethodPost {
+		return &util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				Success bool `json:"success"`
+			}{res.Validated},
+		}
+	}
+	if !res.Validated {
+		return writeHTTPMessage(w, req,
+			"The link is invalid or has expired. Please request a new email.",
+			http.StatusBadRequest,
+		)
 	}
+	return writeHTTPMessage(w, req, validatedMessage, http.StatusOK)
 }
@@ -0,0 +1,79 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	roomserverVersion "github.com/matrix-org/dendrite/roomserver/version"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type upgradeRoomRequest struct {
+	NewVersion string `json:"new_version"`
+}
+
+type upgradeRoomResponse struct {
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// UpgradeRoom implements POST /rooms/{roomID}/upgrade
+func UpgradeRoom(
+	req *http.Request, device *userapi.Device,
+	roomID string, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	var r upgradeRoomRequest
+	if rErr := httputil.UnmarshalJSONRequest(req, &r); rErr != nil {
+		return *rErr
+	}
+	if r.NewVersion == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("Missing new_version"),
+		}
+	}
+	newVersion := gomatrixserverlib.RoomVersion(r.NewVersion)
+	if _, err := roomserverVersion.SupportedRoomVersion(newVersion); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UnsupportedRoomVersion(err.Error()),
+		}
+	}
+
+	upgradeRes := roomserverAPI.PerformRoomUpgradeResponse{}
+	rsAPI.PerformRoomUpgrade(req.Context(), &roomserverAPI.PerformRoomUpgradeRequest{
+		RoomID:      roomID,
+		UserID:      device.UserID,
+		RoomVersion: newVersion,
+	}, &upgradeRes)
+	if upgradeRes.Error != nil {
+		if upgradeRes.Error.Code == 0 {
+			util.GetLogger(req.Context()).WithError(upgradeRes.Error).Error("rsAPI.PerformRoomUpgrade failed")
+		}
+		return upgradeRes.Error.JSONResponse()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: upgradeRoomResponse{
+			ReplacementRoom: upgradeRes.NewRoomID,
+		},
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package threepid
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// ErrInvalidEmail is returned when an email address can't be parsed, or
+// contains more than a bare address.
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// ValidateEmail checks that the email address is a single, bare address
+// which is safe to use in the headers of an email.
+func ValidateEmail(email string) error {
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || strings.ContainsAny(email, "\r\n") {
+		return ErrInvalidEmail
+	}
+	return nil
+}
+
+// SendValidationEmail emails a link to the address which the user must
+// follow to prove that they own it.
+func SendValidationEmail(cfg *config.Email, to, subject, link string) error {
+	if err := ValidateEmail(to); err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	fmt.Fprintf(&msg, "A request was made using this email address on %s.\r\n\r\n", cfg.PublicBaseURL)
+	fmt.Fprintf(&msg, "To confirm that it was you, follow this link:\r\n\r\n%s\r\n\r\n", link)
+	fmt.Fprintf(&msg, "If you didn't make this request, you can safely ignore this email.\r\n")
+
+	var auth smtp.Auth
+	if cfg.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(cfg.SMTPServer)
+		if err != nil {
+			return fmt.Errorf("net.SplitHostPort: %w", err)
+		}
+		auth = smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)
+	}
+	return smtp.SendMail(cfg.SMTPServer, auth, cfg.From, []string{to}, msg.Bytes())
+}
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
@@ -52,6 +53,9 @@ type idServerLookupResponse struct {
 	Address    string                       `json:"address"`
 	MXID       string                       `json:"mxid"`
 	Signatures map[string]map[string]string `json:"signatures"`
+	// The response as sent by the identity server, which the signatures are
+	// checked against so that fields unknown to us are also covered.
+	raw []byte
 }
 
 // idServerLookupResponse represents the response described at https://matrix.org/docs/spec/client_server/r0.2.0.html#invitation-storage
@@ -163,8 +167,9 @@ func queryIDServer(
 	now := time.Now().UnixNano() / 1000000
 	if lookupRes.NotBefore > now || now > lookupRes.NotAfter {
 		// If the current timestamp isn't in the time frame in which the association
-		// is known to be valid, re-run the query
-		return queryIDServer(ctx, db, cfg, device, body, roomID)
+		// is known to be valid, the identity server's answer can't be trusted
+		err = fmt.Errorf("identity server %s returned an association which isn't currently valid", body.IDServer)
+		return
 	}
 
 	// Check the request signatures and send an error if one isn't valid
@@ -189,15 +194,20 @@ func queryIDServerLookup(ctx context.Context, body *MembershipRequest) (*idServe
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	if resp.StatusCode != http.StatusOK {
 		// TODO: Log the error supplied with the identity server?
-		errMgs := fmt.Sprintf("Failed to ask %s to store an invite for %s", body.IDServer, body.Address)
+		errMgs := fmt.Sprintf("Failed to look up %s on %s", body.Address, body.IDServer)
 		return nil, errors.New(errMgs)
 	}
 
-	var res idServerLookupResponse
-	err = json.NewDecoder(resp.Body).Decode(&res)
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	res := idServerLookupResponse{raw: raw}
+	err = json.Unmarshal(raw, &res)
 	return &res, err
 }
 
@@ -251,6 +261,7 @@ func queryIDServerStoreInvite(
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	if resp.StatusCode != http.StatusOK {
 		errMsg := fmt.Sprintf("Identity server %s responded with a %d error code", body.IDServer, resp.StatusCode)
@@ -277,6 +288,7 @@ func queryIDServerPubKey(ctx context.Context, idServerName string, keyID string)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
 	var pubKeyRes struct {
 		PublicKey gomatrixserverlib.Base64Bytes `json:"public_key"`
@@ -301,14 +313,8 @@ func queryIDServerPubKey(ctx context.Context, idServerName string, keyID string)
 func checkIDServerSignatures(
 	ctx context.Context, body *MembershipRequest, res *idServerLookupResponse,
 ) error {
-	// Mashall the body so we can give it to VerifyJSON
-	marshalledBody, err := json.Marshal(*res)
-	if err != nil {
-		return err
-	}
-
 	signatures, ok := res.Signatures[body.IDServer]
-	if !ok {
+	if !ok || len(signatures) == 0 {
 		return errors.New("No signature for domain " + body.IDServer)
 	}
 
@@ -317,7 +323,7 @@ func checkIDServerSignatures(
 		if err != nil {
 			return err
 		}
-		if err = gomatrixserverlib.VerifyJSON(body.IDServer, gomatrixserverlib.KeyID(keyID), pubKey, marshalledBody); err != nil {
+		if err = gomatrixserverlib.VerifyJSON(body.IDServer, gomatrixserverlib.KeyID(keyID), pubKey, res.raw); err != nil {
 			return err
 		}
 	}
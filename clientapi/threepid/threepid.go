@@ -15,6 +15,7 @@
 package threepid
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -24,7 +25,9 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // EmailAssociationRequest represents the request defined at https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-register-email-requesttoken
@@ -43,11 +46,16 @@ type EmailAssociationCheckRequest struct {
 
 // Credentials represents the "ThreePidCredentials" structure defined at https://matrix.org/docs/spec/client_server/r0.2.0.html#post-matrix-client-r0-account-3pid
 type Credentials struct {
-	SID      string `json:"sid"`
-	IDServer string `json:"id_server"`
-	Secret   string `json:"client_secret"`
+	SID           string `json:"sid"`
+	IDServer      string `json:"id_server"`
+	IDAccessToken string `json:"id_access_token"`
+	Secret        string `json:"client_secret"`
 }
 
+// ErrUnbindNotSupported is returned when an identity server doesn't support
+// unbinding third-party identifiers.
+var ErrUnbindNotSupported = errors.New("identity server does not support unbinding")
+
 // CreateSession creates a session on an identity server.
 // Returns the session's ID.
 // Returns an error if there was a problem sending the request or decoding the
@@ -139,39 +147,114 @@ func CheckAssociation(
 }
 
 // PublishAssociation publishes a validated association between a third-party
-// identifier and a Matrix ID.
+// identifier and a Matrix ID, and returns the third-party identifier.
 // Returns an error if there was a problem sending the request or decoding the
 // response, or if the identity server responded with a non-OK status.
-func PublishAssociation(creds Credentials, userID string, cfg *config.ClientAPI) error {
+func PublishAssociation(
+	ctx context.Context, creds Credentials, userID string, cfg *config.ClientAPI,
+) (*authtypes.ThreePID, error) {
 	if err := isTrusted(creds.IDServer, cfg); err != nil {
-		return err
+		return nil, err
 	}
 
-	postURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/3pid/bind", creds.IDServer)
+	var request *http.Request
+	var err error
+	if creds.IDAccessToken != "" {
+		// The v2 API authenticates the user with the identity server.
+		body, _ := json.Marshal(map[string]string{
+			"sid":           creds.SID,
+			"client_secret": creds.Secret,
+			"mxid":          userID,
+		})
+		postURL := fmt.Sprintf("https://%s/_matrix/identity/v2/3pid/bind", creds.IDServer)
+		if request, err = http.NewRequest(http.MethodPost, postURL, bytes.NewReader(body)); err != nil {
+			return nil, err
+		}
+		request.Header.Add("Content-Type", "application/json")
+		request.Header.Add("Authorization", "Bearer "+creds.IDAccessToken)
+	} else {
+		data := url.Values{}
+		data.Add("sid", creds.SID)
+		data.Add("client_secret", creds.Secret)
+		data.Add("mxid", userID)
+		postURL := fmt.Sprintf("https://%s/_matrix/identity/api/v1/3pid/bind", creds.IDServer)
+		if request, err = http.NewRequest(http.MethodPost, postURL, strings.NewReader(data.Encode())); err != nil {
+			return nil, err
+		}
+		request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	}
 
-	data := url.Values{}
-	data.Add("sid", creds.SID)
-	data.Add("client_secret", creds.Secret)
-	data.Add("mxid", userID)
+	client := http.Client{}
+	resp, err := client.Do(request.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
 
-	request, err := http.NewRequest(http.MethodPost, postURL, strings.NewReader(data.Encode()))
+	// Error if the status isn't OK
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not publish the association on the server %s", creds.IDServer)
+	}
+
+	var threePID authtypes.ThreePID
+	if err = json.NewDecoder(resp.Body).Decode(&threePID); err != nil {
+		return nil, err
+	}
+	return &threePID, nil
+}
+
+// UnpublishAssociation removes the association between a third-party identifier
+// and a Matrix ID from an identity server. The request is signed with this
+// server's key, which proves to the identity server that the Matrix ID belongs
+// to this server.
+// Returns ErrUnbindNotSupported if the identity server doesn't support
+// unbinding, or another error if the identity server couldn't be reached or
+// failed to unbind the association.
+func UnpublishAssociation(
+	ctx context.Context, idServer, userID, medium, address string, cfg *config.ClientAPI,
+) error {
+	if err := isTrusted(idServer, cfg); err != nil {
+		return err
+	}
+
+	fedReq := gomatrixserverlib.NewFederationRequest(
+		http.MethodPost, gomatrixserverlib.ServerName(idServer), "/_matrix/identity/api/v1/3pid/unbind",
+	)
+	if err := fedReq.SetContent(map[string]interface{}{
+		"mxid": userID,
+		"threepid": authtypes.ThreePID{
+			Medium:  medium,
+			Address: address,
+		},
+	}); err != nil {
+		return err
+	}
+	if err := fedReq.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return err
+	}
+	request, err := fedReq.HTTPRequest()
 	if err != nil {
 		return err
 	}
-	request.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	// Identity servers are contacted directly over HTTPS, rather than by
+	// resolving them as Matrix servers.
+	request.URL.Scheme = "https"
 
 	client := http.Client{}
-	resp, err := client.Do(request)
+	resp, err := client.Do(request.WithContext(ctx))
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close() // nolint: errcheck
 
-	// Error if the status isn't OK
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Could not publish the association on the server %s", creds.IDServer)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusNotImplemented:
+		return ErrUnbindNotSupported
+	default:
+		return fmt.Errorf("Could not remove the association from the server %s: HTTP %d", idServer, resp.StatusCode)
 	}
-
-	return nil
 }
 
 // isTrusted checks if a given identity server is part of the list of trusted
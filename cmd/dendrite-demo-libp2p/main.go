@@ -181,6 +181,7 @@ func main() {
 		Client:    createClient(base),
 		FedClient: federation,
 		KeyRing:   keyRing,
+		Caches:    base.Base.Caches,
 
 		AppserviceAPI:          asAPI,
 		EDUInternalAPI:         eduInputAPI,
@@ -200,6 +200,7 @@ func main() {
 		Client:    conn.CreateClient(base, pQUIC),
 		FedClient: federation,
 		KeyRing:   keyRing,
+		Caches:    base.Caches,
 
 		AppserviceAPI:          asAPI,
 		EDUInternalAPI:         eduInputAPI,
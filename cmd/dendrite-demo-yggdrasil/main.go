@@ -137,6 +137,7 @@ func main() {
 		Client:    ygg.CreateClient(base),
 		FedClient: federation,
 		KeyRing:   keyRing,
+		Caches:    base.Caches,
 
 		AppserviceAPI:       asAPI,
 		EDUInternalAPI:      eduInputAPI,
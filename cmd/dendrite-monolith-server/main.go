@@ -134,6 +134,7 @@ func main() {
 		Client:    base.CreateClient(),
 		FedClient: federation,
 		KeyRing:   keyRing,
+		Caches:    base.Caches,
 
 		AppserviceAPI:       asAPI,
 		EDUInternalAPI:      eduInputAPI,
@@ -220,6 +220,7 @@ func main() {
 		Client:    createClient(node),
 		FedClient: federation,
 		KeyRing:   &keyRing,
+		Caches:    base.Caches,
 
 		AppserviceAPI:       asQuery,
 		EDUInternalAPI:      eduInputAPI,
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/setup"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+)
+
+// This is a utility for rebuilding the full-text search index of the sync API
+// from the events which it has already stored, e.g. those which were stored
+// before search was supported. It takes the IDs of the rooms to reindex as
+// arguments, or reindexes every room with joined users if none are given.
+// Dendrite should be stopped while it runs.
+//
+// Usage: ./reindex-search --config=dendrite.yaml [room ID ...]
+//   e.g. ./reindex-search --config=dendrite.yaml '!abc:example.com'
+
+func main() {
+	ctx := context.Background()
+	cfg := setup.ParseFlags(true)
+
+	syncDB, err := storage.NewSyncServerDatasource(&cfg.SyncAPI.Database)
+	if err != nil {
+		panic(err)
+	}
+
+	roomIDs := flag.Args()
+	if len(roomIDs) == 0 {
+		joinedUsers, err := syncDB.AllJoinedUsersInRooms(ctx)
+		if err != nil {
+			panic(err)
+		}
+		for roomID := range joinedUsers {
+			roomIDs = append(roomIDs, roomID)
+		}
+	}
+
+	for _, roomID := range roomIDs {
+		fmt.Println("Reindexing", roomID)
+		if err = syncDB.ReindexSearch(ctx, roomID); err != nil {
+			panic(err)
+		}
+	}
+	fmt.Println("Reindexed", len(roomIDs), "rooms")
+}
@@ -23,8 +23,14 @@ import (
 
 const defaultTypingTimeout = 10 * time.Second
 
-// userSet is a map of user IDs to a timer, timer fires at expiry.
-type userSet map[string]*time.Timer
+// typingUser is a user who is typing in a room. The timer fires at expiry.
+type typingUser struct {
+	timer   *time.Timer
+	expires time.Time
+}
+
+// userSet is a map of user IDs to their typing state.
+type userSet map[string]*typingUser
 
 // TimeoutCallbackFn is a function called right after the removal of a user
 // from the typing user list due to timeout.
@@ -61,6 +67,8 @@ func New() *EDUCache {
 // SetTimeoutCallback sets a callback function that is called right after
 // a user is removed from the typing user list due to timeout.
 func (t *EDUCache) SetTimeoutCallback(fn TimeoutCallbackFn) {
+	t.Lock()
+	defer t.Unlock()
 	t.timeoutCallback = fn
 }
 
@@ -102,13 +110,7 @@ func (t *EDUCache) AddTypingUser(
 ) int64 {
 	expireTime := getExpireTime(expire)
 	if until := time.Until(expireTime); until > 0 {
-		timer := time.AfterFunc(until, func() {
-			latestSyncPosition := t.RemoveUser(userID, roomID)
-			if t.timeoutCallback != nil {
-				t.timeoutCallback(userID, roomID, latestSyncPosition)
-			}
-		})
-		return t.addUser(userID, roomID, timer)
+		return t.addUser(userID, roomID, expireTime)
 	}
 	return t.GetLatestSyncPosition()
 }
@@ -116,7 +118,7 @@ func (t *EDUCache) AddTypingUser(
 // addUser with mutex lock & replace the previous timer.
 // Returns the latest typing sync position after update.
 func (t *EDUCache) addUser(
-	userID, roomID string, expiryTimer *time.Timer,
+	userID, roomID string, expires time.Time,
 ) int64 {
 	t.Lock()
 	defer t.Unlock()
@@ -129,22 +131,54 @@ func (t *EDUCache) addUser(
 		t.data[roomID].syncPosition = t.latestSyncPosition
 	}
 
-	// Stop the timer to cancel the call to timeoutCallback
-	if timer, ok := t.data[roomID].userSet[userID]; ok {
-		// It may happen that at this stage the timer fires, but we now have a lock on
-		// it. Hence the execution of timeoutCallback will happen after we unlock. So
-		// we may lose a typing state, though this is highly unlikely. This can be
-		// mitigated by keeping another time.Time in the map and checking against it
-		// before removing, but its occurrence is so infrequent it does not seem
-		// worthwhile.
-		timer.Stop()
+	// Stop the timer to cancel the call to timeoutCallback. If the timer has
+	// already fired then expireUser will see that the expiry time has changed
+	// and leave the user alone.
+	if user, ok := t.data[roomID].userSet[userID]; ok {
+		user.timer.Stop()
 	}
 
-	t.data[roomID].userSet[userID] = expiryTimer
+	// The timer is started with the lock held, so that expireUser always
+	// finds the user in the set even if the timer fires straight away.
+	t.data[roomID].userSet[userID] = &typingUser{
+		timer: time.AfterFunc(time.Until(expires), func() {
+			t.expireUser(userID, roomID, expires)
+		}),
+		expires: expires,
+	}
 
 	return t.latestSyncPosition
 }
 
+// expireUser removes the user from the typing user list if they are still
+// due to expire at the given time, and then calls the timeout callback. This
+// happens even if no other typing updates arrive for the room.
+func (t *EDUCache) expireUser(userID, roomID string, expires time.Time) {
+	t.Lock()
+	roomData, ok := t.data[roomID]
+	if !ok {
+		t.Unlock()
+		return
+	}
+	user, ok := roomData.userSet[userID]
+	if !ok || !user.expires.Equal(expires) {
+		// The user stopped typing or started typing again since the timer
+		// was started.
+		t.Unlock()
+		return
+	}
+	delete(roomData.userSet, userID)
+	t.latestSyncPosition++
+	roomData.syncPosition = t.latestSyncPosition
+	latestSyncPosition := t.latestSyncPosition
+	timeoutCallback := t.timeoutCallback
+	t.Unlock()
+
+	if timeoutCallback != nil {
+		timeoutCallback(userID, roomID, latestSyncPosition)
+	}
+}
+
 // RemoveUser with mutex lock & stop the timer.
 // Returns the latest sync position for typing after update.
 func (t *EDUCache) RemoveUser(userID, roomID string) int64 {
@@ -156,12 +190,12 @@ func (t *EDUCache) RemoveUser(userID, roomID string) int64 {
 		return t.latestSyncPosition
 	}
 
-	timer, ok := roomData.userSet[userID]
+	user, ok := roomData.userSet[userID]
 	if !ok {
 		return t.latestSyncPosition
 	}
 
-	timer.Stop()
+	user.timer.Stop()
 	delete(roomData.userSet, userID)
 
 	t.latestSyncPosition++
@@ -101,3 +101,32 @@ func testRemoveUser(t *testing.T, tCache *EDUCache) {
 		}
 	}
 }
+
+func TestEDUCacheTypingTimeout(t *testing.T) {
+	tCache := New()
+	expired := make(chan string, 2)
+	tCache.SetTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
+		expired <- userID
+	})
+
+	// user1 times out without any further updates arriving.
+	soon := time.Now().Add(50 * time.Millisecond)
+	tCache.AddTypingUser("user1", "room1", &soon)
+	// user2 starts typing again before their first timeout, which must not
+	// remove them early.
+	tCache.AddTypingUser("user2", "room1", &soon)
+	later := time.Now().Add(time.Second)
+	tCache.AddTypingUser("user2", "room1", &later)
+
+	select {
+	case userID := <-expired:
+		if userID != "user1" {
+			t.Fatalf("got timeout for %s, want user1", userID)
+		}
+	case <-time.After(time.Second / 2):
+		t.Fatal("timed out waiting for typing timeout")
+	}
+	if users := tCache.GetTypingUsers("room1"); !test.UnsortedStringSliceEqual(users, []string{"user2"}) {
+		t.Errorf("got typing users %v, want [user2]", users)
+	}
+}
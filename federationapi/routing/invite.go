@@ -133,6 +133,14 @@ func processInvite(
 		}
 	}
 
+	// Reject the invite if its content has been tampered with.
+	if event.Redacted() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The content hash of the invite event doesn't match"),
+		}
+	}
+
 	// Check that the event is signed by the server sending the request.
 	redacted := event.Redact()
 	verifyRequests := []gomatrixserverlib.VerifyJSONRequest{{
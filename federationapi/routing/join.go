@@ -15,6 +15,8 @@
 package routing
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
@@ -140,6 +142,10 @@ func MakeJoin(
 		stateEvents[i] = queryRes.StateEvents[i].Event
 	}
 
+	if resErr := checkRestrictedJoin(httpReq.Context(), rsAPI, userID, stateEvents); resErr != nil {
+		return *resErr
+	}
+
 	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
 	if err = gomatrixserverlib.Allowed(event.Event, &provider); err != nil {
 		return util.JSONResponse{
@@ -194,6 +200,20 @@ func SendJoin(
 		}
 	}
 
+	// Check that this is actually a join event.
+	if event.Type() != gomatrixserverlib.MRoomMember {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The event is not a m.room.member event."),
+		}
+	}
+	if membership, merr := event.Membership(); merr != nil || membership != gomatrixserverlib.Join {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The membership in the event content must be set to join."),
+		}
+	}
+
 	// Check that the room ID is correct.
 	if event.RoomID() != roomID {
 		return util.JSONResponse{
@@ -228,6 +248,15 @@ func SendJoin(
 		}
 	}
 
+	// Check that the content of the event matches its content hash, since
+	// gomatrixserverlib redacts events which don't rather than rejecting them.
+	if event.Redacted() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The content hash of the join event doesn't match"),
+		}
+	}
+
 	// Check that the event is signed by the server sending the request.
 	redacted := event.Redact()
 	verifyRequests := []gomatrixserverlib.VerifyJSONRequest{{
@@ -269,6 +298,20 @@ func SendJoin(
 		}
 	}
 
+	// Check that the join is allowed by the state of the room before it, so
+	// that we don't return the room state for an event that will be rejected.
+	stateEvents := gomatrixserverlib.UnwrapEventHeaders(stateAndAuthChainResponse.StateEvents)
+	if resErr := checkRestrictedJoin(httpReq.Context(), rsAPI, *event.StateKey(), stateEvents); resErr != nil {
+		return *resErr
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(event, &provider); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+
 	// Check if the user is already in the room. If they're already in then
 	// there isn't much point in sending another join event into the room.
 	alreadyJoined := false
@@ -295,6 +338,12 @@ func SendJoin(
 			cfg.Matrix.ServerName,
 			nil,
 		); err != nil {
+			if _, ok := err.(*gomatrixserverlib.NotAllowed); ok {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: jsonerror.Forbidden(err.Error()),
+				}
+			}
 			util.GetLogger(httpReq.Context()).WithError(err).Error("SendEvents failed")
 			return jsonerror.InternalServerError()
 		}
@@ -309,14 +358,103 @@ func SendJoin(
 	// https://matrix.org/docs/spec/server_server/latest#put-matrix-federation-v1-send-join-roomid-eventid
 	return util.JSONResponse{
 		Code: http.StatusOK,
-		JSON: gomatrixserverlib.RespSendJoin{
-			StateEvents: gomatrixserverlib.UnwrapEventHeaders(stateAndAuthChainResponse.StateEvents),
-			AuthEvents:  gomatrixserverlib.UnwrapEventHeaders(stateAndAuthChainResponse.AuthChainEvents),
+		JSON: sendJoinResponse{
+			Event:       event,
+			StateEvents: unwrapEvents(stateAndAuthChainResponse.StateEvents),
+			AuthEvents:  unwrapEvents(stateAndAuthChainResponse.AuthChainEvents),
 			Origin:      cfg.Matrix.ServerName,
 		},
 	}
 }
 
+// sendJoinResponse is the body of a /send_join response. It is the same as
+// gomatrixserverlib.RespSendJoin but also includes the join event, as per
+// the v2 API. The v1 API leaves the event out.
+type sendJoinResponse struct {
+	Event       *gomatrixserverlib.Event     `json:"event,omitempty"`
+	StateEvents []*gomatrixserverlib.Event   `json:"state"`
+	AuthEvents  []*gomatrixserverlib.Event   `json:"auth_chain"`
+	Origin      gomatrixserverlib.ServerName `json:"origin"`
+}
+
+// unwrapEvents is like gomatrixserverlib.UnwrapEventHeaders but never returns
+// nil, so that empty lists are encoded as [] rather than null.
+func unwrapEvents(events []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.Event {
+	unwrapped := make([]*gomatrixserverlib.Event, 0, len(events))
+	return append(unwrapped, gomatrixserverlib.UnwrapEventHeaders(events)...)
+}
+
+const (
+	// joinRuleRestricted is the MSC3083 join rule which allows users to join
+	// if they are joined to one of the rooms listed in the join rules.
+	joinRuleRestricted = "restricted"
+	// allowTypeRoomMembership is the MSC3083 allow condition type which is
+	// met by being joined to the given room.
+	allowTypeRoomMembership = "m.room_membership"
+)
+
+// restrictedJoinRuleContent is the content of an MSC3083 m.room.join_rules event.
+type restrictedJoinRuleContent struct {
+	JoinRule string `json:"join_rule"`
+	Allow    []struct {
+		Type   string `json:"type"`
+		RoomID string `json:"room_id"`
+	} `json:"allow"`
+}
+
+// checkRestrictedJoin checks that the user is allowed to join the room if it
+// has restricted join rules, by checking that they are joined to one of the
+// allowed rooms. Users who are already invited or joined don't need to meet
+// the allow conditions. Returns nil if the join can go ahead.
+func checkRestrictedJoin(
+	ctx context.Context,
+	rsAPI api.RoomserverInternalAPI,
+	userID string,
+	stateEvents []*gomatrixserverlib.Event,
+) *util.JSONResponse {
+	var content restrictedJoinRuleContent
+	for _, se := range stateEvents {
+		switch {
+		case se.Type() == gomatrixserverlib.MRoomJoinRules && se.StateKeyEquals(""):
+			if err := json.Unmarshal(se.Content(), &content); err != nil {
+				return &util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.BadJSON("The room has invalid join rules"),
+				}
+			}
+		case se.Type() == gomatrixserverlib.MRoomMember && se.StateKeyEquals(userID):
+			if membership, err := se.Membership(); err == nil {
+				if membership == gomatrixserverlib.Join || membership == gomatrixserverlib.Invite {
+					return nil
+				}
+			}
+		}
+	}
+	if content.JoinRule != joinRuleRestricted {
+		return nil
+	}
+	for _, allow := range content.Allow {
+		if allow.Type != allowTypeRoomMembership {
+			continue
+		}
+		var res api.QueryMembershipForUserResponse
+		if err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+			RoomID: allow.RoomID,
+			UserID: userID,
+		}, &res); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+			continue
+		}
+		if res.IsInRoom {
+			return nil
+		}
+	}
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("The user is not joined to any of the rooms allowed by the join rules"),
+	}
+}
+
 type eventsByDepth []*gomatrixserverlib.HeaderedEvent
 
 func (e eventsByDepth) Len() int {
@@ -0,0 +1,262 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testJoinRoomID = "!join:localhost"
+	testJoinAlice  = "@alice:localhost"
+	testJoinBob    = "@bob:remote"
+)
+
+var testJoinRoomVersion = gomatrixserverlib.RoomVersionV6
+
+type testJoinRoomserverAPI struct {
+	api.RoomserverInternalAPITrace
+	state         []*gomatrixserverlib.HeaderedEvent
+	joinedRooms   map[string]bool
+	inputEventIDs []string
+}
+
+func (t *testJoinRoomserverAPI) QueryRoomVersionForRoom(
+	ctx context.Context, req *api.QueryRoomVersionForRoomRequest, res *api.QueryRoomVersionForRoomResponse,
+) error {
+	res.RoomVersion = testJoinRoomVersion
+	return nil
+}
+
+func (t *testJoinRoomserverAPI) QueryStateAndAuthChain(
+	ctx context.Context, req *api.QueryStateAndAuthChainRequest, res *api.QueryStateAndAuthChainResponse,
+) error {
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	res.RoomVersion = testJoinRoomVersion
+	res.StateEvents = t.state
+	res.AuthChainEvents = t.state
+	return nil
+}
+
+func (t *testJoinRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context, req *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse,
+) error {
+	res.RoomExists = true
+	res.RoomVersion = testJoinRoomVersion
+	if len(t.state) == 0 {
+		return nil
+	}
+	latest := t.state[len(t.state)-1]
+	res.LatestEvents = []gomatrixserverlib.EventReference{latest.EventReference()}
+	res.Depth = latest.Depth() + 1
+	// Later events replace earlier ones with the same type and state key.
+	current := map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range t.state {
+		current[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+	}
+	for _, tuple := range req.StateToFetch {
+		if ev, ok := current[tuple]; ok {
+			res.StateEvents = append(res.StateEvents, ev)
+		}
+	}
+	return nil
+}
+
+func (t *testJoinRoomserverAPI) QueryMembershipForUser(
+	ctx context.Context, req *api.QueryMembershipForUserRequest, res *api.QueryMembershipForUserResponse,
+) error {
+	res.IsInRoom = t.joinedRooms[req.RoomID]
+	return nil
+}
+
+func (t *testJoinRoomserverAPI) InputRoomEvents(
+	ctx context.Context, req *api.InputRoomEventsRequest, res *api.InputRoomEventsResponse,
+) {
+	for _, ire := range req.InputRoomEvents {
+		t.inputEventIDs = append(t.inputEventIDs, ire.Event.EventID())
+	}
+}
+
+// testJoinVerifier accepts every signature.
+type testJoinVerifier struct{}
+
+func (v *testJoinVerifier) VerifyJSONs(
+	ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest,
+) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	return make([]gomatrixserverlib.VerifyJSONResult, len(requests)), nil
+}
+
+// testJoinRoom builds the events of a room, which are signed by the server
+// of their sender.
+type testJoinRoom struct {
+	t      *testing.T
+	key    ed25519.PrivateKey
+	events []*gomatrixserverlib.HeaderedEvent
+}
+
+func (r *testJoinRoom) mustCreateEvent(sender, evType string, stateKey *string, content interface{}) *gomatrixserverlib.HeaderedEvent {
+	r.t.Helper()
+	// Every event is authed by all of the state before it, which is enough
+	// for the auth checks as long as nothing is replaced.
+	authEvents := []string{}
+	for _, ev := range r.events {
+		authEvents = append(authEvents, ev.EventID())
+	}
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:     sender,
+		RoomID:     testJoinRoomID,
+		Type:       evType,
+		StateKey:   stateKey,
+		Depth:      int64(len(r.events) + 1),
+		AuthEvents: authEvents,
+	}
+	if len(r.events) > 0 {
+		eb.PrevEvents = []string{r.events[len(r.events)-1].EventID()}
+	}
+	if err := eb.SetContent(content); err != nil {
+		r.t.Fatalf("failed to set content: %s", err)
+	}
+	_, origin, err := gomatrixserverlib.SplitID('@', sender)
+	if err != nil {
+		r.t.Fatalf("invalid sender: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), origin, "ed25519:test", r.key, testJoinRoomVersion)
+	if err != nil {
+		r.t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(testJoinRoomVersion)
+}
+
+func (r *testJoinRoom) addState(sender, evType, stateKey string, content interface{}) {
+	r.t.Helper()
+	r.events = append(r.events, r.mustCreateEvent(sender, evType, &stateKey, content))
+}
+
+func mustCreateJoinRoom(t *testing.T, joinRules interface{}) *testJoinRoom {
+	t.Helper()
+	r := &testJoinRoom{
+		t:   t,
+		key: ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
+	}
+	r.addState(testJoinAlice, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{"creator": testJoinAlice})
+	r.addState(testJoinAlice, gomatrixserverlib.MRoomMember, testJoinAlice, map[string]interface{}{"membership": "join"})
+	r.addState(testJoinAlice, gomatrixserverlib.MRoomPowerLevels, "", map[string]interface{}{"users": map[string]int{testJoinAlice: 100}})
+	r.addState(testJoinAlice, gomatrixserverlib.MRoomJoinRules, "", joinRules)
+	return r
+}
+
+func TestSendJoin(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.Global.ServerName = "localhost"
+
+	public := map[string]interface{}{"join_rule": "public"}
+	restricted := map[string]interface{}{
+		"join_rule": "restricted",
+		"allow": []map[string]string{
+			{"type": "m.room_membership", "room_id": "!allowed:localhost"},
+		},
+	}
+	for _, tc := range []struct {
+		name       string
+		joinRules  interface{}
+		banned     bool
+		membership string
+		wantCode   int
+	}{
+		{name: "join", joinRules: public, membership: "join", wantCode: http.StatusOK},
+		{name: "non-join membership", joinRules: public, membership: "leave", wantCode: http.StatusForbidden},
+		{name: "banned user", joinRules: public, banned: true, membership: "join", wantCode: http.StatusForbidden},
+		{name: "invite-only room", joinRules: map[string]interface{}{"join_rule": "invite"}, membership: "join", wantCode: http.StatusForbidden},
+		{name: "not joined to an allowed room", joinRules: restricted, membership: "join", wantCode: http.StatusForbidden},
+	} {
+		room := mustCreateJoinRoom(t, tc.joinRules)
+		if tc.banned {
+			room.addState(testJoinAlice, gomatrixserverlib.MRoomMember, testJoinBob, map[string]interface{}{"membership": "ban"})
+		}
+		bobKey := testJoinBob
+		join := room.mustCreateEvent(testJoinBob, gomatrixserverlib.MRoomMember, &bobKey, map[string]interface{}{"membership": tc.membership})
+
+		fedReq := gomatrixserverlib.NewFederationRequest(http.MethodPut, "localhost", "/send_join/"+testJoinRoomID+"/"+join.EventID())
+		if err := fedReq.SetContent(join.Unwrap()); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err := fedReq.Sign("remote", "ed25519:test", room.key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		rsAPI := &testJoinRoomserverAPI{state: room.events}
+		req := httptest.NewRequest(http.MethodPut, "/send_join/"+testJoinRoomID+"/"+join.EventID(), nil)
+		res := SendJoin(req, &fedReq, &cfg.FederationAPI, rsAPI, &testJoinVerifier{}, testJoinRoomID, join.EventID())
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got status %d, want %d: %+v", tc.name, res.Code, tc.wantCode, res.JSON)
+			continue
+		}
+		if res.Code != http.StatusOK {
+			if len(rsAPI.inputEventIDs) != 0 {
+				t.Errorf("%s: rejected join was sent to the roomserver", tc.name)
+			}
+			continue
+		}
+		if len(rsAPI.inputEventIDs) != 1 || rsAPI.inputEventIDs[0] != join.EventID() {
+			t.Errorf("%s: got events %v sent to the roomserver, want %s", tc.name, rsAPI.inputEventIDs, join.EventID())
+		}
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("failed to marshal response: %s", err)
+		}
+		var resp struct {
+			Event json.RawMessage `json:"event"`
+		}
+		if err = json.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("failed to unmarshal response: %s", err)
+		}
+		if string(resp.Event) != string(join.JSON()) {
+			t.Errorf("%s: got event %s, want %s", tc.name, resp.Event, join.JSON())
+		}
+	}
+}
+
+func TestCheckRestrictedJoin(t *testing.T) {
+	room := mustCreateJoinRoom(t, map[string]interface{}{
+		"join_rule": "restricted",
+		"allow": []map[string]string{
+			{"type": "m.room_membership", "room_id": "!allowed:localhost"},
+			{"type": "m.unknown", "room_id": "!unknown:localhost"},
+		},
+	})
+	bobKey := testJoinBob
+	invite := room.mustCreateEvent(testJoinAlice, gomatrixserverlib.MRoomMember, &bobKey, map[string]interface{}{"membership": "invite"})
+
+	for _, tc := range []struct {
+		name        string
+		joinedRooms map[string]bool
+		invited     bool
+		wantAllowed bool
+	}{
+		{name: "not joined to any room", wantAllowed: false},
+		{name: "joined to an allowed room", joinedRooms: map[string]bool{"!allowed:localhost": true}, wantAllowed: true},
+		{name: "joined to a room with an unknown allow type", joinedRooms: map[string]bool{"!unknown:localhost": true}, wantAllowed: false},
+		{name: "invited", invited: true, wantAllowed: true},
+	} {
+		state := gomatrixserverlib.UnwrapEventHeaders(room.events)
+		if tc.invited {
+			state = append(state, invite.Unwrap())
+		}
+		rsAPI := &testJoinRoomserverAPI{joinedRooms: tc.joinedRooms}
+		resErr := checkRestrictedJoin(context.Background(), rsAPI, testJoinBob, state)
+		if allowed := resErr == nil; allowed != tc.wantAllowed {
+			t.Errorf("%s: got allowed %v, want %v", tc.name, allowed, tc.wantAllowed)
+		} else if resErr != nil && resErr.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d", tc.name, resErr.Code, http.StatusForbidden)
+		}
+	}
+}
@@ -15,13 +15,16 @@
 package routing
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -68,11 +71,20 @@ func QueryDeviceKeys(
 		util.GetLogger(httpReq.Context()).WithError(queryRes.Error).Error("Failed to QueryKeys")
 		return jsonerror.InternalServerError()
 	}
+	// unknown users and devices are omitted rather than returned empty
+	for userID, devices := range queryRes.DeviceKeys {
+		if len(devices) == 0 {
+			delete(queryRes.DeviceKeys, userID)
+		}
+	}
+	// user-signing keys are only visible to their owner, so they are never sent over federation
 	return util.JSONResponse{
 		Code: 200,
 		JSON: struct {
-			DeviceKeys interface{} `json:"device_keys"`
-		}{queryRes.DeviceKeys},
+			DeviceKeys      interface{} `json:"device_keys"`
+			MasterKeys      interface{} `json:"master_keys"`
+			SelfSigningKeys interface{} `json:"self_signing_keys"`
+		}{queryRes.DeviceKeys, queryRes.MasterKeys, queryRes.SelfSigningKeys},
 	}
 }
 
@@ -171,9 +183,17 @@ func localKeys(cfg *config.FederationAPI, validUntil time.Time) (*gomatrixserver
 	return &keys, nil
 }
 
+// NotaryKeys implements POST /_matrix/key/v2/query and
+// GET /_matrix/key/v2/query/{serverName}/{keyID}, returning the key responses
+// of other servers countersigned by us. Responses are cached until their
+// valid_until_ts, and are fetched again if they would expire before the
+// minimum_valid_until_ts of the request. If a server can't be reached, the last
+// response we have from it is returned anyway, so that old events can still be
+// verified.
 func NotaryKeys(
 	httpReq *http.Request, cfg *config.FederationAPI,
 	fsAPI federationSenderAPI.FederationSenderInternalAPI,
+	cache caching.ServerKeyResponseCache,
 	req *gomatrixserverlib.PublicKeyNotaryLookupRequest,
 ) util.JSONResponse {
 	if req == nil {
@@ -188,7 +208,7 @@ func NotaryKeys(
 	}
 	response.ServerKeys = []json.RawMessage{}
 
-	for serverName := range req.ServerKeys {
+	for serverName, criteria := range req.ServerKeys {
 		var keys *gomatrixserverlib.ServerKeys
 		if serverName == cfg.Matrix.ServerName {
 			if k, err := localKeys(cfg, time.Now().Add(cfg.Matrix.KeyValidityPeriod)); err == nil {
@@ -197,10 +217,16 @@ func NotaryKeys(
 				return util.ErrorResponse(err)
 			}
 		} else {
-			if k, err := fsAPI.GetServerKeys(httpReq.Context(), serverName); err == nil {
+			// The keys must be valid until at least now, or later if any of
+			// the key IDs were requested with a minimum_valid_until_ts.
+			validUntil := gomatrixserverlib.AsTimestamp(time.Now())
+			for _, c := range criteria {
+				if c.MinimumValidUntilTS > validUntil {
+					validUntil = c.MinimumValidUntilTS
+				}
+			}
+			if k, ok := notaryServerKeys(httpReq.Context(), fsAPI, cache, serverName, validUntil); ok {
 				keys = &k
-			} else {
-				return util.ErrorResponse(err)
 			}
 		}
 		if keys == nil {
@@ -229,3 +255,28 @@ func NotaryKeys(
 		JSON: response,
 	}
 }
+
+// notaryServerKeys returns the key response of the server which is valid until
+// at least validUntil, from the cache if possible or else from the server
+// itself. Responses from the server must be signed by each of the keys in them.
+func notaryServerKeys(
+	ctx context.Context, fsAPI federationSenderAPI.FederationSenderInternalAPI,
+	cache caching.ServerKeyResponseCache, serverName gomatrixserverlib.ServerName,
+	validUntil gomatrixserverlib.Timestamp,
+) (gomatrixserverlib.ServerKeys, bool) {
+	if keys, ok := cache.GetServerKeyResponse(serverName, validUntil); ok {
+		return keys, true
+	}
+	logger := logrus.WithField("server_name", serverName)
+	keys, err := fsAPI.GetServerKeys(ctx, serverName)
+	if err == nil {
+		if checks, _ := gomatrixserverlib.CheckKeys(serverName, time.Now(), keys); checks.AllChecksOK {
+			cache.StoreServerKeyResponse(keys)
+			return keys, true
+		}
+		err = fmt.Errorf("key response failed checks")
+	}
+	logger.WithError(err).Warn("Failed to fetch server keys for notary request")
+	// Fall back to the last response that we had, however old it is.
+	return cache.GetServerKeyResponse(serverName, 0)
+}
@@ -0,0 +1,213 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+type testQueryKeysAPI struct {
+	api.KeyInternalAPI
+	req api.QueryKeysRequest
+}
+
+func (t *testQueryKeysAPI) QueryKeys(ctx context.Context, req *api.QueryKeysRequest, res *api.QueryKeysResponse) {
+	t.req = *req
+	res.DeviceKeys = map[string]map[string]json.RawMessage{
+		"@alice:localhost":   {"ALICE": json.RawMessage(`{"device_id":"ALICE"}`)},
+		"@unknown:localhost": {},
+	}
+	res.MasterKeys = map[string]api.CrossSigningKey{
+		"@alice:localhost": {UserID: "@alice:localhost", Usage: []api.CrossSigningKeyPurpose{api.CrossSigningKeyPurposeMaster}},
+	}
+	res.SelfSigningKeys = map[string]api.CrossSigningKey{
+		"@alice:localhost": {UserID: "@alice:localhost", Usage: []api.CrossSigningKeyPurpose{api.CrossSigningKeyPurposeSelfSigning}},
+	}
+	res.UserSigningKeys = map[string]api.CrossSigningKey{
+		"@alice:localhost": {UserID: "@alice:localhost", Usage: []api.CrossSigningKeyPurpose{api.CrossSigningKeyPurposeUserSigning}},
+	}
+}
+
+func TestQueryDeviceKeys(t *testing.T) {
+	keyAPI := &testQueryKeysAPI{}
+	fedReq := gomatrixserverlib.NewFederationRequest("POST", "localhost", "/_matrix/federation/v1/user/keys/query")
+	if err := fedReq.SetContent(map[string]interface{}{
+		"device_keys": map[string][]string{
+			"@alice:localhost":   {},
+			"@unknown:localhost": {"FOO"},
+			"@bob:remote.test":   {},
+		},
+	}); err != nil {
+		t.Fatalf("failed to set request content: %s", err)
+	}
+
+	res := QueryDeviceKeys(httptest.NewRequest("POST", "/", nil), &fedReq, keyAPI, "localhost")
+	if res.Code != 200 {
+		t.Fatalf("got code %d, want 200", res.Code)
+	}
+	wantQuery := map[string][]string{"@alice:localhost": {}, "@unknown:localhost": {"FOO"}}
+	if !reflect.DeepEqual(keyAPI.req.UserToDevices, wantQuery) {
+		t.Errorf("queried %v, want only the local users %v", keyAPI.req.UserToDevices, wantQuery)
+	}
+	if keyAPI.req.UserID != "" {
+		t.Errorf("federation query was made as user %q", keyAPI.req.UserID)
+	}
+
+	body, err := json.Marshal(res.JSON)
+	if err != nil {
+		t.Fatalf("failed to marshal response: %s", err)
+	}
+	var got map[string]map[string]json.RawMessage
+	if err = json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("failed to unmarshal response: %s", err)
+	}
+	if _, ok := got["device_keys"]["@unknown:localhost"]; ok {
+		t.Errorf("unknown user was included in device_keys: %s", body)
+	}
+	if _, ok := got["device_keys"]["@alice:localhost"]; !ok {
+		t.Errorf("missing device keys for alice: %s", body)
+	}
+	for _, field := range []string{"master_keys", "self_signing_keys"} {
+		if _, ok := got[field]["@alice:localhost"]; !ok {
+			t.Errorf("missing %s for alice: %s", field, body)
+		}
+	}
+	if _, ok := got["user_signing_keys"]; ok {
+		t.Errorf("user-signing keys were sent over federation: %s", body)
+	}
+}
+
+type testNotaryFederationSenderAPI struct {
+	federationSenderAPI.FederationSenderInternalAPI
+	keys  map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerKeys
+	err   error
+	calls int
+}
+
+func (f *testNotaryFederationSenderAPI) GetServerKeys(ctx context.Context, s gomatrixserverlib.ServerName) (gomatrixserverlib.ServerKeys, error) {
+	f.calls++
+	if f.err != nil {
+		return gomatrixserverlib.ServerKeys{}, f.err
+	}
+	return f.keys[s], nil
+}
+
+func mustMakeServerKeys(t *testing.T, serverName gomatrixserverlib.ServerName, signedBy gomatrixserverlib.ServerName, validUntil time.Time) gomatrixserverlib.ServerKeys {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	fields, err := json.Marshal(gomatrixserverlib.ServerKeyFields{
+		ServerName:    serverName,
+		VerifyKeys:    map[gomatrixserverlib.KeyID]gomatrixserverlib.VerifyKey{"ed25519:1": {Key: gomatrixserverlib.Base64Bytes(pub)}},
+		ValidUntilTS:  gomatrixserverlib.AsTimestamp(validUntil),
+		OldVerifyKeys: map[gomatrixserverlib.KeyID]gomatrixserverlib.OldVerifyKey{},
+	})
+	if err != nil {
+		t.Fatalf("failed to marshal keys: %s", err)
+	}
+	signed, err := gomatrixserverlib.SignJSON(string(signedBy), "ed25519:1", priv, fields)
+	if err != nil {
+		t.Fatalf("failed to sign keys: %s", err)
+	}
+	var keys gomatrixserverlib.ServerKeys
+	if err = json.Unmarshal(signed, &keys); err != nil {
+		t.Fatalf("failed to unmarshal keys: %s", err)
+	}
+	return keys
+}
+
+func TestNotaryKeys(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	caches, err := caching.NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	validUntil := time.Now().Add(time.Hour)
+	fsAPI := &testNotaryFederationSenderAPI{
+		keys: map[gomatrixserverlib.ServerName]gomatrixserverlib.ServerKeys{
+			"remote.test": mustMakeServerKeys(t, "remote.test", "remote.test", validUntil),
+			// signed by the wrong server, so the self-signature is missing
+			"evil.test": mustMakeServerKeys(t, "evil.test", "remote.test", validUntil),
+		},
+	}
+	query := func(serverName gomatrixserverlib.ServerName, minValidUntil time.Time) []gomatrixserverlib.ServerKeys {
+		t.Helper()
+		res := NotaryKeys(httptest.NewRequest("POST", "/", nil), &cfg.FederationAPI, fsAPI, caches, &gomatrixserverlib.PublicKeyNotaryLookupRequest{
+			ServerKeys: map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]gomatrixserverlib.PublicKeyNotaryQueryCriteria{
+				serverName: {"ed25519:1": {MinimumValidUntilTS: gomatrixserverlib.AsTimestamp(minValidUntil)}},
+			},
+		})
+		if res.Code != 200 {
+			t.Fatalf("got code %d, want 200", res.Code)
+		}
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("failed to marshal response: %s", err)
+		}
+		var got struct {
+			ServerKeys []gomatrixserverlib.ServerKeys `json:"server_keys"`
+		}
+		if err = json.Unmarshal(body, &got); err != nil {
+			t.Fatalf("failed to unmarshal response: %s", err)
+		}
+		return got.ServerKeys
+	}
+
+	// the keys are fetched, and countersigned by us as well as the server
+	got := query("remote.test", time.Now())
+	if len(got) != 1 || fsAPI.calls != 1 {
+		t.Fatalf("got %d keys from %d fetches, want 1 from 1", len(got), fsAPI.calls)
+	}
+	for _, signer := range []gomatrixserverlib.ServerName{"remote.test", cfg.Global.ServerName} {
+		var signatures struct {
+			Signatures map[gomatrixserverlib.ServerName]json.RawMessage `json:"signatures"`
+		}
+		if err = json.Unmarshal(got[0].Raw, &signatures); err != nil {
+			t.Fatalf("failed to unmarshal signatures: %s", err)
+		}
+		if _, ok := signatures.Signatures[signer]; !ok {
+			t.Errorf("keys weren't signed by %s: %s", signer, got[0].Raw)
+		}
+	}
+	if err = gomatrixserverlib.VerifyJSON(
+		string(cfg.Global.ServerName), cfg.Global.KeyID, cfg.Global.PrivateKey.Public().(ed25519.PublicKey), got[0].Raw,
+	); err != nil {
+		t.Errorf("notary signature is invalid: %s", err)
+	}
+
+	// they are then served from the cache, until they would expire too soon
+	query("remote.test", time.Now().Add(time.Minute))
+	if fsAPI.calls != 1 {
+		t.Errorf("keys were fetched again when they were cached")
+	}
+	query("remote.test", validUntil.Add(time.Hour))
+	if fsAPI.calls != 2 {
+		t.Errorf("keys weren't fetched again when they would expire too soon")
+	}
+
+	// if the server can't be reached then the last keys are still returned
+	fsAPI.err = errors.New("unreachable")
+	if got = query("remote.test", validUntil.Add(time.Hour)); len(got) != 1 {
+		t.Errorf("got %d keys for an unreachable server, want the cached keys", len(got))
+	}
+
+	// keys which aren't signed by the server they are for are never returned
+	fsAPI.err = nil
+	if got = query("evil.test", time.Now()); len(got) != 0 {
+		t.Errorf("got %d keys with a bad self-signature, want none", len(got))
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/eventutil"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// knockStrippedStateTypes are the types of the state events which are sent
+// back to the knocking server, so that the user can see which room they have
+// knocked on.
+var knockStrippedStateTypes = []string{
+	gomatrixserverlib.MRoomCreate, gomatrixserverlib.MRoomName, gomatrixserverlib.MRoomCanonicalAlias,
+	gomatrixserverlib.MRoomJoinRules, "m.room.avatar", "m.room.encryption",
+}
+
+// MakeKnock implements the MSC2403 /make_knock API
+func MakeKnock(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg *config.FederationAPI,
+	rsAPI api.RoomserverInternalAPI,
+	roomID, userID string,
+) util.JSONResponse {
+	_, domain, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Invalid UserID"),
+		}
+	}
+	if domain != request.Origin() {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The knock must be sent by the server of the user"),
+		}
+	}
+
+	// Try building an event for the server
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   userID,
+		RoomID:   roomID,
+		Type:     gomatrixserverlib.MRoomMember,
+		StateKey: &userID,
+	}
+	err = builder.SetContent(map[string]interface{}{"membership": auth.Knock})
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("builder.SetContent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var queryRes api.QueryLatestEventsAndStateResponse
+	event, err := eventutil.QueryAndBuildEvent(httpReq.Context(), &builder, cfg.Matrix, time.Now(), rsAPI, &queryRes)
+	if err == eventutil.ErrRoomNoExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Room ID %q was not found on this server", roomID)),
+		}
+	} else if e, ok := err.(gomatrixserverlib.BadJSONError); ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(e.Error()),
+		}
+	} else if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("eventutil.BuildEvent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Check that the knock is allowed or not
+	provider := gomatrixserverlib.NewAuthEvents(gomatrixserverlib.UnwrapEventHeaders(queryRes.StateEvents))
+	if err = auth.Allowed(event.Event, &provider); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"room_version": event.RoomVersion,
+			"event":        builder,
+		},
+	}
+}
+
+// SendKnock implements the MSC2403 /send_knock API
+func SendKnock(
+	httpReq *http.Request,
+	request *gomatrixserverlib.FederationRequest,
+	cfg *config.FederationAPI,
+	rsAPI api.RoomserverInternalAPI,
+	keys gomatrixserverlib.JSONVerifier,
+	roomID, eventID string,
+) util.JSONResponse {
+	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
+	verRes := api.QueryRoomVersionForRoomResponse{}
+	if err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), &verReq, &verRes); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Room ID %q was not found on this server", roomID)),
+		}
+	}
+
+	// Decode the event JSON from the request.
+	event, err := gomatrixserverlib.NewEventFromUntrustedJSON(request.Content(), verRes.RoomVersion)
+	switch err.(type) {
+	case gomatrixserverlib.BadJSONError:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON(err.Error()),
+		}
+	case nil:
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.NotJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+
+	// Check that the room ID is correct.
+	if event.RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The room ID in the request path must match the room ID in the knock event JSON"),
+		}
+	}
+
+	// Check that the event ID is correct.
+	if event.EventID() != eventID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The event ID in the request path must match the event ID in the knock event JSON"),
+		}
+	}
+
+	// Check that the event is a knock.
+	if !auth.IsKnock(event) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The membership in the event content must be set to knock"),
+		}
+	}
+
+	// Check that the event is from the server sending the request.
+	if event.Origin() != request.Origin() {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The knock must be sent by the server it originated on"),
+		}
+	}
+
+	// Reject the knock if its content hash didn't match when it was parsed.
+	if event.Redacted() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The content hash of the knock event doesn't match"),
+		}
+	}
+
+	// Check that the event is signed by the server sending the request.
+	redacted := event.Redact()
+	verifyRequests := []gomatrixserverlib.VerifyJSONRequest{{
+		ServerName:             event.Origin(),
+		Message:                redacted.JSON(),
+		AtTS:                   event.OriginServerTS(),
+		StrictValidityChecking: true,
+	}}
+	verifyResults, err := keys.VerifyJSONs(httpReq.Context(), verifyRequests)
+	if err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("keys.VerifyJSONs failed")
+		return jsonerror.InternalServerError()
+	}
+	if verifyResults[0].Error != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The knock must be signed by the server it originated on"),
+		}
+	}
+
+	// Check that the knock is allowed by the current state of the room, and
+	// fetch the state which is sent back to the knocking server at the same
+	// time.
+	stateNeeded := auth.StateNeededForAuth([]*gomatrixserverlib.Event{event})
+	queryReq := api.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID,
+		StateToFetch: stateNeeded.Tuples(),
+	}
+	for _, evType := range knockStrippedStateTypes {
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: evType, StateKey: ""}
+		if !containsStateKeyTuple(queryReq.StateToFetch, tuple) {
+			queryReq.StateToFetch = append(queryReq.StateToFetch, tuple)
+		}
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	if err = rsAPI.QueryLatestEventsAndState(httpReq.Context(), &queryReq, &queryRes); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
+		return jsonerror.InternalServerError()
+	}
+	if !queryRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(fmt.Sprintf("Room ID %q was not found on this server", roomID)),
+		}
+	}
+	provider := gomatrixserverlib.NewAuthEvents(gomatrixserverlib.UnwrapEventHeaders(queryRes.StateEvents))
+	if err = auth.Allowed(event, &provider); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+
+	// Send the events to the room server.
+	// We are responsible for notifying other servers that the user has
+	// knocked, so set SendAsServer to cfg.Matrix.ServerName
+	if err = api.SendEvents(
+		httpReq.Context(), rsAPI,
+		api.KindNew,
+		[]*gomatrixserverlib.HeaderedEvent{
+			event.Headered(verRes.RoomVersion),
+		},
+		cfg.Matrix.ServerName,
+		nil,
+	); err != nil {
+		util.GetLogger(httpReq.Context()).WithError(err).Error("producer.SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	knockState := []gomatrixserverlib.InviteV2StrippedState{}
+	for _, ev := range queryRes.StateEvents {
+		for _, evType := range knockStrippedStateTypes {
+			if ev.Type() == evType && ev.StateKeyEquals("") {
+				knockState = append(knockState, gomatrixserverlib.NewInviteV2StrippedState(ev.Event))
+				break
+			}
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"knock_state_events": knockState,
+		},
+	}
+}
+
+func containsStateKeyTuple(tuples []gomatrixserverlib.StateKeyTuple, tuple gomatrixserverlib.StateKeyTuple) bool {
+	for _, t := range tuples {
+		if t == tuple {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/auth"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestSendKnock(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.Global.ServerName = "localhost"
+
+	knock := map[string]interface{}{"join_rule": auth.JoinRuleKnock}
+	for _, tc := range []struct {
+		name       string
+		joinRules  interface{}
+		membership string
+		previous   string
+		wantCode   int
+	}{
+		{name: "knock", joinRules: knock, membership: auth.Knock, wantCode: http.StatusOK},
+		{name: "knock after leaving", joinRules: knock, membership: auth.Knock, previous: "leave", wantCode: http.StatusOK},
+		{name: "public room", joinRules: map[string]interface{}{"join_rule": "public"}, membership: auth.Knock, wantCode: http.StatusForbidden},
+		{name: "invite-only room", joinRules: map[string]interface{}{"join_rule": "invite"}, membership: auth.Knock, wantCode: http.StatusForbidden},
+		{name: "banned user", joinRules: knock, membership: auth.Knock, previous: "ban", wantCode: http.StatusForbidden},
+		{name: "invited user", joinRules: knock, membership: auth.Knock, previous: "invite", wantCode: http.StatusForbidden},
+		{name: "non-knock membership", joinRules: knock, membership: "join", wantCode: http.StatusBadRequest},
+	} {
+		room := mustCreateJoinRoom(t, tc.joinRules)
+		if tc.previous != "" {
+			room.addState(testJoinAlice, gomatrixserverlib.MRoomMember, testJoinBob, map[string]interface{}{"membership": tc.previous})
+		}
+		bobKey := testJoinBob
+		ev := room.mustCreateEvent(testJoinBob, gomatrixserverlib.MRoomMember, &bobKey, map[string]interface{}{"membership": tc.membership})
+
+		fedReq := gomatrixserverlib.NewFederationRequest(http.MethodPut, "localhost", "/send_knock/"+testJoinRoomID+"/"+ev.EventID())
+		if err := fedReq.SetContent(ev.Unwrap()); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		if err := fedReq.Sign("remote", "ed25519:test", room.key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		rsAPI := &testJoinRoomserverAPI{state: room.events}
+		req := httptest.NewRequest(http.MethodPut, "/send_knock/"+testJoinRoomID+"/"+ev.EventID(), nil)
+		res := SendKnock(req, &fedReq, &cfg.FederationAPI, rsAPI, &testJoinVerifier{}, testJoinRoomID, ev.EventID())
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got status %d, want %d: %+v", tc.name, res.Code, tc.wantCode, res.JSON)
+			continue
+		}
+		if res.Code != http.StatusOK {
+			if len(rsAPI.inputEventIDs) != 0 {
+				t.Errorf("%s: rejected knock was sent to the roomserver", tc.name)
+			}
+			continue
+		}
+		if len(rsAPI.inputEventIDs) != 1 || rsAPI.inputEventIDs[0] != ev.EventID() {
+			t.Errorf("%s: got events %v sent to the roomserver, want %s", tc.name, rsAPI.inputEventIDs, ev.EventID())
+		}
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("failed to marshal response: %s", err)
+		}
+		var resp struct {
+			KnockStateEvents []gomatrixserverlib.InviteV2StrippedState `json:"knock_state_events"`
+		}
+		if err = json.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("failed to unmarshal response: %s", err)
+		}
+		// The create and join rules events are the only stripped state in the room.
+		if len(resp.KnockStateEvents) != 2 {
+			t.Errorf("%s: got %d knock state events, want 2", tc.name, len(resp.KnockStateEvents))
+		}
+	}
+}
+
+func TestMakeKnock(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.Global.ServerName = "localhost"
+	cfg.Global.KeyID = "ed25519:test"
+
+	for _, tc := range []struct {
+		name     string
+		joinRule string
+		wantCode int
+	}{
+		{name: "knock", joinRule: auth.JoinRuleKnock, wantCode: http.StatusOK},
+		{name: "public room", joinRule: "public", wantCode: http.StatusForbidden},
+	} {
+		room := mustCreateJoinRoom(t, map[string]interface{}{"join_rule": tc.joinRule})
+		cfg.Global.PrivateKey = room.key
+		fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, "localhost", "/make_knock/"+testJoinRoomID+"/"+testJoinBob)
+		if err := fedReq.Sign("remote", "ed25519:test", room.key); err != nil {
+			t.Fatalf("failed to sign request: %s", err)
+		}
+		rsAPI := &testJoinRoomserverAPI{state: room.events}
+		req := httptest.NewRequest(http.MethodGet, "/make_knock/"+testJoinRoomID+"/"+testJoinBob, nil)
+		res := MakeKnock(req, &fedReq, &cfg.FederationAPI, rsAPI, testJoinRoomID, testJoinBob)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got status %d, want %d: %+v", tc.name, res.Code, tc.wantCode, res.JSON)
+			continue
+		}
+		if res.Code != http.StatusOK {
+			continue
+		}
+		body, err := json.Marshal(res.JSON)
+		if err != nil {
+			t.Fatalf("failed to marshal response: %s", err)
+		}
+		var resp struct {
+			Event gomatrixserverlib.EventBuilder `json:"event"`
+		}
+		if err = json.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("failed to unmarshal response: %s", err)
+		}
+		// The join rules are needed to authorise the knock.
+		var joinRulesEventID string
+		for _, ev := range room.events {
+			if ev.Type() == gomatrixserverlib.MRoomJoinRules {
+				joinRulesEventID = ev.EventID()
+			}
+		}
+		authEvents, _ := resp.Event.AuthEvents.([]interface{})
+		found := false
+		for _, authEventID := range authEvents {
+			found = found || authEventID == joinRulesEventID
+		}
+		if !found {
+			t.Errorf("%s: got auth events %v, want them to include the join rules event %s", tc.name, authEvents, joinRulesEventID)
+		}
+	}
+}
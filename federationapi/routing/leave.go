@@ -216,6 +216,14 @@ func SendLeave(
 		}
 	}
 
+	// Reject the leave if its content hash didn't match when it was parsed.
+	if event.Redacted() {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The content hash of the leave event doesn't match"),
+		}
+	}
+
 	// Check that the event is signed by the server sending the request.
 	redacted := event.Redact()
 	verifyRequests := []gomatrixserverlib.VerifyJSONRequest{{
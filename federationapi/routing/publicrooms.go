@@ -3,7 +3,9 @@ package routing
 import (
 	"context"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -28,7 +30,7 @@ func GetPostPublicRooms(req *http.Request, rsAPI roomserverAPI.RoomserverInterna
 	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
 		return *fillErr
 	}
-	if request.Limit == 0 {
+	if request.Limit <= 0 {
 		request.Limit = 50
 	}
 	response, err := publicRooms(req.Context(), request, rsAPI)
@@ -45,10 +47,9 @@ func publicRooms(
 	ctx context.Context, request PublicRoomReq, rsAPI roomserverAPI.RoomserverInternalAPI,
 ) (*gomatrixserverlib.RespPublicRooms, error) {
 
-	var response gomatrixserverlib.RespPublicRooms
-	var limit int16
-	var offset int64
-	limit = request.Limit
+	response := gomatrixserverlib.RespPublicRooms{
+		Chunk: []gomatrixserverlib.PublicRoom{},
+	}
 	offset, err := strconv.ParseInt(request.Since, 10, 64)
 	// ParseInt returns 0 and an error when trying to parse an empty string
 	// In that case, we want to assign 0 so we ignore the error
@@ -56,6 +57,9 @@ func publicRooms(
 		util.GetLogger(ctx).WithError(err).Error("strconv.ParseInt failed")
 		return nil, err
 	}
+	if offset < 0 {
+		offset = 0
+	}
 
 	var queryRes roomserverAPI.QueryPublishedRoomsResponse
 	err = rsAPI.QueryPublishedRooms(ctx, &roomserverAPI.QueryPublishedRoomsRequest{}, &queryRes)
@@ -63,25 +67,58 @@ func publicRooms(
 		util.GetLogger(ctx).WithError(err).Error("QueryPublishedRooms failed")
 		return nil, err
 	}
-	response.TotalRoomCountEstimate = len(queryRes.RoomIDs)
+	rooms, err := roomserverAPI.PopulatePublicRooms(ctx, queryRes.RoomIDs, rsAPI)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("PopulatePublicRooms failed")
+		return nil, err
+	}
+	response.TotalRoomCountEstimate = len(rooms)
+
+	// Sort by joined member count (big to small), falling back to the room
+	// ID so that the order is the same for every page.
+	sort.Slice(rooms, func(i, j int) bool {
+		if rooms[i].JoinedMembersCount != rooms[j].JoinedMembersCount {
+			return rooms[i].JoinedMembersCount > rooms[j].JoinedMembersCount
+		}
+		return rooms[i].RoomID < rooms[j].RoomID
+	})
+	rooms = filterRooms(rooms, request.Filter.SearchTerms)
 
 	if offset > 0 {
-		response.PrevBatch = strconv.Itoa(int(offset) - 1)
+		prev := int(offset) - int(request.Limit)
+		if prev < 0 {
+			prev = 0
+		}
+		response.PrevBatch = "T" + strconv.Itoa(prev)
 	}
-	nextIndex := int(offset) + int(limit)
-	if response.TotalRoomCountEstimate > nextIndex {
-		response.NextBatch = strconv.Itoa(nextIndex)
+	nextIndex := int(offset) + int(request.Limit)
+	if len(rooms) > nextIndex {
+		response.NextBatch = "T" + strconv.Itoa(nextIndex)
+	} else {
+		nextIndex = len(rooms)
 	}
+	if int(offset) < nextIndex {
+		response.Chunk = rooms[offset:nextIndex]
+	}
+	return &response, nil
+}
 
-	if offset < 0 {
-		offset = 0
+// filterRooms returns the rooms whose name, topic or canonical alias
+// contain the search term, ignoring case.
+func filterRooms(rooms []gomatrixserverlib.PublicRoom, searchTerm string) []gomatrixserverlib.PublicRoom {
+	if searchTerm == "" {
+		return rooms
 	}
-	if nextIndex > len(queryRes.RoomIDs) {
-		nextIndex = len(queryRes.RoomIDs)
+	normalizedTerm := strings.ToLower(searchTerm)
+	result := make([]gomatrixserverlib.PublicRoom, 0, len(rooms))
+	for _, room := range rooms {
+		if strings.Contains(strings.ToLower(room.Name), normalizedTerm) ||
+			strings.Contains(strings.ToLower(room.Topic), normalizedTerm) ||
+			strings.Contains(strings.ToLower(room.CanonicalAlias), normalizedTerm) {
+			result = append(result, room)
+		}
 	}
-	roomIDs := queryRes.RoomIDs[offset:nextIndex]
-	response.Chunk, err = fillInRooms(ctx, roomIDs, rsAPI)
-	return &response, err
+	return result
 }
 
 // fillPublicRoomsReq fills the Limit, Since and Filter attributes of a GET or POST request
@@ -94,84 +131,26 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 		// In that case, we want to assign 0 so we ignore the error
 		if err != nil && len(httpReq.FormValue("limit")) > 0 {
 			util.GetLogger(httpReq.Context()).WithError(err).Error("strconv.Atoi failed")
-			reqErr := jsonerror.InternalServerError()
-			return &reqErr
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("limit param is not a number"),
+			}
 		}
 		request.Limit = int16(limit)
 		request.Since = httpReq.FormValue("since")
-		return nil
 	} else if httpReq.Method == http.MethodPost {
-		return httputil.UnmarshalJSONRequest(httpReq, request)
-	}
-
-	return &util.JSONResponse{
-		Code: http.StatusMethodNotAllowed,
-		JSON: jsonerror.NotFound("Bad method"),
-	}
-}
-
-// due to lots of switches
-func fillInRooms(ctx context.Context, roomIDs []string, rsAPI roomserverAPI.RoomserverInternalAPI) ([]gomatrixserverlib.PublicRoom, error) {
-	avatarTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.avatar", StateKey: ""}
-	nameTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.name", StateKey: ""}
-	canonicalTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCanonicalAlias, StateKey: ""}
-	topicTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.topic", StateKey: ""}
-	guestTuple := gomatrixserverlib.StateKeyTuple{EventType: "m.room.guest_access", StateKey: ""}
-	visibilityTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""}
-	joinRuleTuple := gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""}
-
-	var stateRes roomserverAPI.QueryBulkStateContentResponse
-	err := rsAPI.QueryBulkStateContent(ctx, &roomserverAPI.QueryBulkStateContentRequest{
-		RoomIDs:        roomIDs,
-		AllowWildcards: true,
-		StateTuples: []gomatrixserverlib.StateKeyTuple{
-			nameTuple, canonicalTuple, topicTuple, guestTuple, visibilityTuple, joinRuleTuple, avatarTuple,
-			{EventType: gomatrixserverlib.MRoomMember, StateKey: "*"},
-		},
-	}, &stateRes)
-	if err != nil {
-		util.GetLogger(ctx).WithError(err).Error("QueryBulkStateContent failed")
-		return nil, err
-	}
-	util.GetLogger(ctx).Infof("room IDs: %+v", roomIDs)
-	util.GetLogger(ctx).Infof("State res: %+v", stateRes.Rooms)
-	chunk := make([]gomatrixserverlib.PublicRoom, len(roomIDs))
-	i := 0
-	for roomID, data := range stateRes.Rooms {
-		pub := gomatrixserverlib.PublicRoom{
-			RoomID: roomID,
+		if resErr := httputil.UnmarshalJSONRequest(httpReq, request); resErr != nil {
+			return resErr
 		}
-		joinCount := 0
-		var joinRule, guestAccess string
-		for tuple, contentVal := range data {
-			if tuple.EventType == gomatrixserverlib.MRoomMember && contentVal == "join" {
-				joinCount++
-				continue
-			}
-			switch tuple {
-			case avatarTuple:
-				pub.AvatarURL = contentVal
-			case nameTuple:
-				pub.Name = contentVal
-			case topicTuple:
-				pub.Topic = contentVal
-			case canonicalTuple:
-				pub.CanonicalAlias = contentVal
-			case visibilityTuple:
-				pub.WorldReadable = contentVal == "world_readable"
-			// need both of these to determine whether guests can join
-			case joinRuleTuple:
-				joinRule = contentVal
-			case guestTuple:
-				guestAccess = contentVal
-			}
-		}
-		if joinRule == gomatrixserverlib.Public && guestAccess == "can_join" {
-			pub.GuestCanJoin = true
+	} else {
+		return &util.JSONResponse{
+			Code: http.StatusMethodNotAllowed,
+			JSON: jsonerror.NotFound("Bad method"),
 		}
-		pub.JoinedMembersCount = joinCount
-		chunk[i] = pub
-		i++
 	}
-	return chunk, nil
+
+	// The pagination tokens are prefixed with a 'T', for the same reason as
+	// on the client API: so that a token for the first page is never falsey.
+	request.Since = strings.TrimPrefix(request.Since, "T")
+	return nil
 }
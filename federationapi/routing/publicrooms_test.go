@@ -0,0 +1,95 @@
+package routing
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type testPublicRoomsAPI struct {
+	api.RoomserverInternalAPITrace
+	rooms map[string]map[gomatrixserverlib.StateKeyTuple]string
+}
+
+func (t *testPublicRoomsAPI) QueryPublishedRooms(
+	ctx context.Context, req *api.QueryPublishedRoomsRequest, res *api.QueryPublishedRoomsResponse,
+) error {
+	for roomID := range t.rooms {
+		res.RoomIDs = append(res.RoomIDs, roomID)
+	}
+	return nil
+}
+
+func (t *testPublicRoomsAPI) QueryBulkStateContent(
+	ctx context.Context, req *api.QueryBulkStateContentRequest, res *api.QueryBulkStateContentResponse,
+) error {
+	res.Rooms = t.rooms
+	return nil
+}
+
+func publicRoomState(name string, joined int) map[gomatrixserverlib.StateKeyTuple]string {
+	state := map[gomatrixserverlib.StateKeyTuple]string{
+		{EventType: "m.room.name", StateKey: ""}: name,
+	}
+	for i := 0; i < joined; i++ {
+		state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: string(rune('a' + i))}] = "join"
+	}
+	return state
+}
+
+func TestPublicRoomsPaginationAndFilter(t *testing.T) {
+	rsAPI := &testPublicRoomsAPI{
+		rooms: map[string]map[gomatrixserverlib.StateKeyTuple]string{
+			"!a:test": publicRoomState("Apple", 3),
+			"!b:test": publicRoomState("Banana", 2),
+			"!c:test": publicRoomState("Cherry", 1),
+			"!d:test": publicRoomState("Apricot", 0),
+		},
+	}
+	roomIDs := func(rooms []gomatrixserverlib.PublicRoom) (ids []string) {
+		for _, room := range rooms {
+			ids = append(ids, room.RoomID)
+		}
+		return
+	}
+
+	// Rooms are ordered by the number of joined members.
+	res, err := publicRooms(context.Background(), PublicRoomReq{Limit: 2}, rsAPI)
+	if err != nil {
+		t.Fatalf("publicRooms failed: %s", err)
+	}
+	if got, want := roomIDs(res.Chunk), []string{"!a:test", "!b:test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("first page: got %v, want %v", got, want)
+	}
+	if res.Chunk[0].JoinedMembersCount != 3 {
+		t.Errorf("got %d joined members, want 3", res.Chunk[0].JoinedMembersCount)
+	}
+	if res.PrevBatch != "" || res.NextBatch != "T2" || res.TotalRoomCountEstimate != 4 {
+		t.Errorf("first page: got prev %q, next %q, total %d", res.PrevBatch, res.NextBatch, res.TotalRoomCountEstimate)
+	}
+
+	res, err = publicRooms(context.Background(), PublicRoomReq{Limit: 2, Since: "2"}, rsAPI)
+	if err != nil {
+		t.Fatalf("publicRooms failed: %s", err)
+	}
+	if got, want := roomIDs(res.Chunk), []string{"!c:test", "!d:test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("second page: got %v, want %v", got, want)
+	}
+	if res.PrevBatch != "T0" || res.NextBatch != "" {
+		t.Errorf("second page: got prev %q, next %q", res.PrevBatch, res.NextBatch)
+	}
+
+	res, err = publicRooms(context.Background(), PublicRoomReq{
+		Limit:  10,
+		Filter: filter{SearchTerms: "ap"},
+	}, rsAPI)
+	if err != nil {
+		t.Fatalf("publicRooms failed: %s", err)
+	}
+	if got, want := roomIDs(res.Chunk), []string{"!a:test", "!d:test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("filtered: got %v, want %v", got, want)
+	}
+}
@@ -71,9 +71,17 @@ func RoomAliasToID(
 				return jsonerror.InternalServerError()
 			}
 
+			// We know about the alias, so list ourselves first as a candidate
+			// server to join the room through.
+			servers := []gomatrixserverlib.ServerName{cfg.Matrix.ServerName}
+			for _, server := range serverQueryRes.ServerNames {
+				if server != cfg.Matrix.ServerName {
+					servers = append(servers, server)
+				}
+			}
 			resp = gomatrixserverlib.RespDirectory{
 				RoomID:  queryRes.RoomID,
-				Servers: serverQueryRes.ServerNames,
+				Servers: servers,
 			}
 		} else {
 			// If no alias was found, return an error
@@ -16,12 +16,14 @@ package routing
 
 import (
 	"net/http"
+	"strconv"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
@@ -50,6 +52,7 @@ func Setup(
 	userAPI userapi.UserInternalAPI,
 	keyAPI keyserverAPI.KeyInternalAPI,
 	mscCfg *config.MSCs,
+	caches *caching.Caches,
 ) {
 	v2keysmux := keyMux.PathPrefix("/v2").Subrouter()
 	v1fedmux := fedMux.PathPrefix("/v1").Subrouter()
@@ -71,16 +74,27 @@ func Setup(
 		var pkReq *gomatrixserverlib.PublicKeyNotaryLookupRequest
 		serverName := gomatrixserverlib.ServerName(vars["serverName"])
 		keyID := gomatrixserverlib.KeyID(vars["keyID"])
-		if serverName != "" && keyID != "" {
+		if serverName != "" {
+			var criteria gomatrixserverlib.PublicKeyNotaryQueryCriteria
+			if ts := req.URL.Query().Get("minimum_valid_until_ts"); ts != "" {
+				minValidUntil, err := strconv.ParseUint(ts, 10, 64)
+				if err != nil {
+					return util.JSONResponse{
+						Code: http.StatusBadRequest,
+						JSON: jsonerror.InvalidArgumentValue("minimum_valid_until_ts must be a timestamp"),
+					}
+				}
+				criteria.MinimumValidUntilTS = gomatrixserverlib.Timestamp(minValidUntil)
+			}
 			pkReq = &gomatrixserverlib.PublicKeyNotaryLookupRequest{
 				ServerKeys: map[gomatrixserverlib.ServerName]map[gomatrixserverlib.KeyID]gomatrixserverlib.PublicKeyNotaryQueryCriteria{
 					serverName: {
-						keyID: gomatrixserverlib.PublicKeyNotaryQueryCriteria{},
+						keyID: criteria,
 					},
 				},
 			}
 		}
-		return NotaryKeys(req, cfg, fsAPI, pkReq)
+		return NotaryKeys(req, cfg, fsAPI, caches, pkReq)
 	})
 
 	// Ignore the {keyID} argument as we only have a single server key so we always
@@ -92,6 +106,7 @@ func Setup(
 	v2keysmux.Handle("/server", localKeys).Methods(http.MethodGet)
 	v2keysmux.Handle("/query", notaryKeys).Methods(http.MethodPost)
 	v2keysmux.Handle("/query/{serverName}/{keyID}", notaryKeys).Methods(http.MethodGet)
+	v2keysmux.Handle("/query/{serverName}", notaryKeys).Methods(http.MethodGet)
 
 	mu := internal.NewMutexByRoom()
 	v1fedmux.Handle("/send/{txnID}", httputil.MakeFedAPI(
@@ -99,7 +114,7 @@ func Setup(
 		func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, rsAPI, eduAPI, keyAPI, keys, federation, mu,
+				cfg, rsAPI, eduAPI, keyAPI, userAPI, keys, federation, mu,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
@@ -232,6 +247,38 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
+	if mscCfg.Enabled("msc2403") {
+		v1fedmux.Handle("/make_knock/{roomID}/{userID}", httputil.MakeFedAPI(
+			"federation_make_knock", cfg.Matrix.ServerName, keys, wakeup,
+			func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+					return util.JSONResponse{
+						Code: http.StatusForbidden,
+						JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
+					}
+				}
+				return MakeKnock(
+					httpReq, request, cfg, rsAPI, vars["roomID"], vars["userID"],
+				)
+			},
+		)).Methods(http.MethodGet)
+
+		v1fedmux.Handle("/send_knock/{roomID}/{eventID}", httputil.MakeFedAPI(
+			"federation_send_knock", cfg.Matrix.ServerName, keys, wakeup,
+			func(httpReq *http.Request, request *gomatrixserverlib.FederationRequest, vars map[string]string) util.JSONResponse {
+				if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+					return util.JSONResponse{
+						Code: http.StatusForbidden,
+						JSON: jsonerror.Forbidden("Forbidden by server ACLs"),
+					}
+				}
+				return SendKnock(
+					httpReq, request, cfg, rsAPI, keys, vars["roomID"], vars["eventID"],
+				)
+			},
+		)).Methods(http.MethodPut)
+	}
+
 	if mscCfg.Enabled("msc2444") {
 		v1fedmux.Handle("/peek/{roomID}/{peekID}", httputil.MakeFedAPI(
 			"federation_peek", cfg.Matrix.ServerName, keys, wakeup,
@@ -309,6 +356,11 @@ func Setup(
 			res := SendJoin(
 				httpReq, request, cfg, rsAPI, keys, roomID, eventID,
 			)
+			// the join event is only returned by the v2 API
+			if joinRes, ok := res.JSON.(sendJoinResponse); ok {
+				joinRes.Event = nil
+				res.JSON = joinRes
+			}
 			// not all responses get wrapped in [code, body]
 			var body interface{}
 			body = []interface{}{
@@ -447,7 +499,7 @@ func Setup(
 		httputil.MakeExternalAPI("federation_public_rooms", func(req *http.Request) util.JSONResponse {
 			return GetPostPublicRooms(req, rsAPI)
 		}),
-	).Methods(http.MethodGet)
+	).Methods(http.MethodGet, http.MethodPost)
 
 	v1fedmux.Handle("/user/keys/claim", httputil.MakeFedAPI(
 		"federation_keys_claim", cfg.Matrix.ServerName, keys, wakeup,
@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
@@ -29,7 +30,9 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	"github.com/prometheus/client_golang/prometheus"
@@ -97,6 +100,7 @@ func Send(
 	rsAPI api.RoomserverInternalAPI,
 	eduAPI eduserverAPI.EDUServerInputAPI,
 	keyAPI keyapi.KeyInternalAPI,
+	userAPI userapi.UserInternalAPI,
 	keys gomatrixserverlib.JSONVerifier,
 	federation *gomatrixserverlib.FederationClient,
 	mu *internal.MutexByRoom,
@@ -109,6 +113,7 @@ func Send(
 		haveEvents: make(map[string]*gomatrixserverlib.HeaderedEvent),
 		newEvents:  make(map[string]bool),
 		keyAPI:     keyAPI,
+		userAPI:    userAPI,
 		roomsMu:    mu,
 	}
 
@@ -162,6 +167,7 @@ type txnReq struct {
 	rsAPI        api.RoomserverInternalAPI
 	eduAPI       eduserverAPI.EDUServerInputAPI
 	keyAPI       keyapi.KeyInternalAPI
+	userAPI      userapi.UserInternalAPI
 	keys         gomatrixserverlib.JSONVerifier
 	federation   txnFederationClient
 	servers      []gomatrixserverlib.ServerName
@@ -228,6 +234,16 @@ func (t *txnReq) processTransaction(ctx context.Context) (*gomatrixserverlib.Res
 			util.GetLogger(ctx).WithError(err).Warnf("Transaction: Failed to parse event JSON of event %s", string(pdu))
 			continue
 		}
+		if event.Redacted() {
+			// gomatrixserverlib redacts events whose content doesn't match
+			// their content hash, rather than failing to parse them. New
+			// events should never arrive redacted, so reject them.
+			util.GetLogger(ctx).Warnf("Transaction: Content hash of event %q doesn't match", event.EventID())
+			results[event.EventID()] = gomatrixserverlib.PDUResult{
+				Error: errContentHashMismatch.Error(),
+			}
+			continue
+		}
 		if api.IsServerBannedFromRoom(ctx, t.rsAPI, event.RoomID(), t.Origin) {
 			results[event.EventID()] = gomatrixserverlib.PDUResult{
 				Error: "Forbidden by server ACLs",
@@ -320,6 +336,8 @@ func isProcessingErrorFatal(err error) bool {
 	return false
 }
 
+var errContentHashMismatch = errors.New("content hash mismatch")
+
 type roomNotFoundError struct {
 	roomID string
 }
@@ -377,6 +395,10 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 				util.GetLogger(ctx).Warnf("Dropping typing event where sender domain (%q) doesn't match origin (%q)", domain, t.Origin)
 				continue
 			}
+			if api.IsServerBannedFromRoom(ctx, t.rsAPI, typingPayload.RoomID, t.Origin) {
+				util.GetLogger(ctx).Debugf("Dropping typing event for room %q where origin (%q) is forbidden by server ACLs", typingPayload.RoomID, t.Origin)
+				continue
+			}
 			if err := eduserverAPI.SendTyping(ctx, t.eduAPI, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, 30*1000); err != nil {
 				util.GetLogger(ctx).WithError(err).Error("Failed to send typing event to edu server")
 			}
@@ -401,6 +423,8 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 			}
 		case gomatrixserverlib.MDeviceListUpdate:
 			t.processDeviceListUpdate(ctx, e)
+		case userapi.MPresence:
+			t.processPresence(ctx, e)
 		case gomatrixserverlib.MReceipt:
 			// https://matrix.org/docs/spec/server_server/r0.1.4#receipts
 			payload := map[string]eduserverAPI.FederationReceiptMRead{}
@@ -411,6 +435,10 @@ func (t *txnReq) processEDUs(ctx context.Context) {
 			}
 
 			for roomID, receipt := range payload {
+				if api.IsServerBannedFromRoom(ctx, t.rsAPI, roomID, t.Origin) {
+					util.GetLogger(ctx).Debugf("Dropping receipt events for room %q where origin (%q) is forbidden by server ACLs", roomID, t.Origin)
+					continue
+				}
 				for userID, mread := range receipt.User {
 					_, domain, err := gomatrixserverlib.SplitID('@', userID)
 					if err != nil {
@@ -464,6 +492,41 @@ func (t *txnReq) processReceiptEvent(ctx context.Context,
 	return nil
 }
 
+func (t *txnReq) processPresence(ctx context.Context, e gomatrixserverlib.EDU) {
+	// https://matrix.org/docs/spec/server_server/r0.1.4#presence
+	var payload userapi.PresenceEDU
+	if err := json.Unmarshal(e.Content, &payload); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to unmarshal presence event")
+		return
+	}
+	now := time.Now()
+	for _, push := range payload.Push {
+		_, domain, err := gomatrixserverlib.SplitID('@', push.UserID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to split domain from presence event sender")
+			continue
+		}
+		if domain != t.Origin {
+			util.GetLogger(ctx).Warnf("Dropping presence event where sender domain (%q) doesn't match origin (%q)", domain, t.Origin)
+			continue
+		}
+		if !userapi.ValidPresence(push.Presence) {
+			util.GetLogger(ctx).Warnf("Dropping presence event with invalid presence %q", push.Presence)
+			continue
+		}
+		req := userapi.PerformPresenceUpdateRequest{
+			UserID:       push.UserID,
+			Presence:     push.Presence,
+			StatusMsg:    push.StatusMsg,
+			LastActiveTS: gomatrixserverlib.AsTimestamp(now.Add(-time.Duration(push.LastActiveAgo) * time.Millisecond)),
+		}
+		var res userapi.PerformPresenceUpdateResponse
+		if err := t.userAPI.PerformPresenceUpdate(ctx, &req, &res); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("user_id", push.UserID).Error("Failed to update presence")
+		}
+	}
+}
+
 func (t *txnReq) processDeviceListUpdate(ctx context.Context, e gomatrixserverlib.EDU) {
 	var payload gomatrixserverlib.DeviceListUpdateEvent
 	if err := json.Unmarshal(e.Content, &payload); err != nil {
@@ -582,6 +645,10 @@ withNextEvent:
 				logger.WithError(err).Warnf("Failed to unmarshal auth event %q", missingAuthEventID)
 				continue withNextServer
 			}
+			if err = gomatrixserverlib.VerifyAllEventSignatures(ctx, []*gomatrixserverlib.Event{ev}, t.keys); err != nil {
+				logger.WithError(err).Warnf("Couldn't validate signature of auth event %q", missingAuthEventID)
+				continue withNextServer
+			}
 			if err = api.SendInputRoomEvents(
 				context.Background(),
 				t.rsAPI,
@@ -615,7 +682,7 @@ func checkAllowedByState(e *gomatrixserverlib.Event, stateEvents []*gomatrixserv
 			return err
 		}
 	}
-	return gomatrixserverlib.Allowed(e, &authUsingState)
+	return auth.Allowed(e, &authUsingState)
 }
 
 func (t *txnReq) processEventWithMissingState(
@@ -922,7 +989,7 @@ retryAllowedState:
 
 func (t *txnReq) getMissingEvents(ctx context.Context, e *gomatrixserverlib.Event, roomVersion gomatrixserverlib.RoomVersion) (newEvents []*gomatrixserverlib.Event, err error) {
 	logger := util.GetLogger(ctx).WithField("event_id", e.EventID()).WithField("room_id", e.RoomID())
-	needed := gomatrixserverlib.StateNeededForAuth([]*gomatrixserverlib.Event{e})
+	needed := auth.StateNeededForAuth([]*gomatrixserverlib.Event{e})
 	// query latest events (our trusted forward extremities)
 	req := api.QueryLatestEventsAndStateRequest{
 		RoomID:       e.RoomID(),
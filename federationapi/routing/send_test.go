@@ -1,6 +1,7 @@
 package routing
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -319,6 +320,10 @@ func (t *testRoomserverAPI) QueryServerBannedFromRoom(ctx context.Context, req *
 	return nil
 }
 
+func (t *testRoomserverAPI) QueryRoomStorageUsage(ctx context.Context, req *api.QueryRoomStorageUsageRequest, res *api.QueryRoomStorageUsageResponse) error {
+	return fmt.Errorf("not implemented")
+}
+
 type txnFedClient struct {
 	state            map[string]gomatrixserverlib.RespState    // event_id to response
 	stateIDs         map[string]gomatrixserverlib.RespStateIDs // event_id to response
@@ -476,6 +481,31 @@ func TestTransactionFailAuthChecks(t *testing.T) {
 	assertInputRoomEvents(t, rsAPI.inputRoomEvents, []*gomatrixserverlib.HeaderedEvent{testEvents[len(testEvents)-1]})
 }
 
+// The purpose of this test is to check that an event whose content doesn't match its content hash is rejected rather
+// than being sent to the roomserver.
+func TestTransactionRejectContentHashMismatch(t *testing.T) {
+	rsAPI := &testRoomserverAPI{
+		queryMissingAuthPrevEvents: func(req *api.QueryMissingAuthPrevEventsRequest) api.QueryMissingAuthPrevEventsResponse {
+			return api.QueryMissingAuthPrevEventsResponse{
+				RoomExists:          true,
+				MissingAuthEventIDs: []string{},
+				MissingPrevEventIDs: []string{},
+			}
+		},
+	}
+	tampered := bytes.Replace(testData[len(testData)-1], []byte("Test Message"), []byte("Evil Message"), 1)
+	txn := mustCreateTransaction(rsAPI, &txnFedClient{}, []json.RawMessage{tampered})
+	res, err := txn.processTransaction(context.Background())
+	if err != nil {
+		t.Fatalf("txn.processTransaction returned an error: %v", err)
+	}
+	eventID := testEvents[len(testEvents)-1].EventID()
+	if result, ok := res.PDUs[eventID]; !ok || result.Error != errContentHashMismatch.Error() {
+		t.Errorf("got PDU result %+v for the tampered event, want %q", result, errContentHashMismatch)
+	}
+	assertInputRoomEvents(t, rsAPI.inputRoomEvents, nil)
+}
+
 // The purpose of this test is to make sure that when an event is received for which we do not know the prev_events,
 // we request them from /get_missing_events. It works by setting PrevEventsExist=false in the roomserver query response,
 // resulting in a call to /get_missing_events which returns the missing prev event. Both events should be processed in
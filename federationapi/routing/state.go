@@ -106,6 +106,23 @@ func getState(
 	if event.RoomID() != roomID {
 		return nil, &util.JSONResponse{Code: http.StatusNotFound, JSON: jsonerror.NotFound("event does not belong to this room")}
 	}
+
+	// Only servers that are participating in the room may request its state.
+	var inRoomRes api.QueryServerJoinedToRoomResponse
+	if err := rsAPI.QueryServerJoinedToRoom(ctx, &api.QueryServerJoinedToRoomRequest{
+		ServerName: request.Origin(),
+		RoomID:     roomID,
+	}, &inRoomRes); err != nil {
+		resErr := util.ErrorResponse(err)
+		return nil, &resErr
+	}
+	if !inRoomRes.RoomExists {
+		return nil, &util.JSONResponse{Code: http.StatusNotFound, JSON: jsonerror.NotFound("room not found")}
+	}
+	if !inRoomRes.IsInRoom {
+		return nil, &util.JSONResponse{Code: http.StatusForbidden, JSON: jsonerror.Forbidden("server is not in the room")}
+	}
+
 	resErr = allowedToSeeEvent(ctx, request.Origin(), rsAPI, eventID)
 	if resErr != nil {
 		return nil, resErr
@@ -129,6 +146,9 @@ func getState(
 	if !response.RoomExists {
 		return nil, &util.JSONResponse{Code: http.StatusNotFound, JSON: nil}
 	}
+	if !response.PrevEventsExist {
+		return nil, &util.JSONResponse{Code: http.StatusNotFound, JSON: jsonerror.NotFound("state at event not found")}
+	}
 
 	return &gomatrixserverlib.RespState{
 		StateEvents: gomatrixserverlib.UnwrapEventHeaders(response.StateEvents),
@@ -67,6 +67,14 @@ func CreateInvitesFrom3PIDInvites(
 
 	evs := []*gomatrixserverlib.HeaderedEvent{}
 	for _, inv := range body.Invites {
+		// The identity server signs the binding for the invited Matrix ID, so
+		// the invites must all be for the Matrix ID that the 3PID is bound to.
+		if inv.MXID != body.MXID || inv.Signed.MXID != body.MXID {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.BadJSON("The invite's Matrix ID doesn't match the bound Matrix ID"),
+			}
+		}
 		verReq := api.QueryRoomVersionForRoomRequest{RoomID: inv.RoomID}
 		verRes := api.QueryRoomVersionForRoomResponse{}
 		if err := rsAPI.QueryRoomVersionForRoom(req.Context(), &verReq, &verRes); err != nil {
@@ -80,6 +88,12 @@ func CreateInvitesFrom3PIDInvites(
 			req.Context(), rsAPI, cfg, inv, federation, userAPI,
 		)
 		if err != nil {
+			if err == errNotLocalUser {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.BadJSON(err.Error()),
+				}
+			}
 			util.GetLogger(req.Context()).WithError(err).Error("createInviteFrom3PIDInvite failed")
 			return jsonerror.InternalServerError()
 		}
@@ -126,6 +140,12 @@ func ExchangeThirdPartyInvite(
 	}
 
 	// Check that the state key is correct.
+	if builder.StateKey == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The event doesn't have a state key"),
+		}
+	}
 	_, targetDomain, err := gomatrixserverlib.SplitID('@', *builder.StateKey)
 	if err != nil {
 		return util.JSONResponse{
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
@@ -92,6 +93,11 @@ type FederationSenderInternalAPI interface {
 		request *PerformBroadcastEDURequest,
 		response *PerformBroadcastEDUResponse,
 	) error
+	// Fetches a room and its immediate children from a remote server, as per
+	// the /hierarchy version of MSC2946.
+	MSC2946Hierarchy(
+		ctx context.Context, dst gomatrixserverlib.ServerName, roomID string, suggestedOnly bool,
+	) (res MSC2946HierarchyResponse, err error)
 }
 
 type PerformDirectoryLookupRequest struct {
@@ -168,3 +174,29 @@ type PerformBroadcastEDURequest struct {
 
 type PerformBroadcastEDUResponse struct {
 }
+
+// MSC2946HierarchyRoom is a room in a space hierarchy: the public room
+// information along with the m.space.child events in the room.
+type MSC2946HierarchyRoom struct {
+	gomatrixserverlib.PublicRoom
+	RoomType      string                     `json:"room_type,omitempty"`
+	ChildrenState []MSC2946HierarchyStripped `json:"children_state"`
+}
+
+// MSC2946HierarchyStripped is a stripped m.space.child event, which unlike
+// stripped state elsewhere includes the origin_server_ts for ordering.
+type MSC2946HierarchyStripped struct {
+	Content        json.RawMessage             `json:"content"`
+	StateKey       string                      `json:"state_key"`
+	Sender         string                      `json:"sender"`
+	Type           string                      `json:"type"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+}
+
+// MSC2946HierarchyResponse is the response to the federated /hierarchy
+// request: the requested room and whatever is known about its children.
+type MSC2946HierarchyResponse struct {
+	Room                 MSC2946HierarchyRoom   `json:"room"`
+	Children             []MSC2946HierarchyRoom `json:"children"`
+	InaccessibleChildren []string               `json:"inaccessible_children"`
+}
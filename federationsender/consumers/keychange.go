@@ -94,6 +94,10 @@ func (t *KeyChangeConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 	if originServerName != t.serverName {
 		return nil
 	}
+	// cross-signing changes aren't about a device, so there is no device list update to send
+	if m.DeviceID == "" {
+		return nil
+	}
 
 	var queryRes roomserverAPI.QueryRoomsForUserResponse
 	err = t.rsAPI.QueryRoomsForUser(context.Background(), &roomserverAPI.QueryRoomsForUserRequest{
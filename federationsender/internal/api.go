@@ -2,6 +2,8 @@ package internal
 
 import (
 	"context"
+	"net/http"
+	"net/url"
 	"sync"
 	"time"
 
@@ -258,3 +260,33 @@ func (a *FederationSenderInternalAPI) MSC2946Spaces(
 	}
 	return ires.(gomatrixserverlib.MSC2946SpacesResponse), nil
 }
+
+func (a *FederationSenderInternalAPI) MSC2946Hierarchy(
+	ctx context.Context, s gomatrixserverlib.ServerName, roomID string, suggestedOnly bool,
+) (res api.MSC2946HierarchyResponse, err error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	ires, err := a.doRequest(s, func() (interface{}, error) {
+		// gomatrixserverlib doesn't know about /hierarchy yet, so build and
+		// sign the request ourselves.
+		path := "/_matrix/federation/unstable/org.matrix.msc2946/hierarchy/" + url.PathEscape(roomID)
+		if suggestedOnly {
+			path += "?suggested_only=true"
+		}
+		fedReq := gomatrixserverlib.NewFederationRequest(http.MethodGet, s, path)
+		if err := fedReq.Sign(a.cfg.Matrix.ServerName, a.cfg.Matrix.KeyID, a.cfg.Matrix.PrivateKey); err != nil {
+			return nil, err
+		}
+		httpReq, err := fedReq.HTTPRequest()
+		if err != nil {
+			return nil, err
+		}
+		var hierarchy api.MSC2946HierarchyResponse
+		err = a.federation.DoRequestAndParseResponse(ctx, httpReq, &hierarchy)
+		return hierarchy, err
+	})
+	if err != nil {
+		return res, err
+	}
+	return ires.(api.MSC2946HierarchyResponse), nil
+}
@@ -35,6 +35,7 @@ const (
 	FederationSenderLookupServerKeysPath   = "/federationsender/client/lookupServerKeys"
 	FederationSenderEventRelationshipsPath = "/federationsender/client/msc2836eventRelationships"
 	FederationSenderSpacesSummaryPath      = "/federationsender/client/msc2946spacesSummary"
+	FederationSenderSpacesHierarchyPath    = "/federationsender/client/msc2946spacesHierarchy"
 )
 
 // NewFederationSenderClient creates a FederationSenderInternalAPI implemented by talking to a HTTP POST API.
@@ -495,3 +496,34 @@ func (h *httpFederationSenderInternalAPI) MSC2946Spaces(
 	}
 	return response.Res, nil
 }
+
+type hierarchyReq struct {
+	S             gomatrixserverlib.ServerName
+	RoomID        string
+	SuggestedOnly bool
+	Res           api.MSC2946HierarchyResponse
+	Err           *api.FederationClientError
+}
+
+func (h *httpFederationSenderInternalAPI) MSC2946Hierarchy(
+	ctx context.Context, dst gomatrixserverlib.ServerName, roomID string, suggestedOnly bool,
+) (res api.MSC2946HierarchyResponse, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "MSC2946Hierarchy")
+	defer span.Finish()
+
+	request := hierarchyReq{
+		S:             dst,
+		RoomID:        roomID,
+		SuggestedOnly: suggestedOnly,
+	}
+	var response hierarchyReq
+	apiURL := h.federationSenderURL + FederationSenderSpacesHierarchyPath
+	err = httputil.PostJSON(ctx, span, h.httpClient, apiURL, &request, &response)
+	if err != nil {
+		return res, err
+	}
+	if response.Err != nil {
+		return res, response.Err
+	}
+	return response.Res, nil
+}
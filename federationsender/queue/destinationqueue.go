@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
@@ -35,10 +36,12 @@ import (
 
 const (
 	maxPDUsPerTransaction = 50
-	maxEDUsPerTransaction = 50
+	maxEDUsPerTransaction = 100
 	maxPDUsInMemory       = 128
 	maxEDUsInMemory       = 128
 	queueIdleTimeout      = time.Second * 30
+	// How often blacklisted servers are retried in case they have come back.
+	blacklistRetryInterval = time.Hour
 )
 
 // destinationQueue is a queue of events for a single destination.
@@ -409,33 +412,21 @@ func (oq *destinationQueue) nextTransaction(
 	logrus.WithField("server_name", oq.destination).Debugf("Sending transaction %q containing %d PDUs, %d EDUs", t.TransactionID, len(t.PDUs), len(t.EDUs))
 
 	// Try to send the transaction to the destination server.
-	// TODO: we should check for 500-ish fails vs 400-ish here,
-	// since we shouldn't queue things indefinitely in response
-	// to a 400-ish error
 	ctx, cancel := context.WithTimeout(oq.process.Context(), time.Minute*5)
 	defer cancel()
 	_, err := oq.client.SendTransaction(ctx, t)
-	switch err.(type) {
+	switch errv := err.(type) {
 	case nil:
-		// Clean up the transaction in the database.
-		if pduReceipts != nil {
-			//logrus.Infof("Cleaning PDUs %q", pduReceipt.String())
-			if err = oq.db.CleanPDUs(context.Background(), oq.destination, pduReceipts); err != nil {
-				log.WithError(err).Errorf("Failed to clean PDUs for server %q", t.Destination)
-			}
-		}
-		if eduReceipts != nil {
-			//logrus.Infof("Cleaning EDUs %q", eduReceipt.String())
-			if err = oq.db.CleanEDUs(context.Background(), oq.destination, eduReceipts); err != nil {
-				log.WithError(err).Errorf("Failed to clean EDUs for server %q", t.Destination)
-			}
-		}
-		// Reset the transaction ID.
-		oq.transactionIDMutex.Lock()
-		oq.transactionID = ""
-		oq.transactionIDMutex.Unlock()
+		oq.cleanTransaction(pduReceipts, eduReceipts)
 		return true, len(t.PDUs), len(t.EDUs), nil
 	case gomatrix.HTTPError:
+		if isPermanentSendError(errv.Code) {
+			// The destination rejected the transaction, so sending it
+			// again won't help. Drop it rather than queueing it forever.
+			log.WithError(err).Warnf("Dropping transaction %q to %q containing %d PDUs, %d EDUs", t.TransactionID, oq.destination, len(t.PDUs), len(t.EDUs))
+			oq.cleanTransaction(pduReceipts, eduReceipts)
+			return true, len(t.PDUs), len(t.EDUs), nil
+		}
 		// Report that we failed to send the transaction and we
 		// will retry again, subject to backoff.
 		return false, 0, 0, err
@@ -447,3 +438,34 @@ func (oq *destinationQueue) nextTransaction(
 		return false, 0, 0, err
 	}
 }
+
+// cleanTransaction removes the PDUs and EDUs of the last transaction from
+// the database, once they no longer need to be sent, and resets the
+// transaction ID so that the next transaction gets a new one.
+func (oq *destinationQueue) cleanTransaction(pduReceipts, eduReceipts []*shared.Receipt) {
+	if pduReceipts != nil {
+		if err := oq.db.CleanPDUs(context.Background(), oq.destination, pduReceipts); err != nil {
+			log.WithError(err).Errorf("Failed to clean PDUs for server %q", oq.destination)
+		}
+	}
+	if eduReceipts != nil {
+		if err := oq.db.CleanEDUs(context.Background(), oq.destination, eduReceipts); err != nil {
+			log.WithError(err).Errorf("Failed to clean EDUs for server %q", oq.destination)
+		}
+	}
+	oq.transactionIDMutex.Lock()
+	oq.transactionID = ""
+	oq.transactionIDMutex.Unlock()
+}
+
+// isPermanentSendError returns whether a transaction which failed with the
+// HTTP status code will fail again if it is retried. Server errors, timeouts
+// and rate limiting are temporary, whereas other client errors mean that the
+// destination won't ever accept the transaction.
+func isPermanentSendError(code int) bool {
+	switch code {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return code >= 400 && code < 500
+}
@@ -125,10 +125,38 @@ func NewOutgoingQueues(
 				}
 			}
 		})
+		go queues.retryBlacklistedServers()
 	}
 	return queues
 }
 
+// retryBlacklistedServers periodically tries sending to the blacklisted
+// servers again, in case they have come back. Any PDUs and EDUs that
+// were queued for them before they were blacklisted are still in the
+// database and will be sent if they have.
+func (oqs *OutgoingQueues) retryBlacklistedServers() {
+	ticker := time.NewTicker(blacklistRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-oqs.process.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		serverNames, err := oqs.db.GetAllBlacklisted()
+		if err != nil {
+			log.WithError(err).Error("Failed to get blacklisted servers to retry")
+			continue
+		}
+		for _, serverName := range serverNames {
+			oqs.statistics.ForServer(serverName).RetryBlacklisted()
+			if queue := oqs.getQueue(serverName); queue != nil {
+				queue.wakeQueueIfNeeded()
+			}
+		}
+	}
+}
+
 // TODO: Move this somewhere useful for other components as we often need to ferry these 3 variables
 // around together
 type SigningInfo struct {
@@ -154,7 +182,7 @@ func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *d
 	oqs.queuesMutex.Lock()
 	defer oqs.queuesMutex.Unlock()
 	oq, ok := oqs.queues[destination]
-	if !ok || oq != nil {
+	if !ok || oq == nil {
 		destinationQueueTotal.Inc()
 		oq = &destinationQueue{
 			queues:           oqs,
@@ -103,6 +103,16 @@ func (s *ServerStatistics) Success() {
 	}
 }
 
+// RetryBlacklisted unblacklists the server in memory so that we will
+// try to send to it again. The failure counter is kept, so if the next
+// attempt fails then the server will be blacklisted again straight away,
+// whereas if it succeeds then the server will be removed from the
+// blacklist in the database too.
+func (s *ServerStatistics) RetryBlacklisted() {
+	s.cancel()
+	s.backoffStarted.Store(false)
+}
+
 // Failure marks a failure and starts backing off if needed.
 // The next call to BackoffIfRequired will do the right thing
 // after this. It will return the time that the current failure
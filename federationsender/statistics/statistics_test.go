@@ -62,3 +62,41 @@ func TestBackoff(t *testing.T) {
 		}
 	}
 }
+
+func TestRetryBlacklisted(t *testing.T) {
+	stats := Statistics{
+		FailuresUntilBlacklist: 2,
+	}
+	server := ServerStatistics{
+		statistics: &stats,
+		serverName: "test.com",
+		interrupt:  make(chan struct{}),
+	}
+
+	// Fail enough times to be blacklisted.
+	for i := uint32(0); i < stats.FailuresUntilBlacklist; i++ {
+		server.cancel()
+		server.backoffStarted.Store(false)
+		server.Failure()
+	}
+	if !server.Blacklisted() {
+		t.Fatalf("Expected to be blacklisted but wasn't")
+	}
+
+	// Retrying unblacklists the server, but failing again blacklists
+	// it again straight away.
+	server.RetryBlacklisted()
+	if server.Blacklisted() {
+		t.Fatalf("Expected not to be blacklisted after retrying but was")
+	}
+	if _, blacklisted := server.Failure(); !blacklisted {
+		t.Fatalf("Expected to be blacklisted after failing the retry but wasn't")
+	}
+
+	// Succeeding after retrying unblacklists the server for good.
+	server.RetryBlacklisted()
+	server.Success()
+	if _, blacklisted := server.Failure(); blacklisted {
+		t.Fatalf("Expected not to be blacklisted after succeeding but was")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -37,14 +38,18 @@ const insertBlacklistSQL = "" +
 const selectBlacklistSQL = "" +
 	"SELECT server_name FROM federationsender_blacklist WHERE server_name = $1"
 
+const selectAllBlacklistSQL = "" +
+	"SELECT server_name FROM federationsender_blacklist"
+
 const deleteBlacklistSQL = "" +
 	"DELETE FROM federationsender_blacklist WHERE server_name = $1"
 
 type blacklistStatements struct {
-	db                  *sql.DB
-	insertBlacklistStmt *sql.Stmt
-	selectBlacklistStmt *sql.Stmt
-	deleteBlacklistStmt *sql.Stmt
+	db                     *sql.DB
+	insertBlacklistStmt    *sql.Stmt
+	selectBlacklistStmt    *sql.Stmt
+	selectAllBlacklistStmt *sql.Stmt
+	deleteBlacklistStmt    *sql.Stmt
 }
 
 func NewPostgresBlacklistTable(db *sql.DB) (s *blacklistStatements, err error) {
@@ -62,6 +67,9 @@ func NewPostgresBlacklistTable(db *sql.DB) (s *blacklistStatements, err error) {
 	if s.selectBlacklistStmt, err = db.Prepare(selectBlacklistSQL); err != nil {
 		return
 	}
+	if s.selectAllBlacklistStmt, err = db.Prepare(selectAllBlacklistSQL); err != nil {
+		return
+	}
 	if s.deleteBlacklistStmt, err = db.Prepare(deleteBlacklistSQL); err != nil {
 		return
 	}
@@ -96,6 +104,27 @@ func (s *blacklistStatements) SelectBlacklist(
 	return res.Next(), nil
 }
 
+// SelectAllBlacklist returns all of the blacklisted server names.
+func (s *blacklistStatements) SelectAllBlacklist(
+	ctx context.Context, txn *sql.Tx,
+) ([]gomatrixserverlib.ServerName, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAllBlacklistStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectAllBlacklist: rows.close() failed")
+	var result []gomatrixserverlib.ServerName
+	for rows.Next() {
+		var serverName gomatrixserverlib.ServerName
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		result = append(result, serverName)
+	}
+	return result, rows.Err()
+}
+
 // updateRoom updates the last_event_id for the room. selectRoomForUpdate should
 // have already been called earlier within the transaction.
 func (s *blacklistStatements) DeleteBlacklist(
@@ -152,6 +152,10 @@ func (d *Database) IsServerBlacklisted(serverName gomatrixserverlib.ServerName)
 	return d.FederationSenderBlacklist.SelectBlacklist(context.TODO(), nil, serverName)
 }
 
+func (d *Database) GetAllBlacklisted() ([]gomatrixserverlib.ServerName, error) {
+	return d.FederationSenderBlacklist.SelectAllBlacklist(context.TODO(), nil)
+}
+
 func (d *Database) AddOutboundPeek(ctx context.Context, serverName gomatrixserverlib.ServerName, roomID, peekID string, renewalInterval int64) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		return d.FederationSenderOutboundPeeks.InsertOutboundPeek(ctx, txn, serverName, roomID, peekID, renewalInterval)
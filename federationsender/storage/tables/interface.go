@@ -59,6 +59,7 @@ type FederationSenderJoinedHosts interface {
 type FederationSenderBlacklist interface {
 	InsertBlacklist(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) error
 	SelectBlacklist(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) (bool, error)
+	SelectAllBlacklist(ctx context.Context, txn *sql.Tx) ([]gomatrixserverlib.ServerName, error)
 	DeleteBlacklist(ctx context.Context, txn *sql.Tx, serverName gomatrixserverlib.ServerName) error
 }
 
@@ -0,0 +1,38 @@
+package caching
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	ServerKeyResponseCacheName       = "server_key_response"
+	ServerKeyResponseCacheMaxEntries = 1024
+	ServerKeyResponseCacheMutable    = true
+)
+
+// ServerKeyResponseCache contains the subset of functions needed for
+// a cache of the signed key responses of other servers, which are
+// served when acting as a notary.
+type ServerKeyResponseCache interface {
+	// Returns the last key response from the server, as long as it is
+	// valid until at least the given timestamp.
+	GetServerKeyResponse(serverName gomatrixserverlib.ServerName, validUntil gomatrixserverlib.Timestamp) (keys gomatrixserverlib.ServerKeys, ok bool)
+	StoreServerKeyResponse(keys gomatrixserverlib.ServerKeys)
+}
+
+func (c Caches) GetServerKeyResponse(
+	serverName gomatrixserverlib.ServerName,
+	validUntil gomatrixserverlib.Timestamp,
+) (gomatrixserverlib.ServerKeys, bool) {
+	val, found := c.ServerKeyResponses.Get(string(serverName))
+	if found && val != nil {
+		if keys, ok := val.(gomatrixserverlib.ServerKeys); ok && keys.ValidUntilTS >= validUntil {
+			return keys, true
+		}
+	}
+	return gomatrixserverlib.ServerKeys{}, false
+}
+
+func (c Caches) StoreServerKeyResponse(keys gomatrixserverlib.ServerKeys) {
+	c.ServerKeyResponses.Set(string(keys.ServerName), keys)
+}
@@ -6,6 +6,7 @@ package caching
 type Caches struct {
 	RoomVersions            Cache // RoomVersionCache
 	ServerKeys              Cache // ServerKeyCache
+	ServerKeyResponses      Cache // ServerKeyResponseCache
 	RoomServerStateKeyNIDs  Cache // RoomServerNIDsCache
 	RoomServerEventTypeNIDs Cache // RoomServerNIDsCache
 	RoomServerRoomNIDs      Cache // RoomServerNIDsCache
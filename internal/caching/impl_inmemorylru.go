@@ -28,6 +28,15 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 	if err != nil {
 		return nil, err
 	}
+	serverKeyResponses, err := NewInMemoryLRUCachePartition(
+		ServerKeyResponseCacheName,
+		ServerKeyResponseCacheMutable,
+		ServerKeyResponseCacheMaxEntries,
+		enablePrometheus,
+	)
+	if err != nil {
+		return nil, err
+	}
 	roomServerStateKeyNIDs, err := NewInMemoryLRUCachePartition(
 		RoomServerStateKeyNIDsCacheName,
 		RoomServerStateKeyNIDsCacheMutable,
@@ -74,13 +83,14 @@ func NewInMemoryLRUCache(enablePrometheus bool) (*Caches, error) {
 		return nil, err
 	}
 	go cacheCleaner(
-		roomVersions, serverKeys, roomServerStateKeyNIDs,
+		roomVersions, serverKeys, serverKeyResponses, roomServerStateKeyNIDs,
 		roomServerEventTypeNIDs, roomServerRoomIDs,
 		roomInfos, federationEvents,
 	)
 	return &Caches{
 		RoomVersions:            roomVersions,
 		ServerKeys:              serverKeys,
+		ServerKeyResponses:      serverKeyResponses,
 		RoomServerStateKeyNIDs:  roomServerStateKeyNIDs,
 		RoomServerEventTypeNIDs: roomServerEventTypeNIDs,
 		RoomServerRoomIDs:       roomServerRoomIDs,
@@ -66,7 +66,8 @@ type AliasesContent struct {
 
 // CanonicalAliasContent is the event content for http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-canonical-alias
 type CanonicalAliasContent struct {
-	Alias string `json:"alias"`
+	Alias      string   `json:"alias"`
+	AltAliases []string `json:"alt_aliases,omitempty"`
 }
 
 // AvatarContent is the event content for http://matrix.org/docs/spec/client_server/r0.2.0.html#m-room-avatar
@@ -61,6 +61,10 @@ func MakeAuthAPI(
 		logger := util.GetLogger((req.Context()))
 		logger = logger.WithField("user_id", device.UserID)
 		req = req.WithContext(util.ContextWithLogger(req.Context(), logger))
+		// add the user to the tracing span
+		if span := opentracing.SpanFromContext(req.Context()); span != nil {
+			span.SetTag("user_id", device.UserID)
+		}
 		// add the user to Sentry, if enabled
 		hub := sentry.GetHubFromContext(req.Context())
 		if hub != nil {
@@ -140,23 +144,49 @@ func MakeExternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 			}
 		}
 
-		span := opentracing.StartSpan(metricsName)
+		span := startHTTPSpan(metricsName, req)
 		defer span.Finish()
 		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
-		h.ServeHTTP(nextWriter, req)
+		h.ServeHTTP(&spanStatusWriter{nextWriter, span}, req)
 
 	}
 
 	return http.HandlerFunc(withSpan)
 }
 
+// startHTTPSpan starts the tracing span for an incoming request to a client
+// or federation API endpoint. The span is named after the endpoint rather than
+// the path, so that requests to the same endpoint can be aggregated.
+func startHTTPSpan(metricsName string, req *http.Request) opentracing.Span {
+	span := opentracing.StartSpan(metricsName)
+	ext.SpanKindRPCServer.Set(span)
+	ext.HTTPMethod.Set(span, req.Method)
+	ext.HTTPUrl.Set(span, req.URL.Path)
+	return span
+}
+
+// spanStatusWriter tags the span with the status code of the response.
+type spanStatusWriter struct {
+	http.ResponseWriter
+	span opentracing.Span
+}
+
+func (w *spanStatusWriter) WriteHeader(code int) {
+	ext.HTTPStatusCode.Set(w.span, uint16(code))
+	if code >= 500 {
+		ext.Error.Set(w.span, true)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
 // MakeHTMLAPI adds Span metrics to the HTML Handler function
 // This is used to serve HTML alongside JSON error messages
 func MakeHTMLAPI(metricsName string, f func(http.ResponseWriter, *http.Request) *util.JSONResponse) http.Handler {
 	withSpan := func(w http.ResponseWriter, req *http.Request) {
-		span := opentracing.StartSpan(metricsName)
+		span := startHTTPSpan(metricsName, req)
 		defer span.Finish()
 		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
+		w = &spanStatusWriter{w, span}
 		if err := f(w, req); err != nil {
 			h := util.MakeJSONAPI(util.NewJSONRequestHandler(func(req *http.Request) util.JSONResponse {
 				return *err
@@ -188,13 +218,14 @@ func MakeInternalAPI(metricsName string, f func(*http.Request) util.JSONResponse
 		tracer := opentracing.GlobalTracer()
 		clientContext, err := tracer.Extract(opentracing.HTTPHeaders, carrier)
 		var span opentracing.Span
-		if err == nil {
+		if err != nil {
 			// Default to a span without RPC context.
 			span = tracer.StartSpan(metricsName)
 		} else {
 			// Set the RPC context.
 			span = tracer.StartSpan(metricsName, ext.RPCServerOption(clientContext))
 		}
+		ext.HTTPMethod.Set(span, req.Method)
 		defer span.Finish()
 		req = req.WithContext(opentracing.ContextWithSpan(req.Context(), span))
 		h.ServeHTTP(w, req)
@@ -218,6 +249,10 @@ func MakeFedAPI(
 		if fedReq == nil {
 			return errResp
 		}
+		// add the origin to the tracing span
+		if span := opentracing.SpanFromContext(req.Context()); span != nil {
+			span.SetTag("origin", string(fedReq.Origin()))
+		}
 		// add the user to Sentry, if enabled
 		hub := sentry.GetHubFromContext(req.Context())
 		if hub != nil {
@@ -0,0 +1,89 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/util"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func useMockTracer(t *testing.T) *mocktracer.MockTracer {
+	tracer := mocktracer.New()
+	previous := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	t.Cleanup(func() { opentracing.SetGlobalTracer(previous) })
+	return tracer
+}
+
+func TestMakeInternalAPIContinuesTrace(t *testing.T) {
+	tracer := useMockTracer(t)
+
+	h := MakeInternalAPI("test_internal", func(req *http.Request) util.JSONResponse {
+		span, _ := sqlutil.StartSpan(req.Context(), "test.storage", "selectThings")
+		sqlutil.FinishSpan(span, 3, nil)
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	})
+
+	client := tracer.StartSpan("client")
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	if err := tracer.Inject(client.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)); err != nil {
+		t.Fatalf("failed to inject span: %s", err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	client.Finish()
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 3 {
+		t.Fatalf("got %d finished spans, want 3", len(spans))
+	}
+	storage, server := spans[0], spans[1]
+	clientID := client.Context().(mocktracer.MockSpanContext).SpanID
+	if server.OperationName != "test_internal" || server.ParentID != clientID {
+		t.Errorf("server span %q has parent %d, want the client span %d", server.OperationName, server.ParentID, clientID)
+	}
+	if storage.OperationName != "test.storage.selectThings" || storage.ParentID != server.SpanContext.SpanID {
+		t.Errorf("storage span %q has parent %d, want the server span", storage.OperationName, storage.ParentID)
+	}
+	if storage.Tag(sqlutil.TagStatementName) != "selectThings" || storage.Tag(sqlutil.TagRowCount) != 3 {
+		t.Errorf("storage span has tags %v", storage.Tags())
+	}
+}
+
+func TestMakeExternalAPITagsSpan(t *testing.T) {
+	tracer := useMockTracer(t)
+
+	h := MakeExternalAPI("test_external", func(req *http.Request) util.JSONResponse {
+		return util.JSONResponse{Code: http.StatusNotFound, JSON: struct{}{}}
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/foo?bar=baz", nil))
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d finished spans, want 1", len(spans))
+	}
+	tags := spans[0].Tags()
+	if tags["http.method"] != http.MethodGet || tags["http.url"] != "/foo" || tags["http.status_code"] != uint16(http.StatusNotFound) {
+		t.Errorf("span has tags %v", tags)
+	}
+	if _, found := tags["error"]; found {
+		t.Errorf("4xx responses shouldn't be tagged as errors")
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// A Client sends notifications to push gateways.
+type Client interface {
+	// Notify sends the notification to the push gateway at the URL, which
+	// includes the NotifyPath.
+	Notify(ctx context.Context, url string, req *NotifyRequest, resp *NotifyResponse) error
+}
+
+type httpClient struct {
+	hc *http.Client
+}
+
+// NewHTTPClient creates a new push gateway client. Requests are only
+// limited by the deadline of their context.
+func NewHTTPClient() Client {
+	return &httpClient{
+		hc: &http.Client{},
+	}
+}
+
+func (h *httpClient) Notify(ctx context.Context, url string, req *NotifyRequest, resp *NotifyResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "Notify")
+	defer span.Finish()
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	hresp, err := h.hc.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close() // nolint:errcheck
+
+	if hresp.StatusCode != http.StatusOK {
+		return fmt.Errorf("push gateway returned HTTP %d", hresp.StatusCode)
+	}
+	if err = json.NewDecoder(hresp.Body).Decode(resp); err != nil {
+		return fmt.Errorf("failed to decode push gateway response: %w", err)
+	}
+	return nil
+}
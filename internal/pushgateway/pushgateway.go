@@ -0,0 +1,77 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushgateway
+
+import (
+	"encoding/json"
+)
+
+// NotifyPath is the path of the push gateway endpoint which notifications
+// are sent to. The URL of an HTTP pusher must point to it.
+const NotifyPath = "/_matrix/push/v1/notify"
+
+// A NotifyRequest is the body of a request to a push gateway.
+// https://matrix.org/docs/spec/push_gateway/r0.1.1#post-matrix-push-v1-notify
+type NotifyRequest struct {
+	Notification Notification `json:"notification"` // Required
+}
+
+// A NotifyResponse is the body of a push gateway's response.
+type NotifyResponse struct {
+	// Rejected lists the pushkeys which the push gateway no longer
+	// accepts. The pushers for them should be removed.
+	Rejected []string `json:"rejected"` // Required
+}
+
+// A Notification describes the event which a notification is about. Only
+// Counts and Devices are set if the pusher only wants event IDs.
+type Notification struct {
+	Content           json.RawMessage `json:"content,omitempty"`
+	Counts            *Counts         `json:"counts,omitempty"`
+	Devices           []*Device       `json:"devices"` // Required
+	EventID           string          `json:"event_id,omitempty"`
+	Membership        string          `json:"membership,omitempty"`
+	Prio              Prio            `json:"prio,omitempty"`
+	RoomAlias         string          `json:"room_alias,omitempty"`
+	RoomID            string          `json:"room_id,omitempty"`
+	RoomName          string          `json:"room_name,omitempty"`
+	Sender            string          `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	Type              string          `json:"type,omitempty"`
+	UserIsTarget      bool            `json:"user_is_target,omitempty"`
+}
+
+// Counts are the unread counts of the user which the notification is for.
+type Counts struct {
+	MissedCalls int `json:"missed_calls,omitempty"`
+	Unread      int `json:"unread"`
+}
+
+// A Device is a pusher which the notification should be delivered to.
+type Device struct {
+	AppID     string                 `json:"app_id"`  // Required
+	Data      map[string]interface{} `json:"data"`    // Required
+	PushKey   string                 `json:"pushkey"` // Required
+	PushKeyTS int64                  `json:"pushkey_ts,omitempty"`
+	Tweaks    map[string]interface{} `json:"tweaks,omitempty"`
+}
+
+// Prio is the priority of a notification.
+type Prio string
+
+const (
+	HighPrio Prio = "high"
+	LowPrio  Prio = "low"
+)
@@ -0,0 +1,235 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// An EvaluationContext gives a RuleSetEvaluator access to the
+// environment, for rules that require that.
+type EvaluationContext interface {
+	// UserDisplayName returns the current user's display name.
+	UserDisplayName() string
+
+	// RoomMemberCount returns the number of members in the room of
+	// the current event.
+	RoomMemberCount() (int, error)
+
+	// HasPowerLevel returns whether the user has at least the given
+	// power in the room of the current event.
+	HasPowerLevel(userID, levelKey string) (bool, error)
+}
+
+// A RuleSetEvaluator encapsulates context to evaluate an event
+// against a rule set.
+type RuleSetEvaluator struct {
+	ec      EvaluationContext
+	ruleSet *RuleSet
+}
+
+// NewRuleSetEvaluator creates a new evaluator for the given rule set.
+func NewRuleSetEvaluator(ec EvaluationContext, ruleSet *RuleSet) *RuleSetEvaluator {
+	return &RuleSetEvaluator{
+		ec:      ec,
+		ruleSet: ruleSet,
+	}
+}
+
+// MatchEvent returns the first matching rule. Returns nil if there
+// was no match rule.
+func (rse *RuleSetEvaluator) MatchEvent(event *gomatrixserverlib.Event) (*Rule, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(event.JSON(), &fields); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	for _, kind := range Kinds {
+		for _, rule := range *rse.ruleSet.RuleSetByKind(kind) {
+			ok, err := rse.ruleMatches(rule, kind, event, fields)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return rule, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (rse *RuleSetEvaluator) ruleMatches(rule *Rule, kind Kind, event *gomatrixserverlib.Event, fields map[string]interface{}) (bool, error) {
+	if !rule.Enabled {
+		return false, nil
+	}
+
+	switch kind {
+	case OverrideKind, UnderrideKind:
+		for _, cond := range rule.Conditions {
+			ok, err := rse.conditionMatches(cond, event, fields)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				return false, nil
+			}
+		}
+		return true, nil
+
+	case ContentKind:
+		// TODO: "These configure behaviour for (unencrypted) messages
+		// that match certain patterns." - Does that mean "content.body"?
+		return patternMatches("content.body", rule.Pattern, fields)
+
+	case RoomKind:
+		return rule.RuleID == event.RoomID(), nil
+
+	case SenderKind:
+		return rule.RuleID == event.Sender(), nil
+
+	default:
+		return false, nil
+	}
+}
+
+func (rse *RuleSetEvaluator) conditionMatches(cond *Condition, event *gomatrixserverlib.Event, fields map[string]interface{}) (bool, error) {
+	switch cond.Kind {
+	case EventMatchCondition:
+		return patternMatches(cond.Key, cond.Pattern, fields)
+
+	case ContainsDisplayNameCondition:
+		displayName := rse.ec.UserDisplayName()
+		if displayName == "" {
+			return false, nil
+		}
+		body, ok := lookupString(fields, "content.body")
+		if !ok {
+			return false, nil
+		}
+		return wordBoundaryRegexp(regexp.QuoteMeta(displayName)).MatchString(body), nil
+
+	case RoomMemberCountCondition:
+		cmp, err := parseRoomMemberCountCondition(cond.Is)
+		if err != nil {
+			// Unrecognised conditions don't match.
+			return false, nil
+		}
+		n, err := rse.ec.RoomMemberCount()
+		if err != nil {
+			return false, err
+		}
+		return cmp(n), nil
+
+	case SenderNotificationPermissionCondition:
+		return rse.ec.HasPowerLevel(event.Sender(), cond.Key)
+
+	default:
+		return false, nil
+	}
+}
+
+// parseRoomMemberCountCondition parses the "is" field of a
+// room_member_count condition, which is an integer prefixed by one of
+// ==, <, >, >= or <=. A bare integer is the same as ==.
+func parseRoomMemberCountCondition(s string) (func(int) bool, error) {
+	var op string
+	for _, prefix := range []string{"==", "<=", ">=", "<", ">"} {
+		if strings.HasPrefix(s, prefix) {
+			op = prefix
+			s = s[len(prefix):]
+			break
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "<":
+		return func(count int) bool { return count < n }, nil
+	case "<=":
+		return func(count int) bool { return count <= n }, nil
+	case ">":
+		return func(count int) bool { return count > n }, nil
+	case ">=":
+		return func(count int) bool { return count >= n }, nil
+	default:
+		return func(count int) bool { return count == n }, nil
+	}
+}
+
+// patternMatches matches the glob pattern against the string value at the
+// dot-separated key in the event. The content.body key matches on word
+// boundaries, and every other key must match the whole value.
+func patternMatches(key, pattern string, fields map[string]interface{}) (bool, error) {
+	value, ok := lookupString(fields, key)
+	if !ok {
+		return false, nil
+	}
+	if key == "content.body" {
+		return wordBoundaryRegexp(globToRegexp(pattern)).MatchString(value), nil
+	}
+	re, err := regexp.Compile("(?is)^" + globToRegexp(pattern) + "$")
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(value), nil
+}
+
+// lookupString returns the string value at the dot-separated key in the
+// event fields. Values which aren't strings are treated as missing.
+func lookupString(fields map[string]interface{}, key string) (string, bool) {
+	parts := strings.Split(key, ".")
+	var v interface{} = fields
+	for _, part := range parts {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[part]; !ok {
+			return "", false
+		}
+	}
+	s, ok := v.(string)
+	return s, ok
+}
+
+// globToRegexp converts a glob with the wildcards * and ? into a regular
+// expression. Everything else matches literally.
+func globToRegexp(pattern string) string {
+	var sb strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*?")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	return sb.String()
+}
+
+// wordBoundaryRegexp matches the expression case-insensitively, as long as it
+// isn't part of a larger word.
+func wordBoundaryRegexp(expr string) *regexp.Regexp {
+	return regexp.MustCompile(`(?is)(^|\W)` + expr + `(\W|$)`)
+}
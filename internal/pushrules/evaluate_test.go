@@ -0,0 +1,221 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeEvaluationContext struct {
+	displayName string
+	memberCount int
+	powerLevels map[string]bool
+}
+
+func (ec *fakeEvaluationContext) UserDisplayName() string       { return ec.displayName }
+func (ec *fakeEvaluationContext) RoomMemberCount() (int, error) { return ec.memberCount, nil }
+func (ec *fakeEvaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	return ec.powerLevels[userID], nil
+}
+
+func mustEvent(t *testing.T, eventType string, stateKey *string, content map[string]interface{}) *gomatrixserverlib.Event {
+	t.Helper()
+	fields := map[string]interface{}{
+		"event_id":         "$event:test",
+		"room_id":          "!room:test",
+		"sender":           "@bob:test",
+		"type":             eventType,
+		"content":          content,
+		"origin_server_ts": 1,
+		"depth":            1,
+		"auth_events":      []string{},
+		"prev_events":      []string{},
+	}
+	if stateKey != nil {
+		fields["state_key"] = *stateKey
+	}
+	bs, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON(bs, false, gomatrixserverlib.RoomVersionV5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ev
+}
+
+func TestDefaultRuleSet(t *testing.T) {
+	emptyStateKey, aliceStateKey := "", "@alice:test"
+	tsts := []struct {
+		Name        string
+		EC          *fakeEvaluationContext
+		Event       *gomatrixserverlib.Event
+		WantRuleID  string
+		WantNotify  bool
+		WantHighlit bool
+	}{
+		{
+			Name:        "groupMessage",
+			EC:          &fakeEvaluationContext{displayName: "Alice", memberCount: 3},
+			Event:       mustEvent(t, "m.room.message", nil, map[string]interface{}{"msgtype": "m.text", "body": "hello"}),
+			WantRuleID:  MRuleMessage,
+			WantNotify:  true,
+			WantHighlit: false,
+		},
+		{
+			Name:       "oneToOneMessage",
+			EC:         &fakeEvaluationContext{displayName: "Alice", memberCount: 2},
+			Event:      mustEvent(t, "m.room.message", nil, map[string]interface{}{"msgtype": "m.text", "body": "hello"}),
+			WantRuleID: MRuleRoomOneToOne,
+			WantNotify: true,
+		},
+		{
+			Name:        "displayName",
+			EC:          &fakeEvaluationContext{displayName: "Alice Smith", memberCount: 3},
+			Event:       mustEvent(t, "m.room.message", nil, map[string]interface{}{"msgtype": "m.text", "body": "hi alice smith!"}),
+			WantRuleID:  MRuleContainsDisplayName,
+			WantNotify:  true,
+			WantHighlit: true,
+		},
+		{
+			Name:       "displayNameInsideWord",
+			EC:         &fakeEvaluationContext{displayName: "Al", memberCount: 3},
+			Event:      mustEvent(t, "m.room.message", nil, map[string]interface{}{"msgtype": "m.text", "body": "also"}),
+			WantRuleID: MRuleMessage,
+			WantNotify: true,
+		},
+		{
+			Name:        "userName",
+			EC:          &fakeEvaluationContext{memberCount: 3},
+			Event:       mustEvent(t, "m.room.message", nil, map[string]interface{}{"msgtype": "m.text", "body": "ping alice"}),
+			WantRuleID:  MRuleContainsUserName,
+			WantNotify:  true,
+			WantHighlit: true,
+		},
+		{
+			Name:       "notice",
+			EC:         &fakeEvaluationContext{displayName: "Alice", memberCount: 3},
+			Event:      mustEvent(t, "m.room.message", nil, map[string]interface{}{"msgtype": "m.notice", "body": "Alice"}),
+			WantRuleID: MRuleSuppressNotices,
+		},
+		{
+			Name:       "roomNotifWithoutPower",
+			EC:         &fakeEvaluationContext{memberCount: 3},
+			Event:      mustEvent(t, "m.room.message", nil, map[string]interface{}{"msgtype": "m.text", "body": "@room hi"}),
+			WantRuleID: MRuleMessage,
+			WantNotify: true,
+		},
+		{
+			Name:        "roomNotifWithPower",
+			EC:          &fakeEvaluationContext{memberCount: 3, powerLevels: map[string]bool{"@bob:test": true}},
+			Event:       mustEvent(t, "m.room.message", nil, map[string]interface{}{"msgtype": "m.text", "body": "@room hi"}),
+			WantRuleID:  MRuleRoomNotif,
+			WantNotify:  true,
+			WantHighlit: true,
+		},
+		{
+			Name:       "inviteForMe",
+			EC:         &fakeEvaluationContext{memberCount: 3},
+			Event:      mustEvent(t, "m.room.member", &aliceStateKey, map[string]interface{}{"membership": "invite"}),
+			WantRuleID: MRuleInviteForMe,
+			WantNotify: true,
+		},
+		{
+			Name:       "memberEvent",
+			EC:         &fakeEvaluationContext{memberCount: 3},
+			Event:      mustEvent(t, "m.room.member", &emptyStateKey, map[string]interface{}{"membership": "join"}),
+			WantRuleID: MRuleMemberEvent,
+		},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Name, func(t *testing.T) {
+			rs := DefaultGlobalRuleSet("alice", "test")
+			rule, err := NewRuleSetEvaluator(tst.EC, rs).MatchEvent(tst.Event)
+			if err != nil {
+				t.Fatalf("MatchEvent failed: %v", err)
+			}
+			if rule == nil {
+				t.Fatalf("MatchEvent: got no rule, want %q", tst.WantRuleID)
+			}
+			if rule.RuleID != tst.WantRuleID {
+				t.Errorf("MatchEvent: got rule %q, want %q", rule.RuleID, tst.WantRuleID)
+			}
+			notify, highlight := NotifyAndHighlight(rule.Actions)
+			if notify != tst.WantNotify || highlight != tst.WantHighlit {
+				t.Errorf("NotifyAndHighlight: got (%v, %v), want (%v, %v)", notify, highlight, tst.WantNotify, tst.WantHighlit)
+			}
+		})
+	}
+}
+
+func TestRoomMemberCountCondition(t *testing.T) {
+	tsts := []struct {
+		Is    string
+		Count int
+		Want  bool
+	}{
+		{"2", 2, true},
+		{"2", 3, false},
+		{"==2", 2, true},
+		{"<2", 1, true},
+		{"<2", 2, false},
+		{"<=2", 2, true},
+		{">2", 3, true},
+		{">2", 2, false},
+		{">=2", 2, true},
+		{"two", 2, false},
+		{"", 0, false},
+	}
+	ev := mustEvent(t, "m.room.message", nil, map[string]interface{}{"body": "hello"})
+	for _, tst := range tsts {
+		t.Run(fmt.Sprintf("%s/%d", tst.Is, tst.Count), func(t *testing.T) {
+			rse := NewRuleSetEvaluator(&fakeEvaluationContext{memberCount: tst.Count}, &RuleSet{})
+			got, err := rse.conditionMatches(&Condition{Kind: RoomMemberCountCondition, Is: tst.Is}, ev, nil)
+			if err != nil {
+				t.Fatalf("conditionMatches failed: %v", err)
+			}
+			if got != tst.Want {
+				t.Errorf("conditionMatches: got %v, want %v", got, tst.Want)
+			}
+		})
+	}
+}
+
+func TestActionJSON(t *testing.T) {
+	tsts := []string{
+		`"notify"`,
+		`"dont_notify"`,
+		`{"set_tweak":"sound","value":"default"}`,
+		`{"set_tweak":"highlight"}`,
+	}
+	for _, tst := range tsts {
+		var a Action
+		if err := json.Unmarshal([]byte(tst), &a); err != nil {
+			t.Fatalf("Unmarshal(%s) failed: %v", tst, err)
+		}
+		bs, err := json.Marshal(&a)
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		if string(bs) != tst {
+			t.Errorf("round trip: got %s, want %s", bs, tst)
+		}
+	}
+}
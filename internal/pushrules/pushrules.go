@@ -0,0 +1,117 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+// An AccountRuleSets carries the rule sets associated with an
+// account.
+type AccountRuleSets struct {
+	Global RuleSet `json:"global"` // Required
+}
+
+// A RuleSet contains all the various push rules for an
+// account. Listed in decreasing order of priority.
+type RuleSet struct {
+	Override  []*Rule `json:"override"`
+	Content   []*Rule `json:"content"`
+	Room      []*Rule `json:"room"`
+	Sender    []*Rule `json:"sender"`
+	Underride []*Rule `json:"underride"`
+}
+
+// A Rule contains matchers, conditions and final actions. While
+// evaluating, at most one rule is considered matching.
+//
+// Kind and scope are part of the push rules request/responses, but
+// not of the core data model.
+type Rule struct {
+	// RuleID is either a free identifier, or the sender's MXID for
+	// SenderKind. Required.
+	RuleID string `json:"rule_id"`
+
+	// Default indicates whether this is a server-defined default, or
+	// a user-provided rule. Required.
+	//
+	// The server-default rules have the lowest priority.
+	Default bool `json:"default"`
+
+	// Enabled allows the user to disable rules while keeping them
+	// around. Required.
+	Enabled bool `json:"enabled"`
+
+	// Actions describe the desired outcome, should the rule
+	// match. Required.
+	Actions []*Action `json:"actions"`
+
+	// Conditions provide the rule's conditions for OverrideKind and
+	// UnderrideKind. Not allowed for other kinds.
+	Conditions []*Condition `json:"conditions,omitempty"`
+
+	// Pattern is the body pattern to match for ContentKind. Required
+	// for that kind. The interpretation is the same as that of
+	// Condition.Pattern.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Scope only has one valid value. See also AccountRuleSets.
+type Scope string
+
+const (
+	UnknownScope Scope = ""
+	GlobalScope  Scope = "global"
+)
+
+// Kind is the type of push rule. See also RuleSet.
+type Kind string
+
+const (
+	UnknownKind   Kind = ""
+	OverrideKind  Kind = "override"
+	ContentKind   Kind = "content"
+	RoomKind      Kind = "room"
+	SenderKind    Kind = "sender"
+	UnderrideKind Kind = "underride"
+)
+
+// Kinds lists the kinds of push rule in the order that they are evaluated.
+var Kinds = []Kind{OverrideKind, ContentKind, RoomKind, SenderKind, UnderrideKind}
+
+// RuleSetByKind returns the rules of the given kind, or nil if the kind
+// isn't known.
+func (rs *RuleSet) RuleSetByKind(kind Kind) *[]*Rule {
+	switch kind {
+	case OverrideKind:
+		return &rs.Override
+	case ContentKind:
+		return &rs.Content
+	case RoomKind:
+		return &rs.Room
+	case SenderKind:
+		return &rs.Sender
+	case UnderrideKind:
+		return &rs.Underride
+	default:
+		return nil
+	}
+}
+
+// IsEmpty returns true if there are no rules of any kind in the rule set.
+func (rs *RuleSet) IsEmpty() bool {
+	for _, kind := range Kinds {
+		if len(*rs.RuleSetByKind(kind)) > 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,180 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+const schemaMigrationsSchema = `
+-- Tracks which versioned migrations have been applied to each component.
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    -- The component which owns the migration, e.g. "roomserver".
+    component TEXT NOT NULL,
+    -- The version of the migration.
+    version BIGINT NOT NULL,
+    -- A checksum of the migration, used to detect migrations which have
+    -- been changed after they were applied.
+    checksum TEXT NOT NULL,
+    PRIMARY KEY (component, version)
+);
+`
+
+const selectSchemaMigrationsSQL = "" +
+	"SELECT version, checksum FROM schema_migrations WHERE component = $1"
+
+const insertSchemaMigrationSQL = "" +
+	"INSERT INTO schema_migrations (component, version, checksum) VALUES ($1, $2, $3)"
+
+// Migration is a single, ordered schema change. Migrations are applied in
+// ascending version order and each one runs inside its own transaction.
+type Migration struct {
+	// Version must be unique for the component and must never be reused.
+	Version int
+	// Name describes what the migration does. It forms part of the checksum,
+	// so it must not be changed once the migration has been released.
+	Name string
+	// SQL is the statements which the migration runs. It is required, as it
+	// forms part of the checksum, so that changing the body of a migration
+	// after it was applied is detected.
+	SQL string
+	// Up applies the migration. If it is nil then SQL is executed instead.
+	// Migrations which need to inspect the database first should only run
+	// the statements in SQL.
+	Up func(*sql.Tx) error
+}
+
+// Checksum returns the checksum which is recorded when the migration is applied.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%s:%s", m.Version, m.Name, m.SQL)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (m Migration) up(txn *sql.Tx) error {
+	if m.Up != nil {
+		return m.Up(txn)
+	}
+	_, err := txn.Exec(m.SQL)
+	return err
+}
+
+// Migrator applies versioned migrations for a single component, tracking
+// the applied versions in the schema_migrations table so that restarts
+// are idempotent.
+type Migrator struct {
+	db         *sql.DB
+	component  string
+	migrations map[int]Migration
+}
+
+// NewMigrator returns a migrator for the given component. Components may
+// share a database, as applied versions are tracked per component.
+func NewMigrator(db *sql.DB, component string) *Migrator {
+	return &Migrator{
+		db:         db,
+		component:  component,
+		migrations: make(map[int]Migration),
+	}
+}
+
+// AddMigrations registers migrations with the migrator. It panics if a
+// version is registered more than once, as this is always a programming error.
+func (m *Migrator) AddMigrations(migrations ...Migration) {
+	for _, migration := range migrations {
+		if migration.Version <= 0 {
+			panic(fmt.Sprintf("migration %q has invalid version %d", migration.Name, migration.Version))
+		}
+		if migration.SQL == "" {
+			panic(fmt.Sprintf("migration %q has no SQL", migration.Name))
+		}
+		if existing, ok := m.migrations[migration.Version]; ok {
+			panic(fmt.Sprintf("migration %q: version %d conflicts with %q", migration.Name, migration.Version, existing.Name))
+		}
+		m.migrations[migration.Version] = migration
+	}
+}
+
+// Up applies all registered migrations which have not yet been applied.
+// Returns an error without applying anything if a previously applied
+// migration has a different checksum to the registered one, or if the
+// database contains migrations that this version doesn't know about.
+func (m *Migrator) Up(ctx context.Context) error {
+	if _, err := m.db.ExecContext(ctx, schemaMigrationsSchema); err != nil {
+		return fmt.Errorf("m.db.ExecContext: %w", err)
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return fmt.Errorf("m.applied: %w", err)
+	}
+	for version, checksum := range applied {
+		migration, ok := m.migrations[version]
+		if !ok {
+			return fmt.Errorf("%s: database has unknown migration version %d applied", m.component, version)
+		}
+		if migration.Checksum() != checksum {
+			return fmt.Errorf("%s: checksum mismatch for applied migration %d (%s)", m.component, version, migration.Name)
+		}
+	}
+	versions := make([]int, 0, len(m.migrations))
+	for version := range m.migrations {
+		if _, ok := applied[version]; !ok {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	for _, version := range versions {
+		migration := m.migrations[version]
+		err = WithTransaction(m.db, func(txn *sql.Tx) error {
+			if err = migration.up(txn); err != nil {
+				return err
+			}
+			_, err = txn.ExecContext(ctx, insertSchemaMigrationSQL, m.component, version, migration.Checksum())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("%s: failed to apply migration %d (%s): %w", m.component, version, migration.Name, err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"component": m.component,
+			"version":   version,
+		}).Infof("Applied migration %q", migration.Name)
+	}
+	return nil
+}
+
+func (m *Migrator) applied(ctx context.Context) (map[int]string, error) {
+	rows, err := m.db.QueryContext(ctx, selectSchemaMigrationsSQL, m.component)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close() // nolint:errcheck
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var checksum string
+		if err = rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		applied[version] = checksum
+	}
+	return applied, rows.Err()
+}
@@ -0,0 +1,112 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openTestSQLite(t *testing.T) *sql.DB {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dendrite-migrator")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	db, err := sql.Open(SQLiteDriverName(), filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	return db
+}
+
+func TestMigratorAppliesInOrderOnce(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+	var applied []int
+	migrations := []Migration{
+		{Version: 2, Name: "add column", SQL: "ALTER TABLE test ADD COLUMN b TEXT", Up: func(txn *sql.Tx) error {
+			applied = append(applied, 2)
+			_, err := txn.Exec("ALTER TABLE test ADD COLUMN b TEXT")
+			return err
+		}},
+		{Version: 1, Name: "create table", SQL: "CREATE TABLE test (a TEXT)", Up: func(txn *sql.Tx) error {
+			applied = append(applied, 1)
+			_, err := txn.Exec("CREATE TABLE test (a TEXT)")
+			return err
+		}},
+	}
+	for i := 0; i < 2; i++ {
+		m := NewMigrator(db, "test")
+		m.AddMigrations(migrations...)
+		if err := m.Up(ctx); err != nil {
+			t.Fatalf("run %d: Up returned an error: %s", i, err)
+		}
+	}
+	if len(applied) != 2 || applied[0] != 1 || applied[1] != 2 {
+		t.Fatalf("expected migrations [1 2] to be applied once, got %v", applied)
+	}
+}
+
+func TestMigratorRollsBackFailedMigration(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+	m := NewMigrator(db, "test")
+	m.AddMigrations(Migration{Version: 1, Name: "broken", SQL: "CREATE TABLE test (a TEXT); THIS IS NOT SQL"})
+	if err := m.Up(ctx); err == nil {
+		t.Fatalf("expected Up to return an error")
+	}
+	if _, err := db.Exec("SELECT a FROM test"); err == nil {
+		t.Fatalf("expected failed migration to be rolled back")
+	}
+}
+
+func TestMigratorDetectsChecksumMismatch(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+	noop := func(txn *sql.Tx) error { return nil }
+
+	m := NewMigrator(db, "test")
+	m.AddMigrations(Migration{Version: 1, Name: "original", SQL: "SELECT 1", Up: noop})
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up returned an error: %s", err)
+	}
+
+	m = NewMigrator(db, "test")
+	m.AddMigrations(Migration{Version: 1, Name: "changed", SQL: "SELECT 1", Up: noop})
+	if err := m.Up(ctx); err == nil {
+		t.Fatalf("expected Up to fail on a changed migration")
+	}
+
+	// Another component sharing the database is unaffected.
+	m = NewMigrator(db, "other")
+	m.AddMigrations(Migration{Version: 1, Name: "changed", SQL: "SELECT 1", Up: noop})
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up returned an error for a different component: %s", err)
+	}
+}
+
+func TestMigratorDetectsChangedBody(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+
+	m := NewMigrator(db, "test")
+	m.AddMigrations(Migration{Version: 1, Name: "create table", SQL: "CREATE TABLE test (a TEXT)"})
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("Up returned an error: %s", err)
+	}
+
+	m = NewMigrator(db, "test")
+	m.AddMigrations(Migration{Version: 1, Name: "create table", SQL: "CREATE TABLE test (a TEXT, b TEXT)"})
+	if err := m.Up(ctx); err == nil {
+		t.Fatalf("expected Up to fail on a migration with a changed body")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+)
+
+// TagStatementName is the span tag holding the name of the SQL statement
+// which the span covers, e.g. "bulkSelectEventJSON".
+const TagStatementName = "db.statement_name"
+
+// TagRowCount is the span tag holding the number of rows read or written.
+const TagRowCount = "db.row_count"
+
+// StartSpan starts a tracing span for a database statement, as a child of any
+// span in the context. The span is named "<component>.<statement>" so that it
+// can be aggregated across requests, and must be finished with FinishSpan.
+func StartSpan(ctx context.Context, component, statement string) (opentracing.Span, context.Context) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, component+"."+statement)
+	ext.Component.Set(span, component)
+	ext.DBType.Set(span, "sql")
+	span.SetTag(TagStatementName, statement)
+	return span, ctx
+}
+
+// FinishSpan tags the span with the number of rows affected and, if the
+// statement failed, the error, then finishes it. A missing row isn't
+// considered an error.
+func FinishSpan(span opentracing.Span, rows int, err error) {
+	span.SetTag(TagRowCount, rows)
+	if err != nil && err != sql.ErrNoRows {
+		ext.LogError(span, err)
+	}
+	span.Finish()
+}
@@ -113,6 +113,20 @@ func QueryVariadicOffset(count, offset int) string {
 	return str
 }
 
+// QueryVariadicTuples returns count comma-separated tuples of width placeholders,
+// e.g. "($1, $2), ($3, $4)" for a count and width of 2. This is for multi-row
+// INSERT statements.
+func QueryVariadicTuples(count, width int) string {
+	var b strings.Builder
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(QueryVariadicOffset(width, i*width))
+	}
+	return b.String()
+}
+
 func SQLiteDriverName() string {
 	if runtime.GOOS == "js" {
 		return "sqlite3_js"
@@ -136,6 +150,10 @@ type QueryProvider interface {
 // SQLlite can handle. See https://www.sqlite.org/limits.html for more information.
 const SQLite3MaxVariables = 999
 
+// PostgresMaxVariables is the maximum number of bind parameters in a single statement
+// that the Postgres wire protocol can handle.
+const PostgresMaxVariables = 65535
+
 // RunLimitedVariablesQuery split up a query with more variables than the used database can handle in multiple queries.
 func RunLimitedVariablesQuery(ctx context.Context, query string, qp QueryProvider, variables []interface{}, limit uint, rowHandler func(*sql.Rows) error) error {
 	var start int
@@ -3,7 +3,11 @@ package sqlutil
 import (
 	"context"
 	"database/sql"
+	"math/rand"
 	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
@@ -171,3 +175,44 @@ func assertNoError(t *testing.T, err error, msg string) {
 	}
 	t.Fatalf(msg)
 }
+
+// TestQueryVariadicPlaceholders checks that the generated placeholders are
+// numbered consecutively from the offset for a range of random sizes,
+// including 0 and sizes above the SQLite variable limit.
+func TestQueryVariadicPlaceholders(t *testing.T) {
+	placeholder := regexp.MustCompile(`\$(\d+)`)
+	check := func(got string, count, offset int) {
+		t.Helper()
+		matches := placeholder.FindAllStringSubmatch(got, -1)
+		if len(matches) != count {
+			t.Fatalf("count %d offset %d: got %d placeholders, want %d", count, offset, len(matches), count)
+		}
+		for i, match := range matches {
+			if n, _ := strconv.Atoi(match[1]); n != offset+i+1 {
+				t.Fatalf("count %d offset %d: placeholder %d is $%d, want $%d", count, offset, i, n, offset+i+1)
+			}
+		}
+	}
+	rng := rand.New(rand.NewSource(1))
+	counts := []int{0, 1, 2, SQLite3MaxVariables - 1, SQLite3MaxVariables, SQLite3MaxVariables + 1}
+	for i := 0; i < 50; i++ {
+		counts = append(counts, rng.Intn(3*SQLite3MaxVariables))
+	}
+	for _, count := range counts {
+		offset := rng.Intn(100)
+		got := QueryVariadicOffset(count, offset)
+		if !strings.HasPrefix(got, "(") || !strings.HasSuffix(got, ")") {
+			t.Fatalf("count %d: %q is not parenthesised", count, got)
+		}
+		check(got, count, offset)
+		if count > 0 && strings.Count(got, ",") != count-1 {
+			t.Fatalf("count %d: got %d commas, want %d", count, strings.Count(got, ","), count-1)
+		}
+		width := 1 + rng.Intn(4)
+		check(QueryVariadicTuples(count, width), count*width, 0)
+	}
+	// There is no valid SQL for an empty list, so callers must check for it.
+	if got := QueryVariadic(0); got != "()" {
+		t.Fatalf("QueryVariadic(0): got %q, want \"()\"", got)
+	}
+}
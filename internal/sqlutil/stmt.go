@@ -0,0 +1,250 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxReprepareAttempts is the number of times that a statement will be
+// re-prepared for a single call before giving up and returning the error.
+const maxReprepareAttempts = 1
+
+// errStmtClosed matches the unexported error that database/sql returns when
+// using a statement which has been closed.
+const errStmtClosed = "sql: statement is closed"
+
+// maxLoggedQueryLength is the maximum length of a query included in the log
+// line when a query times out.
+const maxLoggedQueryLength = 200
+
+// queryTimeouts holds the configured query timeout for each database opened
+// with Open, keyed by *sql.DB.
+var queryTimeouts sync.Map
+
+// setQueryTimeout sets the timeout applied to statements prepared with
+// PrepareStmt on the given database, when the caller's context has no deadline.
+func setQueryTimeout(db *sql.DB, timeout time.Duration) {
+	if timeout > 0 {
+		queryTimeouts.Store(db, timeout)
+	}
+}
+
+// Stmt is a prepared statement which is transparently re-prepared if it
+// becomes unusable, e.g. because the database connection was lost or the
+// SQLite database file was replaced. Calls made on a statement which is
+// bound to a transaction using WithTx are never retried, as the transaction
+// can't be recovered. If the database has a query timeout configured then it
+// is applied to calls whose context has no deadline.
+type Stmt struct {
+	prepared *preparedStmt
+	txn      *sql.Tx
+}
+
+type preparedStmt struct {
+	db      *sql.DB
+	query   string
+	timeout time.Duration
+	mu      sync.RWMutex
+	stmt    *sql.Stmt
+}
+
+// PrepareStmt prepares the query and returns a statement that will be
+// re-prepared automatically after connection loss.
+func PrepareStmt(db *sql.DB, query string) (*Stmt, error) {
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	prepared := &preparedStmt{
+		db:    db,
+		query: query,
+		stmt:  stmt,
+	}
+	if timeout, ok := queryTimeouts.Load(db); ok {
+		prepared.timeout = timeout.(time.Duration)
+	}
+	return &Stmt{
+		prepared: prepared,
+	}, nil
+}
+
+// WithTx returns the statement bound to the given transaction. If the
+// transaction is nil then the statement is returned unchanged.
+func (s *Stmt) WithTx(txn *sql.Tx) *Stmt {
+	if txn == nil {
+		return s
+	}
+	return &Stmt{
+		prepared: s.prepared,
+		txn:      txn,
+	}
+}
+
+// ExecContext executes the prepared statement with the given arguments.
+func (s *Stmt) ExecContext(ctx context.Context, args ...interface{}) (res sql.Result, err error) {
+	ctx, cancel := s.withTimeout(ctx)
+	defer cancel()
+	err = s.do(ctx, func(stmt *sql.Stmt) error {
+		res, err = stmt.ExecContext(ctx, args...)
+		return err
+	})
+	return
+}
+
+// QueryContext executes the prepared query statement with the given arguments.
+// Any query timeout also applies to reading the returned rows, and is released
+// when they are closed.
+func (s *Stmt) QueryContext(ctx context.Context, args ...interface{}) (*Rows, error) {
+	ctx, cancel := s.withTimeout(ctx)
+	var rows *sql.Rows
+	err := s.do(ctx, func(stmt *sql.Stmt) (err error) {
+		rows, err = stmt.QueryContext(ctx, args...)
+		return err
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return &Rows{Rows: rows, ctx: ctx, cancel: cancel}, nil
+}
+
+// QueryRowContext executes the prepared query statement, which is expected
+// to return at most one row. As with database/sql, errors are deferred until
+// Scan is called on the returned row.
+func (s *Stmt) QueryRowContext(ctx context.Context, args ...interface{}) *Row {
+	rows, err := s.QueryContext(ctx, args...)
+	return &Row{rows: rows, err: err}
+}
+
+// Close closes the underlying prepared statement.
+func (s *Stmt) Close() error {
+	s.prepared.mu.RLock()
+	defer s.prepared.mu.RUnlock()
+	return s.prepared.stmt.Close()
+}
+
+// withTimeout applies the query timeout to the context if it has no deadline.
+func (s *Stmt) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || s.prepared.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, s.prepared.timeout)
+}
+
+func (s *Stmt) do(ctx context.Context, f func(stmt *sql.Stmt) error) error {
+	err := s.try(ctx, f)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		query := s.prepared.query
+		if len(query) > maxLoggedQueryLength {
+			query = query[:maxLoggedQueryLength] + "..."
+		}
+		logrus.WithError(err).WithField("query", query).Warn("SQL query timed out")
+	}
+	return err
+}
+
+func (s *Stmt) try(ctx context.Context, f func(stmt *sql.Stmt) error) error {
+	stmt := s.prepared.current()
+	if s.txn != nil {
+		return f(s.txn.StmtContext(ctx, stmt))
+	}
+	err := f(stmt)
+	for attempt := 0; attempt < maxReprepareAttempts && isStaleStmtError(err); attempt++ {
+		if stmt, err = s.prepared.reprepare(ctx, stmt); err != nil {
+			return err
+		}
+		err = f(stmt)
+	}
+	return err
+}
+
+func (p *preparedStmt) current() *sql.Stmt {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.stmt
+}
+
+// reprepare replaces the failed statement with a newly prepared one. If
+// another caller has already replaced it then the replacement is returned
+// instead of preparing the statement again.
+func (p *preparedStmt) reprepare(ctx context.Context, failed *sql.Stmt) (*sql.Stmt, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stmt != failed {
+		return p.stmt, nil
+	}
+	stmt, err := p.db.PrepareContext(ctx, p.query)
+	if err != nil {
+		return nil, err
+	}
+	_ = failed.Close()
+	p.stmt = stmt
+	return stmt, nil
+}
+
+func isStaleStmtError(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, driver.ErrBadConn) || err.Error() == errStmtClosed
+}
+
+// Rows is the result of calling QueryContext on a Stmt. Closing the rows
+// also releases the query timeout.
+type Rows struct {
+	*sql.Rows
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Close closes the rows and releases the query timeout.
+func (r *Rows) Close() error {
+	defer r.cancel()
+	return r.Rows.Close()
+}
+
+// Row is the result of calling QueryRowContext on a Stmt. Scan closes the
+// row, which releases the query timeout.
+type Row struct {
+	rows *Rows
+	err  error
+}
+
+// Scan copies the columns of the matched row into the values pointed at by
+// dest. If no rows matched then sql.ErrNoRows is returned.
+func (r *Row) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	defer r.rows.Close() // nolint:errcheck
+	if !r.rows.Next() {
+		if err := r.rows.Err(); err != nil {
+			return err
+		}
+		return sql.ErrNoRows
+	}
+	if err := r.rows.Scan(dest...); err != nil {
+		return err
+	}
+	return r.rows.Close()
+}
@@ -0,0 +1,92 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestStmtReprepareAfterClose(t *testing.T) {
+	ctx := context.Background()
+	db := openTestSQLite(t)
+	if _, err := db.Exec("CREATE TABLE test (a TEXT)"); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	insert, err := PrepareStmt(db, "INSERT INTO test (a) VALUES ($1)")
+	if err != nil {
+		t.Fatalf("failed to prepare statement: %s", err)
+	}
+	sel, err := PrepareStmt(db, "SELECT a FROM test WHERE a = $1")
+	if err != nil {
+		t.Fatalf("failed to prepare statement: %s", err)
+	}
+
+	// Closing the underlying statements simulates them being invalidated.
+	_ = insert.Close()
+	_ = sel.Close()
+	if _, err = insert.ExecContext(ctx, "foo"); err != nil {
+		t.Fatalf("ExecContext was not retried: %s", err)
+	}
+	var a string
+	if err = sel.QueryRowContext(ctx, "foo").Scan(&a); err != nil {
+		t.Fatalf("QueryRowContext was not retried: %s", err)
+	}
+	if a != "foo" {
+		t.Fatalf("got %q, want %q", a, "foo")
+	}
+	if err = sel.QueryRowContext(ctx, "bar").Scan(&a); err != sql.ErrNoRows {
+		t.Fatalf("got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestStmtQueryTimeout(t *testing.T) {
+	db := openTestSQLite(t)
+	setQueryTimeout(db, time.Nanosecond)
+	stmt, err := PrepareStmt(db, "SELECT 1")
+	if err != nil {
+		t.Fatalf("failed to prepare statement: %s", err)
+	}
+	var one int
+	if err = stmt.QueryRowContext(context.Background()).Scan(&one); err == nil {
+		t.Fatalf("expected query without a deadline to time out")
+	}
+
+	// A deadline set by the caller takes precedence.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err = stmt.QueryRowContext(ctx).Scan(&one); err != nil {
+		t.Fatalf("query with a deadline returned an error: %s", err)
+	}
+}
+
+func TestStmtQueryTimeoutReleasedOnClose(t *testing.T) {
+	db := openTestSQLite(t)
+	setQueryTimeout(db, time.Minute)
+	stmt, err := PrepareStmt(db, "SELECT 1")
+	if err != nil {
+		t.Fatalf("failed to prepare statement: %s", err)
+	}
+	rows, err := stmt.QueryContext(context.Background())
+	if err != nil {
+		t.Fatalf("query returned an error: %s", err)
+	}
+	if rows.ctx.Err() != nil {
+		t.Fatalf("query context was done before the rows were closed")
+	}
+	if err = rows.Close(); err != nil {
+		t.Fatalf("failed to close rows: %s", err)
+	}
+	if rows.ctx.Err() != context.Canceled {
+		t.Fatalf("got query context error %v after closing the rows, want %v", rows.ctx.Err(), context.Canceled)
+	}
+
+	row := stmt.QueryRowContext(context.Background())
+	var one int
+	if err = row.Scan(&one); err != nil {
+		t.Fatalf("scan returned an error: %s", err)
+	}
+	if row.rows.ctx.Err() != context.Canceled {
+		t.Fatalf("got query context error %v after scanning the row, want %v", row.rows.ctx.Err(), context.Canceled)
+	}
+}
@@ -109,6 +109,7 @@ func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 		if err != nil {
 			return nil, fmt.Errorf("ParseFileURI: %w", err)
 		}
+		dsn = sqliteConnectionOptions(dsn, dbProperties)
 	case dbProperties.ConnectionString.IsPostgres():
 		driverName = "postgres"
 		dsn = string(dbProperties.ConnectionString)
@@ -123,7 +124,9 @@ func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	if driverName != SQLiteDriverName() {
+	if dbProperties.ConnectionString.IsSQLite() {
+		db.SetMaxOpenConns(SQLiteMaxOpenConns)
+	} else {
 		logrus.WithFields(logrus.Fields{
 			"MaxOpenConns":    dbProperties.MaxOpenConns,
 			"MaxIdleConns":    dbProperties.MaxIdleConns,
@@ -134,9 +137,31 @@ func Open(dbProperties *config.DatabaseOptions) (*sql.DB, error) {
 		db.SetMaxIdleConns(dbProperties.MaxIdleConns())
 		db.SetConnMaxLifetime(dbProperties.ConnMaxLifetime())
 	}
+	setQueryTimeout(db, dbProperties.QueryTimeout())
 	return db, nil
 }
 
+// SQLiteMaxOpenConns is the maximum number of open connections to an SQLite
+// database. In WAL mode only one connection can write at a time, which the
+// ExclusiveWriter already makes sure of, but the others can read at the same
+// time as it, so the limit only needs to be high enough for the concurrent
+// readers. Setting it too low will eventually make the roomserver unresponsive,
+// because something acquires the global mutex and then waits forever for a
+// connection which has been leaked.
+const SQLiteMaxOpenConns = 20
+
+// sqliteConnectionOptions adds the options used for every SQLite connection
+// to the DSN. WAL mode allows reads to happen concurrently with a write, and
+// the busy timeout makes connections wait for a lock rather than failing with
+// "database is locked" straight away.
+func sqliteConnectionOptions(dsn string, dbProperties *config.DatabaseOptions) string {
+	if runtime.GOOS == "js" {
+		// The sqlite3_js driver doesn't support these options.
+		return dsn
+	}
+	return fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=%d", dsn, dbProperties.BusyTimeout().Milliseconds())
+}
+
 func init() {
 	registerDrivers()
 }
@@ -0,0 +1,107 @@
+package sqlutil
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestOpenSQLiteConnectionOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dendrite-sqlutil")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	dbProperties := &config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "test.db")),
+	}
+	dbProperties.Defaults(100)
+	dbProperties.BusyTimeoutMilliseconds = 1234
+	db, err := Open(dbProperties)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	ctx := context.Background()
+
+	if got := db.Stats().MaxOpenConnections; got != SQLiteMaxOpenConns {
+		t.Errorf("got max open connections %d, want %d", got, SQLiteMaxOpenConns)
+	}
+	// The options must apply to every connection, not just the first.
+	conns := make([]*sql.Conn, SQLiteMaxOpenConns)
+	for i := range conns {
+		if conns[i], err = db.Conn(ctx); err != nil {
+			t.Fatalf("failed to get connection: %s", err)
+		}
+	}
+	for i, conn := range conns {
+		var journalMode string
+		var busyTimeout int
+		if err = conn.QueryRowContext(ctx, "PRAGMA journal_mode").Scan(&journalMode); err != nil {
+			t.Fatalf("failed to query journal mode: %s", err)
+		}
+		if err = conn.QueryRowContext(ctx, "PRAGMA busy_timeout").Scan(&busyTimeout); err != nil {
+			t.Fatalf("failed to query busy timeout: %s", err)
+		}
+		if journalMode != "wal" || busyTimeout != 1234 {
+			t.Errorf("connection %d: got journal mode %q and busy timeout %d", i, journalMode, busyTimeout)
+		}
+		_ = conn.Close()
+	}
+
+	if _, err = db.Exec("CREATE TABLE test (a BLOB)"); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	// Readers don't have to wait for the writer in WAL mode, so none of them
+	// should see SQLITE_BUSY while a write transaction is open. The write is
+	// larger than the page cache, so without WAL the writer would have to take
+	// an exclusive lock on the database before committing.
+	writer := NewExclusiveWriter()
+	writing, reading := make(chan struct{}), make(chan struct{})
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- writer.Do(db, nil, func(txn *sql.Tx) error {
+			if _, err := txn.Exec("INSERT INTO test (a) VALUES (randomblob(8388608))"); err != nil {
+				return err
+			}
+			close(writing)
+			<-reading
+			return nil
+		})
+	}()
+	<-writing
+	var wg sync.WaitGroup
+	readErrs := make(chan error, SQLiteMaxOpenConns)
+	for i := 0; i < SQLiteMaxOpenConns-1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var count int
+			if err := db.QueryRow("SELECT COUNT(*) FROM test").Scan(&count); err != nil {
+				readErrs <- err
+			} else if count != 0 {
+				readErrs <- fmt.Errorf("read an uncommitted write")
+			}
+		}()
+	}
+	wg.Wait()
+	close(reading)
+	close(readErrs)
+	for err = range readErrs {
+		t.Errorf("read failed: %s", err)
+	}
+	if err = <-writeErr; err != nil {
+		t.Errorf("write failed: %s", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package test
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// Room creates events in a single room for tests. The events are signed by
+// "localhost" with a fixed key and have no prev or auth events.
+type Room struct {
+	ID      string
+	Version gomatrixserverlib.RoomVersion
+	key     ed25519.PrivateKey
+}
+
+// NewRoom returns a room with the given ID, using room version 6.
+func NewRoom(roomID string) *Room {
+	return &Room{
+		ID:      roomID,
+		Version: gomatrixserverlib.RoomVersionV6,
+		key:     ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)),
+	}
+}
+
+// CreateEvent builds an event in the room, failing the test if it can't be built.
+func (r *Room) CreateEvent(
+	t *testing.T, sender, evType string, stateKey *string, content interface{},
+) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	eb := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		Depth:    1,
+		Type:     evType,
+		StateKey: stateKey,
+		RoomID:   r.ID,
+	}
+	if err := eb.SetContent(content); err != nil {
+		t.Fatalf("failed to set event content: %s", err)
+	}
+	ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", r.key, r.Version)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev.Headered(r.Version)
+}
+
+// CreateMemberEvent builds an m.room.member event for the user, sent by the user.
+func (r *Room) CreateMemberEvent(t *testing.T, userID, membership string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	return r.CreateEvent(t, userID, gomatrixserverlib.MRoomMember, &userID, map[string]string{"membership": membership})
+}
@@ -32,6 +32,12 @@ type KeyInternalAPI interface {
 	PerformUploadKeys(ctx context.Context, req *PerformUploadKeysRequest, res *PerformUploadKeysResponse)
 	// PerformClaimKeys claims one-time keys for use in pre-key messages
 	PerformClaimKeys(ctx context.Context, req *PerformClaimKeysRequest, res *PerformClaimKeysResponse)
+	// PerformUploadDeviceKeys uploads the master, self-signing and user-signing keys of a local user
+	PerformUploadDeviceKeys(ctx context.Context, req *PerformUploadDeviceKeysRequest, res *PerformUploadDeviceKeysResponse)
+	// PerformUploadSignatures stores signatures made by a local user on device keys and cross-signing keys
+	PerformUploadSignatures(ctx context.Context, req *PerformUploadSignaturesRequest, res *PerformUploadSignaturesResponse)
+	// PerformDeleteKeys deletes the one-time keys and cross-signing keys of a local user whose account is being deactivated
+	PerformDeleteKeys(ctx context.Context, req *PerformDeleteKeysRequest, res *PerformDeleteKeysResponse)
 	QueryKeys(ctx context.Context, req *QueryKeysRequest, res *QueryKeysResponse)
 	QueryKeyChanges(ctx context.Context, req *QueryKeyChangesRequest, res *QueryKeyChangesResponse)
 	QueryOneTimeKeys(ctx context.Context, req *QueryOneTimeKeysRequest, res *QueryOneTimeKeysResponse)
@@ -41,6 +47,12 @@ type KeyInternalAPI interface {
 // KeyError is returned if there was a problem performing/querying the server
 type KeyError struct {
 	Err string
+	// Set if the request was missing a required parameter (M_MISSING_PARAM)
+	IsMissingParam bool
+	// Set if a parameter in the request was invalid (M_INVALID_PARAM)
+	IsInvalidParam bool
+	// Set if a signature was missing or didn't verify (M_INVALID_SIGNATURE)
+	IsInvalidSignature bool
 }
 
 func (k *KeyError) Error() string {
@@ -151,7 +163,86 @@ type PerformClaimKeysResponse struct {
 	Error *KeyError
 }
 
+// CrossSigningKeyPurpose is the usage of a cross-signing key.
+type CrossSigningKeyPurpose string
+
+const (
+	CrossSigningKeyPurposeMaster      CrossSigningKeyPurpose = "master"
+	CrossSigningKeyPurposeSelfSigning CrossSigningKeyPurpose = "self_signing"
+	CrossSigningKeyPurposeUserSigning CrossSigningKeyPurpose = "user_signing"
+)
+
+// CrossSigningKey is a master, self-signing or user-signing key
+// https://matrix.org/docs/spec/client_server/unstable#post-matrix-client-r0-keys-device-signing-upload
+type CrossSigningKey struct {
+	UserID     string                                                               `json:"user_id"`
+	Usage      []CrossSigningKeyPurpose                                             `json:"usage"`
+	Keys       map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes            `json:"keys"`
+	Signatures map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"signatures,omitempty"`
+}
+
+// PublicKey returns the key ID and public key of a cross-signing key, which
+// must have exactly one key.
+func (k *CrossSigningKey) PublicKey() (gomatrixserverlib.KeyID, gomatrixserverlib.Base64Bytes) {
+	for keyID, key := range k.Keys {
+		return keyID, key
+	}
+	return "", nil
+}
+
+// PerformUploadDeviceKeysRequest is the request to PerformUploadDeviceKeys
+type PerformUploadDeviceKeysRequest struct {
+	UserID string
+	// The keys to upload by purpose. Keys which aren't included are left as they are,
+	// unless the master key is replaced, in which case they are removed.
+	Keys map[CrossSigningKeyPurpose]CrossSigningKey
+}
+
+// PerformUploadDeviceKeysResponse is the response to PerformUploadDeviceKeys
+type PerformUploadDeviceKeysResponse struct {
+	Error *KeyError
+}
+
+// PerformUploadSignaturesRequest is the request to PerformUploadSignatures
+type PerformUploadSignaturesRequest struct {
+	// The user whose device or cross-signing keys made the signatures
+	UserID string
+	// Map of user_id to key_id to the signed device key or cross-signing key JSON, where
+	// key_id is a device ID or the public part of a cross-signing key.
+	Signatures map[string]map[string]json.RawMessage
+}
+
+// PerformUploadSignaturesResponse is the response to PerformUploadSignatures
+type PerformUploadSignaturesResponse struct {
+	// Map of user_id to key_id to the reason the signatures on that key were rejected
+	Failures map[string]map[string]*KeyError
+	// Set if there was a fatal error processing this action
+	Error *KeyError
+}
+
+// Failure sets a failure for the given key
+func (r *PerformUploadSignaturesResponse) Failure(userID, keyID string, err *KeyError) {
+	if r.Failures[userID] == nil {
+		r.Failures[userID] = make(map[string]*KeyError)
+	}
+	r.Failures[userID][keyID] = err
+}
+
+// PerformDeleteKeysRequest is the request to PerformDeleteKeys
+type PerformDeleteKeysRequest struct {
+	UserID string
+}
+
+// PerformDeleteKeysResponse is the response to PerformDeleteKeys
+type PerformDeleteKeysResponse struct {
+	// Set if there was a fatal error processing this action
+	Error *KeyError
+}
+
 type QueryKeysRequest struct {
+	// The user performing the query, who can see their own user-signing key and the
+	// signatures made by it. Empty for federation queries.
+	UserID string
 	// Maps user IDs to a list of devices
 	UserToDevices map[string][]string
 	Timeout       time.Duration
@@ -162,6 +253,10 @@ type QueryKeysResponse struct {
 	Failures map[string]interface{}
 	// Map of user_id to device_id to device_key
 	DeviceKeys map[string]map[string]json.RawMessage
+	// Maps of user_id to cross-signing key, including the signatures on it
+	MasterKeys      map[string]CrossSigningKey
+	SelfSigningKeys map[string]CrossSigningKey
+	UserSigningKeys map[string]CrossSigningKey
 	// Set if there was a fatal error processing this query
 	Error *KeyError
 }
@@ -0,0 +1,388 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/sjson"
+)
+
+// signatureMap is the signatures field of a signed JSON object, as user ID to key ID to signature.
+type signatureMap map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes
+
+func (a *KeyInternalAPI) PerformUploadDeviceKeys(ctx context.Context, req *api.PerformUploadDeviceKeysRequest, res *api.PerformUploadDeviceKeysResponse) {
+	for purpose, key := range req.Keys {
+		if err := validateCrossSigningKey(req.UserID, purpose, key); err != nil {
+			res.Error = &api.KeyError{
+				Err:            fmt.Sprintf("invalid %s key: %s", purpose, err),
+				IsInvalidParam: true,
+			}
+			return
+		}
+	}
+	existingKeys, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query existing cross-signing keys: %s", err),
+		}
+		return
+	}
+
+	// the self-signing and user-signing keys must be signed by the master key, which is
+	// either being uploaded now or was uploaded before
+	masterKey, ok := req.Keys[api.CrossSigningKeyPurposeMaster]
+	if !ok {
+		masterKey, ok = existingKeys[api.CrossSigningKeyPurposeMaster]
+	}
+	if !ok {
+		res.Error = &api.KeyError{
+			Err:            "no master key was uploaded or found",
+			IsMissingParam: true,
+		}
+		return
+	}
+	masterKeyID, masterPublicKey := masterKey.PublicKey()
+	for _, purpose := range []api.CrossSigningKeyPurpose{api.CrossSigningKeyPurposeSelfSigning, api.CrossSigningKeyPurposeUserSigning} {
+		key, ok := req.Keys[purpose]
+		if !ok {
+			continue
+		}
+		keyJSON, err := json.Marshal(key)
+		if err != nil {
+			res.Error = &api.KeyError{
+				Err: fmt.Sprintf("failed to marshal %s key: %s", purpose, err),
+			}
+			return
+		}
+		if err = gomatrixserverlib.VerifyJSON(req.UserID, masterKeyID, ed25519.PublicKey(masterPublicKey), keyJSON); err != nil {
+			res.Error = &api.KeyError{
+				Err:                fmt.Sprintf("%s key isn't signed by the master key: %s", purpose, err),
+				IsInvalidSignature: true,
+			}
+			return
+		}
+	}
+
+	if err = a.DB.StoreCrossSigningKeysForUser(ctx, req.UserID, req.Keys); err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to store cross-signing keys: %s", err),
+		}
+		return
+	}
+	if err = a.produceCrossSigningChange(req.UserID); err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to produce key change: %s", err),
+		}
+	}
+}
+
+// produceCrossSigningChange records that the cross-signing keys or signatures of the user have
+// changed, so that they appear in the device_lists.changed of anyone who shares a room with them.
+// The change has no device ID, which tells consumers that no device was updated.
+func (a *KeyInternalAPI) produceCrossSigningChange(userID string) error {
+	if a.Producer == nil {
+		return nil
+	}
+	return a.Producer.ProduceKeyChanges([]api.DeviceMessage{{
+		DeviceKeys: api.DeviceKeys{UserID: userID},
+	}})
+}
+
+// validateCrossSigningKey checks that the key belongs to the user, is for the given purpose and
+// contains exactly one ed25519 key.
+func validateCrossSigningKey(userID string, purpose api.CrossSigningKeyPurpose, key api.CrossSigningKey) error {
+	if key.UserID != userID {
+		return fmt.Errorf("user_id mismatch: %q != %q", key.UserID, userID)
+	}
+	hasPurpose := false
+	for _, usage := range key.Usage {
+		hasPurpose = hasPurpose || usage == purpose
+	}
+	if !hasPurpose {
+		return fmt.Errorf("usage doesn't include %q", purpose)
+	}
+	if len(key.Keys) != 1 {
+		return fmt.Errorf("keys must contain exactly one key, found %d", len(key.Keys))
+	}
+	keyID, publicKey := key.PublicKey()
+	if keyID != gomatrixserverlib.KeyID("ed25519:"+publicKey.Encode()) || len(publicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("key %q isn't an ed25519 key named after its public part", keyID)
+	}
+	return nil
+}
+
+func (a *KeyInternalAPI) PerformUploadSignatures(ctx context.Context, req *api.PerformUploadSignaturesRequest, res *api.PerformUploadSignaturesResponse) {
+	res.Failures = make(map[string]map[string]*api.KeyError)
+	ownKeys, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{
+			Err: fmt.Sprintf("failed to query cross-signing keys: %s", err),
+		}
+		return
+	}
+	for targetUserID, forUser := range req.Signatures {
+		for targetKeyID, signedJSON := range forUser {
+			if keyErr := a.uploadSignatures(ctx, req.UserID, ownKeys, targetUserID, targetKeyID, signedJSON); keyErr != nil {
+				res.Failure(targetUserID, targetKeyID, keyErr)
+			}
+		}
+	}
+}
+
+// uploadSignatures verifies and stores the signatures made by the user on a single device or
+// cross-signing key. Users can sign their own devices with their self-signing key, their own master
+// key with their devices and the master keys of other users with their user-signing key.
+func (a *KeyInternalAPI) uploadSignatures(
+	ctx context.Context, userID string, ownKeys map[api.CrossSigningKeyPurpose]api.CrossSigningKey,
+	targetUserID, targetKeyID string, signedJSON json.RawMessage,
+) *api.KeyError {
+	var signed struct {
+		Signatures signatureMap `json:"signatures"`
+	}
+	if err := json.Unmarshal(signedJSON, &signed); err != nil {
+		return &api.KeyError{Err: fmt.Sprintf("invalid JSON: %s", err), IsInvalidParam: true}
+	}
+	if len(signed.Signatures[userID]) == 0 {
+		return &api.KeyError{Err: "no signatures were made by " + userID, IsInvalidSignature: true}
+	}
+
+	// work out which object was signed and which keys are allowed to sign it
+	var targetJSON json.RawMessage
+	signerKeys := make(map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes)
+	masterKey, hasMaster := ownKeys[api.CrossSigningKeyPurposeMaster]
+	_, masterPublicKey := masterKey.PublicKey()
+	switch {
+	case targetUserID == userID && hasMaster && targetKeyID == masterPublicKey.Encode():
+		masterKey.Signatures = nil
+		var err error
+		if targetJSON, err = json.Marshal(masterKey); err != nil {
+			return &api.KeyError{Err: fmt.Sprintf("failed to marshal master key: %s", err)}
+		}
+		devices, err := a.DB.DeviceKeysForUser(ctx, userID, nil)
+		if err != nil {
+			return &api.KeyError{Err: fmt.Sprintf("failed to query device keys: %s", err)}
+		}
+		for _, device := range devices {
+			var deviceKey struct {
+				Keys map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes `json:"keys"`
+			}
+			if len(device.KeyJSON) == 0 || json.Unmarshal(device.KeyJSON, &deviceKey) != nil {
+				continue
+			}
+			keyID := gomatrixserverlib.KeyID("ed25519:" + device.DeviceID)
+			if key, ok := deviceKey.Keys[keyID]; ok {
+				signerKeys[keyID] = key
+			}
+		}
+	case targetUserID == userID:
+		devices, err := a.DB.DeviceKeysForUser(ctx, userID, []string{targetKeyID})
+		if err != nil {
+			return &api.KeyError{Err: fmt.Sprintf("failed to query device keys: %s", err)}
+		}
+		if len(devices) == 0 || len(devices[0].KeyJSON) == 0 {
+			return &api.KeyError{Err: "unknown device " + targetKeyID, IsInvalidParam: true}
+		}
+		targetJSON = devices[0].KeyJSON
+		if selfSigningKey, ok := ownKeys[api.CrossSigningKeyPurposeSelfSigning]; ok {
+			keyID, key := selfSigningKey.PublicKey()
+			signerKeys[keyID] = key
+		}
+	default:
+		key, keyErr := a.masterKeyForSigning(ctx, targetUserID, targetKeyID, signedJSON)
+		if keyErr != nil {
+			return keyErr
+		}
+		var err error
+		if targetJSON, err = json.Marshal(key); err != nil {
+			return &api.KeyError{Err: fmt.Sprintf("failed to marshal master key: %s", err)}
+		}
+		if userSigningKey, ok := ownKeys[api.CrossSigningKeyPurposeUserSigning]; ok {
+			keyID, key := userSigningKey.PublicKey()
+			signerKeys[keyID] = key
+		}
+	}
+
+	verified := make(map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes)
+	for keyID, signerKey := range signerKeys {
+		sig, ok := signed.Signatures[userID][keyID]
+		if !ok {
+			continue
+		}
+		withSig, err := sjson.SetBytes(targetJSON, "signatures", signatureMap{userID: {keyID: sig}})
+		if err != nil {
+			return &api.KeyError{Err: fmt.Sprintf("failed to add signature: %s", err)}
+		}
+		if err = gomatrixserverlib.VerifyJSON(userID, keyID, ed25519.PublicKey(signerKey), withSig); err != nil {
+			return &api.KeyError{Err: fmt.Sprintf("signature by %s doesn't verify: %s", keyID, err), IsInvalidSignature: true}
+		}
+		verified[keyID] = sig
+	}
+	if len(verified) == 0 {
+		return &api.KeyError{Err: "no signatures were made by a key which is allowed to sign this key", IsInvalidSignature: true}
+	}
+	for keyID, sig := range verified {
+		if err := a.DB.StoreCrossSigningSigsForTarget(ctx, userID, keyID, targetUserID, targetKeyID, sig); err != nil {
+			return &api.KeyError{Err: fmt.Sprintf("failed to store signature: %s", err)}
+		}
+	}
+	if err := a.produceCrossSigningChange(targetUserID); err != nil {
+		return &api.KeyError{Err: fmt.Sprintf("failed to produce key change: %s", err)}
+	}
+	return nil
+}
+
+// masterKeyForSigning returns the master key of another user which is being signed. The master keys
+// of local users are known, but those of remote users are taken from the signed object instead.
+func (a *KeyInternalAPI) masterKeyForSigning(
+	ctx context.Context, targetUserID, targetKeyID string, signedJSON json.RawMessage,
+) (api.CrossSigningKey, *api.KeyError) {
+	var key api.CrossSigningKey
+	_, serverName, err := gomatrixserverlib.SplitID('@', targetUserID)
+	if err != nil {
+		return key, &api.KeyError{Err: "invalid user ID " + targetUserID, IsInvalidParam: true}
+	}
+	if serverName == a.ThisServer {
+		keys, err := a.DB.CrossSigningKeysForUser(ctx, targetUserID)
+		if err != nil {
+			return key, &api.KeyError{Err: fmt.Sprintf("failed to query cross-signing keys: %s", err)}
+		}
+		key = keys[api.CrossSigningKeyPurposeMaster]
+	} else {
+		if err = json.Unmarshal(signedJSON, &key); err != nil {
+			return key, &api.KeyError{Err: fmt.Sprintf("invalid master key: %s", err), IsInvalidParam: true}
+		}
+		if err = validateCrossSigningKey(targetUserID, api.CrossSigningKeyPurposeMaster, key); err != nil {
+			return key, &api.KeyError{Err: fmt.Sprintf("invalid master key: %s", err), IsInvalidParam: true}
+		}
+	}
+	if _, publicKey := key.PublicKey(); publicKey == nil || publicKey.Encode() != targetKeyID {
+		return key, &api.KeyError{Err: "unknown master key " + targetKeyID, IsInvalidParam: true}
+	}
+	key.Signatures = nil
+	return key, nil
+}
+
+// crossSigningKeysFromDatabase adds the cross-signing keys of the queried users to the response, and
+// adds the signatures on them and on the device keys in the response. Users only see the signatures
+// that users made on their own keys, along with the signatures made by their own user-signing key.
+func (a *KeyInternalAPI) crossSigningKeysFromDatabase(ctx context.Context, req *api.QueryKeysRequest, res *api.QueryKeysResponse) {
+	res.MasterKeys = make(map[string]api.CrossSigningKey)
+	res.SelfSigningKeys = make(map[string]api.CrossSigningKey)
+	res.UserSigningKeys = make(map[string]api.CrossSigningKey)
+	for targetUserID := range req.UserToDevices {
+		keys, err := a.DB.CrossSigningKeysForUser(ctx, targetUserID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to query cross-signing keys")
+			continue
+		}
+		for purpose, key := range keys {
+			if purpose == api.CrossSigningKeyPurposeUserSigning && targetUserID != req.UserID {
+				continue // user-signing keys are only visible to their owner
+			}
+			_, publicKey := key.PublicKey()
+			sigs, err := a.DB.CrossSigningSigsForTarget(ctx, targetUserID, publicKey.Encode())
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("Failed to query cross-signing signatures")
+				continue
+			}
+			key.Signatures = visibleSignatures(req.UserID, targetUserID, sigs)
+			switch purpose {
+			case api.CrossSigningKeyPurposeMaster:
+				res.MasterKeys[targetUserID] = key
+			case api.CrossSigningKeyPurposeSelfSigning:
+				res.SelfSigningKeys[targetUserID] = key
+			case api.CrossSigningKeyPurposeUserSigning:
+				res.UserSigningKeys[targetUserID] = key
+			}
+		}
+	}
+	for targetUserID, devices := range res.DeviceKeys {
+		for deviceID, keyJSON := range devices {
+			sigs, err := a.DB.CrossSigningSigsForTarget(ctx, targetUserID, deviceID)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("Failed to query cross-signing signatures")
+				continue
+			}
+			sigs = visibleSignatures(req.UserID, targetUserID, sigs)
+			if len(sigs) == 0 {
+				continue
+			}
+			if keyJSON, err = addSignatures(keyJSON, sigs); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("Failed to add cross-signing signatures to device key")
+				continue
+			}
+			devices[deviceID] = keyJSON
+		}
+	}
+}
+
+// visibleSignatures returns the signatures on a key of the target user which the querying user can see.
+func visibleSignatures(userID, targetUserID string, sigs signatureMap) signatureMap {
+	visible := make(signatureMap)
+	for originUserID, forOrigin := range sigs {
+		if originUserID == targetUserID || (userID != "" && originUserID == userID) {
+			visible[originUserID] = forOrigin
+		}
+	}
+	return visible
+}
+
+// addSignatures merges the signatures into the signatures field of the key JSON.
+func addSignatures(keyJSON json.RawMessage, sigs signatureMap) (json.RawMessage, error) {
+	var existing struct {
+		Signatures signatureMap `json:"signatures"`
+	}
+	if err := json.Unmarshal(keyJSON, &existing); err != nil {
+		return nil, err
+	}
+	if existing.Signatures == nil {
+		existing.Signatures = make(signatureMap)
+	}
+	for originUserID, forOrigin := range sigs {
+		if existing.Signatures[originUserID] == nil {
+			existing.Signatures[originUserID] = make(map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes)
+		}
+		for keyID, sig := range forOrigin {
+			existing.Signatures[originUserID][keyID] = sig
+		}
+	}
+	return sjson.SetBytes(keyJSON, "signatures", existing.Signatures)
+}
+
+// PerformDeleteKeys deletes the one-time keys, cross-signing keys and cross-signing signatures of the user.
+// The device keys are deleted by the user API alongside the devices themselves.
+func (a *KeyInternalAPI) PerformDeleteKeys(ctx context.Context, req *api.PerformDeleteKeysRequest, res *api.PerformDeleteKeysResponse) {
+	keys, err := a.DB.CrossSigningKeysForUser(ctx, req.UserID)
+	if err != nil {
+		res.Error = &api.KeyError{Err: fmt.Sprintf("failed to query cross-signing keys: %s", err)}
+		return
+	}
+	if err = a.DB.DeleteKeysForUser(ctx, req.UserID); err != nil {
+		res.Error = &api.KeyError{Err: fmt.Sprintf("failed to delete keys: %s", err)}
+		return
+	}
+	if len(keys) > 0 {
+		if err = a.produceCrossSigningChange(req.UserID); err != nil {
+			res.Error = &api.KeyError{Err: fmt.Sprintf("failed to produce cross-signing change: %s", err)}
+		}
+	}
+}
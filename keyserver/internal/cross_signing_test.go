@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const crossSigningUserID = "@alice:localhost"
+
+type testCrossSigningKey struct {
+	api.CrossSigningKey
+	private ed25519.PrivateKey
+}
+
+func mustCreateCrossSigningKey(t *testing.T, purpose api.CrossSigningKeyPurpose) *testCrossSigningKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %s", err)
+	}
+	publicKey := gomatrixserverlib.Base64Bytes(public)
+	return &testCrossSigningKey{
+		CrossSigningKey: api.CrossSigningKey{
+			UserID: crossSigningUserID,
+			Usage:  []api.CrossSigningKeyPurpose{purpose},
+			Keys: map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes{
+				gomatrixserverlib.KeyID("ed25519:" + publicKey.Encode()): publicKey,
+			},
+		},
+		private: private,
+	}
+}
+
+// sign returns the JSON signed by the key.
+func (k *testCrossSigningKey) sign(t *testing.T, message []byte) []byte {
+	t.Helper()
+	keyID, _ := k.PublicKey()
+	signed, err := gomatrixserverlib.SignJSON(crossSigningUserID, keyID, k.private, message)
+	if err != nil {
+		t.Fatalf("failed to sign JSON: %s", err)
+	}
+	return signed
+}
+
+// signedBy returns the key signed by the other key.
+func (k *testCrossSigningKey) signedBy(t *testing.T, other *testCrossSigningKey) api.CrossSigningKey {
+	t.Helper()
+	keyJSON, err := json.Marshal(k.CrossSigningKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err)
+	}
+	var signed api.CrossSigningKey
+	if err = json.Unmarshal(other.sign(t, keyJSON), &signed); err != nil {
+		t.Fatalf("failed to unmarshal key: %s", err)
+	}
+	return signed
+}
+
+func hasSignature(t *testing.T, keyJSON json.RawMessage, keyID gomatrixserverlib.KeyID) bool {
+	t.Helper()
+	var key struct {
+		Signatures signatureMap `json:"signatures"`
+	}
+	if err := json.Unmarshal(keyJSON, &key); err != nil {
+		t.Fatalf("failed to unmarshal key: %s", err)
+	}
+	_, ok := key.Signatures[crossSigningUserID][keyID]
+	return ok
+}
+
+func mustCreateKeyDatabase(t *testing.T) (storage.Database, func()) {
+	t.Helper()
+	tmpfile, err := ioutil.TempFile("", "keyserver_cross_signing_test")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %s", err)
+	}
+	db, err := storage.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(fmt.Sprintf("file://%s", tmpfile.Name())),
+	})
+	if err != nil {
+		t.Fatalf("failed to create database: %s", err)
+	}
+	return db, func() {
+		os.Remove(tmpfile.Name()) // nolint:errcheck
+	}
+}
+
+func TestCrossSigning(t *testing.T) {
+	db, clean := mustCreateKeyDatabase(t)
+	defer clean()
+	a := &KeyInternalAPI{DB: db, ThisServer: "localhost"}
+
+	deviceKeyJSON := []byte(`{"user_id":"` + crossSigningUserID + `","device_id":"DEVICE","algorithms":["m.olm.v1.curve25519-aes-sha2"],"keys":{}}`)
+	if err := db.StoreLocalDeviceKeys(ctx, []api.DeviceMessage{{
+		DeviceKeys: api.DeviceKeys{UserID: crossSigningUserID, DeviceID: "DEVICE", KeyJSON: deviceKeyJSON},
+	}}); err != nil {
+		t.Fatalf("failed to store device keys: %s", err)
+	}
+
+	master := mustCreateCrossSigningKey(t, api.CrossSigningKeyPurposeMaster)
+	selfSigning := mustCreateCrossSigningKey(t, api.CrossSigningKeyPurposeSelfSigning)
+	unsigned := &api.PerformUploadDeviceKeysResponse{}
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID: crossSigningUserID,
+		Keys: map[api.CrossSigningKeyPurpose]api.CrossSigningKey{
+			api.CrossSigningKeyPurposeMaster:      master.CrossSigningKey,
+			api.CrossSigningKeyPurposeSelfSigning: selfSigning.CrossSigningKey,
+		},
+	}, unsigned)
+	if unsigned.Error == nil || !unsigned.Error.IsInvalidSignature {
+		t.Fatalf("self-signing key not signed by the master key: got error %+v, want an invalid signature", unsigned.Error)
+	}
+
+	uploadRes := &api.PerformUploadDeviceKeysResponse{}
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID: crossSigningUserID,
+		Keys: map[api.CrossSigningKeyPurpose]api.CrossSigningKey{
+			api.CrossSigningKeyPurposeMaster:      master.CrossSigningKey,
+			api.CrossSigningKeyPurposeSelfSigning: selfSigning.signedBy(t, master),
+		},
+	}, uploadRes)
+	if uploadRes.Error != nil {
+		t.Fatalf("PerformUploadDeviceKeys failed: %s", uploadRes.Error)
+	}
+
+	// sign the device with the self-signing key
+	sigRes := &api.PerformUploadSignaturesResponse{}
+	a.PerformUploadSignatures(ctx, &api.PerformUploadSignaturesRequest{
+		UserID: crossSigningUserID,
+		Signatures: map[string]map[string]json.RawMessage{
+			crossSigningUserID: {"DEVICE": selfSigning.sign(t, deviceKeyJSON)},
+		},
+	}, sigRes)
+	if sigRes.Error != nil || len(sigRes.Failures) > 0 {
+		t.Fatalf("PerformUploadSignatures failed: %+v %+v", sigRes.Error, sigRes.Failures)
+	}
+
+	query := func() *api.QueryKeysResponse {
+		res := &api.QueryKeysResponse{
+			DeviceKeys: map[string]map[string]json.RawMessage{
+				crossSigningUserID: {"DEVICE": deviceKeyJSON},
+			},
+		}
+		a.crossSigningKeysFromDatabase(ctx, &api.QueryKeysRequest{
+			UserID:        crossSigningUserID,
+			UserToDevices: map[string][]string{crossSigningUserID: nil},
+		}, res)
+		return res
+	}
+	selfSigningKeyID, _ := selfSigning.PublicKey()
+	masterKeyID, _ := master.PublicKey()
+	res := query()
+	if _, ok := res.MasterKeys[crossSigningUserID]; !ok {
+		t.Errorf("master key missing from query response")
+	}
+	if _, ok := res.SelfSigningKeys[crossSigningUserID].Signatures[crossSigningUserID][masterKeyID]; !ok {
+		t.Errorf("self-signing key is missing the master key signature: %+v", res.SelfSigningKeys)
+	}
+	if !hasSignature(t, res.DeviceKeys[crossSigningUserID]["DEVICE"], selfSigningKeyID) {
+		t.Errorf("device key is missing the self-signing key signature: %s", res.DeviceKeys[crossSigningUserID]["DEVICE"])
+	}
+
+	// replacing the master key invalidates the self-signing key and its signatures
+	newMaster := mustCreateCrossSigningKey(t, api.CrossSigningKeyPurposeMaster)
+	a.PerformUploadDeviceKeys(ctx, &api.PerformUploadDeviceKeysRequest{
+		UserID: crossSigningUserID,
+		Keys: map[api.CrossSigningKeyPurpose]api.CrossSigningKey{
+			api.CrossSigningKeyPurposeMaster: newMaster.CrossSigningKey,
+		},
+	}, uploadRes)
+	if uploadRes.Error != nil {
+		t.Fatalf("PerformUploadDeviceKeys failed: %s", uploadRes.Error)
+	}
+	res = query()
+	if _, ok := res.SelfSigningKeys[crossSigningUserID]; ok {
+		t.Errorf("self-signing key signed by the old master key is still present")
+	}
+	if hasSignature(t, res.DeviceKeys[crossSigningUserID]["DEVICE"], selfSigningKeyID) {
+		t.Errorf("signature by the old self-signing key is still present: %s", res.DeviceKeys[crossSigningUserID]["DEVICE"])
+	}
+}
@@ -40,14 +40,41 @@ var (
 		},
 		[]string{"server"},
 	)
+	staleDeviceListsGauge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "dendrite",
+			Subsystem: "keyserver",
+			Name:      "stale_device_lists",
+			Help:      "Number of remote users whose device lists are stale and waiting to be resynced",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(
-		deviceListUpdateCount,
+		deviceListUpdateCount, staleDeviceListsGauge,
 	)
 }
 
+const (
+	// deviceListMinBackoff is how long to wait before retrying a server after the first failed resync.
+	// It doubles with each consecutive failure, up to deviceListMaxBackoff.
+	deviceListMinBackoff = 2 * time.Second
+	deviceListMaxBackoff = time.Hour
+)
+
+// deviceListBackoff returns how long to wait before retrying a server which has failed this many times in a row.
+func deviceListBackoff(failures int) time.Duration {
+	wait := deviceListMinBackoff
+	for i := 1; i < failures && wait < deviceListMaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > deviceListMaxBackoff {
+		wait = deviceListMaxBackoff
+	}
+	return wait
+}
+
 // DeviceListUpdater handles device list updates from remote servers.
 //
 // In the case where we have the prev_id for an update, the updater just stores the update (after acquiring a per-user lock).
@@ -74,6 +101,8 @@ func init() {
 //     than being stuck behind foo.bar
 // In the event that the query fails, a lock is acquired and the server name along with the time to wait before retrying is
 // set in a map. A restarter goroutine periodically probes this map and injects servers which are ready to be retried.
+// The wait doubles with each consecutive failure, and pokes for a server which is waiting to be retried are dropped so
+// that a stream of EDUs from an unreachable server doesn't defeat the backoff: the stale users are picked up on retry.
 type DeviceListUpdater struct {
 	// A map from user_id to a mutex. Used when we are missing prev IDs so we don't make more than 1
 	// request to the remote server and race.
@@ -151,12 +180,23 @@ func (u *DeviceListUpdater) Start() error {
 	if err != nil {
 		return err
 	}
+	staleDeviceListsGauge.Set(float64(len(staleLists)))
 	for _, userID := range staleLists {
 		u.notifyWorkers(userID)
 	}
 	return nil
 }
 
+// updateStaleGauge sets the stale device lists metric from the database.
+func (u *DeviceListUpdater) updateStaleGauge(ctx context.Context) {
+	staleLists, err := u.db.StaleDeviceLists(ctx, []gomatrixserverlib.ServerName{})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("failed to count stale device lists")
+		return
+	}
+	staleDeviceListsGauge.Set(float64(len(staleLists)))
+}
+
 func (u *DeviceListUpdater) mutex(userID string) *sync.Mutex {
 	u.mu.Lock()
 	defer u.mu.Unlock()
@@ -251,6 +291,7 @@ func (u *DeviceListUpdater) update(ctx context.Context, event gomatrixserverlib.
 	if err != nil {
 		return false, fmt.Errorf("failed to mark device list for %s as stale: %w", event.UserID, err)
 	}
+	u.updateStaleGauge(ctx)
 
 	return true, nil
 }
@@ -318,16 +359,27 @@ func (u *DeviceListUpdater) worker(ch chan gomatrixserverlib.ServerName) {
 			}
 		}
 	}()
+	// consecutive failures per server, only used by this goroutine
+	failures := make(map[gomatrixserverlib.ServerName]int)
 	for serverName := range ch {
+		retriesMu.Lock()
+		_, backingOff := retries[serverName]
+		retriesMu.Unlock()
+		if backingOff {
+			continue // the restarter will inject the server again when it's time
+		}
 		waitTime, shouldRetry := u.processServer(serverName)
-		if shouldRetry {
-			retriesMu.Lock()
-			_, exists := retries[serverName]
-			if !exists {
-				retries[serverName] = time.Now().Add(waitTime)
-			}
-			retriesMu.Unlock()
+		if !shouldRetry {
+			delete(failures, serverName)
+			continue
+		}
+		failures[serverName]++
+		if waitTime == 0 {
+			waitTime = deviceListBackoff(failures[serverName])
 		}
+		retriesMu.Lock()
+		retries[serverName] = time.Now().Add(waitTime)
+		retriesMu.Unlock()
 	}
 }
 
@@ -337,7 +389,8 @@ func (u *DeviceListUpdater) processServer(serverName gomatrixserverlib.ServerNam
 	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 	logger := util.GetLogger(ctx).WithField("server_name", serverName)
-	waitTime := 2 * time.Second
+	// zero means the worker picks the wait based on how many times in a row the server has failed
+	var waitTime time.Duration
 	// fetch stale device lists
 	userIDs, err := u.db.StaleDeviceLists(ctx, []gomatrixserverlib.ServerName{serverName})
 	if err != nil {
@@ -380,6 +433,7 @@ func (u *DeviceListUpdater) processServer(serverName gomatrixserverlib.ServerNam
 		// always clear the channel to unblock Update calls regardless of success/failure
 		u.clearChannel(userID)
 	}
+	u.updateStaleGauge(ctx)
 	return waitTime, failCount > 0
 }
 
@@ -29,6 +29,7 @@ import (
 
 	"github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 var (
@@ -54,7 +55,10 @@ type mockDeviceListUpdaterDatabase struct {
 // If no domains are given, all user IDs with stale device lists are returned.
 func (d *mockDeviceListUpdaterDatabase) StaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error) {
 	var result []string
-	for userID := range d.staleUsers {
+	for userID, isStale := range d.staleUsers {
+		if !isStale {
+			continue
+		}
 		_, remoteServer, err := gomatrixserverlib.SplitID('@', userID)
 		if err != nil {
 			return nil, err
@@ -236,3 +240,58 @@ func TestUpdateNoPrevID(t *testing.T) {
 	}
 
 }
+
+// Test that the stale device lists metric counts users until their device list has been fetched.
+func TestStaleDeviceListsGauge(t *testing.T) {
+	db := &mockDeviceListUpdaterDatabase{
+		staleUsers: make(map[string]bool),
+		prevIDsExist: func(string, []int) bool {
+			return false
+		},
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	fedClient := newFedClient(func(req *http.Request) (*http.Response, error) {
+		defer wg.Done()
+		return nil, fmt.Errorf("test: server is down")
+	})
+	updater := NewDeviceListUpdater(db, &mockKeyChangeProducer{}, fedClient, 1)
+	if err := updater.Start(); err != nil {
+		t.Fatalf("failed to start updater: %s", err)
+	}
+	if got := testutil.ToFloat64(staleDeviceListsGauge); got != 0 {
+		t.Fatalf("got %v stale device lists before any updates, want 0", got)
+	}
+	stale, err := updater.update(ctx, gomatrixserverlib.DeviceListUpdateEvent{
+		DeviceID: "FOO",
+		PrevID:   []int{3},
+		StreamID: 4,
+		UserID:   "@alice:down.test",
+	})
+	if err != nil || !stale {
+		t.Fatalf("update returned stale=%v err=%v, want a stale device list", stale, err)
+	}
+	if got := testutil.ToFloat64(staleDeviceListsGauge); got != 1 {
+		t.Errorf("got %v stale device lists, want 1", got)
+	}
+	// the resync fails, so the user must still be counted
+	updater.notifyWorkers("@alice:down.test")
+	wg.Wait()
+	time.Sleep(100 * time.Millisecond)
+	if got := testutil.ToFloat64(staleDeviceListsGauge); got != 1 {
+		t.Errorf("got %v stale device lists after a failed resync, want 1", got)
+	}
+}
+
+func TestDeviceListBackoff(t *testing.T) {
+	for failures, want := range map[int]time.Duration{
+		1:  2 * time.Second,
+		2:  4 * time.Second,
+		5:  32 * time.Second,
+		20: time.Hour,
+	} {
+		if got := deviceListBackoff(failures); got != want {
+			t.Errorf("deviceListBackoff(%d) = %s, want %s", failures, got, want)
+		}
+	}
+}
@@ -271,30 +271,47 @@ func (a *KeyInternalAPI) QueryKeys(ctx context.Context, req *api.QueryKeysReques
 				res.DeviceKeys[userID][dk.DeviceID] = dk.KeyJSON
 			}
 		} else {
-			domainToDeviceKeys[domain] = make(map[string][]string)
+			if _, ok := domainToDeviceKeys[domain]; !ok {
+				domainToDeviceKeys[domain] = make(map[string][]string)
+			}
 			domainToDeviceKeys[domain][userID] = append(domainToDeviceKeys[domain][userID], deviceIDs...)
 		}
 	}
 
 	// attempt to satisfy key queries from the local database first as we should get device updates pushed to us
 	domainToDeviceKeys = a.remoteKeysFromDatabase(ctx, res, domainToDeviceKeys)
-	if len(domainToDeviceKeys) == 0 {
-		return // nothing to query
+	if len(domainToDeviceKeys) > 0 {
+		// perform key queries for remote devices
+		a.queryRemoteKeys(ctx, req.Timeout, res, domainToDeviceKeys)
 	}
 
-	// perform key queries for remote devices
-	a.queryRemoteKeys(ctx, req.Timeout, res, domainToDeviceKeys)
+	// add cross-signing keys and the signatures on them and on the device keys
+	a.crossSigningKeysFromDatabase(ctx, req, res)
 }
 
 func (a *KeyInternalAPI) remoteKeysFromDatabase(
 	ctx context.Context, res *api.QueryKeysResponse, domainToDeviceKeys map[string]map[string][]string,
 ) map[string]map[string][]string {
 	fetchRemote := make(map[string]map[string][]string)
+	// device list updates for users whose lists are stale arrived without us having the
+	// prev_id, so anything we have in the db for them may be out of date.
+	domains := make([]gomatrixserverlib.ServerName, 0, len(domainToDeviceKeys))
+	for domain := range domainToDeviceKeys {
+		domains = append(domains, gomatrixserverlib.ServerName(domain))
+	}
+	staleUsers := make(map[string]bool)
+	staleUserIDs, err := a.DB.StaleDeviceLists(ctx, domains)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("failed to query stale device lists, assuming none are stale")
+	}
+	for _, userID := range staleUserIDs {
+		staleUsers[userID] = true
+	}
 	for domain, userToDeviceMap := range domainToDeviceKeys {
 		for userID, deviceIDs := range userToDeviceMap {
 			// we can't safely return keys from the db when all devices are requested as we don't
 			// know if one has just been added.
-			if len(deviceIDs) > 0 {
+			if len(deviceIDs) > 0 && !staleUsers[userID] {
 				err := a.populateResponseWithDeviceKeysFromDatabase(ctx, res, userID, deviceIDs)
 				if err == nil {
 					continue
@@ -315,7 +332,7 @@ func (a *KeyInternalAPI) remoteKeysFromDatabase(
 func (a *KeyInternalAPI) queryRemoteKeys(
 	ctx context.Context, timeout time.Duration, res *api.QueryKeysResponse, domainToDeviceKeys map[string]map[string][]string,
 ) {
-	resultCh := make(chan *gomatrixserverlib.RespQueryKeys, len(domainToDeviceKeys))
+	resultCh := make(chan map[string]map[string]json.RawMessage, len(domainToDeviceKeys))
 	// allows us to wait until all federation servers have been poked
 	var wg sync.WaitGroup
 	wg.Add(len(domainToDeviceKeys))
@@ -334,22 +351,75 @@ func (a *KeyInternalAPI) queryRemoteKeys(
 	}()
 
 	for result := range resultCh {
-		for userID, nest := range result.DeviceKeys {
-			res.DeviceKeys[userID] = make(map[string]json.RawMessage)
-			for deviceID, deviceKey := range nest {
-				keyJSON, err := json.Marshal(deviceKey)
-				if err != nil {
-					continue
-				}
+		for userID, nest := range result {
+			// merge with any keys we already have for the user, e.g from the database
+			if res.DeviceKeys[userID] == nil {
+				res.DeviceKeys[userID] = make(map[string]json.RawMessage)
+			}
+			for deviceID, keyJSON := range nest {
 				res.DeviceKeys[userID][deviceID] = keyJSON
 			}
 		}
 	}
 }
 
+// cacheRemoteKeys validates the device keys returned by a /keys/query request to the server and
+// stores them so later queries for the same devices can be answered from the database. Keys for
+// users on other servers or with mismatched IDs are dropped. The stream ID is unknown so it is
+// left alone: a device list update with a prev_id we don't have will mark the list as stale,
+// which makes the next query go to the server again.
+func (a *KeyInternalAPI) cacheRemoteKeys(
+	ctx context.Context, serverName string, queryKeysResp *gomatrixserverlib.RespQueryKeys,
+) map[string]map[string]json.RawMessage {
+	result := make(map[string]map[string]json.RawMessage)
+	var keys []api.DeviceMessage
+	for userID, nest := range queryKeysResp.DeviceKeys {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || string(domain) != serverName {
+			continue
+		}
+		for deviceID, deviceKey := range nest {
+			if deviceKey.UserID != userID || deviceKey.DeviceID != deviceID {
+				continue
+			}
+			keyJSON, err := json.Marshal(deviceKey)
+			if err != nil {
+				continue
+			}
+			if result[userID] == nil {
+				result[userID] = make(map[string]json.RawMessage)
+			}
+			result[userID][deviceID] = keyJSON
+			displayName := ""
+			if deviceKey.Unsigned != nil {
+				displayName, _ = deviceKey.Unsigned["device_display_name"].(string)
+			}
+			// the display name is stored separately and injected back into `unsigned` when read
+			storedJSON, err := sjson.DeleteBytes(keyJSON, "unsigned")
+			if err != nil {
+				continue
+			}
+			keys = append(keys, api.DeviceMessage{
+				DeviceKeys: api.DeviceKeys{
+					UserID:      userID,
+					DeviceID:    deviceID,
+					DisplayName: displayName,
+					KeyJSON:     storedJSON,
+				},
+			})
+		}
+	}
+	if len(keys) > 0 {
+		if err := a.DB.StoreRemoteDeviceKeys(ctx, keys, nil); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("server", serverName).Error("failed to cache remote device keys")
+		}
+	}
+	return result
+}
+
 func (a *KeyInternalAPI) queryRemoteKeysOnServer(
 	ctx context.Context, serverName string, devKeys map[string][]string, wg *sync.WaitGroup,
-	respMu *sync.Mutex, timeout time.Duration, resultCh chan<- *gomatrixserverlib.RespQueryKeys,
+	respMu *sync.Mutex, timeout time.Duration, resultCh chan<- map[string]map[string]json.RawMessage,
 	res *api.QueryKeysResponse,
 ) {
 	defer wg.Done()
@@ -398,7 +468,7 @@ func (a *KeyInternalAPI) queryRemoteKeysOnServer(
 	}
 	queryKeysResp, err := a.FedClient.QueryKeys(fedCtx, gomatrixserverlib.ServerName(serverName), devKeys)
 	if err == nil {
-		resultCh <- &queryKeysResp
+		resultCh <- a.cacheRemoteKeys(ctx, serverName, &queryKeysResp)
 		return
 	}
 	respMu.Lock()
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+)
+
+func remoteDeviceKeyJSON(userID, deviceID string) string {
+	return `{"user_id":"` + userID + `","device_id":"` + deviceID + `","algorithms":["m.olm.v1.curve25519-aes-sha2"],` +
+		`"keys":{"ed25519:` + deviceID + `":"key+` + deviceID + `"},"signatures":{},"unsigned":{"device_display_name":"Phone"}}`
+}
+
+// Test that remote keys are fetched with one request per server, that failures are reported per server,
+// and that the keys are cached until the device list goes stale.
+func TestQueryRemoteKeys(t *testing.T) {
+	db, clean := mustCreateKeyDatabase(t)
+	defer clean()
+	alice, bob, charlie := "@alice:remote.test", "@bob:remote.test", "@charlie:down.test"
+
+	var mu sync.Mutex
+	queries := make(map[string]int)
+	fedClient := newFedClient(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		queries[req.URL.Host]++
+		mu.Unlock()
+		if req.URL.Host != "remote.test" {
+			return nil, fmt.Errorf("test: %s is down", req.URL.Host)
+		}
+		if req.URL.Path != "/_matrix/federation/v1/user/keys/query" {
+			return nil, fmt.Errorf("test: invalid path: %s", req.URL.Path)
+		}
+		return &http.Response{
+			StatusCode: 200,
+			Body: ioutil.NopCloser(strings.NewReader(`{"device_keys":{` +
+				`"` + alice + `":{"ALICE":` + remoteDeviceKeyJSON(alice, "ALICE") + `},` +
+				`"` + bob + `":{"BOB":` + remoteDeviceKeyJSON(bob, "BOB") + `},` +
+				// another server's user, which must not be cached
+				`"` + charlie + `":{"CHARLIE":` + remoteDeviceKeyJSON(charlie, "CHARLIE") + `}` +
+				`}}`)),
+		}, nil
+	})
+	a := &KeyInternalAPI{DB: db, ThisServer: "localhost", FedClient: fedClient}
+	query := func() *api.QueryKeysResponse {
+		var res api.QueryKeysResponse
+		a.QueryKeys(ctx, &api.QueryKeysRequest{
+			UserToDevices: map[string][]string{
+				alice:   {"ALICE"},
+				bob:     {"BOB"},
+				charlie: {"CHARLIE"},
+			},
+			Timeout: time.Second,
+		}, &res)
+		if res.Error != nil {
+			t.Fatalf("QueryKeys returned an error: %s", res.Error)
+		}
+		return &res
+	}
+	assertKeys := func(res *api.QueryKeysResponse) {
+		t.Helper()
+		for userID, deviceID := range map[string]string{alice: "ALICE", bob: "BOB"} {
+			var key struct {
+				DeviceID string `json:"device_id"`
+				Unsigned struct {
+					DisplayName string `json:"device_display_name"`
+				} `json:"unsigned"`
+			}
+			if err := json.Unmarshal(res.DeviceKeys[userID][deviceID], &key); err != nil {
+				t.Fatalf("failed to unmarshal key for %s: %s", userID, err)
+			}
+			if key.DeviceID != deviceID || key.Unsigned.DisplayName != "Phone" {
+				t.Errorf("got key %+v for %s, want device %s", key, userID, deviceID)
+			}
+		}
+		if len(res.DeviceKeys[charlie]) != 0 {
+			t.Errorf("got keys for %s from the wrong server", charlie)
+		}
+		if _, ok := res.Failures["down.test"]; !ok || len(res.Failures) != 1 {
+			t.Errorf("got failures %v, want just down.test", res.Failures)
+		}
+	}
+
+	assertKeys(query())
+	if queries["remote.test"] != 1 {
+		t.Errorf("got %d queries to remote.test, want 1", queries["remote.test"])
+	}
+
+	// the keys are now cached, so remote.test isn't asked again
+	assertKeys(query())
+	if queries["remote.test"] != 1 {
+		t.Errorf("got %d queries to remote.test after caching, want 1", queries["remote.test"])
+	}
+
+	// a device list update we couldn't apply makes the cache stale for that user
+	if err := db.MarkDeviceListStale(ctx, alice, true); err != nil {
+		t.Fatalf("failed to mark device list stale: %s", err)
+	}
+	assertKeys(query())
+	if queries["remote.test"] != 2 {
+		t.Errorf("got %d queries to remote.test after the device list went stale, want 2", queries["remote.test"])
+	}
+}
@@ -27,13 +27,16 @@ import (
 
 // HTTP paths for the internal HTTP APIs
 const (
-	InputDeviceListUpdatePath = "/keyserver/inputDeviceListUpdate"
-	PerformUploadKeysPath     = "/keyserver/performUploadKeys"
-	PerformClaimKeysPath      = "/keyserver/performClaimKeys"
-	QueryKeysPath             = "/keyserver/queryKeys"
-	QueryKeyChangesPath       = "/keyserver/queryKeyChanges"
-	QueryOneTimeKeysPath      = "/keyserver/queryOneTimeKeys"
-	QueryDeviceMessagesPath   = "/keyserver/queryDeviceMessages"
+	InputDeviceListUpdatePath   = "/keyserver/inputDeviceListUpdate"
+	PerformUploadKeysPath       = "/keyserver/performUploadKeys"
+	PerformClaimKeysPath        = "/keyserver/performClaimKeys"
+	PerformUploadDeviceKeysPath = "/keyserver/performUploadDeviceKeys"
+	PerformUploadSignaturesPath = "/keyserver/performUploadSignatures"
+	PerformDeleteKeysPath       = "/keyserver/performDeleteKeys"
+	QueryKeysPath               = "/keyserver/queryKeys"
+	QueryKeyChangesPath         = "/keyserver/queryKeyChanges"
+	QueryOneTimeKeysPath        = "/keyserver/queryOneTimeKeys"
+	QueryDeviceMessagesPath     = "/keyserver/queryDeviceMessages"
 )
 
 // NewKeyServerClient creates a KeyInternalAPI implemented by talking to a HTTP POST API.
@@ -175,3 +178,54 @@ func (h *httpKeyInternalAPI) QueryKeyChanges(
 		}
 	}
 }
+
+func (h *httpKeyInternalAPI) PerformUploadDeviceKeys(
+	ctx context.Context,
+	request *api.PerformUploadDeviceKeysRequest,
+	response *api.PerformUploadDeviceKeysResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUploadDeviceKeys")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformUploadDeviceKeysPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.KeyError{
+			Err: err.Error(),
+		}
+	}
+}
+
+func (h *httpKeyInternalAPI) PerformUploadSignatures(
+	ctx context.Context,
+	request *api.PerformUploadSignaturesRequest,
+	response *api.PerformUploadSignaturesResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUploadSignatures")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformUploadSignaturesPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.KeyError{
+			Err: err.Error(),
+		}
+	}
+}
+
+func (h *httpKeyInternalAPI) PerformDeleteKeys(
+	ctx context.Context,
+	request *api.PerformDeleteKeysRequest,
+	response *api.PerformDeleteKeysResponse,
+) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDeleteKeys")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformDeleteKeysPath
+	err := httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+	if err != nil {
+		response.Error = &api.KeyError{
+			Err: err.Error(),
+		}
+	}
+}
@@ -73,4 +73,23 @@ type Database interface {
 
 	// MarkDeviceListStale sets the stale bit for this user to isStale.
 	MarkDeviceListStale(ctx context.Context, userID string, isStale bool) error
+
+	// CrossSigningKeysForUser returns the cross-signing keys of the user by purpose, without their signatures.
+	CrossSigningKeysForUser(ctx context.Context, userID string) (map[api.CrossSigningKeyPurpose]api.CrossSigningKey, error)
+
+	// CrossSigningSigsForTarget returns the signatures on the target key as origin user ID to origin key ID to signature.
+	// The target key ID is either a device ID or the public part of a cross-signing key.
+	CrossSigningSigsForTarget(ctx context.Context, targetUserID, targetKeyID string) (map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes, error)
+
+	// StoreCrossSigningKeysForUser persists the given cross-signing keys and the signatures on them. Signatures on and by any
+	// keys which are replaced are deleted. If the master key is replaced then the other cross-signing keys, which were signed
+	// by the old master key, are deleted unless they are replaced as well.
+	StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[api.CrossSigningKeyPurpose]api.CrossSigningKey) error
+
+	// StoreCrossSigningSigsForTarget persists the signatures on the target key.
+	StoreCrossSigningSigsForTarget(ctx context.Context, originUserID string, originKeyID gomatrixserverlib.KeyID, targetUserID, targetKeyID string, signature gomatrixserverlib.Base64Bytes) error
+
+	// DeleteKeysForUser deletes the one-time keys, cross-signing keys and cross-signing signatures of the user. Device keys
+	// are left alone, as removing them must be done with StoreLocalDeviceKeys so that the deletion is sent to other servers.
+	DeleteKeysForUser(ctx context.Context, userID string) error
 }
@@ -0,0 +1,121 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+)
+
+var crossSigningKeysSchema = `
+-- Stores the master, self-signing and user-signing keys of local users
+CREATE TABLE IF NOT EXISTS keyserver_cross_signing_keys (
+    user_id TEXT NOT NULL,
+    key_type TEXT NOT NULL,
+    key_data TEXT NOT NULL,
+    PRIMARY KEY (user_id, key_type)
+);
+`
+
+const selectCrossSigningKeysForUserSQL = "" +
+	"SELECT key_type, key_data FROM keyserver_cross_signing_keys" +
+	" WHERE user_id = $1"
+
+const upsertCrossSigningKeyForUserSQL = "" +
+	"INSERT INTO keyserver_cross_signing_keys (user_id, key_type, key_data)" +
+	" VALUES($1, $2, $3)" +
+	" ON CONFLICT (user_id, key_type) DO UPDATE SET key_data = $3"
+
+const deleteCrossSigningKeyForUserSQL = "" +
+	"DELETE FROM keyserver_cross_signing_keys WHERE user_id = $1 AND key_type = $2"
+
+const deleteAllCrossSigningKeysForUserSQL = "" +
+	"DELETE FROM keyserver_cross_signing_keys WHERE user_id = $1"
+
+type crossSigningKeysStatements struct {
+	db                                   *sql.DB
+	selectCrossSigningKeysForUserStmt    *sql.Stmt
+	upsertCrossSigningKeyForUserStmt     *sql.Stmt
+	deleteCrossSigningKeyForUserStmt     *sql.Stmt
+	deleteAllCrossSigningKeysForUserStmt *sql.Stmt
+}
+
+func NewPostgresCrossSigningKeysTable(db *sql.DB) (tables.CrossSigningKeys, error) {
+	s := &crossSigningKeysStatements{
+		db: db,
+	}
+	_, err := db.Exec(crossSigningKeysSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.selectCrossSigningKeysForUserStmt, err = db.Prepare(selectCrossSigningKeysForUserSQL); err != nil {
+		return nil, err
+	}
+	if s.upsertCrossSigningKeyForUserStmt, err = db.Prepare(upsertCrossSigningKeyForUserSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteCrossSigningKeyForUserStmt, err = db.Prepare(deleteCrossSigningKeyForUserSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteAllCrossSigningKeysForUserStmt, err = db.Prepare(deleteAllCrossSigningKeysForUserSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *crossSigningKeysStatements) SelectCrossSigningKeysForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (map[string]json.RawMessage, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectCrossSigningKeysForUserStmt).QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectCrossSigningKeysForUserStmt: rows.close() failed")
+	result := make(map[string]json.RawMessage)
+	for rows.Next() {
+		var keyType, keyData string
+		if err = rows.Scan(&keyType, &keyData); err != nil {
+			return nil, err
+		}
+		result[keyType] = json.RawMessage(keyData)
+	}
+	return result, rows.Err()
+}
+
+func (s *crossSigningKeysStatements) UpsertCrossSigningKeyForUser(
+	ctx context.Context, txn *sql.Tx, userID, keyType string, keyData json.RawMessage,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertCrossSigningKeyForUserStmt).ExecContext(ctx, userID, keyType, string(keyData))
+	return err
+}
+
+func (s *crossSigningKeysStatements) DeleteCrossSigningKeyForUser(
+	ctx context.Context, txn *sql.Tx, userID, keyType string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteCrossSigningKeyForUserStmt).ExecContext(ctx, userID, keyType)
+	return err
+}
+
+func (s *crossSigningKeysStatements) DeleteAllCrossSigningKeysForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteAllCrossSigningKeysForUserStmt).ExecContext(ctx, userID)
+	return err
+}
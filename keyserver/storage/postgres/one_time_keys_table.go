@@ -52,19 +52,26 @@ const selectKeysSQL = "" +
 const selectKeysCountSQL = "" +
 	"SELECT algorithm, COUNT(key_id) FROM keyserver_one_time_keys WHERE user_id=$1 AND device_id=$2 GROUP BY algorithm"
 
-const deleteOneTimeKeySQL = "" +
-	"DELETE FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 AND key_id = $4"
-
-const selectKeyByAlgorithmSQL = "" +
-	"SELECT key_id, key_json FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 LIMIT 1"
+// Claiming a key deletes and returns it in one statement. The row is locked by
+// the subquery and rows which are already locked by concurrent claims are
+// skipped, so the same key can never be handed out twice.
+const claimOneTimeKeySQL = "" +
+	"DELETE FROM keyserver_one_time_keys WHERE (user_id, device_id, algorithm, key_id) IN (" +
+	" SELECT user_id, device_id, algorithm, key_id FROM keyserver_one_time_keys" +
+	" WHERE user_id = $1 AND device_id = $2 AND algorithm = $3" +
+	" LIMIT 1 FOR UPDATE SKIP LOCKED" +
+	") RETURNING key_id, key_json"
+
+const deleteAllOneTimeKeysSQL = "" +
+	"DELETE FROM keyserver_one_time_keys WHERE user_id = $1"
 
 type oneTimeKeysStatements struct {
 	db                       *sql.DB
 	upsertKeysStmt           *sql.Stmt
 	selectKeysStmt           *sql.Stmt
 	selectKeysCountStmt      *sql.Stmt
-	selectKeyByAlgorithmStmt *sql.Stmt
-	deleteOneTimeKeyStmt     *sql.Stmt
+	claimOneTimeKeyStmt      *sql.Stmt
+	deleteAllOneTimeKeysStmt *sql.Stmt
 }
 
 func NewPostgresOneTimeKeysTable(db *sql.DB) (tables.OneTimeKeys, error) {
@@ -84,10 +91,10 @@ func NewPostgresOneTimeKeysTable(db *sql.DB) (tables.OneTimeKeys, error) {
 	if s.selectKeysCountStmt, err = db.Prepare(selectKeysCountSQL); err != nil {
 		return nil, err
 	}
-	if s.selectKeyByAlgorithmStmt, err = db.Prepare(selectKeyByAlgorithmSQL); err != nil {
+	if s.claimOneTimeKeyStmt, err = db.Prepare(claimOneTimeKeySQL); err != nil {
 		return nil, err
 	}
-	if s.deleteOneTimeKeyStmt, err = db.Prepare(deleteOneTimeKeySQL); err != nil {
+	if s.deleteAllOneTimeKeysStmt, err = db.Prepare(deleteAllOneTimeKeysSQL); err != nil {
 		return nil, err
 	}
 	return s, nil
@@ -181,15 +188,19 @@ func (s *oneTimeKeysStatements) SelectAndDeleteOneTimeKey(
 ) (map[string]json.RawMessage, error) {
 	var keyID string
 	var keyJSON string
-	err := sqlutil.TxStmtContext(ctx, txn, s.selectKeyByAlgorithmStmt).QueryRowContext(ctx, userID, deviceID, algorithm).Scan(&keyID, &keyJSON)
+	err := sqlutil.TxStmtContext(ctx, txn, s.claimOneTimeKeyStmt).QueryRowContext(ctx, userID, deviceID, algorithm).Scan(&keyID, &keyJSON)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 		return nil, err
 	}
-	_, err = sqlutil.TxStmtContext(ctx, txn, s.deleteOneTimeKeyStmt).ExecContext(ctx, userID, deviceID, algorithm, keyID)
 	return map[string]json.RawMessage{
 		algorithm + ":" + keyID: json.RawMessage(keyJSON),
-	}, err
+	}, nil
+}
+
+func (s *oneTimeKeysStatements) DeleteAllOneTimeKeys(ctx context.Context, txn *sql.Tx, userID string) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteAllOneTimeKeysStmt).ExecContext(ctx, userID)
+	return err
 }
@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/keyserver/api"
@@ -32,6 +33,8 @@ type Database struct {
 	DeviceKeysTable       tables.DeviceKeys
 	KeyChangesTable       tables.KeyChanges
 	StaleDeviceListsTable tables.StaleDeviceLists
+	CrossSigningKeysTable tables.CrossSigningKeys
+	CrossSigningSigsTable tables.CrossSigningSigs
 }
 
 func (d *Database) ExistingOneTimeKeys(ctx context.Context, userID, deviceID string, keyIDsWithAlgorithms []string) (map[string]json.RawMessage, error) {
@@ -152,3 +155,119 @@ func (d *Database) MarkDeviceListStale(ctx context.Context, userID string, isSta
 		return d.StaleDeviceListsTable.InsertStaleDeviceList(ctx, userID, isStale)
 	})
 }
+
+// CrossSigningKeysForUser returns the cross-signing keys of the user by purpose, without their signatures.
+func (d *Database) CrossSigningKeysForUser(ctx context.Context, userID string) (map[api.CrossSigningKeyPurpose]api.CrossSigningKey, error) {
+	return d.crossSigningKeysForUser(ctx, nil, userID)
+}
+
+func (d *Database) crossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string) (map[api.CrossSigningKeyPurpose]api.CrossSigningKey, error) {
+	keyData, err := d.CrossSigningKeysTable.SelectCrossSigningKeysForUser(ctx, txn, userID)
+	if err != nil {
+		return nil, fmt.Errorf("d.CrossSigningKeysTable.SelectCrossSigningKeysForUser: %w", err)
+	}
+	keys := make(map[api.CrossSigningKeyPurpose]api.CrossSigningKey, len(keyData))
+	for keyType, data := range keyData {
+		var key api.CrossSigningKey
+		if err = json.Unmarshal(data, &key); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+		keys[api.CrossSigningKeyPurpose(keyType)] = key
+	}
+	return keys, nil
+}
+
+// CrossSigningSigsForTarget returns the signatures on the target key as origin user ID to origin key ID to signature.
+func (d *Database) CrossSigningSigsForTarget(ctx context.Context, targetUserID, targetKeyID string) (map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes, error) {
+	return d.CrossSigningSigsTable.SelectCrossSigningSigsForTarget(ctx, nil, targetUserID, targetKeyID)
+}
+
+// StoreCrossSigningKeysForUser persists the given cross-signing keys and the signatures on them, deleting
+// the signatures on and by keys which are replaced.
+func (d *Database) StoreCrossSigningKeysForUser(ctx context.Context, userID string, keys map[api.CrossSigningKeyPurpose]api.CrossSigningKey) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		existing, err := d.crossSigningKeysForUser(ctx, txn, userID)
+		if err != nil {
+			return err
+		}
+		oldMaster, hadMaster := existing[api.CrossSigningKeyPurposeMaster]
+		newMaster, hasMaster := keys[api.CrossSigningKeyPurposeMaster]
+		masterReplaced := hadMaster && hasMaster && !sameCrossSigningKey(oldMaster, newMaster)
+		for purpose, oldKey := range existing {
+			newKey, ok := keys[purpose]
+			if ok && sameCrossSigningKey(oldKey, newKey) {
+				continue
+			}
+			if !ok && !masterReplaced {
+				continue
+			}
+			// The old key is being replaced, or was signed by a master key which is being
+			// replaced, so the signatures on it and the signatures it made are no longer valid.
+			keyID, publicKey := oldKey.PublicKey()
+			if err = d.CrossSigningSigsTable.DeleteCrossSigningSigsForTarget(ctx, txn, userID, publicKey.Encode()); err != nil {
+				return fmt.Errorf("d.CrossSigningSigsTable.DeleteCrossSigningSigsForTarget: %w", err)
+			}
+			if err = d.CrossSigningSigsTable.DeleteCrossSigningSigsByOrigin(ctx, txn, userID, keyID); err != nil {
+				return fmt.Errorf("d.CrossSigningSigsTable.DeleteCrossSigningSigsByOrigin: %w", err)
+			}
+			if !ok {
+				if err = d.CrossSigningKeysTable.DeleteCrossSigningKeyForUser(ctx, txn, userID, string(purpose)); err != nil {
+					return fmt.Errorf("d.CrossSigningKeysTable.DeleteCrossSigningKeyForUser: %w", err)
+				}
+			}
+		}
+		for purpose, key := range keys {
+			_, publicKey := key.PublicKey()
+			for originUserID, sigs := range key.Signatures {
+				for originKeyID, sig := range sigs {
+					if err = d.CrossSigningSigsTable.UpsertCrossSigningSigForTarget(
+						ctx, txn, originUserID, originKeyID, userID, publicKey.Encode(), sig,
+					); err != nil {
+						return fmt.Errorf("d.CrossSigningSigsTable.UpsertCrossSigningSigForTarget: %w", err)
+					}
+				}
+			}
+			key.Signatures = nil
+			keyData, err := json.Marshal(key)
+			if err != nil {
+				return fmt.Errorf("json.Marshal: %w", err)
+			}
+			if err = d.CrossSigningKeysTable.UpsertCrossSigningKeyForUser(ctx, txn, userID, string(purpose), keyData); err != nil {
+				return fmt.Errorf("d.CrossSigningKeysTable.UpsertCrossSigningKeyForUser: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func sameCrossSigningKey(a, b api.CrossSigningKey) bool {
+	aKeyID, aKey := a.PublicKey()
+	bKeyID, bKey := b.PublicKey()
+	return aKeyID == bKeyID && aKey.Encode() == bKey.Encode()
+}
+
+// StoreCrossSigningSigsForTarget persists the signatures on the target key.
+func (d *Database) StoreCrossSigningSigsForTarget(
+	ctx context.Context, originUserID string, originKeyID gomatrixserverlib.KeyID,
+	targetUserID, targetKeyID string, signature gomatrixserverlib.Base64Bytes,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.CrossSigningSigsTable.UpsertCrossSigningSigForTarget(ctx, txn, originUserID, originKeyID, targetUserID, targetKeyID, signature)
+	})
+}
+
+// DeleteKeysForUser deletes the one-time keys, cross-signing keys and cross-signing signatures of the user.
+func (d *Database) DeleteKeysForUser(ctx context.Context, userID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.OneTimeKeysTable.DeleteAllOneTimeKeys(ctx, txn, userID); err != nil {
+			return fmt.Errorf("d.OneTimeKeysTable.DeleteAllOneTimeKeys: %w", err)
+		}
+		if err := d.CrossSigningKeysTable.DeleteAllCrossSigningKeysForUser(ctx, txn, userID); err != nil {
+			return fmt.Errorf("d.CrossSigningKeysTable.DeleteAllCrossSigningKeysForUser: %w", err)
+		}
+		if err := d.CrossSigningSigsTable.DeleteAllCrossSigningSigsForUser(ctx, txn, userID); err != nil {
+			return fmt.Errorf("d.CrossSigningSigsTable.DeleteAllCrossSigningSigsForUser: %w", err)
+		}
+		return nil
+	})
+}
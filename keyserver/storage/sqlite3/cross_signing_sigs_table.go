@@ -0,0 +1,153 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var crossSigningSigsSchema = `
+-- Stores signatures made by devices and cross-signing keys on device keys
+-- and cross-signing keys. The target key ID is either a device ID or the
+-- public part of a cross-signing key.
+CREATE TABLE IF NOT EXISTS keyserver_cross_signing_sigs (
+    origin_user_id TEXT NOT NULL,
+    origin_key_id TEXT NOT NULL,
+    target_user_id TEXT NOT NULL,
+    target_key_id TEXT NOT NULL,
+    signature TEXT NOT NULL,
+    PRIMARY KEY (origin_user_id, origin_key_id, target_user_id, target_key_id)
+);
+
+CREATE INDEX IF NOT EXISTS keyserver_cross_signing_sigs_target_idx ON keyserver_cross_signing_sigs (target_user_id, target_key_id);
+`
+
+const selectCrossSigningSigsForTargetSQL = "" +
+	"SELECT origin_user_id, origin_key_id, signature FROM keyserver_cross_signing_sigs" +
+	" WHERE target_user_id = $1 AND target_key_id = $2"
+
+const upsertCrossSigningSigForTargetSQL = "" +
+	"INSERT INTO keyserver_cross_signing_sigs (origin_user_id, origin_key_id, target_user_id, target_key_id, signature)" +
+	" VALUES($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (origin_user_id, origin_key_id, target_user_id, target_key_id) DO UPDATE SET signature = $5"
+
+const deleteCrossSigningSigsForTargetSQL = "" +
+	"DELETE FROM keyserver_cross_signing_sigs WHERE target_user_id = $1 AND target_key_id = $2"
+
+const deleteCrossSigningSigsByOriginSQL = "" +
+	"DELETE FROM keyserver_cross_signing_sigs WHERE origin_user_id = $1 AND origin_key_id = $2"
+
+const deleteAllCrossSigningSigsForUserSQL = "" +
+	"DELETE FROM keyserver_cross_signing_sigs WHERE origin_user_id = $1 OR target_user_id = $1"
+
+type crossSigningSigsStatements struct {
+	db                                   *sql.DB
+	selectCrossSigningSigsForTargetStmt  *sql.Stmt
+	upsertCrossSigningSigForTargetStmt   *sql.Stmt
+	deleteCrossSigningSigsForTargetStmt  *sql.Stmt
+	deleteCrossSigningSigsByOriginStmt   *sql.Stmt
+	deleteAllCrossSigningSigsForUserStmt *sql.Stmt
+}
+
+func NewSqliteCrossSigningSigsTable(db *sql.DB) (tables.CrossSigningSigs, error) {
+	s := &crossSigningSigsStatements{
+		db: db,
+	}
+	_, err := db.Exec(crossSigningSigsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.selectCrossSigningSigsForTargetStmt, err = db.Prepare(selectCrossSigningSigsForTargetSQL); err != nil {
+		return nil, err
+	}
+	if s.upsertCrossSigningSigForTargetStmt, err = db.Prepare(upsertCrossSigningSigForTargetSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteCrossSigningSigsForTargetStmt, err = db.Prepare(deleteCrossSigningSigsForTargetSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteCrossSigningSigsByOriginStmt, err = db.Prepare(deleteCrossSigningSigsByOriginSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteAllCrossSigningSigsForUserStmt, err = db.Prepare(deleteAllCrossSigningSigsForUserSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *crossSigningSigsStatements) SelectCrossSigningSigsForTarget(
+	ctx context.Context, txn *sql.Tx, targetUserID, targetKeyID string,
+) (map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectCrossSigningSigsForTargetStmt).QueryContext(ctx, targetUserID, targetKeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectCrossSigningSigsForTargetStmt: rows.close() failed")
+	result := make(map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes)
+	for rows.Next() {
+		var originUserID, originKeyID, signature string
+		if err = rows.Scan(&originUserID, &originKeyID, &signature); err != nil {
+			return nil, err
+		}
+		var sig gomatrixserverlib.Base64Bytes
+		if err = sig.Decode(signature); err != nil {
+			return nil, err
+		}
+		if _, ok := result[originUserID]; !ok {
+			result[originUserID] = make(map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes)
+		}
+		result[originUserID][gomatrixserverlib.KeyID(originKeyID)] = sig
+	}
+	return result, rows.Err()
+}
+
+func (s *crossSigningSigsStatements) UpsertCrossSigningSigForTarget(
+	ctx context.Context, txn *sql.Tx,
+	originUserID string, originKeyID gomatrixserverlib.KeyID,
+	targetUserID, targetKeyID string,
+	signature gomatrixserverlib.Base64Bytes,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertCrossSigningSigForTargetStmt).ExecContext(
+		ctx, originUserID, string(originKeyID), targetUserID, targetKeyID, signature.Encode(),
+	)
+	return err
+}
+
+func (s *crossSigningSigsStatements) DeleteCrossSigningSigsForTarget(
+	ctx context.Context, txn *sql.Tx, targetUserID, targetKeyID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteCrossSigningSigsForTargetStmt).ExecContext(ctx, targetUserID, targetKeyID)
+	return err
+}
+
+func (s *crossSigningSigsStatements) DeleteCrossSigningSigsByOrigin(
+	ctx context.Context, txn *sql.Tx, originUserID string, originKeyID gomatrixserverlib.KeyID,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteCrossSigningSigsByOriginStmt).ExecContext(ctx, originUserID, string(originKeyID))
+	return err
+}
+
+func (s *crossSigningSigsStatements) DeleteAllCrossSigningSigsForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteAllCrossSigningSigsForUserStmt).ExecContext(ctx, userID)
+	return err
+}
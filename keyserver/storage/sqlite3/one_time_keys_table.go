@@ -58,6 +58,9 @@ const deleteOneTimeKeySQL = "" +
 const selectKeyByAlgorithmSQL = "" +
 	"SELECT key_id, key_json FROM keyserver_one_time_keys WHERE user_id = $1 AND device_id = $2 AND algorithm = $3 LIMIT 1"
 
+const deleteAllOneTimeKeysSQL = "" +
+	"DELETE FROM keyserver_one_time_keys WHERE user_id = $1"
+
 type oneTimeKeysStatements struct {
 	db                       *sql.DB
 	upsertKeysStmt           *sql.Stmt
@@ -65,6 +68,7 @@ type oneTimeKeysStatements struct {
 	selectKeysCountStmt      *sql.Stmt
 	selectKeyByAlgorithmStmt *sql.Stmt
 	deleteOneTimeKeyStmt     *sql.Stmt
+	deleteAllOneTimeKeysStmt *sql.Stmt
 }
 
 func NewSqliteOneTimeKeysTable(db *sql.DB) (tables.OneTimeKeys, error) {
@@ -90,6 +94,9 @@ func NewSqliteOneTimeKeysTable(db *sql.DB) (tables.OneTimeKeys, error) {
 	if s.deleteOneTimeKeyStmt, err = db.Prepare(deleteOneTimeKeySQL); err != nil {
 		return nil, err
 	}
+	if s.deleteAllOneTimeKeysStmt, err = db.Prepare(deleteAllOneTimeKeysSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -181,23 +188,41 @@ func (s *oneTimeKeysStatements) InsertOneTimeKeys(
 func (s *oneTimeKeysStatements) SelectAndDeleteOneTimeKey(
 	ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string,
 ) (map[string]json.RawMessage, error) {
-	var keyID string
-	var keyJSON string
-	err := sqlutil.TxStmtContext(ctx, txn, s.selectKeyByAlgorithmStmt).QueryRowContext(ctx, userID, deviceID, algorithm).Scan(&keyID, &keyJSON)
-	if err != nil {
-		if err == sql.ErrNoRows {
+	// Claims are serialised by the writer, but only hand the key out if this
+	// claim was the one that deleted it, so that it can never be handed out
+	// twice.
+	for {
+		var keyID string
+		var keyJSON string
+		err := sqlutil.TxStmtContext(ctx, txn, s.selectKeyByAlgorithmStmt).QueryRowContext(ctx, userID, deviceID, algorithm).Scan(&keyID, &keyJSON)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, nil
+			}
+			return nil, err
+		}
+		res, err := sqlutil.TxStmtContext(ctx, txn, s.deleteOneTimeKeyStmt).ExecContext(ctx, userID, deviceID, algorithm, keyID)
+		if err != nil {
+			return nil, err
+		}
+		deleted, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if deleted == 0 {
+			// Someone else claimed the key first, so try the next one.
+			continue
+		}
+		if keyJSON == "" {
 			return nil, nil
 		}
-		return nil, err
+		return map[string]json.RawMessage{
+			algorithm + ":" + keyID: json.RawMessage(keyJSON),
+		}, nil
 	}
-	_, err = sqlutil.TxStmtContext(ctx, txn, s.deleteOneTimeKeyStmt).ExecContext(ctx, userID, deviceID, algorithm, keyID)
-	if err != nil {
-		return nil, err
-	}
-	if keyJSON == "" {
-		return nil, nil
-	}
-	return map[string]json.RawMessage{
-		algorithm + ":" + keyID: json.RawMessage(keyJSON),
-	}, err
+}
+
+func (s *oneTimeKeysStatements) DeleteAllOneTimeKeys(ctx context.Context, txn *sql.Tx, userID string) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteAllOneTimeKeysStmt).ExecContext(ctx, userID)
+	return err
 }
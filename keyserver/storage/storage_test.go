@@ -2,11 +2,13 @@ package storage
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/Shopify/sarama"
@@ -174,3 +176,59 @@ func TestDeviceKeysStreamIDGeneration(t *testing.T) {
 		}
 	}
 }
+
+func TestClaimKeysConcurrently(t *testing.T) {
+	db, clean := MustCreateDatabase(t)
+	defer clean()
+	userID, deviceID := "@alice:localhost", "ALICE"
+	keyJSON := make(map[string]json.RawMessage)
+	for i := 0; i < 10; i++ {
+		keyJSON[fmt.Sprintf("signed_curve25519:KEY%d", i)] = json.RawMessage(fmt.Sprintf(`{"key":"%d"}`, i))
+	}
+	_, err := db.StoreOneTimeKeys(ctx, api.OneTimeKeys{
+		UserID:   userID,
+		DeviceID: deviceID,
+		KeyJSON:  keyJSON,
+	})
+	MustNotError(t, err)
+
+	// Claim more keys than there are, concurrently.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	claimed := make(map[string]int)
+	for i := 0; i < 15; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys, err := db.ClaimKeys(ctx, map[string]map[string]string{
+				userID: {deviceID: "signed_curve25519"},
+			})
+			if err != nil {
+				t.Errorf("ClaimKeys failed: %s", err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, key := range keys {
+				for keyID := range key.KeyJSON {
+					claimed[keyID]++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(claimed) != len(keyJSON) {
+		t.Errorf("claimed %d different keys, want %d", len(claimed), len(keyJSON))
+	}
+	for keyID, count := range claimed {
+		if count != 1 {
+			t.Errorf("key %s was claimed %d times", keyID, count)
+		}
+	}
+	count, err := db.OneTimeKeysCount(ctx, userID, deviceID)
+	MustNotError(t, err)
+	if count.KeyCount["signed_curve25519"] != 0 {
+		t.Errorf("got %d keys left, want 0", count.KeyCount["signed_curve25519"])
+	}
+}
@@ -30,6 +30,7 @@ type OneTimeKeys interface {
 	// SelectAndDeleteOneTimeKey selects a single one time key matching the user/device/algorithm specified and returns the algo:key_id => JSON.
 	// Returns an empty map if the key does not exist.
 	SelectAndDeleteOneTimeKey(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
+	DeleteAllOneTimeKeys(ctx context.Context, txn *sql.Tx, userID string) error
 }
 
 type DeviceKeys interface {
@@ -52,3 +53,24 @@ type StaleDeviceLists interface {
 	InsertStaleDeviceList(ctx context.Context, userID string, isStale bool) error
 	SelectUserIDsWithStaleDeviceLists(ctx context.Context, domains []gomatrixserverlib.ServerName) ([]string, error)
 }
+
+type CrossSigningKeys interface {
+	// SelectCrossSigningKeysForUser returns a map of key purpose to key JSON for the user.
+	SelectCrossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string) (map[string]json.RawMessage, error)
+	UpsertCrossSigningKeyForUser(ctx context.Context, txn *sql.Tx, userID, keyType string, keyData json.RawMessage) error
+	DeleteCrossSigningKeyForUser(ctx context.Context, txn *sql.Tx, userID, keyType string) error
+	DeleteAllCrossSigningKeysForUser(ctx context.Context, txn *sql.Tx, userID string) error
+}
+
+type CrossSigningSigs interface {
+	// SelectCrossSigningSigsForTarget returns a map of origin user ID to origin key ID to signature for the target key,
+	// which is either a device ID or the public part of a cross-signing key.
+	SelectCrossSigningSigsForTarget(ctx context.Context, txn *sql.Tx, targetUserID, targetKeyID string) (map[string]map[gomatrixserverlib.KeyID]gomatrixserverlib.Base64Bytes, error)
+	UpsertCrossSigningSigForTarget(ctx context.Context, txn *sql.Tx, originUserID string, originKeyID gomatrixserverlib.KeyID, targetUserID, targetKeyID string, signature gomatrixserverlib.Base64Bytes) error
+	// DeleteCrossSigningSigsForTarget deletes all signatures on the target key.
+	DeleteCrossSigningSigsForTarget(ctx context.Context, txn *sql.Tx, targetUserID, targetKeyID string) error
+	// DeleteCrossSigningSigsByOrigin deletes all signatures made by the origin key.
+	DeleteCrossSigningSigsByOrigin(ctx context.Context, txn *sql.Tx, originUserID string, originKeyID gomatrixserverlib.KeyID) error
+	// DeleteAllCrossSigningSigsForUser deletes all signatures made by or on the keys of the user.
+	DeleteAllCrossSigningSigsForUser(ctx context.Context, txn *sql.Tx, userID string) error
+}
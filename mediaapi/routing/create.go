@@ -0,0 +1,181 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// How often media IDs which expired without their content being uploaded are deleted.
+	pendingMediaCleanupInterval = time.Minute
+	// How long clients are told to wait before downloading media whose content hasn't been uploaded yet.
+	pendingMediaRetryAfter = 5 * time.Second
+)
+
+// createResponse defines the format of the JSON response
+// https://github.com/matrix-org/matrix-doc/pull/2246
+type createResponse struct {
+	ContentURI      string       `json:"content_uri"`
+	UnusedExpiresAt types.UnixMs `json:"unused_expires_at"`
+}
+
+// CreateMedia implements POST /create
+// It creates a media ID whose content is uploaded later with PUT /upload/{serverName}/{mediaId},
+// so that clients can send the mxc:// URI before the content has been uploaded.
+func CreateMedia(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database) util.JSONResponse {
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin: cfg.Matrix.ServerName,
+			UserID: types.MatrixUserID(dev.UserID),
+		},
+		Logger: util.GetLogger(req.Context()).WithField("Origin", cfg.Matrix.ServerName),
+	}
+	mediaID, err := r.generateMediaID(req.Context(), db)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to generate media ID for asynchronous upload")
+		return jsonerror.InternalServerError()
+	}
+	now := time.Now()
+	pendingMedia := &types.PendingMedia{
+		MediaID:           mediaID,
+		Origin:            cfg.Matrix.ServerName,
+		UserID:            r.MediaMetadata.UserID,
+		CreationTimestamp: types.UnixMs(now.UnixNano() / 1000000),
+		ExpiresTimestamp:  types.UnixMs(now.Add(time.Duration(cfg.PendingUploadExpiryMS)*time.Millisecond).UnixNano() / 1000000),
+	}
+	if err = db.StorePendingMedia(req.Context(), pendingMedia); err != nil {
+		r.Logger.WithError(err).Error("Failed to store media ID for asynchronous upload")
+		return jsonerror.InternalServerError()
+	}
+	r.Logger.WithField("media_id", mediaID).Info("Created media ID for asynchronous upload")
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: createResponse{
+			ContentURI:      fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, mediaID),
+			UnusedExpiresAt: pendingMedia.ExpiresTimestamp,
+		},
+	}
+}
+
+// UploadPendingMedia implements PUT /upload/{serverName}/{mediaId}
+// It uploads the content of a media ID created by POST /create. Only the user who created the
+// media ID may upload the content, and only once.
+func UploadPendingMedia(
+	req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	serverName gomatrixserverlib.ServerName, mediaID types.MediaID,
+) util.JSONResponse {
+	r, resErr := parseAndValidateRequest(req, cfg, dev)
+	if resErr != nil {
+		return *resErr
+	}
+	r.MediaMetadata.MediaID = mediaID
+	r.Logger = r.Logger.WithField("media_id", mediaID)
+
+	if serverName != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Media was not created on this server"),
+		}
+	}
+	pendingMedia, err := db.GetPendingMedia(req.Context(), mediaID, serverName)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to get media ID for asynchronous upload")
+		return jsonerror.InternalServerError()
+	}
+	if pendingMedia == nil {
+		return r.notPendingJSONResponse(req.Context(), db)
+	}
+	if pendingMedia.UserID != r.MediaMetadata.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Media was created by another user"),
+		}
+	}
+	if pendingMedia.ExpiresTimestamp <= types.UnixMs(time.Now().UnixNano()/1000000) {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Media has expired"),
+		}
+	}
+
+	if resErr = r.checkQuota(req.Context(), db); resErr != nil {
+		return *resErr
+	}
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+		// If another upload of the content finished first then storing the metadata failed.
+		if existing, err := db.GetMediaMetadata(req.Context(), mediaID, serverName); err == nil && existing != nil {
+			return r.notPendingJSONResponse(req.Context(), db)
+		}
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// notPendingJSONResponse returns the error for uploading the content of a media ID which isn't
+// pending, which depends on whether the content has already been uploaded.
+func (r *uploadRequest) notPendingJSONResponse(ctx context.Context, db storage.Database) util.JSONResponse {
+	existing, err := db.GetMediaMetadata(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to get media metadata")
+		return jsonerror.InternalServerError()
+	}
+	if existing != nil {
+		return util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: jsonerror.CannotOverwriteMedia("Media has already been uploaded"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("Media not found"),
+	}
+}
+
+// cleanupExpiredPendingMedia periodically deletes the media IDs created for asynchronous uploads
+// which expired without their content being uploaded. It blocks forever, so should be called in
+// a goroutine.
+func cleanupExpiredPendingMedia(db storage.Database) {
+	ticker := time.NewTicker(pendingMediaCleanupInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		deleted, err := db.DeleteExpiredPendingMedia(context.Background(), types.UnixMs(now.UnixNano()/1000000))
+		if err != nil {
+			log.WithError(err).Error("Failed to delete expired media IDs for asynchronous uploads")
+			continue
+		}
+		if deleted > 0 {
+			log.WithField("deleted", deleted).Info("Deleted expired media IDs for asynchronous uploads")
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+func TestAsyncUpload(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "create_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+	db, err := storage.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	cfg := &config.MediaAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	cfg.Defaults()
+	cfg.AbsBasePath = config.Path(basePath)
+	cfg.ThumbnailSizes = nil
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	alice := &userapi.Device{UserID: "@alice:localhost"}
+	bob := &userapi.Device{UserID: "@bob:localhost"}
+
+	res := CreateMedia(httptest.NewRequest(http.MethodPost, "/create", nil), cfg, alice, db)
+	created, ok := res.JSON.(createResponse)
+	if res.Code != http.StatusOK || !ok {
+		t.Fatalf("CreateMedia: got %d %+v, want 200", res.Code, res.JSON)
+	}
+	if !strings.HasPrefix(created.ContentURI, "mxc://localhost/") {
+		t.Fatalf("got content URI %q, want a local mxc:// URI", created.ContentURI)
+	}
+	mediaID := types.MediaID(strings.TrimPrefix(created.ContentURI, "mxc://localhost/"))
+
+	remoteMediaCache := NewRemoteMediaCache(cfg, db)
+	download := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		Download(
+			w, httptest.NewRequest(http.MethodGet, "/download", nil), "localhost", mediaID,
+			cfg, db, nil, nil, activeThumbnailGeneration, remoteMediaCache, false, "",
+		)
+		return w
+	}
+	if w := download(); w.Code != http.StatusGatewayTimeout || w.Header().Get("Retry-After") == "" || !strings.Contains(w.Body.String(), "M_NOT_YET_UPLOADED") {
+		t.Errorf("download before upload: got %d %q, want 504 M_NOT_YET_UPLOADED with Retry-After", w.Code, w.Body.String())
+	}
+
+	upload := func(dev *userapi.Device) int {
+		req := httptest.NewRequest(http.MethodPut, "/upload", bytes.NewReader([]byte("content")))
+		req.Header.Set("Content-Type", "text/plain")
+		return UploadPendingMedia(req, cfg, dev, db, activeThumbnailGeneration, "localhost", mediaID).Code
+	}
+	if code := upload(bob); code != http.StatusForbidden {
+		t.Errorf("upload by another user: got %d, want %d", code, http.StatusForbidden)
+	}
+	if code := upload(alice); code != http.StatusOK {
+		t.Fatalf("upload: got %d, want %d", code, http.StatusOK)
+	}
+	if code := upload(alice); code != http.StatusConflict {
+		t.Errorf("second upload: got %d, want %d", code, http.StatusConflict)
+	}
+	if w := download(); w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Errorf("download after upload: got %d %q, want 200 with the content", w.Code, w.Body.String())
+	}
+
+	// Media IDs whose content isn't uploaded before they expire are deleted.
+	ctx := context.Background()
+	expired := &types.PendingMedia{MediaID: "expired", Origin: "localhost", UserID: "@alice:localhost", ExpiresTimestamp: 1}
+	if err = db.StorePendingMedia(ctx, expired); err != nil {
+		t.Fatalf("StorePendingMedia failed: %s", err)
+	}
+	deleted, err := db.DeleteExpiredPendingMedia(ctx, types.UnixMs(time.Now().UnixNano()/1000000))
+	if err != nil {
+		t.Fatalf("DeleteExpiredPendingMedia failed: %s", err)
+	}
+	if deleted != 1 {
+		t.Errorf("got %d expired media IDs deleted, want 1", deleted)
+	}
+}
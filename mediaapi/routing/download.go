@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -29,6 +30,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
@@ -69,6 +71,7 @@ type downloadRequest struct {
 // If they are present in the cache, they are served directly.
 // If they are not present in the cache, they are obtained from the remote server and
 // simultaneously served back to the client and written into the cache.
+// The least recently used remote files are evicted once the cache is larger than configured.
 func Download(
 	w http.ResponseWriter,
 	req *http.Request,
@@ -79,6 +82,7 @@ func Download(
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	remoteMediaCache *RemoteMediaCache,
 	isThumbnailRequest bool,
 	customFilename string,
 ) {
@@ -136,6 +140,16 @@ func Download(
 	}
 
 	if metadata == nil {
+		if origin == cfg.Matrix.ServerName && dReq.isPending(req.Context(), db) {
+			// The media ID was created for an asynchronous upload whose content
+			// hasn't been uploaded yet, so the client should try again later.
+			w.Header().Set("Retry-After", strconv.Itoa(int(pendingMediaRetryAfter/time.Second)))
+			dReq.jsonErrorResponse(w, util.JSONResponse{
+				Code: http.StatusGatewayTimeout,
+				JSON: jsonerror.NotYetUploaded("File has not been uploaded yet"),
+			})
+			return
+		}
 		dReq.jsonErrorResponse(w, util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("File not found"),
@@ -143,6 +157,18 @@ func Download(
 		return
 	}
 
+	remoteMediaCache.Accessed(req.Context(), dReq.MediaMetadata, dReq.Logger)
+}
+
+// isPending returns whether the media ID was created for an asynchronous upload which
+// hasn't expired, but whose content hasn't been uploaded yet.
+func (r *downloadRequest) isPending(ctx context.Context, db storage.Database) bool {
+	pendingMedia, err := db.GetPendingMedia(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to get media ID for asynchronous upload")
+		return false
+	}
+	return pendingMedia != nil && pendingMedia.ExpiresTimestamp > types.UnixMs(time.Now().UnixNano()/1000000)
 }
 
 func (r *downloadRequest) jsonErrorResponse(w http.ResponseWriter, res util.JSONResponse) {
@@ -236,7 +262,7 @@ func (r *downloadRequest) doDownload(
 	return r.respondFromLocalFile(
 		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
 		cfg.MaxThumbnailGenerators, db,
-		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
+		cfg.DynamicThumbnailGeneration(), cfg.ThumbnailSizes,
 	)
 }
 
@@ -274,7 +300,7 @@ func (r *downloadRequest) respondFromLocalFile(
 		return nil, errors.New("file size in database and on-disk differ")
 	}
 
-	var responseFile *os.File
+	var responseFile io.Reader
 	var responseMetadata *types.MediaMetadata
 	if r.IsThumbnailRequest {
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
@@ -310,14 +336,18 @@ func (r *downloadRequest) respondFromLocalFile(
 		}).Info("Responding with file")
 		responseFile = file
 		responseMetadata = r.MediaMetadata
-		if err := r.addDownloadFilenameToHeaders(w, responseMetadata); err != nil {
-			return nil, err
-		}
 	}
 
+	if err := r.addDownloadFilenameToHeaders(w, responseMetadata); err != nil {
+		return nil, err
+	}
 	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
 	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
-	contentSecurityPolicy := "default-src 'none';" +
+	// Stop browsers from running scripts in the served content, or guessing
+	// that it is of a different content type which could run scripts.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	contentSecurityPolicy := "sandbox;" +
+		" default-src 'none';" +
 		" script-src 'none';" +
 		" plugin-types application/pdf;" +
 		" style-src 'unsafe-inline';" +
@@ -330,10 +360,46 @@ func (r *downloadRequest) respondFromLocalFile(
 	return responseMetadata, nil
 }
 
+// inlineContentTypes are the content types which browsers may display rather than download.
+// These are images which can't contain scripts, so SVG isn't included.
+var inlineContentTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/png":  true,
+	"image/apng": true,
+	"image/webp": true,
+	"image/avif": true,
+}
+
+// contentDispositionType returns whether the content should be displayed inline by
+// browsers, or downloaded as an attachment.
+func contentDispositionType(contentType types.ContentType) string {
+	mediaType, _, err := mime.ParseMediaType(string(contentType))
+	if err == nil && inlineContentTypes[mediaType] {
+		return "inline"
+	}
+	return "attachment"
+}
+
+// sanitizeFilename removes the control characters from the filename, including
+// CR and LF which could otherwise be used to inject headers.
+func sanitizeFilename(filename string) string {
+	return strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) {
+			return -1
+		}
+		return c
+	}, filename)
+}
+
+// addDownloadFilenameToHeaders sets the Content-Disposition header, which
+// names the download and tells browsers whether to display it inline.
 func (r *downloadRequest) addDownloadFilenameToHeaders(
 	w http.ResponseWriter,
 	responseMetadata *types.MediaMetadata,
 ) error {
+	disposition := contentDispositionType(responseMetadata.ContentType)
+
 	// If the requestor supplied a filename to name the download then
 	// use that, otherwise use the filename from the response metadata.
 	filename := string(responseMetadata.UploadName)
@@ -341,14 +407,16 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 		filename = r.DownloadFilename
 	}
 
-	if len(filename) == 0 {
-		return nil
-	}
-
 	unescaped, err := url.PathUnescape(filename)
 	if err != nil {
 		return fmt.Errorf("url.PathUnescape: %w", err)
 	}
+	unescaped = sanitizeFilename(unescaped)
+
+	if len(unescaped) == 0 {
+		w.Header().Set("Content-Disposition", disposition)
+		return nil
+	}
 
 	isASCII := true // Is the string ASCII or UTF-8?
 	quote := ``     // Encloses the string (ASCII only)
@@ -356,9 +424,10 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 		if unescaped[i] > unicode.MaxASCII {
 			isASCII = false
 		}
-		if unescaped[i] == 0x20 || unescaped[i] == 0x3B {
-			// If the filename contains a space or a semicolon, which
-			// are special characters in Content-Disposition
+		switch unescaped[i] {
+		case 0x20, 0x3B, 0x22, 0x5C:
+			// If the filename contains a space, a semicolon, a quote or
+			// a backslash, which are special characters in Content-Disposition
 			quote = `"`
 		}
 	}
@@ -368,7 +437,7 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 	// browser support for encoding is a bit wild, so we'll escape only
 	// the characters that we know will mess up the parsing of the
 	// Content-Disposition header elements themselves
-	unescaped = strings.ReplaceAll(unescaped, `\`, `\\"`)
+	unescaped = strings.ReplaceAll(unescaped, `\`, `\\`)
 	unescaped = strings.ReplaceAll(unescaped, `"`, `\"`)
 
 	if isASCII {
@@ -377,14 +446,14 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 		// that would otherwise be parsed as a control character in the
 		// Content-Disposition header
 		w.Header().Set("Content-Disposition", fmt.Sprintf(
-			`inline; filename=%s%s%s`,
-			quote, unescaped, quote,
+			`%s; filename=%s%s%s`,
+			disposition, quote, unescaped, quote,
 		))
 	} else {
 		// For UTF-8 filenames, we quote always, as that's the standard
 		w.Header().Set("Content-Disposition", fmt.Sprintf(
-			`inline; filename*=utf-8''%s`,
-			url.QueryEscape(unescaped),
+			`%s; filename*=utf-8''%s`,
+			disposition, url.QueryEscape(unescaped),
 		))
 	}
 
@@ -392,6 +461,8 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 }
 
 // Note: Thumbnail generation may be ongoing asynchronously.
+// If the best thumbnail is larger than requested then it is downscaled to the requested size for the
+// response, without storing the result.
 // If no thumbnail was found then returns nil, nil, nil
 func (r *downloadRequest) getThumbnailFile(
 	ctx context.Context,
@@ -401,7 +472,7 @@ func (r *downloadRequest) getThumbnailFile(
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
-) (*os.File, *types.ThumbnailMetadata, error) {
+) (io.ReadCloser, *types.ThumbnailMetadata, error) {
 	var thumbnail *types.ThumbnailMetadata
 	var err error
 
@@ -471,7 +542,36 @@ func (r *downloadRequest) getThumbnailFile(
 		thumbFile.Close() // nolint: errcheck
 		return nil, nil, errors.New("thumbnail file sizes on disk and in database differ")
 	}
-	return thumbFile, thumbnail, nil
+	if !isLargerThumbnail(thumbnail.ThumbnailSize, r.ThumbnailSize) {
+		return thumbFile, thumbnail, nil
+	}
+	thumbFile.Close() // nolint: errcheck
+	data, err := thumbnailer.DownscaleThumbnail(types.Path(thumbPath), r.ThumbnailSize, r.Logger)
+	if err != nil {
+		return nil, nil, fmt.Errorf("thumbnailer.DownscaleThumbnail: %w", err)
+	}
+	r.Logger.WithFields(log.Fields{
+		"RequestedWidth":  r.ThumbnailSize.Width,
+		"RequestedHeight": r.ThumbnailSize.Height,
+	}).Info("Downscaled thumbnail for response")
+	return ioutil.NopCloser(bytes.NewReader(data)), &types.ThumbnailMetadata{
+		MediaMetadata: &types.MediaMetadata{
+			MediaID:       thumbnail.MediaMetadata.MediaID,
+			Origin:        thumbnail.MediaMetadata.Origin,
+			ContentType:   types.ContentType("image/jpeg"),
+			FileSizeBytes: types.FileSizeBytes(len(data)),
+		},
+		ThumbnailSize: r.ThumbnailSize,
+	}, nil
+}
+
+// isLargerThumbnail returns true if the thumbnail is at least as large as the desired size in both
+// dimensions and larger in one of them, so that it can be downscaled to the desired size.
+func isLargerThumbnail(thumbnail, desired types.ThumbnailSize) bool {
+	if thumbnail.Width < desired.Width || thumbnail.Height < desired.Height {
+		return false
+	}
+	return thumbnail.Width > desired.Width || thumbnail.Height > desired.Height
 }
 
 func (r *downloadRequest) generateThumbnail(
@@ -552,7 +652,7 @@ func (r *downloadRequest) getRemoteFile(
 			err := r.fetchRemoteFileAndStoreMetadata(
 				ctx, client,
 				cfg.AbsBasePath, *cfg.MaxFileSizeBytes, db,
-				cfg.ThumbnailSizes, activeThumbnailGeneration,
+				preGeneratedThumbnailSizes(cfg), activeThumbnailGeneration,
 				cfg.MaxThumbnailGenerators,
 			)
 			if err != nil {
@@ -0,0 +1,45 @@
+package routing
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/util"
+)
+
+func TestAddDownloadFilenameToHeaders(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		contentType types.ContentType
+		filename    types.Filename
+		want        string
+	}{
+		{"no filename", "image/png", "", `inline`},
+		{"image", "image/png; charset=binary", "cat.png", `inline; filename=cat.png`},
+		{"svg", "image/svg+xml", "cat.svg", `attachment; filename=cat.svg`},
+		{"html", "text/html", "page.html", `attachment; filename=page.html`},
+		{"space", "text/plain", "my%20file.txt", `attachment; filename="my file.txt"`},
+		{"header injection", "text/plain", "a%0D%0ASet-Cookie:%20x=y", `attachment; filename="aSet-Cookie: x=y"`},
+		{"control characters", "text/plain", "a%00b%07c%7F", `attachment; filename=abc`},
+		{"only control characters", "text/plain", "%0D%0A", `attachment`},
+		{"quotes", "text/plain", `a%22%3B%20b=%5C.txt`, `attachment; filename="a\"; b=\\.txt"`},
+		{"utf-8", "text/plain", "%C3%A9t%C3%A9%0A.txt", `attachment; filename*=utf-8''%C3%A9t%C3%A9.txt`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &downloadRequest{Logger: util.GetLogger(context.Background())}
+			w := httptest.NewRecorder()
+			err := r.addDownloadFilenameToHeaders(w, &types.MediaMetadata{
+				ContentType: tc.contentType,
+				UploadName:  tc.filename,
+			})
+			if err != nil {
+				t.Fatalf("addDownloadFilenameToHeaders failed: %s", err)
+			}
+			if got := w.Header().Get("Content-Disposition"); got != tc.want {
+				t.Errorf("got Content-Disposition %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
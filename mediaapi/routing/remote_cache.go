@@ -0,0 +1,174 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// remoteMediaEvictionInterval is how often the size of the remote media cache is checked,
+	// in addition to after media is accessed.
+	remoteMediaEvictionInterval = time.Minute
+	// remoteMediaEvictionBatchSize is how many of the least recently used media are looked up
+	// at a time when evicting.
+	remoteMediaEvictionBatchSize = 100
+)
+
+var remoteMediaCacheSize = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "mediaapi",
+		Name:      "remote_media_cache_size_bytes",
+		Help:      "Total size of the media and thumbnails cached from remote servers",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(remoteMediaCacheSize)
+}
+
+// RemoteMediaCache tracks when media fetched from remote servers is accessed and
+// evicts the least recently used remote media once the cache is larger than the
+// configured maximum. Media uploaded to this server is never evicted.
+type RemoteMediaCache struct {
+	cfg    *config.MediaAPI
+	db     storage.Database
+	notify chan struct{}
+}
+
+// NewRemoteMediaCache returns a remote media cache. Call Start to begin evicting.
+func NewRemoteMediaCache(cfg *config.MediaAPI, db storage.Database) *RemoteMediaCache {
+	return &RemoteMediaCache{
+		cfg:    cfg,
+		db:     db,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// Accessed records that the remote media was downloaded or thumbnailed, and checks
+// whether anything needs to be evicted.
+func (c *RemoteMediaCache) Accessed(ctx context.Context, mediaMetadata *types.MediaMetadata, logger *log.Entry) {
+	if mediaMetadata.Origin == c.cfg.Matrix.ServerName {
+		return
+	}
+	ts := types.UnixMs(time.Now().UnixNano() / 1000000)
+	if err := c.db.UpdateRemoteMediaAccess(ctx, mediaMetadata.MediaID, mediaMetadata.Origin, ts); err != nil {
+		logger.WithError(err).Warn("Failed to record remote media access")
+	}
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Start evicts remote media whenever the cache is too large, forever. It should be
+// run in its own goroutine.
+func (c *RemoteMediaCache) Start() {
+	ticker := time.NewTicker(remoteMediaEvictionInterval)
+	defer ticker.Stop()
+	for {
+		if err := c.evict(context.Background()); err != nil {
+			log.WithError(err).Warn("Failed to evict remote media")
+		}
+		select {
+		case <-ticker.C:
+		case <-c.notify:
+		}
+	}
+}
+
+// evict deletes the least recently used remote media until the cache is no larger
+// than the configured maximum, and updates the cache size metric.
+func (c *RemoteMediaCache) evict(ctx context.Context) error {
+	size, err := c.db.GetRemoteMediaCacheSize(ctx, c.cfg.Matrix.ServerName)
+	if err != nil {
+		return fmt.Errorf("c.db.GetRemoteMediaCacheSize: %w", err)
+	}
+	remoteMediaCacheSize.Set(float64(size))
+	maxSize := types.FileSizeBytes(c.cfg.RemoteCacheMaxBytes)
+	if maxSize <= 0 {
+		return nil
+	}
+	for size > maxSize {
+		media, err := c.db.GetLeastRecentlyUsedRemoteMedia(ctx, c.cfg.Matrix.ServerName, remoteMediaEvictionBatchSize)
+		if err != nil {
+			return fmt.Errorf("c.db.GetLeastRecentlyUsedRemoteMedia: %w", err)
+		}
+		if len(media) == 0 {
+			break
+		}
+		for _, mediaMetadata := range media {
+			if size <= maxSize {
+				break
+			}
+			evicted, err := c.evictMedia(ctx, mediaMetadata)
+			if err != nil {
+				return err
+			}
+			size -= evicted
+		}
+	}
+	remoteMediaCacheSize.Set(float64(size))
+	return nil
+}
+
+// evictMedia deletes the remote media and its thumbnails, returning how much of the
+// cache size they accounted for.
+func (c *RemoteMediaCache) evictMedia(ctx context.Context, mediaMetadata *types.MediaMetadata) (types.FileSizeBytes, error) {
+	if mediaMetadata.Origin == c.cfg.Matrix.ServerName {
+		return 0, fmt.Errorf("refusing to evict local media %q", mediaMetadata.MediaID)
+	}
+	logger := log.WithFields(log.Fields{
+		"Origin":  mediaMetadata.Origin,
+		"MediaID": mediaMetadata.MediaID,
+	})
+	size := mediaMetadata.FileSizeBytes
+	thumbnails, err := c.db.GetThumbnails(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+	if err != nil {
+		return 0, fmt.Errorf("c.db.GetThumbnails: %w", err)
+	}
+	for _, thumbnail := range thumbnails {
+		size += thumbnail.MediaMetadata.FileSizeBytes
+	}
+	err = c.db.DeleteRemoteMedia(ctx, mediaMetadata, func(stillReferenced bool) error {
+		// Files are stored by hash, so other media with the same content share the
+		// file and its thumbnails.
+		if stillReferenced {
+			return nil
+		}
+		filePath, err := fileutils.GetPathFromBase64Hash(mediaMetadata.Base64Hash, c.cfg.AbsBasePath)
+		if err != nil {
+			return fmt.Errorf("fileutils.GetPathFromBase64Hash: %w", err)
+		}
+		return os.RemoveAll(filepath.Dir(filePath))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("c.db.DeleteRemoteMedia: %w", err)
+	}
+	logger.WithField("FileSizeBytes", size).Info("Evicted remote media from the cache")
+	return size, nil
+}
@@ -0,0 +1,92 @@
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/fileutils"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestRemoteMediaCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	basePath, err := ioutil.TempDir("", "remote_cache_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+	db, err := storage.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	cfg := &config.MediaAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	cfg.Defaults()
+	cfg.AbsBasePath = config.Path(basePath)
+	cfg.RemoteCacheMaxBytes = 25
+
+	store := func(mediaID types.MediaID, origin gomatrixserverlib.ServerName, hash types.Base64Hash, lastAccess types.UnixMs) string {
+		filePath, err := fileutils.GetPathFromBase64Hash(hash, cfg.AbsBasePath)
+		if err != nil {
+			t.Fatalf("GetPathFromBase64Hash failed: %s", err)
+		}
+		if err = os.MkdirAll(filepath.Dir(filePath), 0770); err != nil {
+			t.Fatalf("failed to create media directory: %s", err)
+		}
+		if err = ioutil.WriteFile(filePath, make([]byte, 10), 0600); err != nil {
+			t.Fatalf("failed to write media file: %s", err)
+		}
+		if err = db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+			MediaID: mediaID, Origin: origin, FileSizeBytes: 10, Base64Hash: hash,
+		}); err != nil {
+			t.Fatalf("StoreMediaMetadata failed: %s", err)
+		}
+		if err = db.UpdateRemoteMediaAccess(ctx, mediaID, origin, lastAccess); err != nil {
+			t.Fatalf("UpdateRemoteMediaAccess failed: %s", err)
+		}
+		return filePath
+	}
+	// The local media is the least recently used, but must never be evicted.
+	local := store("local", "localhost", "localhash", 1)
+	oldest := store("oldest", "remote", "oldesthash", 2)
+	// This media has the same content as the local media, so shares its file.
+	shared := store("shared", "remote", "localhash", 3)
+	newer := store("newer", "remote", "newerhash", 4)
+	newest := store("newest", "remote", "newesthash", 5)
+
+	c := NewRemoteMediaCache(cfg, db)
+	if err = c.evict(ctx); err != nil {
+		t.Fatalf("evict failed: %s", err)
+	}
+	size, err := db.GetRemoteMediaCacheSize(ctx, cfg.Matrix.ServerName)
+	if err != nil {
+		t.Fatalf("GetRemoteMediaCacheSize failed: %s", err)
+	}
+	if size != 20 {
+		t.Errorf("got cache size %d, want 20", size)
+	}
+	for mediaID, wantExists := range map[types.MediaID]bool{
+		"oldest": false, "shared": false, "newer": true, "newest": true,
+	} {
+		metadata, err := db.GetMediaMetadata(ctx, mediaID, "remote")
+		if err != nil {
+			t.Fatalf("GetMediaMetadata failed: %s", err)
+		}
+		if exists := metadata != nil; exists != wantExists {
+			t.Errorf("media %q: got exists %v, want %v", mediaID, exists, wantExists)
+		}
+	}
+	for filePath, wantExists := range map[string]bool{
+		local: true, oldest: false, shared: true, newer: true, newest: true,
+	} {
+		_, err := os.Stat(filePath)
+		if exists := err == nil; exists != wantExists {
+			t.Errorf("file %q: got exists %v, want %v", filePath, exists, wantExists)
+		}
+	}
+}
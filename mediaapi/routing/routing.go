@@ -30,6 +30,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 // Setup registers the media API HTTP handlers
@@ -46,6 +47,7 @@ func Setup(
 ) {
 	r0mux := publicAPIMux.PathPrefix("/r0").Subrouter()
 	v1mux := publicAPIMux.PathPrefix("/v1").Subrouter()
+	msc2246mux := publicAPIMux.PathPrefix("/unstable/fi.mau.msc2246").Subrouter()
 
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
@@ -61,19 +63,59 @@ func Setup(
 	r0mux.Handle("/upload", uploadHandler).Methods(http.MethodPost, http.MethodOptions)
 	v1mux.Handle("/upload", uploadHandler).Methods(http.MethodPost, http.MethodOptions)
 
+	// Asynchronous uploads, see https://github.com/matrix-org/matrix-doc/pull/2246
+	createHandler := httputil.MakeAuthAPI(
+		"create", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			return CreateMedia(req, cfg, dev, db)
+		},
+	)
+	uploadPendingHandler := httputil.MakeAuthAPI(
+		"upload_pending", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UploadPendingMedia(
+				req, cfg, dev, db, activeThumbnailGeneration,
+				gomatrixserverlib.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]),
+			)
+		},
+	)
+	go cleanupExpiredPendingMedia(db)
+
+	v1mux.Handle("/create", createHandler).Methods(http.MethodPost, http.MethodOptions)
+	msc2246mux.Handle("/create", createHandler).Methods(http.MethodPost, http.MethodOptions)
+	r0mux.Handle("/upload/{serverName}/{mediaId}", uploadPendingHandler).Methods(http.MethodPut, http.MethodOptions)
+	v1mux.Handle("/upload/{serverName}/{mediaId}", uploadPendingHandler).Methods(http.MethodPut, http.MethodOptions)
+	msc2246mux.Handle("/upload/{serverName}/{mediaId}", uploadPendingHandler).Methods(http.MethodPut, http.MethodOptions)
+
 	activeRemoteRequests := &types.ActiveRemoteRequests{
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
+	remoteMediaCache := NewRemoteMediaCache(cfg, db)
+	go remoteMediaCache.Start()
 
-	downloadHandler := makeDownloadAPI("download", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration)
+	downloadHandler := makeDownloadAPI("download", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration, remoteMediaCache)
 	r0mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	r0mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	v1mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)                // TODO: remove when synapse is fixed
 	v1mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions) // TODO: remove when synapse is fixed
 
 	r0mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration),
+		makeDownloadAPI("thumbnail", cfg, db, client, activeRemoteRequests, activeThumbnailGeneration, remoteMediaCache),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	if cfg.URLPreviews.Enabled {
+		previewer, err := newURLPreviewer(cfg, db, activeThumbnailGeneration)
+		if err != nil {
+			logrus.WithError(err).Panicf("failed to create URL previewer")
+		}
+		previewHandler := httputil.MakeAuthAPI("preview_url", userAPI, previewer.Preview)
+		r0mux.Handle("/preview_url", previewHandler).Methods(http.MethodGet, http.MethodOptions)
+		v1mux.Handle("/preview_url", previewHandler).Methods(http.MethodGet, http.MethodOptions)
+	}
 }
 
 func makeDownloadAPI(
@@ -83,6 +125,7 @@ func makeDownloadAPI(
 	client *gomatrixserverlib.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	remoteMediaCache *RemoteMediaCache,
 ) http.HandlerFunc {
 	counterVec := promauto.NewCounterVec(
 		prometheus.CounterOpts{
@@ -122,6 +165,7 @@ func makeDownloadAPI(
 			client,
 			activeRemoteRequests,
 			activeThumbnailGeneration,
+			remoteMediaCache,
 			name == "thumbnail",
 			vars["downloadName"],
 		)
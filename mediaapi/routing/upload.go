@@ -43,6 +43,8 @@ import (
 type uploadRequest struct {
 	MediaMetadata *types.MediaMetadata
 	Logger        *log.Entry
+	// The maximum total size of the media uploaded by the user, or 0 if unlimited.
+	Quota types.FileSizeBytes
 }
 
 // uploadResponse defines the format of the JSON response
@@ -62,6 +64,10 @@ func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db sto
 		return *resErr
 	}
 
+	if resErr = r.checkQuota(req.Context(), db); resErr != nil {
+		return *resErr
+	}
+
 	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
@@ -87,6 +93,10 @@ func parseAndValidateRequest(req *http.Request, cfg *config.MediaAPI, dev *usera
 			UserID:        types.MatrixUserID(dev.UserID),
 		},
 		Logger: util.GetLogger(req.Context()).WithField("Origin", cfg.Matrix.ServerName),
+		Quota:  types.FileSizeBytes(cfg.UploadQuota.MaxBytesPerUser),
+	}
+	if dev.AppserviceID != "" {
+		r.Quota = types.FileSizeBytes(cfg.UploadQuota.MaxBytesPerAppserviceUser)
 	}
 
 	if resErr := r.Validate(*cfg.MaxFileSizeBytes); resErr != nil {
@@ -96,6 +106,25 @@ func parseAndValidateRequest(req *http.Request, cfg *config.MediaAPI, dev *usera
 	return r, nil
 }
 
+// checkQuota rejects the upload before the file is received if the reported size would take
+// the user over their quota. The quota is checked again when the metadata is stored, as other
+// uploads by the user may be in progress.
+func (r *uploadRequest) checkQuota(ctx context.Context, db storage.Database) *util.JSONResponse {
+	if r.Quota == 0 {
+		return nil
+	}
+	usage, err := db.GetUploadUsage(ctx, r.MediaMetadata.UserID)
+	if err != nil {
+		r.Logger.WithError(err).Error("Failed to get upload usage")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if usage+r.MediaMetadata.FileSizeBytes > r.Quota {
+		return quotaExceededJSONResponse(r.Quota)
+	}
+	return nil
+}
+
 func (r *uploadRequest) generateMediaID(ctx context.Context, db storage.Database) (types.MediaID, error) {
 	for {
 		// First try generating a meda ID. We'll do this by
@@ -118,6 +147,15 @@ func (r *uploadRequest) generateMediaID(ctx context.Context, db storage.Database
 			// and generate a new one instead.
 			continue
 		}
+		// The media ID may also have been created for an asynchronous
+		// upload whose content hasn't been uploaded yet.
+		pendingMedia, err := db.GetPendingMedia(ctx, mediaID, r.MediaMetadata.Origin)
+		if err != nil {
+			return "", fmt.Errorf("db.GetPendingMedia: %w", err)
+		}
+		if pendingMedia != nil {
+			continue
+		}
 		// The media ID was not already used - let's return that.
 		return mediaID, nil
 	}
@@ -179,12 +217,17 @@ func (r *uploadRequest) doUpload(
 	if existingMetadata != nil {
 		// The file already exists, delete the uploaded temporary file.
 		defer fileutils.RemoveDir(tmpDir, r.Logger)
-		// The file already exists. Make a new media ID up for it.
-		mediaID, merr := r.generateMediaID(ctx, db)
-		if merr != nil {
-			r.Logger.WithError(merr).Error("Failed to generate media ID for existing file")
-			resErr := jsonerror.InternalServerError()
-			return &resErr
+		// The file already exists. Make a new media ID up for it, unless the
+		// media ID was created beforehand for an asynchronous upload.
+		mediaID := r.MediaMetadata.MediaID
+		if mediaID == "" {
+			var merr error
+			mediaID, merr = r.generateMediaID(ctx, db)
+			if merr != nil {
+				r.Logger.WithError(merr).Error("Failed to generate media ID for existing file")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			}
 		}
 
 		// Then amend the upload metadata.
@@ -202,12 +245,14 @@ func (r *uploadRequest) doUpload(
 		// The file doesn't exist. Update the request metadata.
 		r.MediaMetadata.FileSizeBytes = bytesWritten
 		r.MediaMetadata.Base64Hash = hash
-		r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, db)
-		if err != nil {
-			fileutils.RemoveDir(tmpDir, r.Logger)
-			r.Logger.WithError(err).Error("Failed to generate media ID for new upload")
-			resErr := jsonerror.InternalServerError()
-			return &resErr
+		if r.MediaMetadata.MediaID == "" {
+			r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, db)
+			if err != nil {
+				fileutils.RemoveDir(tmpDir, r.Logger)
+				r.Logger.WithError(err).Error("Failed to generate media ID for new upload")
+				resErr := jsonerror.InternalServerError()
+				return &resErr
+			}
 		}
 	}
 
@@ -220,11 +265,20 @@ func (r *uploadRequest) doUpload(
 	}).Info("File uploaded")
 
 	return r.storeFileAndMetadata(
-		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
+		ctx, tmpDir, cfg.AbsBasePath, db, preGeneratedThumbnailSizes(cfg),
 		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
 	)
 }
 
+// preGeneratedThumbnailSizes returns the thumbnail sizes to generate when media is stored,
+// which is none if thumbnails are generated dynamically.
+func preGeneratedThumbnailSizes(cfg *config.MediaAPI) []config.ThumbnailSize {
+	if cfg.DynamicThumbnailGeneration() {
+		return nil
+	}
+	return cfg.ThumbnailSizes
+}
+
 func requestEntityTooLargeJSONResponse(maxFileSizeBytes config.FileSizeBytes) *util.JSONResponse {
 	return &util.JSONResponse{
 		Code: http.StatusRequestEntityTooLarge,
@@ -232,6 +286,13 @@ func requestEntityTooLargeJSONResponse(maxFileSizeBytes config.FileSizeBytes) *u
 	}
 }
 
+func quotaExceededJSONResponse(quota types.FileSizeBytes) *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: http.StatusRequestEntityTooLarge,
+		JSON: jsonerror.Forbidden(fmt.Sprintf("The upload would exceed your media upload quota (%v).", quota)),
+	}
+}
+
 // Validate validates the uploadRequest fields
 func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JSONResponse {
 	if maxFileSizeBytes > 0 && r.MediaMetadata.FileSizeBytes > types.FileSizeBytes(maxFileSizeBytes) {
@@ -286,14 +347,19 @@ func (r *uploadRequest) storeFileAndMetadata(
 		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
 	}
 
-	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
-		r.Logger.WithError(err).Warn("Failed to store metadata")
+	withinQuota, err := db.StoreUploadedMediaMetadata(ctx, r.MediaMetadata, r.Quota)
+	if err != nil || !withinQuota {
 		// If the file is a duplicate (has the same hash as an existing file) then
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
 			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
 		}
+		if err == nil {
+			r.Logger.WithField("Quota", r.Quota).Info("Upload would exceed the user's quota")
+			return quotaExceededJSONResponse(r.Quota)
+		}
+		r.Logger.WithError(err).Warn("Failed to store metadata")
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.Unknown("Failed to upload"),
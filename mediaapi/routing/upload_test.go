@@ -0,0 +1,75 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+func TestUploadQuota(t *testing.T) {
+	basePath, err := ioutil.TempDir("", "upload_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+	db, err := storage.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	cfg := &config.MediaAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	cfg.Defaults()
+	cfg.AbsBasePath = config.Path(basePath)
+	cfg.ThumbnailSizes = nil
+	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	}
+	ctx := context.Background()
+	const userID = types.MatrixUserID("@alice:localhost")
+
+	// Only one of the concurrent uploads fits within the quota.
+	var wg sync.WaitGroup
+	results := make([]*util.JSONResponse, 4)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := &uploadRequest{
+				MediaMetadata: &types.MediaMetadata{
+					Origin: "localhost", FileSizeBytes: 10, UserID: userID,
+				},
+				Logger: util.GetLogger(ctx),
+				Quota:  15,
+			}
+			results[i] = r.doUpload(ctx, bytes.NewReader([]byte{byte(i), 1, 2, 3, 4, 5, 6, 7, 8, 9}), cfg, db, activeThumbnailGeneration)
+		}(i)
+	}
+	wg.Wait()
+	var succeeded int
+	for _, resErr := range results {
+		switch {
+		case resErr == nil:
+			succeeded++
+		case resErr.Code != http.StatusRequestEntityTooLarge:
+			t.Errorf("got response code %d, want %d", resErr.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("got %d successful uploads, want 1", succeeded)
+	}
+	usage, err := db.GetUploadUsage(ctx, userID)
+	if err != nil {
+		t.Fatalf("GetUploadUsage failed: %s", err)
+	}
+	if usage != 10 {
+		t.Errorf("got upload usage %d, want 10", usage)
+	}
+}
@@ -0,0 +1,425 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // register the GIF decoder for image.DecodeConfig
+	_ "image/jpeg" // register the JPEG decoder for image.DecodeConfig
+	_ "image/png"  // register the PNG decoder for image.DecodeConfig
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+// urlPreviewCacheMaxEntries is the number of URLs for which previews are cached.
+const urlPreviewCacheMaxEntries = 1000
+
+var (
+	errHostDenied         = errors.New("host isn't allowed to be previewed")
+	errTooLarge           = errors.New("response is too large")
+	errUnsupportedContent = errors.New("unsupported content type")
+)
+
+// hostList matches hosts against a list of hostnames, "*.domain" wildcards
+// and CIDR ranges.
+type hostList struct {
+	names    []string
+	networks []*net.IPNet
+}
+
+func newHostList(hosts []string) hostList {
+	var l hostList
+	for _, host := range hosts {
+		if _, network, err := net.ParseCIDR(host); err == nil {
+			l.networks = append(l.networks, network)
+		} else if host != "" {
+			l.names = append(l.names, strings.ToLower(host))
+		}
+	}
+	return l
+}
+
+func (l hostList) empty() bool {
+	return len(l.names) == 0 && len(l.networks) == 0
+}
+
+// matchesName returns true if the hostname is in the list. IP addresses
+// used as hostnames are also matched against the CIDR ranges.
+func (l hostList) matchesName(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, name := range l.names {
+		if strings.HasPrefix(name, "*.") {
+			if strings.HasSuffix(host, name[1:]) {
+				return true
+			}
+		} else if host == name {
+			return true
+		}
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return l.matchesIP(ip)
+	}
+	return false
+}
+
+func (l hostList) matchesIP(ip net.IP) bool {
+	for _, network := range l.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type cachedURLPreview struct {
+	preview map[string]interface{}
+	expires time.Time
+}
+
+// urlPreviewer generates previews of URLs for /preview_url. The allowed and
+// denied hosts are checked whenever a connection is made, including when
+// following redirects, and against the addresses that are actually connected
+// to, so that DNS can't be used to reach a denied address.
+type urlPreviewer struct {
+	cfg                       *config.MediaAPI
+	db                        storage.Database
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration
+	allowed                   hostList
+	denied                    hostList
+	client                    *http.Client
+	cache                     *lru.Cache // URL -> *cachedURLPreview
+}
+
+func newURLPreviewer(
+	cfg *config.MediaAPI, db storage.Database,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) (*urlPreviewer, error) {
+	cache, err := lru.New(urlPreviewCacheMaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	p := &urlPreviewer{
+		cfg:                       cfg,
+		db:                        db,
+		activeThumbnailGeneration: activeThumbnailGeneration,
+		allowed:                   newHostList(cfg.URLPreviews.AllowedHosts),
+		denied:                    newHostList(cfg.URLPreviews.DeniedHosts),
+		cache:                     cache,
+	}
+	p.client = &http.Client{
+		Transport: &http.Transport{
+			// Proxies would connect on our behalf without the hosts being checked.
+			Proxy:               nil,
+			DialContext:         p.dialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     30 * time.Second,
+		},
+	}
+	return p, nil
+}
+
+// dialContext resolves the host and connects to it if the host and all of
+// its addresses are allowed.
+func (p *urlPreviewer) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if p.denied.matchesName(host) {
+		return nil, errHostDenied
+	}
+	allowedByName := p.allowed.empty() || p.allowed.matchesName(host)
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %q", host)
+	}
+	for _, ip := range ips {
+		if p.denied.matchesIP(ip.IP) || (!allowedByName && !p.allowed.matchesIP(ip.IP)) {
+			return nil, errHostDenied
+		}
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].IP.String(), port))
+}
+
+// Preview implements GET /preview_url
+func (p *urlPreviewer) Preview(req *http.Request, dev *userapi.Device) util.JSONResponse {
+	rawURL := req.URL.Query().Get("url")
+	if rawURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("url is required"),
+		}
+	}
+	target, err := url.Parse(rawURL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("url must be an absolute http or https URL"),
+		}
+	}
+	target.Fragment = ""
+	key := target.String()
+
+	if cached, ok := p.cache.Get(key); ok && time.Now().Before(cached.(*cachedURLPreview).expires) {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: cached.(*cachedURLPreview).preview,
+		}
+	}
+
+	logger := util.GetLogger(req.Context()).WithField("url", key)
+	ctx, cancel := context.WithTimeout(req.Context(), time.Duration(p.cfg.URLPreviews.TimeoutMS)*time.Millisecond)
+	defer cancel()
+	preview, err := p.generatePreview(ctx, target, dev, logger)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to generate URL preview")
+		if errors.Is(err, errHostDenied) {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("URL isn't allowed to be previewed"),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to generate a preview of the URL"),
+		}
+	}
+
+	p.cache.Add(key, &cachedURLPreview{
+		preview: preview,
+		expires: time.Now().Add(time.Duration(p.cfg.URLPreviews.CacheTTLMS) * time.Millisecond),
+	})
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: preview,
+	}
+}
+
+func (p *urlPreviewer) generatePreview(
+	ctx context.Context, target *url.URL, dev *userapi.Device, logger *log.Entry,
+) (map[string]interface{}, error) {
+	body, contentType, finalURL, err := p.fetch(ctx, target, int64(p.cfg.URLPreviews.MaxPageSizeBytes), func(contentType string) bool {
+		return contentType == "text/html" || contentType == "application/xhtml+xml" || strings.HasPrefix(contentType, "image/")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Links to images are previewed as the image itself.
+	if strings.HasPrefix(contentType, "image/") {
+		preview := map[string]interface{}{}
+		if err = p.storeImage(ctx, preview, body, contentType, finalURL, dev, logger); err != nil {
+			return nil, err
+		}
+		return preview, nil
+	}
+
+	preview := parseOpenGraph(body)
+	if imageURL, ok := preview["og:image"].(string); ok {
+		delete(preview, "og:image")
+		if err = p.fetchImage(ctx, preview, finalURL, imageURL, dev, logger); err != nil {
+			// The rest of the preview is still useful without the image.
+			logger.WithError(err).WithField("image_url", imageURL).Warn("Failed to fetch URL preview image")
+		}
+	}
+	return preview, nil
+}
+
+// fetchImage downloads the image, stores it in the media repository and adds
+// it to the preview.
+func (p *urlPreviewer) fetchImage(
+	ctx context.Context, preview map[string]interface{}, pageURL *url.URL, imageURL string,
+	dev *userapi.Device, logger *log.Entry,
+) error {
+	target, err := pageURL.Parse(imageURL)
+	if err != nil {
+		return err
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return errUnsupportedContent
+	}
+	maxSize := int64(p.cfg.URLPreviews.MaxPageSizeBytes)
+	if maxFileSize := int64(*p.cfg.MaxFileSizeBytes); maxFileSize > 0 && maxFileSize < maxSize {
+		maxSize = maxFileSize
+	}
+	body, contentType, finalURL, err := p.fetch(ctx, target, maxSize, func(contentType string) bool {
+		return strings.HasPrefix(contentType, "image/")
+	})
+	if err != nil {
+		return err
+	}
+	return p.storeImage(ctx, preview, body, contentType, finalURL, dev, logger)
+}
+
+// storeImage stores the image in the media repository, which also generates
+// its thumbnails, and adds it to the preview.
+func (p *urlPreviewer) storeImage(
+	ctx context.Context, preview map[string]interface{}, body []byte, contentType string,
+	imageURL *url.URL, dev *userapi.Device, logger *log.Entry,
+) error {
+	uploadName := path.Base(imageURL.Path)
+	if uploadName == "." || uploadName == "/" {
+		uploadName = ""
+	}
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:      p.cfg.Matrix.ServerName,
+			ContentType: types.ContentType(contentType),
+			UploadName:  types.Filename(url.PathEscape(strings.TrimLeft(uploadName, "~"))),
+			UserID:      types.MatrixUserID(dev.UserID),
+		},
+		Logger: logger,
+	}
+	if resErr := r.doUpload(ctx, bytes.NewReader(body), p.cfg, p.db, p.activeThumbnailGeneration); resErr != nil {
+		return fmt.Errorf("failed to store image: %v", resErr.JSON)
+	}
+	preview["og:image"] = fmt.Sprintf("mxc://%s/%s", p.cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	preview["og:image:type"] = contentType
+	preview["matrix:image:size"] = len(body)
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(body)); err == nil {
+		preview["og:image:width"] = cfg.Width
+		preview["og:image:height"] = cfg.Height
+	}
+	return nil
+}
+
+// fetch downloads the target, returning the body, its content type and the
+// URL it was downloaded from after following redirects. The response must
+// have an accepted content type and be no larger than maxSize bytes.
+func (p *urlPreviewer) fetch(
+	ctx context.Context, target *url.URL, maxSize int64, accept func(contentType string) bool,
+) ([]byte, string, *url.URL, error) {
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "Dendrite URL preview")
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, "", nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	contentType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil || !accept(contentType) {
+		return nil, "", nil, errUnsupportedContent
+	}
+	if res.ContentLength > maxSize {
+		return nil, "", nil, errTooLarge
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxSize+1))
+	if err != nil {
+		return nil, "", nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, "", nil, errTooLarge
+	}
+	return body, contentType, res.Request.URL, nil
+}
+
+// parseOpenGraph returns the OpenGraph properties of the HTML document in
+// the <meta property="og:..."> tags of its head. The title and description
+// are taken from the <title> and <meta name="description"> tags if there
+// aren't OpenGraph ones.
+func parseOpenGraph(body []byte) map[string]interface{} {
+	preview := map[string]interface{}{}
+	var title, description string
+	inTitle := false
+	z := html.NewTokenizer(bytes.NewReader(body))
+loop:
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = true
+			case "meta":
+				if !hasAttr {
+					continue
+				}
+				attrs := map[string]string{}
+				for more := true; more; {
+					var key, val []byte
+					key, val, more = z.TagAttr()
+					attrs[string(key)] = string(val)
+				}
+				property := attrs["property"]
+				if property == "" {
+					property = attrs["name"]
+				}
+				if strings.HasPrefix(property, "og:") {
+					if _, ok := preview[property]; !ok {
+						preview[property] = attrs["content"]
+					}
+				} else if strings.EqualFold(property, "description") {
+					description = attrs["content"]
+				}
+			}
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				// The OpenGraph properties are all in the head, so stop here
+				// rather than tokenising the rest of the document.
+				break loop
+			}
+		}
+	}
+	if _, ok := preview["og:title"]; !ok && title != "" {
+		preview["og:title"] = title
+	}
+	if _, ok := preview["og:description"]; !ok && description != "" {
+		preview["og:description"] = description
+	}
+	return preview
+}
@@ -0,0 +1,102 @@
+package routing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/storage"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/util"
+)
+
+func TestURLPreview(t *testing.T) {
+	var pngData bytes.Buffer
+	if err := png.Encode(&pngData, image.NewRGBA(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatalf("failed to encode image: %s", err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(`<html><head><title>Fallback</title>
+				<meta property="og:description" content="A page">
+				<meta property="og:image" content="/image.png">
+				</head><body><meta property="og:title" content="Too late"></body></html>`))
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write(pngData.Bytes())
+		case "/download":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, _ = w.Write([]byte("data"))
+		}
+	}))
+	defer srv.Close()
+
+	basePath, err := ioutil.TempDir("", "url_preview_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(basePath) // nolint: errcheck
+	db, err := storage.Open(&config.DatabaseOptions{ConnectionString: "file::memory:"})
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	cfg := &config.MediaAPI{Matrix: &config.Global{ServerName: "localhost"}}
+	cfg.Defaults()
+	cfg.AbsBasePath = config.Path(basePath)
+	previewer, err := newURLPreviewer(cfg, db, &types.ActiveThumbnailGeneration{
+		PathToResult: map[string]*types.ThumbnailGenerationResult{},
+	})
+	if err != nil {
+		t.Fatalf("newURLPreviewer failed: %s", err)
+	}
+	ctx := context.Background()
+	dev := &userapi.Device{UserID: "@alice:localhost"}
+	logger := util.GetLogger(ctx)
+	target, _ := url.Parse(srv.URL + "/page")
+
+	// The test server is on a loopback address, which is denied by default.
+	if _, err = previewer.generatePreview(ctx, target, dev, logger); !errors.Is(err, errHostDenied) {
+		t.Fatalf("loopback preview: got error %v, want %v", err, errHostDenied)
+	}
+
+	previewer.denied = newHostList(nil)
+	preview, err := previewer.generatePreview(ctx, target, dev, logger)
+	if err != nil {
+		t.Fatalf("generatePreview failed: %s", err)
+	}
+	if preview["og:title"] != "Fallback" || preview["og:description"] != "A page" {
+		t.Errorf("got title %v and description %v, want the fallback title and the OpenGraph description", preview["og:title"], preview["og:description"])
+	}
+	if preview["og:image:width"] != 4 || preview["og:image:height"] != 3 || preview["matrix:image:size"] != pngData.Len() {
+		t.Errorf("got image properties %+v, want a 4x3 image of %d bytes", preview, pngData.Len())
+	}
+	if mxc, _ := preview["og:image"].(string); !strings.HasPrefix(mxc, "mxc://localhost/") {
+		t.Errorf("got og:image %v, want a local mxc:// URI", preview["og:image"])
+	}
+
+	// Only the listed hosts may be previewed when there is an allow list.
+	// The hosts are checked when connecting, so don't reuse the connections.
+	previewer.allowed = newHostList([]string{"*.example.com"})
+	previewer.client.CloseIdleConnections()
+	if _, err = previewer.generatePreview(ctx, target, dev, logger); !errors.Is(err, errHostDenied) {
+		t.Errorf("unlisted host: got error %v, want %v", err, errHostDenied)
+	}
+	previewer.allowed = newHostList([]string{"127.0.0.0/8"})
+	download, _ := url.Parse(srv.URL + "/download")
+	if _, err = previewer.generatePreview(ctx, download, dev, logger); !errors.Is(err, errUnsupportedContent) {
+		t.Errorf("unsupported content type: got error %v, want %v", err, errUnsupportedContent)
+	}
+}
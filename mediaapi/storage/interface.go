@@ -23,9 +23,18 @@ import (
 
 type Database interface {
 	StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error
+	StoreUploadedMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata, quota types.FileSizeBytes) (bool, error)
+	GetUploadUsage(ctx context.Context, userID types.MatrixUserID) (types.FileSizeBytes, error)
+	StorePendingMedia(ctx context.Context, pendingMedia *types.PendingMedia) error
+	GetPendingMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.PendingMedia, error)
+	DeleteExpiredPendingMedia(ctx context.Context, now types.UnixMs) (int64, error)
 	GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaMetadata, error)
 	GetMediaMetadataByHash(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin gomatrixserverlib.ServerName) (*types.MediaMetadata, error)
 	StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error
 	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName) ([]*types.ThumbnailMetadata, error)
+	UpdateRemoteMediaAccess(ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, ts types.UnixMs) error
+	GetRemoteMediaCacheSize(ctx context.Context, localServer gomatrixserverlib.ServerName) (types.FileSizeBytes, error)
+	GetLeastRecentlyUsedRemoteMedia(ctx context.Context, localServer gomatrixserverlib.ServerName, limit int) ([]*types.MediaMetadata, error)
+	DeleteRemoteMedia(ctx context.Context, mediaMetadata *types.MediaMetadata, removeFiles func(stillReferenced bool) error) error
 }
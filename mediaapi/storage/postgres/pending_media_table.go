@@ -0,0 +1,126 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const pendingMediaSchema = `
+-- The mediaapi_pending_media table holds the media IDs which have been created for
+-- asynchronous uploads but whose content hasn't been uploaded yet.
+CREATE TABLE IF NOT EXISTS mediaapi_pending_media (
+    media_id TEXT NOT NULL,
+    media_origin TEXT NOT NULL,
+    -- The user who created the media ID, who is the only user who may upload the content.
+    user_id TEXT NOT NULL,
+    -- When the media ID was created in UNIX epoch ms.
+    creation_ts BIGINT NOT NULL,
+    -- When the media ID expires if the content hasn't been uploaded, in UNIX epoch ms.
+    expires_ts BIGINT NOT NULL,
+    PRIMARY KEY (media_id, media_origin)
+);
+`
+
+const insertPendingMediaSQL = `
+INSERT INTO mediaapi_pending_media (media_id, media_origin, user_id, creation_ts, expires_ts)
+    VALUES ($1, $2, $3, $4, $5)
+`
+
+const selectPendingMediaSQL = `
+SELECT user_id, creation_ts, expires_ts FROM mediaapi_pending_media WHERE media_id = $1 AND media_origin = $2
+`
+
+const deletePendingMediaSQL = `
+DELETE FROM mediaapi_pending_media WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteExpiredPendingMediaSQL = `
+DELETE FROM mediaapi_pending_media WHERE expires_ts <= $1
+`
+
+type pendingMediaStatements struct {
+	insertPendingMediaStmt        *sql.Stmt
+	selectPendingMediaStmt        *sql.Stmt
+	deletePendingMediaStmt        *sql.Stmt
+	deleteExpiredPendingMediaStmt *sql.Stmt
+}
+
+func (s *pendingMediaStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pendingMediaSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.insertPendingMediaStmt, insertPendingMediaSQL},
+		{&s.selectPendingMediaStmt, selectPendingMediaSQL},
+		{&s.deletePendingMediaStmt, deletePendingMediaSQL},
+		{&s.deleteExpiredPendingMediaStmt, deleteExpiredPendingMediaSQL},
+	}.prepare(db)
+}
+
+func (s *pendingMediaStatements) insertPendingMedia(
+	ctx context.Context, txn *sql.Tx, pendingMedia *types.PendingMedia,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertPendingMediaStmt).ExecContext(
+		ctx,
+		pendingMedia.MediaID,
+		pendingMedia.Origin,
+		pendingMedia.UserID,
+		pendingMedia.CreationTimestamp,
+		pendingMedia.ExpiresTimestamp,
+	)
+	return err
+}
+
+func (s *pendingMediaStatements) selectPendingMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (*types.PendingMedia, error) {
+	pendingMedia := types.PendingMedia{
+		MediaID: mediaID,
+		Origin:  mediaOrigin,
+	}
+	err := s.selectPendingMediaStmt.QueryRowContext(
+		ctx, mediaID, mediaOrigin,
+	).Scan(
+		&pendingMedia.UserID,
+		&pendingMedia.CreationTimestamp,
+		&pendingMedia.ExpiresTimestamp,
+	)
+	return &pendingMedia, err
+}
+
+func (s *pendingMediaStatements) deletePendingMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePendingMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *pendingMediaStatements) deleteExpiredPendingMedia(
+	ctx context.Context, txn *sql.Tx, now types.UnixMs,
+) (int64, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteExpiredPendingMediaStmt).ExecContext(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
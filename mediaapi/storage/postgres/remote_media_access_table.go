@@ -0,0 +1,128 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const remoteMediaAccessSchema = `
+-- The mediaapi_remote_media_access table records when media fetched from other servers was last accessed, so that
+-- the least recently used remote media can be evicted from the cache.
+CREATE TABLE IF NOT EXISTS mediaapi_remote_media_access (
+    media_id TEXT NOT NULL,
+    media_origin TEXT NOT NULL,
+    -- When the media was last downloaded or thumbnailed in UNIX epoch ms.
+    last_access_ts BIGINT NOT NULL,
+    PRIMARY KEY (media_id, media_origin)
+);
+`
+
+const upsertRemoteMediaAccessSQL = `
+INSERT INTO mediaapi_remote_media_access (media_id, media_origin, last_access_ts) VALUES ($1, $2, $3)
+    ON CONFLICT (media_id, media_origin) DO UPDATE SET last_access_ts = $3
+`
+
+const deleteRemoteMediaAccessSQL = `
+DELETE FROM mediaapi_remote_media_access WHERE media_id = $1 AND media_origin = $2
+`
+
+// Media which has never been accessed since it was fetched was last accessed when it was fetched.
+const selectLeastRecentlyUsedRemoteMediaSQL = `
+SELECT m.media_id, m.media_origin, m.file_size_bytes, m.base64hash, m.user_id FROM mediaapi_media_repository m
+    LEFT JOIN mediaapi_remote_media_access a ON m.media_id = a.media_id AND m.media_origin = a.media_origin
+    WHERE m.media_origin != $1
+    ORDER BY COALESCE(a.last_access_ts, m.creation_ts) ASC LIMIT $2
+`
+
+const selectRemoteMediaCacheSizeSQL = `
+SELECT
+    COALESCE((SELECT SUM(file_size_bytes) FROM mediaapi_media_repository WHERE media_origin != $1), 0) +
+    COALESCE((SELECT SUM(file_size_bytes) FROM mediaapi_thumbnail WHERE media_origin != $1), 0)
+`
+
+type remoteMediaAccessStatements struct {
+	upsertRemoteMediaAccessStmt            *sql.Stmt
+	deleteRemoteMediaAccessStmt            *sql.Stmt
+	selectLeastRecentlyUsedRemoteMediaStmt *sql.Stmt
+	selectRemoteMediaCacheSizeStmt         *sql.Stmt
+}
+
+func (s *remoteMediaAccessStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(remoteMediaAccessSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.upsertRemoteMediaAccessStmt, upsertRemoteMediaAccessSQL},
+		{&s.deleteRemoteMediaAccessStmt, deleteRemoteMediaAccessSQL},
+		{&s.selectLeastRecentlyUsedRemoteMediaStmt, selectLeastRecentlyUsedRemoteMediaSQL},
+		{&s.selectRemoteMediaCacheSizeStmt, selectRemoteMediaCacheSizeSQL},
+	}.prepare(db)
+}
+
+func (s *remoteMediaAccessStatements) upsertRemoteMediaAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, ts types.UnixMs,
+) error {
+	_, err := s.upsertRemoteMediaAccessStmt.ExecContext(ctx, mediaID, mediaOrigin, ts)
+	return err
+}
+
+func (s *remoteMediaAccessStatements) deleteRemoteMediaAccess(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRemoteMediaAccessStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *remoteMediaAccessStatements) selectLeastRecentlyUsedRemoteMedia(
+	ctx context.Context, localServer gomatrixserverlib.ServerName, limit int,
+) ([]*types.MediaMetadata, error) {
+	rows, err := s.selectLeastRecentlyUsedRemoteMediaStmt.QueryContext(ctx, localServer, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectLeastRecentlyUsedRemoteMedia: rows.close() failed")
+
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		var mediaMetadata types.MediaMetadata
+		if err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func (s *remoteMediaAccessStatements) selectRemoteMediaCacheSize(
+	ctx context.Context, localServer gomatrixserverlib.ServerName,
+) (size types.FileSizeBytes, err error) {
+	err = s.selectRemoteMediaCacheSizeStmt.QueryRowContext(ctx, localServer).Scan(&size)
+	return
+}
@@ -22,6 +22,9 @@ import (
 type statements struct {
 	media     mediaStatements
 	thumbnail thumbnailStatements
+	access    remoteMediaAccessStatements
+	usage     uploadUsageStatements
+	pending   pendingMediaStatements
 }
 
 func (s *statements) prepare(db *sql.DB) (err error) {
@@ -31,6 +34,15 @@ func (s *statements) prepare(db *sql.DB) (err error) {
 	if err = s.thumbnail.prepare(db); err != nil {
 		return
 	}
+	if err = s.access.prepare(db); err != nil {
+		return
+	}
+	if err = s.usage.prepare(db); err != nil {
+		return
+	}
+	if err = s.pending.prepare(db); err != nil {
+		return
+	}
 
 	return
 }
@@ -51,7 +51,71 @@ func Open(dbProperties *config.DatabaseOptions) (*Database, error) {
 func (d *Database) StoreMediaMetadata(
 	ctx context.Context, mediaMetadata *types.MediaMetadata,
 ) error {
-	return d.statements.media.insertMedia(ctx, mediaMetadata)
+	return d.statements.media.insertMedia(ctx, nil, mediaMetadata)
+}
+
+// StoreUploadedMediaMetadata inserts the metadata about the uploaded media into the database and
+// adds its size to the total uploaded by the user, in the same transaction. If that would take the
+// total over the quota then nothing is stored and false is returned. A quota of 0 is unlimited.
+// If the media ID was created for an asynchronous upload then it is no longer pending.
+// Returns an error if the combination of MediaID and Origin are not unique in the table.
+func (d *Database) StoreUploadedMediaMetadata(
+	ctx context.Context, mediaMetadata *types.MediaMetadata, quota types.FileSizeBytes,
+) (withinQuota bool, err error) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		withinQuota = true
+		if mediaMetadata.UserID != "" {
+			withinQuota, err = d.statements.usage.addUploadUsage(ctx, txn, mediaMetadata.UserID, mediaMetadata.FileSizeBytes, quota)
+			if err != nil || !withinQuota {
+				return err
+			}
+		}
+		if err = d.statements.media.insertMedia(ctx, txn, mediaMetadata); err != nil {
+			return err
+		}
+		return d.statements.pending.deletePendingMedia(ctx, txn, mediaMetadata.MediaID, mediaMetadata.Origin)
+	})
+	return
+}
+
+// StorePendingMedia stores a media ID which has been created for an asynchronous upload.
+func (d *Database) StorePendingMedia(
+	ctx context.Context, pendingMedia *types.PendingMedia,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.statements.pending.insertPendingMedia(ctx, txn, pendingMedia)
+	})
+}
+
+// GetPendingMedia returns the media ID created for an asynchronous upload if its content
+// hasn't been uploaded yet. Returns nil if there is no such media ID.
+func (d *Database) GetPendingMedia(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) (*types.PendingMedia, error) {
+	pendingMedia, err := d.statements.pending.selectPendingMedia(ctx, mediaID, mediaOrigin)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return pendingMedia, err
+}
+
+// DeleteExpiredPendingMedia deletes the media IDs created for asynchronous uploads which
+// expired before now without their content being uploaded. Returns how many were deleted.
+func (d *Database) DeleteExpiredPendingMedia(
+	ctx context.Context, now types.UnixMs,
+) (deleted int64, err error) {
+	err = sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		deleted, err = d.statements.pending.deleteExpiredPendingMedia(ctx, txn, now)
+		return err
+	})
+	return
+}
+
+// GetUploadUsage returns the total size of the media uploaded by the user.
+func (d *Database) GetUploadUsage(
+	ctx context.Context, userID types.MatrixUserID,
+) (types.FileSizeBytes, error) {
+	return d.statements.usage.selectUploadUsage(ctx, userID)
 }
 
 // GetMediaMetadata returns metadata about media stored on this server.
@@ -119,3 +183,57 @@ func (d *Database) GetThumbnails(
 	}
 	return thumbnails, err
 }
+
+// UpdateRemoteMediaAccess records that media fetched from another server was accessed at the given time.
+func (d *Database) UpdateRemoteMediaAccess(
+	ctx context.Context, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName, ts types.UnixMs,
+) error {
+	return d.statements.access.upsertRemoteMediaAccess(ctx, mediaID, mediaOrigin, ts)
+}
+
+// GetRemoteMediaCacheSize returns the total size of the media, and their thumbnails, which were fetched
+// from servers other than the local server.
+func (d *Database) GetRemoteMediaCacheSize(
+	ctx context.Context, localServer gomatrixserverlib.ServerName,
+) (types.FileSizeBytes, error) {
+	return d.statements.access.selectRemoteMediaCacheSize(ctx, localServer)
+}
+
+// GetLeastRecentlyUsedRemoteMedia returns up to limit media fetched from servers other than the local
+// server, least recently accessed first. Only the media ID, origin, file size and hash are returned.
+func (d *Database) GetLeastRecentlyUsedRemoteMedia(
+	ctx context.Context, localServer gomatrixserverlib.ServerName, limit int,
+) ([]*types.MediaMetadata, error) {
+	return d.statements.access.selectLeastRecentlyUsedRemoteMedia(ctx, localServer, limit)
+}
+
+// DeleteRemoteMedia deletes the metadata of the media and its thumbnails, subtracting its size from
+// the total uploaded by its uploader if there is one, and calling removeFiles in the
+// same transaction so that the metadata is only deleted if the files are removed successfully.
+// removeFiles is told whether any other media is stored in the same file, in which case the files
+// must be kept.
+func (d *Database) DeleteRemoteMedia(
+	ctx context.Context, mediaMetadata *types.MediaMetadata, removeFiles func(stillReferenced bool) error,
+) error {
+	return sqlutil.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.statements.media.deleteMedia(ctx, txn, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+			return err
+		}
+		if err := d.statements.thumbnail.deleteThumbnails(ctx, txn, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+			return err
+		}
+		if err := d.statements.access.deleteRemoteMediaAccess(ctx, txn, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+			return err
+		}
+		if mediaMetadata.UserID != "" {
+			if err := d.statements.usage.subtractUploadUsage(ctx, txn, mediaMetadata.UserID, mediaMetadata.FileSizeBytes); err != nil {
+				return err
+			}
+		}
+		count, err := d.statements.media.selectMediaCountByHash(ctx, txn, mediaMetadata.Base64Hash)
+		if err != nil {
+			return err
+		}
+		return removeFiles(count > 0)
+	})
+}
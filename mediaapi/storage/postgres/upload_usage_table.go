@@ -0,0 +1,99 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/mediaapi/types"
+)
+
+const uploadUsageSchema = `
+-- The mediaapi_upload_usage table holds the total size of the media uploaded by each user, which is
+-- limited by the upload quotas.
+CREATE TABLE IF NOT EXISTS mediaapi_upload_usage (
+    user_id TEXT NOT NULL PRIMARY KEY,
+    total_bytes BIGINT NOT NULL
+);
+`
+
+// Adds to the usage of the user, unless that would take it over the quota. A quota of 0 is unlimited.
+const upsertUploadUsageSQL = `
+INSERT INTO mediaapi_upload_usage (user_id, total_bytes) VALUES ($1, $2)
+    ON CONFLICT (user_id) DO UPDATE SET total_bytes = mediaapi_upload_usage.total_bytes + $2
+    WHERE $3 = 0 OR mediaapi_upload_usage.total_bytes + $2 <= $3
+`
+
+const subtractUploadUsageSQL = `
+UPDATE mediaapi_upload_usage SET total_bytes = GREATEST(total_bytes - $2, 0) WHERE user_id = $1
+`
+
+const selectUploadUsageSQL = `
+SELECT total_bytes FROM mediaapi_upload_usage WHERE user_id = $1
+`
+
+type uploadUsageStatements struct {
+	upsertUploadUsageStmt   *sql.Stmt
+	subtractUploadUsageStmt *sql.Stmt
+	selectUploadUsageStmt   *sql.Stmt
+}
+
+func (s *uploadUsageStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(uploadUsageSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.upsertUploadUsageStmt, upsertUploadUsageSQL},
+		{&s.subtractUploadUsageStmt, subtractUploadUsageSQL},
+		{&s.selectUploadUsageStmt, selectUploadUsageSQL},
+	}.prepare(db)
+}
+
+// addUploadUsage adds the size to the usage of the user, returning false without changing it if
+// that would take it over the quota. A quota of 0 is unlimited.
+func (s *uploadUsageStatements) addUploadUsage(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, size, quota types.FileSizeBytes,
+) (bool, error) {
+	if quota > 0 && size > quota {
+		return false, nil
+	}
+	res, err := sqlutil.TxStmt(txn, s.upsertUploadUsageStmt).ExecContext(ctx, userID, size, quota)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *uploadUsageStatements) subtractUploadUsage(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, size types.FileSizeBytes,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.subtractUploadUsageStmt).ExecContext(ctx, userID, size)
+	return err
+}
+
+func (s *uploadUsageStatements) selectUploadUsage(
+	ctx context.Context, userID types.MatrixUserID,
+) (size types.FileSizeBytes, err error) {
+	err = s.selectUploadUsageStmt.QueryRowContext(ctx, userID).Scan(&size)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
@@ -64,12 +64,22 @@ const selectMediaByHashSQL = `
 SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
 `
 
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectMediaCountByHashSQL = `
+SELECT COUNT(*) FROM mediaapi_media_repository WHERE base64hash = $1
+`
+
 type mediaStatements struct {
-	db                    *sql.DB
-	writer                sqlutil.Writer
-	insertMediaStmt       *sql.Stmt
-	selectMediaStmt       *sql.Stmt
-	selectMediaByHashStmt *sql.Stmt
+	db                         *sql.DB
+	writer                     sqlutil.Writer
+	insertMediaStmt            *sql.Stmt
+	selectMediaStmt            *sql.Stmt
+	selectMediaByHashStmt      *sql.Stmt
+	deleteMediaStmt            *sql.Stmt
+	selectMediaCountByHashStmt *sql.Stmt
 }
 
 func (s *mediaStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -85,28 +95,27 @@ func (s *mediaStatements) prepare(db *sql.DB, writer sqlutil.Writer) (err error)
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
 		{&s.selectMediaByHashStmt, selectMediaByHashSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
+		{&s.selectMediaCountByHashStmt, selectMediaCountByHashSQL},
 	}.prepare(db)
 }
 
 func (s *mediaStatements) insertMedia(
-	ctx context.Context, mediaMetadata *types.MediaMetadata,
+	ctx context.Context, txn *sql.Tx, mediaMetadata *types.MediaMetadata,
 ) error {
 	mediaMetadata.CreationTimestamp = types.UnixMs(time.Now().UnixNano() / 1000000)
-	return s.writer.Do(s.db, nil, func(txn *sql.Tx) error {
-		stmt := sqlutil.TxStmt(txn, s.insertMediaStmt)
-		_, err := stmt.ExecContext(
-			ctx,
-			mediaMetadata.MediaID,
-			mediaMetadata.Origin,
-			mediaMetadata.ContentType,
-			mediaMetadata.FileSizeBytes,
-			mediaMetadata.CreationTimestamp,
-			mediaMetadata.UploadName,
-			mediaMetadata.Base64Hash,
-			mediaMetadata.UserID,
-		)
-		return err
-	})
+	_, err := sqlutil.TxStmt(txn, s.insertMediaStmt).ExecContext(
+		ctx,
+		mediaMetadata.MediaID,
+		mediaMetadata.Origin,
+		mediaMetadata.ContentType,
+		mediaMetadata.FileSizeBytes,
+		mediaMetadata.CreationTimestamp,
+		mediaMetadata.UploadName,
+		mediaMetadata.Base64Hash,
+		mediaMetadata.UserID,
+	)
+	return err
 }
 
 func (s *mediaStatements) selectMedia(
@@ -148,3 +157,18 @@ func (s *mediaStatements) selectMediaByHash(
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) deleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin gomatrixserverlib.ServerName,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+// selectMediaCountByHash returns how many media, from any origin, are stored in the file with the hash.
+func (s *mediaStatements) selectMediaCountByHash(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (count int, err error) {
+	err = sqlutil.TxStmt(txn, s.selectMediaCountByHashStmt).QueryRowContext(ctx, mediaHash).Scan(&count)
+	return
+}
@@ -24,6 +24,9 @@ import (
 type statements struct {
 	media     mediaStatements
 	thumbnail thumbnailStatements
+	access    remoteMediaAccessStatements
+	usage     uploadUsageStatements
+	pending   pendingMediaStatements
 }
 
 func (s *statements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
@@ -33,6 +36,15 @@ func (s *statements) prepare(db *sql.DB, writer sqlutil.Writer) (err error) {
 	if err = s.thumbnail.prepare(db, writer); err != nil {
 		return
 	}
+	if err = s.access.prepare(db, writer); err != nil {
+		return
+	}
+	if err = s.usage.prepare(db); err != nil {
+		return
+	}
+	if err = s.pending.prepare(db); err != nil {
+		return
+	}
 
 	return
 }
@@ -98,6 +98,22 @@ func GenerateThumbnail(
 	return false, nil
 }
 
+// DownscaleThumbnail resizes an existing thumbnail to the requested size and
+// returns the JPEG data without storing it. It is used to serve sizes which
+// weren't pre-generated from the nearest larger thumbnail.
+func DownscaleThumbnail(src types.Path, config types.ThumbnailSize, logger *log.Entry) ([]byte, error) {
+	buffer, err := bimg.Read(string(src))
+	if err != nil {
+		logger.WithError(err).WithField("src", src).Error("Failed to read thumbnail file")
+		return nil, err
+	}
+	options, err := resizeOptions(bimg.NewImage(buffer), config.Width, config.Height, config.ResizeMethod == "crop")
+	if err != nil {
+		return nil, err
+	}
+	return bimg.NewImage(buffer).Process(options)
+}
+
 // createThumbnail checks if the thumbnail exists, and if not, generates it
 // Thumbnail generation is only done once for each non-existing thumbnail.
 func createThumbnail(
@@ -206,11 +222,32 @@ func isLargerThanOriginal(config types.ThumbnailSize, img *bimg.Image) bool {
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
 func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
-	inSize, err := inImage.Size()
+	options, err := resizeOptions(inImage, w, h, crop)
 	if err != nil {
 		return -1, -1, err
 	}
 
+	newImage, err := inImage.Process(options)
+	if err != nil {
+		return -1, -1, err
+	}
+
+	if err = bimg.Write(string(dst), newImage); err != nil {
+		logger.WithError(err).Error("Failed to resize image")
+		return -1, -1, err
+	}
+
+	return options.Width, options.Height, nil
+}
+
+// resizeOptions returns the options to scale an image in the same way as resize.
+// Only the first frame of an animated GIF is processed, so that is what gets thumbnailed.
+func resizeOptions(inImage *bimg.Image, w, h int, crop bool) (bimg.Options, error) {
+	inSize, err := inImage.Size()
+	if err != nil {
+		return bimg.Options{}, err
+	}
+
 	options := bimg.Options{
 		Type:    bimg.JPEG,
 		Quality: 85,
@@ -233,16 +270,5 @@ func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *lo
 			options.Height = h
 		}
 	}
-
-	newImage, err := inImage.Process(options)
-	if err != nil {
-		return -1, -1, err
-	}
-
-	if err = bimg.Write(string(dst), newImage); err != nil {
-		logger.WithError(err).Error("Failed to resize image")
-		return -1, -1, err
-	}
-
-	return options.Width, options.Height, nil
+	return options, nil
 }
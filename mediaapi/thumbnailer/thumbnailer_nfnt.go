@@ -17,6 +17,7 @@
 package thumbnailer
 
 import (
+	"bytes"
 	"context"
 	"image"
 	"image/draw"
@@ -27,6 +28,7 @@ import (
 
 	// Imported for png codec
 	_ "image/png"
+	"io"
 	"os"
 	"time"
 
@@ -105,6 +107,24 @@ func GenerateThumbnail(
 	return false, nil
 }
 
+// DownscaleThumbnail resizes an existing thumbnail to the requested size and
+// returns the JPEG data without storing it. It is used to serve sizes which
+// weren't pre-generated from the nearest larger thumbnail.
+func DownscaleThumbnail(src types.Path, config types.ThumbnailSize, logger *log.Entry) ([]byte, error) {
+	img, err := readFile(string(src))
+	if err != nil {
+		logger.WithError(err).WithField("src", src).Error("Failed to read thumbnail file")
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err = encodeJPEG(&buf, resizeImage(img, config.Width, config.Height, config.ResizeMethod == types.Crop)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readFile decodes the image in the file. Only the first frame of an animated
+// GIF is decoded, so that is what gets thumbnailed.
 func readFile(src string) (image.Image, error) {
 	file, err := os.Open(src)
 	if err != nil {
@@ -127,7 +147,11 @@ func writeFile(img image.Image, dst string) (err error) {
 	}
 	defer (func() { err = out.Close() })()
 
-	return jpeg.Encode(out, img, &jpeg.Options{
+	return encodeJPEG(out, img)
+}
+
+func encodeJPEG(w io.Writer, img image.Image) error {
+	return jpeg.Encode(w, img, &jpeg.Options{
 		Quality: 85,
 	})
 }
@@ -232,8 +256,18 @@ func createThumbnail(
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
 func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+	out := resizeImage(img, w, h, crop)
+	if err := writeFile(out, string(dst)); err != nil {
+		logger.WithError(err).Error("Failed to encode and write image")
+		return -1, -1, err
+	}
+
+	return out.Bounds().Max.X, out.Bounds().Max.Y, nil
+}
+
+// resizeImage scales an image in the same way as adjustSize, without writing it out.
+func resizeImage(img image.Image, w, h int, crop bool) image.Image {
 	var out image.Image
-	var err error
 	if crop {
 		inAR := float64(img.Bounds().Dx()) / float64(img.Bounds().Dy())
 		outAR := float64(w) / float64(h)
@@ -261,11 +295,5 @@ func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *lo
 	} else {
 		out = resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
 	}
-
-	if err = writeFile(out, string(dst)); err != nil {
-		logger.WithError(err).Error("Failed to encode and write image")
-		return -1, -1, err
-	}
-
-	return out.Bounds().Max.X, out.Bounds().Max.Y, nil
+	return out
 }
@@ -0,0 +1,72 @@
+// +build !bimg
+
+package thumbnailer
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/mediaapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+func TestDownscaleAnimatedGIF(t *testing.T) {
+	dir, err := ioutil.TempDir("", "thumbnailer_test")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	// The first frame is white and the second is black.
+	palette := color.Palette{color.White, color.Black}
+	frame := func(c uint8) *image.Paletted {
+		img := image.NewPaletted(image.Rect(0, 0, 40, 20), palette)
+		for i := range img.Pix {
+			img.Pix[i] = c
+		}
+		return img
+	}
+	var buf bytes.Buffer
+	if err = gif.EncodeAll(&buf, &gif.GIF{
+		Image: []*image.Paletted{frame(0), frame(1)},
+		Delay: []int{10, 10},
+	}); err != nil {
+		t.Fatalf("failed to encode GIF: %s", err)
+	}
+	src := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(src, buf.Bytes(), 0600); err != nil {
+		t.Fatalf("failed to write GIF: %s", err)
+	}
+
+	logger := log.WithField("test", t.Name())
+	for _, size := range []types.ThumbnailSize{
+		{Width: 20, Height: 20, ResizeMethod: types.Scale},
+		{Width: 10, Height: 10, ResizeMethod: types.Crop},
+	} {
+		data, err := DownscaleThumbnail(types.Path(src), size, logger)
+		if err != nil {
+			t.Fatalf("DownscaleThumbnail failed: %s", err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to decode thumbnail: %s", err)
+		}
+		want := image.Pt(size.Width, size.Height)
+		if size.ResizeMethod == types.Scale {
+			want.Y = size.Width / 2 // scaled keeps the 2:1 aspect ratio of the source
+		}
+		if got := img.Bounds().Size(); got != want {
+			t.Errorf("%s: got size %v, want %v", size.ResizeMethod, got, want)
+		}
+		if r, _, _, _ := img.At(0, 0).RGBA(); r < 0x8000 {
+			t.Errorf("%s: thumbnail is dark, want the white first frame", size.ResizeMethod)
+		}
+	}
+}
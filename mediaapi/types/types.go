@@ -60,6 +60,16 @@ type MediaMetadata struct {
 	UserID            MatrixUserID
 }
 
+// PendingMedia is a media ID which has been created for an asynchronous upload, but
+// whose content hasn't been uploaded yet.
+type PendingMedia struct {
+	MediaID           MediaID
+	Origin            gomatrixserverlib.ServerName
+	UserID            MatrixUserID
+	CreationTimestamp UnixMs
+	ExpiresTimestamp  UnixMs
+}
+
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
 type RemoteRequestResult struct {
 	// Condition used for the requester to signal the result to all other routines waiting on this condition
@@ -37,14 +37,16 @@ type ServerACLDatabase interface {
 }
 
 type ServerACLs struct {
-	acls      map[string]*serverACL // room ID -> ACL
-	aclsMutex sync.RWMutex          // protects the above
+	acls       map[string]*serverACL // room ID -> ACL
+	aclsMutex  sync.RWMutex          // protects the above
+	serverName gomatrixserverlib.ServerName
 }
 
-func NewServerACLs(db ServerACLDatabase) *ServerACLs {
+func NewServerACLs(db ServerACLDatabase, serverName gomatrixserverlib.ServerName) *ServerACLs {
 	ctx := context.TODO()
 	acls := &ServerACLs{
-		acls: make(map[string]*serverACL),
+		acls:       make(map[string]*serverACL),
+		serverName: serverName,
 	}
 	// Look up all of the rooms that the current state server knows about.
 	rooms, err := db.GetKnownRooms(ctx)
@@ -83,7 +85,8 @@ func compileACLRegex(orig string) (*regexp.Regexp, error) {
 	escaped := regexp.QuoteMeta(orig)
 	escaped = strings.Replace(escaped, "\\?", ".", -1)
 	escaped = strings.Replace(escaped, "\\*", ".*", -1)
-	return regexp.Compile(escaped)
+	// The whole hostname must match, not just part of it.
+	return regexp.Compile("^" + escaped + "$")
 }
 
 func (s *ServerACLs) OnServerACLUpdate(state *gomatrixserverlib.Event) {
@@ -110,6 +113,12 @@ func (s *ServerACLs) OnServerACLUpdate(state *gomatrixserverlib.Event) {
 			acls.deniedRegexes = append(acls.deniedRegexes, expr)
 		}
 	}
+	// An ACL which would deny our own server is ignored, as otherwise we would
+	// stop participating in the room.
+	if s.serverName != "" && acls.isServerBanned(s.serverName) {
+		logrus.Warnf("Ignoring server ACLs for %q which would deny our own server", state.RoomID())
+		return
+	}
 	logrus.WithFields(logrus.Fields{
 		"allow_ip_literals": acls.AllowIPLiterals,
 		"num_allowed":       len(acls.allowedRegexes),
@@ -130,6 +139,10 @@ func (s *ServerACLs) IsServerBannedFromRoom(serverName gomatrixserverlib.ServerN
 		return false
 	}
 	s.aclsMutex.RUnlock()
+	return acls.isServerBanned(serverName)
+}
+
+func (acls *serverACL) isServerBanned(serverName gomatrixserverlib.ServerName) bool {
 	// Split the host and port apart. This is because the spec calls on us to
 	// validate the hostname only in cases where the port is also present.
 	if serverNameOnly, _, err := net.SplitHostPort(string(serverName)); err == nil {
@@ -17,6 +17,8 @@ package acls
 import (
 	"regexp"
 	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 func TestOpenACLsWithBlacklist(t *testing.T) {
@@ -103,3 +105,68 @@ func TestDefaultACLsWithWhitelist(t *testing.T) {
 		t.Fatal("Expected qux.com:4567 to be allowed but wasn't")
 	}
 }
+
+func TestACLsMatchWholeHostname(t *testing.T) {
+	roomID := "!test:test.com"
+	allowRegex, err := compileACLRegex("*")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	denyRegex, err := compileACLRegex("foo.com")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	acls := ServerACLs{
+		acls: make(map[string]*serverACL),
+	}
+
+	acls.acls[roomID] = &serverACL{
+		allowedRegexes: []*regexp.Regexp{allowRegex},
+		deniedRegexes:  []*regexp.Regexp{denyRegex},
+	}
+
+	if acls.IsServerBannedFromRoom("notfoo.com", roomID) {
+		t.Fatal("Expected notfoo.com to be allowed but wasn't")
+	}
+	if acls.IsServerBannedFromRoom("foo.com.bar.com", roomID) {
+		t.Fatal("Expected foo.com.bar.com to be allowed but wasn't")
+	}
+}
+
+func TestACLsDenyingOwnServerAreIgnored(t *testing.T) {
+	roomID := "!test:test.com"
+	acls := ServerACLs{
+		acls:       make(map[string]*serverACL),
+		serverName: "test.com",
+	}
+
+	update := func(content string) {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+			"type": "m.room.server_acl",
+			"state_key": "",
+			"room_id": "`+roomID+`",
+			"event_id": "$`+content+`:test.com",
+			"sender": "@alice:test.com",
+			"origin_server_ts": 0,
+			"content": {"allow": ["*"], "deny": ["`+content+`"]}
+		}`), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		acls.OnServerACLUpdate(ev)
+	}
+
+	update("foo.com")
+	if !acls.IsServerBannedFromRoom("foo.com", roomID) {
+		t.Fatal("Expected foo.com to be banned but wasn't")
+	}
+	// This would deny our own server, so the previous ACLs still apply.
+	update("*.com")
+	if !acls.IsServerBannedFromRoom("foo.com", roomID) {
+		t.Fatal("Expected foo.com to be banned but wasn't")
+	}
+	if acls.IsServerBannedFromRoom("bar.com", roomID) {
+		t.Fatal("Expected bar.com to be allowed but wasn't")
+	}
+}
@@ -56,6 +56,13 @@ type RoomserverInternalAPI interface {
 		res *PerformPublishResponse,
 	)
 
+	// PerformRoomUpgrade replaces a room with a new room of a different version
+	PerformRoomUpgrade(
+		ctx context.Context,
+		req *PerformRoomUpgradeRequest,
+		res *PerformRoomUpgradeResponse,
+	)
+
 	PerformInboundPeek(
 		ctx context.Context,
 		req *PerformInboundPeekRequest,
@@ -162,6 +169,8 @@ type RoomserverInternalAPI interface {
 	QueryKnownUsers(ctx context.Context, req *QueryKnownUsersRequest, res *QueryKnownUsersResponse) error
 	// QueryServerBannedFromRoom returns whether a server is banned from a room by server ACLs.
 	QueryServerBannedFromRoom(ctx context.Context, req *QueryServerBannedFromRoomRequest, res *QueryServerBannedFromRoomResponse) error
+	// QueryRoomStorageUsage returns how many events are stored for a room and how much space their event JSON takes up.
+	QueryRoomStorageUsage(ctx context.Context, req *QueryRoomStorageUsageRequest, res *QueryRoomStorageUsageResponse) error
 
 	// Query a given amount (or less) of events prior to a given set of events.
 	PerformBackfill(
@@ -173,6 +182,15 @@ type RoomserverInternalAPI interface {
 	// PerformForget forgets a rooms history for a specific user
 	PerformForget(ctx context.Context, req *PerformForgetRequest, resp *PerformForgetResponse) error
 
+	// PerformAdminEvacuateRoom makes every local user leave a room.
+	PerformAdminEvacuateRoom(ctx context.Context, req *PerformAdminEvacuateRoomRequest, res *PerformAdminEvacuateRoomResponse) error
+	// PerformAdminBlockRoom stops local users from joining or creating a room, or unblocks it again.
+	PerformAdminBlockRoom(ctx context.Context, req *PerformAdminBlockRoomRequest, res *PerformAdminBlockRoomResponse) error
+	// PerformPurgeHistory starts purging the old history of a room in the background.
+	PerformPurgeHistory(ctx context.Context, req *PerformPurgeHistoryRequest, res *PerformPurgeHistoryResponse) error
+	// QueryPurgeHistoryStatus returns the progress of a purge started with PerformPurgeHistory.
+	QueryPurgeHistoryStatus(ctx context.Context, req *QueryPurgeHistoryStatusRequest, res *QueryPurgeHistoryStatusResponse) error
+
 	// Asks for the default room version as preferred by the server.
 	QueryRoomVersionCapabilities(
 		ctx context.Context,
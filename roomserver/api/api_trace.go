@@ -88,6 +88,15 @@ func (t *RoomserverInternalAPITrace) PerformPublish(
 	util.GetLogger(ctx).Infof("PerformPublish req=%+v res=%+v", js(req), js(res))
 }
 
+func (t *RoomserverInternalAPITrace) PerformRoomUpgrade(
+	ctx context.Context,
+	req *PerformRoomUpgradeRequest,
+	res *PerformRoomUpgradeResponse,
+) {
+	t.Impl.PerformRoomUpgrade(ctx, req, res)
+	util.GetLogger(ctx).Infof("PerformRoomUpgrade req=%+v res=%+v", js(req), js(res))
+}
+
 func (t *RoomserverInternalAPITrace) PerformInboundPeek(
 	ctx context.Context,
 	req *PerformInboundPeekRequest,
@@ -228,6 +237,46 @@ func (t *RoomserverInternalAPITrace) PerformForget(
 	return err
 }
 
+func (t *RoomserverInternalAPITrace) PerformAdminEvacuateRoom(
+	ctx context.Context,
+	req *PerformAdminEvacuateRoomRequest,
+	res *PerformAdminEvacuateRoomResponse,
+) error {
+	err := t.Impl.PerformAdminEvacuateRoom(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformAdminEvacuateRoom req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) PerformAdminBlockRoom(
+	ctx context.Context,
+	req *PerformAdminBlockRoomRequest,
+	res *PerformAdminBlockRoomResponse,
+) error {
+	err := t.Impl.PerformAdminBlockRoom(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformAdminBlockRoom req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) PerformPurgeHistory(
+	ctx context.Context,
+	req *PerformPurgeHistoryRequest,
+	res *PerformPurgeHistoryResponse,
+) error {
+	err := t.Impl.PerformPurgeHistory(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("PerformPurgeHistory req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
+func (t *RoomserverInternalAPITrace) QueryPurgeHistoryStatus(
+	ctx context.Context,
+	req *QueryPurgeHistoryStatusRequest,
+	res *QueryPurgeHistoryStatusResponse,
+) error {
+	err := t.Impl.QueryPurgeHistoryStatus(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryPurgeHistoryStatus req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryRoomVersionCapabilities(
 	ctx context.Context,
 	req *QueryRoomVersionCapabilitiesRequest,
@@ -339,6 +388,13 @@ func (t *RoomserverInternalAPITrace) QueryServerBannedFromRoom(ctx context.Conte
 	return err
 }
 
+// QueryRoomStorageUsage returns how many events are stored for a room and how much space their event JSON takes up.
+func (t *RoomserverInternalAPITrace) QueryRoomStorageUsage(ctx context.Context, req *QueryRoomStorageUsageRequest, res *QueryRoomStorageUsageResponse) error {
+	err := t.Impl.QueryRoomStorageUsage(ctx, req, res)
+	util.GetLogger(ctx).WithError(err).Infof("QueryRoomStorageUsage req=%+v res=%+v", js(req), js(res))
+	return err
+}
+
 func (t *RoomserverInternalAPITrace) QueryAuthChain(
 	ctx context.Context,
 	request *QueryAuthChainRequest,
@@ -92,6 +92,7 @@ type InputRoomEventsRequest struct {
 type InputRoomEventsResponse struct {
 	ErrMsg     string // set if there was any error
 	NotAllowed bool   // true if an event in the input was not allowed.
+	TooLarge   bool   // true if an event in the input was too large.
 }
 
 func (r *InputRoomEventsResponse) Err() error {
@@ -103,5 +104,11 @@ func (r *InputRoomEventsResponse) Err() error {
 			Message: r.ErrMsg,
 		}
 	}
+	if r.TooLarge {
+		return gomatrixserverlib.EventValidationError{
+			Code:    gomatrixserverlib.EventValidationTooLarge,
+			Message: r.ErrMsg,
+		}
+	}
 	return fmt.Errorf("InputRoomEventsResponse: %s", r.ErrMsg)
 }
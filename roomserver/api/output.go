@@ -55,6 +55,8 @@ const (
 	OutputTypeNewInboundPeek OutputType = "new_inbound_peek"
 	// OutputTypeRetirePeek indicates that the kafka event is an OutputRetirePeek
 	OutputTypeRetirePeek OutputType = "retire_peek"
+	// OutputTypePurgedEvents indicates that the kafka event is an OutputPurgedEvents
+	OutputTypePurgedEvents OutputType = "purged_events"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -78,6 +80,8 @@ type OutputEvent struct {
 	NewInboundPeek *OutputNewInboundPeek `json:"new_inbound_peek,omitempty"`
 	// The content of event with type OutputTypeRetirePeek
 	RetirePeek *OutputRetirePeek `json:"retire_peek,omitempty"`
+	// The content of event with type OutputTypePurgedEvents
+	PurgedEvents *OutputPurgedEvents `json:"purged_events,omitempty"`
 }
 
 // Type of the OutputNewRoomEvent.
@@ -268,3 +272,11 @@ type OutputRetirePeek struct {
 	UserID   string
 	DeviceID string
 }
+
+// An OutputPurgedEvents is written whenever old timeline events have been purged
+// from a room because of its retention policy. Downstream components should stop
+// serving the events. State events are never purged.
+type OutputPurgedEvents struct {
+	RoomID   string
+	EventIDs []string
+}
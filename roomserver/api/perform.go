@@ -79,6 +79,8 @@ type PerformJoinRequest struct {
 	UserID        string                         `json:"user_id"`
 	Content       map[string]interface{}         `json:"content"`
 	ServerNames   []gomatrixserverlib.ServerName `json:"server_names"`
+	// Guests can only join rooms which allow guest access.
+	IsGuest bool `json:"is_guest"`
 }
 
 type PerformJoinResponse struct {
@@ -172,6 +174,19 @@ type PerformPublishResponse struct {
 	Error *PerformError
 }
 
+type PerformRoomUpgradeRequest struct {
+	RoomID      string                        `json:"room_id"`
+	UserID      string                        `json:"user_id"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+}
+
+type PerformRoomUpgradeResponse struct {
+	// The ID of the replacement room, populated on success.
+	NewRoomID string `json:"new_room_id"`
+	// If non-nil, the upgrade request failed. Contains more information why it failed.
+	Error *PerformError
+}
+
 type PerformInboundPeekRequest struct {
 	UserID          string                       `json:"user_id"`
 	RoomID          string                       `json:"room_id"`
@@ -201,3 +216,45 @@ type PerformForgetRequest struct {
 }
 
 type PerformForgetResponse struct{}
+
+// PerformAdminEvacuateRoomRequest is a request to PerformAdminEvacuateRoom.
+type PerformAdminEvacuateRoomRequest struct {
+	RoomID string `json:"room_id"`
+	// Also forget the room for every local user, so it doesn't show up in their sync.
+	Forget bool `json:"forget"`
+	// Stop local users from joining the room again.
+	Block bool `json:"block"`
+}
+
+type PerformAdminEvacuateRoomResponse struct {
+	// The local users who left the room, or rejected their invites to it.
+	Affected []string      `json:"affected"`
+	Error    *PerformError `json:"error,omitempty"`
+}
+
+// PerformAdminBlockRoomRequest is a request to PerformAdminBlockRoom.
+type PerformAdminBlockRoomRequest struct {
+	RoomID string `json:"room_id"`
+	// Block the room if true, unblock it if false.
+	Block bool `json:"block"`
+}
+
+type PerformAdminBlockRoomResponse struct {
+	Error *PerformError `json:"error,omitempty"`
+}
+
+// PerformPurgeHistoryRequest is a request to PerformPurgeHistory. Exactly one of
+// BeforeEventID and BeforeTS must be given.
+type PerformPurgeHistoryRequest struct {
+	RoomID string `json:"room_id"`
+	// Purge the events which were sent before this event.
+	BeforeEventID string `json:"before_event_id,omitempty"`
+	// Purge the events which were sent before this time.
+	BeforeTS gomatrixserverlib.Timestamp `json:"before_ts,omitempty"`
+}
+
+type PerformPurgeHistoryResponse struct {
+	// The ID of the purge, which can be passed to QueryPurgeHistoryStatus.
+	PurgeID string        `json:"purge_id"`
+	Error   *PerformError `json:"error,omitempty"`
+}
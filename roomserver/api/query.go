@@ -108,6 +108,9 @@ type QueryMissingAuthPrevEventsResponse struct {
 type QueryEventsByIDRequest struct {
 	// The event IDs to look up.
 	EventIDs []string `json:"event_ids"`
+	// Leave out soft-failed events, e.g. because the events are being
+	// served to a client.
+	ExcludeSoftFailed bool `json:"exclude_soft_failed"`
 }
 
 // QueryEventsByIDResponse is a response to QueryEventsByID
@@ -164,6 +167,9 @@ type QueryMembershipsForRoomResponse struct {
 	// True if the user has been in room before and has either stayed in it or
 	// left it.
 	HasBeenInRoom bool `json:"has_been_in_room"`
+	// True if the user is joined to the room, in which case the events are
+	// from the current state of the room.
+	IsInRoom bool `json:"is_in_room"`
 	// True if the user asked to forget this room.
 	IsRoomForgotten bool `json:"is_room_forgotten"`
 }
@@ -357,6 +363,40 @@ type QueryServerBannedFromRoomResponse struct {
 	Banned bool `json:"banned"`
 }
 
+type QueryPurgeHistoryStatusRequest struct {
+	PurgeID string `json:"purge_id"`
+}
+
+const (
+	PurgeHistoryStatusActive   = "active"
+	PurgeHistoryStatusComplete = "complete"
+	PurgeHistoryStatusFailed   = "failed"
+)
+
+type QueryPurgeHistoryStatusResponse struct {
+	// True if the purge was started by this roomserver since it was last restarted.
+	Exists bool `json:"exists"`
+	// One of PurgeHistoryStatusActive, PurgeHistoryStatusComplete or PurgeHistoryStatusFailed.
+	Status string `json:"status"`
+	// The number of events which were purged, once the purge is complete.
+	PurgedEvents int `json:"purged_events"`
+	// Why the purge failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+type QueryRoomStorageUsageRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+type QueryRoomStorageUsageResponse struct {
+	// True if the room is known to the roomserver.
+	RoomExists bool `json:"room_exists"`
+	// The number of events stored for the room.
+	EventCount int64 `json:"event_count"`
+	// The total size in bytes of the event JSON stored for the room, after compression.
+	SizeBytes int64 `json:"size_bytes"`
+}
+
 // MarshalJSON stringifies the room ID and StateKeyTuple keys so they can be sent over the wire in HTTP API mode.
 func (r *QueryBulkStateContentResponse) MarshalJSON() ([]byte, error) {
 	se := make(map[string]string)
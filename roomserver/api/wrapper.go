@@ -169,6 +169,49 @@ func IsServerBannedFromRoom(ctx context.Context, rsAPI RoomserverInternalAPI, ro
 	return res.Banned
 }
 
+// IsEventVisibleTo returns whether the history visibility of the room allows
+// the user to see the event. Shared history is only visible to users who are
+// in the room now, or who were joined when the event was sent.
+func IsEventVisibleTo(
+	ctx context.Context, rsAPI RoomserverInternalAPI, userID string, isInRoom bool, ev *gomatrixserverlib.HeaderedEvent,
+) (bool, error) {
+	var queryRes QueryStateAfterEventsResponse
+	if err := rsAPI.QueryStateAfterEvents(ctx, &QueryStateAfterEventsRequest{
+		RoomID:       ev.RoomID(),
+		PrevEventIDs: ev.PrevEventIDs(),
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: gomatrixserverlib.MRoomMember, StateKey: userID},
+			{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+		},
+	}, &queryRes); err != nil {
+		return false, fmt.Errorf("rsAPI.QueryStateAfterEvents: %w", err)
+	}
+	if !queryRes.RoomExists || !queryRes.PrevEventsExist {
+		return false, nil
+	}
+	visibility, membership := "shared", ""
+	for _, stateEvent := range queryRes.StateEvents {
+		switch stateEvent.Type() {
+		case gomatrixserverlib.MRoomHistoryVisibility:
+			if v, err := stateEvent.HistoryVisibility(); err == nil {
+				visibility = v
+			}
+		case gomatrixserverlib.MRoomMember:
+			membership, _ = stateEvent.Membership()
+		}
+	}
+	switch visibility {
+	case "world_readable":
+		return true, nil
+	case "shared":
+		return isInRoom || membership == gomatrixserverlib.Join, nil
+	case "invited":
+		return membership == gomatrixserverlib.Join || membership == gomatrixserverlib.Invite, nil
+	default:
+		return membership == gomatrixserverlib.Join, nil
+	}
+}
+
 // PopulatePublicRooms extracts PublicRoom information for all the provided room IDs. The IDs are not checked to see if they are visible in the
 // published room directory.
 // due to lots of switches
@@ -194,8 +237,7 @@ func PopulatePublicRooms(ctx context.Context, roomIDs []string, rsAPI Roomserver
 		util.GetLogger(ctx).WithError(err).Error("QueryBulkStateContent failed")
 		return nil, err
 	}
-	chunk := make([]gomatrixserverlib.PublicRoom, len(roomIDs))
-	i := 0
+	chunk := make([]gomatrixserverlib.PublicRoom, 0, len(stateRes.Rooms))
 	for roomID, data := range stateRes.Rooms {
 		pub := gomatrixserverlib.PublicRoom{
 			RoomID: roomID,
@@ -229,8 +271,7 @@ func PopulatePublicRooms(ctx context.Context, roomIDs []string, rsAPI Roomserver
 			pub.GuestCanJoin = true
 		}
 		pub.JoinedMembersCount = joinCount
-		chunk[i] = pub
-		i++
+		chunk = append(chunk, pub)
 	}
 	return chunk, nil
 }
@@ -0,0 +1,113 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// TODO: Knocking should live in gomatrixserverlib, along with a room version
+// which allows it.
+
+const (
+	// JoinRuleKnock is the MSC2403 join rule which allows users to knock on a room.
+	JoinRuleKnock = "knock"
+	// Knock is the MSC2403 membership of a user who has knocked on a room.
+	Knock = "knock"
+)
+
+// IsKnock returns whether the event is an MSC2403 knock.
+func IsKnock(event *gomatrixserverlib.Event) bool {
+	if event.Type() != gomatrixserverlib.MRoomMember || event.StateKey() == nil {
+		return false
+	}
+	membership, err := event.Membership()
+	return err == nil && membership == Knock
+}
+
+// Allowed checks whether the event is allowed by the auth events, like
+// gomatrixserverlib.Allowed, except that knocks are checked against the auth
+// rules of MSC2403.
+func Allowed(event *gomatrixserverlib.Event, authEvents gomatrixserverlib.AuthEventProvider) error {
+	if !IsKnock(event) {
+		return gomatrixserverlib.Allowed(event, authEvents)
+	}
+	createEvent, err := authEvents.Create()
+	if err != nil {
+		return err
+	}
+	if createEvent == nil || createEvent.RoomID() != event.RoomID() {
+		return knockNotAllowed("the create event is missing or in a different room")
+	}
+	if *event.StateKey() != event.Sender() {
+		return knockNotAllowed("users can only knock on their own behalf")
+	}
+	joinRuleEvent, err := authEvents.JoinRules()
+	if err != nil {
+		return err
+	}
+	var joinRule gomatrixserverlib.JoinRuleContent
+	if joinRuleEvent != nil {
+		if err = json.Unmarshal(joinRuleEvent.Content(), &joinRule); err != nil {
+			return knockNotAllowed("unparsable join rules: %s", err)
+		}
+	}
+	if joinRule.JoinRule != JoinRuleKnock {
+		return knockNotAllowed("the join rule of the room is not %q", JoinRuleKnock)
+	}
+	member, err := gomatrixserverlib.NewMemberContentFromAuthEvents(authEvents, event.Sender())
+	if err != nil {
+		return err
+	}
+	switch member.Membership {
+	case gomatrixserverlib.Ban, gomatrixserverlib.Join, gomatrixserverlib.Invite:
+		return knockNotAllowed("%q can't knock while their membership is %q", event.Sender(), member.Membership)
+	}
+	return nil
+}
+
+// StateNeededForAuth returns the state needed to authenticate the events,
+// like gomatrixserverlib.StateNeededForAuth, including the join rules for knocks.
+func StateNeededForAuth(events []*gomatrixserverlib.Event) gomatrixserverlib.StateNeeded {
+	result := gomatrixserverlib.StateNeededForAuth(events)
+	for _, event := range events {
+		if IsKnock(event) {
+			result.JoinRules = true
+		}
+	}
+	return result
+}
+
+// StateNeededForEventBuilder returns the state needed to authenticate the event
+// being built, like gomatrixserverlib.StateNeededForEventBuilder, including the
+// join rules for knocks.
+func StateNeededForEventBuilder(builder *gomatrixserverlib.EventBuilder) (gomatrixserverlib.StateNeeded, error) {
+	result, err := gomatrixserverlib.StateNeededForEventBuilder(builder)
+	if err != nil || builder.Type != gomatrixserverlib.MRoomMember {
+		return result, err
+	}
+	var content gomatrixserverlib.MemberContent
+	if err = json.Unmarshal(builder.Content, &content); err == nil && content.Membership == Knock {
+		result.JoinRules = true
+	}
+	return result, nil
+}
+
+func knockNotAllowed(message string, args ...interface{}) error {
+	return &gomatrixserverlib.NotAllowed{Message: fmt.Sprintf("knock: "+message, args...)}
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/input"
 	"github.com/matrix-org/dendrite/roomserver/internal/perform"
 	"github.com/matrix-org/dendrite/roomserver/internal/query"
+	"github.com/matrix-org/dendrite/roomserver/internal/retention"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -31,6 +32,10 @@ type RoomserverInternalAPI struct {
 	*perform.Publisher
 	*perform.Backfiller
 	*perform.Forgetter
+	*perform.Upgrader
+	*perform.HistoryPurger
+	*perform.Admin
+	Purger                 *retention.Purger
 	DB                     storage.Database
 	Cfg                    *config.RoomServer
 	Producer               sarama.SyncProducer
@@ -48,7 +53,7 @@ func NewRoomserverAPI(
 	outputRoomEventTopic string, caches caching.RoomServerCaches,
 	keyRing gomatrixserverlib.JSONVerifier, perspectiveServerNames []gomatrixserverlib.ServerName,
 ) *RoomserverInternalAPI {
-	serverACLs := acls.NewServerACLs(roomserverDB)
+	serverACLs := acls.NewServerACLs(roomserverDB, cfg.Matrix.ServerName)
 	a := &RoomserverInternalAPI{
 		DB:                     roomserverDB,
 		Cfg:                    cfg,
@@ -62,6 +67,7 @@ func NewRoomserverAPI(
 			ServerACLs: serverACLs,
 		},
 		Inputer: &input.Inputer{
+			Cfg:                  cfg,
 			DB:                   roomserverDB,
 			OutputRoomEventTopic: outputRoomEventTopic,
 			Producer:             producer,
@@ -70,6 +76,18 @@ func NewRoomserverAPI(
 		},
 		// perform-er structs get initialised when we have a federation sender to use
 	}
+	a.HistoryPurger = &perform.HistoryPurger{
+		DB:      roomserverDB,
+		Inputer: a.Inputer,
+	}
+	if cfg.Retention.Enabled {
+		a.Purger = &retention.Purger{
+			DB:      roomserverDB,
+			Cfg:     cfg,
+			Inputer: a.Inputer,
+		}
+		a.Purger.Start()
+	}
 	return a
 }
 
@@ -117,6 +135,11 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 		FSAPI:   r.fsAPI,
 		Inputer: r.Inputer,
 	}
+	r.Admin = &perform.Admin{
+		DB:      r.DB,
+		Inputer: r.Inputer,
+		Leaver:  r.Leaver,
+	}
 	r.Publisher = &perform.Publisher{
 		DB: r.DB,
 	}
@@ -133,6 +156,12 @@ func (r *RoomserverInternalAPI) SetFederationSenderAPI(fsAPI fsAPI.FederationSen
 	r.Forgetter = &perform.Forgetter{
 		DB: r.DB,
 	}
+	r.Upgrader = &perform.Upgrader{
+		Cfg:     r.Cfg,
+		DB:      r.DB,
+		URSAPI:  r,
+		Inputer: r.Inputer,
+	}
 }
 
 func (r *RoomserverInternalAPI) SetAppserviceAPI(asAPI asAPI.AppServiceQueryAPI) {
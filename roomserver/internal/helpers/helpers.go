@@ -204,6 +204,23 @@ func LoadEvents(
 	return result, nil
 }
 
+// LoadTimelineEvents loads the given events, leaving out any which were
+// soft-failed, since those must not be served in a timeline.
+func LoadTimelineEvents(
+	ctx context.Context, db storage.Database, eventNIDs []types.EventNID,
+) ([]*gomatrixserverlib.Event, error) {
+	timelineEvents, err := db.TimelineEvents(ctx, eventNIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*gomatrixserverlib.Event, len(timelineEvents))
+	for i := range timelineEvents {
+		result[i] = timelineEvents[i].Event
+	}
+	return result, nil
+}
+
 func LoadStateEvents(
 	ctx context.Context, db storage.Database, stateEntries []types.StateEntry,
 ) ([]*gomatrixserverlib.Event, error) {
@@ -27,12 +27,15 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/acls"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/opentracing/opentracing-go"
 	log "github.com/sirupsen/logrus"
 	"go.uber.org/atomic"
 )
 
 type Inputer struct {
+	Cfg                  *config.RoomServer
 	DB                   storage.Database
 	Producer             sarama.SyncProducer
 	ServerName           gomatrixserverlib.ServerName
@@ -100,6 +103,10 @@ func (r *Inputer) WriteOutputEvents(roomID string, updates []api.OutputEvent) er
 				ev := updates[i].NewRoomEvent.Event.Unwrap()
 				defer r.ACLs.OnServerACLUpdate(ev)
 			}
+			if updates[i].NewRoomEvent.Event.Type() == gomatrixserverlib.MRoomJoinRules && updates[i].NewRoomEvent.Event.StateKeyEquals("") {
+				ev := updates[i].NewRoomEvent.Event.Unwrap()
+				defer r.onJoinRulesUpdate(ev)
+			}
 		}
 		logger.Infof("Producing to topic '%s'", r.OutputRoomEventTopic)
 		messages[i] = &sarama.ProducerMessage{
@@ -117,12 +124,28 @@ func (r *Inputer) WriteOutputEvents(roomID string, updates []api.OutputEvent) er
 	return errs
 }
 
+// onJoinRulesUpdate removes a room from the room directory when its join
+// rules stop it from being joined by anyone who finds it there.
+func (r *Inputer) onJoinRulesUpdate(ev *gomatrixserverlib.Event) {
+	joinRule, err := ev.JoinRule()
+	if err != nil || joinRule == gomatrixserverlib.Public {
+		return
+	}
+	if err = r.DB.PublishRoom(context.Background(), ev.RoomID(), false); err != nil {
+		log.WithError(err).WithField("room_id", ev.RoomID()).Error("Failed to remove room from the room directory")
+	}
+}
+
 // InputRoomEvents implements api.RoomserverInternalAPI
 func (r *Inputer) InputRoomEvents(
-	_ context.Context,
+	ctx context.Context,
 	request *api.InputRoomEventsRequest,
 	response *api.InputRoomEventsResponse,
 ) {
+	span, _ := opentracing.StartSpanFromContext(ctx, "roomserver.InputRoomEvents")
+	defer span.Finish()
+	span.SetTag("event_count", len(request.InputRoomEvents))
+
 	// Create a wait group. Each task that we dispatch will call Done on
 	// this wait group so that we know when all of our events have been
 	// processed.
@@ -149,9 +172,11 @@ func (r *Inputer) InputRoomEvents(
 
 		// Create a task. This contains the input event and a reference to
 		// the wait group, so that the worker can notify us when this specific
-		// task has been finished.
+		// task has been finished. The task doesn't inherit the caller's
+		// context, so that processing isn't cancelled with the request, but
+		// does carry our span so that the work is part of the same trace.
 		tasks[i] = &inputTask{
-			ctx:   context.Background(),
+			ctx:   opentracing.ContextWithSpan(context.Background(), span),
 			event: &request.InputRoomEvents[i],
 			wg:    wg,
 		}
@@ -173,6 +198,9 @@ func (r *Inputer) InputRoomEvents(
 			response.ErrMsg = task.err.Error()
 			_, rejected := task.err.(*gomatrixserverlib.NotAllowed)
 			response.NotAllowed = rejected
+			if e, ok := task.err.(gomatrixserverlib.EventValidationError); ok {
+				response.TooLarge = e.Code == gomatrixserverlib.EventValidationTooLarge
+			}
 			return
 		}
 	}
@@ -27,8 +27,10 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/state"
 	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
@@ -63,6 +65,11 @@ func (r *Inputer) processRoomEvent(
 	ctx context.Context,
 	input *api.InputRoomEvent,
 ) (eventID string, err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "roomserver.processRoomEvent")
+	defer span.Finish()
+	span.SetTag("room_id", input.Event.RoomID())
+	span.SetTag("event_id", input.Event.EventID())
+
 	// Measure how long it takes to process this event.
 	started := time.Now()
 	defer func() {
@@ -75,6 +82,28 @@ func (r *Inputer) processRoomEvent(
 	// Parse and validate the event JSON
 	headered := input.Event
 	event := headered.Unwrap()
+	if err = checkEventLimits(r.Cfg, event); err != nil {
+		return "", err
+	}
+
+	// Server admins can block room IDs before the rooms exist, in which case
+	// we mustn't start storing events for them. Rooms which we already know
+	// about carry on as normal for any remote users still in them.
+	blocked, err := r.DB.IsRoomBlocked(ctx, event.RoomID())
+	if err != nil {
+		return "", fmt.Errorf("r.DB.IsRoomBlocked: %w", err)
+	}
+	if blocked {
+		info, err2 := r.DB.RoomInfo(ctx, event.RoomID())
+		if err2 != nil {
+			return "", fmt.Errorf("r.DB.RoomInfo: %w", err2)
+		}
+		if info == nil || info.IsStub {
+			return "", &gomatrixserverlib.NotAllowed{
+				Message: fmt.Sprintf("Room %q has been blocked by the server admins", event.RoomID()),
+			}
+		}
+	}
 
 	// if we have already got this event then do not process it again, if the input kind is an outlier.
 	// Outliers contain no extra information which may warrant a re-processing.
@@ -134,7 +163,7 @@ func (r *Inputer) processRoomEvent(
 	}
 
 	// Store the event.
-	_, stateAtEvent, redactionEvent, redactedEventID, err := r.DB.StoreEvent(ctx, event, input.TransactionID, authEventNIDs, isRejected)
+	_, stateAtEvent, redactionEvent, redactedEventID, err := r.DB.StoreEvent(ctx, event, input.TransactionID, authEventNIDs, isRejected, softfail)
 	if err != nil {
 		return "", fmt.Errorf("r.DB.StoreEvent: %w", err)
 	}
@@ -289,3 +318,35 @@ func (r *Inputer) calculateAndSetState(
 	}
 	return nil
 }
+
+// maxDepth is the largest depth an event can have, which is the largest
+// integer allowed in canonical JSON.
+const maxDepth = 1<<53 - 1
+
+// checkEventLimits rejects events which are too big to store, or which refer
+// to so many other events that they can only have been crafted to cause
+// trouble, with a gomatrixserverlib.EventValidationError. Events with an
+// impossible depth are not allowed.
+func checkEventLimits(cfg *config.RoomServer, event *gomatrixserverlib.Event) error {
+	tooLarge := func(format string, args ...interface{}) error {
+		return gomatrixserverlib.EventValidationError{
+			Code:    gomatrixserverlib.EventValidationTooLarge,
+			Message: fmt.Sprintf("event %s: "+format, append([]interface{}{event.EventID()}, args...)...),
+		}
+	}
+	if size := len(event.JSON()); size > cfg.MaxEventSize {
+		return tooLarge("event is too large, %d bytes > maximum %d", size, cfg.MaxEventSize)
+	}
+	if count := len(event.PrevEventIDs()); count > cfg.MaxPrevEvents {
+		return tooLarge("too many prev_events, %d > maximum %d", count, cfg.MaxPrevEvents)
+	}
+	if count := len(event.AuthEventIDs()); count > cfg.MaxAuthEvents {
+		return tooLarge("too many auth_events, %d > maximum %d", count, cfg.MaxAuthEvents)
+	}
+	if depth := event.Depth(); depth < 0 || depth > maxDepth {
+		return &gomatrixserverlib.NotAllowed{
+			Message: fmt.Sprintf("event %s: invalid depth %d", event.EventID(), depth),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+type Admin struct {
+	DB      storage.Database
+	Inputer *input.Inputer
+	Leaver  *Leaver
+}
+
+// PerformAdminEvacuateRoom implements api.RoomserverInternalAPI
+func (r *Admin) PerformAdminEvacuateRoom(
+	ctx context.Context,
+	req *api.PerformAdminEvacuateRoomRequest,
+	res *api.PerformAdminEvacuateRoomResponse,
+) error {
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %s not found", req.RoomID),
+		}
+		return nil
+	}
+	if req.Block {
+		// Block the room first, so that nobody can join again while we're
+		// making everyone leave.
+		if err = r.DB.BlockRoom(ctx, req.RoomID); err != nil {
+			return fmt.Errorf("r.DB.BlockRoom: %w", err)
+		}
+	}
+
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, info.RoomNID, false, true)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetMembershipEventNIDsForRoom: %w", err)
+	}
+	memberEvents, err := r.DB.Events(ctx, memberNIDs)
+	if err != nil {
+		return fmt.Errorf("r.DB.Events: %w", err)
+	}
+	for _, memberEvent := range memberEvents {
+		if memberEvent.StateKey() == nil {
+			continue
+		}
+		userID := *memberEvent.StateKey()
+		logger := logrus.WithFields(logrus.Fields{
+			"room_id": req.RoomID,
+			"user_id": userID,
+		})
+		membership, err := memberEvent.Membership()
+		if err != nil {
+			continue
+		}
+		if membership == gomatrixserverlib.Join || membership == gomatrixserverlib.Invite {
+			outputEvents, err := r.Leaver.PerformLeave(ctx, &api.PerformLeaveRequest{
+				RoomID: req.RoomID,
+				UserID: userID,
+			}, &api.PerformLeaveResponse{})
+			if err != nil {
+				// carry on with everyone else, the admin can try again
+				logger.WithError(err).Error("Failed to make user leave room")
+				continue
+			}
+			if len(outputEvents) > 0 {
+				if err = r.Inputer.WriteOutputEvents(req.RoomID, outputEvents); err != nil {
+					logger.WithError(err).Error("Failed to write output events")
+				}
+			}
+			res.Affected = append(res.Affected, userID)
+		}
+		if req.Forget {
+			if err = r.DB.ForgetRoom(ctx, userID, req.RoomID, true); err != nil {
+				logger.WithError(err).Error("Failed to forget room")
+			}
+		}
+	}
+	return nil
+}
+
+// PerformAdminBlockRoom implements api.RoomserverInternalAPI
+func (r *Admin) PerformAdminBlockRoom(
+	ctx context.Context,
+	req *api.PerformAdminBlockRoomRequest,
+	res *api.PerformAdminBlockRoomResponse,
+) error {
+	// The room doesn't have to exist yet: blocking a room ID in advance stops
+	// it from being created or joined over federation later.
+	if _, _, err := gomatrixserverlib.SplitID('!', req.RoomID); err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("Room ID %q is invalid: %s", req.RoomID, err),
+		}
+		return nil
+	}
+	if req.Block {
+		if err := r.DB.BlockRoom(ctx, req.RoomID); err != nil {
+			return fmt.Errorf("r.DB.BlockRoom: %w", err)
+		}
+		return nil
+	}
+	if err := r.DB.UnblockRoom(ctx, req.RoomID); err != nil {
+		return fmt.Errorf("r.DB.UnblockRoom: %w", err)
+	}
+	return nil
+}
@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
 	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -35,6 +36,9 @@ import (
 // as we try dead servers.
 const maxBackfillServers = 5
 
+// the max number of events to return to another server's backfill request, whatever limit they asked for.
+const maxBackfillLimit = 100
+
 type Backfiller struct {
 	ServerName gomatrixserverlib.ServerName
 	DB         storage.Database
@@ -76,15 +80,25 @@ func (r *Backfiller) PerformBackfill(
 		return fmt.Errorf("PerformBackfill: missing room info for room %s", request.RoomID)
 	}
 
+	limit := request.Limit
+	if limit > maxBackfillLimit {
+		limit = maxBackfillLimit
+	}
+
+	// The event tree scan only checks whether the server may see the events that it
+	// walks back to, so check the events that it starts from here.
+	front = r.eventsServerCanSee(ctx, *info, request.RoomID, front, request.ServerName)
+
 	// Scan the event tree for events to send back.
-	resultNIDs, err := helpers.ScanEventTree(ctx, r.DB, *info, front, visited, request.Limit, request.ServerName)
+	resultNIDs, err := helpers.ScanEventTree(ctx, r.DB, *info, front, visited, limit, request.ServerName)
 	if err != nil {
 		return err
 	}
 
-	// Retrieve events from the list that was filled previously.
+	// Retrieve events from the list that was filled previously. Soft-failed
+	// events are left out, as they must not appear in the timeline.
 	var loadedEvents []*gomatrixserverlib.Event
-	loadedEvents, err = helpers.LoadEvents(ctx, r.DB, resultNIDs)
+	loadedEvents, err = helpers.LoadTimelineEvents(ctx, r.DB, resultNIDs)
 	if err != nil {
 		return err
 	}
@@ -96,6 +110,32 @@ func (r *Backfiller) PerformBackfill(
 	return err
 }
 
+// eventsServerCanSee returns the event IDs which the server is allowed to see according
+// to the history visibility of the room at each event. Events which we don't have the
+// state for are left out.
+func (r *Backfiller) eventsServerCanSee(
+	ctx context.Context, info types.RoomInfo, roomID string, eventIDs []string, serverName gomatrixserverlib.ServerName,
+) []string {
+	isServerInRoom, err := helpers.IsServerCurrentlyInRoom(ctx, r.DB, serverName, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to check if server is currently in room, assuming not.")
+	}
+	allowedIDs := make([]string, 0, len(eventIDs))
+	for _, eventID := range eventIDs {
+		logger := util.GetLogger(ctx).WithField("server", serverName).WithField("event_id", eventID)
+		allowed, err := helpers.CheckServerAllowedToSeeEvent(ctx, r.DB, info, eventID, serverName, isServerInRoom)
+		switch {
+		case err != nil:
+			logger.WithError(err).Error("Error checking if allowed to see event")
+		case !allowed:
+			logger.Info("Not allowed to see event")
+		default:
+			allowedIDs = append(allowedIDs, eventID)
+		}
+	}
+	return allowedIDs
+}
+
 func (r *Backfiller) backfillViaFederation(ctx context.Context, req *api.PerformBackfillRequest, res *api.PerformBackfillResponse) error {
 	info, err := r.DB.RoomInfo(ctx, req.RoomID)
 	if err != nil {
@@ -544,14 +584,23 @@ func joinEventsFromHistoryVisibility(
 	return db.Events(ctx, joinEventNIDs)
 }
 
+// persistEvents stores the backfilled events. Where the database supports it,
+// the event JSON of the events is imported in bulk rather than being stored
+// with each event.
 func persistEvents(ctx context.Context, db storage.Database, events []*gomatrixserverlib.HeaderedEvent) (types.RoomNID, map[string]types.Event) {
 	var roomNID types.RoomNID
 	backfilledEventMap := make(map[string]types.Event)
-	for j, ev := range events {
+	bulkImport := db.SupportsBulkEventJSONImport()
+	var eventJSON []tables.EventJSONPair
+	// Redactions can't be applied to events until their JSON has been stored,
+	// so when importing in bulk, redaction events are stored once it has been.
+	var redactions []int
+	store := func(j int, withJSON bool) {
+		ev := events[j]
 		nidMap, err := db.EventNIDs(ctx, ev.AuthEventIDs())
 		if err != nil { // this shouldn't happen as RequestBackfill already found them
 			logrus.WithError(err).WithField("auth_events", ev.AuthEventIDs()).Error("Failed to find one or more auth events")
-			continue
+			return
 		}
 		authNids := make([]types.EventNID, len(nidMap))
 		i := 0
@@ -562,10 +611,14 @@ func persistEvents(ctx context.Context, db storage.Database, events []*gomatrixs
 		var stateAtEvent types.StateAtEvent
 		var redactedEventID string
 		var redactionEvent *gomatrixserverlib.Event
-		roomNID, stateAtEvent, redactionEvent, redactedEventID, err = db.StoreEvent(ctx, ev.Unwrap(), nil, authNids, false)
+		if withJSON {
+			roomNID, stateAtEvent, redactionEvent, redactedEventID, err = db.StoreEvent(ctx, ev.Unwrap(), nil, authNids, false, false)
+		} else {
+			roomNID, stateAtEvent, redactionEvent, redactedEventID, err = db.StoreEventWithoutJSON(ctx, ev.Unwrap(), authNids)
+		}
 		if err != nil {
 			logrus.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to persist event")
-			continue
+			return
 		}
 		// If storing this event results in it being redacted, then do so.
 		// It's also possible for this event to be a redaction which results in another event being
@@ -575,15 +628,40 @@ func persistEvents(ctx context.Context, db storage.Database, events []*gomatrixs
 			redactedEvent, err := eventutil.RedactEvent(redactionEvent, eventToRedact)
 			if err != nil {
 				logrus.WithError(err).WithField("event_id", ev.EventID()).Error("Failed to redact event")
-				continue
+				return
 			}
 			ev = redactedEvent.Headered(ev.RoomVersion)
 			events[j] = ev
 		}
+		if !withJSON {
+			eventJSON = append(eventJSON, tables.EventJSONPair{
+				EventNID:    stateAtEvent.StateEntry.EventNID,
+				RoomVersion: ev.RoomVersion,
+				EventJSON:   ev.JSON(),
+			})
+		}
 		backfilledEventMap[ev.EventID()] = types.Event{
 			EventNID: stateAtEvent.StateEntry.EventNID,
 			Event:    ev.Unwrap(),
 		}
 	}
+	for j, ev := range events {
+		if bulkImport && ev.Type() == gomatrixserverlib.MRoomRedaction && ev.StateKey() == nil {
+			redactions = append(redactions, j)
+			continue
+		}
+		store(j, !bulkImport)
+	}
+	if len(eventJSON) > 0 {
+		if err := db.BulkImportEventJSON(ctx, eventJSON); err != nil {
+			// None of the events stored so far can be loaded without their
+			// JSON, so don't return them.
+			logrus.WithError(err).Error("Failed to import event JSON")
+			backfilledEventMap = make(map[string]types.Event)
+		}
+	}
+	for _, j := range redactions {
+		store(j, true)
+	}
 	return roomNID, backfilledEventMap
 }
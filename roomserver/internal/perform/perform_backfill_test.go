@@ -0,0 +1,154 @@
+package perform
+
+import (
+	"context"
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// bulkImportDB records the event JSON which is imported in bulk.
+type bulkImportDB struct {
+	storage.Database
+	imported []tables.EventJSONPair
+}
+
+func (d *bulkImportDB) BulkImportEventJSON(ctx context.Context, pairs []tables.EventJSONPair) error {
+	d.imported = append(d.imported, pairs...)
+	return d.Database.BulkImportEventJSON(ctx, pairs)
+}
+
+func mustOpenTestDB(t *testing.T) storage.Database {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dendrite-backfill")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.RoomServer.Database = config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "roomserver.db")),
+	}
+	cache, err := caching.NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	db, err := storage.Open(&cfg.RoomServer, cache)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	return db
+}
+
+func mustCreateBackfillEvents(t *testing.T) []*gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	const (
+		roomID = "!backfill:localhost"
+		alice  = "@alice:localhost"
+	)
+	roomVer := gomatrixserverlib.RoomVersionV6
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	emptyKey, aliceKey := "", alice
+	var events []*gomatrixserverlib.HeaderedEvent
+	var authEvents []string
+	for i, b := range []struct {
+		evType   string
+		stateKey *string
+		content  map[string]interface{}
+		redacts  int
+	}{
+		{gomatrixserverlib.MRoomCreate, &emptyKey, map[string]interface{}{"creator": alice, "room_version": "6"}, -1},
+		{gomatrixserverlib.MRoomMember, &aliceKey, map[string]interface{}{"membership": "join"}, -1},
+		{"m.room.message", nil, map[string]interface{}{"body": "redacted"}, -1},
+		{gomatrixserverlib.MRoomRedaction, nil, map[string]interface{}{}, 2},
+		{"m.room.message", nil, map[string]interface{}{"body": "kept"}, -1},
+	} {
+		eb := gomatrixserverlib.EventBuilder{
+			Sender:     alice,
+			RoomID:     roomID,
+			Type:       b.evType,
+			StateKey:   b.stateKey,
+			Depth:      int64(i + 1),
+			AuthEvents: authEvents,
+		}
+		if len(events) > 0 {
+			eb.PrevEvents = []string{events[len(events)-1].EventID()}
+		}
+		if b.redacts >= 0 {
+			eb.Redacts = events[b.redacts].EventID()
+		}
+		if err := eb.SetContent(b.content); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", key, roomVer)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		if b.stateKey != nil {
+			authEvents = append(authEvents, ev.EventID())
+		}
+		events = append(events, ev.Headered(roomVer))
+	}
+	return events
+}
+
+func TestPersistEventsBulkImport(t *testing.T) {
+	ctx := context.Background()
+	db := &bulkImportDB{Database: mustOpenTestDB(t)}
+	if !db.SupportsBulkEventJSONImport() {
+		t.Fatalf("expected SQLite to import event JSON in bulk")
+	}
+	events := mustCreateBackfillEvents(t)
+
+	_, backfilled := persistEvents(ctx, db, events)
+	if len(backfilled) != len(events) {
+		t.Fatalf("got %d backfilled events, want %d", len(backfilled), len(events))
+	}
+	// Everything but the redaction is imported in bulk.
+	if len(db.imported) != len(events)-1 {
+		t.Errorf("got %d events imported in bulk, want %d", len(db.imported), len(events)-1)
+	}
+
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	stored, err := db.EventsFromIDs(ctx, eventIDs)
+	if err != nil {
+		t.Fatalf("EventsFromIDs failed: %s", err)
+	}
+	if len(stored) != len(events) {
+		t.Fatalf("got %d stored events, want %d", len(stored), len(events))
+	}
+	for _, ev := range stored {
+		if backfilled[ev.EventID()].EventNID != ev.EventNID {
+			t.Errorf("event %s: got event NID %d, want %d", ev.EventID(), backfilled[ev.EventID()].EventNID, ev.EventNID)
+		}
+		body := gjson.GetBytes(ev.Content(), "body")
+		switch ev.EventID() {
+		case events[2].EventID():
+			// The redaction was stored after the event JSON was imported, so
+			// it was applied.
+			if body.Exists() {
+				t.Errorf("expected redacted event to have been redacted, got %s", ev.JSON())
+			}
+		case events[4].EventID():
+			if body.String() != "kept" {
+				t.Errorf("got event JSON %s", ev.JSON())
+			}
+		}
+	}
+}
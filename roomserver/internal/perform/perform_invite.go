@@ -66,6 +66,22 @@ func (r *Inviter) PerformInvite(
 	isTargetLocal := domain == r.Cfg.Matrix.ServerName
 	isOriginLocal := event.Origin() == r.Cfg.Matrix.ServerName
 
+	if isTargetLocal {
+		// Local users can't join blocked rooms, so there's no point in
+		// accepting invites to them either.
+		blocked, err := r.DB.IsRoomBlocked(ctx, roomID)
+		if err != nil {
+			return nil, fmt.Errorf("r.DB.IsRoomBlocked: %w", err)
+		}
+		if blocked {
+			res.Error = &api.PerformError{
+				Code: api.PerformErrorNotAllowed,
+				Msg:  fmt.Sprintf("Room %q has been blocked by the server admins", roomID),
+			}
+			return nil, nil
+		}
+	}
+
 	inviteState := req.InviteRoomState
 	if len(inviteState) == 0 && info != nil {
 		var is []gomatrixserverlib.InviteV2StrippedState
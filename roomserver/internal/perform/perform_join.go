@@ -16,6 +16,7 @@ package perform
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -172,6 +173,19 @@ func (r *Joiner) performJoinRoomByID(
 		}
 	}
 
+	// Server admins can stop local users joining a room, e.g. after
+	// evacuating an abusive room.
+	blocked, err := r.DB.IsRoomBlocked(ctx, req.RoomIDOrAlias)
+	if err != nil {
+		return "", "", fmt.Errorf("r.DB.IsRoomBlocked: %w", err)
+	}
+	if blocked {
+		return "", "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("Room %q has been blocked by the server admins", req.RoomIDOrAlias),
+		}
+	}
+
 	// If the server name in the room ID isn't ours then it's a
 	// possible candidate for finding the room via federation. Add
 	// it to the list of servers to try.
@@ -208,6 +222,15 @@ func (r *Joiner) performJoinRoomByID(
 	serverInRoom, _ := helpers.IsServerCurrentlyInRoom(ctx, r.DB, r.ServerName, req.RoomIDOrAlias)
 	forceFederatedJoin := len(req.ServerNames) > 0 && !serverInRoom
 
+	// Guests can only join rooms that allow guest access. We can't check
+	// that for rooms which we aren't in yet, so guests can't join those.
+	if req.IsGuest && (!serverInRoom || !r.guestCanJoin(ctx, req.RoomIDOrAlias)) {
+		return "", "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "Guest access is not allowed in this room",
+		}
+	}
+
 	// Force a federated join if we're dealing with a pending invite
 	// and we aren't in the room.
 	isInvitePending, inviteSender, _, err := helpers.IsInvitePending(ctx, r.DB, req.RoomIDOrAlias, req.UserID)
@@ -310,6 +333,20 @@ func (r *Joiner) performJoinRoomByID(
 	return req.RoomIDOrAlias, r.Cfg.Matrix.ServerName, nil
 }
 
+// guestCanJoin returns whether the m.room.guest_access state of the room
+// allows guests to join it.
+func (r *Joiner) guestCanJoin(ctx context.Context, roomID string) bool {
+	ev, err := r.DB.GetStateEvent(ctx, roomID, "m.room.guest_access", "")
+	if err != nil || ev == nil {
+		return false
+	}
+	var content eventutil.GuestAccessContent
+	if err = json.Unmarshal(ev.Content(), &content); err != nil {
+		return false
+	}
+	return content.GuestAccess == "can_join"
+}
+
 func (r *Joiner) performFederatedJoinRoomByID(
 	ctx context.Context,
 	req *api.PerformJoinRequest,
@@ -0,0 +1,138 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// HistoryPurger purges the old history of rooms when asked to by a server admin.
+// Purges run in the background, and their status is only kept in memory.
+type HistoryPurger struct {
+	DB      storage.Database
+	Inputer *input.Inputer
+
+	mu     sync.Mutex
+	purges map[string]*api.QueryPurgeHistoryStatusResponse
+}
+
+// PerformPurgeHistory implements api.RoomserverInternalAPI
+func (p *HistoryPurger) PerformPurgeHistory(
+	ctx context.Context,
+	req *api.PerformPurgeHistoryRequest,
+	res *api.PerformPurgeHistoryResponse,
+) error {
+	if (req.BeforeEventID == "") == (req.BeforeTS == 0) {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  "Exactly one of an event ID or a timestamp must be given",
+		}
+		return nil
+	}
+	info, err := p.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("p.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %s not found", req.RoomID),
+		}
+		return nil
+	}
+	before := req.BeforeTS
+	if req.BeforeEventID != "" {
+		events, err := p.DB.EventsFromIDs(ctx, []string{req.BeforeEventID})
+		if err != nil {
+			return fmt.Errorf("p.DB.EventsFromIDs: %w", err)
+		}
+		if len(events) == 0 || events[0].RoomID() != req.RoomID {
+			res.Error = &api.PerformError{
+				Code: api.PerformErrorNoRoom,
+				Msg:  fmt.Sprintf("Event %s not found in room %s", req.BeforeEventID, req.RoomID),
+			}
+			return nil
+		}
+		before = events[0].OriginServerTS()
+	}
+
+	res.PurgeID = util.RandomString(16)
+	status := &api.QueryPurgeHistoryStatusResponse{
+		Exists: true,
+		Status: api.PurgeHistoryStatusActive,
+	}
+	p.mu.Lock()
+	if p.purges == nil {
+		p.purges = make(map[string]*api.QueryPurgeHistoryStatusResponse)
+	}
+	p.purges[res.PurgeID] = status
+	p.mu.Unlock()
+
+	go p.purge(req.RoomID, before, status)
+	return nil
+}
+
+func (p *HistoryPurger) purge(roomID string, before gomatrixserverlib.Timestamp, status *api.QueryPurgeHistoryStatusResponse) {
+	logger := logrus.WithField("room_id", roomID)
+	eventIDs, err := p.DB.PurgeHistory(context.Background(), roomID, before, true, false)
+	if err == nil && len(eventIDs) > 0 {
+		// the events have gone from the roomserver, so also remove them from
+		// downstream components so they aren't served to clients any more
+		err = p.Inputer.WriteOutputEvents(roomID, []api.OutputEvent{
+			{
+				Type: api.OutputTypePurgedEvents,
+				PurgedEvents: &api.OutputPurgedEvents{
+					RoomID:   roomID,
+					EventIDs: eventIDs,
+				},
+			},
+		})
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status.PurgedEvents = len(eventIDs)
+	if err != nil {
+		logger.WithError(err).Error("Failed to purge history")
+		status.Status = api.PurgeHistoryStatusFailed
+		status.Error = err.Error()
+		return
+	}
+	logger.WithField("events", len(eventIDs)).Info("Purged history")
+	status.Status = api.PurgeHistoryStatusComplete
+}
+
+// QueryPurgeHistoryStatus implements api.RoomserverInternalAPI
+func (p *HistoryPurger) QueryPurgeHistoryStatus(
+	ctx context.Context,
+	req *api.QueryPurgeHistoryStatusRequest,
+	res *api.QueryPurgeHistoryStatusResponse,
+) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if status, ok := p.purges[req.PurgeID]; ok {
+		*res = *status
+	}
+	return nil
+}
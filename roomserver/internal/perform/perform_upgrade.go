@@ -0,0 +1,500 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/helpers"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// The state event types which are copied from the old room into the
+// replacement room when a room is upgraded. The power levels are handled
+// separately, as they need to be relaxed until the rest has been copied.
+var upgradeTransferableStateTypes = []string{
+	gomatrixserverlib.MRoomJoinRules,
+	gomatrixserverlib.MRoomHistoryVisibility,
+	"m.room.guest_access",
+	gomatrixserverlib.MRoomName,
+	"m.room.topic",
+	"m.room.avatar",
+	"m.room.encryption",
+	"m.room.server_acl",
+	"m.room.related_groups",
+	gomatrixserverlib.MRoomCanonicalAlias,
+}
+
+type Upgrader struct {
+	Cfg    *config.RoomServer
+	DB     storage.Database
+	URSAPI api.RoomserverInternalAPI
+
+	Inputer *input.Inputer
+}
+
+// PerformRoomUpgrade replaces a room with a new room of the requested
+// version, copying over its state, tombstoning the old room and inviting
+// its members into the new one.
+func (r *Upgrader) PerformRoomUpgrade(
+	ctx context.Context,
+	req *api.PerformRoomUpgradeRequest,
+	res *api.PerformRoomUpgradeResponse,
+) {
+	res.NewRoomID, res.Error = r.performRoomUpgrade(ctx, req)
+	if res.Error != nil {
+		res.NewRoomID = ""
+	}
+}
+
+func (r *Upgrader) performRoomUpgrade(
+	ctx context.Context,
+	req *api.PerformRoomUpgradeRequest,
+) (string, *api.PerformError) {
+	if _, err := version.SupportedRoomVersion(req.RoomVersion); err != nil {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  err.Error(),
+		}
+	}
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil || domain != r.Cfg.Matrix.ServerName {
+		return "", &api.PerformError{
+			Code: api.PerformErrorBadRequest,
+			Msg:  fmt.Sprintf("User %q does not belong to this homeserver", req.UserID),
+		}
+	}
+
+	// Load the current state of the old room.
+	oldState := api.QueryLatestEventsAndStateResponse{}
+	if err = helpers.QueryLatestEventsAndState(ctx, r.DB, &api.QueryLatestEventsAndStateRequest{
+		RoomID: req.RoomID,
+	}, &oldState); err != nil {
+		return "", &api.PerformError{Msg: fmt.Sprintf("QueryLatestEventsAndState: %s", err)}
+	}
+	if !oldState.RoomExists {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %q does not exist", req.RoomID),
+		}
+	}
+	state := make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent, len(oldState.StateEvents))
+	for _, ev := range oldState.StateEvents {
+		state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+	}
+
+	// Only a joined user with the power to tombstone the room may upgrade it.
+	memberEvent := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: req.UserID}]
+	if memberEvent == nil {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "You are not joined to the room",
+		}
+	}
+	if membership, merr := memberEvent.Membership(); merr != nil || membership != gomatrixserverlib.Join {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "You are not joined to the room",
+		}
+	}
+	var powerLevels gomatrixserverlib.PowerLevelContent
+	powerLevelsEvent := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]
+	if powerLevelsEvent != nil {
+		if powerLevels, err = gomatrixserverlib.NewPowerLevelContentFromEvent(powerLevelsEvent.Event); err != nil {
+			return "", &api.PerformError{Msg: fmt.Sprintf("gomatrixserverlib.NewPowerLevelContentFromEvent: %s", err)}
+		}
+	} else {
+		powerLevels.Defaults()
+	}
+	if powerLevels.UserLevel(req.UserID) < powerLevels.EventLevel("m.room.tombstone", true) {
+		return "", &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "You don't have permission to upgrade the room",
+		}
+	}
+
+	newRoomID := fmt.Sprintf("!%s:%s", util.RandomString(16), r.Cfg.Matrix.ServerName)
+
+	// Build the tombstone first, so that the new room can name it as the
+	// last event of its predecessor. It is only sent once the new room exists.
+	tombstone, err := r.buildOldRoomEvent(ctx, req, "m.room.tombstone", map[string]interface{}{
+		"body":             "This room has been replaced",
+		"replacement_room": newRoomID,
+	})
+	if err != nil {
+		return "", &api.PerformError{Msg: fmt.Sprintf("failed to build tombstone: %s", err)}
+	}
+
+	newEvents, err := r.buildReplacementRoom(req, newRoomID, tombstone.EventID(), state, powerLevels)
+	if err != nil {
+		return "", &api.PerformError{Msg: fmt.Sprintf("failed to build replacement room: %s", err)}
+	}
+	if err = r.input(ctx, newEvents); err != nil {
+		return "", &api.PerformError{Msg: fmt.Sprintf("failed to create replacement room: %s", err)}
+	}
+	if err = r.input(ctx, []*gomatrixserverlib.HeaderedEvent{tombstone}); err != nil {
+		return "", &api.PerformError{Msg: fmt.Sprintf("failed to send tombstone: %s", err)}
+	}
+
+	// The replacement room exists by now, so the rest is best effort.
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":     req.RoomID,
+		"new_room_id": newRoomID,
+	})
+	if err = r.restrictOldRoom(ctx, req, state, powerLevels); err != nil {
+		logger.WithError(err).Warn("Failed to restrict the power levels of the old room")
+	}
+	if err = r.moveAliasesAndDirectory(ctx, req.RoomID, newRoomID); err != nil {
+		logger.WithError(err).Warn("Failed to move the aliases of the old room")
+	}
+	r.inviteMembers(ctx, req, newRoomID, state)
+
+	return newRoomID, nil
+}
+
+// buildReplacementRoom builds the events which create the new room, in order.
+// While the state of the old room is copied, the upgrading user is given
+// enough power to send any of it, and the original power levels are then
+// restored.
+func (r *Upgrader) buildReplacementRoom(
+	req *api.PerformRoomUpgradeRequest, newRoomID, tombstoneEventID string,
+	state map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent,
+	powerLevels gomatrixserverlib.PowerLevelContent,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	type fledglingEvent struct {
+		Type     string
+		StateKey string
+		Content  interface{}
+	}
+
+	createContent := map[string]interface{}{}
+	if createEvent := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}]; createEvent != nil {
+		if err := json.Unmarshal(createEvent.Content(), &createContent); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+	createContent["creator"] = req.UserID
+	createContent["room_version"] = req.RoomVersion
+	createContent["predecessor"] = map[string]interface{}{
+		"room_id":  req.RoomID,
+		"event_id": tombstoneEventID,
+	}
+
+	// Work out the highest power level needed to send the copied state,
+	// including banning users who had power of their own.
+	needed := powerLevels.EventLevel(gomatrixserverlib.MRoomPowerLevels, true)
+	for _, level := range []int64{powerLevels.StateDefault, powerLevels.Ban} {
+		if level > needed {
+			needed = level
+		}
+	}
+	for tuple, ev := range state {
+		if tuple.EventType != gomatrixserverlib.MRoomMember {
+			if level := powerLevels.EventLevel(tuple.EventType, true); level > needed {
+				needed = level
+			}
+		} else if membership, err := ev.Membership(); err == nil && membership == gomatrixserverlib.Ban {
+			if level := powerLevels.UserLevel(tuple.StateKey) + 1; level > needed {
+				needed = level
+			}
+		}
+	}
+	// The power levels are copied as raw JSON where possible, so that none
+	// of their fields are lost.
+	var finalPowerLevels interface{} = powerLevels
+	if powerLevelsEvent := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]; powerLevelsEvent != nil {
+		finalPowerLevels = json.RawMessage(powerLevelsEvent.Content())
+	}
+	var initialPowerLevels interface{} = finalPowerLevels
+	raised := powerLevels.UserLevel(req.UserID) < needed
+	if raised {
+		content := map[string]interface{}{}
+		raw, err := json.Marshal(finalPowerLevels)
+		if err != nil {
+			return nil, fmt.Errorf("json.Marshal: %w", err)
+		}
+		if err = json.Unmarshal(raw, &content); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+		users, _ := content["users"].(map[string]interface{})
+		if users == nil {
+			users = map[string]interface{}{}
+		}
+		users[req.UserID] = needed
+		content["users"] = users
+		initialPowerLevels = content
+	}
+
+	memberContent := map[string]interface{}{}
+	if memberEvent := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: req.UserID}]; memberEvent != nil {
+		_ = json.Unmarshal(memberEvent.Content(), &memberContent)
+	}
+	memberContent["membership"] = gomatrixserverlib.Join
+
+	eventsToMake := []fledglingEvent{
+		{gomatrixserverlib.MRoomCreate, "", createContent},
+		{gomatrixserverlib.MRoomMember, req.UserID, memberContent},
+		{gomatrixserverlib.MRoomPowerLevels, "", initialPowerLevels},
+	}
+	for _, eventType := range upgradeTransferableStateTypes {
+		if ev := state[gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: ""}]; ev != nil {
+			eventsToMake = append(eventsToMake, fledglingEvent{eventType, "", json.RawMessage(ev.Content())})
+		}
+	}
+	for tuple, ev := range state {
+		if tuple.EventType != gomatrixserverlib.MRoomMember {
+			continue
+		}
+		if membership, err := ev.Membership(); err == nil && membership == gomatrixserverlib.Ban {
+			eventsToMake = append(eventsToMake, fledglingEvent{
+				gomatrixserverlib.MRoomMember, tuple.StateKey,
+				map[string]interface{}{"membership": gomatrixserverlib.Ban},
+			})
+		}
+	}
+	if raised {
+		eventsToMake = append(eventsToMake, fledglingEvent{gomatrixserverlib.MRoomPowerLevels, "", finalPowerLevels})
+	}
+
+	evTime := time.Now()
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	builtEvents := make([]*gomatrixserverlib.HeaderedEvent, 0, len(eventsToMake))
+	for i, e := range eventsToMake {
+		stateKey := e.StateKey
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   req.UserID,
+			RoomID:   newRoomID,
+			Type:     e.Type,
+			StateKey: &stateKey,
+			Depth:    int64(i + 1), // depth starts at 1
+		}
+		if err := builder.SetContent(e.Content); err != nil {
+			return nil, fmt.Errorf("builder.SetContent: %w", err)
+		}
+		if i > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[i-1].EventReference()}
+		}
+		eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
+		}
+		if builder.AuthEvents, err = eventsNeeded.AuthEventReferences(&authEvents); err != nil {
+			return nil, fmt.Errorf("eventsNeeded.AuthEventReferences: %w", err)
+		}
+		ev, err := builder.Build(
+			evTime, r.Cfg.Matrix.ServerName, r.Cfg.Matrix.KeyID,
+			r.Cfg.Matrix.PrivateKey, req.RoomVersion,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("builder.Build %s: %w", e.Type, err)
+		}
+		if err = gomatrixserverlib.Allowed(ev, &authEvents); err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.Allowed %s: %w", e.Type, err)
+		}
+		if err = authEvents.AddEvent(ev); err != nil {
+			return nil, fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+		builtEvents = append(builtEvents, ev.Headered(req.RoomVersion))
+	}
+	return builtEvents, nil
+}
+
+// restrictOldRoom stops users without elevated power from sending messages
+// or inviting others into the old room, if the upgrading user is allowed to.
+// The content of the old power levels is edited directly, so that none of
+// its other fields are lost.
+func (r *Upgrader) restrictOldRoom(
+	ctx context.Context, req *api.PerformRoomUpgradeRequest,
+	state map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent,
+	powerLevels gomatrixserverlib.PowerLevelContent,
+) error {
+	if powerLevels.UserLevel(req.UserID) < powerLevels.EventLevel(gomatrixserverlib.MRoomPowerLevels, true) {
+		return nil
+	}
+	content := map[string]interface{}{}
+	if powerLevelsEvent := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]; powerLevelsEvent != nil {
+		if err := json.Unmarshal(powerLevelsEvent.Content(), &content); err != nil {
+			return fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+	restricted := powerLevels.UsersDefault + 1
+	if restricted < 50 {
+		restricted = 50
+	}
+	changed := false
+	for _, key := range []string{"events_default", "invite"} {
+		if level, ok := content[key].(float64); !ok || int64(level) < restricted {
+			content[key] = restricted
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	ev, err := r.buildOldRoomEvent(ctx, req, gomatrixserverlib.MRoomPowerLevels, content)
+	if err != nil {
+		return err
+	}
+	return r.input(ctx, []*gomatrixserverlib.HeaderedEvent{ev})
+}
+
+// moveAliasesAndDirectory points the local aliases of the old room at the
+// new room, and replaces the old room in the room directory.
+func (r *Upgrader) moveAliasesAndDirectory(ctx context.Context, oldRoomID, newRoomID string) error {
+	aliases, err := r.DB.GetAliasesForRoomID(ctx, oldRoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetAliasesForRoomID: %w", err)
+	}
+	for _, alias := range aliases {
+		creator, err := r.DB.GetCreatorIDForAlias(ctx, alias)
+		if err != nil {
+			return fmt.Errorf("r.DB.GetCreatorIDForAlias: %w", err)
+		}
+		if err = r.DB.RemoveRoomAlias(ctx, alias); err != nil {
+			return fmt.Errorf("r.DB.RemoveRoomAlias: %w", err)
+		}
+		if err = r.DB.SetRoomAlias(ctx, alias, newRoomID, creator); err != nil {
+			return fmt.Errorf("r.DB.SetRoomAlias: %w", err)
+		}
+	}
+
+	published, err := r.DB.GetPublishedRooms(ctx)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetPublishedRooms: %w", err)
+	}
+	for _, roomID := range published {
+		if roomID != oldRoomID {
+			continue
+		}
+		if err = r.DB.PublishRoom(ctx, oldRoomID, false); err != nil {
+			return fmt.Errorf("r.DB.PublishRoom: %w", err)
+		}
+		if err = r.DB.PublishRoom(ctx, newRoomID, true); err != nil {
+			return fmt.Errorf("r.DB.PublishRoom: %w", err)
+		}
+	}
+	return nil
+}
+
+// inviteMembers invites everyone who was joined to or invited into the old
+// room into the new one. Failures are logged, as the upgrade has already
+// happened by this point.
+func (r *Upgrader) inviteMembers(
+	ctx context.Context, req *api.PerformRoomUpgradeRequest, newRoomID string,
+	state map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent,
+) {
+	for tuple, ev := range state {
+		if tuple.EventType != gomatrixserverlib.MRoomMember || tuple.StateKey == req.UserID {
+			continue
+		}
+		membership, err := ev.Membership()
+		if err != nil || (membership != gomatrixserverlib.Join && membership != gomatrixserverlib.Invite) {
+			continue
+		}
+		logger := logrus.WithFields(logrus.Fields{
+			"room_id": newRoomID,
+			"user_id": tuple.StateKey,
+		})
+
+		// Keep the display name and avatar the member had in the old room.
+		var oldContent gomatrixserverlib.MemberContent
+		_ = json.Unmarshal(ev.Content(), &oldContent)
+		content := gomatrixserverlib.MemberContent{
+			Membership:  gomatrixserverlib.Invite,
+			DisplayName: oldContent.DisplayName,
+			AvatarURL:   oldContent.AvatarURL,
+		}
+		stateKey := tuple.StateKey
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   req.UserID,
+			RoomID:   newRoomID,
+			Type:     gomatrixserverlib.MRoomMember,
+			StateKey: &stateKey,
+		}
+		if err = builder.SetContent(content); err != nil {
+			logger.WithError(err).Error("Failed to set invite content")
+			continue
+		}
+		invite, _, err := buildEvent(ctx, r.DB, r.Cfg.Matrix, &builder)
+		if err != nil {
+			logger.WithError(err).Error("Failed to build invite")
+			continue
+		}
+		var inviteRes api.PerformInviteResponse
+		if err = r.URSAPI.PerformInvite(ctx, &api.PerformInviteRequest{
+			RoomVersion:  req.RoomVersion,
+			Event:        invite,
+			SendAsServer: string(r.Cfg.Matrix.ServerName),
+		}, &inviteRes); err != nil {
+			logger.WithError(err).Error("Failed to invite user into replacement room")
+			continue
+		}
+		if inviteRes.Error != nil {
+			logger.WithError(inviteRes.Error).Warn("Failed to invite user into replacement room")
+		}
+	}
+}
+
+// buildOldRoomEvent builds a state event from the upgrading user in the old room.
+func (r *Upgrader) buildOldRoomEvent(
+	ctx context.Context, req *api.PerformRoomUpgradeRequest, eventType string, content interface{},
+) (*gomatrixserverlib.HeaderedEvent, error) {
+	stateKey := ""
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   req.UserID,
+		RoomID:   req.RoomID,
+		Type:     eventType,
+		StateKey: &stateKey,
+	}
+	if err := builder.SetContent(content); err != nil {
+		return nil, fmt.Errorf("builder.SetContent: %w", err)
+	}
+	ev, _, err := buildEvent(ctx, r.DB, r.Cfg.Matrix, &builder)
+	if err != nil {
+		return nil, fmt.Errorf("buildEvent: %w", err)
+	}
+	return ev, nil
+}
+
+// input sends new events to the roomserver input stream, in order.
+func (r *Upgrader) input(ctx context.Context, events []*gomatrixserverlib.HeaderedEvent) error {
+	inputReq := api.InputRoomEventsRequest{
+		InputRoomEvents: make([]api.InputRoomEvent, 0, len(events)),
+	}
+	for _, ev := range events {
+		inputReq.InputRoomEvents = append(inputReq.InputRoomEvents, api.InputRoomEvent{
+			Kind:         api.KindNew,
+			Event:        ev,
+			AuthEventIDs: ev.AuthEventIDs(),
+			SendAsServer: string(r.Cfg.Matrix.ServerName),
+		})
+	}
+	inputRes := api.InputRoomEventsResponse{}
+	r.Inputer.InputRoomEvents(ctx, &inputReq, &inputRes)
+	if err := inputRes.Err(); err != nil {
+		return fmt.Errorf("r.InputRoomEvents: %w", err)
+	}
+	return nil
+}
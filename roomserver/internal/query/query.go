@@ -18,6 +18,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal/caching"
@@ -30,6 +32,7 @@ import (
 	"github.com/matrix-org/dendrite/roomserver/version"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/opentracing/opentracing-go"
 	"github.com/sirupsen/logrus"
 )
 
@@ -37,6 +40,8 @@ type Queryer struct {
 	DB         storage.Database
 	Cache      caching.RoomServerCaches
 	ServerACLs *acls.ServerACLs
+
+	roomStorageUsage roomStorageUsageCache
 }
 
 // QueryLatestEventsAndState implements api.RoomserverInternalAPI
@@ -45,6 +50,10 @@ func (r *Queryer) QueryLatestEventsAndState(
 	request *api.QueryLatestEventsAndStateRequest,
 	response *api.QueryLatestEventsAndStateResponse,
 ) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "roomserver.QueryLatestEventsAndState")
+	defer span.Finish()
+	span.SetTag("room_id", request.RoomID)
+
 	return helpers.QueryLatestEventsAndState(ctx, r.DB, request, response)
 }
 
@@ -54,6 +63,10 @@ func (r *Queryer) QueryStateAfterEvents(
 	request *api.QueryStateAfterEventsRequest,
 	response *api.QueryStateAfterEventsResponse,
 ) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "roomserver.QueryStateAfterEvents")
+	defer span.Finish()
+	span.SetTag("room_id", request.RoomID)
+
 	info, err := r.DB.RoomInfo(ctx, request.RoomID)
 	if err != nil {
 		return err
@@ -162,6 +175,10 @@ func (r *Queryer) QueryEventsByID(
 	request *api.QueryEventsByIDRequest,
 	response *api.QueryEventsByIDResponse,
 ) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "roomserver.QueryEventsByID")
+	defer span.Finish()
+	span.SetTag("event_count", len(request.EventIDs))
+
 	eventNIDMap, err := r.DB.EventNIDs(ctx, request.EventIDs)
 	if err != nil {
 		return err
@@ -172,7 +189,12 @@ func (r *Queryer) QueryEventsByID(
 		eventNIDs = append(eventNIDs, nid)
 	}
 
-	events, err := helpers.LoadEvents(ctx, r.DB, eventNIDs)
+	var events []*gomatrixserverlib.Event
+	if request.ExcludeSoftFailed {
+		events, err = helpers.LoadTimelineEvents(ctx, r.DB, eventNIDs)
+	} else {
+		events, err = helpers.LoadEvents(ctx, r.DB, eventNIDs)
+	}
 	if err != nil {
 		return err
 	}
@@ -280,6 +302,7 @@ func (r *Queryer) QueryMembershipsForRoom(
 	}
 
 	response.HasBeenInRoom = true
+	response.IsInRoom = stillInRoom
 	response.JoinEvents = []gomatrixserverlib.ClientEvent{}
 
 	var events []types.Event
@@ -459,6 +482,10 @@ func (r *Queryer) QueryStateAndAuthChain(
 	request *api.QueryStateAndAuthChainRequest,
 	response *api.QueryStateAndAuthChainResponse,
 ) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "roomserver.QueryStateAndAuthChain")
+	defer span.Finish()
+	span.SetTag("room_id", request.RoomID)
+
 	info, err := r.DB.RoomInfo(ctx, request.RoomID)
 	if err != nil {
 		return err
@@ -472,7 +499,13 @@ func (r *Queryer) QueryStateAndAuthChain(
 	var stateEvents []*gomatrixserverlib.Event
 	stateEvents, err = r.loadStateAtEventIDs(ctx, *info, request.PrevEventIDs)
 	if err != nil {
-		return err
+		switch err.(type) {
+		case types.MissingEventError:
+			util.GetLogger(ctx).Errorf("QueryStateAndAuthChain: MissingEventError: %s", err)
+			return nil
+		default:
+			return err
+		}
 	}
 
 	response.PrevEventsExist = true
@@ -513,12 +546,7 @@ func (r *Queryer) loadStateAtEventIDs(ctx context.Context, roomInfo types.RoomIn
 	roomState := state.NewStateResolution(r.DB, roomInfo)
 	prevStates, err := r.DB.StateAtEventIDs(ctx, eventIDs)
 	if err != nil {
-		switch err.(type) {
-		case types.MissingEventError:
-			return nil, nil
-		default:
-			return nil, err
-		}
+		return nil, err
 	}
 
 	// Look up the currrent state for the requested tuples.
@@ -643,7 +671,16 @@ func (r *Queryer) QueryPublishedRooms(
 	if err != nil {
 		return err
 	}
-	res.RoomIDs = rooms
+	if req.RoomID == "" {
+		res.RoomIDs = rooms
+		return nil
+	}
+	for _, roomID := range rooms {
+		if roomID == req.RoomID {
+			res.RoomIDs = []string{roomID}
+			break
+		}
+	}
 	return nil
 }
 
@@ -741,6 +778,68 @@ func (r *Queryer) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryS
 	return nil
 }
 
+// roomStorageUsageCacheDuration is how long the storage usage of a room is
+// cached for, since calculating it means scanning all of the event JSON in
+// the room.
+const roomStorageUsageCacheDuration = time.Minute
+
+type roomStorageUsageCache struct {
+	sync.Mutex
+	entries map[string]roomStorageUsage // room ID -> usage
+}
+
+type roomStorageUsage struct {
+	eventCount int64
+	sizeBytes  int64
+	expires    time.Time
+}
+
+func (r *Queryer) QueryRoomStorageUsage(ctx context.Context, req *api.QueryRoomStorageUsageRequest, res *api.QueryRoomStorageUsageResponse) error {
+	now := time.Now()
+	cache := &r.roomStorageUsage
+	cache.Lock()
+	usage, ok := cache.entries[req.RoomID]
+	cache.Unlock()
+	if ok && now.Before(usage.expires) {
+		res.RoomExists = true
+		res.EventCount = usage.eventCount
+		res.SizeBytes = usage.sizeBytes
+		return nil
+	}
+
+	info, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomInfo: %w", err)
+	}
+	if info == nil {
+		return nil
+	}
+	eventCount, sizeBytes, err := r.DB.RoomStorageUsage(ctx, info.RoomNID)
+	if err != nil {
+		return fmt.Errorf("r.DB.RoomStorageUsage: %w", err)
+	}
+	res.RoomExists = true
+	res.EventCount = eventCount
+	res.SizeBytes = sizeBytes
+
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.entries == nil {
+		cache.entries = make(map[string]roomStorageUsage)
+	}
+	for roomID, usage := range cache.entries {
+		if !now.Before(usage.expires) {
+			delete(cache.entries, roomID)
+		}
+	}
+	cache.entries[req.RoomID] = roomStorageUsage{
+		eventCount: eventCount,
+		sizeBytes:  sizeBytes,
+		expires:    now.Add(roomStorageUsageCacheDuration),
+	}
+	return nil
+}
+
 func (r *Queryer) QueryAuthChain(ctx context.Context, req *api.QueryAuthChainRequest, res *api.QueryAuthChainResponse) error {
 	chain, err := GetAuthChain(ctx, r.DB.EventsFromIDs, req.EventIDs)
 	if err != nil {
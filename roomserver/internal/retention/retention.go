@@ -0,0 +1,138 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retention
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/internal/input"
+	"github.com/matrix-org/dendrite/roomserver/storage"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// MRoomRetention is the state event which sets a room's retention policy, as per MSC1763.
+const MRoomRetention = "m.room.retention"
+
+// Purger purges timeline events from rooms once they are older than the room's
+// retention policy allows, according to the retention configuration.
+type Purger struct {
+	DB      storage.Database
+	Cfg     *config.RoomServer
+	Inputer *input.Inputer
+}
+
+// Start purges old events every purge interval, until the process exits.
+func (p *Purger) Start() {
+	go func() {
+		for {
+			if _, err := p.PurgeRooms(context.Background(), time.Now()); err != nil {
+				logrus.WithError(err).Error("Failed to purge old events")
+			}
+			time.Sleep(p.Cfg.Retention.PurgeInterval)
+		}
+	}()
+}
+
+// PurgeRooms purges the events in every room which have outlived the room's
+// retention policy at the given time. Returns the number of events purged, or
+// which would have been purged in dry-run mode.
+func (p *Purger) PurgeRooms(ctx context.Context, now time.Time) (int, error) {
+	roomIDs, err := p.DB.GetKnownRooms(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("p.DB.GetKnownRooms: %w", err)
+	}
+	purged := 0
+	for _, roomID := range roomIDs {
+		eventIDs, err := p.purgeRoom(ctx, roomID, now)
+		if err != nil {
+			// carry on with the other rooms, we'll try this one again next time
+			logrus.WithError(err).WithField("room_id", roomID).Error("Failed to purge old events in room")
+			continue
+		}
+		purged += len(eventIDs)
+	}
+	return purged, nil
+}
+
+func (p *Purger) purgeRoom(ctx context.Context, roomID string, now time.Time) ([]string, error) {
+	info, err := p.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("p.DB.RoomInfo: %w", err)
+	}
+	if info == nil || info.IsStub {
+		return nil, nil
+	}
+	lifetime, err := p.lifetime(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if lifetime <= 0 {
+		return nil, nil
+	}
+	dryRun := p.Cfg.Retention.DryRun
+	before := gomatrixserverlib.AsTimestamp(now.Add(-lifetime))
+	eventIDs, err := p.DB.PurgeHistory(ctx, roomID, before, false, dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("p.DB.PurgeHistory: %w", err)
+	}
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	logger := logrus.WithFields(logrus.Fields{
+		"room_id":  roomID,
+		"lifetime": lifetime,
+		"events":   len(eventIDs),
+	})
+	if dryRun {
+		logger.WithField("event_ids", eventIDs).Info("Would purge old events (dry run)")
+		return eventIDs, nil
+	}
+	logger.Info("Purged old events")
+	return eventIDs, p.Inputer.WriteOutputEvents(roomID, []api.OutputEvent{
+		{
+			Type: api.OutputTypePurgedEvents,
+			PurgedEvents: &api.OutputPurgedEvents{
+				RoomID:   roomID,
+				EventIDs: eventIDs,
+			},
+		},
+	})
+}
+
+// lifetime returns how long to keep events in the room for, or 0 to keep them forever.
+func (p *Purger) lifetime(ctx context.Context, roomID string) (time.Duration, error) {
+	event, err := p.DB.GetStateEvent(ctx, roomID, MRoomRetention, "")
+	if err != nil {
+		return 0, fmt.Errorf("p.DB.GetStateEvent: %w", err)
+	}
+	if event == nil {
+		return p.Cfg.Retention.Lifetime(nil), nil
+	}
+	var content struct {
+		MaxLifetime *int64 `json:"max_lifetime"`
+	}
+	if err = json.Unmarshal(event.Content(), &content); err != nil || content.MaxLifetime == nil {
+		// treat a malformed policy as if there wasn't one
+		return p.Cfg.Retention.Lifetime(nil), nil
+	}
+	maxLifetime := time.Duration(*content.MaxLifetime) * time.Millisecond
+	return p.Cfg.Retention.Lifetime(&maxLifetime), nil
+}
@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -16,6 +18,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/test"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/internal"
+	"github.com/matrix-org/dendrite/roomserver/internal/retention"
 	"github.com/matrix-org/dendrite/roomserver/storage"
 	"github.com/matrix-org/dendrite/setup"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -176,7 +179,7 @@ func mustCreateRoomserverAPI(t *testing.T) (api.RoomserverInternalAPI, *dummyPro
 		Caches: cache,
 		Cfg:    cfg,
 	}
-	roomserverDB, err := storage.Open(&cfg.RoomServer.Database, base.Caches)
+	roomserverDB, err := storage.Open(&cfg.RoomServer, base.Caches)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to room server db")
 	}
@@ -406,3 +409,822 @@ func TestOutputRewritesState(t *testing.T) {
 		t.Errorf("Output event did not overwrite room state")
 	}
 }
+
+// This tests that other servers can only backfill the events which the history
+// visibility of the room allows them to see.
+func TestPerformBackfillHistoryVisibility(t *testing.T) {
+	roomID := "!backfill:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID: roomID,
+			Sender: alice,
+			Content: map[string]interface{}{
+				"creator":      alice,
+				"room_version": "6",
+			},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID: roomID,
+			Sender: alice,
+			Content: map[string]interface{}{
+				"membership": "join",
+			},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID: roomID,
+			Sender: alice,
+			Content: map[string]interface{}{
+				"history_visibility": "world_readable",
+			},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomHistoryVisibility,
+		},
+		{
+			RoomID: roomID,
+			Sender: alice,
+			Content: map[string]interface{}{
+				"body": "world readable",
+			},
+			Type: "m.room.message",
+		},
+		{
+			RoomID: roomID,
+			Sender: alice,
+			Content: map[string]interface{}{
+				"history_visibility": "joined",
+			},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomHistoryVisibility,
+		},
+		{
+			RoomID: roomID,
+			Sender: alice,
+			Content: map[string]interface{}{
+				"body": "joined only",
+			},
+			Type: "m.room.message",
+		},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	// Servicing backfill requests from other servers doesn't use the federation sender.
+	rsAPI.SetFederationSenderAPI(nil)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("SendEvents failed: %s", err)
+	}
+
+	backfill := func(eventID string) []string {
+		var res api.PerformBackfillResponse
+		if err := rsAPI.PerformBackfill(ctx, &api.PerformBackfillRequest{
+			RoomID:               roomID,
+			BackwardsExtremities: map[string][]string{"": {eventID}},
+			Limit:                10,
+			ServerName:           "other.server",
+		}, &res); err != nil {
+			t.Fatalf("PerformBackfill failed: %s", err)
+		}
+		var eventIDs []string
+		for _, ev := range res.Events {
+			eventIDs = append(eventIDs, ev.EventID())
+		}
+		return eventIDs
+	}
+	// The history wasn't visible to other servers before it was made world readable.
+	if got, want := backfill(events[3].EventID()), []string{events[3].EventID()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backfill from world readable message: got %v, want %v", got, want)
+	}
+	if got := backfill(events[5].EventID()); len(got) != 0 {
+		t.Errorf("backfill from joined only message: got %v, want no events", got)
+	}
+}
+
+// This tests that upgrading a room copies its state, bans and power levels
+// into the replacement room, tombstones the old room and re-invites members.
+func TestPerformRoomUpgrade(t *testing.T) {
+	roomID := "!upgrade:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	charlie := "@charlie:" + string(testOrigin)
+	emptyKey := ""
+	powerLevels := map[string]interface{}{
+		"users":          map[string]interface{}{alice: 100},
+		"users_default":  0,
+		"events_default": 0,
+		"state_default":  50,
+		"ban":            50,
+		"kick":           50,
+		"redact":         50,
+		"invite":         0,
+		"events":         map[string]interface{}{"m.room.tombstone": 100},
+	}
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV5, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "5"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  powerLevels,
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomPowerLevels,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"join_rule": "public"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"name": "Old room"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomName,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Content:  map[string]interface{}{"membership": "join", "displayname": "Bob"},
+			StateKey: &bob,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   charlie,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &charlie,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "ban"},
+			StateKey: &charlie,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	// Upgrading a room with only local members doesn't use the federation sender.
+	rsAPI.SetFederationSenderAPI(nil)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("SendEvents failed: %s", err)
+	}
+
+	var res api.PerformRoomUpgradeResponse
+	rsAPI.PerformRoomUpgrade(ctx, &api.PerformRoomUpgradeRequest{
+		RoomID:      roomID,
+		UserID:      bob,
+		RoomVersion: gomatrixserverlib.RoomVersionV6,
+	}, &res)
+	if res.Error == nil || res.Error.Code != api.PerformErrorNotAllowed {
+		t.Fatalf("upgrade by user without power: got error %v, want not allowed", res.Error)
+	}
+	res = api.PerformRoomUpgradeResponse{}
+	rsAPI.PerformRoomUpgrade(ctx, &api.PerformRoomUpgradeRequest{
+		RoomID:      roomID,
+		UserID:      alice,
+		RoomVersion: gomatrixserverlib.RoomVersionV6,
+	}, &res)
+	if res.Error != nil {
+		t.Fatalf("PerformRoomUpgrade failed: %s", res.Error)
+	}
+
+	currentState := func(roomID string) map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent {
+		var stateRes api.QueryLatestEventsAndStateResponse
+		if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+			RoomID: roomID,
+		}, &stateRes); err != nil {
+			t.Fatalf("QueryLatestEventsAndState failed: %s", err)
+		}
+		state := make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.HeaderedEvent)
+		for _, ev := range stateRes.StateEvents {
+			state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+		}
+		return state
+	}
+	oldState := currentState(roomID)
+	newState := currentState(res.NewRoomID)
+
+	tombstone := oldState[gomatrixserverlib.StateKeyTuple{EventType: "m.room.tombstone"}]
+	if tombstone == nil {
+		t.Fatalf("old room has no tombstone")
+	}
+	var tombstoneContent struct {
+		ReplacementRoom string `json:"replacement_room"`
+	}
+	if err := json.Unmarshal(tombstone.Content(), &tombstoneContent); err != nil || tombstoneContent.ReplacementRoom != res.NewRoomID {
+		t.Errorf("tombstone points at %q, want %q", tombstoneContent.ReplacementRoom, res.NewRoomID)
+	}
+
+	var createContent struct {
+		RoomVersion string `json:"room_version"`
+		Predecessor struct {
+			RoomID  string `json:"room_id"`
+			EventID string `json:"event_id"`
+		} `json:"predecessor"`
+	}
+	if err := json.Unmarshal(newState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate}].Content(), &createContent); err != nil {
+		t.Fatalf("failed to unmarshal create event: %s", err)
+	}
+	if createContent.RoomVersion != "6" || createContent.Predecessor.RoomID != roomID || createContent.Predecessor.EventID != tombstone.EventID() {
+		t.Errorf("unexpected create content: %+v", createContent)
+	}
+	if name := newState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomName}]; name == nil || !bytes.Contains(name.Content(), []byte("Old room")) {
+		t.Errorf("room name wasn't copied to the new room")
+	}
+	newPowerLevels, err := gomatrixserverlib.NewPowerLevelContentFromEvent(
+		newState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels}].Event,
+	)
+	if err != nil {
+		t.Fatalf("failed to parse new power levels: %s", err)
+	}
+	if newPowerLevels.UserLevel(alice) != 100 || newPowerLevels.EventLevel("m.room.tombstone", true) != 100 {
+		t.Errorf("power levels weren't preserved: %+v", newPowerLevels)
+	}
+	wantMemberships := map[string]string{alice: "join", bob: "invite", charlie: "ban"}
+	for userID, want := range wantMemberships {
+		ev := newState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: userID}]
+		if ev == nil {
+			t.Errorf("%s has no membership in the new room, want %s", userID, want)
+			continue
+		}
+		if got, _ := ev.Membership(); got != want {
+			t.Errorf("%s has membership %s in the new room, want %s", userID, got, want)
+		}
+	}
+
+	var oldPowerLevels struct {
+		EventsDefault int64 `json:"events_default"`
+		Invite        int64 `json:"invite"`
+	}
+	if err = json.Unmarshal(oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels}].Content(), &oldPowerLevels); err != nil {
+		t.Fatalf("failed to unmarshal old power levels: %s", err)
+	}
+	if oldPowerLevels.EventsDefault != 50 || oldPowerLevels.Invite != 50 {
+		t.Errorf("old room wasn't restricted: %+v", oldPowerLevels)
+	}
+}
+
+// This tests that a room drops out of the room directory once its join rules
+// no longer let anyone join it.
+func TestJoinRulesUnpublishRoom(t *testing.T) {
+	roomID := "!directory:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"join_rule": "public"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"join_rule": "invite"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[:3], testOrigin, nil); err != nil {
+		t.Fatalf("SendEvents failed: %s", err)
+	}
+	var pubRes api.PerformPublishResponse
+	rsAPI.PerformPublish(ctx, &api.PerformPublishRequest{RoomID: roomID, Visibility: "public"}, &pubRes)
+	if pubRes.Error != nil {
+		t.Fatalf("PerformPublish failed: %s", pubRes.Error)
+	}
+
+	isPublished := func() bool {
+		var res api.QueryPublishedRoomsResponse
+		if err := rsAPI.QueryPublishedRooms(ctx, &api.QueryPublishedRoomsRequest{RoomID: roomID}, &res); err != nil {
+			t.Fatalf("QueryPublishedRooms failed: %s", err)
+		}
+		return len(res.RoomIDs) == 1
+	}
+	if !isPublished() {
+		t.Fatalf("room wasn't published")
+	}
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[3:], testOrigin, nil); err != nil {
+		t.Fatalf("SendEvents failed: %s", err)
+	}
+	if isPublished() {
+		t.Errorf("room is still published after its join rules became invite only")
+	}
+}
+
+func TestPurgeHistory(t *testing.T) {
+	roomID := "!retention:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"max_lifetime": time.Hour.Milliseconds()},
+			StateKey: &emptyKey,
+			Type:     retention.MRoomRetention,
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "first", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"name": "Room Name"},
+			StateKey: &emptyKey,
+			Type:     "m.room.name",
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "second", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+		{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": "latest", "msgtype": "m.text"},
+			Type:    "m.room.message",
+		},
+	})
+	deleteDatabase()
+	rsAPI, producer := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("SendEvents failed: %s", err)
+	}
+	internalAPI := rsAPI.(*internal.RoomserverInternalAPI)
+	cfg := *internalAPI.Cfg
+	cfg.Retention.Enabled = true
+	cfg.Retention.DryRun = true
+	purger := &retention.Purger{DB: internalAPI.DB, Cfg: &cfg, Inputer: internalAPI.Inputer}
+	purge := func(after time.Duration, want int) {
+		t.Helper()
+		producer.producedMessages = nil
+		purged, err := purger.PurgeRooms(ctx, time.Now().Add(after))
+		if err != nil {
+			t.Fatalf("PurgeRooms failed: %s", err)
+		}
+		if purged != want {
+			t.Fatalf("purged %d events after %s, want %d", purged, after, want)
+		}
+	}
+	storedEventIDs := func() map[string]bool {
+		t.Helper()
+		var eventIDs []string
+		for _, ev := range events {
+			eventIDs = append(eventIDs, ev.EventID())
+		}
+		stored, err := internalAPI.DB.EventsFromIDs(ctx, eventIDs)
+		if err != nil {
+			t.Fatalf("EventsFromIDs failed: %s", err)
+		}
+		result := make(map[string]bool)
+		for _, ev := range stored {
+			result[ev.EventID()] = true
+		}
+		return result
+	}
+
+	// nothing has outlived the room's max_lifetime yet
+	purge(time.Minute*30, 0)
+
+	// the old messages are reported, but nothing is deleted in a dry run
+	purge(time.Hour*2, 2)
+	if len(producer.producedMessages) != 0 {
+		t.Errorf("dry run produced %d output events", len(producer.producedMessages))
+	}
+	if stored := storedEventIDs(); len(stored) != len(events) {
+		t.Errorf("dry run deleted events, %d of %d are left", len(stored), len(events))
+	}
+
+	cfg.Retention.DryRun = false
+	purge(time.Hour*2, 2)
+	stored := storedEventIDs()
+	for i, ev := range events {
+		// only the old messages are purged: the state events and the message
+		// which is the forward extremity of the room are kept
+		wantPurged := i == 3 || i == 5
+		if stored[ev.EventID()] == wantPurged {
+			t.Errorf("event %d (%s): got stored %v, want %v", i, ev.Type(), stored[ev.EventID()], !wantPurged)
+		}
+	}
+	if len(producer.producedMessages) != 1 || producer.producedMessages[0].Type != api.OutputTypePurgedEvents {
+		t.Fatalf("got output events %+v, want one purged events output", producer.producedMessages)
+	}
+	wantOutput := &api.OutputPurgedEvents{RoomID: roomID, EventIDs: []string{events[3].EventID(), events[5].EventID()}}
+	if got := producer.producedMessages[0].PurgedEvents; !reflect.DeepEqual(got, wantOutput) {
+		t.Errorf("got purged events output %+v, want %+v", got, wantOutput)
+	}
+
+	// the events have already gone, so there is nothing left to purge
+	purge(time.Hour*2, 0)
+}
+
+func TestPerformPurgeHistory(t *testing.T) {
+	roomID := "!purge:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	message := func(body string) fledglingEvent {
+		return fledglingEvent{
+			RoomID:  roomID,
+			Sender:  alice,
+			Content: map[string]interface{}{"body": body, "msgtype": "m.text"},
+			Type:    "m.room.message",
+		}
+	}
+	topic := func(topic string) fledglingEvent {
+		return fledglingEvent{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"topic": topic},
+			StateKey: &emptyKey,
+			Type:     "m.room.topic",
+		}
+	}
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		topic("first"), message("one"), topic("second"), message("two"), topic("current"), message("latest"),
+	})
+	deleteDatabase()
+	rsAPI, producer := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("SendEvents failed: %s", err)
+	}
+	producer.producedMessages = nil
+
+	for _, req := range []api.PerformPurgeHistoryRequest{
+		{RoomID: roomID},
+		{RoomID: roomID, BeforeEventID: "$unknown:" + string(testOrigin)},
+		{RoomID: "!unknown:" + string(testOrigin), BeforeTS: gomatrixserverlib.AsTimestamp(time.Now())},
+	} {
+		var res api.PerformPurgeHistoryResponse
+		if err := rsAPI.PerformPurgeHistory(ctx, &req, &res); err != nil {
+			t.Fatalf("PerformPurgeHistory failed: %s", err)
+		}
+		if res.Error == nil || res.PurgeID != "" {
+			t.Errorf("PerformPurgeHistory(%+v): got response %+v, want an error", req, res)
+		}
+	}
+
+	var res api.PerformPurgeHistoryResponse
+	if err := rsAPI.PerformPurgeHistory(ctx, &api.PerformPurgeHistoryRequest{
+		RoomID:   roomID,
+		BeforeTS: gomatrixserverlib.AsTimestamp(time.Now().Add(time.Minute)),
+	}, &res); err != nil || res.Error != nil {
+		t.Fatalf("PerformPurgeHistory failed: %v %v", err, res.Error)
+	}
+	var status api.QueryPurgeHistoryStatusResponse
+	for i := 0; ; i++ {
+		if err := rsAPI.QueryPurgeHistoryStatus(ctx, &api.QueryPurgeHistoryStatusRequest{PurgeID: res.PurgeID}, &status); err != nil {
+			t.Fatalf("QueryPurgeHistoryStatus failed: %s", err)
+		}
+		if !status.Exists {
+			t.Fatalf("purge %q doesn't exist", res.PurgeID)
+		}
+		if status.Status != api.PurgeHistoryStatusActive {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("purge didn't finish")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if status.Status != api.PurgeHistoryStatusComplete || status.PurgedEvents != 4 {
+		t.Fatalf("got purge status %+v, want 4 events purged", status)
+	}
+
+	// The old messages and the topics which were replaced are purged, but the
+	// current state and the latest event are kept.
+	wantPurged := []string{events[2].EventID(), events[3].EventID(), events[4].EventID(), events[5].EventID()}
+	if len(producer.producedMessages) != 1 || !reflect.DeepEqual(producer.producedMessages[0].PurgedEvents.EventIDs, wantPurged) {
+		t.Fatalf("got output events %+v, want the purged events %v", producer.producedMessages, wantPurged)
+	}
+	internalAPI := rsAPI.(*internal.RoomserverInternalAPI)
+	var eventIDs []string
+	for _, ev := range events {
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	stored, err := internalAPI.DB.EventsFromIDs(ctx, eventIDs)
+	if err != nil {
+		t.Fatalf("EventsFromIDs failed: %s", err)
+	}
+	if len(stored) != len(events)-len(wantPurged) {
+		t.Errorf("got %d stored events, want %d", len(stored), len(events)-len(wantPurged))
+	}
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err = rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, &stateRes); err != nil {
+		t.Fatalf("QueryLatestEventsAndState failed: %s", err)
+	}
+	if len(stateRes.StateEvents) != 3 {
+		t.Errorf("got %d current state events after the purge, want 3", len(stateRes.StateEvents))
+	}
+}
+
+func TestPerformAdminEvacuateRoom(t *testing.T) {
+	roomID := "!evacuate:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	charlie := "@charlie:remote.server"
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"join_rule": "public"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomJoinRules,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   bob,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &bob,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   charlie,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &charlie,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, testOrigin, nil); err != nil {
+		t.Fatalf("SendEvents failed: %s", err)
+	}
+
+	var res api.PerformAdminEvacuateRoomResponse
+	if err := rsAPI.PerformAdminEvacuateRoom(ctx, &api.PerformAdminEvacuateRoomRequest{
+		RoomID: roomID,
+		Forget: true,
+		Block:  true,
+	}, &res); err != nil || res.Error != nil {
+		t.Fatalf("PerformAdminEvacuateRoom failed: %v %v", err, res.Error)
+	}
+	sort.Strings(res.Affected)
+	if want := []string{alice, bob}; !reflect.DeepEqual(res.Affected, want) {
+		t.Errorf("got affected users %v, want %v", res.Affected, want)
+	}
+
+	// the remote user is still in the room
+	var membersRes api.QueryMembershipsForRoomResponse
+	if err := rsAPI.QueryMembershipsForRoom(ctx, &api.QueryMembershipsForRoomRequest{
+		RoomID:     roomID,
+		JoinedOnly: true,
+	}, &membersRes); err != nil {
+		t.Fatalf("QueryMembershipsForRoom failed: %s", err)
+	}
+	if len(membersRes.JoinEvents) != 1 || *membersRes.JoinEvents[0].StateKey != charlie {
+		t.Errorf("got joined members %+v, want just %s", membersRes.JoinEvents, charlie)
+	}
+
+	// and local users can't join again
+	var joinRes api.PerformJoinResponse
+	rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{
+		RoomIDOrAlias: roomID,
+		UserID:        bob,
+		Content:       map[string]interface{}{},
+	}, &joinRes)
+	if joinRes.Error == nil || joinRes.Error.Code != api.PerformErrorNotAllowed {
+		t.Errorf("got join error %v, want not allowed", joinRes.Error)
+	}
+}
+
+func TestPerformAdminBlockRoom(t *testing.T) {
+	roomID := "!blocked:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	bob := "@bob:" + string(testOrigin)
+	emptyKey := ""
+	events := mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+			StateKey: &emptyKey,
+			Type:     gomatrixserverlib.MRoomCreate,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "join"},
+			StateKey: &alice,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+		{
+			RoomID:   roomID,
+			Sender:   alice,
+			Content:  map[string]interface{}{"membership": "invite"},
+			StateKey: &bob,
+			Type:     gomatrixserverlib.MRoomMember,
+		},
+	})
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	rsAPI.SetFederationSenderAPI(nil)
+
+	block := func(block bool) {
+		t.Helper()
+		var res api.PerformAdminBlockRoomResponse
+		if err := rsAPI.PerformAdminBlockRoom(ctx, &api.PerformAdminBlockRoomRequest{
+			RoomID: roomID,
+			Block:  block,
+		}, &res); err != nil || res.Error != nil {
+			t.Fatalf("PerformAdminBlockRoom failed: %v %v", err, res.Error)
+		}
+	}
+
+	// the room has never been seen, but can still be blocked
+	block(true)
+	err := api.SendEvents(ctx, rsAPI, api.KindNew, events[:2], testOrigin, nil)
+	if _, ok := err.(*gomatrixserverlib.NotAllowed); !ok {
+		t.Errorf("got error %v creating a blocked room, want not allowed", err)
+	}
+	var joinRes api.PerformJoinResponse
+	rsAPI.PerformJoin(ctx, &api.PerformJoinRequest{
+		RoomIDOrAlias: roomID,
+		UserID:        bob,
+		Content:       map[string]interface{}{},
+	}, &joinRes)
+	if joinRes.Error == nil || joinRes.Error.Code != api.PerformErrorNotAllowed {
+		t.Errorf("got join error %v, want not allowed", joinRes.Error)
+	}
+	var inviteRes api.PerformInviteResponse
+	if err = rsAPI.PerformInvite(ctx, &api.PerformInviteRequest{
+		RoomVersion: gomatrixserverlib.RoomVersionV6,
+		Event:       events[2],
+	}, &inviteRes); err != nil {
+		t.Fatalf("PerformInvite failed: %s", err)
+	}
+	if inviteRes.Error == nil || inviteRes.Error.Code != api.PerformErrorNotAllowed {
+		t.Errorf("got invite error %v, want not allowed", inviteRes.Error)
+	}
+
+	// once unblocked, the room can be created
+	block(false)
+	if err = api.SendEvents(ctx, rsAPI, api.KindNew, events[:2], testOrigin, nil); err != nil {
+		t.Errorf("SendEvents failed after unblocking the room: %s", err)
+	}
+}
+
+func TestEventLimits(t *testing.T) {
+	roomID := "!limits:" + string(testOrigin)
+	alice := "@alice:" + string(testOrigin)
+	emptyKey := ""
+	createEvents := func(padding int) []*gomatrixserverlib.HeaderedEvent {
+		t.Helper()
+		return mustCreateEvents(t, gomatrixserverlib.RoomVersionV6, []fledglingEvent{
+			{
+				RoomID:   roomID,
+				Sender:   alice,
+				Content:  map[string]interface{}{"creator": alice, "room_version": "6"},
+				StateKey: &emptyKey,
+				Type:     gomatrixserverlib.MRoomCreate,
+			},
+			{
+				RoomID:   roomID,
+				Sender:   alice,
+				Content:  map[string]interface{}{"membership": "join"},
+				StateKey: &alice,
+				Type:     gomatrixserverlib.MRoomMember,
+			},
+			{
+				RoomID: roomID,
+				Sender: alice,
+				Content: map[string]interface{}{
+					"msgtype": "m.text",
+					"body":    strings.Repeat("a", padding),
+				},
+				Type: "m.room.message",
+			},
+		})
+	}
+	// Pad the message so that it is exactly as big as the spec allows.
+	events := createEvents(0)
+	events = createEvents(config.DefaultMaxEventSize - len(events[2].JSON()))
+	if size := len(events[2].JSON()); size != config.DefaultMaxEventSize {
+		t.Fatalf("made an event of %d bytes, want %d", size, config.DefaultMaxEventSize)
+	}
+
+	deleteDatabase()
+	rsAPI, _ := mustCreateRoomserverAPI(t)
+	defer deleteDatabase()
+	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events[:2], testOrigin, nil); err != nil {
+		t.Fatalf("SendEvents failed: %s", err)
+	}
+
+	cfg := rsAPI.(*internal.RoomserverInternalAPI).Cfg
+	send := func(wantTooLarge bool) {
+		t.Helper()
+		err := api.SendEvents(ctx, rsAPI, api.KindNew, events[2:], testOrigin, nil)
+		e, tooLarge := err.(gomatrixserverlib.EventValidationError)
+		tooLarge = tooLarge && e.Code == gomatrixserverlib.EventValidationTooLarge
+		if tooLarge != wantTooLarge || (!wantTooLarge && err != nil) {
+			t.Errorf("got error %v sending an event of %d bytes, want too large: %v", err, len(events[2].JSON()), wantTooLarge)
+		}
+	}
+
+	// an event one byte over a lowered limit is rejected
+	cfg.MaxEventSize = config.DefaultMaxEventSize - 1
+	send(true)
+	// as is an event which refers to too many auth events
+	cfg.MaxEventSize = config.DefaultMaxEventSize
+	cfg.MaxAuthEvents = len(events[2].AuthEventIDs()) - 1
+	send(true)
+	// but an event right at the default limits is accepted
+	cfg.MaxAuthEvents = config.DefaultMaxAuthEvents
+	send(false)
+}
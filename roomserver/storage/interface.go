@@ -16,6 +16,7 @@ package storage
 
 import (
 	"context"
+	"io"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
@@ -27,6 +28,12 @@ import (
 type Database interface {
 	// Do we support processing input events for more than one room at a time?
 	SupportsConcurrentRoomInputs() bool
+	// Is importing event JSON with BulkImportEventJSON faster than storing it with
+	// each event? BulkImportEventJSON works either way.
+	SupportsBulkEventJSONImport() bool
+	// Store the event JSON for events which have already been assigned event NIDs.
+	// Events which already have event JSON are left unchanged.
+	BulkImportEventJSON(ctx context.Context, pairs []tables.EventJSONPair) error
 	// RoomInfo returns room information for the given room ID, or nil if there is no room.
 	RoomInfo(ctx context.Context, roomID string) (*types.RoomInfo, error)
 	// Store the room state at an event in the database
@@ -65,12 +72,21 @@ type Database interface {
 	// Look up the Events for a list of numeric event IDs.
 	// Returns a sorted list of events.
 	Events(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
+	// Look up the Events for a list of numeric event IDs, leaving out soft-failed events. This should be used
+	// when serving events in a timeline, whereas state resolution should use Events.
+	// Returns a sorted list of events.
+	TimelineEvents(ctx context.Context, eventNIDs []types.EventNID) ([]types.Event, error)
 	// Look up snapshot NID for an event ID string
 	SnapshotNIDFromEventID(ctx context.Context, eventID string) (types.StateSnapshotNID, error)
 	// Stores a matrix room event in the database. Returns the room NID, the state snapshot and the redacted event ID if any, or an error.
 	StoreEvent(
 		ctx context.Context, event *gomatrixserverlib.Event, txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID,
-		isRejected bool,
+		isRejected, isSoftFailed bool,
+	) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error)
+	// Stores a matrix room event like StoreEvent, but without its event JSON, which must then be
+	// stored with BulkImportEventJSON. Until then the event can't be loaded or redacted.
+	StoreEventWithoutJSON(
+		ctx context.Context, event *gomatrixserverlib.Event, authEventNIDs []types.EventNID,
 	) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error)
 	// Look up the state entries for a list of string event IDs
 	// Returns an error if the there is an error talking to the database
@@ -140,6 +156,35 @@ type Database interface {
 	PublishRoom(ctx context.Context, roomID string, publish bool) error
 	// Returns a list of room IDs for rooms which are published.
 	GetPublishedRooms(ctx context.Context) ([]string, error)
+	// BlockRoom stops local users from joining or creating the room, and refuses
+	// invites to it. The room doesn't need to be known to the server.
+	BlockRoom(ctx context.Context, roomID string) error
+	// UnblockRoom reverses BlockRoom.
+	UnblockRoom(ctx context.Context, roomID string) error
+	// IsRoomBlocked returns whether the room has been blocked with BlockRoom.
+	IsRoomBlocked(ctx context.Context, roomID string) (bool, error)
+	// PurgeRoom deletes the event JSON for all events in a room in a single transaction.
+	// Returns the number of rows removed.
+	PurgeRoom(ctx context.Context, roomID string) (int64, error)
+	// PurgeHistory deletes the event JSON for the timeline events in a room which were sent before the given time,
+	// keeping the forward extremities. State events are kept too, unless orphanedState is true, in which case the ones
+	// which were replaced before the given time are deleted. If dryRun is true then nothing is deleted. Returns the
+	// IDs of the events which were, or would have been, purged.
+	PurgeHistory(ctx context.Context, roomID string, before gomatrixserverlib.Timestamp, orphanedState, dryRun bool) ([]string, error)
+	// RedactEvent rewrites the stored JSON of an event to its redacted form, according to the redaction algorithm
+	// of the room version. If the event hasn't been stored yet then the redaction is applied when it is.
+	RedactEvent(ctx context.Context, redactedEventNID, redactionEventNID types.EventNID) error
+	// EventJSONCursor iterates over the event JSON for all events in a room without loading it all into memory,
+	// starting after the given event NID. The cursor must be closed if it isn't read until the end.
+	EventJSONCursor(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID) (tables.EventJSONCursor, error)
+	// ExportUserEvents writes every event sent by the user to w as JSON lines, in the stable format described by
+	// shared.ExportedEvent. Events in rooms the user is no longer joined to are redacted. Returns the number of events written.
+	ExportUserEvents(ctx context.Context, userID string, w io.Writer) (int, error)
+	// RoomStorageUsage returns the number of events stored for a room and the total size in bytes of their event
+	// JSON as stored. This scans all of the event JSON in the room, so is expensive for large rooms.
+	RoomStorageUsage(ctx context.Context, roomNID types.RoomNID) (eventCount int64, sizeBytes int64, err error)
+	// CheckEventJSONIntegrity finds events without event JSON and event JSON without events, a chunk at a time.
+	CheckEventJSONIntegrity(ctx context.Context) (*shared.EventJSONIntegrityReport, error)
 
 	// TODO: factor out - from currentstateserver
 
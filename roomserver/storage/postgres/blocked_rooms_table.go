@@ -0,0 +1,89 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+)
+
+const blockedRoomsSchema = `
+-- Stores the rooms which server admins have blocked local users from joining
+CREATE TABLE IF NOT EXISTS roomserver_blocked_rooms (
+    -- The room ID of the room
+    room_id TEXT NOT NULL PRIMARY KEY
+);
+`
+
+const insertBlockedRoomSQL = "" +
+	"INSERT INTO roomserver_blocked_rooms (room_id) VALUES ($1) ON CONFLICT DO NOTHING"
+
+const deleteBlockedRoomSQL = "" +
+	"DELETE FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+const selectBlockedRoomSQL = "" +
+	"SELECT 1 FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+type blockedRoomsStatements struct {
+	insertBlockedRoomStmt *sqlutil.Stmt
+	deleteBlockedRoomStmt *sqlutil.Stmt
+	selectBlockedRoomStmt *sqlutil.Stmt
+}
+
+func createBlockedRoomsTable(db *sql.DB) error {
+	_, err := db.Exec(blockedRoomsSchema)
+	return err
+}
+
+func prepareBlockedRoomsTable(db *sql.DB) (tables.BlockedRooms, error) {
+	s := &blockedRoomsStatements{}
+
+	return s, shared.StatementList{
+		{&s.insertBlockedRoomStmt, insertBlockedRoomSQL},
+		{&s.deleteBlockedRoomStmt, deleteBlockedRoomSQL},
+		{&s.selectBlockedRoomStmt, selectBlockedRoomSQL},
+	}.Prepare(db)
+}
+
+func (s *blockedRoomsStatements) InsertBlockedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := s.insertBlockedRoomStmt.WithTx(txn)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *blockedRoomsStatements) DeleteBlockedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := s.deleteBlockedRoomStmt.WithTx(txn)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *blockedRoomsStatements) SelectRoomBlocked(
+	ctx context.Context, roomID string,
+) (bool, error) {
+	var exists int
+	err := s.selectBlockedRoomStmt.QueryRowContext(ctx, roomID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,79 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/sirupsen/logrus"
+)
+
+// Migrations returns the versioned roomserver migrations, which are tracked
+// in the schema_migrations table. New schema changes should be added here
+// rather than as goose deltas. Versions must never be reused or renumbered.
+func Migrations() []sqlutil.Migration {
+	return []sqlutil.Migration{
+		{Version: 1, Name: "add event JSON blob encoding", SQL: eventJSONBlobEncodingSQL + eventJSONByteaSQL, Up: UpEventJSONBlobEncoding},
+		{Version: 2, Name: "add soft-failed events", SQL: eventsSoftFailedSQL},
+		{Version: 3, Name: "add event JSON deduplication", SQL: eventJSONDeduplicationSQL},
+	}
+}
+
+const eventJSONBlobEncodingSQL = `ALTER TABLE roomserver_event_json ADD COLUMN IF NOT EXISTS blob_encoding SMALLINT NOT NULL DEFAULT 0;`
+
+const eventJSONByteaSQL = `ALTER TABLE roomserver_event_json ALTER COLUMN event_json TYPE BYTEA USING convert_to(event_json, 'UTF8');`
+
+const eventsSoftFailedSQL = `ALTER TABLE roomserver_events ADD COLUMN IF NOT EXISTS soft_failed BOOLEAN NOT NULL DEFAULT FALSE;`
+
+const eventJSONDeduplicationSQL = `
+CREATE TABLE IF NOT EXISTS roomserver_event_json_blobs (
+    hash BYTEA NOT NULL PRIMARY KEY,
+    event_json BYTEA NOT NULL,
+    blob_encoding SMALLINT NOT NULL DEFAULT 0
+);
+ALTER TABLE roomserver_event_json ADD COLUMN IF NOT EXISTS blob_hash BYTEA;
+CREATE INDEX IF NOT EXISTS roomserver_event_json_blob_hash_idx ON roomserver_event_json (blob_hash);
+`
+
+// UpEventJSONBlobEncoding adds the blob_encoding column to the event JSON
+// table and converts the event JSON column to BYTEA so that it can hold
+// compressed data. Existing rows are uncompressed, which is what the default
+// encoding means.
+func UpEventJSONBlobEncoding(tx *sql.Tx) error {
+	_, err := tx.Exec(eventJSONBlobEncodingSQL)
+	if err != nil {
+		return fmt.Errorf("failed to add blob_encoding column: %w", err)
+	}
+	var dataType string
+	err = tx.QueryRow(
+		"SELECT data_type FROM information_schema.columns" +
+			" WHERE table_name = 'roomserver_event_json' AND column_name = 'event_json'",
+	).Scan(&dataType)
+	if err != nil {
+		return fmt.Errorf("failed to look up event_json column type: %w", err)
+	}
+	if dataType == "bytea" {
+		return nil
+	}
+	logrus.Warn("Converting event JSON storage to BYTEA. Please wait, this may take some time!")
+	defer logrus.Warn("Event JSON storage conversion complete")
+	_, err = tx.Exec(eventJSONByteaSQL)
+	if err != nil {
+		return fmt.Errorf("failed to convert event_json column: %w", err)
+	}
+	return nil
+}
@@ -18,8 +18,12 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strings"
 
+	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -31,32 +35,177 @@ const eventJSONSchema = `
 CREATE TABLE IF NOT EXISTS roomserver_event_json (
     -- Local numeric ID for the event.
     event_nid BIGINT NOT NULL PRIMARY KEY,
-    -- The JSON for the event.
-    -- Stored as TEXT because this should be valid UTF-8.
+    -- The JSON for the event, encoded according to blob_encoding.
+    -- Stored as BYTEA because the JSON may be compressed.
     -- Not stored as a JSONB because we always just pull the entire event
     -- so there is no point in postgres parsing it.
     -- Not stored as JSON because we already validate the JSON in the server
     -- so there is no point in postgres validating it.
-    -- TODO: Should we be compressing the events with Snappy or DEFLATE?
-    event_json TEXT NOT NULL
+    event_json BYTEA NOT NULL,
+    -- How the event JSON is encoded: 0 for uncompressed, 1 for gzip and
+    -- 2 for zstd. Rows with different encodings can coexist.
+    blob_encoding SMALLINT NOT NULL DEFAULT 0,
+    -- If set then the event JSON is deduplicated: it is stored in the blobs
+    -- table under this hash, and event_json is empty.
+    blob_hash BYTEA
+);
+
+-- Stores event JSON which is shared by every event with byte-identical JSON.
+CREATE TABLE IF NOT EXISTS roomserver_event_json_blobs (
+    -- The SHA-256 hash of the event JSON before it was encoded.
+    hash BYTEA NOT NULL PRIMARY KEY,
+    -- The JSON for the event, encoded according to blob_encoding.
+    event_json BYTEA NOT NULL,
+    blob_encoding SMALLINT NOT NULL DEFAULT 0
 );
 `
 
+// Rows which are deduplicated have a blob_hash and read their event JSON from
+// the blobs table. Other rows, including those written before deduplication
+// was enabled, hold their event JSON inline.
+const eventJSONWithBlobs = "" +
+	"roomserver_event_json j LEFT JOIN roomserver_event_json_blobs b ON j.blob_hash = b.hash"
+
+const eventJSONColumns = "" +
+	"j.event_nid, COALESCE(b.event_json, j.event_json), COALESCE(b.blob_encoding, j.blob_encoding)"
+
 const insertEventJSONSQL = "" +
-	"INSERT INTO roomserver_event_json (event_nid, event_json) VALUES ($1, $2)" +
-	" ON CONFLICT (event_nid) DO UPDATE SET event_json=$2"
+	"INSERT INTO roomserver_event_json (event_nid, event_json, blob_encoding) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (event_nid) DO UPDATE SET event_json=$2, blob_encoding=$3, blob_hash=NULL"
+
+// The ($1, $2, $3) is replaced with one tuple of placeholders per row.
+const bulkInsertEventJSONSQL = "" +
+	"INSERT INTO roomserver_event_json (event_nid, event_json, blob_encoding) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (event_nid) DO NOTHING"
+
+const purgeEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid = ANY($1) RETURNING blob_hash"
+
+const insertEventJSONBlobSQL = "" +
+	"INSERT INTO roomserver_event_json_blobs (hash, event_json, blob_encoding) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (hash) DO NOTHING"
+
+const insertEventJSONBlobLinkSQL = "" +
+	"INSERT INTO roomserver_event_json (event_nid, event_json, blob_encoding, blob_hash) VALUES ($1, '', 0, $2)" +
+	" ON CONFLICT (event_nid) DO UPDATE SET event_json='', blob_encoding=0, blob_hash=$2"
+
+// The ($1, $2, $3) is replaced with one tuple of placeholders per row.
+const bulkInsertEventJSONBlobSQL = "" +
+	"INSERT INTO roomserver_event_json_blobs (hash, event_json, blob_encoding) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (hash) DO NOTHING"
+
+// The ($1, $2, $3, $4) is replaced with one tuple of placeholders per row.
+const bulkInsertEventJSONBlobLinkSQL = "" +
+	"INSERT INTO roomserver_event_json (event_nid, event_json, blob_encoding, blob_hash) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (event_nid) DO NOTHING"
+
+// Deletes the blob that an event links to, unless another event links to it
+// too. This must happen before the event JSON is replaced, e.g. by a redaction,
+// so that the old event JSON doesn't linger in the blobs table.
+const deleteReplacedEventJSONBlobSQL = "" +
+	"DELETE FROM roomserver_event_json_blobs WHERE hash = (" +
+	" SELECT blob_hash FROM roomserver_event_json WHERE event_nid = $1" +
+	") AND (" +
+	" SELECT COUNT(*) FROM roomserver_event_json WHERE blob_hash = roomserver_event_json_blobs.hash" +
+	") = 1"
+
+const deleteOrphanedEventJSONBlobsSQL = "" +
+	"DELETE FROM roomserver_event_json_blobs WHERE hash = ANY($1) AND NOT EXISTS (" +
+	" SELECT 1 FROM roomserver_event_json WHERE blob_hash = roomserver_event_json_blobs.hash" +
+	")"
+
+// The COPY import goes via a temporary table so that rows which conflict with
+// existing event JSON can be skipped, which COPY doesn't support by itself.
+const createEventJSONImportTableSQL = "" +
+	"CREATE TEMPORARY TABLE roomserver_event_json_import (" +
+	" event_nid BIGINT NOT NULL, event_json BYTEA NOT NULL, blob_encoding SMALLINT NOT NULL" +
+	") ON COMMIT DROP"
+
+const insertEventJSONFromImportSQL = "" +
+	"INSERT INTO roomserver_event_json (event_nid, event_json, blob_encoding)" +
+	" SELECT DISTINCT ON (event_nid) event_nid, event_json, blob_encoding FROM roomserver_event_json_import" +
+	" ON CONFLICT (event_nid) DO NOTHING"
+
+const dropEventJSONImportTableSQL = "" +
+	"DROP TABLE roomserver_event_json_import"
 
 // Bulk event JSON lookup by numeric event ID.
 // Sort by the numeric event ID.
 // This means that we can use binary search to lookup by numeric event ID.
 const bulkSelectEventJSONSQL = "" +
-	"SELECT event_nid, event_json FROM roomserver_event_json" +
-	" WHERE event_nid = ANY($1)" +
-	" ORDER BY event_nid ASC"
+	"SELECT " + eventJSONColumns + " FROM " + eventJSONWithBlobs +
+	" WHERE j.event_nid = ANY($1)" +
+	" ORDER BY j.event_nid ASC"
+
+// The total size of the stored event JSON in bytes, after compression.
+const selectEventJSONSizeSQL = "" +
+	"SELECT (SELECT COALESCE(SUM(LENGTH(event_json)), 0) FROM roomserver_event_json)" +
+	" + (SELECT COALESCE(SUM(LENGTH(event_json)), 0) FROM roomserver_event_json_blobs)"
+
+// The number of events in a room and the total size of their event JSON in bytes, after compression.
+// Deduplicated event JSON is counted once for every event which uses it.
+const selectRoomEventJSONSizeSQL = "" +
+	"SELECT COUNT(*), COALESCE(SUM(LENGTH(COALESCE(b.event_json, j.event_json))), 0) FROM " + eventJSONWithBlobs +
+	" JOIN roomserver_events e ON j.event_nid = e.event_nid" +
+	" WHERE e.room_nid = $1"
+
+// Event JSON for all events in a room, for iterating over with a cursor.
+// Sorting by the numeric event ID lets an interrupted iteration be resumed.
+const selectEventJSONCursorSQL = "" +
+	"SELECT " + eventJSONColumns + " FROM " + eventJSONWithBlobs +
+	" JOIN roomserver_events e ON j.event_nid = e.event_nid" +
+	" WHERE e.room_nid = $1 AND j.event_nid > $2" +
+	" ORDER BY j.event_nid ASC"
+
+// Event JSON either side of an event NID, for paging through the table.
+// Both queries are range scans over the primary key.
+const selectEventJSONRangeAscSQL = "" +
+	"SELECT " + eventJSONColumns + " FROM " + eventJSONWithBlobs +
+	" WHERE j.event_nid > $1 ORDER BY j.event_nid ASC LIMIT $2"
+
+const selectEventJSONRangeDescSQL = "" +
+	"SELECT " + eventJSONColumns + " FROM " + eventJSONWithBlobs +
+	" WHERE j.event_nid < $1 ORDER BY j.event_nid DESC LIMIT $2"
+
+const selectMaxEventNIDSQL = "" +
+	"SELECT COALESCE(MAX(event_nid), 0) FROM (" +
+	" SELECT MAX(event_nid) AS event_nid FROM roomserver_events" +
+	" UNION ALL SELECT MAX(event_nid) AS event_nid FROM roomserver_event_json" +
+	") AS max_event_nids"
+
+// Anti-joins which find events without event JSON, and event JSON without events.
+// These are used to check the integrity of the database a range of NIDs at a time.
+const selectEventNIDsMissingJSONSQL = "" +
+	"SELECT e.event_nid FROM roomserver_events e" +
+	" LEFT JOIN roomserver_event_json j ON e.event_nid = j.event_nid" +
+	" WHERE e.event_nid > $1 AND e.event_nid <= $2 AND j.event_nid IS NULL" +
+	" ORDER BY e.event_nid ASC"
+
+const selectEventJSONNIDsMissingEventSQL = "" +
+	"SELECT j.event_nid FROM roomserver_event_json j" +
+	" LEFT JOIN roomserver_events e ON j.event_nid = e.event_nid" +
+	" WHERE j.event_nid > $1 AND j.event_nid <= $2 AND e.event_nid IS NULL" +
+	" ORDER BY j.event_nid ASC"
 
 type eventJSONStatements struct {
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	db                                  *sql.DB
+	encoding                            shared.EventJSONEncoding
+	deduplicate                         bool
+	insertEventJSONStmt                 *sqlutil.Stmt
+	insertEventJSONBlobStmt             *sqlutil.Stmt
+	insertEventJSONBlobLinkStmt         *sqlutil.Stmt
+	deleteReplacedEventJSONBlobStmt     *sqlutil.Stmt
+	deleteOrphanedEventJSONBlobsStmt    *sqlutil.Stmt
+	bulkSelectEventJSONStmt             *sqlutil.Stmt
+	selectEventJSONSizeStmt             *sqlutil.Stmt
+	selectRoomEventJSONSizeStmt         *sqlutil.Stmt
+	selectEventJSONCursorStmt           *sqlutil.Stmt
+	selectEventJSONRangeAscStmt         *sqlutil.Stmt
+	selectEventJSONRangeDescStmt        *sqlutil.Stmt
+	selectMaxEventNIDStmt               *sqlutil.Stmt
+	selectEventNIDsMissingJSONStmt      *sqlutil.Stmt
+	selectEventJSONNIDsMissingEventStmt *sqlutil.Stmt
+	purgeEventJSONStmt                  *sqlutil.Stmt
 }
 
 func createEventJSONTable(db *sql.DB) error {
@@ -64,44 +213,334 @@ func createEventJSONTable(db *sql.DB) error {
 	return err
 }
 
-func prepareEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
-	s := &eventJSONStatements{}
+func prepareEventJSONTable(db *sql.DB, encoding shared.EventJSONEncoding, deduplicate bool) (*eventJSONStatements, error) {
+	s := &eventJSONStatements{
+		db:          db,
+		encoding:    encoding,
+		deduplicate: deduplicate,
+	}
 
 	return s, shared.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
+		{&s.insertEventJSONBlobStmt, insertEventJSONBlobSQL},
+		{&s.insertEventJSONBlobLinkStmt, insertEventJSONBlobLinkSQL},
+		{&s.deleteReplacedEventJSONBlobStmt, deleteReplacedEventJSONBlobSQL},
+		{&s.deleteOrphanedEventJSONBlobsStmt, deleteOrphanedEventJSONBlobsSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.selectEventJSONSizeStmt, selectEventJSONSizeSQL},
+		{&s.selectRoomEventJSONSizeStmt, selectRoomEventJSONSizeSQL},
+		{&s.selectEventJSONCursorStmt, selectEventJSONCursorSQL},
+		{&s.selectEventJSONRangeAscStmt, selectEventJSONRangeAscSQL},
+		{&s.selectEventJSONRangeDescStmt, selectEventJSONRangeDescSQL},
+		{&s.selectMaxEventNIDStmt, selectMaxEventNIDSQL},
+		{&s.selectEventNIDsMissingJSONStmt, selectEventNIDsMissingJSONSQL},
+		{&s.selectEventJSONNIDsMissingEventStmt, selectEventJSONNIDsMissingEventSQL},
+		{&s.purgeEventJSONStmt, purgeEventJSONSQL},
 	}.Prepare(db)
 }
 
 func (s *eventJSONStatements) InsertEventJSON(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
 ) error {
-	_, err := s.insertEventJSONStmt.ExecContext(ctx, int64(eventNID), eventJSON)
+	encoded, err := s.encoding.Encode(eventJSON)
+	if err != nil {
+		return err
+	}
+	if _, err = s.deleteReplacedEventJSONBlobStmt.WithTx(txn).ExecContext(ctx, int64(eventNID)); err != nil {
+		return err
+	}
+	if !s.deduplicate {
+		_, err = s.insertEventJSONStmt.WithTx(txn).ExecContext(ctx, int64(eventNID), encoded, s.encoding)
+		return err
+	}
+	hash := shared.HashEventJSON(eventJSON)
+	if _, err = s.insertEventJSONBlobStmt.WithTx(txn).ExecContext(ctx, hash, encoded, s.encoding); err != nil {
+		return err
+	}
+	_, err = s.insertEventJSONBlobLinkStmt.WithTx(txn).ExecContext(ctx, int64(eventNID), hash)
 	return err
 }
 
+func (s *eventJSONStatements) BulkInsertEventJSON(
+	ctx context.Context, txn *sql.Tx, pairs []tables.EventJSONPair,
+) error {
+	if s.deduplicate {
+		return s.bulkInsertEventJSONBlobs(ctx, txn, pairs)
+	}
+	const width = 3
+	const chunkSize = sqlutil.PostgresMaxVariables / width
+	for start := 0; start < len(pairs); start += chunkSize {
+		chunk := pairs[start:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		params := make([]interface{}, 0, len(chunk)*width)
+		for _, pair := range chunk {
+			encoded, err := s.encoding.Encode(pair.EventJSON)
+			if err != nil {
+				return err
+			}
+			params = append(params, int64(pair.EventNID), encoded, s.encoding)
+		}
+		query := strings.Replace(bulkInsertEventJSONSQL, "($1, $2, $3)", sqlutil.QueryVariadicTuples(len(chunk), width), 1)
+		if _, err := execTxn(ctx, s.db, txn, query, params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bulkInsertEventJSONBlobs behaves like BulkInsertEventJSON, but stores the
+// event JSON in the blobs table and links the events to it.
+func (s *eventJSONStatements) bulkInsertEventJSONBlobs(
+	ctx context.Context, txn *sql.Tx, pairs []tables.EventJSONPair,
+) error {
+	const width = 4
+	const chunkSize = sqlutil.PostgresMaxVariables / width
+	for start := 0; start < len(pairs); start += chunkSize {
+		chunk := pairs[start:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		blobParams := make([]interface{}, 0, len(chunk)*3)
+		linkParams := make([]interface{}, 0, len(chunk)*width)
+		hashes := make(pq.ByteaArray, 0, len(chunk))
+		for _, pair := range chunk {
+			encoded, err := s.encoding.Encode(pair.EventJSON)
+			if err != nil {
+				return err
+			}
+			hash := shared.HashEventJSON(pair.EventJSON)
+			blobParams = append(blobParams, hash, encoded, s.encoding)
+			linkParams = append(linkParams, int64(pair.EventNID), []byte{}, shared.EventJSONEncodingNone, hash)
+			hashes = append(hashes, hash)
+		}
+		query := strings.Replace(bulkInsertEventJSONBlobSQL, "($1, $2, $3)", sqlutil.QueryVariadicTuples(len(chunk), 3), 1)
+		if _, err := execTxn(ctx, s.db, txn, query, blobParams...); err != nil {
+			return err
+		}
+		query = strings.Replace(bulkInsertEventJSONBlobLinkSQL, "($1, $2, $3, $4)", sqlutil.QueryVariadicTuples(len(chunk), width), 1)
+		if _, err := execTxn(ctx, s.db, txn, query, linkParams...); err != nil {
+			return err
+		}
+		// Events which already had event JSON weren't linked, so the blobs
+		// for them may not be used by anything.
+		if _, err := s.deleteOrphanedEventJSONBlobsStmt.WithTx(txn).ExecContext(ctx, hashes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execTxn runs the query in the transaction, or directly on the database if
+// there is no transaction.
+func execTxn(ctx context.Context, db *sql.DB, txn *sql.Tx, query string, params ...interface{}) (sql.Result, error) {
+	if txn != nil {
+		return txn.ExecContext(ctx, query, params...)
+	}
+	return db.ExecContext(ctx, query, params...)
+}
+
+// bulkInsertEventJSONCopy behaves like BulkInsertEventJSON but uses COPY, which
+// is much faster for large imports. It must be called within a transaction.
+func (s *eventJSONStatements) bulkInsertEventJSONCopy(
+	ctx context.Context, txn *sql.Tx, pairs []tables.EventJSONPair,
+) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	if s.deduplicate {
+		// The blobs have to be written along with the links to them, which
+		// the import table doesn't support.
+		return s.bulkInsertEventJSONBlobs(ctx, txn, pairs)
+	}
+	if _, err := txn.ExecContext(ctx, createEventJSONImportTableSQL); err != nil {
+		return fmt.Errorf("txn.ExecContext (create): %w", err)
+	}
+	stmt, err := txn.PrepareContext(ctx, pq.CopyIn("roomserver_event_json_import", "event_nid", "event_json", "blob_encoding"))
+	if err != nil {
+		return fmt.Errorf("txn.PrepareContext: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "bulkInsertEventJSONCopy: stmt.close() failed")
+	for _, pair := range pairs {
+		encoded, err := s.encoding.Encode(pair.EventJSON)
+		if err != nil {
+			return err
+		}
+		if _, err = stmt.ExecContext(ctx, int64(pair.EventNID), encoded, int64(s.encoding)); err != nil {
+			return fmt.Errorf("stmt.ExecContext: %w", err)
+		}
+	}
+	// An empty exec flushes the buffered rows to the server.
+	if _, err = stmt.ExecContext(ctx); err != nil {
+		return fmt.Errorf("stmt.ExecContext (flush): %w", err)
+	}
+	if _, err = txn.ExecContext(ctx, insertEventJSONFromImportSQL); err != nil {
+		return fmt.Errorf("txn.ExecContext (insert): %w", err)
+	}
+	if _, err = txn.ExecContext(ctx, dropEventJSONImportTableSQL); err != nil {
+		return fmt.Errorf("txn.ExecContext (drop): %w", err)
+	}
+	return nil
+}
+
 func (s *eventJSONStatements) BulkSelectEventJSON(
 	ctx context.Context, eventNIDs []types.EventNID,
 ) ([]tables.EventJSONPair, error) {
-	rows, err := s.bulkSelectEventJSONStmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
+	// The event NIDs are passed as a single array parameter, but very large
+	// arrays are still split up so that each query stays a reasonable size.
+	return shared.ChunkedBulkSelectEventJSON(
+		eventNIDs, sqlutil.PostgresMaxVariables,
+		func(chunk []types.EventNID, results []tables.EventJSONPair) ([]tables.EventJSONPair, error) {
+			return s.bulkSelectEventJSONChunk(ctx, nil, chunk, results)
+		},
+	)
+}
+
+func (s *eventJSONStatements) BulkSelectEventJSONInOrder(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) ([]*tables.EventJSONPair, error) {
+	return shared.ChunkedBulkSelectEventJSONInOrder(
+		eventNIDs, sqlutil.PostgresMaxVariables,
+		func(chunk []types.EventNID, results []tables.EventJSONPair) ([]tables.EventJSONPair, error) {
+			return s.bulkSelectEventJSONChunk(ctx, txn, chunk, results)
+		},
+	)
+}
+
+func (s *eventJSONStatements) bulkSelectEventJSONChunk(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID, results []tables.EventJSONPair,
+) ([]tables.EventJSONPair, error) {
+	rows, err := s.bulkSelectEventJSONStmt.WithTx(txn).QueryContext(ctx, eventNIDsAsArray(eventNIDs))
 	if err != nil {
 		return nil, err
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectEventJSON: rows.close() failed")
 
-	// We know that we will only get as many results as event NIDs
-	// because of the unique constraint on event NIDs.
-	// So we can allocate an array of the correct size now.
-	// We might get fewer results than NIDs so we adjust the length of the slice before returning it.
-	results := make([]tables.EventJSONPair, len(eventNIDs))
-	i := 0
-	for ; rows.Next(); i++ {
-		result := &results[i]
+	for rows.Next() {
+		var eventNID int64
+		var data []byte
+		var encoding shared.EventJSONEncoding
+		if err := rows.Scan(&eventNID, &data, &encoding); err != nil {
+			return nil, err
+		}
+		result := tables.EventJSONPair{EventNID: types.EventNID(eventNID)}
+		if result.EventJSON, err = encoding.Decode(data); err != nil {
+			return nil, fmt.Errorf("failed to decode event JSON for event NID %d: %w", eventNID, err)
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *eventJSONStatements) PurgeEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) (int64, error) {
+	// The event NIDs are passed as a single array parameter, so there is no
+	// need to chunk them to stay within the bind parameter limit.
+	rows, err := s.purgeEventJSONStmt.WithTx(txn).QueryContext(ctx, eventNIDsAsArray(eventNIDs))
+	if err != nil {
+		return 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "purgeEventJSON: rows.close() failed")
+	var purged int64
+	var hashes pq.ByteaArray
+	for rows.Next() {
+		var hash []byte
+		if err = rows.Scan(&hash); err != nil {
+			return purged, err
+		}
+		purged++
+		if hash != nil {
+			hashes = append(hashes, hash)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return purged, err
+	}
+	if len(hashes) > 0 {
+		if _, err = s.deleteOrphanedEventJSONBlobsStmt.WithTx(txn).ExecContext(ctx, hashes); err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (s *eventJSONStatements) SelectEventJSONSize(ctx context.Context) (size int64, err error) {
+	err = s.selectEventJSONSizeStmt.QueryRowContext(ctx).Scan(&size)
+	return
+}
+
+func (s *eventJSONStatements) SelectRoomEventJSONSize(
+	ctx context.Context, roomNID types.RoomNID,
+) (count int64, size int64, err error) {
+	err = s.selectRoomEventJSONSizeStmt.QueryRowContext(ctx, int64(roomNID)).Scan(&count, &size)
+	return
+}
+
+func (s *eventJSONStatements) SelectEventJSONCursor(
+	ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID,
+) (tables.EventJSONCursor, error) {
+	rows, err := s.selectEventJSONCursorStmt.QueryContext(ctx, int64(roomNID), int64(afterEventNID))
+	if err != nil {
+		return nil, err
+	}
+	return shared.NewEventJSONCursor(rows), nil
+}
+
+func (s *eventJSONStatements) SelectEventJSONRange(
+	ctx context.Context, fromNID types.EventNID, limit int, ascending bool,
+) ([]tables.EventJSONPair, error) {
+	limit, err := tables.CheckEventJSONRangeLimit(limit)
+	if err != nil {
+		return nil, err
+	}
+	stmt := s.selectEventJSONRangeDescStmt
+	if ascending {
+		stmt = s.selectEventJSONRangeAscStmt
+	}
+	rows, err := stmt.QueryContext(ctx, int64(fromNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	return shared.ReadEventJSONPairs(shared.NewEventJSONCursor(rows), limit)
+}
+
+func (s *eventJSONStatements) SelectMaxEventNID(
+	ctx context.Context, txn *sql.Tx,
+) (types.EventNID, error) {
+	var eventNID int64
+	err := s.selectMaxEventNIDStmt.WithTx(txn).QueryRowContext(ctx).Scan(&eventNID)
+	return types.EventNID(eventNID), err
+}
+
+func (s *eventJSONStatements) SelectEventNIDsMissingJSON(
+	ctx context.Context, txn *sql.Tx, fromNID, toNID types.EventNID,
+) ([]types.EventNID, error) {
+	return selectEventNIDRange(ctx, s.selectEventNIDsMissingJSONStmt.WithTx(txn), fromNID, toNID)
+}
+
+func (s *eventJSONStatements) SelectEventJSONNIDsMissingEvent(
+	ctx context.Context, txn *sql.Tx, fromNID, toNID types.EventNID,
+) ([]types.EventNID, error) {
+	return selectEventNIDRange(ctx, s.selectEventJSONNIDsMissingEventStmt.WithTx(txn), fromNID, toNID)
+}
+
+func selectEventNIDRange(
+	ctx context.Context, stmt *sqlutil.Stmt, fromNID, toNID types.EventNID,
+) ([]types.EventNID, error) {
+	rows, err := stmt.QueryContext(ctx, int64(fromNID), int64(toNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventNIDRange: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
 		var eventNID int64
-		if err := rows.Scan(&eventNID, &result.EventJSON); err != nil {
+		if err = rows.Scan(&eventNID); err != nil {
 			return nil, err
 		}
-		result.EventNID = types.EventNID(eventNID)
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
 	}
-	return results[:i], rows.Err()
+	return eventNIDs, rows.Err()
 }
@@ -71,10 +71,10 @@ const bulkSelectEventStateKeySQL = "" +
 	" WHERE event_state_key_nid = ANY($1)"
 
 type eventStateKeyStatements struct {
-	insertEventStateKeyNIDStmt     *sql.Stmt
-	selectEventStateKeyNIDStmt     *sql.Stmt
-	bulkSelectEventStateKeyNIDStmt *sql.Stmt
-	bulkSelectEventStateKeyStmt    *sql.Stmt
+	insertEventStateKeyNIDStmt     *sqlutil.Stmt
+	selectEventStateKeyNIDStmt     *sqlutil.Stmt
+	bulkSelectEventStateKeyNIDStmt *sqlutil.Stmt
+	bulkSelectEventStateKeyStmt    *sqlutil.Stmt
 }
 
 func createEventStateKeysTable(db *sql.DB) error {
@@ -97,7 +97,7 @@ func (s *eventStateKeyStatements) InsertEventStateKeyNID(
 	ctx context.Context, txn *sql.Tx, eventStateKey string,
 ) (types.EventStateKeyNID, error) {
 	var eventStateKeyNID int64
-	stmt := sqlutil.TxStmt(txn, s.insertEventStateKeyNIDStmt)
+	stmt := s.insertEventStateKeyNIDStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, eventStateKey).Scan(&eventStateKeyNID)
 	return types.EventStateKeyNID(eventStateKeyNID), err
 }
@@ -106,7 +106,7 @@ func (s *eventStateKeyStatements) SelectEventStateKeyNID(
 	ctx context.Context, txn *sql.Tx, eventStateKey string,
 ) (types.EventStateKeyNID, error) {
 	var eventStateKeyNID int64
-	stmt := sqlutil.TxStmt(txn, s.selectEventStateKeyNIDStmt)
+	stmt := s.selectEventStateKeyNIDStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, eventStateKey).Scan(&eventStateKeyNID)
 	return types.EventStateKeyNID(eventStateKeyNID), err
 }
@@ -95,9 +95,9 @@ const bulkSelectEventTypeNIDSQL = "" +
 	" WHERE event_type = ANY($1)"
 
 type eventTypeStatements struct {
-	insertEventTypeNIDStmt     *sql.Stmt
-	selectEventTypeNIDStmt     *sql.Stmt
-	bulkSelectEventTypeNIDStmt *sql.Stmt
+	insertEventTypeNIDStmt     *sqlutil.Stmt
+	selectEventTypeNIDStmt     *sqlutil.Stmt
+	bulkSelectEventTypeNIDStmt *sqlutil.Stmt
 }
 
 func createEventTypesTable(db *sql.DB) error {
@@ -119,7 +119,7 @@ func (s *eventTypeStatements) InsertEventTypeNID(
 	ctx context.Context, txn *sql.Tx, eventType string,
 ) (types.EventTypeNID, error) {
 	var eventTypeNID int64
-	stmt := sqlutil.TxStmt(txn, s.insertEventTypeNIDStmt)
+	stmt := s.insertEventTypeNIDStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, eventType).Scan(&eventTypeNID)
 	return types.EventTypeNID(eventTypeNID), err
 }
@@ -128,7 +128,7 @@ func (s *eventTypeStatements) SelectEventTypeNID(
 	ctx context.Context, txn *sql.Tx, eventType string,
 ) (types.EventTypeNID, error) {
 	var eventTypeNID int64
-	stmt := sqlutil.TxStmt(txn, s.selectEventTypeNIDStmt)
+	stmt := s.selectEventTypeNIDStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, eventType).Scan(&eventTypeNID)
 	return types.EventTypeNID(eventTypeNID), err
 }
@@ -67,13 +67,17 @@ CREATE TABLE IF NOT EXISTS roomserver_events (
     reference_sha256 BYTEA NOT NULL,
     -- A list of numeric IDs for events that can authenticate this event.
 	auth_event_nids BIGINT[] NOT NULL,
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	-- Whether the event was soft-failed, i.e. it passed auth against its own
+	-- auth events but not against the current room state. Soft-failed events
+	-- are used for state resolution but not served in timelines.
+	soft_failed BOOLEAN NOT NULL DEFAULT FALSE
 );
 `
 
 const insertEventSQL = "" +
-	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected)" +
-	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	"INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected, soft_failed)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
 	" ON CONFLICT ON CONSTRAINT roomserver_event_id_unique" +
 	" DO NOTHING" +
 	" RETURNING event_nid, state_snapshot_nid"
@@ -134,22 +138,30 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid = ANY($1)"
 
+const selectEventNIDsForRoomSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1"
+
+const bulkSelectSoftFailedSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE soft_failed = TRUE AND event_nid = ANY($1)"
+
 type eventStatements struct {
-	insertEventStmt                        *sql.Stmt
-	selectEventStmt                        *sql.Stmt
-	bulkSelectStateEventByIDStmt           *sql.Stmt
-	bulkSelectStateEventByNIDStmt          *sql.Stmt
-	bulkSelectStateAtEventByIDStmt         *sql.Stmt
-	updateEventStateStmt                   *sql.Stmt
-	selectEventSentToOutputStmt            *sql.Stmt
-	updateEventSentToOutputStmt            *sql.Stmt
-	selectEventIDStmt                      *sql.Stmt
-	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
-	bulkSelectEventReferenceStmt           *sql.Stmt
-	bulkSelectEventIDStmt                  *sql.Stmt
-	bulkSelectEventNIDStmt                 *sql.Stmt
-	selectMaxEventDepthStmt                *sql.Stmt
-	selectRoomNIDsForEventNIDsStmt         *sql.Stmt
+	insertEventStmt                        *sqlutil.Stmt
+	selectEventStmt                        *sqlutil.Stmt
+	bulkSelectStateEventByIDStmt           *sqlutil.Stmt
+	bulkSelectStateEventByNIDStmt          *sqlutil.Stmt
+	bulkSelectStateAtEventByIDStmt         *sqlutil.Stmt
+	updateEventStateStmt                   *sqlutil.Stmt
+	selectEventSentToOutputStmt            *sqlutil.Stmt
+	updateEventSentToOutputStmt            *sqlutil.Stmt
+	selectEventIDStmt                      *sqlutil.Stmt
+	bulkSelectStateAtEventAndReferenceStmt *sqlutil.Stmt
+	bulkSelectEventReferenceStmt           *sqlutil.Stmt
+	bulkSelectEventIDStmt                  *sqlutil.Stmt
+	bulkSelectEventNIDStmt                 *sqlutil.Stmt
+	selectMaxEventDepthStmt                *sqlutil.Stmt
+	selectRoomNIDsForEventNIDsStmt         *sqlutil.Stmt
+	selectEventNIDsForRoomStmt             *sqlutil.Stmt
+	bulkSelectSoftFailedStmt               *sqlutil.Stmt
 }
 
 func createEventsTable(db *sql.DB) error {
@@ -176,6 +188,8 @@ func prepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
 		{&s.selectMaxEventDepthStmt, selectMaxEventDepthSQL},
 		{&s.selectRoomNIDsForEventNIDsStmt, selectRoomNIDsForEventNIDsSQL},
+		{&s.selectEventNIDsForRoomStmt, selectEventNIDsForRoomSQL},
+		{&s.bulkSelectSoftFailedStmt, bulkSelectSoftFailedSQL},
 	}.Prepare(db)
 }
 
@@ -190,13 +204,14 @@ func (s *eventStatements) InsertEvent(
 	authEventNIDs []types.EventNID,
 	depth int64,
 	isRejected bool,
+	isSoftFailed bool,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
 	err := s.insertEventStmt.QueryRowContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
 		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth,
-		isRejected,
+		isRejected, isSoftFailed,
 	).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -332,7 +347,7 @@ func (s *eventStatements) BulkSelectStateAtEventByID(
 func (s *eventStatements) UpdateEventState(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, stateNID types.StateSnapshotNID,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.updateEventStateStmt)
+	stmt := s.updateEventStateStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, int64(eventNID), int64(stateNID))
 	return err
 }
@@ -340,13 +355,13 @@ func (s *eventStatements) UpdateEventState(
 func (s *eventStatements) SelectEventSentToOutput(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (sentToOutput bool, err error) {
-	stmt := sqlutil.TxStmt(txn, s.selectEventSentToOutputStmt)
+	stmt := s.selectEventSentToOutputStmt.WithTx(txn)
 	err = stmt.QueryRowContext(ctx, int64(eventNID)).Scan(&sentToOutput)
 	return
 }
 
 func (s *eventStatements) UpdateEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error {
-	stmt := sqlutil.TxStmt(txn, s.updateEventSentToOutputStmt)
+	stmt := s.updateEventSentToOutputStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, int64(eventNID))
 	return err
 }
@@ -354,7 +369,7 @@ func (s *eventStatements) UpdateEventSentToOutput(ctx context.Context, txn *sql.
 func (s *eventStatements) SelectEventID(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (eventID string, err error) {
-	stmt := sqlutil.TxStmt(txn, s.selectEventIDStmt)
+	stmt := s.selectEventIDStmt.WithTx(txn)
 	err = stmt.QueryRowContext(ctx, int64(eventNID)).Scan(&eventID)
 	return
 }
@@ -362,7 +377,7 @@ func (s *eventStatements) SelectEventID(
 func (s *eventStatements) BulkSelectStateAtEventAndReference(
 	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
 ) ([]types.StateAtEventAndReference, error) {
-	stmt := sqlutil.TxStmt(txn, s.bulkSelectStateAtEventAndReferenceStmt)
+	stmt := s.bulkSelectStateAtEventAndReferenceStmt.WithTx(txn)
 	rows, err := stmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
 	if err != nil {
 		return nil, err
@@ -502,6 +517,25 @@ func (s *eventStatements) SelectRoomNIDsForEventNIDs(
 	return result, nil
 }
 
+func (s *eventStatements) SelectEventNIDsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.EventNID, error) {
+	rows, err := s.selectEventNIDsForRoomStmt.WithTx(txn).QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventNIDsForRoom: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
 	nids := make([]int64, len(eventNIDs))
 	for i := range eventNIDs {
@@ -509,3 +543,20 @@ func eventNIDsAsArray(eventNIDs []types.EventNID) pq.Int64Array {
 	}
 	return nids
 }
+
+func (s *eventStatements) BulkSelectSoftFailed(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]bool, error) {
+	rows, err := s.bulkSelectSoftFailedStmt.QueryContext(ctx, eventNIDsAsArray(eventNIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectSoftFailed: rows.close() failed")
+	results := make(map[types.EventNID]bool)
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		results[types.EventNID(eventNID)] = true
+	}
+	return results, rows.Err()
+}
@@ -77,9 +77,9 @@ const updateInviteRetiredSQL = "" +
 	" RETURNING invite_event_id"
 
 type inviteStatements struct {
-	insertInviteEventStmt               *sql.Stmt
-	selectInviteActiveForUserInRoomStmt *sql.Stmt
-	updateInviteRetiredStmt             *sql.Stmt
+	insertInviteEventStmt               *sqlutil.Stmt
+	selectInviteActiveForUserInRoomStmt *sqlutil.Stmt
+	updateInviteRetiredStmt             *sqlutil.Stmt
 }
 
 func createInvitesTable(db *sql.DB) error {
@@ -103,7 +103,7 @@ func (s *inviteStatements) InsertInviteEvent(
 	targetUserNID, senderUserNID types.EventStateKeyNID,
 	inviteEventJSON []byte,
 ) (bool, error) {
-	result, err := sqlutil.TxStmt(txn, s.insertInviteEventStmt).ExecContext(
+	result, err := s.insertInviteEventStmt.WithTx(txn).ExecContext(
 		ctx, inviteEventID, roomNID, targetUserNID, senderUserNID, inviteEventJSON,
 	)
 	if err != nil {
@@ -120,7 +120,7 @@ func (s *inviteStatements) UpdateInviteRetired(
 	ctx context.Context,
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 ) ([]string, error) {
-	stmt := sqlutil.TxStmt(txn, s.updateInviteRetiredStmt)
+	stmt := s.updateInviteRetiredStmt.WithTx(txn)
 	rows, err := stmt.QueryContext(ctx, roomNID, targetUserNID)
 	if err != nil {
 		return nil, err
@@ -125,18 +125,18 @@ var selectKnownUsersSQL = "" +
 	") AND membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) + " AND event_state_key LIKE $2 LIMIT $3"
 
 type membershipStatements struct {
-	insertMembershipStmt                            *sql.Stmt
-	selectMembershipForUpdateStmt                   *sql.Stmt
-	selectMembershipFromRoomAndTargetStmt           *sql.Stmt
-	selectMembershipsFromRoomAndMembershipStmt      *sql.Stmt
-	selectLocalMembershipsFromRoomAndMembershipStmt *sql.Stmt
-	selectMembershipsFromRoomStmt                   *sql.Stmt
-	selectLocalMembershipsFromRoomStmt              *sql.Stmt
-	updateMembershipStmt                            *sql.Stmt
-	selectRoomsWithMembershipStmt                   *sql.Stmt
-	selectJoinedUsersSetForRoomsStmt                *sql.Stmt
-	selectKnownUsersStmt                            *sql.Stmt
-	updateMembershipForgetRoomStmt                  *sql.Stmt
+	insertMembershipStmt                            *sqlutil.Stmt
+	selectMembershipForUpdateStmt                   *sqlutil.Stmt
+	selectMembershipFromRoomAndTargetStmt           *sqlutil.Stmt
+	selectMembershipsFromRoomAndMembershipStmt      *sqlutil.Stmt
+	selectLocalMembershipsFromRoomAndMembershipStmt *sqlutil.Stmt
+	selectMembershipsFromRoomStmt                   *sqlutil.Stmt
+	selectLocalMembershipsFromRoomStmt              *sqlutil.Stmt
+	updateMembershipStmt                            *sqlutil.Stmt
+	selectRoomsWithMembershipStmt                   *sqlutil.Stmt
+	selectJoinedUsersSetForRoomsStmt                *sqlutil.Stmt
+	selectKnownUsersStmt                            *sqlutil.Stmt
+	updateMembershipForgetRoomStmt                  *sqlutil.Stmt
 }
 
 func createMembershipTable(db *sql.DB) error {
@@ -168,7 +168,7 @@ func (s *membershipStatements) InsertMembership(
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 	localTarget bool,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.insertMembershipStmt)
+	stmt := s.insertMembershipStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, roomNID, targetUserNID, localTarget)
 	return err
 }
@@ -177,7 +177,7 @@ func (s *membershipStatements) SelectMembershipForUpdate(
 	ctx context.Context,
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 ) (membership tables.MembershipState, err error) {
-	err = sqlutil.TxStmt(txn, s.selectMembershipForUpdateStmt).QueryRowContext(
+	err = s.selectMembershipForUpdateStmt.WithTx(txn).QueryRowContext(
 		ctx, roomNID, targetUserNID,
 	).Scan(&membership)
 	return
@@ -196,7 +196,7 @@ func (s *membershipStatements) SelectMembershipFromRoomAndTarget(
 func (s *membershipStatements) SelectMembershipsFromRoom(
 	ctx context.Context, roomNID types.RoomNID, localOnly bool,
 ) (eventNIDs []types.EventNID, err error) {
-	var stmt *sql.Stmt
+	var stmt *sqlutil.Stmt
 	if localOnly {
 		stmt = s.selectLocalMembershipsFromRoomStmt
 	} else {
@@ -222,8 +222,8 @@ func (s *membershipStatements) SelectMembershipsFromRoomAndMembership(
 	ctx context.Context,
 	roomNID types.RoomNID, membership tables.MembershipState, localOnly bool,
 ) (eventNIDs []types.EventNID, err error) {
-	var rows *sql.Rows
-	var stmt *sql.Stmt
+	var rows *sqlutil.Rows
+	var stmt *sqlutil.Stmt
 	if localOnly {
 		stmt = s.selectLocalMembershipsFromRoomAndMembershipStmt
 	} else {
@@ -250,7 +250,7 @@ func (s *membershipStatements) UpdateMembership(
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, senderUserNID types.EventStateKeyNID, membership tables.MembershipState,
 	eventNID types.EventNID, forgotten bool,
 ) error {
-	_, err := sqlutil.TxStmt(txn, s.updateMembershipStmt).ExecContext(
+	_, err := s.updateMembershipStmt.WithTx(txn).ExecContext(
 		ctx, roomNID, targetUserNID, senderUserNID, membership, eventNID, forgotten,
 	)
 	return err
@@ -319,7 +319,7 @@ func (s *membershipStatements) UpdateForgetMembership(
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 	forget bool,
 ) error {
-	_, err := sqlutil.TxStmt(txn, s.updateMembershipForgetRoomStmt).ExecContext(
+	_, err := s.updateMembershipForgetRoomStmt.WithTx(txn).ExecContext(
 		ctx, roomNID, targetUserNID, forget,
 	)
 	return err
@@ -61,8 +61,8 @@ const selectPreviousEventExistsSQL = "" +
 	" WHERE previous_event_id = $1 AND previous_reference_sha256 = $2"
 
 type previousEventStatements struct {
-	insertPreviousEventStmt       *sql.Stmt
-	selectPreviousEventExistsStmt *sql.Stmt
+	insertPreviousEventStmt       *sqlutil.Stmt
+	selectPreviousEventExistsStmt *sqlutil.Stmt
 }
 
 func createPrevEventsTable(db *sql.DB) error {
@@ -86,7 +86,7 @@ func (s *previousEventStatements) InsertPreviousEvent(
 	previousEventReferenceSHA256 []byte,
 	eventNID types.EventNID,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.insertPreviousEventStmt)
+	stmt := s.insertPreviousEventStmt.WithTx(txn)
 	_, err := stmt.ExecContext(
 		ctx, previousEventID, previousEventReferenceSHA256, int64(eventNID),
 	)
@@ -99,6 +99,6 @@ func (s *previousEventStatements) SelectPreviousEventExists(
 	ctx context.Context, txn *sql.Tx, eventID string, eventReferenceSHA256 []byte,
 ) error {
 	var ok int64
-	stmt := sqlutil.TxStmt(txn, s.selectPreviousEventExistsStmt)
+	stmt := s.selectPreviousEventExistsStmt.WithTx(txn)
 	return stmt.QueryRowContext(ctx, eventID, eventReferenceSHA256).Scan(&ok)
 }
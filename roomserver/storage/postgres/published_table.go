@@ -45,9 +45,9 @@ const selectPublishedSQL = "" +
 	"SELECT published FROM roomserver_published WHERE room_id = $1"
 
 type publishedStatements struct {
-	upsertPublishedStmt    *sql.Stmt
-	selectAllPublishedStmt *sql.Stmt
-	selectPublishedStmt    *sql.Stmt
+	upsertPublishedStmt    *sqlutil.Stmt
+	selectAllPublishedStmt *sqlutil.Stmt
+	selectPublishedStmt    *sqlutil.Stmt
 }
 
 func createPublishedTable(db *sql.DB) error {
@@ -68,7 +68,7 @@ func preparePublishedTable(db *sql.DB) (tables.Published, error) {
 func (s *publishedStatements) UpsertRoomPublished(
 	ctx context.Context, txn *sql.Tx, roomID string, published bool,
 ) (err error) {
-	stmt := sqlutil.TxStmt(txn, s.upsertPublishedStmt)
+	stmt := s.upsertPublishedStmt.WithTx(txn)
 	_, err = stmt.ExecContext(ctx, roomID, published)
 	return
 }
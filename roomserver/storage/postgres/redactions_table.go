@@ -54,10 +54,10 @@ const markRedactionValidatedSQL = "" +
 	" UPDATE roomserver_redactions SET validated = $2 WHERE redaction_event_id = $1"
 
 type redactionStatements struct {
-	insertRedactionStmt                         *sql.Stmt
-	selectRedactionInfoByRedactionEventIDStmt   *sql.Stmt
-	selectRedactionInfoByEventBeingRedactedStmt *sql.Stmt
-	markRedactionValidatedStmt                  *sql.Stmt
+	insertRedactionStmt                         *sqlutil.Stmt
+	selectRedactionInfoByRedactionEventIDStmt   *sqlutil.Stmt
+	selectRedactionInfoByEventBeingRedactedStmt *sqlutil.Stmt
+	markRedactionValidatedStmt                  *sqlutil.Stmt
 }
 
 func createRedactionsTable(db *sql.DB) error {
@@ -79,7 +79,7 @@ func prepareRedactionsTable(db *sql.DB) (tables.Redactions, error) {
 func (s *redactionStatements) InsertRedaction(
 	ctx context.Context, txn *sql.Tx, info tables.RedactionInfo,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.insertRedactionStmt)
+	stmt := s.insertRedactionStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, info.RedactionEventID, info.RedactsEventID, info.Validated)
 	return err
 }
@@ -88,7 +88,7 @@ func (s *redactionStatements) SelectRedactionInfoByRedactionEventID(
 	ctx context.Context, txn *sql.Tx, redactionEventID string,
 ) (info *tables.RedactionInfo, err error) {
 	info = &tables.RedactionInfo{}
-	stmt := sqlutil.TxStmt(txn, s.selectRedactionInfoByRedactionEventIDStmt)
+	stmt := s.selectRedactionInfoByRedactionEventIDStmt.WithTx(txn)
 	err = stmt.QueryRowContext(ctx, redactionEventID).Scan(
 		&info.RedactionEventID, &info.RedactsEventID, &info.Validated,
 	)
@@ -103,7 +103,7 @@ func (s *redactionStatements) SelectRedactionInfoByEventBeingRedacted(
 	ctx context.Context, txn *sql.Tx, eventID string,
 ) (info *tables.RedactionInfo, err error) {
 	info = &tables.RedactionInfo{}
-	stmt := sqlutil.TxStmt(txn, s.selectRedactionInfoByEventBeingRedactedStmt)
+	stmt := s.selectRedactionInfoByEventBeingRedactedStmt.WithTx(txn)
 	err = stmt.QueryRowContext(ctx, eventID).Scan(
 		&info.RedactionEventID, &info.RedactsEventID, &info.Validated,
 	)
@@ -117,7 +117,7 @@ func (s *redactionStatements) SelectRedactionInfoByEventBeingRedacted(
 func (s *redactionStatements) MarkRedactionValidated(
 	ctx context.Context, txn *sql.Tx, redactionEventID string, validated bool,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.markRedactionValidatedStmt)
+	stmt := s.markRedactionValidatedStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, redactionEventID, validated)
 	return err
 }
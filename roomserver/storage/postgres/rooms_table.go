@@ -84,16 +84,16 @@ const bulkSelectRoomNIDsSQL = "" +
 	"SELECT room_nid FROM roomserver_rooms WHERE room_id = ANY($1)"
 
 type roomStatements struct {
-	insertRoomNIDStmt                  *sql.Stmt
-	selectRoomNIDStmt                  *sql.Stmt
-	selectLatestEventNIDsStmt          *sql.Stmt
-	selectLatestEventNIDsForUpdateStmt *sql.Stmt
-	updateLatestEventNIDsStmt          *sql.Stmt
-	selectRoomVersionsForRoomNIDsStmt  *sql.Stmt
-	selectRoomInfoStmt                 *sql.Stmt
-	selectRoomIDsStmt                  *sql.Stmt
-	bulkSelectRoomIDsStmt              *sql.Stmt
-	bulkSelectRoomNIDsStmt             *sql.Stmt
+	insertRoomNIDStmt                  *sqlutil.Stmt
+	selectRoomNIDStmt                  *sqlutil.Stmt
+	selectLatestEventNIDsStmt          *sqlutil.Stmt
+	selectLatestEventNIDsForUpdateStmt *sqlutil.Stmt
+	updateLatestEventNIDsStmt          *sqlutil.Stmt
+	selectRoomVersionsForRoomNIDsStmt  *sqlutil.Stmt
+	selectRoomInfoStmt                 *sqlutil.Stmt
+	selectRoomIDsStmt                  *sqlutil.Stmt
+	bulkSelectRoomIDsStmt              *sqlutil.Stmt
+	bulkSelectRoomNIDsStmt             *sqlutil.Stmt
 }
 
 func createRoomsTable(db *sql.DB) error {
@@ -139,7 +139,7 @@ func (s *roomStatements) InsertRoomNID(
 	roomID string, roomVersion gomatrixserverlib.RoomVersion,
 ) (types.RoomNID, error) {
 	var roomNID int64
-	stmt := sqlutil.TxStmt(txn, s.insertRoomNIDStmt)
+	stmt := s.insertRoomNIDStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, roomID, roomVersion).Scan(&roomNID)
 	return types.RoomNID(roomNID), err
 }
@@ -161,7 +161,7 @@ func (s *roomStatements) SelectRoomNID(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) (types.RoomNID, error) {
 	var roomNID int64
-	stmt := sqlutil.TxStmt(txn, s.selectRoomNIDStmt)
+	stmt := s.selectRoomNIDStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, roomID).Scan(&roomNID)
 	return types.RoomNID(roomNID), err
 }
@@ -189,7 +189,7 @@ func (s *roomStatements) SelectLatestEventsNIDsForUpdate(
 	var nids pq.Int64Array
 	var lastEventSentNID int64
 	var stateSnapshotNID int64
-	stmt := sqlutil.TxStmt(txn, s.selectLatestEventNIDsForUpdateStmt)
+	stmt := s.selectLatestEventNIDsForUpdateStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, int64(roomNID)).Scan(&nids, &lastEventSentNID, &stateSnapshotNID)
 	if err != nil {
 		return nil, 0, 0, err
@@ -209,7 +209,7 @@ func (s *roomStatements) UpdateLatestEventNIDs(
 	lastEventSentNID types.EventNID,
 	stateSnapshotNID types.StateSnapshotNID,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.updateLatestEventNIDsStmt)
+	stmt := s.updateLatestEventNIDsStmt.WithTx(txn)
 	_, err := stmt.ExecContext(
 		ctx,
 		roomNID,
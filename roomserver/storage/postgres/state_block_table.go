@@ -23,6 +23,7 @@ import (
 
 	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/roomserver/types"
@@ -67,8 +68,8 @@ const bulkSelectStateBlockEntriesSQL = "" +
 	" FROM roomserver_state_block WHERE state_block_nid = ANY($1)"
 
 type stateBlockStatements struct {
-	insertStateDataStmt             *sql.Stmt
-	bulkSelectStateBlockEntriesStmt *sql.Stmt
+	insertStateDataStmt             *sqlutil.Stmt
+	bulkSelectStateBlockEntriesStmt *sqlutil.Stmt
 }
 
 func createStateBlockTable(db *sql.DB) error {
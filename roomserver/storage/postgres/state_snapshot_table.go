@@ -74,8 +74,8 @@ const bulkSelectStateBlockNIDsSQL = "" +
 	" WHERE state_snapshot_nid = ANY($1) ORDER BY state_snapshot_nid ASC"
 
 type stateSnapshotStatements struct {
-	insertStateStmt              *sql.Stmt
-	bulkSelectStateBlockNIDsStmt *sql.Stmt
+	insertStateStmt              *sqlutil.Stmt
+	bulkSelectStateBlockNIDsStmt *sqlutil.Stmt
 }
 
 func createStateSnapshotTable(db *sql.DB) error {
@@ -97,7 +97,7 @@ func (s *stateSnapshotStatements) InsertState(
 ) (stateNID types.StateSnapshotNID, err error) {
 	nids = nids[:util.SortAndUnique(nids)]
 	var id int64
-	err = sqlutil.TxStmt(txn, s.insertStateStmt).QueryRowContext(ctx, nids.Hash(), int64(roomNID), stateBlockNIDsAsArray(nids)).Scan(&id)
+	err = s.insertStateStmt.WithTx(txn).QueryRowContext(ctx, nids.Hash(), int64(roomNID), stateBlockNIDsAsArray(nids)).Scan(&id)
 	if err != nil {
 		return 0, err
 	}
@@ -16,6 +16,7 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 
@@ -26,19 +27,26 @@ import (
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/postgres/deltas"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 	"github.com/matrix-org/dendrite/setup/config"
 )
 
 // A Database is used to store room events and stream offsets.
 type Database struct {
 	shared.Database
+	eventJSON *eventJSONStatements
 }
 
 // Open a postgres database.
-func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (*Database, error) {
+func Open(cfg *config.RoomServer, cache caching.RoomServerCaches) (*Database, error) {
 	var d Database
 	var db *sql.DB
 	var err error
+	dbProperties := &cfg.Database
+	encoding, err := shared.ParseEventJSONCompression(cfg.EventJSONCompression)
+	if err != nil {
+		return nil, err
+	}
 	if db, err = sqlutil.Open(dbProperties); err != nil {
 		return nil, fmt.Errorf("sqlutil.Open: %w", err)
 	}
@@ -57,11 +65,22 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 		return nil, err
 	}
 
+	// Then execute the versioned migrations, which are tracked in the
+	// schema_migrations table.
+	migrator := sqlutil.NewMigrator(db, "roomserver")
+	migrator.AddMigrations(deltas.Migrations()...)
+	if err := migrator.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
 	// Then prepare the statements. Now that the migrations have run, any columns referred
 	// to in the database code should now exist.
-	if err := d.prepare(db, cache); err != nil {
+	if err := d.prepare(db, cache, cfg, encoding); err != nil {
 		return nil, err
 	}
+	if cfg.EventJSONSizeRefreshInterval > 0 {
+		go shared.RefreshEventJSONSizeMetric(d.EventJSONTable, cfg.EventJSONSizeRefreshInterval)
+	}
 
 	return &d, nil
 }
@@ -106,6 +125,9 @@ func (d *Database) create(db *sql.DB) error {
 	if err := createPublishedTable(db); err != nil {
 		return err
 	}
+	if err := createBlockedRoomsTable(db); err != nil {
+		return err
+	}
 	if err := createRedactionsTable(db); err != nil {
 		return err
 	}
@@ -113,7 +135,9 @@ func (d *Database) create(db *sql.DB) error {
 	return nil
 }
 
-func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
+func (d *Database) prepare(
+	db *sql.DB, cache caching.RoomServerCaches, cfg *config.RoomServer, encoding shared.EventJSONEncoding,
+) error {
 	eventStateKeys, err := prepareEventStateKeysTable(db)
 	if err != nil {
 		return err
@@ -122,7 +146,11 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
-	eventJSON, err := prepareEventJSONTable(db)
+	eventJSON, err := prepareEventJSONTable(db, encoding, cfg.EventJSONDeduplication)
+	if err != nil {
+		return err
+	}
+	eventJSONTable, err := shared.WrapEventJSONTable(eventJSON, cfg.EventCacheMaxEntries)
 	if err != nil {
 		return err
 	}
@@ -166,6 +194,10 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
+	blockedRooms, err := prepareBlockedRoomsTable(db)
+	if err != nil {
+		return err
+	}
 	redactions, err := prepareRedactionsTable(db)
 	if err != nil {
 		return err
@@ -176,7 +208,7 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 		Writer:              sqlutil.NewDummyWriter(),
 		EventTypesTable:     eventTypes,
 		EventStateKeysTable: eventStateKeys,
-		EventJSONTable:      eventJSON,
+		EventJSONTable:      eventJSONTable,
 		EventsTable:         events,
 		RoomsTable:          rooms,
 		TransactionsTable:   transactions,
@@ -187,7 +219,24 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 		InvitesTable:        invites,
 		MembershipTable:     membership,
 		PublishedTable:      published,
+		BlockedRoomsTable:   blockedRooms,
 		RedactionsTable:     redactions,
 	}
+	d.eventJSON = eventJSON
+	return nil
+}
+
+// BulkImportEventJSON stores the event JSON using COPY, which is much faster
+// than inserting the rows individually.
+func (d *Database) BulkImportEventJSON(
+	ctx context.Context, pairs []tables.EventJSONPair,
+) error {
+	err := d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.eventJSON.bulkInsertEventJSONCopy(ctx, txn, pairs)
+	})
+	if err != nil {
+		return err
+	}
+	shared.CountEventJSONRowsInserted(len(pairs))
 	return nil
 }
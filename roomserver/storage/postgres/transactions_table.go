@@ -19,6 +19,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/roomserver/storage/shared"
 	"github.com/matrix-org/dendrite/roomserver/storage/tables"
 )
@@ -50,8 +51,8 @@ const selectTransactionEventIDSQL = "" +
 	" WHERE transaction_id = $1 AND session_id = $2 AND user_id = $3"
 
 type transactionStatements struct {
-	insertTransactionStmt        *sql.Stmt
-	selectTransactionEventIDStmt *sql.Stmt
+	insertTransactionStmt        *sqlutil.Stmt
+	selectTransactionEventIDStmt *sqlutil.Stmt
 }
 
 func createTransactionsTable(db *sql.DB) error {
@@ -0,0 +1,168 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func init() {
+	prometheus.MustRegister(eventJSONCacheHits, eventJSONCacheMisses)
+}
+
+var eventJSONCacheHits = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "event_json_cache_hits_total",
+		Help:      "Number of event JSON lookups which were served from the cache",
+	},
+)
+
+var eventJSONCacheMisses = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver",
+		Name:      "event_json_cache_misses_total",
+		Help:      "Number of event JSON lookups which had to be fetched from the database",
+	},
+)
+
+// EventJSONCache is an LRU cache of event JSON keyed by event NID, which sits
+// in front of an event JSON table. Writes go straight through to the table and
+// invalidate any cached entries for the events that they touch.
+type EventJSONCache struct {
+	tables.EventJSON
+	lru *lru.Cache
+}
+
+// NewEventJSONCache returns a cache holding at most maxEntries events in front
+// of the given event JSON table.
+func NewEventJSONCache(table tables.EventJSON, maxEntries int) (*EventJSONCache, error) {
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &EventJSONCache{
+		EventJSON: table,
+		lru:       cache,
+	}, nil
+}
+
+// InsertEventJSON implements tables.EventJSON
+func (c *EventJSONCache) InsertEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) error {
+	c.Invalidate(eventNID)
+	return c.EventJSON.InsertEventJSON(ctx, txn, eventNID, eventJSON)
+}
+
+// PurgeEventJSON implements tables.EventJSON
+func (c *EventJSONCache) PurgeEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) (int64, error) {
+	c.Invalidate(eventNIDs...)
+	return c.EventJSON.PurgeEventJSON(ctx, txn, eventNIDs)
+}
+
+// BulkSelectEventJSON implements tables.EventJSON. Only the events which
+// aren't already cached are fetched from the table.
+func (c *EventJSONCache) BulkSelectEventJSON(
+	ctx context.Context, eventNIDs []types.EventNID,
+) ([]tables.EventJSONPair, error) {
+	// The table returns results in ascending NID order, so callers depend on that.
+	sorted := uniqueEventNIDs(eventNIDs)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	pairs, err := c.BulkSelectEventJSONInOrder(ctx, nil, sorted)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]tables.EventJSONPair, 0, len(pairs))
+	for _, pair := range pairs {
+		if pair != nil {
+			results = append(results, *pair)
+		}
+	}
+	return results, nil
+}
+
+// BulkSelectEventJSONInOrder implements tables.EventJSON. Only the events
+// which aren't already cached are fetched from the table. Reads inside a
+// transaction go straight to the table, since they may see uncommitted writes
+// which mustn't be cached.
+func (c *EventJSONCache) BulkSelectEventJSONInOrder(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) ([]*tables.EventJSONPair, error) {
+	if txn != nil {
+		return c.EventJSON.BulkSelectEventJSONInOrder(ctx, txn, eventNIDs)
+	}
+	results := make([]*tables.EventJSONPair, len(eventNIDs))
+	misses := make([]types.EventNID, 0, len(eventNIDs))
+	seen := make(map[types.EventNID]struct{}, len(eventNIDs))
+	hits := 0
+	for i, eventNID := range eventNIDs {
+		if eventJSON, ok := c.lru.Get(eventNID); ok {
+			results[i] = &tables.EventJSONPair{
+				EventNID:  eventNID,
+				EventJSON: eventJSON.([]byte),
+			}
+			hits++
+			continue
+		}
+		if _, ok := seen[eventNID]; !ok {
+			seen[eventNID] = struct{}{}
+			misses = append(misses, eventNID)
+		}
+	}
+	eventJSONCacheHits.Add(float64(hits))
+	eventJSONCacheMisses.Add(float64(len(misses)))
+	if len(misses) == 0 {
+		return results, nil
+	}
+	fetched, err := c.EventJSON.BulkSelectEventJSONInOrder(ctx, nil, misses)
+	if err != nil {
+		return nil, err
+	}
+	byNID := make(map[types.EventNID]*tables.EventJSONPair, len(fetched))
+	for _, pair := range fetched {
+		if pair == nil {
+			continue
+		}
+		c.lru.Add(pair.EventNID, pair.EventJSON)
+		byNID[pair.EventNID] = pair
+	}
+	for i, eventNID := range eventNIDs {
+		if results[i] == nil {
+			results[i] = byNID[eventNID]
+		}
+	}
+	return results, nil
+}
+
+// Invalidate removes the given events from the cache.
+func (c *EventJSONCache) Invalidate(eventNIDs ...types.EventNID) {
+	for _, eventNID := range eventNIDs {
+		c.lru.Remove(eventNID)
+	}
+}
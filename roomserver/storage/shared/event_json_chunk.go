@@ -0,0 +1,108 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"sort"
+
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// ChunkedBulkSelectEventJSON selects the event JSON for the given event NIDs
+// by calling selectChunk with at most chunkSize event NIDs at a time, so that
+// no single query goes over the driver's limit. selectChunk must append the
+// results for its event NIDs to the given slice in ascending event NID order.
+// The merged results are returned in ascending event NID order.
+func ChunkedBulkSelectEventJSON(
+	eventNIDs []types.EventNID, chunkSize int,
+	selectChunk func(chunk []types.EventNID, results []tables.EventJSONPair) ([]tables.EventJSONPair, error),
+) ([]tables.EventJSONPair, error) {
+	chunked := len(eventNIDs) > chunkSize
+	results, err := chunkedSelectEventJSON(eventNIDs, chunkSize, selectChunk)
+	if err != nil {
+		return nil, err
+	}
+	// Each chunk is sorted by event NID, but the chunks may not be.
+	if chunked {
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].EventNID < results[j].EventNID
+		})
+	}
+	return results, nil
+}
+
+// ChunkedBulkSelectEventJSONInOrder behaves like ChunkedBulkSelectEventJSON,
+// but returns the event JSON in the same order as eventNIDs. Entries for
+// events which have no event JSON are nil.
+func ChunkedBulkSelectEventJSONInOrder(
+	eventNIDs []types.EventNID, chunkSize int,
+	selectChunk func(chunk []types.EventNID, results []tables.EventJSONPair) ([]tables.EventJSONPair, error),
+) ([]*tables.EventJSONPair, error) {
+	pairs, err := chunkedSelectEventJSON(eventNIDs, chunkSize, selectChunk)
+	if err != nil {
+		return nil, err
+	}
+	byNID := make(map[types.EventNID]*tables.EventJSONPair, len(pairs))
+	for i := range pairs {
+		byNID[pairs[i].EventNID] = &pairs[i]
+	}
+	results := make([]*tables.EventJSONPair, len(eventNIDs))
+	for i, eventNID := range eventNIDs {
+		results[i] = byNID[eventNID]
+	}
+	return results, nil
+}
+
+func chunkedSelectEventJSON(
+	eventNIDs []types.EventNID, chunkSize int,
+	selectChunk func(chunk []types.EventNID, results []tables.EventJSONPair) ([]tables.EventJSONPair, error),
+) ([]tables.EventJSONPair, error) {
+	if len(eventNIDs) == 0 {
+		return []tables.EventJSONPair{}, nil
+	}
+	// Remove duplicates so that an event can't appear in two chunks and so
+	// be returned twice.
+	if len(eventNIDs) > chunkSize {
+		eventNIDs = uniqueEventNIDs(eventNIDs)
+	}
+	// We know that we will only get as many results as event NIDs
+	// because of the unique constraint on event NIDs.
+	// So we can allocate enough capacity for all of them now.
+	results := make([]tables.EventJSONPair, 0, len(eventNIDs))
+	for start := 0; start < len(eventNIDs); start += chunkSize {
+		chunk := eventNIDs[start:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		var err error
+		if results, err = selectChunk(chunk, results); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func uniqueEventNIDs(eventNIDs []types.EventNID) []types.EventNID {
+	seen := make(map[types.EventNID]struct{}, len(eventNIDs))
+	unique := make([]types.EventNID, 0, len(eventNIDs))
+	for _, eventNID := range eventNIDs {
+		if _, ok := seen[eventNID]; !ok {
+			seen[eventNID] = struct{}{}
+			unique = append(unique, eventNID)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// EventJSONEncoding is the value stored in the blob_encoding column of the
+// event JSON table. It describes how the stored event JSON was encoded, so
+// that rows written with different compression settings can coexist.
+type EventJSONEncoding int16
+
+const (
+	// EventJSONEncodingNone means the event JSON is stored as-is.
+	EventJSONEncodingNone EventJSONEncoding = 0
+	// EventJSONEncodingGzip means the event JSON is gzip compressed.
+	EventJSONEncodingGzip EventJSONEncoding = 1
+	// EventJSONEncodingZstd means the event JSON is zstd compressed.
+	EventJSONEncodingZstd EventJSONEncoding = 2
+)
+
+// The zstd encoder and decoder are safe for concurrent use when using
+// EncodeAll and DecodeAll, so share a single instance of each.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// ParseEventJSONCompression maps the room_server.event_json_compression
+// config option onto the encoding used for newly written event JSON.
+func ParseEventJSONCompression(compression string) (EventJSONEncoding, error) {
+	switch compression {
+	case "", "none":
+		return EventJSONEncodingNone, nil
+	case "gzip":
+		return EventJSONEncodingGzip, nil
+	case "zstd":
+		return EventJSONEncodingZstd, nil
+	default:
+		return EventJSONEncodingNone, fmt.Errorf("unknown event JSON compression %q", compression)
+	}
+}
+
+// Encode returns the event JSON encoded for storage.
+func (e EventJSONEncoding) Encode(eventJSON []byte) ([]byte, error) {
+	switch e {
+	case EventJSONEncodingNone:
+		return eventJSON, nil
+	case EventJSONEncodingGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(eventJSON); err != nil {
+			return nil, fmt.Errorf("w.Write: %w", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("w.Close: %w", err)
+		}
+		return buf.Bytes(), nil
+	case EventJSONEncodingZstd:
+		return zstdEncoder.EncodeAll(eventJSON, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown event JSON encoding %d", e)
+	}
+}
+
+// Decode returns the event JSON from data which was stored with this encoding.
+func (e EventJSONEncoding) Decode(data []byte) ([]byte, error) {
+	switch e {
+	case EventJSONEncodingNone:
+		return data, nil
+	case EventJSONEncodingGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("gzip.NewReader: %w", err)
+		}
+		defer r.Close() // nolint:errcheck
+		return ioutil.ReadAll(r)
+	case EventJSONEncodingZstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unknown event JSON encoding %d", e)
+	}
+}
+
+// HashEventJSON returns the hash that identifies the event JSON in the event
+// JSON blobs table when deduplication is enabled. The hash is taken over the
+// event JSON before it is encoded, so that identical events are deduplicated
+// regardless of the compression settings that they were stored with.
+func HashEventJSON(eventJSON []byte) []byte {
+	hash := sha256.Sum256(eventJSON)
+	return hash[:]
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// eventJSONCursor implements tables.EventJSONCursor over rows containing the
+// event NID, the event JSON and its encoding, in that order.
+type eventJSONCursor struct {
+	rows      *sqlutil.Rows
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// NewEventJSONCursor returns a cursor which reads event JSON from the given
+// rows. The rows are closed when the cursor reaches the end of the rows, hits
+// an error or is closed. If the cursor is abandoned without being closed then
+// the rows are closed when the cursor is garbage collected.
+func NewEventJSONCursor(rows *sqlutil.Rows) tables.EventJSONCursor {
+	c := &eventJSONCursor{rows: rows}
+	runtime.SetFinalizer(c, func(c *eventJSONCursor) {
+		_ = c.Close()
+	})
+	return c
+}
+
+// Next implements tables.EventJSONCursor
+func (c *eventJSONCursor) Next() (tables.EventJSONPair, error) {
+	if !c.rows.Next() {
+		err := c.rows.Err()
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		return tables.EventJSONPair{}, err
+	}
+	var eventNID int64
+	var data []byte
+	var encoding EventJSONEncoding
+	if err := c.rows.Scan(&eventNID, &data, &encoding); err != nil {
+		_ = c.Close()
+		return tables.EventJSONPair{}, err
+	}
+	eventJSON, err := encoding.Decode(data)
+	if err != nil {
+		_ = c.Close()
+		return tables.EventJSONPair{}, fmt.Errorf("failed to decode event JSON for event NID %d: %w", eventNID, err)
+	}
+	return tables.EventJSONPair{
+		EventNID:  types.EventNID(eventNID),
+		EventJSON: eventJSON,
+	}, nil
+}
+
+// Close implements tables.EventJSONCursor
+func (c *eventJSONCursor) Close() error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.rows.Close()
+	})
+	return c.closeErr
+}
+
+// ReadEventJSONPairs reads the rest of the cursor into a slice. The cursor is
+// always closed. sizeHint is the number of pairs expected, if known.
+func ReadEventJSONPairs(cursor tables.EventJSONCursor, sizeHint int) ([]tables.EventJSONPair, error) {
+	defer cursor.Close() // nolint:errcheck
+	pairs := make([]tables.EventJSONPair, 0, sizeHint)
+	for {
+		pair, err := cursor.Next()
+		if err == io.EOF {
+			return pairs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, pair)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	prometheus.MustRegister(
+		eventJSONSelectDuration, eventJSONInsertDuration,
+		eventJSONRowsInserted, eventJSONSize,
+	)
+}
+
+var eventJSONDurationBuckets = []float64{ // milliseconds
+	0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000,
+}
+
+var eventJSONSelectDuration = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver_eventjson",
+		Name:      "bulk_select_duration_millis",
+		Help:      "How long it takes to select event JSON from the database",
+		Buckets:   eventJSONDurationBuckets,
+	},
+)
+
+var eventJSONInsertDuration = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver_eventjson",
+		Name:      "insert_duration_millis",
+		Help:      "How long it takes to insert event JSON into the database",
+		Buckets:   eventJSONDurationBuckets,
+	},
+)
+
+var eventJSONRowsInserted = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver_eventjson",
+		Name:      "rows_inserted_total",
+		Help:      "Number of event JSON rows written to the database",
+	},
+)
+
+var eventJSONSize = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "dendrite",
+		Subsystem: "roomserver_eventjson",
+		Name:      "size_bytes",
+		Help:      "Total size of the stored event JSON, after compression",
+	},
+)
+
+func observeMillis(h prometheus.Histogram, start time.Time) {
+	h.Observe(float64(time.Since(start).Microseconds()) / 1000.)
+}
+
+// EventJSONMetrics records Prometheus metrics for the database operations of
+// an event JSON table.
+type EventJSONMetrics struct {
+	tables.EventJSON
+}
+
+// NewEventJSONMetrics returns the given event JSON table with metrics recorded.
+func NewEventJSONMetrics(table tables.EventJSON) *EventJSONMetrics {
+	return &EventJSONMetrics{table}
+}
+
+// InsertEventJSON implements tables.EventJSON
+func (m *EventJSONMetrics) InsertEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) error {
+	defer observeMillis(eventJSONInsertDuration, time.Now())
+	if err := m.EventJSON.InsertEventJSON(ctx, txn, eventNID, eventJSON); err != nil {
+		return err
+	}
+	eventJSONRowsInserted.Inc()
+	return nil
+}
+
+// BulkInsertEventJSON implements tables.EventJSON
+func (m *EventJSONMetrics) BulkInsertEventJSON(
+	ctx context.Context, txn *sql.Tx, pairs []tables.EventJSONPair,
+) error {
+	defer observeMillis(eventJSONInsertDuration, time.Now())
+	if err := m.EventJSON.BulkInsertEventJSON(ctx, txn, pairs); err != nil {
+		return err
+	}
+	CountEventJSONRowsInserted(len(pairs))
+	return nil
+}
+
+// BulkSelectEventJSON implements tables.EventJSON
+func (m *EventJSONMetrics) BulkSelectEventJSON(
+	ctx context.Context, eventNIDs []types.EventNID,
+) ([]tables.EventJSONPair, error) {
+	defer observeMillis(eventJSONSelectDuration, time.Now())
+	return m.EventJSON.BulkSelectEventJSON(ctx, eventNIDs)
+}
+
+// BulkSelectEventJSONInOrder implements tables.EventJSON
+func (m *EventJSONMetrics) BulkSelectEventJSONInOrder(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) ([]*tables.EventJSONPair, error) {
+	defer observeMillis(eventJSONSelectDuration, time.Now())
+	return m.EventJSON.BulkSelectEventJSONInOrder(ctx, txn, eventNIDs)
+}
+
+// WrapEventJSONTable adds metrics, tracing spans and, if cacheMaxEntries is
+// greater than 0, an LRU cache in front of the given event JSON table. The
+// cache goes in front so that spans are only started for database calls.
+func WrapEventJSONTable(table tables.EventJSON, cacheMaxEntries int) (tables.EventJSON, error) {
+	wrapped := tables.EventJSON(NewEventJSONTracing(NewEventJSONMetrics(table)))
+	if cacheMaxEntries > 0 {
+		return NewEventJSONCache(wrapped, cacheMaxEntries)
+	}
+	return wrapped, nil
+}
+
+// CountEventJSONRowsInserted adds to the count of event JSON rows written, for
+// backend-specific write paths which don't go through the table interface.
+func CountEventJSONRowsInserted(count int) {
+	eventJSONRowsInserted.Add(float64(count))
+}
+
+// RefreshEventJSONSizeMetric updates the event JSON size gauge from the table
+// every interval, forever. The size is queried periodically rather than being
+// kept up to date on every write, since calculating it is expensive.
+func RefreshEventJSONSizeMetric(table tables.EventJSON, interval time.Duration) {
+	for {
+		size, err := table.SelectEventJSONSize(context.Background())
+		if err != nil {
+			logrus.WithError(err).Warn("Failed to refresh event JSON size metric")
+		} else {
+			eventJSONSize.Set(float64(size))
+		}
+		time.Sleep(interval)
+	}
+}
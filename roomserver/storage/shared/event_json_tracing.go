@@ -0,0 +1,93 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// eventJSONSpanComponent prefixes the names of the spans started by
+// EventJSONTracing.
+const eventJSONSpanComponent = "roomserver.storage"
+
+// EventJSONTracing starts a tracing span, named after the statement, for each
+// database operation of an event JSON table which reads or writes event JSON.
+type EventJSONTracing struct {
+	tables.EventJSON
+}
+
+// NewEventJSONTracing returns the given event JSON table with tracing spans.
+func NewEventJSONTracing(table tables.EventJSON) *EventJSONTracing {
+	return &EventJSONTracing{table}
+}
+
+// InsertEventJSON implements tables.EventJSON
+func (t *EventJSONTracing) InsertEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) (err error) {
+	span, ctx := sqlutil.StartSpan(ctx, eventJSONSpanComponent, "insertEventJSON")
+	defer func() { sqlutil.FinishSpan(span, 1, err) }()
+	return t.EventJSON.InsertEventJSON(ctx, txn, eventNID, eventJSON)
+}
+
+// BulkInsertEventJSON implements tables.EventJSON
+func (t *EventJSONTracing) BulkInsertEventJSON(
+	ctx context.Context, txn *sql.Tx, pairs []tables.EventJSONPair,
+) (err error) {
+	span, ctx := sqlutil.StartSpan(ctx, eventJSONSpanComponent, "bulkInsertEventJSON")
+	defer func() { sqlutil.FinishSpan(span, len(pairs), err) }()
+	return t.EventJSON.BulkInsertEventJSON(ctx, txn, pairs)
+}
+
+// BulkSelectEventJSON implements tables.EventJSON
+func (t *EventJSONTracing) BulkSelectEventJSON(
+	ctx context.Context, eventNIDs []types.EventNID,
+) (pairs []tables.EventJSONPair, err error) {
+	span, ctx := sqlutil.StartSpan(ctx, eventJSONSpanComponent, "bulkSelectEventJSON")
+	defer func() { sqlutil.FinishSpan(span, len(pairs), err) }()
+	return t.EventJSON.BulkSelectEventJSON(ctx, eventNIDs)
+}
+
+// BulkSelectEventJSONInOrder implements tables.EventJSON
+func (t *EventJSONTracing) BulkSelectEventJSONInOrder(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) (pairs []*tables.EventJSONPair, err error) {
+	span, ctx := sqlutil.StartSpan(ctx, eventJSONSpanComponent, "bulkSelectEventJSONInOrder")
+	defer func() { sqlutil.FinishSpan(span, len(pairs), err) }()
+	return t.EventJSON.BulkSelectEventJSONInOrder(ctx, txn, eventNIDs)
+}
+
+// PurgeEventJSON implements tables.EventJSON
+func (t *EventJSONTracing) PurgeEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) (deleted int64, err error) {
+	span, ctx := sqlutil.StartSpan(ctx, eventJSONSpanComponent, "purgeEventJSON")
+	defer func() { sqlutil.FinishSpan(span, int(deleted), err) }()
+	return t.EventJSON.PurgeEventJSON(ctx, txn, eventNIDs)
+}
+
+// SelectEventJSONRange implements tables.EventJSON
+func (t *EventJSONTracing) SelectEventJSONRange(
+	ctx context.Context, fromNID types.EventNID, limit int, ascending bool,
+) (pairs []tables.EventJSONPair, err error) {
+	span, ctx := sqlutil.StartSpan(ctx, eventJSONSpanComponent, "selectEventJSONRange")
+	defer func() { sqlutil.FinishSpan(span, len(pairs), err) }()
+	return t.EventJSON.SelectEventJSONRange(ctx, fromNID, limit, ascending)
+}
@@ -0,0 +1,135 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// ExportedEvent is a single line of the output of ExportUserEvents, which is
+// written as JSON lines: one JSON object per line, separated by "\n".
+//
+// The format is stable. New fields may be added, but existing fields will not
+// be renamed, removed or have their meaning changed.
+type ExportedEvent struct {
+	// The room that the event was sent in.
+	RoomID string `json:"room_id"`
+	// The ID of the event.
+	EventID string `json:"event_id"`
+	// Whether the event has been redacted, either because the user is no
+	// longer in the room or because it was redacted in the room.
+	Redacted bool `json:"redacted"`
+	// The full event, in the federation format for the room version.
+	Event json.RawMessage `json:"event"`
+}
+
+// ExportUserEvents writes every event sent by the given user to w, in the
+// format described by ExportedEvent. Events are streamed from the database
+// a room at a time, so memory use doesn't depend on how many events there are.
+// Events in rooms which the user is no longer joined to are redacted, as the
+// user no longer has permission to see them. Returns the number of events
+// written.
+func (d *Database) ExportUserEvents(ctx context.Context, userID string, w io.Writer) (int, error) {
+	userNID, err := d.EventStateKeysTable.SelectEventStateKeyNID(ctx, nil, userID)
+	if err == sql.ErrNoRows {
+		// we've never seen this user, so they can't have sent anything
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("d.EventStateKeysTable.SelectEventStateKeyNID: %w", err)
+	}
+	encoder := json.NewEncoder(w)
+	count := 0
+	for _, membership := range []tables.MembershipState{
+		tables.MembershipStateJoin, tables.MembershipStateLeaveOrBan,
+	} {
+		roomNIDs, err := d.MembershipTable.SelectRoomsWithMembership(ctx, userNID, membership)
+		if err != nil {
+			return count, fmt.Errorf("d.MembershipTable.SelectRoomsWithMembership: %w", err)
+		}
+		redact := membership != tables.MembershipStateJoin
+		for _, roomNID := range roomNIDs {
+			exported, err := d.exportUserEventsInRoom(ctx, userID, roomNID, redact, encoder)
+			count += exported
+			if err != nil {
+				return count, fmt.Errorf("d.exportUserEventsInRoom: %w", err)
+			}
+		}
+	}
+	return count, nil
+}
+
+func (d *Database) exportUserEventsInRoom(
+	ctx context.Context, userID string, roomNID types.RoomNID, redact bool, encoder *json.Encoder,
+) (int, error) {
+	roomIDs, err := d.RoomsTable.BulkSelectRoomIDs(ctx, []types.RoomNID{roomNID})
+	if err != nil {
+		return 0, fmt.Errorf("d.RoomsTable.BulkSelectRoomIDs: %w", err)
+	}
+	if len(roomIDs) != 1 {
+		return 0, fmt.Errorf("room NID %d not found", roomNID)
+	}
+	roomVersions, err := d.RoomsTable.SelectRoomVersionsForRoomNIDs(ctx, []types.RoomNID{roomNID})
+	if err != nil {
+		return 0, fmt.Errorf("d.RoomsTable.SelectRoomVersionsForRoomNIDs: %w", err)
+	}
+	cursor, err := d.EventJSONTable.SelectEventJSONCursor(ctx, roomNID, 0)
+	if err != nil {
+		return 0, fmt.Errorf("d.EventJSONTable.SelectEventJSONCursor: %w", err)
+	}
+	defer cursor.Close() // nolint:errcheck
+	count := 0
+	for {
+		pair, err := cursor.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		// Check the sender before parsing the whole event, as most events
+		// in a room will usually have been sent by other users.
+		if gjson.GetBytes(pair.EventJSON, "sender").Str != userID {
+			continue
+		}
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(pair.EventJSON, false, roomVersions[roomNID])
+		if err != nil {
+			return count, fmt.Errorf("gomatrixserverlib.NewEventFromTrustedJSON: %w", err)
+		}
+		redacted := gjson.GetBytes(event.Unsigned(), "redacted_because").Exists()
+		if redact && !redacted {
+			event = event.Redact()
+			redacted = true
+		}
+		if err = encoder.Encode(ExportedEvent{
+			RoomID:   roomIDs[0],
+			EventID:  event.EventID(),
+			Redacted: redacted,
+			Event:    event.JSON(),
+		}); err != nil {
+			return count, fmt.Errorf("encoder.Encode: %w", err)
+		}
+		count++
+	}
+}
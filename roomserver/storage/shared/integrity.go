@@ -0,0 +1,88 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// integrityCheckChunkSize is the number of event NIDs checked in each read
+// transaction, so that the check never holds a transaction open for long.
+const integrityCheckChunkSize = 10000
+
+// EventJSONIntegrityReport describes inconsistencies between the events table
+// and the event JSON table.
+type EventJSONIntegrityReport struct {
+	// The highest event NID that was checked.
+	MaxEventNID types.EventNID
+	// Event NIDs which are in the events table but have no event JSON.
+	EventNIDsMissingJSON []types.EventNID
+	// Event NIDs which have event JSON but aren't in the events table.
+	EventJSONNIDsMissingEvent []types.EventNID
+}
+
+// OK returns true if no inconsistencies were found.
+func (r *EventJSONIntegrityReport) OK() bool {
+	return len(r.EventNIDsMissingJSON) == 0 && len(r.EventJSONNIDsMissingEvent) == 0
+}
+
+// CheckEventJSONIntegrity finds events which have no event JSON and event JSON
+// which has no event. The check is done in chunks of event NIDs, each in its
+// own read-only transaction, so it doesn't stop other work for long. Events
+// which are written while the check is running may not be checked.
+func (d *Database) CheckEventJSONIntegrity(ctx context.Context) (*EventJSONIntegrityReport, error) {
+	maxEventNID, err := d.EventJSONTable.SelectMaxEventNID(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("d.EventJSONTable.SelectMaxEventNID: %w", err)
+	}
+	report := &EventJSONIntegrityReport{
+		MaxEventNID: maxEventNID,
+	}
+	for fromNID := types.EventNID(0); fromNID < maxEventNID; fromNID += integrityCheckChunkSize {
+		toNID := fromNID + integrityCheckChunkSize
+		err = d.checkEventJSONIntegrityChunk(ctx, report, fromNID, toNID)
+		if err != nil {
+			return nil, fmt.Errorf("d.checkEventJSONIntegrityChunk: %w", err)
+		}
+	}
+	return report, nil
+}
+
+func (d *Database) checkEventJSONIntegrityChunk(
+	ctx context.Context, report *EventJSONIntegrityReport, fromNID, toNID types.EventNID,
+) error {
+	txn, err := d.DB.BeginTx(ctx, &sql.TxOptions{
+		ReadOnly: true,
+	})
+	if err != nil {
+		return fmt.Errorf("d.DB.BeginTx: %w", err)
+	}
+	defer txn.Rollback() // nolint:errcheck
+	missingJSON, err := d.EventJSONTable.SelectEventNIDsMissingJSON(ctx, txn, fromNID, toNID)
+	if err != nil {
+		return fmt.Errorf("d.EventJSONTable.SelectEventNIDsMissingJSON: %w", err)
+	}
+	missingEvent, err := d.EventJSONTable.SelectEventJSONNIDsMissingEvent(ctx, txn, fromNID, toNID)
+	if err != nil {
+		return fmt.Errorf("d.EventJSONTable.SelectEventJSONNIDsMissingEvent: %w", err)
+	}
+	report.EventNIDsMissingJSON = append(report.EventNIDsMissingJSON, missingJSON...)
+	report.EventJSONNIDsMissingEvent = append(report.EventJSONNIDsMissingEvent, missingEvent...)
+	return nil
+}
@@ -18,18 +18,21 @@ package shared
 import (
 	"context"
 	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
 )
 
 // StatementList is a list of SQL statements to prepare and a pointer to where to store the resulting prepared statement.
+// The prepared statements are re-prepared automatically if the database connection is lost.
 type StatementList []struct {
-	Statement **sql.Stmt
+	Statement **sqlutil.Stmt
 	SQL       string
 }
 
 // Prepare the SQL for each statement in the list and assign the result to the prepared statement.
 func (s StatementList) Prepare(db *sql.DB) (err error) {
 	for _, statement := range s {
-		if *statement.Statement, err = db.Prepare(statement.SQL); err != nil {
+		if *statement.Statement, err = sqlutil.PrepareStmt(db, statement.SQL); err != nil {
 			return
 		}
 	}
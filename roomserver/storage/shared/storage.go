@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"io"
 	"sort"
 
 	"github.com/matrix-org/dendrite/internal/caching"
@@ -43,6 +44,7 @@ type Database struct {
 	InvitesTable               tables.Invites
 	MembershipTable            tables.Membership
 	PublishedTable             tables.Published
+	BlockedRoomsTable          tables.BlockedRooms
 	RedactionsTable            tables.Redactions
 	GetLatestEventsForUpdateFn func(ctx context.Context, roomInfo types.RoomInfo) (*LatestEventsUpdater, error)
 }
@@ -51,6 +53,24 @@ func (d *Database) SupportsConcurrentRoomInputs() bool {
 	return true
 }
 
+// SupportsBulkEventJSONImport is true because BulkImportEventJSON inserts the
+// event JSON in chunks within a single transaction, which is much faster than
+// storing it with each event.
+func (d *Database) SupportsBulkEventJSONImport() bool {
+	return true
+}
+
+// BulkImportEventJSON stores the event JSON for events which have already been
+// assigned event NIDs, using as few statements as possible. Events which already
+// have event JSON are left unchanged.
+func (d *Database) BulkImportEventJSON(
+	ctx context.Context, pairs []tables.EventJSONPair,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EventJSONTable.BulkInsertEventJSON(ctx, txn, pairs)
+	})
+}
+
 func (d *Database) EventTypeNIDs(
 	ctx context.Context, eventTypes []string,
 ) (map[string]types.EventTypeNID, error) {
@@ -419,6 +439,25 @@ func (d *Database) Events(
 	return results, nil
 }
 
+func (d *Database) TimelineEvents(
+	ctx context.Context, eventNIDs []types.EventNID,
+) ([]types.Event, error) {
+	softFailed, err := d.EventsTable.BulkSelectSoftFailed(ctx, eventNIDs)
+	if err != nil {
+		return nil, fmt.Errorf("d.EventsTable.BulkSelectSoftFailed: %w", err)
+	}
+	if len(softFailed) == 0 {
+		return d.Events(ctx, eventNIDs)
+	}
+	timelineEventNIDs := make([]types.EventNID, 0, len(eventNIDs))
+	for _, eventNID := range eventNIDs {
+		if !softFailed[eventNID] {
+			timelineEventNIDs = append(timelineEventNIDs, eventNID)
+		}
+	}
+	return d.Events(ctx, timelineEventNIDs)
+}
+
 func (d *Database) GetTransactionEventID(
 	ctx context.Context, transactionID string,
 	sessionID int64, userID string,
@@ -466,7 +505,24 @@ func (d *Database) GetLatestEventsForUpdate(
 
 func (d *Database) StoreEvent(
 	ctx context.Context, event *gomatrixserverlib.Event,
-	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected bool,
+	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected, isSoftFailed bool,
+) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	return d.storeEvent(ctx, event, txnAndSessionID, authEventNIDs, isRejected, isSoftFailed, true)
+}
+
+// StoreEventWithoutJSON stores an event like StoreEvent, except that the event
+// JSON isn't stored, so that the JSON of many events can be stored at once with
+// BulkImportEventJSON. The event can't be loaded until its JSON is stored, so
+// redactions of it can't be applied until then either.
+func (d *Database) StoreEventWithoutJSON(
+	ctx context.Context, event *gomatrixserverlib.Event, authEventNIDs []types.EventNID,
+) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
+	return d.storeEvent(ctx, event, nil, authEventNIDs, false, false, false)
+}
+
+func (d *Database) storeEvent(
+	ctx context.Context, event *gomatrixserverlib.Event,
+	txnAndSessionID *api.TransactionID, authEventNIDs []types.EventNID, isRejected, isSoftFailed, storeJSON bool,
 ) (types.RoomNID, types.StateAtEvent, *gomatrixserverlib.Event, string, error) {
 	var (
 		roomNID          types.RoomNID
@@ -476,6 +532,7 @@ func (d *Database) StoreEvent(
 		stateNID         types.StateSnapshotNID
 		redactionEvent   *gomatrixserverlib.Event
 		redactedEventID  string
+		redactedEventNID types.EventNID
 		err              error
 	)
 
@@ -531,6 +588,7 @@ func (d *Database) StoreEvent(
 			authEventNIDs,
 			event.Depth(),
 			isRejected,
+			isSoftFailed,
 		); err != nil {
 			if err == sql.ErrNoRows {
 				// We've already inserted the event so select the numeric event ID
@@ -541,11 +599,13 @@ func (d *Database) StoreEvent(
 			}
 		}
 
-		if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
-			return fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
+		if storeJSON {
+			if err = d.EventJSONTable.InsertEventJSON(ctx, txn, eventNID, event.JSON()); err != nil {
+				return fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
+			}
 		}
 		if !isRejected { // ignore rejected redaction events
-			redactionEvent, redactedEventID, err = d.handleRedactions(ctx, txn, eventNID, event)
+			redactionEvent, redactedEventID, redactedEventNID, err = d.handleRedactions(ctx, txn, eventNID, event)
 			if err != nil {
 				return fmt.Errorf("d.handleRedactions: %w", err)
 			}
@@ -555,6 +615,9 @@ func (d *Database) StoreEvent(
 	if err != nil {
 		return 0, types.StateAtEvent{}, nil, "", fmt.Errorf("d.Writer.Do: %w", err)
 	}
+	if redactedEventNID != 0 {
+		d.invalidateEventJSON(redactedEventNID)
+	}
 
 	// We should attempt to update the previous events table with any
 	// references that this new event makes. We do this using a latest
@@ -617,6 +680,212 @@ func (d *Database) PublishRoom(ctx context.Context, roomID string, publish bool)
 	})
 }
 
+func (d *Database) BlockRoom(ctx context.Context, roomID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.BlockedRoomsTable.InsertBlockedRoom(ctx, txn, roomID)
+	})
+}
+
+func (d *Database) UnblockRoom(ctx context.Context, roomID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.BlockedRoomsTable.DeleteBlockedRoom(ctx, txn, roomID)
+	})
+}
+
+func (d *Database) IsRoomBlocked(ctx context.Context, roomID string) (bool, error) {
+	return d.BlockedRoomsTable.SelectRoomBlocked(ctx, roomID)
+}
+
+// PurgeRoom deletes the event JSON for every event in the given room, returning
+// the number of rows removed. Either all of the event JSON is deleted or, on
+// error, none of it is.
+func (d *Database) PurgeRoom(ctx context.Context, roomID string) (int64, error) {
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil {
+		return 0, fmt.Errorf("d.RoomInfo: %w", err)
+	}
+	if roomInfo == nil {
+		return 0, nil
+	}
+	var purged int64
+	var eventNIDs []types.EventNID
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		eventNIDs, err = d.EventsTable.SelectEventNIDsForRoom(ctx, txn, roomInfo.RoomNID)
+		if err != nil {
+			return fmt.Errorf("d.EventsTable.SelectEventNIDsForRoom: %w", err)
+		}
+		purged, err = d.EventJSONTable.PurgeEventJSON(ctx, txn, eventNIDs)
+		if err != nil {
+			return fmt.Errorf("d.EventJSONTable.PurgeEventJSON: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	d.invalidateEventJSON(eventNIDs...)
+	return purged, nil
+}
+
+// PurgeHistory deletes the event JSON for the timeline events in the room which were sent before the given time.
+// State events are kept, so that the state of the room can still be worked out and the room stays joinable, as
+// are the forward extremities, which new events need to reference. If orphanedState is true then state events
+// which were replaced before the given time are deleted too, as they are neither the current state nor the state
+// of any event which is kept. The purged events are still in the events table, so they are still known to the
+// room graph and won't be fetched again by backfill. If dryRun is true then nothing is deleted. Returns the IDs
+// of the events which were, or would have been, purged.
+func (d *Database) PurgeHistory(
+	ctx context.Context, roomID string, before gomatrixserverlib.Timestamp, orphanedState, dryRun bool,
+) ([]string, error) {
+	roomInfo, err := d.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("d.RoomInfo: %w", err)
+	}
+	if roomInfo == nil || roomInfo.IsStub {
+		return nil, nil
+	}
+	latestNIDs, _, err := d.RoomsTable.SelectLatestEventNIDs(ctx, nil, roomInfo.RoomNID)
+	if err != nil {
+		return nil, fmt.Errorf("d.RoomsTable.SelectLatestEventNIDs: %w", err)
+	}
+	keep := make(map[types.EventNID]bool, len(latestNIDs))
+	for _, eventNID := range latestNIDs {
+		keep[eventNID] = true
+	}
+	if orphanedState {
+		currentState, err := d.loadStateAtSnapshot(ctx, roomInfo.StateSnapshotNID)
+		if err != nil {
+			return nil, fmt.Errorf("d.loadStateAtSnapshot: %w", err)
+		}
+		for _, entry := range currentState {
+			keep[entry.EventNID] = true
+		}
+	}
+
+	type purgedEvent struct {
+		eventNID types.EventNID
+		eventID  string
+		ts       gomatrixserverlib.Timestamp
+	}
+	var purged []purgedEvent
+	// The state events sent before the cutoff which aren't current, by type and state key.
+	replacedState := make(map[gomatrixserverlib.StateKeyTuple][]purgedEvent)
+	// Whether the current state event of each type and state key was sent before the cutoff.
+	currentBeforeCutoff := make(map[gomatrixserverlib.StateKeyTuple]bool)
+
+	// Find the events to purge before starting the transaction, so that the
+	// cursor isn't holding a connection open while we write.
+	cursor, err := d.EventJSONTable.SelectEventJSONCursor(ctx, roomInfo.RoomNID, 0)
+	if err != nil {
+		return nil, fmt.Errorf("d.EventJSONTable.SelectEventJSONCursor: %w", err)
+	}
+	defer cursor.Close() // nolint:errcheck
+	for {
+		pair, err := cursor.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		stateKey := gjson.GetBytes(pair.EventJSON, "state_key")
+		if stateKey.Exists() && !orphanedState {
+			continue
+		}
+		ts := gomatrixserverlib.Timestamp(gjson.GetBytes(pair.EventJSON, "origin_server_ts").Uint())
+		if ts >= before {
+			continue
+		}
+		tuple := gomatrixserverlib.StateKeyTuple{
+			EventType: gjson.GetBytes(pair.EventJSON, "type").Str,
+			StateKey:  stateKey.Str,
+		}
+		if keep[pair.EventNID] {
+			if stateKey.Exists() {
+				currentBeforeCutoff[tuple] = true
+			}
+			continue
+		}
+		event, err := gomatrixserverlib.NewEventFromTrustedJSON(pair.EventJSON, false, roomInfo.RoomVersion)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.NewEventFromTrustedJSON: %w", err)
+		}
+		ev := purgedEvent{eventNID: pair.EventNID, eventID: event.EventID(), ts: ts}
+		if stateKey.Exists() {
+			replacedState[tuple] = append(replacedState[tuple], ev)
+			continue
+		}
+		purged = append(purged, ev)
+	}
+	if err = cursor.Close(); err != nil {
+		return nil, fmt.Errorf("cursor.Close: %w", err)
+	}
+	for tuple, events := range replacedState {
+		if currentBeforeCutoff[tuple] {
+			// all of these were replaced before the cutoff
+			purged = append(purged, events...)
+			continue
+		}
+		// The most recent of these was still the state at the cutoff, so
+		// the events after the cutoff may need it. The rest were replaced
+		// before the cutoff, so nothing we keep refers to them.
+		sort.Slice(events, func(i, j int) bool {
+			if events[i].ts != events[j].ts {
+				return events[i].ts < events[j].ts
+			}
+			return events[i].eventNID < events[j].eventNID
+		})
+		purged = append(purged, events[:len(events)-1]...)
+	}
+	sort.Slice(purged, func(i, j int) bool {
+		return purged[i].eventNID < purged[j].eventNID
+	})
+
+	eventNIDs := make([]types.EventNID, len(purged))
+	eventIDs := make([]string, len(purged))
+	for i := range purged {
+		eventNIDs[i] = purged[i].eventNID
+		eventIDs[i] = purged[i].eventID
+	}
+	if dryRun || len(eventNIDs) == 0 {
+		return eventIDs, nil
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if _, err = d.EventJSONTable.PurgeEventJSON(ctx, txn, eventNIDs); err != nil {
+			return fmt.Errorf("d.EventJSONTable.PurgeEventJSON: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.invalidateEventJSON(eventNIDs...)
+	return eventIDs, nil
+}
+
+// EventJSONCursor returns a cursor over the event JSON for every event in the room with an event NID greater than
+// afterEventNID, in ascending NID order. Pass the NID of the last event read to resume an interrupted iteration.
+func (d *Database) EventJSONCursor(
+	ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID,
+) (tables.EventJSONCursor, error) {
+	return d.EventJSONTable.SelectEventJSONCursor(ctx, roomNID, afterEventNID)
+}
+
+func (d *Database) RoomStorageUsage(
+	ctx context.Context, roomNID types.RoomNID,
+) (eventCount int64, sizeBytes int64, err error) {
+	return d.EventJSONTable.SelectRoomEventJSONSize(ctx, roomNID)
+}
+
+// invalidateEventJSON removes events from the event JSON cache, if there is one. The cache is already invalidated
+// when the event JSON is written, but this should also be called once the transaction has committed, in case the
+// old event JSON was read back into the cache before then.
+func (d *Database) invalidateEventJSON(eventNIDs ...types.EventNID) {
+	if cache, ok := d.EventJSONTable.(*EventJSONCache); ok {
+		cache.Invalidate(eventNIDs...)
+	}
+}
+
 func (d *Database) GetPublishedRooms(ctx context.Context) ([]string, error) {
 	return d.PublishedTable.SelectAllPublishedRooms(ctx, true)
 }
@@ -722,16 +991,17 @@ func extractRoomVersionFromCreateEvent(event *gomatrixserverlib.Event) (
 // when loading events to determine whether to apply redactions. This keeps the hot-path of reading events quick as we don't need
 // to cross-reference with other tables when loading.
 //
-// Returns the redaction event and the event ID of the redacted event if this call resulted in a redaction.
+// Returns the redaction event and the event ID and NID of the redacted event if this call resulted in a redaction.
+// The caller should invalidate the redacted event JSON once the transaction has committed.
 func (d *Database) handleRedactions(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, event *gomatrixserverlib.Event,
-) (*gomatrixserverlib.Event, string, error) {
+) (*gomatrixserverlib.Event, string, types.EventNID, error) {
 	var err error
 	isRedactionEvent := event.Type() == gomatrixserverlib.MRoomRedaction && event.StateKey() == nil
 	if isRedactionEvent {
 		// an event which redacts itself should be ignored
 		if event.EventID() == event.Redacts() {
-			return nil, "", nil
+			return nil, "", 0, nil
 		}
 
 		err = d.RedactionsTable.InsertRedaction(ctx, txn, tables.RedactionInfo{
@@ -740,43 +1010,117 @@ func (d *Database) handleRedactions(
 			RedactsEventID:   event.Redacts(),
 		})
 		if err != nil {
-			return nil, "", fmt.Errorf("d.RedactionsTable.InsertRedaction: %w", err)
+			return nil, "", 0, fmt.Errorf("d.RedactionsTable.InsertRedaction: %w", err)
 		}
 	}
 
 	redactionEvent, redactedEvent, validated, err := d.loadRedactionPair(ctx, txn, eventNID, event)
 	if err != nil {
-		return nil, "", fmt.Errorf("d.loadRedactionPair: %w", err)
+		return nil, "", 0, fmt.Errorf("d.loadRedactionPair: %w", err)
 	}
 	if validated || redactedEvent == nil || redactionEvent == nil {
 		// we've seen this redaction before or there is nothing to redact
-		return nil, "", nil
+		return nil, "", 0, nil
 	}
+	applied, err := d.applyRedaction(ctx, txn, redactionEvent, redactedEvent)
+	if err != nil || !applied {
+		return nil, "", 0, err
+	}
+	return redactionEvent.Event, redactedEvent.EventID(), redactedEvent.EventNID, nil
+}
+
+// applyRedaction overwrites the stored JSON of the redacted event with the redacted form and marks the
+// redaction as validated. Returns false if the redaction isn't allowed to apply to the event.
+func (d *Database) applyRedaction(
+	ctx context.Context, txn *sql.Tx, redactionEvent, redactedEvent *types.Event,
+) (bool, error) {
 	if redactedEvent.RoomID() != redactionEvent.RoomID() {
 		// redactions across rooms aren't allowed
-		return nil, "", nil
+		return false, nil
 	}
 
-	// mark the event as redacted
-	err = redactedEvent.SetUnsignedField("redacted_because", redactionEvent)
-	if err != nil {
-		return nil, "", fmt.Errorf("redactedEvent.SetUnsignedField: %w", err)
-	}
+	// Redacting strips the unsigned section, so this must happen before we mark the event as redacted.
+	// The redaction algorithm used depends on the version of the room that the event belongs to.
 	if redactionsArePermanent {
 		redactedEvent.Event = redactedEvent.Redact()
 	}
+	// mark the event as redacted
+	err := redactedEvent.SetUnsignedField("redacted_because", redactionEvent)
+	if err != nil {
+		return false, fmt.Errorf("redactedEvent.SetUnsignedField: %w", err)
+	}
 	// overwrite the eventJSON table
 	err = d.EventJSONTable.InsertEventJSON(ctx, txn, redactedEvent.EventNID, redactedEvent.JSON())
 	if err != nil {
-		return nil, "", fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
+		return false, fmt.Errorf("d.EventJSONTable.InsertEventJSON: %w", err)
 	}
 
 	err = d.RedactionsTable.MarkRedactionValidated(ctx, txn, redactionEvent.EventID(), true)
 	if err != nil {
-		err = fmt.Errorf("d.RedactionsTable.MarkRedactionValidated: %w", err)
+		return false, fmt.Errorf("d.RedactionsTable.MarkRedactionValidated: %w", err)
 	}
+	return true, nil
+}
 
-	return redactionEvent.Event, redactedEvent.EventID(), err
+// RedactEvent rewrites the stored JSON of the event with the given NID to its redacted form, using the given redaction
+// event. The redaction is recorded and the event JSON is rewritten in a single transaction. If the event being
+// redacted hasn't been stored yet then the redaction is applied when it is.
+func (d *Database) RedactEvent(
+	ctx context.Context, redactedEventNID, redactionEventNID types.EventNID,
+) error {
+	events, err := d.Events(ctx, []types.EventNID{redactedEventNID, redactionEventNID})
+	if err != nil {
+		return fmt.Errorf("d.Events: %w", err)
+	}
+	var redactionEvent, redactedEvent *types.Event
+	for i := range events {
+		switch events[i].EventNID {
+		case redactionEventNID:
+			redactionEvent = &events[i]
+		case redactedEventNID:
+			redactedEvent = &events[i]
+		}
+	}
+	if redactionEvent == nil {
+		return fmt.Errorf("redaction event NID %d not found", redactionEventNID)
+	}
+	if redactionEvent.Type() != gomatrixserverlib.MRoomRedaction || redactionEvent.StateKey() != nil {
+		return fmt.Errorf("event %s is not a redaction event", redactionEvent.EventID())
+	}
+	if redactedEvent != nil && redactedEvent.EventID() != redactionEvent.Redacts() {
+		return fmt.Errorf("redaction event %s does not redact event %s", redactionEvent.EventID(), redactedEvent.EventID())
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		info, err := d.RedactionsTable.SelectRedactionInfoByRedactionEventID(ctx, txn, redactionEvent.EventID())
+		if err != nil {
+			return fmt.Errorf("d.RedactionsTable.SelectRedactionInfoByRedactionEventID: %w", err)
+		}
+		if info != nil && info.Validated {
+			// the redaction has already been applied
+			return nil
+		}
+		if info == nil {
+			err = d.RedactionsTable.InsertRedaction(ctx, txn, tables.RedactionInfo{
+				Validated:        false,
+				RedactionEventID: redactionEvent.EventID(),
+				RedactsEventID:   redactionEvent.Redacts(),
+			})
+			if err != nil {
+				return fmt.Errorf("d.RedactionsTable.InsertRedaction: %w", err)
+			}
+		}
+		if redactedEvent == nil {
+			// handleRedactions will apply the redaction when the event is stored
+			return nil
+		}
+		_, err = d.applyRedaction(ctx, txn, redactionEvent, redactedEvent)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	d.invalidateEventJSON(redactedEventNID)
+	return nil
 }
 
 // loadRedactionPair returns both the redaction event and the redacted event, else nil.
@@ -0,0 +1,97 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+// Migrations returns the versioned roomserver migrations, which are tracked
+// in the schema_migrations table. New schema changes should be added here
+// rather than as goose deltas. Versions must never be reused or renumbered.
+func Migrations() []sqlutil.Migration {
+	return []sqlutil.Migration{
+		{Version: 1, Name: "add event JSON blob encoding", SQL: eventJSONBlobEncodingSQL, Up: UpEventJSONBlobEncoding},
+		{Version: 2, Name: "add soft-failed events", SQL: eventsSoftFailedSQL, Up: UpEventsSoftFailed},
+		{Version: 3, Name: "add event JSON deduplication", SQL: eventJSONBlobsSQL + eventJSONBlobHashSQL + eventJSONBlobHashIndexSQL, Up: UpEventJSONDeduplication},
+	}
+}
+
+const eventJSONBlobEncodingSQL = `ALTER TABLE roomserver_event_json ADD COLUMN blob_encoding INTEGER NOT NULL DEFAULT 0;`
+
+const eventsSoftFailedSQL = `ALTER TABLE roomserver_events ADD COLUMN soft_failed BOOLEAN NOT NULL DEFAULT FALSE;`
+
+const eventJSONBlobsSQL = `CREATE TABLE IF NOT EXISTS roomserver_event_json_blobs (
+    hash BLOB NOT NULL PRIMARY KEY,
+    event_json TEXT NOT NULL,
+    blob_encoding INTEGER NOT NULL DEFAULT 0
+  );`
+
+const eventJSONBlobHashSQL = `ALTER TABLE roomserver_event_json ADD COLUMN blob_hash BLOB;`
+
+const eventJSONBlobHashIndexSQL = `CREATE INDEX IF NOT EXISTS roomserver_event_json_blob_hash_idx ON roomserver_event_json (blob_hash);`
+
+// UpEventJSONBlobEncoding adds the blob_encoding column to the event JSON
+// table. Existing rows are uncompressed, which is what the default means.
+func UpEventJSONBlobEncoding(tx *sql.Tx) error {
+	return addColumnIfNotExists(tx, "roomserver_event_json", "blob_encoding", eventJSONBlobEncodingSQL)
+}
+
+// UpEventsSoftFailed adds the soft_failed column to the events table. Events
+// which were soft-failed before this can't be told apart, so are left as
+// they were, i.e. served in timelines.
+func UpEventsSoftFailed(tx *sql.Tx) error {
+	return addColumnIfNotExists(tx, "roomserver_events", "soft_failed", eventsSoftFailedSQL)
+}
+
+// UpEventJSONDeduplication adds the event JSON blobs table, the blob_hash
+// column which links deduplicated event JSON to it, and an index so that blobs
+// which are no longer used can be found. Existing rows keep their event JSON
+// inline.
+func UpEventJSONDeduplication(tx *sql.Tx) error {
+	if _, err := tx.Exec(eventJSONBlobsSQL); err != nil {
+		return fmt.Errorf("failed to create event JSON blobs table: %w", err)
+	}
+	if err := addColumnIfNotExists(tx, "roomserver_event_json", "blob_hash", eventJSONBlobHashSQL); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(eventJSONBlobHashIndexSQL); err != nil {
+		return fmt.Errorf("failed to create blob_hash index: %w", err)
+	}
+	return nil
+}
+
+// addColumnIfNotExists runs the ALTER TABLE statement which adds a column
+// unless the table was already created with it, as SQLite doesn't support
+// ADD COLUMN IF NOT EXISTS.
+func addColumnIfNotExists(tx *sql.Tx, table, column, alterSQL string) error {
+	var count int
+	err := tx.QueryRow(
+		"SELECT COUNT(*) FROM pragma_table_info($1) WHERE name = $2", table, column,
+	).Scan(&count)
+	if err != nil {
+		return fmt.Errorf("tx.QueryRow.Scan: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+	if _, err = tx.Exec(alterSQL); err != nil {
+		return fmt.Errorf("tx.Exec: %w", err)
+	}
+	return nil
+}
@@ -18,6 +18,7 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"strings"
 
 	"github.com/matrix-org/dendrite/internal"
@@ -30,27 +31,150 @@ import (
 const eventJSONSchema = `
   CREATE TABLE IF NOT EXISTS roomserver_event_json (
     event_nid INTEGER NOT NULL PRIMARY KEY,
-    event_json TEXT NOT NULL
+    event_json TEXT NOT NULL,
+    blob_encoding INTEGER NOT NULL DEFAULT 0,
+    blob_hash BLOB
+  );
+
+  CREATE TABLE IF NOT EXISTS roomserver_event_json_blobs (
+    hash BLOB NOT NULL PRIMARY KEY,
+    event_json TEXT NOT NULL,
+    blob_encoding INTEGER NOT NULL DEFAULT 0
   );
 `
 
+// Rows which are deduplicated have a blob_hash and read their event JSON from
+// the blobs table. Other rows, including those written before deduplication
+// was enabled, hold their event JSON inline.
+const eventJSONWithBlobs = "" +
+	"roomserver_event_json j LEFT JOIN roomserver_event_json_blobs b ON j.blob_hash = b.hash"
+
+const eventJSONColumns = "" +
+	"j.event_nid, COALESCE(b.event_json, j.event_json), COALESCE(b.blob_encoding, j.blob_encoding)"
+
 const insertEventJSONSQL = `
-	INSERT OR REPLACE INTO roomserver_event_json (event_nid, event_json) VALUES ($1, $2)
+	INSERT OR REPLACE INTO roomserver_event_json (event_nid, event_json, blob_encoding) VALUES ($1, $2, $3)
 `
 
+// The ($1, $2, $3) is replaced with one tuple of placeholders per row.
+const bulkInsertEventJSONSQL = `
+	INSERT INTO roomserver_event_json (event_nid, event_json, blob_encoding) VALUES ($1, $2, $3)
+	  ON CONFLICT DO NOTHING
+`
+
+const purgeEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid IN ($1)"
+
+const insertEventJSONBlobSQL = "" +
+	"INSERT INTO roomserver_event_json_blobs (hash, event_json, blob_encoding) VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+const insertEventJSONBlobLinkSQL = "" +
+	"INSERT OR REPLACE INTO roomserver_event_json (event_nid, event_json, blob_encoding, blob_hash) VALUES ($1, '', 0, $2)"
+
+// The ($1, $2, $3) is replaced with one tuple of placeholders per row.
+const bulkInsertEventJSONBlobSQL = "" +
+	"INSERT INTO roomserver_event_json_blobs (hash, event_json, blob_encoding) VALUES ($1, $2, $3)" +
+	" ON CONFLICT DO NOTHING"
+
+// The ($1, $2, $3, $4) is replaced with one tuple of placeholders per row.
+const bulkInsertEventJSONBlobLinkSQL = "" +
+	"INSERT INTO roomserver_event_json (event_nid, event_json, blob_encoding, blob_hash) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT DO NOTHING"
+
+// Deletes the blob that an event links to, unless another event links to it
+// too. This must happen before the event JSON is replaced, e.g. by a redaction,
+// so that the old event JSON doesn't linger in the blobs table.
+const deleteReplacedEventJSONBlobSQL = "" +
+	"DELETE FROM roomserver_event_json_blobs WHERE hash = (" +
+	" SELECT blob_hash FROM roomserver_event_json WHERE event_nid = $1" +
+	") AND (" +
+	" SELECT COUNT(*) FROM roomserver_event_json WHERE blob_hash = roomserver_event_json_blobs.hash" +
+	") = 1"
+
+const selectEventJSONBlobHashesSQL = "" +
+	"SELECT DISTINCT blob_hash FROM roomserver_event_json WHERE blob_hash IS NOT NULL AND event_nid IN ($1)"
+
+const deleteOrphanedEventJSONBlobsSQL = "" +
+	"DELETE FROM roomserver_event_json_blobs WHERE hash IN ($1) AND NOT EXISTS (" +
+	" SELECT 1 FROM roomserver_event_json WHERE blob_hash = roomserver_event_json_blobs.hash" +
+	")"
+
 // Bulk event JSON lookup by numeric event ID.
 // Sort by the numeric event ID.
 // This means that we can use binary search to lookup by numeric event ID.
-const bulkSelectEventJSONSQL = `
-	SELECT event_nid, event_json FROM roomserver_event_json
-	  WHERE event_nid IN ($1)
-	  ORDER BY event_nid ASC
-`
+const bulkSelectEventJSONSQL = "" +
+	"SELECT " + eventJSONColumns + " FROM " + eventJSONWithBlobs +
+	" WHERE j.event_nid IN ($1)" +
+	" ORDER BY j.event_nid ASC"
+
+// The total size of the stored event JSON in bytes, after compression.
+const selectEventJSONSizeSQL = "" +
+	"SELECT (SELECT COALESCE(SUM(LENGTH(CAST(event_json AS BLOB))), 0) FROM roomserver_event_json)" +
+	" + (SELECT COALESCE(SUM(LENGTH(CAST(event_json AS BLOB))), 0) FROM roomserver_event_json_blobs)"
+
+// The number of events in a room and the total size of their event JSON in bytes, after compression.
+// Deduplicated event JSON is counted once for every event which uses it.
+const selectRoomEventJSONSizeSQL = "" +
+	"SELECT COUNT(*), COALESCE(SUM(LENGTH(CAST(COALESCE(b.event_json, j.event_json) AS BLOB))), 0) FROM " + eventJSONWithBlobs +
+	" JOIN roomserver_events e ON j.event_nid = e.event_nid" +
+	" WHERE e.room_nid = $1"
+
+// Event JSON for all events in a room, for iterating over with a cursor.
+// Sorting by the numeric event ID lets an interrupted iteration be resumed.
+const selectEventJSONCursorSQL = "" +
+	"SELECT " + eventJSONColumns + " FROM " + eventJSONWithBlobs +
+	" JOIN roomserver_events e ON j.event_nid = e.event_nid" +
+	" WHERE e.room_nid = $1 AND j.event_nid > $2" +
+	" ORDER BY j.event_nid ASC"
+
+// Event JSON either side of an event NID, for paging through the table.
+// Both queries are range scans over the primary key.
+const selectEventJSONRangeAscSQL = "" +
+	"SELECT " + eventJSONColumns + " FROM " + eventJSONWithBlobs +
+	" WHERE j.event_nid > $1 ORDER BY j.event_nid ASC LIMIT $2"
+
+const selectEventJSONRangeDescSQL = "" +
+	"SELECT " + eventJSONColumns + " FROM " + eventJSONWithBlobs +
+	" WHERE j.event_nid < $1 ORDER BY j.event_nid DESC LIMIT $2"
+
+const selectMaxEventNIDSQL = "" +
+	"SELECT COALESCE(MAX(event_nid), 0) FROM (" +
+	" SELECT MAX(event_nid) AS event_nid FROM roomserver_events" +
+	" UNION ALL SELECT MAX(event_nid) AS event_nid FROM roomserver_event_json" +
+	") AS max_event_nids"
+
+// Anti-joins which find events without event JSON, and event JSON without events.
+// These are used to check the integrity of the database a range of NIDs at a time.
+const selectEventNIDsMissingJSONSQL = "" +
+	"SELECT e.event_nid FROM roomserver_events e" +
+	" LEFT JOIN roomserver_event_json j ON e.event_nid = j.event_nid" +
+	" WHERE e.event_nid > $1 AND e.event_nid <= $2 AND j.event_nid IS NULL" +
+	" ORDER BY e.event_nid ASC"
+
+const selectEventJSONNIDsMissingEventSQL = "" +
+	"SELECT j.event_nid FROM roomserver_event_json j" +
+	" LEFT JOIN roomserver_events e ON j.event_nid = e.event_nid" +
+	" WHERE j.event_nid > $1 AND j.event_nid <= $2 AND e.event_nid IS NULL" +
+	" ORDER BY j.event_nid ASC"
 
 type eventJSONStatements struct {
-	db                      *sql.DB
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	db                                  *sql.DB
+	encoding                            shared.EventJSONEncoding
+	deduplicate                         bool
+	insertEventJSONStmt                 *sqlutil.Stmt
+	insertEventJSONBlobStmt             *sqlutil.Stmt
+	insertEventJSONBlobLinkStmt         *sqlutil.Stmt
+	deleteReplacedEventJSONBlobStmt     *sqlutil.Stmt
+	bulkSelectEventJSONStmt             *sqlutil.Stmt
+	selectEventJSONSizeStmt             *sqlutil.Stmt
+	selectRoomEventJSONSizeStmt         *sqlutil.Stmt
+	selectEventJSONCursorStmt           *sqlutil.Stmt
+	selectEventJSONRangeAscStmt         *sqlutil.Stmt
+	selectEventJSONRangeDescStmt        *sqlutil.Stmt
+	selectMaxEventNIDStmt               *sqlutil.Stmt
+	selectEventNIDsMissingJSONStmt      *sqlutil.Stmt
+	selectEventJSONNIDsMissingEventStmt *sqlutil.Stmt
 }
 
 func createEventJSONTable(db *sql.DB) error {
@@ -58,26 +182,208 @@ func createEventJSONTable(db *sql.DB) error {
 	return err
 }
 
-func prepareEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
+func prepareEventJSONTable(db *sql.DB, encoding shared.EventJSONEncoding, deduplicate bool) (tables.EventJSON, error) {
 	s := &eventJSONStatements{
-		db: db,
+		db:          db,
+		encoding:    encoding,
+		deduplicate: deduplicate,
 	}
 
 	return s, shared.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
+		{&s.insertEventJSONBlobStmt, insertEventJSONBlobSQL},
+		{&s.insertEventJSONBlobLinkStmt, insertEventJSONBlobLinkSQL},
+		{&s.deleteReplacedEventJSONBlobStmt, deleteReplacedEventJSONBlobSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.selectEventJSONSizeStmt, selectEventJSONSizeSQL},
+		{&s.selectRoomEventJSONSizeStmt, selectRoomEventJSONSizeSQL},
+		{&s.selectEventJSONCursorStmt, selectEventJSONCursorSQL},
+		{&s.selectEventJSONRangeAscStmt, selectEventJSONRangeAscSQL},
+		{&s.selectEventJSONRangeDescStmt, selectEventJSONRangeDescSQL},
+		{&s.selectMaxEventNIDStmt, selectMaxEventNIDSQL},
+		{&s.selectEventNIDsMissingJSONStmt, selectEventNIDsMissingJSONSQL},
+		{&s.selectEventJSONNIDsMissingEventStmt, selectEventJSONNIDsMissingEventSQL},
 	}.Prepare(db)
 }
 
 func (s *eventJSONStatements) InsertEventJSON(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
 ) error {
-	_, err := sqlutil.TxStmt(txn, s.insertEventJSONStmt).ExecContext(ctx, int64(eventNID), eventJSON)
+	encoded, err := s.encoding.Encode(eventJSON)
+	if err != nil {
+		return err
+	}
+	if _, err = s.deleteReplacedEventJSONBlobStmt.WithTx(txn).ExecContext(ctx, int64(eventNID)); err != nil {
+		return err
+	}
+	if !s.deduplicate {
+		_, err = s.insertEventJSONStmt.WithTx(txn).ExecContext(ctx, int64(eventNID), encoded, s.encoding)
+		return err
+	}
+	hash := shared.HashEventJSON(eventJSON)
+	if _, err = s.insertEventJSONBlobStmt.WithTx(txn).ExecContext(ctx, hash, encoded, s.encoding); err != nil {
+		return err
+	}
+	_, err = s.insertEventJSONBlobLinkStmt.WithTx(txn).ExecContext(ctx, int64(eventNID), hash)
+	return err
+}
+
+func (s *eventJSONStatements) BulkInsertEventJSON(
+	ctx context.Context, txn *sql.Tx, pairs []tables.EventJSONPair,
+) error {
+	if s.deduplicate {
+		return s.bulkInsertEventJSONBlobs(ctx, txn, pairs)
+	}
+	const width = 3
+	const chunkSize = sqlutil.SQLite3MaxVariables / width
+	for start := 0; start < len(pairs); start += chunkSize {
+		chunk := pairs[start:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		params := make([]interface{}, 0, len(chunk)*width)
+		for _, pair := range chunk {
+			encoded, err := s.encoding.Encode(pair.EventJSON)
+			if err != nil {
+				return err
+			}
+			params = append(params, int64(pair.EventNID), encoded, s.encoding)
+		}
+		query := strings.Replace(bulkInsertEventJSONSQL, "($1, $2, $3)", sqlutil.QueryVariadicTuples(len(chunk), width), 1)
+		if _, err := execTxn(ctx, s.db, txn, query, params...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bulkInsertEventJSONBlobs behaves like BulkInsertEventJSON, but stores the
+// event JSON in the blobs table and links the events to it.
+func (s *eventJSONStatements) bulkInsertEventJSONBlobs(
+	ctx context.Context, txn *sql.Tx, pairs []tables.EventJSONPair,
+) error {
+	const width = 4
+	const chunkSize = sqlutil.SQLite3MaxVariables / width
+	for start := 0; start < len(pairs); start += chunkSize {
+		chunk := pairs[start:]
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		blobParams := make([]interface{}, 0, len(chunk)*3)
+		linkParams := make([]interface{}, 0, len(chunk)*width)
+		hashes := make([][]byte, 0, len(chunk))
+		for _, pair := range chunk {
+			encoded, err := s.encoding.Encode(pair.EventJSON)
+			if err != nil {
+				return err
+			}
+			hash := shared.HashEventJSON(pair.EventJSON)
+			blobParams = append(blobParams, hash, encoded, s.encoding)
+			linkParams = append(linkParams, int64(pair.EventNID), []byte{}, shared.EventJSONEncodingNone, hash)
+			hashes = append(hashes, hash)
+		}
+		query := strings.Replace(bulkInsertEventJSONBlobSQL, "($1, $2, $3)", sqlutil.QueryVariadicTuples(len(chunk), 3), 1)
+		if _, err := execTxn(ctx, s.db, txn, query, blobParams...); err != nil {
+			return err
+		}
+		query = strings.Replace(bulkInsertEventJSONBlobLinkSQL, "($1, $2, $3, $4)", sqlutil.QueryVariadicTuples(len(chunk), width), 1)
+		if _, err := execTxn(ctx, s.db, txn, query, linkParams...); err != nil {
+			return err
+		}
+		// Events which already had event JSON weren't linked, so the blobs
+		// for them may not be used by anything.
+		if err := s.deleteOrphanedEventJSONBlobs(ctx, txn, hashes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteOrphanedEventJSONBlobs deletes those of the given blobs which no event
+// links to. There must be no more hashes than SQLite3MaxVariables.
+func (s *eventJSONStatements) deleteOrphanedEventJSONBlobs(
+	ctx context.Context, txn *sql.Tx, hashes [][]byte,
+) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+	params := make([]interface{}, len(hashes))
+	for i, hash := range hashes {
+		params[i] = hash
+	}
+	query := strings.Replace(deleteOrphanedEventJSONBlobsSQL, "($1)", sqlutil.QueryVariadic(len(params)), 1)
+	_, err := execTxn(ctx, s.db, txn, query, params...)
 	return err
 }
 
+// selectEventJSONBlobHashes returns the hashes of the blobs which the given
+// events link to. There must be no more event NIDs than SQLite3MaxVariables.
+func (s *eventJSONStatements) selectEventJSONBlobHashes(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) ([][]byte, error) {
+	params := make([]interface{}, len(eventNIDs))
+	for i, eventNID := range eventNIDs {
+		params[i] = int64(eventNID)
+	}
+	query := strings.Replace(selectEventJSONBlobHashesSQL, "($1)", sqlutil.QueryVariadic(len(params)), 1)
+	rows, err := queryTxn(ctx, s.db, txn, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventJSONBlobHashes: rows.close() failed")
+	var hashes [][]byte
+	for rows.Next() {
+		var hash []byte
+		if err = rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
+// execTxn runs the query in the transaction, or directly on the database if
+// there is no transaction.
+func execTxn(ctx context.Context, db *sql.DB, txn *sql.Tx, query string, params ...interface{}) (sql.Result, error) {
+	if txn != nil {
+		return txn.ExecContext(ctx, query, params...)
+	}
+	return db.ExecContext(ctx, query, params...)
+}
+
+// queryTxn runs the query in the transaction, or directly on the database if
+// there is no transaction.
+func queryTxn(ctx context.Context, db *sql.DB, txn *sql.Tx, query string, params ...interface{}) (*sql.Rows, error) {
+	if txn != nil {
+		return txn.QueryContext(ctx, query, params...)
+	}
+	return db.QueryContext(ctx, query, params...)
+}
+
 func (s *eventJSONStatements) BulkSelectEventJSON(
 	ctx context.Context, eventNIDs []types.EventNID,
+) ([]tables.EventJSONPair, error) {
+	return shared.ChunkedBulkSelectEventJSON(
+		eventNIDs, sqlutil.SQLite3MaxVariables,
+		func(chunk []types.EventNID, results []tables.EventJSONPair) ([]tables.EventJSONPair, error) {
+			return s.bulkSelectEventJSONChunk(ctx, nil, chunk, results)
+		},
+	)
+}
+
+func (s *eventJSONStatements) BulkSelectEventJSONInOrder(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) ([]*tables.EventJSONPair, error) {
+	return shared.ChunkedBulkSelectEventJSONInOrder(
+		eventNIDs, sqlutil.SQLite3MaxVariables,
+		func(chunk []types.EventNID, results []tables.EventJSONPair) ([]tables.EventJSONPair, error) {
+			return s.bulkSelectEventJSONChunk(ctx, txn, chunk, results)
+		},
+	)
+}
+
+func (s *eventJSONStatements) bulkSelectEventJSONChunk(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID, results []tables.EventJSONPair,
 ) ([]tables.EventJSONPair, error) {
 	iEventNIDs := make([]interface{}, len(eventNIDs))
 	for k, v := range eventNIDs {
@@ -85,25 +391,137 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	selectOrig := strings.Replace(bulkSelectEventJSONSQL, "($1)", sqlutil.QueryVariadic(len(iEventNIDs)), 1)
 
-	rows, err := s.db.QueryContext(ctx, selectOrig, iEventNIDs...)
+	rows, err := queryTxn(ctx, s.db, txn, selectOrig, iEventNIDs...)
 	if err != nil {
 		return nil, err
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectEventJSON: rows.close() failed")
 
-	// We know that we will only get as many results as event NIDs
-	// because of the unique constraint on event NIDs.
-	// So we can allocate an array of the correct size now.
-	// We might get fewer results than NIDs so we adjust the length of the slice before returning it.
-	results := make([]tables.EventJSONPair, len(eventNIDs))
-	i := 0
-	for ; rows.Next(); i++ {
-		result := &results[i]
+	for rows.Next() {
+		var eventNID int64
+		var data []byte
+		var encoding shared.EventJSONEncoding
+		if err := rows.Scan(&eventNID, &data, &encoding); err != nil {
+			return nil, err
+		}
+		result := tables.EventJSONPair{EventNID: types.EventNID(eventNID)}
+		if result.EventJSON, err = encoding.Decode(data); err != nil {
+			return nil, fmt.Errorf("failed to decode event JSON for event NID %d: %w", eventNID, err)
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+func (s *eventJSONStatements) PurgeEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID,
+) (int64, error) {
+	var purged int64
+	for start := 0; start < len(eventNIDs); start += sqlutil.SQLite3MaxVariables {
+		chunk := eventNIDs[start:]
+		if len(chunk) > sqlutil.SQLite3MaxVariables {
+			chunk = chunk[:sqlutil.SQLite3MaxVariables]
+		}
+		params := make([]interface{}, len(chunk))
+		for i, eventNID := range chunk {
+			params[i] = int64(eventNID)
+		}
+		hashes, err := s.selectEventJSONBlobHashes(ctx, txn, chunk)
+		if err != nil {
+			return purged, err
+		}
+		query := strings.Replace(purgeEventJSONSQL, "($1)", sqlutil.QueryVariadic(len(chunk)), 1)
+		result, err := execTxn(ctx, s.db, txn, query, params...)
+		if err != nil {
+			return purged, err
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return purged, err
+		}
+		purged += affected
+		if err = s.deleteOrphanedEventJSONBlobs(ctx, txn, hashes); err != nil {
+			return purged, err
+		}
+	}
+	return purged, nil
+}
+
+func (s *eventJSONStatements) SelectEventJSONSize(ctx context.Context) (size int64, err error) {
+	err = s.selectEventJSONSizeStmt.QueryRowContext(ctx).Scan(&size)
+	return
+}
+
+func (s *eventJSONStatements) SelectRoomEventJSONSize(
+	ctx context.Context, roomNID types.RoomNID,
+) (count int64, size int64, err error) {
+	err = s.selectRoomEventJSONSizeStmt.QueryRowContext(ctx, int64(roomNID)).Scan(&count, &size)
+	return
+}
+
+func (s *eventJSONStatements) SelectEventJSONCursor(
+	ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID,
+) (tables.EventJSONCursor, error) {
+	rows, err := s.selectEventJSONCursorStmt.QueryContext(ctx, int64(roomNID), int64(afterEventNID))
+	if err != nil {
+		return nil, err
+	}
+	return shared.NewEventJSONCursor(rows), nil
+}
+
+func (s *eventJSONStatements) SelectEventJSONRange(
+	ctx context.Context, fromNID types.EventNID, limit int, ascending bool,
+) ([]tables.EventJSONPair, error) {
+	limit, err := tables.CheckEventJSONRangeLimit(limit)
+	if err != nil {
+		return nil, err
+	}
+	stmt := s.selectEventJSONRangeDescStmt
+	if ascending {
+		stmt = s.selectEventJSONRangeAscStmt
+	}
+	rows, err := stmt.QueryContext(ctx, int64(fromNID), limit)
+	if err != nil {
+		return nil, err
+	}
+	return shared.ReadEventJSONPairs(shared.NewEventJSONCursor(rows), limit)
+}
+
+func (s *eventJSONStatements) SelectMaxEventNID(
+	ctx context.Context, txn *sql.Tx,
+) (types.EventNID, error) {
+	var eventNID int64
+	err := s.selectMaxEventNIDStmt.WithTx(txn).QueryRowContext(ctx).Scan(&eventNID)
+	return types.EventNID(eventNID), err
+}
+
+func (s *eventJSONStatements) SelectEventNIDsMissingJSON(
+	ctx context.Context, txn *sql.Tx, fromNID, toNID types.EventNID,
+) ([]types.EventNID, error) {
+	return selectEventNIDRange(ctx, s.selectEventNIDsMissingJSONStmt.WithTx(txn), fromNID, toNID)
+}
+
+func (s *eventJSONStatements) SelectEventJSONNIDsMissingEvent(
+	ctx context.Context, txn *sql.Tx, fromNID, toNID types.EventNID,
+) ([]types.EventNID, error) {
+	return selectEventNIDRange(ctx, s.selectEventJSONNIDsMissingEventStmt.WithTx(txn), fromNID, toNID)
+}
+
+func selectEventNIDRange(
+	ctx context.Context, stmt *sqlutil.Stmt, fromNID, toNID types.EventNID,
+) ([]types.EventNID, error) {
+	rows, err := stmt.QueryContext(ctx, int64(fromNID), int64(toNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventNIDRange: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
 		var eventNID int64
-		if err := rows.Scan(&eventNID, &result.EventJSON); err != nil {
+		if err = rows.Scan(&eventNID); err != nil {
 			return nil, err
 		}
-		result.EventNID = types.EventNID(eventNID)
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
 	}
-	return results[:i], nil
+	return eventNIDs, rows.Err()
 }
@@ -0,0 +1,612 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3/deltas"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+func openEventJSONTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dendrite-event-json")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	db, err := sql.Open(sqlutil.SQLiteDriverName(), filepath.Join(dir, "roomserver.db"))
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	// The event JSON cursor joins against the events table.
+	if err = createEventsTable(db); err != nil {
+		t.Fatalf("failed to create events table: %s", err)
+	}
+	return db
+}
+
+func TestEventJSONMixedEncodings(t *testing.T) {
+	ctx := context.Background()
+	db := openEventJSONTestDB(t)
+
+	// Start with the table as it was before blob_encoding was added, with
+	// an existing uncompressed row, and then migrate it.
+	if _, err := db.Exec(`CREATE TABLE roomserver_event_json (
+		event_nid INTEGER NOT NULL PRIMARY KEY,
+		event_json TEXT NOT NULL
+	)`); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	if _, err := db.Exec(`INSERT INTO roomserver_event_json VALUES (1, '{"legacy":true}')`); err != nil {
+		t.Fatalf("failed to insert legacy row: %s", err)
+	}
+	m := sqlutil.NewMigrator(db, "roomserver")
+	m.AddMigrations(deltas.Migrations()...)
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("failed to run migrations: %s", err)
+	}
+
+	want := map[types.EventNID]string{
+		1: `{"legacy":true}`,
+	}
+	for nid, encoding := range map[types.EventNID]shared.EventJSONEncoding{
+		2: shared.EventJSONEncodingNone,
+		3: shared.EventJSONEncodingGzip,
+		4: shared.EventJSONEncodingZstd,
+	} {
+		table, err := prepareEventJSONTable(db, encoding, false)
+		if err != nil {
+			t.Fatalf("failed to prepare table: %s", err)
+		}
+		want[nid] = `{"type":"m.room.message","encoding":` + string(rune('0'+encoding)) + `}`
+		if err = table.InsertEventJSON(ctx, nil, nid, []byte(want[nid])); err != nil {
+			t.Fatalf("failed to insert event JSON: %s", err)
+		}
+	}
+
+	// Read everything back with a table configured for yet another encoding,
+	// to make sure that decoding uses the stored encoding of each row.
+	table, err := prepareEventJSONTable(db, shared.EventJSONEncodingGzip, false)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	pairs, err := table.BulkSelectEventJSON(ctx, []types.EventNID{4, 3, 2, 1})
+	if err != nil {
+		t.Fatalf("failed to select event JSON: %s", err)
+	}
+	if len(pairs) != len(want) {
+		t.Fatalf("got %d results, want %d", len(pairs), len(want))
+	}
+	for i, pair := range pairs {
+		if i > 0 && pairs[i-1].EventNID >= pair.EventNID {
+			t.Fatalf("results are not sorted by event NID")
+		}
+		if string(pair.EventJSON) != want[pair.EventNID] {
+			t.Fatalf("event NID %d: got %s, want %s", pair.EventNID, pair.EventJSON, want[pair.EventNID])
+		}
+	}
+}
+
+func TestBulkInsertEventJSON(t *testing.T) {
+	ctx := context.Background()
+	db := openEventJSONTestDB(t)
+	if err := createEventJSONTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	table, err := prepareEventJSONTable(db, shared.EventJSONEncodingNone, false)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	if err = table.InsertEventJSON(ctx, nil, 1, []byte(`{"original":true}`)); err != nil {
+		t.Fatalf("failed to insert event JSON: %s", err)
+	}
+
+	// Insert enough rows to need more than one statement within SQLite's
+	// variable limit, including one which conflicts with an existing row.
+	count := sqlutil.SQLite3MaxVariables
+	pairs := make([]tables.EventJSONPair, 0, count)
+	nids := make([]types.EventNID, 0, count)
+	for i := 1; i <= count; i++ {
+		pairs = append(pairs, tables.EventJSONPair{
+			EventNID:  types.EventNID(i),
+			EventJSON: []byte(`{"original":false}`),
+		})
+		nids = append(nids, types.EventNID(i))
+	}
+	if err = table.BulkInsertEventJSON(ctx, nil, pairs); err != nil {
+		t.Fatalf("failed to bulk insert event JSON: %s", err)
+	}
+	if err = table.BulkInsertEventJSON(ctx, nil, nil); err != nil {
+		t.Fatalf("failed to bulk insert no event JSON: %s", err)
+	}
+
+	// Select in chunks to stay within the variable limit.
+	var results []tables.EventJSONPair
+	for start := 0; start < len(nids); start += 500 {
+		end := start + 500
+		if end > len(nids) {
+			end = len(nids)
+		}
+		chunk, err := table.BulkSelectEventJSON(ctx, nids[start:end])
+		if err != nil {
+			t.Fatalf("failed to select event JSON: %s", err)
+		}
+		results = append(results, chunk...)
+	}
+	if len(results) != count {
+		t.Fatalf("got %d results, want %d", len(results), count)
+	}
+	if string(results[0].EventJSON) != `{"original":true}` {
+		t.Fatalf("conflicting row was overwritten: %s", results[0].EventJSON)
+	}
+	if string(results[count-1].EventJSON) != `{"original":false}` {
+		t.Fatalf("unexpected event JSON: %s", results[count-1].EventJSON)
+	}
+}
+
+func TestEventJSONCache(t *testing.T) {
+	ctx := context.Background()
+	db := openEventJSONTestDB(t)
+	if err := createEventJSONTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	table, err := prepareEventJSONTable(db, shared.EventJSONEncodingNone, false)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	cache, err := shared.NewEventJSONCache(table, 2)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	for _, nid := range []types.EventNID{1, 2, 3} {
+		if err = cache.InsertEventJSON(ctx, nil, nid, []byte(`{"original":true}`)); err != nil {
+			t.Fatalf("failed to insert event JSON: %s", err)
+		}
+	}
+	if _, err = cache.BulkSelectEventJSON(ctx, []types.EventNID{1}); err != nil {
+		t.Fatalf("failed to select event JSON: %s", err)
+	}
+
+	// Rewrite the events in the table directly, so that only cache misses
+	// see the new value, then redact event 2 through the cache.
+	if _, err = db.Exec(`UPDATE roomserver_event_json SET event_json = '{"original":false}'`); err != nil {
+		t.Fatalf("failed to update event JSON: %s", err)
+	}
+	if err = cache.InsertEventJSON(ctx, nil, 2, []byte(`{"redacted":true}`)); err != nil {
+		t.Fatalf("failed to insert event JSON: %s", err)
+	}
+	pairs, err := cache.BulkSelectEventJSON(ctx, []types.EventNID{3, 2, 1, 1})
+	if err != nil {
+		t.Fatalf("failed to select event JSON: %s", err)
+	}
+	want := []string{`{"original":true}`, `{"redacted":true}`, `{"original":false}`}
+	if len(pairs) != len(want) {
+		t.Fatalf("got %d results, want %d", len(pairs), len(want))
+	}
+	for i, pair := range pairs {
+		if pair.EventNID != types.EventNID(i+1) {
+			t.Fatalf("results are not sorted by event NID")
+		}
+		if string(pair.EventJSON) != want[i] {
+			t.Fatalf("event NID %d: got %s, want %s", pair.EventNID, pair.EventJSON, want[i])
+		}
+	}
+}
+
+func TestSelectEventJSONRange(t *testing.T) {
+	ctx := context.Background()
+	db := openEventJSONTestDB(t)
+	if err := createEventJSONTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	table, err := prepareEventJSONTable(db, shared.EventJSONEncodingNone, false)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	for nid := types.EventNID(1); nid <= 5; nid++ {
+		if err = table.InsertEventJSON(ctx, nil, nid, []byte(`{}`)); err != nil {
+			t.Fatalf("failed to insert event JSON: %s", err)
+		}
+	}
+	for _, tc := range []struct {
+		fromNID   types.EventNID
+		limit     int
+		ascending bool
+		want      []types.EventNID
+	}{
+		{0, 2, true, []types.EventNID{1, 2}},
+		{2, 2, true, []types.EventNID{3, 4}},
+		{4, 2, true, []types.EventNID{5}},
+		{6, 2, false, []types.EventNID{5, 4}},
+		{2, 2, false, []types.EventNID{1}},
+		{0, tables.MaxEventJSONRangeLimit + 1, true, []types.EventNID{1, 2, 3, 4, 5}},
+	} {
+		pairs, err := table.SelectEventJSONRange(ctx, tc.fromNID, tc.limit, tc.ascending)
+		if err != nil {
+			t.Fatalf("failed to select event JSON range: %s", err)
+		}
+		var got []types.EventNID
+		for _, pair := range pairs {
+			got = append(got, pair.EventNID)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("range from %d (limit %d, ascending %v): got %v, want %v", tc.fromNID, tc.limit, tc.ascending, got, tc.want)
+		}
+	}
+	if _, err = table.SelectEventJSONRange(ctx, 0, 0, true); err == nil {
+		t.Fatalf("expected an error for a limit of 0")
+	}
+}
+
+func TestSelectEventJSONCursor(t *testing.T) {
+	ctx := context.Background()
+	db := openEventJSONTestDB(t)
+	if err := createEventJSONTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	table, err := prepareEventJSONTable(db, shared.EventJSONEncodingGzip, false)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	// Events 1-4 are in room 1 and event 5 is in room 2.
+	for nid := types.EventNID(1); nid <= 5; nid++ {
+		roomNID := 1
+		if nid == 5 {
+			roomNID = 2
+		}
+		if _, err = db.Exec(
+			"INSERT INTO roomserver_events (event_nid, room_nid, event_type_nid, event_state_key_nid, depth, event_id, reference_sha256)"+
+				" VALUES ($1, $2, 0, 0, 0, $3, '')", nid, roomNID, string(rune('a'+nid)),
+		); err != nil {
+			t.Fatalf("failed to insert event: %s", err)
+		}
+		if err = table.InsertEventJSON(ctx, nil, nid, []byte(`{}`)); err != nil {
+			t.Fatalf("failed to insert event JSON: %s", err)
+		}
+	}
+
+	// Resume after event 1 and abandon the cursor part way through.
+	cursor, err := table.SelectEventJSONCursor(ctx, 1, 1)
+	if err != nil {
+		t.Fatalf("failed to select cursor: %s", err)
+	}
+	pair, err := cursor.Next()
+	if err != nil {
+		t.Fatalf("failed to read cursor: %s", err)
+	}
+	if pair.EventNID != 2 || string(pair.EventJSON) != `{}` {
+		t.Fatalf("unexpected first result: %d %s", pair.EventNID, pair.EventJSON)
+	}
+	if err = cursor.Close(); err != nil {
+		t.Fatalf("failed to close cursor: %s", err)
+	}
+
+	cursor, err = table.SelectEventJSONCursor(ctx, 1, pair.EventNID)
+	if err != nil {
+		t.Fatalf("failed to select cursor: %s", err)
+	}
+	var nids []types.EventNID
+	for {
+		pair, err = cursor.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read cursor: %s", err)
+		}
+		nids = append(nids, pair.EventNID)
+	}
+	if len(nids) != 2 || nids[0] != 3 || nids[1] != 4 {
+		t.Fatalf("got event NIDs %v, want [3 4]", nids)
+	}
+}
+
+func TestEventJSONIntegrity(t *testing.T) {
+	ctx := context.Background()
+	db := openEventJSONTestDB(t)
+	if err := createEventJSONTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	table, err := prepareEventJSONTable(db, shared.EventJSONEncodingNone, false)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	if maxNID, err := table.SelectMaxEventNID(ctx, nil); err != nil || maxNID != 0 {
+		t.Fatalf("got max event NID %d (%v) for empty tables, want 0", maxNID, err)
+	}
+	// Event 1 is consistent, event 2 has no JSON and event 3 has no event.
+	for _, nid := range []types.EventNID{1, 2} {
+		if _, err = db.Exec(
+			"INSERT INTO roomserver_events (event_nid, room_nid, event_type_nid, event_state_key_nid, depth, event_id, reference_sha256)"+
+				" VALUES ($1, 1, 0, 0, 0, $2, '')", nid, string(rune('a'+nid)),
+		); err != nil {
+			t.Fatalf("failed to insert event: %s", err)
+		}
+	}
+	for _, nid := range []types.EventNID{1, 3} {
+		if err = table.InsertEventJSON(ctx, nil, nid, []byte(`{}`)); err != nil {
+			t.Fatalf("failed to insert event JSON: %s", err)
+		}
+	}
+	maxNID, err := table.SelectMaxEventNID(ctx, nil)
+	if err != nil || maxNID != 3 {
+		t.Fatalf("got max event NID %d (%v), want 3", maxNID, err)
+	}
+	missingJSON, err := table.SelectEventNIDsMissingJSON(ctx, nil, 0, maxNID)
+	if err != nil || len(missingJSON) != 1 || missingJSON[0] != 2 {
+		t.Fatalf("got event NIDs missing JSON %v (%v), want [2]", missingJSON, err)
+	}
+	missingEvent, err := table.SelectEventJSONNIDsMissingEvent(ctx, nil, 0, maxNID)
+	if err != nil || len(missingEvent) != 1 || missingEvent[0] != 3 {
+		t.Fatalf("got event JSON NIDs missing event %v (%v), want [3]", missingEvent, err)
+	}
+	if missingJSON, err = table.SelectEventNIDsMissingJSON(ctx, nil, 2, maxNID); err != nil || len(missingJSON) != 0 {
+		t.Fatalf("got event NIDs missing JSON %v (%v) outside of range", missingJSON, err)
+	}
+}
+
+func TestEventJSONDeduplication(t *testing.T) {
+	ctx := context.Background()
+	db := openEventJSONTestDB(t)
+	if err := createEventJSONTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	inline, err := prepareEventJSONTable(db, shared.EventJSONEncodingNone, false)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	table, err := prepareEventJSONTable(db, shared.EventJSONEncodingGzip, true)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	countBlobs := func() (count int) {
+		t.Helper()
+		if err := db.QueryRow("SELECT COUNT(*) FROM roomserver_event_json_blobs").Scan(&count); err != nil {
+			t.Fatalf("failed to count blobs: %s", err)
+		}
+		return
+	}
+
+	// Event 1 was stored before deduplication was enabled. Events 2 and 3
+	// are identical, so share a blob.
+	if err = inline.InsertEventJSON(ctx, nil, 1, []byte(`{"same":true}`)); err != nil {
+		t.Fatalf("failed to insert event JSON: %s", err)
+	}
+	if err = table.InsertEventJSON(ctx, nil, 2, []byte(`{"same":true}`)); err != nil {
+		t.Fatalf("failed to insert event JSON: %s", err)
+	}
+	if err = table.BulkInsertEventJSON(ctx, nil, []tables.EventJSONPair{
+		{EventNID: 3, EventJSON: []byte(`{"same":true}`)},
+		{EventNID: 4, EventJSON: []byte(`{"different":true}`)},
+	}); err != nil {
+		t.Fatalf("failed to bulk insert event JSON: %s", err)
+	}
+	if got := countBlobs(); got != 2 {
+		t.Fatalf("got %d blobs, want 2", got)
+	}
+	pairs, err := table.BulkSelectEventJSON(ctx, []types.EventNID{1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("failed to select event JSON: %s", err)
+	}
+	want := []string{`{"same":true}`, `{"same":true}`, `{"same":true}`, `{"different":true}`}
+	if len(pairs) != len(want) {
+		t.Fatalf("got %d pairs, want %d", len(pairs), len(want))
+	}
+	for i, pair := range pairs {
+		if string(pair.EventJSON) != want[i] {
+			t.Fatalf("event NID %d: got %s, want %s", pair.EventNID, pair.EventJSON, want[i])
+		}
+	}
+
+	// Replacing event 4, e.g. by redacting it, must remove its old blob.
+	if err = table.InsertEventJSON(ctx, nil, 4, []byte(`{"redacted":true}`)); err != nil {
+		t.Fatalf("failed to replace event JSON: %s", err)
+	}
+	var orphaned int
+	if err = db.QueryRow(
+		"SELECT COUNT(*) FROM roomserver_event_json_blobs WHERE hash = $1", shared.HashEventJSON([]byte(`{"different":true}`)),
+	).Scan(&orphaned); err != nil {
+		t.Fatalf("failed to count blobs: %s", err)
+	}
+	if orphaned != 0 {
+		t.Fatalf("replaced event JSON is still in the blobs table")
+	}
+
+	// The shared blob is only removed once neither event uses it.
+	if _, err = table.PurgeEventJSON(ctx, nil, []types.EventNID{2}); err != nil {
+		t.Fatalf("failed to purge event JSON: %s", err)
+	}
+	if got := countBlobs(); got != 2 {
+		t.Fatalf("got %d blobs after purging one user of a shared blob, want 2", got)
+	}
+	if _, err = table.PurgeEventJSON(ctx, nil, []types.EventNID{3, 4}); err != nil {
+		t.Fatalf("failed to purge event JSON: %s", err)
+	}
+	if got := countBlobs(); got != 0 {
+		t.Fatalf("got %d blobs after purging, want 0", got)
+	}
+}
+
+func TestBulkSelectEventJSONRandomNIDs(t *testing.T) {
+	ctx := context.Background()
+	db := openEventJSONTestDB(t)
+	if err := createEventJSONTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	table, err := prepareEventJSONTable(db, shared.EventJSONEncodingNone, false)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	// Only the even NIDs have event JSON, so that some lookups miss.
+	const maxNID = 3 * sqlutil.SQLite3MaxVariables
+	var pairs []tables.EventJSONPair
+	for nid := types.EventNID(2); nid <= maxNID; nid += 2 {
+		pairs = append(pairs, tables.EventJSONPair{EventNID: nid, EventJSON: []byte(fmt.Sprintf(`{"nid":%d}`, nid))})
+	}
+	if err = table.BulkInsertEventJSON(ctx, nil, pairs); err != nil {
+		t.Fatalf("failed to insert event JSON: %s", err)
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	sizes := []int{1, sqlutil.SQLite3MaxVariables, sqlutil.SQLite3MaxVariables + 1, 2*sqlutil.SQLite3MaxVariables + 7}
+	for i := 0; i < 10; i++ {
+		sizes = append(sizes, rng.Intn(maxNID))
+	}
+	for _, size := range sizes {
+		nids := make([]types.EventNID, size)
+		want := map[types.EventNID]bool{}
+		for i := range nids {
+			nids[i] = types.EventNID(1 + rng.Intn(maxNID))
+			if nids[i]%2 == 0 {
+				want[nids[i]] = true
+			}
+		}
+		results, err := table.BulkSelectEventJSON(ctx, nids)
+		if err != nil {
+			t.Fatalf("size %d: failed to select event JSON: %s", size, err)
+		}
+		if len(results) != len(want) {
+			t.Fatalf("size %d: got %d results, want %d", size, len(results), len(want))
+		}
+		for i, result := range results {
+			if !want[result.EventNID] || string(result.EventJSON) != fmt.Sprintf(`{"nid":%d}`, result.EventNID) {
+				t.Fatalf("size %d: unexpected result for event NID %d: %s", size, result.EventNID, result.EventJSON)
+			}
+			if i > 0 && results[i-1].EventNID >= result.EventNID {
+				t.Fatalf("size %d: results are not sorted by event NID", size)
+			}
+		}
+	}
+
+	// Selecting nothing must not run any SQL, so works even with the
+	// database closed.
+	if err = db.Close(); err != nil {
+		t.Fatalf("failed to close database: %s", err)
+	}
+	results, err := table.BulkSelectEventJSON(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to select no event JSON: %s", err)
+	}
+	if results == nil || len(results) != 0 {
+		t.Fatalf("got %v, want an empty slice", results)
+	}
+}
+
+func TestBulkSelectEventJSONInOrder(t *testing.T) {
+	ctx := context.Background()
+	db := openEventJSONTestDB(t)
+	if err := createEventJSONTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	table, err := prepareEventJSONTable(db, shared.EventJSONEncodingNone, false)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	for _, nid := range []types.EventNID{1, 2, 3} {
+		if err = table.InsertEventJSON(ctx, nil, nid, []byte(fmt.Sprintf(`{"nid":%d}`, nid))); err != nil {
+			t.Fatalf("failed to insert event JSON: %s", err)
+		}
+	}
+	txn, err := db.Begin()
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %s", err)
+	}
+	defer txn.Rollback() // nolint:errcheck
+	if err = table.InsertEventJSON(ctx, txn, 4, []byte(`{"nid":4}`)); err != nil {
+		t.Fatalf("failed to insert event JSON: %s", err)
+	}
+
+	eventNIDs := []types.EventNID{3, 4, 1, 3}
+	for _, tc := range []struct {
+		name string
+		txn  *sql.Tx
+		want []string
+	}{
+		{"without a transaction", nil, []string{`{"nid":3}`, "", `{"nid":1}`, `{"nid":3}`}},
+		{"in a transaction", txn, []string{`{"nid":3}`, `{"nid":4}`, `{"nid":1}`, `{"nid":3}`}},
+	} {
+		results, err := table.BulkSelectEventJSONInOrder(ctx, tc.txn, eventNIDs)
+		if err != nil {
+			t.Fatalf("%s: failed to select event JSON: %s", tc.name, err)
+		}
+		if len(results) != len(eventNIDs) {
+			t.Fatalf("%s: got %d results, want %d", tc.name, len(results), len(eventNIDs))
+		}
+		for i, result := range results {
+			if tc.want[i] == "" {
+				if result != nil {
+					t.Errorf("%s: result %d: got %s, want nil", tc.name, i, result.EventJSON)
+				}
+				continue
+			}
+			if result == nil || result.EventNID != eventNIDs[i] || string(result.EventJSON) != tc.want[i] {
+				t.Errorf("%s: result %d: got %+v, want %s", tc.name, i, result, tc.want[i])
+			}
+		}
+	}
+}
+
+func TestEventJSONCacheInOrder(t *testing.T) {
+	ctx := context.Background()
+	db := openEventJSONTestDB(t)
+	if err := createEventJSONTable(db); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	table, err := prepareEventJSONTable(db, shared.EventJSONEncodingNone, false)
+	if err != nil {
+		t.Fatalf("failed to prepare table: %s", err)
+	}
+	cache, err := shared.NewEventJSONCache(table, 10)
+	if err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	for _, nid := range []types.EventNID{1, 2, 3} {
+		if err = cache.InsertEventJSON(ctx, nil, nid, []byte(`{"original":true}`)); err != nil {
+			t.Fatalf("failed to insert event JSON: %s", err)
+		}
+	}
+	if _, err = cache.BulkSelectEventJSONInOrder(ctx, nil, []types.EventNID{2}); err != nil {
+		t.Fatalf("failed to select event JSON: %s", err)
+	}
+
+	// Only event 2 is cached, so the others see the rewritten value.
+	if _, err = db.Exec(`UPDATE roomserver_event_json SET event_json = '{"original":false}'`); err != nil {
+		t.Fatalf("failed to update event JSON: %s", err)
+	}
+	eventNIDs := []types.EventNID{3, 5, 2, 1, 3}
+	results, err := cache.BulkSelectEventJSONInOrder(ctx, nil, eventNIDs)
+	if err != nil {
+		t.Fatalf("failed to select event JSON: %s", err)
+	}
+	want := []string{`{"original":false}`, "", `{"original":true}`, `{"original":false}`, `{"original":false}`}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, result := range results {
+		if want[i] == "" {
+			if result != nil {
+				t.Errorf("result %d: got %s, want nil", i, result.EventJSON)
+			}
+			continue
+		}
+		if result == nil || result.EventNID != eventNIDs[i] || string(result.EventJSON) != want[i] {
+			t.Errorf("result %d: got %+v, want %s", i, result, want[i])
+		}
+	}
+}
@@ -64,10 +64,10 @@ const bulkSelectEventStateKeyNIDSQL = `
 
 type eventStateKeyStatements struct {
 	db                             *sql.DB
-	insertEventStateKeyNIDStmt     *sql.Stmt
-	selectEventStateKeyNIDStmt     *sql.Stmt
-	bulkSelectEventStateKeyNIDStmt *sql.Stmt
-	bulkSelectEventStateKeyStmt    *sql.Stmt
+	insertEventStateKeyNIDStmt     *sqlutil.Stmt
+	selectEventStateKeyNIDStmt     *sqlutil.Stmt
+	bulkSelectEventStateKeyNIDStmt *sqlutil.Stmt
+	bulkSelectEventStateKeyStmt    *sqlutil.Stmt
 }
 
 func createEventStateKeysTable(db *sql.DB) error {
@@ -91,7 +91,7 @@ func prepareEventStateKeysTable(db *sql.DB) (tables.EventStateKeys, error) {
 func (s *eventStateKeyStatements) InsertEventStateKeyNID(
 	ctx context.Context, txn *sql.Tx, eventStateKey string,
 ) (types.EventStateKeyNID, error) {
-	insertStmt := sqlutil.TxStmt(txn, s.insertEventStateKeyNIDStmt)
+	insertStmt := s.insertEventStateKeyNIDStmt.WithTx(txn)
 	res, err := insertStmt.ExecContext(ctx, eventStateKey)
 	if err != nil {
 		return 0, err
@@ -107,7 +107,7 @@ func (s *eventStateKeyStatements) SelectEventStateKeyNID(
 	ctx context.Context, txn *sql.Tx, eventStateKey string,
 ) (types.EventStateKeyNID, error) {
 	var eventStateKeyNID int64
-	stmt := sqlutil.TxStmt(txn, s.selectEventStateKeyNIDStmt)
+	stmt := s.selectEventStateKeyNIDStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, eventStateKey).Scan(&eventStateKeyNID)
 	return types.EventStateKeyNID(eventStateKeyNID), err
 }
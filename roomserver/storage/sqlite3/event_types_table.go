@@ -79,10 +79,10 @@ const bulkSelectEventTypeNIDSQL = `
 
 type eventTypeStatements struct {
 	db                           *sql.DB
-	insertEventTypeNIDStmt       *sql.Stmt
-	insertEventTypeNIDResultStmt *sql.Stmt
-	selectEventTypeNIDStmt       *sql.Stmt
-	bulkSelectEventTypeNIDStmt   *sql.Stmt
+	insertEventTypeNIDStmt       *sqlutil.Stmt
+	insertEventTypeNIDResultStmt *sqlutil.Stmt
+	selectEventTypeNIDStmt       *sqlutil.Stmt
+	bulkSelectEventTypeNIDStmt   *sqlutil.Stmt
 }
 
 func createEventTypesTable(db *sql.DB) error {
@@ -107,8 +107,8 @@ func (s *eventTypeStatements) InsertEventTypeNID(
 	ctx context.Context, txn *sql.Tx, eventType string,
 ) (types.EventTypeNID, error) {
 	var eventTypeNID int64
-	insertStmt := sqlutil.TxStmt(txn, s.insertEventTypeNIDStmt)
-	resultStmt := sqlutil.TxStmt(txn, s.insertEventTypeNIDResultStmt)
+	insertStmt := s.insertEventTypeNIDStmt.WithTx(txn)
+	resultStmt := s.insertEventTypeNIDResultStmt.WithTx(txn)
 	_, err := insertStmt.ExecContext(ctx, eventType)
 	if err != nil {
 		return 0, fmt.Errorf("insertStmt.ExecContext: %w", err)
@@ -123,7 +123,7 @@ func (s *eventTypeStatements) SelectEventTypeNID(
 	ctx context.Context, tx *sql.Tx, eventType string,
 ) (types.EventTypeNID, error) {
 	var eventTypeNID int64
-	selectStmt := sqlutil.TxStmt(tx, s.selectEventTypeNIDStmt)
+	selectStmt := s.selectEventTypeNIDStmt.WithTx(tx)
 	err := selectStmt.QueryRowContext(ctx, eventType).Scan(&eventTypeNID)
 	return types.EventTypeNID(eventTypeNID), err
 }
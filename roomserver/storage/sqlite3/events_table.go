@@ -43,13 +43,14 @@ const eventsSchema = `
     event_id TEXT NOT NULL UNIQUE,
     reference_sha256 BLOB NOT NULL,
 	auth_event_nids TEXT NOT NULL DEFAULT '[]',
-	is_rejected BOOLEAN NOT NULL DEFAULT FALSE
+	is_rejected BOOLEAN NOT NULL DEFAULT FALSE,
+	soft_failed BOOLEAN NOT NULL DEFAULT FALSE
   );
 `
 
 const insertEventSQL = `
-	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected)
-	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	INSERT INTO roomserver_events (room_nid, event_type_nid, event_state_key_nid, event_id, reference_sha256, auth_event_nids, depth, is_rejected, soft_failed)
+	  VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	  ON CONFLICT DO NOTHING;
 `
 
@@ -104,20 +105,27 @@ const selectMaxEventDepthSQL = "" +
 const selectRoomNIDsForEventNIDsSQL = "" +
 	"SELECT event_nid, room_nid FROM roomserver_events WHERE event_nid IN ($1)"
 
+const selectEventNIDsForRoomSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1"
+
+const bulkSelectSoftFailedSQL = "" +
+	"SELECT event_nid FROM roomserver_events WHERE soft_failed = TRUE AND event_nid IN ($1)"
+
 type eventStatements struct {
 	db                                     *sql.DB
-	insertEventStmt                        *sql.Stmt
-	selectEventStmt                        *sql.Stmt
-	bulkSelectStateEventByIDStmt           *sql.Stmt
-	bulkSelectStateAtEventByIDStmt         *sql.Stmt
-	updateEventStateStmt                   *sql.Stmt
-	selectEventSentToOutputStmt            *sql.Stmt
-	updateEventSentToOutputStmt            *sql.Stmt
-	selectEventIDStmt                      *sql.Stmt
-	bulkSelectStateAtEventAndReferenceStmt *sql.Stmt
-	bulkSelectEventReferenceStmt           *sql.Stmt
-	bulkSelectEventIDStmt                  *sql.Stmt
-	bulkSelectEventNIDStmt                 *sql.Stmt
+	insertEventStmt                        *sqlutil.Stmt
+	selectEventStmt                        *sqlutil.Stmt
+	bulkSelectStateEventByIDStmt           *sqlutil.Stmt
+	bulkSelectStateAtEventByIDStmt         *sqlutil.Stmt
+	updateEventStateStmt                   *sqlutil.Stmt
+	selectEventSentToOutputStmt            *sqlutil.Stmt
+	updateEventSentToOutputStmt            *sqlutil.Stmt
+	selectEventIDStmt                      *sqlutil.Stmt
+	bulkSelectStateAtEventAndReferenceStmt *sqlutil.Stmt
+	bulkSelectEventReferenceStmt           *sqlutil.Stmt
+	bulkSelectEventIDStmt                  *sqlutil.Stmt
+	bulkSelectEventNIDStmt                 *sqlutil.Stmt
+	selectEventNIDsForRoomStmt             *sqlutil.Stmt
 	//selectRoomNIDsForEventNIDsStmt           *sql.Stmt
 }
 
@@ -144,6 +152,7 @@ func prepareEventsTable(db *sql.DB) (tables.Events, error) {
 		{&s.bulkSelectEventReferenceStmt, bulkSelectEventReferenceSQL},
 		{&s.bulkSelectEventIDStmt, bulkSelectEventIDSQL},
 		{&s.bulkSelectEventNIDStmt, bulkSelectEventNIDSQL},
+		{&s.selectEventNIDsForRoomStmt, selectEventNIDsForRoomSQL},
 		//{&s.selectRoomNIDForEventNIDStmt, selectRoomNIDForEventNIDSQL},
 	}.Prepare(db)
 }
@@ -159,13 +168,14 @@ func (s *eventStatements) InsertEvent(
 	authEventNIDs []types.EventNID,
 	depth int64,
 	isRejected bool,
+	isSoftFailed bool,
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	// attempt to insert: the last_row_id is the event NID
 	var eventNID int64
-	insertStmt := sqlutil.TxStmt(txn, s.insertEventStmt)
+	insertStmt := s.insertEventStmt.WithTx(txn)
 	result, err := insertStmt.ExecContext(
 		ctx, int64(roomNID), int64(eventTypeNID), int64(eventStateKeyNID),
-		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, isRejected,
+		eventID, referenceSHA256, eventNIDsAsArray(authEventNIDs), depth, isRejected, isSoftFailed,
 	)
 	if err != nil {
 		return 0, 0, err
@@ -183,7 +193,7 @@ func (s *eventStatements) SelectEvent(
 ) (types.EventNID, types.StateSnapshotNID, error) {
 	var eventNID int64
 	var stateNID int64
-	selectStmt := sqlutil.TxStmt(txn, s.selectEventStmt)
+	selectStmt := s.selectEventStmt.WithTx(txn)
 	err := selectStmt.QueryRowContext(ctx, eventID).Scan(&eventNID, &stateNID)
 	return types.EventNID(eventNID), types.StateSnapshotNID(stateNID), err
 }
@@ -346,7 +356,7 @@ func (s *eventStatements) BulkSelectStateAtEventByID(
 func (s *eventStatements) UpdateEventState(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, stateNID types.StateSnapshotNID,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.updateEventStateStmt)
+	stmt := s.updateEventStateStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, int64(stateNID), int64(eventNID))
 	return err
 }
@@ -354,13 +364,13 @@ func (s *eventStatements) UpdateEventState(
 func (s *eventStatements) SelectEventSentToOutput(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (sentToOutput bool, err error) {
-	selectStmt := sqlutil.TxStmt(txn, s.selectEventSentToOutputStmt)
+	selectStmt := s.selectEventSentToOutputStmt.WithTx(txn)
 	err = selectStmt.QueryRowContext(ctx, int64(eventNID)).Scan(&sentToOutput)
 	return
 }
 
 func (s *eventStatements) UpdateEventSentToOutput(ctx context.Context, txn *sql.Tx, eventNID types.EventNID) error {
-	updateStmt := sqlutil.TxStmt(txn, s.updateEventSentToOutputStmt)
+	updateStmt := s.updateEventSentToOutputStmt.WithTx(txn)
 	_, err := updateStmt.ExecContext(ctx, int64(eventNID))
 	return err
 }
@@ -368,7 +378,7 @@ func (s *eventStatements) UpdateEventSentToOutput(ctx context.Context, txn *sql.
 func (s *eventStatements) SelectEventID(
 	ctx context.Context, txn *sql.Tx, eventNID types.EventNID,
 ) (eventID string, err error) {
-	selectStmt := sqlutil.TxStmt(txn, s.selectEventIDStmt)
+	selectStmt := s.selectEventIDStmt.WithTx(txn)
 	err = selectStmt.QueryRowContext(ctx, int64(eventNID)).Scan(&eventID)
 	return
 }
@@ -571,7 +581,63 @@ func (s *eventStatements) SelectRoomNIDsForEventNIDs(
 	return result, nil
 }
 
+func (s *eventStatements) SelectEventNIDsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]types.EventNID, error) {
+	rows, err := s.selectEventNIDsForRoomStmt.WithTx(txn).QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventNIDsForRoom: rows.close() failed")
+	var eventNIDs []types.EventNID
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return nil, err
+		}
+		eventNIDs = append(eventNIDs, types.EventNID(eventNID))
+	}
+	return eventNIDs, rows.Err()
+}
+
 func eventNIDsAsArray(eventNIDs []types.EventNID) string {
 	b, _ := json.Marshal(eventNIDs)
 	return string(b)
 }
+
+func (s *eventStatements) BulkSelectSoftFailed(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]bool, error) {
+	results := make(map[types.EventNID]bool)
+	for start := 0; start < len(eventNIDs); start += sqlutil.SQLite3MaxVariables {
+		chunk := eventNIDs[start:]
+		if len(chunk) > sqlutil.SQLite3MaxVariables {
+			chunk = chunk[:sqlutil.SQLite3MaxVariables]
+		}
+		params := make([]interface{}, len(chunk))
+		for i, eventNID := range chunk {
+			params[i] = int64(eventNID)
+		}
+		query := strings.Replace(bulkSelectSoftFailedSQL, "($1)", sqlutil.QueryVariadic(len(chunk)), 1)
+		if err := s.bulkSelectSoftFailedChunk(ctx, query, params, results); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+func (s *eventStatements) bulkSelectSoftFailedChunk(
+	ctx context.Context, query string, params []interface{}, results map[types.EventNID]bool,
+) error {
+	rows, err := s.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "bulkSelectSoftFailed: rows.close() failed")
+	for rows.Next() {
+		var eventNID int64
+		if err = rows.Scan(&eventNID); err != nil {
+			return err
+		}
+		results[types.EventNID(eventNID)] = true
+	}
+	return rows.Err()
+}
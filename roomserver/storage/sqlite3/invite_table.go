@@ -64,10 +64,10 @@ SELECT invite_event_id FROM roomserver_invites WHERE room_nid = $1 AND target_ni
 
 type inviteStatements struct {
 	db                                  *sql.DB
-	insertInviteEventStmt               *sql.Stmt
-	selectInviteActiveForUserInRoomStmt *sql.Stmt
-	updateInviteRetiredStmt             *sql.Stmt
-	selectInvitesAboutToRetireStmt      *sql.Stmt
+	insertInviteEventStmt               *sqlutil.Stmt
+	selectInviteActiveForUserInRoomStmt *sqlutil.Stmt
+	updateInviteRetiredStmt             *sqlutil.Stmt
+	selectInvitesAboutToRetireStmt      *sqlutil.Stmt
 }
 
 func createInvitesTable(db *sql.DB) error {
@@ -95,7 +95,7 @@ func (s *inviteStatements) InsertInviteEvent(
 	inviteEventJSON []byte,
 ) (bool, error) {
 	var count int64
-	stmt := sqlutil.TxStmt(txn, s.insertInviteEventStmt)
+	stmt := s.insertInviteEventStmt.WithTx(txn)
 	result, err := stmt.ExecContext(
 		ctx, inviteEventID, roomNID, targetUserNID, senderUserNID, inviteEventJSON,
 	)
@@ -114,7 +114,7 @@ func (s *inviteStatements) UpdateInviteRetired(
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 ) (eventIDs []string, err error) {
 	// gather all the event IDs we will retire
-	stmt := sqlutil.TxStmt(txn, s.selectInvitesAboutToRetireStmt)
+	stmt := s.selectInvitesAboutToRetireStmt.WithTx(txn)
 	rows, err := stmt.QueryContext(ctx, roomNID, targetUserNID)
 	if err != nil {
 		return
@@ -128,7 +128,7 @@ func (s *inviteStatements) UpdateInviteRetired(
 		eventIDs = append(eventIDs, inviteEventID)
 	}
 	// now retire the invites
-	stmt = sqlutil.TxStmt(txn, s.updateInviteRetiredStmt)
+	stmt = s.updateInviteRetiredStmt.WithTx(txn)
 	_, err = stmt.ExecContext(ctx, roomNID, targetUserNID)
 	return
 }
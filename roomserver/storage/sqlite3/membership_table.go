@@ -102,17 +102,17 @@ var selectKnownUsersSQL = "" +
 
 type membershipStatements struct {
 	db                                              *sql.DB
-	insertMembershipStmt                            *sql.Stmt
-	selectMembershipForUpdateStmt                   *sql.Stmt
-	selectMembershipFromRoomAndTargetStmt           *sql.Stmt
-	selectMembershipsFromRoomAndMembershipStmt      *sql.Stmt
-	selectLocalMembershipsFromRoomAndMembershipStmt *sql.Stmt
-	selectMembershipsFromRoomStmt                   *sql.Stmt
-	selectLocalMembershipsFromRoomStmt              *sql.Stmt
-	selectRoomsWithMembershipStmt                   *sql.Stmt
-	updateMembershipStmt                            *sql.Stmt
-	selectKnownUsersStmt                            *sql.Stmt
-	updateMembershipForgetRoomStmt                  *sql.Stmt
+	insertMembershipStmt                            *sqlutil.Stmt
+	selectMembershipForUpdateStmt                   *sqlutil.Stmt
+	selectMembershipFromRoomAndTargetStmt           *sqlutil.Stmt
+	selectMembershipsFromRoomAndMembershipStmt      *sqlutil.Stmt
+	selectLocalMembershipsFromRoomAndMembershipStmt *sqlutil.Stmt
+	selectMembershipsFromRoomStmt                   *sqlutil.Stmt
+	selectLocalMembershipsFromRoomStmt              *sqlutil.Stmt
+	selectRoomsWithMembershipStmt                   *sqlutil.Stmt
+	updateMembershipStmt                            *sqlutil.Stmt
+	selectKnownUsersStmt                            *sqlutil.Stmt
+	updateMembershipForgetRoomStmt                  *sqlutil.Stmt
 }
 
 func createMembershipTable(db *sql.DB) error {
@@ -145,7 +145,7 @@ func (s *membershipStatements) InsertMembership(
 	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 	localTarget bool,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.insertMembershipStmt)
+	stmt := s.insertMembershipStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, roomNID, targetUserNID, localTarget)
 	return err
 }
@@ -154,7 +154,7 @@ func (s *membershipStatements) SelectMembershipForUpdate(
 	ctx context.Context, txn *sql.Tx,
 	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 ) (membership tables.MembershipState, err error) {
-	stmt := sqlutil.TxStmt(txn, s.selectMembershipForUpdateStmt)
+	stmt := s.selectMembershipForUpdateStmt.WithTx(txn)
 	err = stmt.QueryRowContext(
 		ctx, roomNID, targetUserNID,
 	).Scan(&membership)
@@ -175,7 +175,7 @@ func (s *membershipStatements) SelectMembershipsFromRoom(
 	ctx context.Context,
 	roomNID types.RoomNID, localOnly bool,
 ) (eventNIDs []types.EventNID, err error) {
-	var selectStmt *sql.Stmt
+	var selectStmt *sqlutil.Stmt
 	if localOnly {
 		selectStmt = s.selectLocalMembershipsFromRoomStmt
 	} else {
@@ -201,7 +201,7 @@ func (s *membershipStatements) SelectMembershipsFromRoomAndMembership(
 	ctx context.Context,
 	roomNID types.RoomNID, membership tables.MembershipState, localOnly bool,
 ) (eventNIDs []types.EventNID, err error) {
-	var stmt *sql.Stmt
+	var stmt *sqlutil.Stmt
 	if localOnly {
 		stmt = s.selectLocalMembershipsFromRoomAndMembershipStmt
 	} else {
@@ -228,7 +228,7 @@ func (s *membershipStatements) UpdateMembership(
 	roomNID types.RoomNID, targetUserNID types.EventStateKeyNID, senderUserNID types.EventStateKeyNID, membership tables.MembershipState,
 	eventNID types.EventNID, forgotten bool,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.updateMembershipStmt)
+	stmt := s.updateMembershipStmt.WithTx(txn)
 	_, err := stmt.ExecContext(
 		ctx, senderUserNID, membership, eventNID, forgotten, roomNID, targetUserNID,
 	)
@@ -299,7 +299,7 @@ func (s *membershipStatements) UpdateForgetMembership(
 	txn *sql.Tx, roomNID types.RoomNID, targetUserNID types.EventStateKeyNID,
 	forget bool,
 ) error {
-	_, err := sqlutil.TxStmt(txn, s.updateMembershipForgetRoomStmt).ExecContext(
+	_, err := s.updateMembershipForgetRoomStmt.WithTx(txn).ExecContext(
 		ctx, forget, roomNID, targetUserNID,
 	)
 	return err
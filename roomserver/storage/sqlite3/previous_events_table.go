@@ -66,9 +66,9 @@ const selectPreviousEventExistsSQL = `
 
 type previousEventStatements struct {
 	db                            *sql.DB
-	insertPreviousEventStmt       *sql.Stmt
-	selectPreviousEventNIDsStmt   *sql.Stmt
-	selectPreviousEventExistsStmt *sql.Stmt
+	insertPreviousEventStmt       *sqlutil.Stmt
+	selectPreviousEventNIDsStmt   *sqlutil.Stmt
+	selectPreviousEventExistsStmt *sqlutil.Stmt
 }
 
 func createPrevEventsTable(db *sql.DB) error {
@@ -97,7 +97,7 @@ func (s *previousEventStatements) InsertPreviousEvent(
 ) error {
 	var eventNIDs string
 	eventNIDAsString := fmt.Sprintf("%d", eventNID)
-	selectStmt := sqlutil.TxStmt(txn, s.selectPreviousEventExistsStmt)
+	selectStmt := s.selectPreviousEventExistsStmt.WithTx(txn)
 	err := selectStmt.QueryRowContext(ctx, previousEventID, previousEventReferenceSHA256).Scan(&eventNIDs)
 	if err != nil && err != sql.ErrNoRows {
 		return fmt.Errorf("selectStmt.QueryRowContext.Scan: %w", err)
@@ -114,7 +114,7 @@ func (s *previousEventStatements) InsertPreviousEvent(
 	} else {
 		eventNIDs = eventNIDAsString
 	}
-	insertStmt := sqlutil.TxStmt(txn, s.insertPreviousEventStmt)
+	insertStmt := s.insertPreviousEventStmt.WithTx(txn)
 	_, err = insertStmt.ExecContext(
 		ctx, previousEventID, previousEventReferenceSHA256, eventNIDs,
 	)
@@ -127,6 +127,6 @@ func (s *previousEventStatements) SelectPreviousEventExists(
 	ctx context.Context, txn *sql.Tx, eventID string, eventReferenceSHA256 []byte,
 ) error {
 	var ok int64
-	stmt := sqlutil.TxStmt(txn, s.selectPreviousEventExistsStmt)
+	stmt := s.selectPreviousEventExistsStmt.WithTx(txn)
 	return stmt.QueryRowContext(ctx, eventID, eventReferenceSHA256).Scan(&ok)
 }
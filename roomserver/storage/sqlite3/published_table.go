@@ -45,9 +45,9 @@ const selectPublishedSQL = "" +
 
 type publishedStatements struct {
 	db                     *sql.DB
-	upsertPublishedStmt    *sql.Stmt
-	selectAllPublishedStmt *sql.Stmt
-	selectPublishedStmt    *sql.Stmt
+	upsertPublishedStmt    *sqlutil.Stmt
+	selectAllPublishedStmt *sqlutil.Stmt
+	selectPublishedStmt    *sqlutil.Stmt
 }
 
 func createPublishedTable(db *sql.DB) error {
@@ -70,7 +70,7 @@ func preparePublishedTable(db *sql.DB) (tables.Published, error) {
 func (s *publishedStatements) UpsertRoomPublished(
 	ctx context.Context, txn *sql.Tx, roomID string, published bool,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.upsertPublishedStmt)
+	stmt := s.upsertPublishedStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, roomID, published)
 	return err
 }
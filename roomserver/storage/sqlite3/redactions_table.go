@@ -53,10 +53,10 @@ const markRedactionValidatedSQL = "" +
 
 type redactionStatements struct {
 	db                                          *sql.DB
-	insertRedactionStmt                         *sql.Stmt
-	selectRedactionInfoByRedactionEventIDStmt   *sql.Stmt
-	selectRedactionInfoByEventBeingRedactedStmt *sql.Stmt
-	markRedactionValidatedStmt                  *sql.Stmt
+	insertRedactionStmt                         *sqlutil.Stmt
+	selectRedactionInfoByRedactionEventIDStmt   *sqlutil.Stmt
+	selectRedactionInfoByEventBeingRedactedStmt *sqlutil.Stmt
+	markRedactionValidatedStmt                  *sqlutil.Stmt
 }
 
 func createRedactionsTable(db *sql.DB) error {
@@ -80,7 +80,7 @@ func prepareRedactionsTable(db *sql.DB) (tables.Redactions, error) {
 func (s *redactionStatements) InsertRedaction(
 	ctx context.Context, txn *sql.Tx, info tables.RedactionInfo,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.insertRedactionStmt)
+	stmt := s.insertRedactionStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, info.RedactionEventID, info.RedactsEventID, info.Validated)
 	return err
 }
@@ -89,7 +89,7 @@ func (s *redactionStatements) SelectRedactionInfoByRedactionEventID(
 	ctx context.Context, txn *sql.Tx, redactionEventID string,
 ) (info *tables.RedactionInfo, err error) {
 	info = &tables.RedactionInfo{}
-	stmt := sqlutil.TxStmt(txn, s.selectRedactionInfoByRedactionEventIDStmt)
+	stmt := s.selectRedactionInfoByRedactionEventIDStmt.WithTx(txn)
 	err = stmt.QueryRowContext(ctx, redactionEventID).Scan(
 		&info.RedactionEventID, &info.RedactsEventID, &info.Validated,
 	)
@@ -104,7 +104,7 @@ func (s *redactionStatements) SelectRedactionInfoByEventBeingRedacted(
 	ctx context.Context, txn *sql.Tx, eventID string,
 ) (info *tables.RedactionInfo, err error) {
 	info = &tables.RedactionInfo{}
-	stmt := sqlutil.TxStmt(txn, s.selectRedactionInfoByEventBeingRedactedStmt)
+	stmt := s.selectRedactionInfoByEventBeingRedactedStmt.WithTx(txn)
 	err = stmt.QueryRowContext(ctx, eventID).Scan(
 		&info.RedactionEventID, &info.RedactsEventID, &info.Validated,
 	)
@@ -118,7 +118,7 @@ func (s *redactionStatements) SelectRedactionInfoByEventBeingRedacted(
 func (s *redactionStatements) MarkRedactionValidated(
 	ctx context.Context, txn *sql.Tx, redactionEventID string, validated bool,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.markRedactionValidatedStmt)
+	stmt := s.markRedactionValidatedStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, redactionEventID, validated)
 	return err
 }
@@ -57,11 +57,11 @@ const deleteRoomAliasSQL = `
 
 type roomAliasesStatements struct {
 	db                           *sql.DB
-	insertRoomAliasStmt          *sql.Stmt
-	selectRoomIDFromAliasStmt    *sql.Stmt
-	selectAliasesFromRoomIDStmt  *sql.Stmt
-	selectCreatorIDFromAliasStmt *sql.Stmt
-	deleteRoomAliasStmt          *sql.Stmt
+	insertRoomAliasStmt          *sqlutil.Stmt
+	selectRoomIDFromAliasStmt    *sqlutil.Stmt
+	selectAliasesFromRoomIDStmt  *sqlutil.Stmt
+	selectCreatorIDFromAliasStmt *sqlutil.Stmt
+	deleteRoomAliasStmt          *sqlutil.Stmt
 }
 
 func createRoomAliasesTable(db *sql.DB) error {
@@ -86,7 +86,7 @@ func prepareRoomAliasesTable(db *sql.DB) (tables.RoomAliases, error) {
 func (s *roomAliasesStatements) InsertRoomAlias(
 	ctx context.Context, txn *sql.Tx, alias string, roomID string, creatorUserID string,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.insertRoomAliasStmt)
+	stmt := s.insertRoomAliasStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, alias, roomID, creatorUserID)
 	return err
 }
@@ -137,7 +137,7 @@ func (s *roomAliasesStatements) SelectCreatorIDFromAlias(
 func (s *roomAliasesStatements) DeleteRoomAlias(
 	ctx context.Context, txn *sql.Tx, alias string,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.deleteRoomAliasStmt)
+	stmt := s.deleteRoomAliasStmt.WithTx(txn)
 	_, err := stmt.ExecContext(ctx, alias)
 	return err
 }
@@ -76,14 +76,14 @@ const bulkSelectRoomNIDsSQL = "" +
 
 type roomStatements struct {
 	db                                 *sql.DB
-	insertRoomNIDStmt                  *sql.Stmt
-	selectRoomNIDStmt                  *sql.Stmt
-	selectLatestEventNIDsStmt          *sql.Stmt
-	selectLatestEventNIDsForUpdateStmt *sql.Stmt
-	updateLatestEventNIDsStmt          *sql.Stmt
+	insertRoomNIDStmt                  *sqlutil.Stmt
+	selectRoomNIDStmt                  *sqlutil.Stmt
+	selectLatestEventNIDsStmt          *sqlutil.Stmt
+	selectLatestEventNIDsForUpdateStmt *sqlutil.Stmt
+	updateLatestEventNIDsStmt          *sqlutil.Stmt
 	//selectRoomVersionForRoomNIDStmt    *sql.Stmt
-	selectRoomInfoStmt *sql.Stmt
-	selectRoomIDsStmt  *sql.Stmt
+	selectRoomInfoStmt *sqlutil.Stmt
+	selectRoomIDsStmt  *sqlutil.Stmt
 }
 
 func createRoomsTable(db *sql.DB) error {
@@ -149,7 +149,7 @@ func (s *roomStatements) InsertRoomNID(
 	ctx context.Context, txn *sql.Tx,
 	roomID string, roomVersion gomatrixserverlib.RoomVersion,
 ) (roomNID types.RoomNID, err error) {
-	insertStmt := sqlutil.TxStmt(txn, s.insertRoomNIDStmt)
+	insertStmt := s.insertRoomNIDStmt.WithTx(txn)
 	_, err = insertStmt.ExecContext(ctx, roomID, roomVersion)
 	if err != nil {
 		return 0, fmt.Errorf("insertStmt.ExecContext: %w", err)
@@ -165,7 +165,7 @@ func (s *roomStatements) SelectRoomNID(
 	ctx context.Context, txn *sql.Tx, roomID string,
 ) (types.RoomNID, error) {
 	var roomNID int64
-	stmt := sqlutil.TxStmt(txn, s.selectRoomNIDStmt)
+	stmt := s.selectRoomNIDStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, roomID).Scan(&roomNID)
 	return types.RoomNID(roomNID), err
 }
@@ -176,7 +176,7 @@ func (s *roomStatements) SelectLatestEventNIDs(
 	var eventNIDs []types.EventNID
 	var nidsJSON string
 	var stateSnapshotNID int64
-	stmt := sqlutil.TxStmt(txn, s.selectLatestEventNIDsStmt)
+	stmt := s.selectLatestEventNIDsStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, int64(roomNID)).Scan(&nidsJSON, &stateSnapshotNID)
 	if err != nil {
 		return nil, 0, err
@@ -194,7 +194,7 @@ func (s *roomStatements) SelectLatestEventsNIDsForUpdate(
 	var nidsJSON string
 	var lastEventSentNID int64
 	var stateSnapshotNID int64
-	stmt := sqlutil.TxStmt(txn, s.selectLatestEventNIDsForUpdateStmt)
+	stmt := s.selectLatestEventNIDsForUpdateStmt.WithTx(txn)
 	err := stmt.QueryRowContext(ctx, int64(roomNID)).Scan(&nidsJSON, &lastEventSentNID, &stateSnapshotNID)
 	if err != nil {
 		return nil, 0, 0, err
@@ -213,7 +213,7 @@ func (s *roomStatements) UpdateLatestEventNIDs(
 	lastEventSentNID types.EventNID,
 	stateSnapshotNID types.StateSnapshotNID,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.updateLatestEventNIDsStmt)
+	stmt := s.updateLatestEventNIDsStmt.WithTx(txn)
 	_, err := stmt.ExecContext(
 		ctx,
 		eventNIDsAsArray(eventNIDs),
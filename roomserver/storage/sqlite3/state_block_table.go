@@ -61,8 +61,8 @@ const bulkSelectStateBlockEntriesSQL = "" +
 
 type stateBlockStatements struct {
 	db                              *sql.DB
-	insertStateDataStmt             *sql.Stmt
-	bulkSelectStateBlockEntriesStmt *sql.Stmt
+	insertStateDataStmt             *sqlutil.Stmt
+	bulkSelectStateBlockEntriesStmt *sqlutil.Stmt
 }
 
 func createStateBlockTable(db *sql.DB) error {
@@ -65,8 +65,8 @@ const bulkSelectStateBlockNIDsSQL = "" +
 
 type stateSnapshotStatements struct {
 	db                           *sql.DB
-	insertStateStmt              *sql.Stmt
-	bulkSelectStateBlockNIDsStmt *sql.Stmt
+	insertStateStmt              *sqlutil.Stmt
+	bulkSelectStateBlockNIDsStmt *sqlutil.Stmt
 }
 
 func createStateSnapshotTable(db *sql.DB) error {
@@ -93,7 +93,7 @@ func (s *stateSnapshotStatements) InsertState(
 	if err != nil {
 		return
 	}
-	insertStmt := sqlutil.TxStmt(txn, s.insertStateStmt)
+	insertStmt := s.insertStateStmt.WithTx(txn)
 	var id int64
 	err = insertStmt.QueryRowContext(ctx, stateBlockNIDs.Hash(), int64(roomNID), string(stateBlockNIDsJSON)).Scan(&id)
 	if err != nil {
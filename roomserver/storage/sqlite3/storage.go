@@ -36,22 +36,22 @@ type Database struct {
 }
 
 // Open a sqlite database.
-func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (*Database, error) {
+func Open(cfg *config.RoomServer, cache caching.RoomServerCaches) (*Database, error) {
 	var d Database
 	var db *sql.DB
 	var err error
+	dbProperties := &cfg.Database
+	encoding, err := shared.ParseEventJSONCompression(cfg.EventJSONCompression)
+	if err != nil {
+		return nil, err
+	}
 	if db, err = sqlutil.Open(dbProperties); err != nil {
 		return nil, err
 	}
 
-	//db.Exec("PRAGMA journal_mode=WAL;")
 	//db.Exec("PRAGMA read_uncommitted = true;")
 
-	// FIXME: We are leaking connections somewhere. Setting this to 2 will eventually
-	// cause the roomserver to be unresponsive to new events because something will
-	// acquire the global mutex and never unlock it because it is waiting for a connection
-	// which it will never obtain.
-	db.SetMaxOpenConns(20)
+	// The connection limit is set by sqlutil.Open, see sqlutil.SQLiteMaxOpenConns.
 
 	// Create the tables.
 	if err := d.create(db); err != nil {
@@ -67,11 +67,22 @@ func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches)
 		return nil, err
 	}
 
+	// Then execute the versioned migrations, which are tracked in the
+	// schema_migrations table.
+	migrator := sqlutil.NewMigrator(db, "roomserver")
+	migrator.AddMigrations(deltas.Migrations()...)
+	if err := migrator.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
 	// Then prepare the statements. Now that the migrations have run, any columns referred
 	// to in the database code should now exist.
-	if err := d.prepare(db, cache); err != nil {
+	if err := d.prepare(db, cache, cfg, encoding); err != nil {
 		return nil, err
 	}
+	if cfg.EventJSONSizeRefreshInterval > 0 {
+		go shared.RefreshEventJSONSizeMetric(d.EventJSONTable, cfg.EventJSONSizeRefreshInterval)
+	}
 
 	return &d, nil
 }
@@ -116,6 +127,9 @@ func (d *Database) create(db *sql.DB) error {
 	if err := createPublishedTable(db); err != nil {
 		return err
 	}
+	if err := createBlockedRoomsTable(db); err != nil {
+		return err
+	}
 	if err := createRedactionsTable(db); err != nil {
 		return err
 	}
@@ -123,7 +137,9 @@ func (d *Database) create(db *sql.DB) error {
 	return nil
 }
 
-func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
+func (d *Database) prepare(
+	db *sql.DB, cache caching.RoomServerCaches, cfg *config.RoomServer, encoding shared.EventJSONEncoding,
+) error {
 	eventStateKeys, err := prepareEventStateKeysTable(db)
 	if err != nil {
 		return err
@@ -132,7 +148,11 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
-	eventJSON, err := prepareEventJSONTable(db)
+	eventJSON, err := prepareEventJSONTable(db, encoding, cfg.EventJSONDeduplication)
+	if err != nil {
+		return err
+	}
+	eventJSONTable, err := shared.WrapEventJSONTable(eventJSON, cfg.EventCacheMaxEntries)
 	if err != nil {
 		return err
 	}
@@ -176,6 +196,10 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 	if err != nil {
 		return err
 	}
+	blockedRooms, err := prepareBlockedRoomsTable(db)
+	if err != nil {
+		return err
+	}
 	redactions, err := prepareRedactionsTable(db)
 	if err != nil {
 		return err
@@ -187,7 +211,7 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 		EventsTable:                events,
 		EventTypesTable:            eventTypes,
 		EventStateKeysTable:        eventStateKeys,
-		EventJSONTable:             eventJSON,
+		EventJSONTable:             eventJSONTable,
 		RoomsTable:                 rooms,
 		TransactionsTable:          transactions,
 		StateBlockTable:            stateBlock,
@@ -197,6 +221,7 @@ func (d *Database) prepare(db *sql.DB, cache caching.RoomServerCaches) error {
 		InvitesTable:               invites,
 		MembershipTable:            membership,
 		PublishedTable:             published,
+		BlockedRoomsTable:          blockedRooms,
 		RedactionsTable:            redactions,
 		GetLatestEventsForUpdateFn: d.GetLatestEventsForUpdate,
 	}
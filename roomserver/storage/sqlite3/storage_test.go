@@ -0,0 +1,140 @@
+package sqlite3
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/caching"
+	"github.com/matrix-org/dendrite/roomserver/storage/shared"
+	"github.com/matrix-org/dendrite/roomserver/storage/tables"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// racingEventJSONTable reads event JSON back through the cache, outside of the
+// transaction, straight after it is written. This is what a concurrent reader
+// would do before the transaction commits.
+type racingEventJSONTable struct {
+	tables.EventJSON
+	cache *shared.EventJSONCache
+}
+
+func (r *racingEventJSONTable) InsertEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) error {
+	if err := r.EventJSON.InsertEventJSON(ctx, txn, eventNID, eventJSON); err != nil {
+		return err
+	}
+	_, err := r.cache.BulkSelectEventJSON(ctx, []types.EventNID{eventNID})
+	return err
+}
+
+func TestStoreEventRedactionInvalidatesCache(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dendrite-roomserver")
+	if err != nil {
+		t.Fatalf("failed to make temp dir: %s", err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	cfg.RoomServer.Database = config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(dir, "roomserver.db")),
+	}
+	caches, err := caching.NewInMemoryLRUCache(false)
+	if err != nil {
+		t.Fatalf("failed to make caches: %s", err)
+	}
+	db, err := Open(&cfg.RoomServer, caches)
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	racing := &racingEventJSONTable{EventJSON: db.EventJSONTable}
+	if racing.cache, err = shared.NewEventJSONCache(racing, 10); err != nil {
+		t.Fatalf("failed to create cache: %s", err)
+	}
+	db.EventJSONTable = racing.cache
+
+	const (
+		roomID = "!redact:localhost"
+		alice  = "@alice:localhost"
+	)
+	roomVer := gomatrixserverlib.RoomVersionV6
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	emptyKey, aliceKey := "", alice
+	var events []*gomatrixserverlib.Event
+	var authEvents []string
+	for i, b := range []struct {
+		evType   string
+		stateKey *string
+		content  map[string]interface{}
+		redacts  int
+	}{
+		{gomatrixserverlib.MRoomCreate, &emptyKey, map[string]interface{}{"creator": alice, "room_version": "6"}, -1},
+		{gomatrixserverlib.MRoomMember, &aliceKey, map[string]interface{}{"membership": "join"}, -1},
+		{"m.room.message", nil, map[string]interface{}{"body": "redacted"}, -1},
+		{gomatrixserverlib.MRoomRedaction, nil, map[string]interface{}{}, 2},
+	} {
+		eb := gomatrixserverlib.EventBuilder{
+			Sender:     alice,
+			RoomID:     roomID,
+			Type:       b.evType,
+			StateKey:   b.stateKey,
+			Depth:      int64(i + 1),
+			AuthEvents: authEvents,
+		}
+		if len(events) > 0 {
+			eb.PrevEvents = []string{events[len(events)-1].EventID()}
+		}
+		if b.redacts >= 0 {
+			eb.Redacts = events[b.redacts].EventID()
+		}
+		if err = eb.SetContent(b.content); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		ev, err := eb.Build(time.Now(), "localhost", "ed25519:test", key, roomVer)
+		if err != nil {
+			t.Fatalf("failed to build event: %s", err)
+		}
+		if b.stateKey != nil {
+			authEvents = append(authEvents, ev.EventID())
+		}
+		events = append(events, ev)
+	}
+
+	var messageNID types.EventNID
+	for i, ev := range events {
+		_, stateAtEvent, _, _, err := db.StoreEvent(ctx, ev, nil, nil, false, false)
+		if err != nil {
+			t.Fatalf("failed to store event %d: %s", i, err)
+		}
+		if i == 2 {
+			messageNID = stateAtEvent.EventNID
+			// Read the message through the cache before it is redacted.
+			if _, err = db.Events(ctx, []types.EventNID{messageNID}); err != nil {
+				t.Fatalf("failed to load event: %s", err)
+			}
+		}
+	}
+
+	stored, err := db.Events(ctx, []types.EventNID{messageNID})
+	if err != nil {
+		t.Fatalf("failed to load event: %s", err)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("got %d events, want 1", len(stored))
+	}
+	if body := gjson.GetBytes(stored[0].Content(), "body"); body.Exists() {
+		t.Errorf("expected the cached event to have been redacted, got %s", stored[0].JSON())
+	}
+}
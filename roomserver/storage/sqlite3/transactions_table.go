@@ -45,8 +45,8 @@ const selectTransactionEventIDSQL = `
 
 type transactionStatements struct {
 	db                           *sql.DB
-	insertTransactionStmt        *sql.Stmt
-	selectTransactionEventIDStmt *sql.Stmt
+	insertTransactionStmt        *sqlutil.Stmt
+	selectTransactionEventIDStmt *sqlutil.Stmt
 }
 
 func createTransactionsTable(db *sql.DB) error {
@@ -72,7 +72,7 @@ func (s *transactionStatements) InsertTransaction(
 	userID string,
 	eventID string,
 ) error {
-	stmt := sqlutil.TxStmt(txn, s.insertTransactionStmt)
+	stmt := s.insertTransactionStmt.WithTx(txn)
 	_, err := stmt.ExecContext(
 		ctx, transactionID, sessionID, userID, eventID,
 	)
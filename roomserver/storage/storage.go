@@ -26,12 +26,12 @@ import (
 )
 
 // Open opens a database connection.
-func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (Database, error) {
+func Open(cfg *config.RoomServer, cache caching.RoomServerCaches) (Database, error) {
 	switch {
-	case dbProperties.ConnectionString.IsSQLite():
-		return sqlite3.Open(dbProperties, cache)
-	case dbProperties.ConnectionString.IsPostgres():
-		return postgres.Open(dbProperties, cache)
+	case cfg.Database.ConnectionString.IsSQLite():
+		return sqlite3.Open(cfg, cache)
+	case cfg.Database.ConnectionString.IsPostgres():
+		return postgres.Open(cfg, cache)
 	default:
 		return nil, fmt.Errorf("unexpected database type")
 	}
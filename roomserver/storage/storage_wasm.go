@@ -23,11 +23,11 @@ import (
 )
 
 // NewPublicRoomsServerDatabase opens a database connection.
-func Open(dbProperties *config.DatabaseOptions, cache caching.RoomServerCaches) (Database, error) {
+func Open(cfg *config.RoomServer, cache caching.RoomServerCaches) (Database, error) {
 	switch {
-	case dbProperties.ConnectionString.IsSQLite():
-		return sqlite3.Open(dbProperties, cache)
-	case dbProperties.ConnectionString.IsPostgres():
+	case cfg.Database.ConnectionString.IsSQLite():
+		return sqlite3.Open(cfg, cache)
+	case cfg.Database.ConnectionString.IsPostgres():
 		return nil, fmt.Errorf("can't use Postgres implementation")
 	default:
 		return nil, fmt.Errorf("unexpected database type")
@@ -3,6 +3,7 @@ package tables
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/matrix-org/dendrite/roomserver/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -18,7 +19,58 @@ type EventJSONPair struct {
 type EventJSON interface {
 	// Insert the event JSON. On conflict, replace the event JSON with the new value (for redactions).
 	InsertEventJSON(ctx context.Context, tx *sql.Tx, eventNID types.EventNID, eventJSON []byte) error
+	// Insert the event JSON for many events using as few statements as possible. Events which already
+	// have event JSON are left unchanged. The RoomVersion of each pair is ignored.
+	BulkInsertEventJSON(ctx context.Context, tx *sql.Tx, pairs []EventJSONPair) error
 	BulkSelectEventJSON(ctx context.Context, eventNIDs []types.EventNID) ([]EventJSONPair, error)
+	// BulkSelectEventJSONInOrder returns the event JSON for the given events in the same order as eventNIDs, rather
+	// than in ascending NID order. Entries for events which have no event JSON are nil.
+	BulkSelectEventJSONInOrder(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) ([]*EventJSONPair, error)
+	// PurgeEventJSON deletes the event JSON for the given events. Returns the number of rows deleted.
+	PurgeEventJSON(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
+	// SelectEventJSONSize returns the total size in bytes of the event JSON as stored.
+	SelectEventJSONSize(ctx context.Context) (int64, error)
+	// SelectRoomEventJSONSize returns the number of events in the room which have event JSON, and the total size
+	// in bytes of that event JSON as stored.
+	SelectRoomEventJSONSize(ctx context.Context, roomNID types.RoomNID) (count int64, size int64, err error)
+	// SelectEventJSONCursor returns a cursor over the event JSON for all events in the room with an event NID greater
+	// than afterEventNID, in ascending NID order. The cursor must be closed if it isn't read until the end.
+	SelectEventJSONCursor(ctx context.Context, roomNID types.RoomNID, afterEventNID types.EventNID) (EventJSONCursor, error)
+	// SelectEventJSONRange returns up to limit event JSON pairs with event NIDs after fromNID, in ascending NID
+	// order, or before fromNID, in descending NID order. The NID of the last pair returned can be passed as
+	// fromNID to get the next page. The limit must be at least 1 and is capped at MaxEventJSONRangeLimit.
+	SelectEventJSONRange(ctx context.Context, fromNID types.EventNID, limit int, ascending bool) ([]EventJSONPair, error)
+	// SelectMaxEventNID returns the highest event NID in either the events table or the event JSON table.
+	SelectMaxEventNID(ctx context.Context, txn *sql.Tx) (types.EventNID, error)
+	// SelectEventNIDsMissingJSON returns the event NIDs in the range (fromNID, toNID] which are in the events
+	// table but have no event JSON.
+	SelectEventNIDsMissingJSON(ctx context.Context, txn *sql.Tx, fromNID, toNID types.EventNID) ([]types.EventNID, error)
+	// SelectEventJSONNIDsMissingEvent returns the event NIDs in the range (fromNID, toNID] which have event JSON
+	// but aren't in the events table.
+	SelectEventJSONNIDsMissingEvent(ctx context.Context, txn *sql.Tx, fromNID, toNID types.EventNID) ([]types.EventNID, error)
+}
+
+// EventJSONCursor iterates over event JSON without loading it all into memory.
+type EventJSONCursor interface {
+	// Next returns the next event JSON, or io.EOF once there are no more events.
+	Next() (EventJSONPair, error)
+	// Close releases the cursor. It is safe to call Close more than once.
+	Close() error
+}
+
+// MaxEventJSONRangeLimit is the most event JSON pairs that SelectEventJSONRange will return at once.
+const MaxEventJSONRangeLimit = 1000
+
+// CheckEventJSONRangeLimit returns an error if the limit for SelectEventJSONRange is less than 1, or the limit
+// capped at MaxEventJSONRangeLimit otherwise.
+func CheckEventJSONRangeLimit(limit int) (int, error) {
+	if limit < 1 {
+		return 0, fmt.Errorf("invalid event JSON range limit %d", limit)
+	}
+	if limit > MaxEventJSONRangeLimit {
+		return MaxEventJSONRangeLimit, nil
+	}
+	return limit, nil
 }
 
 type EventTypes interface {
@@ -37,7 +89,7 @@ type EventStateKeys interface {
 type Events interface {
 	InsertEvent(
 		ctx context.Context, txn *sql.Tx, i types.RoomNID, j types.EventTypeNID, k types.EventStateKeyNID, eventID string,
-		referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, isRejected bool,
+		referenceSHA256 []byte, authEventNIDs []types.EventNID, depth int64, isRejected, isSoftFailed bool,
 	) (types.EventNID, types.StateSnapshotNID, error)
 	SelectEvent(ctx context.Context, txn *sql.Tx, eventID string) (types.EventNID, types.StateSnapshotNID, error)
 	// bulkSelectStateEventByID lookups a list of state events by event ID.
@@ -61,6 +113,11 @@ type Events interface {
 	BulkSelectEventNID(ctx context.Context, eventIDs []string) (map[string]types.EventNID, error)
 	SelectMaxEventDepth(ctx context.Context, txn *sql.Tx, eventNIDs []types.EventNID) (int64, error)
 	SelectRoomNIDsForEventNIDs(ctx context.Context, eventNIDs []types.EventNID) (roomNIDs map[types.EventNID]types.RoomNID, err error)
+	// SelectEventNIDsForRoom returns the numeric IDs of all events in a room.
+	SelectEventNIDsForRoom(ctx context.Context, txn *sql.Tx, roomNID types.RoomNID) ([]types.EventNID, error)
+	// BulkSelectSoftFailed returns which of the given events were soft-failed. Events which weren't soft-failed or
+	// aren't in the database are omitted from the map.
+	BulkSelectSoftFailed(ctx context.Context, eventNIDs []types.EventNID) (map[types.EventNID]bool, error)
 }
 
 type Rooms interface {
@@ -143,6 +200,12 @@ type Published interface {
 	SelectAllPublishedRooms(ctx context.Context, published bool) ([]string, error)
 }
 
+type BlockedRooms interface {
+	InsertBlockedRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	DeleteBlockedRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	SelectRoomBlocked(ctx context.Context, roomID string) (bool, error)
+}
+
 type RedactionInfo struct {
 	// whether this redaction is validated (we have both events)
 	Validated bool
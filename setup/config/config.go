@@ -272,17 +272,37 @@ func (config *Dendrite) Derive() error {
 
 	config.Derived.Registration.Params = make(map[string]interface{})
 
-	// TODO: Add email auth type
 	// TODO: Add MSISDN auth type
 
+	// The stages must be completed in this order.
+	var stages []authtypes.LoginType
+	if config.ClientAPI.RegistrationRequiresToken {
+		stages = append(stages, authtypes.LoginTypeRegistrationToken)
+	}
 	if config.ClientAPI.RecaptchaEnabled {
 		config.Derived.Registration.Params[authtypes.LoginTypeRecaptcha] = map[string]string{"public_key": config.ClientAPI.RecaptchaPublicKey}
-		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
-			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha}})
-	} else {
-		config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
-			authtypes.Flow{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}})
+		stages = append(stages, authtypes.LoginTypeRecaptcha)
+	}
+	if config.ClientAPI.RegistrationTerms.Enabled {
+		policies := make(map[string]interface{}, len(config.ClientAPI.RegistrationTerms.Policies))
+		for _, policy := range config.ClientAPI.RegistrationTerms.Policies {
+			p := map[string]interface{}{"version": policy.Version}
+			for lang, translation := range policy.Translations {
+				p[lang] = map[string]string{"name": translation.Name, "url": translation.URL}
+			}
+			policies[policy.ID] = p
+		}
+		config.Derived.Registration.Params[authtypes.LoginTypeTerms] = map[string]interface{}{"policies": policies}
+		stages = append(stages, authtypes.LoginTypeTerms)
+	}
+	if config.ClientAPI.RegistrationRequiresEmail {
+		stages = append(stages, authtypes.LoginTypeEmail)
+	}
+	if len(stages) == 0 {
+		stages = append(stages, authtypes.LoginTypeDummy)
 	}
+	config.Derived.Registration.Flows = append(config.Derived.Registration.Flows,
+		authtypes.Flow{Stages: stages})
 
 	// Load application service configuration files
 	if err := loadAppServices(&config.AppServiceAPI, &config.Derived); err != nil {
@@ -344,7 +364,9 @@ func (c *Dendrite) Wiring() {
 
 	c.ClientAPI.Derived = &c.Derived
 	c.AppServiceAPI.Derived = &c.Derived
+	c.SyncAPI.Derived = &c.Derived
 	c.ClientAPI.MSCs = &c.MSCs
+	c.SyncAPI.MSCs = &c.MSCs
 }
 
 // Error returns a string detailing how many errors were contained within a
@@ -92,6 +92,9 @@ type ApplicationService struct {
 	RateLimited bool `yaml:"rate_limited"`
 	// Any custom protocols that this application service provides (e.g. IRC)
 	Protocols []string `yaml:"protocols"`
+	// Whether the application service wants to receive ephemeral events, as
+	// per MSC2409
+	PushEphemeral bool `yaml:"de.sorunome.msc2409.push_ephemeral"`
 }
 
 // IsInterestedInRoomID returns a bool on whether an application service's
@@ -142,6 +145,22 @@ func (a *ApplicationService) OwnsNamespaceCoveringUserId(
 	return false
 }
 
+// OwnsNamespaceCoveringRoomAlias returns a bool on whether an application
+// service's namespace is exclusive and includes the given room alias
+func (a *ApplicationService) OwnsNamespaceCoveringRoomAlias(
+	roomAlias string,
+) bool {
+	if namespaceSlice, ok := a.NamespaceMap["aliases"]; ok {
+		for _, namespace := range namespaceSlice {
+			if namespace.Exclusive && namespace.RegexpObject.MatchString(roomAlias) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 // IsInterestedInRoomAlias returns a bool on whether an application service's
 // namespace includes the given room alias
 func (a *ApplicationService) IsInterestedInRoomAlias(
@@ -207,13 +226,11 @@ func setupRegexps(asAPI *AppServiceAPI, derived *Derived) (err error) {
 	for _, appservice := range derived.ApplicationServices {
 		// The sender_localpart can be considered an exclusive regex for a single user, so let's do that
 		// to simplify the code
-		var senderUserIDSlice = []string{fmt.Sprintf("@%s:%s", appservice.SenderLocalpart, asAPI.Matrix.ServerName)}
-		usersSlice, found := appservice.NamespaceMap["users"]
-		if !found {
-			usersSlice = []ApplicationServiceNamespace{}
-			appservice.NamespaceMap["users"] = usersSlice
+		senderUserID := fmt.Sprintf("@%s:%s", appservice.SenderLocalpart, asAPI.Matrix.ServerName)
+		exclusiveUsernameStrings = append(exclusiveUsernameStrings, "(^"+regexp.QuoteMeta(senderUserID)+"$)")
+		if _, found := appservice.NamespaceMap["users"]; !found {
+			appservice.NamespaceMap["users"] = []ApplicationServiceNamespace{}
 		}
-		appendExclusiveNamespaceRegexs(&senderUserIDSlice, usersSlice)
 
 		for key, namespaceSlice := range appservice.NamespaceMap {
 			switch key {
@@ -221,6 +238,9 @@ func setupRegexps(asAPI *AppServiceAPI, derived *Derived) (err error) {
 				appendExclusiveNamespaceRegexs(&exclusiveUsernameStrings, namespaceSlice)
 			case "aliases":
 				appendExclusiveNamespaceRegexs(&exclusiveAliasStrings, namespaceSlice)
+			case "rooms":
+				// Room IDs can't be reserved, but the regexes still need compiling
+				appendExclusiveNamespaceRegexs(&[]string{}, namespaceSlice)
 			}
 		}
 	}
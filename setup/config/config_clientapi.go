@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type ClientAPI struct {
@@ -15,6 +17,8 @@ type ClientAPI struct {
 	// If set disables new users from registering (except via shared
 	// secrets)
 	RegistrationDisabled bool `yaml:"registration_disabled"`
+	// If set, prevents guest accounts from being registered.
+	GuestsDisabled bool `yaml:"guests_disabled"`
 	// If set, allows registration by anyone who also has the shared
 	// secret, even if registration is otherwise disabled.
 	RegistrationSharedSecret string `yaml:"registration_shared_secret"`
@@ -32,12 +36,43 @@ type ClientAPI struct {
 	// was successful
 	RecaptchaSiteVerifyAPI string `yaml:"recaptcha_siteverify_api"`
 
+	// Policies, such as terms of service, which users must accept in
+	// order to register
+	RegistrationTerms RegistrationTerms `yaml:"registration_terms"`
+	// Boolean stating whether users must validate an email address in
+	// order to register, which is then associated with their account
+	RegistrationRequiresEmail bool `yaml:"registration_requires_email"`
+	// Boolean stating whether users must provide a registration token,
+	// created with the admin API, in order to register
+	RegistrationRequiresToken bool `yaml:"registration_requires_token"`
+
 	// TURN options
 	TURN TURN `yaml:"turn"`
 
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
 
+	// Single sign-on options
+	SSO SSO `yaml:"sso"`
+
+	// Central Authentication Service login options
+	CAS CAS `yaml:"cas"`
+
+	// Options for sending emails, e.g. for password resets
+	Email Email `yaml:"email"`
+
+	// Which changes users may make to their own accounts
+	UserChanges UserChanges `yaml:"user_changes"`
+
+	// Options for updating users' membership events when they change their profile
+	ProfilePropagation ProfilePropagation `yaml:"profile_propagation"`
+
+	// Users who are allowed to use the server administration endpoints
+	AdminUsers []string `yaml:"admin_users"`
+
+	// Options for the user which sends server notices
+	ServerNotices ServerNotices `yaml:"server_notices"`
+
 	MSCs *MSCs `yaml:"mscs"`
 }
 
@@ -50,9 +85,19 @@ func (c *ClientAPI) Defaults() {
 	c.RecaptchaPrivateKey = ""
 	c.RecaptchaEnabled = false
 	c.RecaptchaBypassSecret = ""
-	c.RecaptchaSiteVerifyAPI = ""
+	c.RecaptchaSiteVerifyAPI = "https://www.google.com/recaptcha/api/siteverify"
+	c.RegistrationTerms = RegistrationTerms{}
+	c.RegistrationRequiresEmail = false
+	c.RegistrationRequiresToken = false
 	c.RegistrationDisabled = false
+	c.GuestsDisabled = false
 	c.RateLimiting.Defaults()
+	c.SSO.Defaults()
+	c.CAS.Defaults()
+	c.Email.Defaults()
+	c.UserChanges.Defaults()
+	c.ProfilePropagation.Defaults()
+	c.ServerNotices.Defaults()
 }
 
 func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -66,8 +111,109 @@ func (c *ClientAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 		checkNotEmpty(configErrs, "client_api.recaptcha_private_key", string(c.RecaptchaPrivateKey))
 		checkNotEmpty(configErrs, "client_api.recaptcha_siteverify_api", string(c.RecaptchaSiteVerifyAPI))
 	}
+	c.RegistrationTerms.Verify(configErrs)
+	if c.RegistrationRequiresEmail && !c.Email.Enabled && (c.Matrix == nil || len(c.Matrix.TrustedIDServers) == 0) {
+		configErrs.Add(fmt.Sprintf(
+			"config key %q requires either %q or %q to be set",
+			"client_api.registration_requires_email", "client_api.email.enabled", "global.trusted_third_party_id_servers",
+		))
+	}
+	for _, userID := range c.AdminUsers {
+		if _, _, err := gomatrixserverlib.SplitID('@', userID); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid user ID for config key %q: %s", "client_api.admin_users", userID))
+		}
+	}
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	c.SSO.Verify(configErrs)
+	c.CAS.Verify(configErrs)
+	c.Email.Verify(configErrs)
+	c.ProfilePropagation.Verify(configErrs)
+	c.ServerNotices.Verify(configErrs)
+}
+
+// IsAdmin returns true if the user is allowed to use the server administration
+// endpoints.
+func (c *ClientAPI) IsAdmin(userID string) bool {
+	for _, adminUserID := range c.AdminUsers {
+		if adminUserID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// UserChanges are the changes which users may make to their own accounts.
+// Changes to things which are managed elsewhere, e.g. by an SSO provider,
+// should be disabled. Clients learn about these from /capabilities.
+type UserChanges struct {
+	// Whether users may change their password, including by resetting it
+	Password bool `yaml:"password"`
+	// Whether users may change their display name
+	DisplayName bool `yaml:"display_name"`
+	// Whether users may change their avatar URL
+	AvatarURL bool `yaml:"avatar_url"`
+	// Whether users may add and remove their third-party identifiers
+	ThreePIDs bool `yaml:"third_party_ids"`
+}
+
+func (c *UserChanges) Defaults() {
+	c.Password = true
+	c.DisplayName = true
+	c.AvatarURL = true
+	c.ThreePIDs = true
+}
+
+// ProfilePropagation configures whether new membership events are sent to the
+// rooms that users are joined to when they change their display name or
+// avatar, so that other users see the change. The events are sent in the
+// background, since users can be joined to a lot of rooms.
+type ProfilePropagation struct {
+	// Whether to send new membership events when users change their profile
+	Enabled bool `yaml:"enabled"`
+	// The maximum number of rooms to send membership events to per second
+	// for each profile change
+	RoomsPerSecond int64 `yaml:"rooms_per_second"`
+}
+
+func (c *ProfilePropagation) Defaults() {
+	c.Enabled = true
+	c.RoomsPerSecond = 10
+}
+
+func (c *ProfilePropagation) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkPositive(configErrs, "client_api.profile_propagation.rooms_per_second", c.RoomsPerSecond)
+}
+
+// ServerNotices configures the user which server admins send notices to local
+// users from, e.g. about changes to the terms of service. Each user gets one
+// room with it, which is tagged m.server_notice.
+type ServerNotices struct {
+	// Whether server notices can be sent
+	Enabled bool `yaml:"enabled"`
+	// The localpart of the user which sends the notices
+	LocalPart string `yaml:"local_part"`
+	// The display name and avatar URL of the user
+	DisplayName string `yaml:"display_name"`
+	AvatarURL   string `yaml:"avatar_url"`
+	// The name of the rooms which the notices are sent in
+	RoomName string `yaml:"room_name"`
+}
+
+func (c *ServerNotices) Defaults() {
+	c.Enabled = false
+	c.LocalPart = "_server"
+	c.DisplayName = "Server Alerts"
+	c.RoomName = "Server Alert"
+}
+
+func (c *ServerNotices) Verify(configErrs *ConfigErrors) {
+	if c.Enabled {
+		checkNotEmpty(configErrs, "client_api.server_notices.local_part", c.LocalPart)
+	}
 }
 
 type TURN struct {
@@ -102,12 +248,33 @@ type RateLimiting struct {
 	// Is rate limiting enabled or disabled?
 	Enabled bool `yaml:"enabled"`
 
-	// How many "slots" a user can occupy sending requests to a rate-limited
-	// endpoint before we apply rate-limiting
+	// How many requests a user or IP address can make to a rate-limited
+	// endpoint in each cooloff period before we apply rate-limiting
 	Threshold int64 `yaml:"threshold"`
 
-	// The cooloff period in milliseconds after a request before the "slot"
-	// is freed again
+	// The cooloff period in milliseconds over which the threshold applies.
+	// Requests are allowed again at an even rate during the period.
+	CooloffMS int64 `yaml:"cooloff_ms"`
+
+	// Separate limits for logging in, registering and sending messages, so
+	// that these don't use up the allowance for other requests. Any which
+	// aren't set use the threshold and cooloff above.
+	Login        RateLimit `yaml:"login"`
+	Registration RateLimit `yaml:"registration"`
+	MessageSend  RateLimit `yaml:"message_send"`
+
+	// Whether server admins are exempt from rate limiting. Application
+	// services are always exempt.
+	ExemptAdminUsers bool `yaml:"exempt_admin_users"`
+
+	// The most users or IP addresses to keep track of for each kind of
+	// limit. The least recently seen are forgotten first.
+	MaxEntries int64 `yaml:"max_entries"`
+}
+
+// RateLimit is the rate limit for one kind of request.
+type RateLimit struct {
+	Threshold int64 `yaml:"threshold"`
 	CooloffMS int64 `yaml:"cooloff_ms"`
 }
 
@@ -115,6 +282,14 @@ func (r *RateLimiting) Verify(configErrs *ConfigErrors) {
 	if r.Enabled {
 		checkPositive(configErrs, "client_api.rate_limiting.threshold", r.Threshold)
 		checkPositive(configErrs, "client_api.rate_limiting.cooloff_ms", r.CooloffMS)
+		checkPositive(configErrs, "client_api.rate_limiting.login.threshold", r.Login.Threshold)
+		checkPositive(configErrs, "client_api.rate_limiting.login.cooloff_ms", r.Login.CooloffMS)
+		checkPositive(configErrs, "client_api.rate_limiting.registration.threshold", r.Registration.Threshold)
+		checkPositive(configErrs, "client_api.rate_limiting.registration.cooloff_ms", r.Registration.CooloffMS)
+		checkPositive(configErrs, "client_api.rate_limiting.message_send.threshold", r.MessageSend.Threshold)
+		checkPositive(configErrs, "client_api.rate_limiting.message_send.cooloff_ms", r.MessageSend.CooloffMS)
+		checkNotZero(configErrs, "client_api.rate_limiting.max_entries", r.MaxEntries)
+		checkPositive(configErrs, "client_api.rate_limiting.max_entries", r.MaxEntries)
 	}
 }
 
@@ -122,4 +297,213 @@ func (r *RateLimiting) Defaults() {
 	r.Enabled = true
 	r.Threshold = 5
 	r.CooloffMS = 500
+	r.Login = RateLimit{Threshold: 3, CooloffMS: 10000}
+	r.Registration = RateLimit{Threshold: 3, CooloffMS: 10000}
+	r.MessageSend = RateLimit{Threshold: 10, CooloffMS: 2000}
+	r.ExemptAdminUsers = false
+	r.MaxEntries = 100000
+}
+
+type SSO struct {
+	// Is single sign-on using an OpenID Connect provider enabled?
+	Enabled bool `yaml:"enabled"`
+
+	// The public URL of the SSO callback endpoint on this homeserver, i.e.
+	// https://<host>/_matrix/client/r0/login/sso/callback. This must be
+	// registered as a redirect URI with the provider.
+	CallbackURL string `yaml:"callback_url"`
+
+	// The client URLs which users may be sent back to once they have logged
+	// in. A redirect URL is allowed if it has the same scheme and host as one
+	// of these, and its path starts with the path of that entry.
+	AllowedRedirectURLs []string `yaml:"allowed_redirect_urls"`
+
+	// Whether to create an account for users logging in for the first time.
+	CreateAccounts bool `yaml:"create_accounts"`
+
+	// The OpenID Connect provider to log in with
+	OIDC OIDCProvider `yaml:"oidc"`
+}
+
+type OIDCProvider struct {
+	// The issuer URL of the provider, which is used for discovery and must
+	// match the "iss" claim of ID tokens
+	Issuer string `yaml:"issuer"`
+	// The client ID and secret registered with the provider
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// The scopes to request, which must include "openid"
+	Scopes []string `yaml:"scopes"`
+
+	// The ID token claim to use as the localpart of the Matrix user ID of
+	// new accounts. Users are linked to their accounts by the "sub" claim,
+	// so this is never used to log into an existing account.
+	LocalpartClaim string `yaml:"localpart_claim"`
+	// The ID token claim to use as the display name of new accounts
+	DisplayNameClaim string `yaml:"display_name_claim"`
+}
+
+func (c *SSO) Defaults() {
+	c.Enabled = false
+	c.CreateAccounts = false
+	c.OIDC.Scopes = []string{"openid", "profile"}
+	c.OIDC.LocalpartClaim = "preferred_username"
+	c.OIDC.DisplayNameClaim = "name"
+}
+
+func (c *SSO) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkURL(configErrs, "client_api.sso.callback_url", c.CallbackURL)
+	for _, redirectURL := range c.AllowedRedirectURLs {
+		checkURL(configErrs, "client_api.sso.allowed_redirect_urls", redirectURL)
+	}
+	checkURL(configErrs, "client_api.sso.oidc.issuer", c.OIDC.Issuer)
+	checkNotEmpty(configErrs, "client_api.sso.oidc.client_id", c.OIDC.ClientID)
+	checkNotEmpty(configErrs, "client_api.sso.oidc.client_secret", c.OIDC.ClientSecret)
+	checkNotEmpty(configErrs, "client_api.sso.oidc.localpart_claim", c.OIDC.LocalpartClaim)
+	hasOpenID := false
+	for _, scope := range c.OIDC.Scopes {
+		if scope == "openid" {
+			hasOpenID = true
+		}
+	}
+	if !hasOpenID {
+		configErrs.Add(fmt.Sprintf("config key %q must include %q", "client_api.sso.oidc.scopes", "openid"))
+	}
+}
+
+type CAS struct {
+	// Is login using a Central Authentication Service server enabled?
+	Enabled bool `yaml:"enabled"`
+
+	// The base URL of the CAS server, e.g. https://cas.example.com/cas,
+	// beneath which are its /login and /serviceValidate endpoints
+	ServerURL string `yaml:"server_url"`
+
+	// The public URL of the CAS ticket endpoint on this homeserver, i.e.
+	// https://<host>/_matrix/client/r0/login/cas/ticket. The CAS server
+	// sends users back to this URL with a service ticket.
+	TicketURL string `yaml:"ticket_url"`
+
+	// The client URLs which users may be sent back to once they have logged
+	// in, in the same format as for SSO.
+	AllowedRedirectURLs []string `yaml:"allowed_redirect_urls"`
+
+	// Whether to create an account for users logging in for the first time.
+	CreateAccounts bool `yaml:"create_accounts"`
+
+	// The attribute to use as the localpart of the Matrix user ID of new
+	// accounts, or empty to use the CAS username. Users are linked to their
+	// accounts by their CAS username, so this is never used to log into an
+	// existing account.
+	LocalpartAttribute string `yaml:"localpart_attribute"`
+	// The attribute to use as the display name of new accounts
+	DisplayNameAttribute string `yaml:"display_name_attribute"`
+	// Attributes which users must have in order to log in. If the value is
+	// empty then the attribute only has to be present, otherwise it must
+	// have that value.
+	RequiredAttributes map[string]string `yaml:"required_attributes"`
+}
+
+func (c *CAS) Defaults() {
+	c.Enabled = false
+	c.CreateAccounts = false
+	c.LocalpartAttribute = ""
+	c.DisplayNameAttribute = ""
+}
+
+func (c *CAS) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkURL(configErrs, "client_api.cas.server_url", c.ServerURL)
+	checkURL(configErrs, "client_api.cas.ticket_url", c.TicketURL)
+	for _, redirectURL := range c.AllowedRedirectURLs {
+		checkURL(configErrs, "client_api.cas.allowed_redirect_urls", redirectURL)
+	}
+}
+
+type RegistrationTerms struct {
+	// Whether users must accept the policies in order to register
+	Enabled bool `yaml:"enabled"`
+	// The policies which users must accept
+	Policies []TermsPolicy `yaml:"policies"`
+}
+
+type TermsPolicy struct {
+	// An identifier for the policy, e.g. terms_of_service
+	ID string `yaml:"id"`
+	// The version of the policy, which should change whenever the policy does
+	Version string `yaml:"version"`
+	// The name and URL of the policy in each language that it is available
+	// in, by language code, e.g. en
+	Translations map[string]TermsPolicyTranslation `yaml:"translations"`
+}
+
+type TermsPolicyTranslation struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+}
+
+func (c *RegistrationTerms) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	if len(c.Policies) == 0 {
+		configErrs.Add(fmt.Sprintf("no policies specified for config key %q", "client_api.registration_terms.policies"))
+	}
+	for _, policy := range c.Policies {
+		checkNotEmpty(configErrs, "client_api.registration_terms.policies.id", policy.ID)
+		checkNotEmpty(configErrs, "client_api.registration_terms.policies.version", policy.Version)
+		if len(policy.Translations) == 0 {
+			configErrs.Add(fmt.Sprintf("no translations specified for policy %q in config key %q", policy.ID, "client_api.registration_terms.policies"))
+		}
+		for _, translation := range policy.Translations {
+			checkNotEmpty(configErrs, "client_api.registration_terms.policies.translations.name", translation.Name)
+			checkURL(configErrs, "client_api.registration_terms.policies.translations.url", translation.URL)
+		}
+	}
+}
+
+type Email struct {
+	// Whether this server sends emails itself to validate email addresses.
+	// If not, clients must ask a trusted identity server to do it instead.
+	Enabled bool `yaml:"enabled"`
+
+	// The SMTP server to send emails through, as host:port
+	SMTPServer string `yaml:"smtp_server"`
+	// The credentials for the SMTP server, if it requires authentication
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	// The address that emails are sent from
+	From string `yaml:"from"`
+
+	// The public URL of this homeserver, e.g. https://matrix.example.com,
+	// which the links in validation emails point to
+	PublicBaseURL string `yaml:"public_base_url"`
+
+	// How long in milliseconds a validation email's token remains valid
+	SessionLifetimeMS int64 `yaml:"session_lifetime_ms"`
+	// The minimum time in milliseconds between validation emails being sent
+	// to the same address
+	SendCooloffMS int64 `yaml:"send_cooloff_ms"`
+}
+
+func (c *Email) Defaults() {
+	c.Enabled = false
+	c.SessionLifetimeMS = 3600000 // 1 hour
+	c.SendCooloffMS = 60000       // 1 minute
+}
+
+func (c *Email) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "client_api.email.smtp_server", c.SMTPServer)
+	checkNotEmpty(configErrs, "client_api.email.from", c.From)
+	checkURL(configErrs, "client_api.email.public_base_url", c.PublicBaseURL)
+	checkPositive(configErrs, "client_api.email.session_lifetime_ms", c.SessionLifetimeMS)
+	checkPositive(configErrs, "client_api.email.send_cooloff_ms", c.SendCooloffMS)
 }
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"math/rand"
 	"time"
 
@@ -34,6 +35,21 @@ type Global struct {
 	// Defaults to 24 hours.
 	KeyValidityPeriod time.Duration `yaml:"key_validity_period"`
 
+	// The host and optional port to delegate federation to, e.g.
+	// "matrix.example.com:8448". If set, it is served from
+	// /.well-known/matrix/server so that other servers connect there
+	// instead of to the server name.
+	WellKnownServerName string `yaml:"well_known_server_name"`
+
+	// The base URL of the client-server API, e.g. "https://matrix.example.com".
+	// If set, it is served from /.well-known/matrix/client so that clients can
+	// discover the homeserver from the server name.
+	WellKnownClientName string `yaml:"well_known_client_name"`
+
+	// The base URL of the identity server to advertise to clients in
+	// /.well-known/matrix/client, if any.
+	WellKnownIdentityServer string `yaml:"well_known_identity_server"`
+
 	// Disables federation. Dendrite will not be able to make any outbound HTTP requests
 	// to other servers and the federation API will not be exposed.
 	DisableFederation bool `yaml:"disable_federation"`
@@ -72,6 +88,17 @@ func (c *Global) Defaults() {
 func (c *Global) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkNotEmpty(configErrs, "global.server_name", string(c.ServerName))
 	checkNotEmpty(configErrs, "global.private_key", string(c.PrivateKeyPath))
+	if c.WellKnownServerName != "" {
+		if _, _, valid := gomatrixserverlib.ParseAndValidateServerName(gomatrixserverlib.ServerName(c.WellKnownServerName)); !valid {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "global.well_known_server_name", c.WellKnownServerName))
+		}
+	}
+	if c.WellKnownClientName != "" {
+		checkURL(configErrs, "global.well_known_client_name", c.WellKnownClientName)
+	}
+	if c.WellKnownIdentityServer != "" {
+		checkURL(configErrs, "global.well_known_identity_server", c.WellKnownIdentityServer)
+	}
 
 	c.Kafka.Verify(configErrs, isMonolith)
 	c.Metrics.Verify(configErrs, isMonolith)
@@ -143,12 +170,17 @@ type DatabaseOptions struct {
 	MaxIdleConnections int `yaml:"max_idle_conns"`
 	// maximum amount of time (in seconds) a connection may be reused (<= 0 means unlimited)
 	ConnMaxLifetimeSeconds int `yaml:"conn_max_lifetime"`
+	// maximum amount of time (in seconds) a query may take when the caller hasn't set a deadline (<= 0 means unlimited)
+	QueryTimeoutSeconds int `yaml:"query_timeout"`
+	// maximum amount of time (in milliseconds) to wait for a lock on an SQLite database before failing (0 means fail immediately)
+	BusyTimeoutMilliseconds int `yaml:"busy_timeout"`
 }
 
 func (c *DatabaseOptions) Defaults(conns int) {
 	c.MaxOpenConnections = conns
 	c.MaxIdleConnections = 2
 	c.ConnMaxLifetimeSeconds = -1
+	c.BusyTimeoutMilliseconds = 5000
 }
 
 func (c *DatabaseOptions) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -169,6 +201,16 @@ func (c DatabaseOptions) ConnMaxLifetime() time.Duration {
 	return time.Duration(c.ConnMaxLifetimeSeconds) * time.Second
 }
 
+// BusyTimeout returns the maximum amount of time to wait for a lock on an SQLite database
+func (c DatabaseOptions) BusyTimeout() time.Duration {
+	return time.Duration(c.BusyTimeoutMilliseconds) * time.Millisecond
+}
+
+// QueryTimeout returns the maximum amount of time a query may take when the caller hasn't set a deadline
+func (c DatabaseOptions) QueryTimeout() time.Duration {
+	return time.Duration(c.QueryTimeoutSeconds) * time.Second
+}
+
 type DNSCacheOptions struct {
 	// Whether the DNS cache is enabled or not
 	Enabled bool `yaml:"enabled"`
@@ -2,6 +2,8 @@ package config
 
 import (
 	"fmt"
+	"net"
+	"strings"
 )
 
 type MediaAPI struct {
@@ -25,7 +27,28 @@ type MediaAPI struct {
 	// Note: if max_file_size_bytes is not set, it will default to 10485760 (10MB)
 	MaxFileSizeBytes *FileSizeBytes `yaml:"max_file_size_bytes,omitempty"`
 
+	// The maximum total size in bytes of the media cached from remote servers, including
+	// their thumbnails. The least recently used remote media is deleted once the cache is
+	// larger than this. Media uploaded to this server is never deleted.
+	// Note: if remote_cache_max_bytes is 0 or not set, the cache size is unlimited.
+	RemoteCacheMaxBytes FileSizeBytes `yaml:"remote_cache_max_bytes"`
+
+	// Upload quota options.
+	UploadQuota UploadQuota `yaml:"upload_quota"`
+
+	// How long in milliseconds a media ID created for an asynchronous upload may be used
+	// to upload the content. Media IDs which expire without being used are deleted.
+	// default: 86400000 (24 hours)
+	PendingUploadExpiryMS int64 `yaml:"pending_upload_expiry_ms"`
+
+	// How thumbnails are generated, either "pre_generate" or "dynamic". pre_generate generates the configured
+	// thumbnail sizes when media is stored, and requests for other sizes are served by downscaling the nearest
+	// larger thumbnail. dynamic generates and stores thumbnails of the requested size when they are requested.
+	// default: pre_generate, or dynamic if dynamic_thumbnails is set
+	ThumbnailGeneration string `yaml:"thumbnail_generation"`
+
 	// Whether to dynamically generate thumbnails on-the-fly if the requested resolution is not already generated
+	// Deprecated: set thumbnail_generation to dynamic instead.
 	DynamicThumbnails bool `yaml:"dynamic_thumbnails"`
 
 	// The maximum number of simultaneous thumbnail generators. default: 10
@@ -33,6 +56,75 @@ type MediaAPI struct {
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// URL preview options.
+	URLPreviews URLPreviews `yaml:"url_previews"`
+}
+
+const (
+	// ThumbnailGenerationPreGenerate generates the configured thumbnail sizes when media is stored.
+	ThumbnailGenerationPreGenerate = "pre_generate"
+	// ThumbnailGenerationDynamic generates thumbnails of the requested size when they are requested.
+	ThumbnailGenerationDynamic = "dynamic"
+)
+
+// UploadQuota contains the limits on the total size of the media uploaded by each user.
+type UploadQuota struct {
+	// The maximum total size in bytes of the media uploaded by each user. Uploads which
+	// would take the user over this are rejected. If 0, the total size is unlimited.
+	MaxBytesPerUser FileSizeBytes `yaml:"max_bytes_per_user"`
+	// The maximum total size in bytes of the media uploaded by each appservice user,
+	// used instead of max_bytes_per_user. If 0, the total size is unlimited.
+	MaxBytesPerAppserviceUser FileSizeBytes `yaml:"max_bytes_per_appservice_user"`
+}
+
+// URLPreviews contains the options for generating previews of URLs.
+type URLPreviews struct {
+	// Whether URL previews are enabled. If not, /preview_url isn't available.
+	Enabled bool `yaml:"enabled"`
+	// The hosts which may be previewed. Entries are hostnames, "*.domain"
+	// wildcards or CIDR ranges, which are matched against the IP addresses
+	// that are connected to. If empty, all hosts which aren't denied may
+	// be previewed.
+	AllowedHosts []string `yaml:"allowed_hosts"`
+	// The hosts which may never be previewed, in the same format as the
+	// allowed hosts. Denied hosts take precedence over allowed hosts.
+	DeniedHosts []string `yaml:"denied_hosts"`
+	// The maximum size in bytes of a page which is previewed.
+	MaxPageSizeBytes FileSizeBytes `yaml:"max_page_size_bytes"`
+	// The maximum time in milliseconds spent fetching a page and its image.
+	TimeoutMS int64 `yaml:"timeout_ms"`
+	// How long in milliseconds a preview is cached for.
+	CacheTTLMS int64 `yaml:"cache_ttl_ms"`
+}
+
+// DefaultPendingUploadExpiryMS is how long a media ID created for an asynchronous upload may be used.
+const DefaultPendingUploadExpiryMS = 86400000 // 24 hours
+
+const (
+	DefaultURLPreviewMaxPageSizeBytes = 10485760 // 10MB
+	DefaultURLPreviewTimeoutMS        = 10000    // 10 seconds
+	DefaultURLPreviewCacheTTLMS       = 3600000  // 1 hour
+)
+
+// DefaultURLPreviewDeniedHosts are the loopback, private and link-local
+// ranges, which must not be reachable through URL previews.
+var DefaultURLPreviewDeniedHosts = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::1/128",
+	"fe80::/10",
+	"fc00::/7",
+	"ff00::/8",
 }
 
 func (c *MediaAPI) Defaults() {
@@ -46,6 +138,20 @@ func (c *MediaAPI) Defaults() {
 	c.MaxFileSizeBytes = &defaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
 	c.BasePath = "./media_store"
+	c.PendingUploadExpiryMS = DefaultPendingUploadExpiryMS
+	c.URLPreviews.DeniedHosts = DefaultURLPreviewDeniedHosts
+	c.URLPreviews.MaxPageSizeBytes = DefaultURLPreviewMaxPageSizeBytes
+	c.URLPreviews.TimeoutMS = DefaultURLPreviewTimeoutMS
+	c.URLPreviews.CacheTTLMS = DefaultURLPreviewCacheTTLMS
+}
+
+// DynamicThumbnailGeneration returns true if thumbnails are generated when they
+// are requested rather than when media is stored.
+func (c *MediaAPI) DynamicThumbnailGeneration() bool {
+	if c.ThumbnailGeneration == "" {
+		return c.DynamicThumbnails
+	}
+	return c.ThumbnailGeneration == ThumbnailGenerationDynamic
 }
 
 func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -58,10 +164,41 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 
 	checkNotEmpty(configErrs, "media_api.base_path", string(c.BasePath))
 	checkPositive(configErrs, "media_api.max_file_size_bytes", int64(*c.MaxFileSizeBytes))
+	checkPositive(configErrs, "media_api.remote_cache_max_bytes", int64(c.RemoteCacheMaxBytes))
+	checkPositive(configErrs, "media_api.upload_quota.max_bytes_per_user", int64(c.UploadQuota.MaxBytesPerUser))
+	checkPositive(configErrs, "media_api.upload_quota.max_bytes_per_appservice_user", int64(c.UploadQuota.MaxBytesPerAppserviceUser))
+	checkPositive(configErrs, "media_api.pending_upload_expiry_ms", c.PendingUploadExpiryMS)
 	checkPositive(configErrs, "media_api.max_thumbnail_generators", int64(c.MaxThumbnailGenerators))
+	switch c.ThumbnailGeneration {
+	case "", ThumbnailGenerationPreGenerate, ThumbnailGenerationDynamic:
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "media_api.thumbnail_generation", c.ThumbnailGeneration))
+	}
 
 	for i, size := range c.ThumbnailSizes {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].height", i), int64(size.Height))
 	}
+
+	if c.URLPreviews.Enabled {
+		checkPositive(configErrs, "media_api.url_previews.max_page_size_bytes", int64(c.URLPreviews.MaxPageSizeBytes))
+		checkPositive(configErrs, "media_api.url_previews.timeout_ms", c.URLPreviews.TimeoutMS)
+		checkPositive(configErrs, "media_api.url_previews.cache_ttl_ms", c.URLPreviews.CacheTTLMS)
+		for i, host := range c.URLPreviews.AllowedHosts {
+			checkURLPreviewHost(configErrs, fmt.Sprintf("media_api.url_previews.allowed_hosts[%d]", i), host)
+		}
+		for i, host := range c.URLPreviews.DeniedHosts {
+			checkURLPreviewHost(configErrs, fmt.Sprintf("media_api.url_previews.denied_hosts[%d]", i), host)
+		}
+	}
+}
+
+func checkURLPreviewHost(configErrs *ConfigErrors, key, value string) {
+	if strings.Contains(value, "/") {
+		if _, _, err := net.ParseCIDR(value); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid CIDR range for config key %q: %s", key, value))
+		}
+		return
+	}
+	checkNotEmpty(configErrs, key, strings.TrimPrefix(value, "*."))
 }
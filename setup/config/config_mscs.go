@@ -4,10 +4,12 @@ type MSCs struct {
 	Matrix *Global `yaml:"-"`
 
 	// The MSCs to enable. Supported MSCs include:
+	// 'msc2403': Knocking - https://github.com/matrix-org/matrix-doc/pull/2403
 	// 'msc2444': Peeking over federation - https://github.com/matrix-org/matrix-doc/pull/2444
 	// 'msc2753': Peeking via /sync - https://github.com/matrix-org/matrix-doc/pull/2753
 	// 'msc2836': Threading - https://github.com/matrix-org/matrix-doc/pull/2836
 	// 'msc2946': Spaces Summary - https://github.com/matrix-org/matrix-doc/pull/2946
+	// 'msc3575': Sliding sync - https://github.com/matrix-org/matrix-doc/pull/3575
 	MSCs []string `yaml:"mscs"`
 
 	Database DatabaseOptions `yaml:"database"`
@@ -1,11 +1,96 @@
 package config
 
+import (
+	"fmt"
+	"time"
+)
+
 type RoomServer struct {
 	Matrix *Global `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 
 	Database DatabaseOptions `yaml:"database"`
+
+	// How to compress event JSON when storing it. One of "none", "gzip" or
+	// "zstd". Existing events are not recompressed when this is changed.
+	EventJSONCompression string `yaml:"event_json_compression"`
+
+	// Whether to store each distinct event JSON only once, even if it is used
+	// by many events. Existing events are not deduplicated when this is enabled.
+	EventJSONDeduplication bool `yaml:"event_json_deduplication"`
+
+	// The maximum number of events to hold in the in-memory event JSON cache.
+	// Set to 0 to disable the cache.
+	EventCacheMaxEntries int `yaml:"event_cache_max_entries"`
+
+	// How often to refresh the metric for the total size of the stored event
+	// JSON. Set to 0 to disable.
+	EventJSONSizeRefreshInterval time.Duration `yaml:"event_json_size_refresh_interval"`
+
+	// Configuration for purging old messages from rooms, as per MSC1763.
+	Retention RetentionOptions `yaml:"retention"`
+
+	// The maximum size in bytes of the canonical JSON of an event. Events
+	// which are bigger are rejected, whether they come from local clients or
+	// over federation. Defaults to the spec limit of 65536 bytes, which is
+	// also the most that can be allowed.
+	MaxEventSize int `yaml:"max_event_size"`
+
+	// The maximum number of prev_events and auth_events an event can refer
+	// to. Events which refer to more are rejected.
+	MaxPrevEvents int `yaml:"max_prev_events"`
+	MaxAuthEvents int `yaml:"max_auth_events"`
+}
+
+const (
+	// DefaultMaxEventSize is the size limit on events given by the spec.
+	// https://matrix.org/docs/spec/client_server/r0.6.1#size-limits
+	DefaultMaxEventSize = 65536
+	// The same limits on the number of prev_events and auth_events as Synapse.
+	DefaultMaxPrevEvents = 20
+	DefaultMaxAuthEvents = 10
+)
+
+// RetentionOptions configures how long messages are kept for. The lifetime of
+// messages in a room comes from the max_lifetime in its m.room.retention state,
+// limited to the bounds given here. State events are always kept.
+type RetentionOptions struct {
+	// Whether to purge old messages at all.
+	Enabled bool `yaml:"enabled"`
+
+	// Only log the messages which would be purged, rather than purging them.
+	DryRun bool `yaml:"dry_run"`
+
+	// How long to keep messages for in rooms without an m.room.retention
+	// event. Set to 0 to keep them forever.
+	DefaultMaxLifetime time.Duration `yaml:"default_max_lifetime"`
+
+	// The bounds for the max_lifetime of m.room.retention events, so that
+	// rooms can't keep messages for longer, or purge them sooner, than the
+	// server allows. Set to 0 to leave unbounded.
+	MinLifetime time.Duration `yaml:"min_lifetime"`
+	MaxLifetime time.Duration `yaml:"max_lifetime"`
+
+	// How often to look for messages to purge.
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+// Lifetime returns how long to keep messages for, given the max_lifetime of the
+// room's m.room.retention event, or nil if there isn't one. Returns 0 if the
+// messages should be kept forever.
+func (c *RetentionOptions) Lifetime(maxLifetime *time.Duration) time.Duration {
+	if maxLifetime == nil || *maxLifetime <= 0 {
+		return c.DefaultMaxLifetime
+	}
+	lifetime := *maxLifetime
+	if c.MinLifetime > 0 && lifetime < c.MinLifetime {
+		lifetime = c.MinLifetime
+	}
+	if c.MaxLifetime > 0 && lifetime > c.MaxLifetime {
+		lifetime = c.MaxLifetime
+	}
+	return lifetime
 }
 
 func (c *RoomServer) Defaults() {
@@ -13,10 +98,55 @@ func (c *RoomServer) Defaults() {
 	c.InternalAPI.Connect = "http://localhost:7770"
 	c.Database.Defaults(10)
 	c.Database.ConnectionString = "file:roomserver.db"
+	c.EventJSONCompression = "none"
+	c.EventJSONSizeRefreshInterval = time.Minute * 5
+	c.Retention.PurgeInterval = time.Hour
+	c.MaxEventSize = DefaultMaxEventSize
+	c.MaxPrevEvents = DefaultMaxPrevEvents
+	c.MaxAuthEvents = DefaultMaxAuthEvents
 }
 
 func (c *RoomServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "room_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "room_server.internal_ap.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "room_server.database.connection_string", string(c.Database.ConnectionString))
+	switch c.EventJSONCompression {
+	case "none", "gzip", "zstd":
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.event_json_compression", c.EventJSONCompression))
+	}
+	if c.EventCacheMaxEntries < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.event_cache_max_entries", c.EventCacheMaxEntries))
+	}
+	if c.EventJSONSizeRefreshInterval < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.event_json_size_refresh_interval", c.EventJSONSizeRefreshInterval))
+	}
+	if c.MaxEventSize <= 0 || c.MaxEventSize > DefaultMaxEventSize {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.max_event_size", c.MaxEventSize))
+	}
+	if c.MaxPrevEvents <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.max_prev_events", c.MaxPrevEvents))
+	}
+	if c.MaxAuthEvents <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "room_server.max_auth_events", c.MaxAuthEvents))
+	}
+	c.Retention.Verify(configErrs)
+}
+
+func (c *RetentionOptions) Verify(configErrs *ConfigErrors) {
+	if c.DefaultMaxLifetime < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.retention.default_max_lifetime", c.DefaultMaxLifetime))
+	}
+	if c.MinLifetime < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.retention.min_lifetime", c.MinLifetime))
+	}
+	if c.MaxLifetime < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.retention.max_lifetime", c.MaxLifetime))
+	}
+	if c.MinLifetime > 0 && c.MaxLifetime > 0 && c.MinLifetime > c.MaxLifetime {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s is less than min_lifetime", "room_server.retention.max_lifetime", c.MaxLifetime))
+	}
+	if c.Enabled && c.PurgeInterval <= 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", "room_server.retention.purge_interval", c.PurgeInterval))
+	}
 }
@@ -1,6 +1,13 @@
 package config
 
-import "github.com/matrix-org/gomatrixserverlib"
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
 
 type SigningKeyServer struct {
 	Matrix *Global `yaml:"-"`
@@ -30,6 +37,18 @@ func (c *SigningKeyServer) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkURL(configErrs, "signing_key_server.internal_api.listen", string(c.InternalAPI.Listen))
 	checkURL(configErrs, "signing_key_server.internal_api.bind", string(c.InternalAPI.Connect))
 	checkNotEmpty(configErrs, "signing_key_server.database.connection_string", string(c.Database.ConnectionString))
+	for i, ps := range c.KeyPerspectives {
+		key := fmt.Sprintf("signing_key_server.key_perspectives[%d]", i)
+		checkNotEmpty(configErrs, key+".server_name", string(ps.ServerName))
+		if len(ps.Keys) == 0 {
+			configErrs.Add(fmt.Sprintf("missing config key %q", key+".keys"))
+		}
+		for j, k := range ps.Keys {
+			if err := k.verify(); err != nil {
+				configErrs.Add(fmt.Sprintf("invalid value for config key %q: %s", fmt.Sprintf("%s.keys[%d]", key, j), err))
+			}
+		}
+	}
 }
 
 // KeyPerspectives are used to configure perspective key servers for
@@ -50,3 +69,22 @@ type KeyPerspectiveTrustKey struct {
 	// The public key in base64 unpadded format
 	PublicKey string `yaml:"public_key"`
 }
+
+// PublicKeyBytes returns the decoded ed25519 public key.
+func (k *KeyPerspectiveTrustKey) PublicKeyBytes() (ed25519.PublicKey, error) {
+	return base64.RawStdEncoding.DecodeString(k.PublicKey)
+}
+
+func (k *KeyPerspectiveTrustKey) verify() error {
+	if !strings.HasPrefix(string(k.KeyID), "ed25519:") {
+		return fmt.Errorf("key ID %q is not an ed25519 key", k.KeyID)
+	}
+	key, err := k.PublicKeyBytes()
+	if err != nil {
+		return fmt.Errorf("public key is not unpadded base64: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("public key is %d bytes, not %d", len(key), ed25519.PublicKeySize)
+	}
+	return nil
+}
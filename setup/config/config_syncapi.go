@@ -1,7 +1,8 @@
 package config
 
 type SyncAPI struct {
-	Matrix *Global `yaml:"-"`
+	Matrix  *Global  `yaml:"-"`
+	Derived *Derived `yaml:"-"`
 
 	InternalAPI InternalAPIOptions `yaml:"internal_api"`
 	ExternalAPI ExternalAPIOptions `yaml:"external_api"`
@@ -9,6 +10,8 @@ type SyncAPI struct {
 	Database DatabaseOptions `yaml:"database"`
 
 	RealIPHeader string `yaml:"real_ip_header"`
+
+	MSCs *MSCs `yaml:"mscs"`
 }
 
 func (c *SyncAPI) Defaults() {
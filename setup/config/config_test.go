@@ -16,7 +16,11 @@ package config
 
 import (
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 )
 
 func TestLoadConfigRelative(t *testing.T) {
@@ -244,6 +248,105 @@ func TestReadKey(t *testing.T) {
 	}
 }
 
+func TestRetentionLifetime(t *testing.T) {
+	c := RetentionOptions{
+		DefaultMaxLifetime: time.Hour * 24,
+		MinLifetime:        time.Hour,
+		MaxLifetime:        time.Hour * 24 * 7,
+	}
+	for _, tc := range []struct {
+		maxLifetime *time.Duration
+		want        time.Duration
+	}{
+		{nil, time.Hour * 24},
+		{durationPtr(0), time.Hour * 24},
+		{durationPtr(time.Minute), time.Hour},
+		{durationPtr(time.Hour * 48), time.Hour * 48},
+		{durationPtr(time.Hour * 24 * 365), time.Hour * 24 * 7},
+	} {
+		if got := c.Lifetime(tc.maxLifetime); got != tc.want {
+			t.Errorf("Lifetime(%v): got %s, want %s", tc.maxLifetime, got, tc.want)
+		}
+	}
+
+	configErrs := &ConfigErrors{}
+	c.MinLifetime = time.Hour * 24 * 30
+	c.Enabled = true
+	c.Verify(configErrs)
+	if len(*configErrs) != 2 {
+		t.Errorf("got config errors %v, want a min_lifetime above max_lifetime and a missing purge_interval", *configErrs)
+	}
+}
+
+func TestKeyPerspectivesVerify(t *testing.T) {
+	c := &SigningKeyServer{}
+	c.Defaults()
+	c.KeyPerspectives = KeyPerspectives{{
+		ServerName: "matrix.org",
+		Keys: []KeyPerspectiveTrustKey{
+			{KeyID: "ed25519:auto", PublicKey: "Noi6WqcDj0QmPxCNQqgezwTlBKrfqehY1u2FyWP9uYw"},
+			{KeyID: "ed25519:padded", PublicKey: "Noi6WqcDj0QmPxCNQqgezwTlBKrfqehY1u2FyWP9uYw="},
+			{KeyID: "ed25519:short", PublicKey: "Noi6WqcDj0QmPxCNQqgezw"},
+			{KeyID: "curve25519:auto", PublicKey: "Noi6WqcDj0QmPxCNQqgezwTlBKrfqehY1u2FyWP9uYw"},
+		},
+	}, {
+		ServerName: "example.com",
+	}}
+	configErrs := &ConfigErrors{}
+	c.Verify(configErrs, true)
+	if len(*configErrs) != 4 {
+		t.Errorf("got config errors %v, want three invalid keys and a perspective without keys", *configErrs)
+	}
+}
+
+func TestDeriveRegistrationFlows(t *testing.T) {
+	for _, tc := range []struct {
+		token, recaptcha, terms, email bool
+		want                           []authtypes.LoginType
+	}{
+		{want: []authtypes.LoginType{authtypes.LoginTypeDummy}},
+		{recaptcha: true, want: []authtypes.LoginType{authtypes.LoginTypeRecaptcha}},
+		{terms: true, email: true, want: []authtypes.LoginType{authtypes.LoginTypeTerms, authtypes.LoginTypeEmail}},
+		{recaptcha: true, terms: true, email: true, want: []authtypes.LoginType{
+			authtypes.LoginTypeRecaptcha, authtypes.LoginTypeTerms, authtypes.LoginTypeEmail,
+		}},
+		{token: true, recaptcha: true, want: []authtypes.LoginType{
+			authtypes.LoginTypeRegistrationToken, authtypes.LoginTypeRecaptcha,
+		}},
+	} {
+		c := &Dendrite{}
+		c.Defaults()
+		c.ClientAPI.RegistrationRequiresToken = tc.token
+		c.ClientAPI.RecaptchaEnabled = tc.recaptcha
+		c.ClientAPI.RegistrationTerms = RegistrationTerms{
+			Enabled: tc.terms,
+			Policies: []TermsPolicy{{
+				ID:      "terms_of_service",
+				Version: "1.0",
+				Translations: map[string]TermsPolicyTranslation{
+					"en": {Name: "Terms of Service", URL: "https://example.com/terms"},
+				},
+			}},
+		}
+		c.ClientAPI.RegistrationRequiresEmail = tc.email
+		if err := c.Derive(); err != nil {
+			t.Fatalf("Derive failed: %s", err)
+		}
+		flows := c.Derived.Registration.Flows
+		if len(flows) != 1 || !reflect.DeepEqual(flows[0].Stages, tc.want) {
+			t.Errorf("token=%v recaptcha=%v terms=%v email=%v: got flows %v, want %v", tc.token, tc.recaptcha, tc.terms, tc.email, flows, tc.want)
+		}
+		_, hasTerms := c.Derived.Registration.Params[authtypes.LoginTypeTerms]
+		if hasTerms != tc.terms {
+			t.Errorf("terms=%v: got terms params %v", tc.terms, c.Derived.Registration.Params)
+		}
+	}
+}
+
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
 const testKeyID = "ed25519:c8NsuQ"
 
 const testKey = `
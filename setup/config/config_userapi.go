@@ -13,16 +13,131 @@ type UserAPI struct {
 	// The length of time an OpenID token is condidered valid in milliseconds
 	OpenIDTokenLifetimeMS int64 `yaml:"openid_token_lifetime_ms"`
 
+	// The length of time a login token issued for m.login.token, e.g. after
+	// SSO, is considered valid in milliseconds
+	LoginTokenLifetimeMS int64 `yaml:"login_token_lifetime_ms"`
+
+	// The length of time an access token issued along with a refresh token
+	// is considered valid in milliseconds. Access tokens issued without a
+	// refresh token never expire.
+	AccessTokenLifetimeMS int64 `yaml:"access_token_lifetime_ms"`
+
+	// The length of time a refresh token is considered valid in milliseconds,
+	// or 0 for refresh tokens to never expire.
+	RefreshTokenLifetimeMS int64 `yaml:"refresh_token_lifetime_ms"`
+
 	// The Account database stores the login details and account information
 	// for local users. It is accessed by the UserAPI.
 	AccountDatabase DatabaseOptions `yaml:"account_database"`
 	// The Device database stores session information for the devices of logged
 	// in local users. It is accessed by the UserAPI.
 	DeviceDatabase DatabaseOptions `yaml:"device_database"`
+
+	// Presence options.
+	Presence Presence `yaml:"presence"`
+
+	// Options for sending push notifications to pushers.
+	Push Push `yaml:"push"`
+
+	// Options for recording where devices connect from, for /admin/whois.
+	DeviceConnections DeviceConnections `yaml:"device_connections"`
+
+	// Options for delegating authentication to an OAuth 2.0 authorization
+	// server (MSC3861), in which case access tokens are issued by it rather
+	// than by Dendrite.
+	DelegatedAuth DelegatedAuth `yaml:"delegated_auth"`
+}
+
+// Presence contains the options for the presence of users.
+type Presence struct {
+	// Whether presence is enabled. If not, presence updates are ignored.
+	Enabled bool `yaml:"enabled"`
+	// The minimum time in milliseconds between presence updates being sent
+	// for each user. Updates made within the interval are combined, and the
+	// latest one is sent when the interval ends.
+	AggregationIntervalMS int64 `yaml:"aggregation_interval_ms"`
+	// How long in milliseconds a local user can be inactive for before they
+	// are automatically marked as offline.
+	IdleTimeoutMS int64 `yaml:"idle_timeout_ms"`
+}
+
+// Push contains the options for delivering notifications to the pushers of
+// users, i.e. push gateways and email addresses.
+type Push struct {
+	// How many times delivering a notification to a pusher is attempted before
+	// the notification is dropped.
+	MaxAttempts int `yaml:"max_attempts"`
+	// How long in milliseconds to wait before retrying a failed delivery. The
+	// wait doubles after each failed attempt.
+	InitialBackoffMS int64 `yaml:"initial_backoff_ms"`
+	// Options for email pushers. Nothing is sent to email pushers unless an
+	// SMTP server is set.
+	Email PushEmail `yaml:"email"`
+}
+
+// PushEmail contains the options for sending notifications by email.
+type PushEmail struct {
+	// The SMTP server to send emails through, as host:port
+	SMTPServer string `yaml:"smtp_server"`
+	// The credentials for the SMTP server, if it requires authentication
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	// The address that emails are sent from
+	From string `yaml:"from"`
+}
+
+// DeviceConnections contains the options for recording the IP addresses and
+// user agents which the devices of local users connect from.
+type DeviceConnections struct {
+	// The minimum time in milliseconds between recording the same connection
+	// again. Requests made within the interval don't update the last seen time.
+	UpdateIntervalMS int64 `yaml:"update_interval_ms"`
+	// How long in milliseconds connections are kept for after they were last
+	// seen.
+	MaxAgeMS int64 `yaml:"max_age_ms"`
+}
+
+// DelegatedAuth contains the options for validating access tokens by asking an
+// OAuth 2.0 authorization server about them.
+type DelegatedAuth struct {
+	// Whether access tokens are validated by the authorization server. If not,
+	// access tokens are the ones issued by Dendrite when logging in.
+	Enabled bool `yaml:"enabled"`
+	// The token introspection endpoint (RFC 7662) of the authorization server,
+	// e.g. https://auth.example.com/oauth2/introspect
+	IntrospectionURL string `yaml:"introspection_url"`
+	// The client ID and secret which Dendrite is registered with at the
+	// authorization server, used to authenticate introspection requests.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// How long in milliseconds the result of introspecting a token is cached
+	// for, so that not every request needs to ask the authorization server.
+	CacheTTLMS int64 `yaml:"cache_ttl_ms"`
 }
 
 const DefaultOpenIDTokenLifetimeMS = 3600000 // 60 minutes
 
+const DefaultLoginTokenLifetimeMS = 120000 // 2 minutes
+
+const DefaultAccessTokenLifetimeMS = 300000 // 5 minutes
+
+const DefaultDelegatedAuthCacheTTLMS = 60000 // 1 minute
+
+const (
+	DefaultPresenceAggregationIntervalMS = 5000   // 5 seconds
+	DefaultPresenceIdleTimeoutMS         = 300000 // 5 minutes
+)
+
+const (
+	DefaultPushMaxAttempts      = 8
+	DefaultPushInitialBackoffMS = 1000 // 1 second
+)
+
+const (
+	DefaultDeviceConnectionsUpdateIntervalMS = 60000      // 1 minute
+	DefaultDeviceConnectionsMaxAgeMS         = 2419200000 // 28 days
+)
+
 func (c *UserAPI) Defaults() {
 	c.InternalAPI.Listen = "http://localhost:7781"
 	c.InternalAPI.Connect = "http://localhost:7781"
@@ -32,6 +147,15 @@ func (c *UserAPI) Defaults() {
 	c.DeviceDatabase.ConnectionString = "file:userapi_devices.db"
 	c.BCryptCost = bcrypt.DefaultCost
 	c.OpenIDTokenLifetimeMS = DefaultOpenIDTokenLifetimeMS
+	c.LoginTokenLifetimeMS = DefaultLoginTokenLifetimeMS
+	c.AccessTokenLifetimeMS = DefaultAccessTokenLifetimeMS
+	c.Presence.AggregationIntervalMS = DefaultPresenceAggregationIntervalMS
+	c.Presence.IdleTimeoutMS = DefaultPresenceIdleTimeoutMS
+	c.Push.MaxAttempts = DefaultPushMaxAttempts
+	c.Push.InitialBackoffMS = DefaultPushInitialBackoffMS
+	c.DeviceConnections.UpdateIntervalMS = DefaultDeviceConnectionsUpdateIntervalMS
+	c.DeviceConnections.MaxAgeMS = DefaultDeviceConnectionsMaxAgeMS
+	c.DelegatedAuth.CacheTTLMS = DefaultDelegatedAuthCacheTTLMS
 }
 
 func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
@@ -40,4 +164,24 @@ func (c *UserAPI) Verify(configErrs *ConfigErrors, isMonolith bool) {
 	checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	checkNotEmpty(configErrs, "user_api.device_database.connection_string", string(c.DeviceDatabase.ConnectionString))
 	checkPositive(configErrs, "user_api.openid_token_lifetime_ms", c.OpenIDTokenLifetimeMS)
+	checkPositive(configErrs, "user_api.login_token_lifetime_ms", c.LoginTokenLifetimeMS)
+	checkNotZero(configErrs, "user_api.access_token_lifetime_ms", c.AccessTokenLifetimeMS)
+	checkPositive(configErrs, "user_api.access_token_lifetime_ms", c.AccessTokenLifetimeMS)
+	checkPositive(configErrs, "user_api.refresh_token_lifetime_ms", c.RefreshTokenLifetimeMS)
+	if c.Presence.Enabled {
+		checkPositive(configErrs, "user_api.presence.aggregation_interval_ms", c.Presence.AggregationIntervalMS)
+		checkPositive(configErrs, "user_api.presence.idle_timeout_ms", c.Presence.IdleTimeoutMS)
+	}
+	checkPositive(configErrs, "user_api.push.max_attempts", int64(c.Push.MaxAttempts))
+	checkPositive(configErrs, "user_api.push.initial_backoff_ms", c.Push.InitialBackoffMS)
+	checkPositive(configErrs, "user_api.device_connections.update_interval_ms", c.DeviceConnections.UpdateIntervalMS)
+	checkPositive(configErrs, "user_api.device_connections.max_age_ms", c.DeviceConnections.MaxAgeMS)
+	if c.DelegatedAuth.Enabled {
+		checkURL(configErrs, "user_api.delegated_auth.introspection_url", c.DelegatedAuth.IntrospectionURL)
+		checkNotEmpty(configErrs, "user_api.delegated_auth.client_id", c.DelegatedAuth.ClientID)
+		checkPositive(configErrs, "user_api.delegated_auth.cache_ttl_ms", c.DelegatedAuth.CacheTTLMS)
+	}
+	if c.Push.Email.SMTPServer != "" {
+		checkNotEmpty(configErrs, "user_api.push.email.from", c.Push.Email.From)
+	}
 }
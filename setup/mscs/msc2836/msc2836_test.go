@@ -512,6 +512,9 @@ func (u *testUserAPI) PerformPasswordUpdate(ctx context.Context, req *userapi.Pe
 func (u *testUserAPI) PerformDeviceCreation(ctx context.Context, req *userapi.PerformDeviceCreationRequest, res *userapi.PerformDeviceCreationResponse) error {
 	return nil
 }
+func (u *testUserAPI) PerformTokenRefresh(ctx context.Context, req *userapi.PerformTokenRefreshRequest, res *userapi.PerformTokenRefreshResponse) error {
+	return nil
+}
 func (u *testUserAPI) PerformDeviceDeletion(ctx context.Context, req *userapi.PerformDeviceDeletionRequest, res *userapi.PerformDeviceDeletionResponse) error {
 	return nil
 }
@@ -521,12 +524,54 @@ func (u *testUserAPI) PerformDeviceUpdate(ctx context.Context, req *userapi.Perf
 func (u *testUserAPI) PerformLastSeenUpdate(ctx context.Context, req *userapi.PerformLastSeenUpdateRequest, res *userapi.PerformLastSeenUpdateResponse) error {
 	return nil
 }
+func (u *testUserAPI) PerformPresenceUpdate(ctx context.Context, req *userapi.PerformPresenceUpdateRequest, res *userapi.PerformPresenceUpdateResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryPresence(ctx context.Context, req *userapi.QueryPresenceRequest, res *userapi.QueryPresenceResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformKeyBackup(ctx context.Context, req *userapi.PerformKeyBackupRequest, res *userapi.PerformKeyBackupResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryKeyBackup(ctx context.Context, req *userapi.QueryKeyBackupRequest, res *userapi.QueryKeyBackupResponse) error {
+	return nil
+}
 func (u *testUserAPI) PerformAccountDeactivation(ctx context.Context, req *userapi.PerformAccountDeactivationRequest, res *userapi.PerformAccountDeactivationResponse) error {
 	return nil
 }
 func (u *testUserAPI) PerformOpenIDTokenCreation(ctx context.Context, req *userapi.PerformOpenIDTokenCreationRequest, res *userapi.PerformOpenIDTokenCreationResponse) error {
 	return nil
 }
+func (u *testUserAPI) PerformLoginTokenCreation(ctx context.Context, req *userapi.PerformLoginTokenCreationRequest, res *userapi.PerformLoginTokenCreationResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformLoginTokenConsumption(ctx context.Context, req *userapi.PerformLoginTokenConsumptionRequest, res *userapi.PerformLoginTokenConsumptionResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformEmailSessionCreation(ctx context.Context, req *userapi.PerformEmailSessionCreationRequest, res *userapi.PerformEmailSessionCreationResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformEmailSessionValidation(ctx context.Context, req *userapi.PerformEmailSessionValidationRequest, res *userapi.PerformEmailSessionValidationResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformEmailSessionConsumption(ctx context.Context, req *userapi.PerformEmailSessionConsumptionRequest, res *userapi.PerformEmailSessionConsumptionResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryPushRules(ctx context.Context, req *userapi.QueryPushRulesRequest, res *userapi.QueryPushRulesResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformPushRulesPut(ctx context.Context, req *userapi.PerformPushRulesPutRequest, res *userapi.PerformPushRulesPutResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryPushers(ctx context.Context, req *userapi.QueryPushersRequest, res *userapi.QueryPushersResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformPusherSet(ctx context.Context, req *userapi.PerformPusherSetRequest, res *userapi.PerformPusherSetResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformPushNotification(ctx context.Context, req *userapi.PerformPushNotificationRequest, res *userapi.PerformPushNotificationResponse) error {
+	return nil
+}
 func (u *testUserAPI) QueryProfile(ctx context.Context, req *userapi.QueryProfileRequest, res *userapi.QueryProfileResponse) error {
 	return nil
 }
@@ -542,6 +587,9 @@ func (u *testUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAc
 func (u *testUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
 	return nil
 }
+func (u *testUserAPI) QueryDeviceConnections(ctx context.Context, req *userapi.QueryDeviceConnectionsRequest, res *userapi.QueryDeviceConnectionsResponse) error {
+	return nil
+}
 func (u *testUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
 	return nil
 }
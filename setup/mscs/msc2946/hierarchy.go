@@ -0,0 +1,467 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package msc2946
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	fs "github.com/matrix-org/dendrite/federationsender/api"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	roomserver "github.com/matrix-org/dendrite/roomserver/api"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// hierarchyDefaultLimit is the number of rooms returned per page when the
+	// client doesn't ask for a limit, and hierarchyMaxLimit the most we'll return.
+	hierarchyDefaultLimit = 50
+	hierarchyMaxLimit     = 100
+	// hierarchyPaginationExpiry is how long a next_batch token can be used for.
+	hierarchyPaginationExpiry = 10 * time.Minute
+)
+
+// hierarchyResponse is the response to a client /hierarchy request.
+type hierarchyResponse struct {
+	Rooms     []fs.MSC2946HierarchyRoom `json:"rooms"`
+	NextBatch string                    `json:"next_batch,omitempty"`
+}
+
+// hierarchyEntry is a room waiting to be visited by the walk.
+type hierarchyEntry struct {
+	roomID string
+	depth  int
+	// The servers from the m.space.child event pointing at this room, used to
+	// ask about the room over federation if we aren't in it.
+	vias []string
+}
+
+// hierarchyPagination is where a walk got to when a page filled up, so that it
+// can carry on from there when the client asks for the next batch.
+type hierarchyPagination struct {
+	callerID      string
+	rootRoomID    string
+	suggestedOnly bool
+	maxDepth      int
+	stack         []hierarchyEntry
+	processed     set
+	// Rooms we've been told about by other servers, but haven't visited yet.
+	remoteRooms map[string]fs.MSC2946HierarchyRoom
+	expires     time.Time
+}
+
+// hierarchyPaginationCache holds the walks which can be continued with a
+// next_batch token. Tokens are single use.
+type hierarchyPaginationCache struct {
+	mu    sync.Mutex
+	cache map[string]*hierarchyPagination
+}
+
+func (c *hierarchyPaginationCache) load(token string) *hierarchyPagination {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.cache[token]
+	if !ok || time.Now().After(p.expires) {
+		return nil
+	}
+	delete(c.cache, token)
+	return p
+}
+
+func (c *hierarchyPaginationCache) store(p *hierarchyPagination) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = make(map[string]*hierarchyPagination)
+	}
+	now := time.Now()
+	for token, cached := range c.cache {
+		if now.After(cached.expires) {
+			delete(c.cache, token)
+		}
+	}
+	p.expires = now.Add(hierarchyPaginationExpiry)
+	token := util.RandomString(16)
+	c.cache[token] = p
+	return token
+}
+
+func hierarchyHandler(
+	db Database, rsAPI roomserver.RoomserverInternalAPI, fsAPI fs.FederationSenderInternalAPI,
+	thisServer gomatrixserverlib.ServerName, paginationCache *hierarchyPaginationCache,
+) func(*http.Request, *userapi.Device) util.JSONResponse {
+	return func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		params, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		roomID := params["roomID"]
+		query := req.URL.Query()
+		suggestedOnly := query.Get("suggested_only") == "true"
+		limit := hierarchyDefaultLimit
+		if s := query.Get("limit"); s != "" {
+			if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+				}
+			}
+			if limit > hierarchyMaxLimit {
+				limit = hierarchyMaxLimit
+			}
+		}
+		maxDepth := -1
+		if s := query.Get("max_depth"); s != "" {
+			if maxDepth, err = strconv.Atoi(s); err != nil || maxDepth < 0 {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("max_depth must be a non-negative integer"),
+				}
+			}
+		}
+
+		w := hierarchyWalker{
+			walker: walker{
+				rootRoomID: roomID,
+				caller:     device,
+				thisServer: thisServer,
+				ctx:        req.Context(),
+				db:         db,
+				rsAPI:      rsAPI,
+				fsAPI:      fsAPI,
+			},
+			suggestedOnly: suggestedOnly,
+		}
+		var page *hierarchyPagination
+		if from := query.Get("from"); from != "" {
+			page = paginationCache.load(from)
+			// The other parameters must match the request which the token came from.
+			if page == nil || page.callerID != w.callerID() || page.rootRoomID != roomID ||
+				page.suggestedOnly != suggestedOnly || page.maxDepth != maxDepth {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidParam("unknown or expired from token"),
+				}
+			}
+		} else {
+			page = &hierarchyPagination{
+				callerID:      w.callerID(),
+				rootRoomID:    roomID,
+				suggestedOnly: suggestedOnly,
+				maxDepth:      maxDepth,
+				stack:         []hierarchyEntry{{roomID: roomID}},
+				processed:     make(set),
+				remoteRooms:   make(map[string]fs.MSC2946HierarchyRoom),
+			}
+		}
+
+		rooms := w.walk(page, limit)
+		if query.Get("from") == "" && len(rooms) == 0 {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You are not allowed to view this room."),
+			}
+		}
+		res := hierarchyResponse{
+			Rooms: rooms,
+		}
+		if len(page.stack) > 0 {
+			res.NextBatch = paginationCache.store(page)
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+}
+
+func federatedHierarchyHandler(
+	ctx context.Context, fedReq *gomatrixserverlib.FederationRequest, roomID string, suggestedOnly bool,
+	db Database, rsAPI roomserver.RoomserverInternalAPI, fsAPI fs.FederationSenderInternalAPI,
+	thisServer gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	w := hierarchyWalker{
+		walker: walker{
+			rootRoomID: roomID,
+			serverName: fedReq.Origin(),
+			thisServer: thisServer,
+			ctx:        ctx,
+			db:         db,
+			rsAPI:      rsAPI,
+			fsAPI:      fsAPI,
+		},
+		suggestedOnly: suggestedOnly,
+	}
+	room := w.localRoom(roomID)
+	if room == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown room"),
+		}
+	}
+	res := fs.MSC2946HierarchyResponse{
+		Room:                 *room,
+		Children:             []fs.MSC2946HierarchyRoom{},
+		InaccessibleChildren: []string{},
+	}
+	// Tell the other server what we know about the children too, so that it
+	// needn't ask again for each of them.
+	for _, child := range w.children(room) {
+		if childRoom := w.localRoom(child.roomID); childRoom != nil {
+			res.Children = append(res.Children, *childRoom)
+		} else if w.roomExists(child.roomID) {
+			res.InaccessibleChildren = append(res.InaccessibleChildren, child.roomID)
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// hierarchyWalker walks the space graph depth-first for /hierarchy. Unlike the
+// /spaces walk it only follows child events, from parents to children.
+type hierarchyWalker struct {
+	walker
+	suggestedOnly bool
+}
+
+// walk visits rooms from the top of the stack until either the stack is empty
+// or limit rooms have been returned, and leaves the rest on the stack.
+func (w *hierarchyWalker) walk(page *hierarchyPagination, limit int) []fs.MSC2946HierarchyRoom {
+	rooms := []fs.MSC2946HierarchyRoom{}
+	for len(page.stack) > 0 && len(rooms) < limit {
+		entry := page.stack[len(page.stack)-1]
+		page.stack = page.stack[:len(page.stack)-1]
+		// Space graphs can have cycles, so never visit the same room twice.
+		if page.processed[entry.roomID] {
+			continue
+		}
+		page.processed[entry.roomID] = true
+
+		room := w.localRoom(entry.roomID)
+		if room == nil {
+			room = w.remoteRoom(page, entry)
+		}
+		if room == nil {
+			continue
+		}
+		rooms = append(rooms, *room)
+
+		if page.maxDepth >= 0 && entry.depth >= page.maxDepth {
+			continue
+		}
+		// Push the children backwards so that the first child is visited next.
+		children := w.children(room)
+		for i := len(children) - 1; i >= 0; i-- {
+			if page.processed[children[i].roomID] {
+				continue
+			}
+			children[i].depth = entry.depth + 1
+			page.stack = append(page.stack, children[i])
+		}
+	}
+	return rooms
+}
+
+// localRoom returns the room if we're in it and the caller may see it, or nil.
+func (w *hierarchyWalker) localRoom(roomID string) *fs.MSC2946HierarchyRoom {
+	if !w.roomExists(roomID) || !w.authorised(roomID) {
+		return nil
+	}
+	pubRoom := w.publicRoomsChunk(roomID)
+	if pubRoom == nil {
+		return nil
+	}
+	events, err := w.db.References(w.ctx, roomID)
+	if err != nil {
+		util.GetLogger(w.ctx).WithError(err).WithField("room_id", roomID).Error("failed to extract references for room")
+		return nil
+	}
+	room := fs.MSC2946HierarchyRoom{
+		PublicRoom:    *pubRoom,
+		ChildrenState: []fs.MSC2946HierarchyStripped{},
+	}
+	if create := w.stateEvent(roomID, gomatrixserverlib.MRoomCreate, ""); create != nil {
+		room.RoomType = gjson.GetBytes(create.Content(), ConstCreateEventContentKeyStable).Str
+		if room.RoomType == "" {
+			// escape the `.`s so gjson doesn't think it's nested
+			room.RoomType = gjson.GetBytes(create.Content(), strings.ReplaceAll(ConstCreateEventContentKey, ".", `\.`)).Str
+		}
+	}
+	for _, ev := range events {
+		if ev.RoomID() != roomID || ev.StateKey() == nil {
+			continue // this is an event pointing at the room, not one from it
+		}
+		if ev.Type() != ConstSpaceChildEventType && ev.Type() != ConstSpaceChildEventTypeStable {
+			continue
+		}
+		// only return events that have a `via` key as per MSC1772
+		// else we'll incorrectly walk redacted events (as the link
+		// is in the state_key)
+		if len(gjson.GetBytes(ev.Content(), "via").Array()) == 0 {
+			continue
+		}
+		room.ChildrenState = append(room.ChildrenState, fs.MSC2946HierarchyStripped{
+			Content:        ev.Content(),
+			StateKey:       *ev.StateKey(),
+			Sender:         ev.Sender(),
+			Type:           ev.Type(),
+			OriginServerTS: ev.OriginServerTS(),
+		})
+	}
+	return &room
+}
+
+// remoteRoom returns the room from what another server has told us about it,
+// asking the servers in the vias if nobody has yet. Only client requests are
+// federated, so that a walk can't bounce between servers.
+func (w *hierarchyWalker) remoteRoom(page *hierarchyPagination, entry hierarchyEntry) *fs.MSC2946HierarchyRoom {
+	if room, ok := page.remoteRooms[entry.roomID]; ok {
+		delete(page.remoteRooms, entry.roomID)
+		return &room
+	}
+	if w.caller == nil {
+		return nil
+	}
+	vias := entry.vias
+	if len(vias) == 0 {
+		// This is the root room, so look for vias in any events pointing at it.
+		vias = w.viasTo(entry.roomID)
+	}
+	for _, via := range vias {
+		serverName := gomatrixserverlib.ServerName(via)
+		if serverName == w.thisServer {
+			continue
+		}
+		res, err := w.fsAPI.MSC2946Hierarchy(w.ctx, serverName, entry.roomID, w.suggestedOnly)
+		if err != nil {
+			util.GetLogger(w.ctx).WithError(err).Warnf("failed to call MSC2946Hierarchy on server %s", serverName)
+			continue
+		}
+		if res.Room.RoomID != entry.roomID {
+			util.GetLogger(w.ctx).Warnf("server %s returned the hierarchy for %s instead of %s", serverName, res.Room.RoomID, entry.roomID)
+			continue
+		}
+		for _, child := range res.Children {
+			if !page.processed[child.RoomID] {
+				page.remoteRooms[child.RoomID] = child
+			}
+		}
+		return &res.Room
+	}
+	return nil
+}
+
+// viasTo returns the servers in the vias of the child events pointing at the room.
+func (w *hierarchyWalker) viasTo(roomID string) []string {
+	events, err := w.db.References(w.ctx, roomID)
+	if err != nil {
+		util.GetLogger(w.ctx).WithError(err).WithField("room_id", roomID).Error("failed to extract references for room")
+		return nil
+	}
+	var vias []string
+	for _, ev := range events {
+		if ev.StateKeyEquals(roomID) {
+			for _, via := range gjson.GetBytes(ev.Content(), "via").Array() {
+				vias = append(vias, via.Str)
+			}
+		}
+	}
+	return vias
+}
+
+// children returns the rooms which the room's m.space.child events point to,
+// in the order they should be visited: suggested children first, then as per
+// MSC1772 those with an `order` lexicographically followed by the rest oldest
+// first.
+func (w *hierarchyWalker) children(room *fs.MSC2946HierarchyRoom) []hierarchyEntry {
+	var content struct {
+		Via       []string `json:"via"`
+		Order     string   `json:"order"`
+		Suggested bool     `json:"suggested"`
+	}
+	type child struct {
+		hierarchyEntry
+		ts        gomatrixserverlib.Timestamp
+		order     string
+		suggested bool
+	}
+	var children []child
+	for _, ev := range room.ChildrenState {
+		content.Via, content.Order, content.Suggested = nil, "", false
+		if err := json.Unmarshal(ev.Content, &content); err != nil || len(content.Via) == 0 {
+			continue // silently ignore corrupted state events
+		}
+		if w.suggestedOnly && !content.Suggested {
+			continue
+		}
+		if !validChildOrder(content.Order) {
+			content.Order = ""
+		}
+		children = append(children, child{
+			hierarchyEntry: hierarchyEntry{roomID: ev.StateKey, vias: content.Via},
+			ts:             ev.OriginServerTS,
+			order:          content.Order,
+			suggested:      content.Suggested,
+		})
+	}
+	sort.SliceStable(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+		if a.suggested != b.suggested {
+			return a.suggested
+		}
+		if (a.order != "") != (b.order != "") {
+			return a.order != ""
+		}
+		if a.order != b.order {
+			return a.order < b.order
+		}
+		if a.ts != b.ts {
+			return a.ts < b.ts
+		}
+		return a.roomID < b.roomID
+	})
+	entries := make([]hierarchyEntry, 0, len(children))
+	for _, c := range children {
+		entries = append(entries, c.hierarchyEntry)
+	}
+	return entries
+}
+
+// validChildOrder returns true if the `order` of an m.space.child event can be
+// used, i.e. it is at most 50 printable ASCII characters.
+func validChildOrder(order string) bool {
+	if order == "" || len(order) > 50 {
+		return false
+	}
+	for _, c := range order {
+		if c < 0x20 || c > 0x7E {
+			return false
+		}
+	}
+	return true
+}
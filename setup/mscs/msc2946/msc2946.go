@@ -42,6 +42,12 @@ const (
 	ConstCreateEventContentKey = "org.matrix.msc1772.type"
 	ConstSpaceChildEventType   = "org.matrix.msc1772.space.child"
 	ConstSpaceParentEventType  = "org.matrix.msc1772.space.parent"
+
+	// The stable identifiers from MSC1772, which are walked in addition to the
+	// unstable ones above.
+	ConstCreateEventContentKeyStable = "type"
+	ConstSpaceChildEventTypeStable   = "m.space.child"
+	ConstSpaceParentEventTypeStable  = "m.space.parent"
 )
 
 // Defaults sets the request defaults
@@ -74,6 +80,11 @@ func Enable(
 		httputil.MakeAuthAPI("spaces", userAPI, spacesHandler(db, rsAPI, fsAPI, base.Cfg.Global.ServerName)),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	paginationCache := &hierarchyPaginationCache{}
+	base.PublicClientAPIMux.Handle("/unstable/org.matrix.msc2946/rooms/{roomID}/hierarchy",
+		httputil.MakeAuthAPI("spaces_hierarchy", userAPI, hierarchyHandler(db, rsAPI, fsAPI, base.Cfg.Global.ServerName, paginationCache)),
+	).Methods(http.MethodGet, http.MethodOptions)
+
 	base.PublicFederationAPIMux.Handle("/unstable/org.matrix.msc2946/spaces/{roomID}", httputil.MakeExternalAPI(
 		"msc2946_fed_spaces", func(req *http.Request) util.JSONResponse {
 			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
@@ -91,6 +102,25 @@ func Enable(
 			return federatedSpacesHandler(req.Context(), fedReq, roomID, db, rsAPI, fsAPI, base.Cfg.Global.ServerName)
 		},
 	)).Methods(http.MethodPost, http.MethodOptions)
+
+	base.PublicFederationAPIMux.Handle("/unstable/org.matrix.msc2946/hierarchy/{roomID}", httputil.MakeExternalAPI(
+		"msc2946_fed_hierarchy", func(req *http.Request) util.JSONResponse {
+			fedReq, errResp := gomatrixserverlib.VerifyHTTPRequest(
+				req, time.Now(), base.Cfg.Global.ServerName, keyRing,
+			)
+			if fedReq == nil {
+				return errResp
+			}
+			params, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			suggestedOnly := req.URL.Query().Get("suggested_only") == "true"
+			return federatedHierarchyHandler(
+				req.Context(), fedReq, params["roomID"], suggestedOnly, db, rsAPI, fsAPI, base.Cfg.Global.ServerName,
+			)
+		},
+	)).Methods(http.MethodGet)
 	return nil
 }
 
@@ -560,9 +590,9 @@ func spaceTargetStripped(event *gomatrixserverlib.MSC2946StrippedEvent) string {
 		return "" // no-op
 	}
 	switch event.Type {
-	case ConstSpaceParentEventType:
+	case ConstSpaceParentEventType, ConstSpaceParentEventTypeStable:
 		return event.StateKey
-	case ConstSpaceChildEventType:
+	case ConstSpaceChildEventType, ConstSpaceChildEventTypeStable:
 		return event.StateKey
 	}
 	return ""
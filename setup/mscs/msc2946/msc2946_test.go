@@ -23,10 +23,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/gorilla/mux"
+	fs "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/hooks"
 	"github.com/matrix-org/dendrite/internal/httputil"
 	roomserver "github.com/matrix-org/dendrite/roomserver/api"
@@ -268,6 +270,141 @@ func TestMSC2946(t *testing.T) {
 			t.Errorf("got %d rooms, want %d", len(res.Rooms), len(allRooms)-1)
 		}
 	})
+	// R3 has been removed and R5 is only linked as a parent, which /hierarchy doesn't follow.
+	hierarchyRooms := []string{rootSpace, room1, room2, subSpaceS1, room4, subSpaceS2}
+	t.Run("hierarchy returns the children depth first", func(t *testing.T) {
+		res := getHierarchy(t, 200, "alice", rootSpace, url.Values{})
+		if got := hierarchyRoomIDs(res); !reflect.DeepEqual(got, hierarchyRooms) {
+			t.Errorf("got rooms %v, want %v", got, hierarchyRooms)
+		}
+		if res.NextBatch != "" {
+			t.Errorf("got next_batch %q for the last page", res.NextBatch)
+		}
+		if len(res.Rooms[0].ChildrenState) != 3 {
+			t.Errorf("got %d children_state for the root, want 3", len(res.Rooms[0].ChildrenState))
+		}
+		if res.Rooms[0].Name != "Root" {
+			t.Errorf("got root name %q", res.Rooms[0].Name)
+		}
+	})
+	t.Run("hierarchy paginates", func(t *testing.T) {
+		var got []string
+		query := url.Values{"limit": []string{"4"}}
+		for i := 0; i < len(hierarchyRooms); i++ {
+			res := getHierarchy(t, 200, "alice", rootSpace, query)
+			if len(res.Rooms) > 4 {
+				t.Fatalf("got %d rooms, want at most 4", len(res.Rooms))
+			}
+			got = append(got, hierarchyRoomIDs(res)...)
+			if res.NextBatch == "" {
+				break
+			}
+			query.Set("from", res.NextBatch)
+		}
+		if !reflect.DeepEqual(got, hierarchyRooms) {
+			t.Errorf("got rooms %v, want %v", got, hierarchyRooms)
+		}
+		// tokens are single use
+		getHierarchy(t, 400, "alice", rootSpace, query)
+	})
+	t.Run("hierarchy honours max_depth", func(t *testing.T) {
+		res := getHierarchy(t, 200, "alice", rootSpace, url.Values{"max_depth": []string{"1"}})
+		want := []string{rootSpace, room1, room2, subSpaceS1}
+		if got := hierarchyRoomIDs(res); !reflect.DeepEqual(got, want) {
+			t.Errorf("got rooms %v, want %v", got, want)
+		}
+	})
+	t.Run("hierarchy puts suggested rooms first and copes with cycles", func(t *testing.T) {
+		suggestR2 := mustCreateEvent(t, fledglingEvent{
+			RoomID:   rootSpace,
+			Sender:   alice,
+			Type:     msc2946.ConstSpaceChildEventTypeStable,
+			StateKey: &room2,
+			Content: map[string]interface{}{
+				"via":       []string{"localhost"},
+				"suggested": true,
+			},
+		})
+		s2ToRoot := mustCreateEvent(t, fledglingEvent{
+			RoomID:   subSpaceS2,
+			Sender:   alice,
+			Type:     msc2946.ConstSpaceChildEventTypeStable,
+			StateKey: &rootSpace,
+			Content: map[string]interface{}{
+				"via": []string{"localhost"},
+			},
+		})
+		for _, ev := range []*gomatrixserverlib.HeaderedEvent{suggestR2, s2ToRoot} {
+			nopRsAPI.events[ev.EventID()] = ev
+			hooks.Run(hooks.KindNewEventPersisted, ev)
+		}
+		defer func() {
+			// remove the cycle again, as the database outlives the test
+			rmS2ToRoot := mustCreateEvent(t, fledglingEvent{
+				RoomID:   subSpaceS2,
+				Sender:   alice,
+				Type:     msc2946.ConstSpaceChildEventTypeStable,
+				StateKey: &rootSpace,
+				Content:  map[string]interface{}{},
+			})
+			hooks.Run(hooks.KindNewEventPersisted, rmS2ToRoot)
+		}()
+
+		res := getHierarchy(t, 200, "alice", rootSpace, url.Values{})
+		want := []string{rootSpace, room2, room1, subSpaceS1, room4, subSpaceS2}
+		if got := hierarchyRoomIDs(res); !reflect.DeepEqual(got, want) {
+			t.Errorf("got rooms %v, want %v", got, want)
+		}
+		res = getHierarchy(t, 200, "alice", rootSpace, url.Values{"suggested_only": []string{"true"}})
+		want = []string{rootSpace, room2}
+		if got := hierarchyRoomIDs(res); !reflect.DeepEqual(got, want) {
+			t.Errorf("suggested_only: got rooms %v, want %v", got, want)
+		}
+	})
+}
+
+type hierarchyResponse struct {
+	Rooms     []fs.MSC2946HierarchyRoom `json:"rooms"`
+	NextBatch string                    `json:"next_batch"`
+}
+
+func hierarchyRoomIDs(res *hierarchyResponse) []string {
+	roomIDs := []string{}
+	for _, room := range res.Rooms {
+		roomIDs = append(roomIDs, room.RoomID)
+	}
+	return roomIDs
+}
+
+func getHierarchy(t *testing.T, expectCode int, accessToken, roomID string, query url.Values) *hierarchyResponse {
+	t.Helper()
+	httpReq, err := http.NewRequest(
+		"GET", "http://localhost:8010/_matrix/client/unstable/org.matrix.msc2946/rooms/"+url.PathEscape(roomID)+"/hierarchy?"+query.Encode(),
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("failed to prepare request: %s", err)
+	}
+	httpReq.Header.Set("Authorization", "Bearer "+accessToken)
+	res, err := client.Do(httpReq)
+	if err != nil {
+		t.Fatalf("failed to do request: %s", err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body: %s", err)
+	}
+	if res.StatusCode != expectCode {
+		t.Fatalf("wrong response code, got %d want %d - body: %s", res.StatusCode, expectCode, string(body))
+	}
+	var result hierarchyResponse
+	if res.StatusCode == 200 {
+		if err := json.Unmarshal(body, &result); err != nil {
+			t.Fatalf("response 200 OK but failed to deserialise JSON : %s\nbody: %s", err, string(body))
+		}
+	}
+	return &result
 }
 
 func newReq(t *testing.T, jsonBody map[string]interface{}) *gomatrixserverlib.MSC2946SpacesRequest {
@@ -355,6 +492,9 @@ func (u *testUserAPI) PerformPasswordUpdate(ctx context.Context, req *userapi.Pe
 func (u *testUserAPI) PerformDeviceCreation(ctx context.Context, req *userapi.PerformDeviceCreationRequest, res *userapi.PerformDeviceCreationResponse) error {
 	return nil
 }
+func (u *testUserAPI) PerformTokenRefresh(ctx context.Context, req *userapi.PerformTokenRefreshRequest, res *userapi.PerformTokenRefreshResponse) error {
+	return nil
+}
 func (u *testUserAPI) PerformDeviceDeletion(ctx context.Context, req *userapi.PerformDeviceDeletionRequest, res *userapi.PerformDeviceDeletionResponse) error {
 	return nil
 }
@@ -364,12 +504,54 @@ func (u *testUserAPI) PerformDeviceUpdate(ctx context.Context, req *userapi.Perf
 func (u *testUserAPI) PerformLastSeenUpdate(ctx context.Context, req *userapi.PerformLastSeenUpdateRequest, res *userapi.PerformLastSeenUpdateResponse) error {
 	return nil
 }
+func (u *testUserAPI) PerformPresenceUpdate(ctx context.Context, req *userapi.PerformPresenceUpdateRequest, res *userapi.PerformPresenceUpdateResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryPresence(ctx context.Context, req *userapi.QueryPresenceRequest, res *userapi.QueryPresenceResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformKeyBackup(ctx context.Context, req *userapi.PerformKeyBackupRequest, res *userapi.PerformKeyBackupResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryKeyBackup(ctx context.Context, req *userapi.QueryKeyBackupRequest, res *userapi.QueryKeyBackupResponse) error {
+	return nil
+}
 func (u *testUserAPI) PerformAccountDeactivation(ctx context.Context, req *userapi.PerformAccountDeactivationRequest, res *userapi.PerformAccountDeactivationResponse) error {
 	return nil
 }
 func (u *testUserAPI) PerformOpenIDTokenCreation(ctx context.Context, req *userapi.PerformOpenIDTokenCreationRequest, res *userapi.PerformOpenIDTokenCreationResponse) error {
 	return nil
 }
+func (u *testUserAPI) PerformLoginTokenCreation(ctx context.Context, req *userapi.PerformLoginTokenCreationRequest, res *userapi.PerformLoginTokenCreationResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformLoginTokenConsumption(ctx context.Context, req *userapi.PerformLoginTokenConsumptionRequest, res *userapi.PerformLoginTokenConsumptionResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformEmailSessionCreation(ctx context.Context, req *userapi.PerformEmailSessionCreationRequest, res *userapi.PerformEmailSessionCreationResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformEmailSessionValidation(ctx context.Context, req *userapi.PerformEmailSessionValidationRequest, res *userapi.PerformEmailSessionValidationResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformEmailSessionConsumption(ctx context.Context, req *userapi.PerformEmailSessionConsumptionRequest, res *userapi.PerformEmailSessionConsumptionResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryPushRules(ctx context.Context, req *userapi.QueryPushRulesRequest, res *userapi.QueryPushRulesResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformPushRulesPut(ctx context.Context, req *userapi.PerformPushRulesPutRequest, res *userapi.PerformPushRulesPutResponse) error {
+	return nil
+}
+func (u *testUserAPI) QueryPushers(ctx context.Context, req *userapi.QueryPushersRequest, res *userapi.QueryPushersResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformPusherSet(ctx context.Context, req *userapi.PerformPusherSetRequest, res *userapi.PerformPusherSetResponse) error {
+	return nil
+}
+func (u *testUserAPI) PerformPushNotification(ctx context.Context, req *userapi.PerformPushNotificationRequest, res *userapi.PerformPushNotificationResponse) error {
+	return nil
+}
 func (u *testUserAPI) QueryProfile(ctx context.Context, req *userapi.QueryProfileRequest, res *userapi.QueryProfileResponse) error {
 	return nil
 }
@@ -385,6 +567,9 @@ func (u *testUserAPI) QueryAccessToken(ctx context.Context, req *userapi.QueryAc
 func (u *testUserAPI) QueryDevices(ctx context.Context, req *userapi.QueryDevicesRequest, res *userapi.QueryDevicesResponse) error {
 	return nil
 }
+func (u *testUserAPI) QueryDeviceConnections(ctx context.Context, req *userapi.QueryDeviceConnectionsRequest, res *userapi.QueryDeviceConnectionsResponse) error {
+	return nil
+}
 func (u *testUserAPI) QueryAccountData(ctx context.Context, req *userapi.QueryAccountDataRequest, res *userapi.QueryAccountDataResponse) error {
 	return nil
 }
@@ -26,8 +26,10 @@ import (
 
 var (
 	relTypes = map[string]int{
-		ConstSpaceChildEventType:  1,
-		ConstSpaceParentEventType: 2,
+		ConstSpaceChildEventType:        1,
+		ConstSpaceParentEventType:       2,
+		ConstSpaceChildEventTypeStable:  1,
+		ConstSpaceParentEventTypeStable: 2,
 	}
 )
 
@@ -173,9 +175,9 @@ func SpaceTarget(he *gomatrixserverlib.HeaderedEvent) string {
 		return "" // no-op
 	}
 	switch he.Type() {
-	case ConstSpaceParentEventType:
+	case ConstSpaceParentEventType, ConstSpaceParentEventTypeStable:
 		return *he.StateKey()
-	case ConstSpaceChildEventType:
+	case ConstSpaceChildEventType, ConstSpaceChildEventTypeStable:
 		return *he.StateKey()
 	}
 	return ""
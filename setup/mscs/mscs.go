@@ -44,6 +44,7 @@ func EnableMSC(base *setup.BaseDendrite, monolith *setup.Monolith, msc string) e
 		return msc2946.Enable(base, monolith.RoomserverAPI, monolith.UserAPI, monolith.FederationSenderAPI, monolith.KeyRing)
 	case "msc2444": // enabled inside federationapi
 	case "msc2753": // enabled inside clientapi
+	case "msc3575": // enabled inside syncapi
 	default:
 		return fmt.Errorf("EnableMSC: unknown msc '%s'", msc)
 	}
@@ -0,0 +1,79 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package setup
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/util"
+)
+
+type wellKnownServerResponse struct {
+	Server string `json:"m.server"`
+}
+
+type wellKnownBaseURL struct {
+	BaseURL string `json:"base_url"`
+}
+
+type wellKnownAuthentication struct {
+	Issuer string `json:"issuer"`
+}
+
+type wellKnownClientResponse struct {
+	Homeserver     wellKnownBaseURL         `json:"m.homeserver"`
+	IdentityServer *wellKnownBaseURL        `json:"m.identity_server,omitempty"`
+	Authentication *wellKnownAuthentication `json:"m.authentication,omitempty"`
+}
+
+// addWellKnownRoutes adds the /.well-known/matrix endpoints which are
+// configured to the router, returning false if there aren't any.
+func addWellKnownRoutes(router *mux.Router, cfg *config.Dendrite) bool {
+	added := false
+	if cfg.Global.WellKnownServerName != "" && !cfg.Global.DisableFederation {
+		res := wellKnownServerResponse{
+			Server: cfg.Global.WellKnownServerName,
+		}
+		router.Handle("/server",
+			httputil.MakeExternalAPI("wellknown_server", func(req *http.Request) util.JSONResponse {
+				return util.JSONResponse{Code: http.StatusOK, JSON: res}
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		added = true
+	}
+	if cfg.Global.WellKnownClientName != "" {
+		res := wellKnownClientResponse{
+			Homeserver: wellKnownBaseURL{cfg.Global.WellKnownClientName},
+		}
+		if cfg.Global.WellKnownIdentityServer != "" {
+			res.IdentityServer = &wellKnownBaseURL{cfg.Global.WellKnownIdentityServer}
+		}
+		if cfg.ClientAPI.SSO.Enabled {
+			res.Authentication = &wellKnownAuthentication{cfg.ClientAPI.SSO.OIDC.Issuer}
+		}
+		// MakeExternalAPI sets the CORS headers, which web clients need in
+		// order to read this from the server name's domain.
+		router.Handle("/client",
+			httputil.MakeExternalAPI("wellknown_client", func(req *http.Request) util.JSONResponse {
+				return util.JSONResponse{Code: http.StatusOK, JSON: res}
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		added = true
+	}
+	return added
+}
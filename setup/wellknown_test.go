@@ -0,0 +1,65 @@
+package setup
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/httputil"
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+func TestWellKnownRoutes(t *testing.T) {
+	cfg := &config.Dendrite{}
+	cfg.Defaults()
+	router := mux.NewRouter().PathPrefix(httputil.PublicWellKnownPathPrefix).Subrouter()
+	if addWellKnownRoutes(router, cfg) {
+		t.Errorf("added well-known routes when none are configured")
+	}
+
+	cfg.Global.WellKnownServerName = "matrix.example.com:8448"
+	cfg.Global.WellKnownClientName = "https://matrix.example.com"
+	cfg.ClientAPI.SSO.Enabled = true
+	cfg.ClientAPI.SSO.OIDC.Issuer = "https://accounts.example.com"
+	router = mux.NewRouter().PathPrefix(httputil.PublicWellKnownPathPrefix).Subrouter()
+	if !addWellKnownRoutes(router, cfg) {
+		t.Fatalf("didn't add the configured well-known routes")
+	}
+
+	get := func(path string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got HTTP %d, want 200", path, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: got Content-Type %q, want application/json", path, ct)
+		}
+		var body map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: failed to unmarshal response: %s", path, err)
+		}
+		return w, body
+	}
+
+	_, body := get("/.well-known/matrix/server")
+	if !reflect.DeepEqual(body, map[string]interface{}{"m.server": "matrix.example.com:8448"}) {
+		t.Errorf("got server response %v", body)
+	}
+
+	w, body := get("/.well-known/matrix/client")
+	want := map[string]interface{}{
+		"m.homeserver":     map[string]interface{}{"base_url": "https://matrix.example.com"},
+		"m.authentication": map[string]interface{}{"issuer": "https://accounts.example.com"},
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Errorf("got client response %v, want %v", body, want)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("client response is missing CORS headers")
+	}
+}
@@ -187,7 +187,11 @@ func (s *ServerKeyAPI) handleDatabaseKeys(
 		// in that case. If the key isn't valid right now, then by
 		// leaving it in the 'requests' map, we'll try to update the
 		// key using the fetchers in handleFetcherKeys.
-		if res.WasValidAt(now, true) {
+		//
+		// Keys which the server has marked as expired will never be
+		// valid again, so there's no point in fetching them again.
+		// They can still verify events sent before they expired.
+		if res.WasValidAt(now, true) || res.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired {
 			delete(requests, req)
 		}
 	}
@@ -243,8 +247,14 @@ func (s *ServerKeyAPI) handleFetcherKeys(
 		// else, we can try verifying against this key.
 		results[req] = res
 
-		// Remove it from the request list so we won't re-fetch it.
-		delete(requests, req)
+		// Remove it from the request list so we won't re-fetch it,
+		// unless the key wasn't valid at the time it was requested for,
+		// in which case the next fetcher might have a newer copy. This
+		// is the case when a perspective server has an out-of-date key
+		// which the server itself can give us.
+		if res.WasValidAt(requests[req], true) || res.ExpiredTS != gomatrixserverlib.PublicKeyNotExpired {
+			delete(requests, req)
+		}
 	}
 
 	// Store the keys from our store map.
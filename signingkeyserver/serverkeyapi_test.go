@@ -17,6 +17,7 @@ import (
 	"github.com/matrix-org/dendrite/internal/caching"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/signingkeyserver/api"
+	"github.com/matrix-org/dendrite/signingkeyserver/internal"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -317,3 +318,136 @@ func TestRenewalBehaviour(t *testing.T) {
 	}
 	t.Log(res)
 }
+
+func TestExpiredKeyBehaviour(t *testing.T) {
+	// Server A knows about a key which server D stopped using an hour
+	// ago. Events which server D signed with it before then should still
+	// verify, but anything signed with it since should not.
+
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("can't generate identity key: %s", err)
+	}
+	req := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: "d.com",
+		KeyID:      "ed25519:old",
+	}
+	if err = serverA.api.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+		req: {
+			VerifyKey: gomatrixserverlib.VerifyKey{
+				Key: gomatrixserverlib.Base64Bytes(priv.Public().(ed25519.PublicKey)),
+			},
+			ExpiredTS:    gomatrixserverlib.AsTimestamp(time.Now().Add(-time.Hour)),
+			ValidUntilTS: gomatrixserverlib.PublicKeyNotValid,
+		},
+	}); err != nil {
+		t.Fatalf("server A failed to store server D key: %s", err)
+	}
+	message, err := gomatrixserverlib.SignJSON(string(req.ServerName), req.KeyID, priv, []byte(`{"hello":"world"}`))
+	if err != nil {
+		t.Fatalf("can't sign message: %s", err)
+	}
+
+	for _, tc := range []struct {
+		at    time.Duration
+		valid bool
+	}{
+		{-time.Hour * 2, true},
+		{-time.Minute * 30, false},
+	} {
+		results, err := serverA.api.KeyRing().VerifyJSONs(context.Background(), []gomatrixserverlib.VerifyJSONRequest{{
+			ServerName:             req.ServerName,
+			Message:                message,
+			AtTS:                   gomatrixserverlib.AsTimestamp(time.Now().Add(tc.at)),
+			StrictValidityChecking: true,
+		}})
+		if err != nil {
+			t.Fatalf("VerifyJSONs failed: %s", err)
+		}
+		if valid := results[0].Error == nil; valid != tc.valid {
+			t.Errorf("message signed %s ago: got valid %v (%v), want %v", -tc.at, valid, results[0].Error, tc.valid)
+		}
+	}
+}
+
+// testKeyFetcher is a key fetcher which always returns the same key, or
+// nothing at all if it doesn't have one.
+type testKeyFetcher struct {
+	name  string
+	key   *gomatrixserverlib.PublicKeyLookupResult
+	calls int
+}
+
+func (f *testKeyFetcher) FetcherName() string { return f.name }
+
+func (f *testKeyFetcher) FetchKeys(
+	_ context.Context, requests map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp,
+) (map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult, error) {
+	f.calls++
+	results := map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{}
+	if f.key != nil {
+		for req := range requests {
+			results[req] = *f.key
+		}
+	}
+	return results, nil
+}
+
+// testKeyDatabase is a key database which stores nothing.
+type testKeyDatabase struct{ testKeyFetcher }
+
+func (d *testKeyDatabase) StoreKeys(
+	_ context.Context, _ map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult,
+) error {
+	return nil
+}
+
+func TestPerspectiveFallbackBehaviour(t *testing.T) {
+	// Server A asks a perspective server for server E's key before asking
+	// server E itself. Server E is only asked if the perspective server
+	// doesn't have a copy of the key which is valid when we need it.
+
+	req := gomatrixserverlib.PublicKeyLookupRequest{
+		ServerName: "e.com",
+		KeyID:      serverKeyID,
+	}
+	key := func(validFor time.Duration) *gomatrixserverlib.PublicKeyLookupResult {
+		return &gomatrixserverlib.PublicKeyLookupResult{
+			VerifyKey:    gomatrixserverlib.VerifyKey{Key: gomatrixserverlib.Base64Bytes("key")},
+			ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+			ValidUntilTS: gomatrixserverlib.AsTimestamp(time.Now().Add(validFor)),
+		}
+	}
+
+	for _, tc := range []struct {
+		name            string
+		perspectiveKey  *gomatrixserverlib.PublicKeyLookupResult
+		wantDirectCalls int
+	}{
+		{"perspective has a valid key", key(time.Hour), 0},
+		{"perspective has an out-of-date key", key(-time.Hour), 1},
+		{"perspective has no key", nil, 1},
+	} {
+		perspective := &testKeyFetcher{name: "perspective", key: tc.perspectiveKey}
+		direct := &testKeyFetcher{name: "direct", key: key(time.Hour * 2)}
+		skAPI := &internal.ServerKeyAPI{
+			ServerName: serverA.name,
+			OurKeyRing: gomatrixserverlib.KeyRing{
+				KeyDatabase: &testKeyDatabase{testKeyFetcher{name: "database"}},
+				KeyFetchers: []gomatrixserverlib.KeyFetcher{perspective, direct},
+			},
+		}
+		res, err := skAPI.FetchKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.Timestamp{
+			req: gomatrixserverlib.AsTimestamp(time.Now()),
+		})
+		if err != nil {
+			t.Fatalf("%s: FetchKeys failed: %s", tc.name, err)
+		}
+		if perspective.calls != 1 || direct.calls != tc.wantDirectCalls {
+			t.Errorf("%s: asked the perspective %d time(s) and server E %d time(s), want 1 and %d", tc.name, perspective.calls, direct.calls, tc.wantDirectCalls)
+		}
+		if !res[req].WasValidAt(gomatrixserverlib.AsTimestamp(time.Now()), true) {
+			t.Errorf("%s: didn't get a valid key for server E", tc.name)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package signingkeyserver
 
 import (
 	"crypto/ed25519"
-	"encoding/base64"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/caching"
@@ -72,7 +71,6 @@ func NewInternalAPI(
 		defer addDirectFetcher()
 	}
 
-	var b64e = base64.StdEncoding.WithPadding(base64.NoPadding)
 	for _, ps := range cfg.KeyPerspectives {
 		perspective := &gomatrixserverlib.PerspectiveKeyFetcher{
 			PerspectiveServerName: ps.ServerName,
@@ -81,7 +79,7 @@ func NewInternalAPI(
 		}
 
 		for _, key := range ps.Keys {
-			rawkey, err := b64e.DecodeString(key.PublicKey)
+			rawkey, err := key.PublicKeyBytes()
 			if err != nil {
 				logrus.WithError(err).WithFields(logrus.Fields{
 					"server_name": ps.ServerName,
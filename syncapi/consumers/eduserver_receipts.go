@@ -95,9 +95,32 @@ func (s *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) erro
 		sentry.CaptureException(err)
 		return err
 	}
+	if output.Type == "m.read" || output.Type == "m.read.private" {
+		s.clearNotifications(context.TODO(), output.UserID, output.RoomID, output.EventID)
+	}
+	if streamPos == 0 {
+		// The same event was marked as read again, so there's nothing new
+		// to send to clients.
+		return nil
+	}
 
 	s.stream.Advance(streamPos)
 	s.notifier.OnNewReceipt(output.RoomID, types.StreamingToken{ReceiptPosition: streamPos})
 
 	return nil
 }
+
+// clearNotifications removes the user's notifications in the room for events
+// up to the one which they have read.
+func (s *OutputReceiptEventConsumer) clearNotifications(ctx context.Context, userID, roomID, eventID string) {
+	_, pos, err := s.db.PositionInTopology(ctx, eventID)
+	if err != nil {
+		// We might not have the event, in which case there's nothing that
+		// we can clear.
+		log.WithError(err).WithField("event_id", eventID).Debug("failed to get the position of the read event")
+		return
+	}
+	if err = s.db.ClearNotifications(ctx, userID, roomID, pos); err != nil {
+		log.WithError(err).Error("failed to clear notifications")
+	}
+}
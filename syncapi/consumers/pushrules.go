@@ -0,0 +1,179 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// evaluatePushRules runs the push rules of every local member of the room
+// against the new event, and records a notification for those whose rules
+// say that they should be notified, which is also sent to their pushers. Failures are logged rather than
+// returned, as a missed notification shouldn't stop the event being synced.
+func (s *OutputRoomEventConsumer) evaluatePushRules(
+	ctx context.Context, ev *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
+) {
+	logger := log.WithFields(log.Fields{
+		"event_id": ev.EventID(),
+		"room_id":  ev.RoomID(),
+	})
+
+	// Sending an event into a room implies that the sender has read the
+	// room up to that point.
+	if _, domain, err := gomatrixserverlib.SplitID('@', ev.Sender()); err == nil && domain == s.cfg.Matrix.ServerName {
+		if err = s.db.ClearNotifications(ctx, ev.Sender(), ev.RoomID(), pos); err != nil {
+			logger.WithError(err).Error("failed to clear the sender's notifications")
+		}
+	}
+
+	members, err := s.db.CurrentState(ctx, ev.RoomID(), &gomatrixserverlib.StateFilter{
+		Types: []string{gomatrixserverlib.MRoomMember},
+		Limit: math.MaxInt32,
+	}, nil)
+	if err != nil {
+		logger.WithError(err).Error("failed to get the room members for push rules")
+		return
+	}
+	ec := &pushEvaluationContext{
+		displayNames: make(map[string]string, len(members)),
+	}
+	for _, member := range members {
+		if member.StateKey() == nil {
+			continue
+		}
+		var content gomatrixserverlib.MemberContent
+		if err = json.Unmarshal(member.Content(), &content); err != nil {
+			continue
+		}
+		if content.Membership == gomatrixserverlib.Join {
+			ec.displayNames[*member.StateKey()] = content.DisplayName
+		}
+	}
+
+	powerLevelsEvent, err := s.db.GetStateEvent(ctx, ev.RoomID(), gomatrixserverlib.MRoomPowerLevels, "")
+	if err != nil {
+		logger.WithError(err).Error("failed to get the power levels for push rules")
+		return
+	}
+	if powerLevelsEvent != nil {
+		if ec.powerLevels, err = gomatrixserverlib.NewPowerLevelContentFromEvent(powerLevelsEvent.Event); err != nil {
+			logger.WithError(err).Error("failed to parse the power levels for push rules")
+			return
+		}
+	} else {
+		ec.powerLevels.Defaults()
+	}
+
+	for userID := range ec.displayNames {
+		if userID == ev.Sender() {
+			continue
+		}
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != s.cfg.Matrix.ServerName {
+			continue
+		}
+		actions, err := s.evaluatePushRulesForUser(ctx, ec, userID, ev)
+		if err != nil {
+			logger.WithError(err).WithField("user_id", userID).Error("failed to evaluate push rules")
+			continue
+		}
+		notify, highlight := pushrules.NotifyAndHighlight(actions)
+		if !notify {
+			continue
+		}
+		if err = s.db.StoreNotification(ctx, userID, ev.RoomID(), pos, highlight); err != nil {
+			logger.WithError(err).WithField("user_id", userID).Error("failed to store notification")
+			continue
+		}
+		if err = s.pushNotification(ctx, userID, ev, ec.displayNames[ev.Sender()], actions); err != nil {
+			logger.WithError(err).WithField("user_id", userID).Error("failed to push notification")
+		}
+	}
+}
+
+// pushNotification asks the user API to deliver the notification to the
+// pushers of the user, along with their total unread count.
+func (s *OutputRoomEventConsumer) pushNotification(
+	ctx context.Context, userID string, ev *gomatrixserverlib.HeaderedEvent,
+	senderDisplayName string, actions []*pushrules.Action,
+) error {
+	counts, err := s.db.NotificationCounts(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("s.db.NotificationCounts: %w", err)
+	}
+	unread := 0
+	for _, c := range counts {
+		unread += c.NotificationCount
+	}
+	if err = s.userAPI.PerformPushNotification(ctx, &userapi.PerformPushNotificationRequest{
+		UserID:            userID,
+		Event:             ev,
+		SenderDisplayName: senderDisplayName,
+		Actions:           actions,
+		UnreadCount:       unread,
+	}, &userapi.PerformPushNotificationResponse{}); err != nil {
+		return fmt.Errorf("s.userAPI.PerformPushNotification: %w", err)
+	}
+	return nil
+}
+
+// evaluatePushRulesForUser returns the actions of the user's push rule which
+// matches the event, or nil if none do.
+func (s *OutputRoomEventConsumer) evaluatePushRulesForUser(
+	ctx context.Context, ec *pushEvaluationContext, userID string, ev *gomatrixserverlib.HeaderedEvent,
+) ([]*pushrules.Action, error) {
+	var res userapi.QueryPushRulesResponse
+	if err := s.userAPI.QueryPushRules(ctx, &userapi.QueryPushRulesRequest{UserID: userID}, &res); err != nil {
+		return nil, fmt.Errorf("s.userAPI.QueryPushRules: %w", err)
+	}
+	ec.userID = userID
+	rule, err := pushrules.NewRuleSetEvaluator(ec, &res.RuleSets.Global).MatchEvent(ev.Event)
+	if err != nil {
+		return nil, fmt.Errorf("MatchEvent: %w", err)
+	}
+	if rule == nil {
+		return nil, nil
+	}
+	return rule.Actions, nil
+}
+
+// pushEvaluationContext gives the push rule evaluator the state of the room
+// from the point of view of one of its members.
+type pushEvaluationContext struct {
+	userID       string
+	displayNames map[string]string // joined user ID -> display name
+	powerLevels  gomatrixserverlib.PowerLevelContent
+}
+
+func (ec *pushEvaluationContext) UserDisplayName() string {
+	return ec.displayNames[ec.userID]
+}
+
+func (ec *pushEvaluationContext) RoomMemberCount() (int, error) {
+	return len(ec.displayNames), nil
+}
+
+func (ec *pushEvaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	return ec.powerLevels.UserLevel(userID) >= ec.powerLevels.NotificationLevel(levelKey), nil
+}
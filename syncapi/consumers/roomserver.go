@@ -28,6 +28,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/notifier"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	log "github.com/sirupsen/logrus"
 )
@@ -36,6 +37,7 @@ import (
 type OutputRoomEventConsumer struct {
 	cfg          *config.SyncAPI
 	rsAPI        api.RoomserverInternalAPI
+	userAPI      userapi.UserInternalAPI
 	rsConsumer   *internal.ContinualConsumer
 	db           storage.Database
 	pduStream    types.StreamProvider
@@ -53,6 +55,7 @@ func NewOutputRoomEventConsumer(
 	pduStream types.StreamProvider,
 	inviteStream types.StreamProvider,
 	rsAPI api.RoomserverInternalAPI,
+	userAPI userapi.UserInternalAPI,
 ) *OutputRoomEventConsumer {
 
 	consumer := internal.ContinualConsumer{
@@ -70,6 +73,7 @@ func NewOutputRoomEventConsumer(
 		pduStream:    pduStream,
 		inviteStream: inviteStream,
 		rsAPI:        rsAPI,
+		userAPI:      userAPI,
 	}
 	consumer.ProcessMessage = s.onMessage
 
@@ -118,6 +122,8 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return s.onRetirePeek(context.TODO(), *output.RetirePeek)
 	case api.OutputTypeRedactedEvent:
 		return s.onRedactEvent(context.TODO(), *output.RedactedEvent)
+	case api.OutputTypePurgedEvents:
+		return s.onPurgedEvents(context.TODO(), *output.PurgedEvents)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -141,6 +147,16 @@ func (s *OutputRoomEventConsumer) onRedactEvent(
 	})
 }
 
+func (s *OutputRoomEventConsumer) onPurgedEvents(
+	ctx context.Context, msg api.OutputPurgedEvents,
+) error {
+	if err := s.db.PurgeEvents(ctx, msg.EventIDs); err != nil {
+		log.WithError(err).WithField("room_id", msg.RoomID).Error("PurgeEvents error'd")
+		return err
+	}
+	return nil
+}
+
 func (s *OutputRoomEventConsumer) onNewRoomEvent(
 	ctx context.Context, msg api.OutputNewRoomEvent,
 ) error {
@@ -189,6 +205,8 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		return nil
 	}
 
+	s.evaluatePushRules(ctx, ev, pduPos)
+
 	if pduPos, err = s.notifyJoinedPeeks(ctx, ev, pduPos); err != nil {
 		log.WithError(err).Errorf("Failed to notifyJoinedPeeks for PDU pos %d", pduPos)
 		sentry.CaptureException(err)
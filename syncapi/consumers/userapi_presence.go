@@ -0,0 +1,97 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/getsentry/sentry-go"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/process"
+	"github.com/matrix-org/dendrite/syncapi/notifier"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/dendrite/userapi/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputPresenceEventConsumer consumes presence updates that originated in
+// the user API.
+type OutputPresenceEventConsumer struct {
+	presenceConsumer *internal.ContinualConsumer
+	db               storage.Database
+	stream           types.StreamProvider
+	notifier         *notifier.Notifier
+}
+
+// NewOutputPresenceEventConsumer creates a new OutputPresenceEventConsumer.
+// Call Start() to begin consuming from the user API.
+func NewOutputPresenceEventConsumer(
+	process *process.ProcessContext,
+	cfg *config.SyncAPI,
+	kafkaConsumer sarama.Consumer,
+	store storage.Database,
+	notifier *notifier.Notifier,
+	stream types.StreamProvider,
+) *OutputPresenceEventConsumer {
+
+	consumer := internal.ContinualConsumer{
+		Process:        process,
+		ComponentName:  "syncapi/userapi/presence",
+		Topic:          cfg.Matrix.Kafka.TopicFor(config.TopicOutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputPresenceEventConsumer{
+		presenceConsumer: &consumer,
+		db:               store,
+		notifier:         notifier,
+		stream:           stream,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the user API
+func (s *OutputPresenceEventConsumer) Start() error {
+	return s.presenceConsumer.Start()
+}
+
+func (s *OutputPresenceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.Presence
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("user API presence output log: message parse failure")
+		sentry.CaptureException(err)
+		return nil
+	}
+
+	streamPos, err := s.db.StorePresence(context.TODO(), &output)
+	if err != nil {
+		sentry.CaptureException(err)
+		return err
+	}
+
+	s.stream.Advance(streamPos)
+	s.notifier.OnNewPresence(types.StreamingToken{PresencePosition: streamPos}, output.UserID)
+
+	return nil
+}
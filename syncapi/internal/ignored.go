@@ -0,0 +1,47 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+// IgnoredUsers returns the users which the user has ignored, from their
+// m.ignored_user_list account data.
+func IgnoredUsers(ctx context.Context, userAPI userapi.UserInternalAPI, userID string) (*types.IgnoredUsers, error) {
+	var res userapi.QueryAccountDataResponse
+	if err := userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: "m.ignored_user_list",
+	}, &res); err != nil {
+		return nil, fmt.Errorf("userAPI.QueryAccountData: %w", err)
+	}
+	ignored := &types.IgnoredUsers{}
+	data, ok := res.GlobalAccountData["m.ignored_user_list"]
+	if !ok {
+		return ignored, nil
+	}
+	if err := json.Unmarshal(data, ignored); err != nil {
+		// Clients can put anything in account data, so don't fail the
+		// request if the list is malformed.
+		return &types.IgnoredUsers{}, nil
+	}
+	return ignored, nil
+}
@@ -40,6 +40,14 @@ func DeviceOTKCounts(ctx context.Context, keyAPI keyapi.KeyInternalAPI, userID,
 		return queryRes.Error
 	}
 	res.DeviceListsOTKCount = queryRes.Count.KeyCount
+	if res.DeviceListsOTKCount == nil {
+		res.DeviceListsOTKCount = make(map[string]int)
+	}
+	// Clients upload more keys when they run low, so tell them when there are
+	// none left rather than leaving the count out.
+	if _, ok := res.DeviceListsOTKCount["signed_curve25519"]; !ok {
+		res.DeviceListsOTKCount["signed_curve25519"] = 0
+	}
 	return nil
 }
 
@@ -0,0 +1,167 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	lru "github.com/hashicorp/golang-lru"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// LazyLoadCacheMaxEntries is the number of device and room pairs for which
+// the sent membership events are remembered.
+const LazyLoadCacheMaxEntries = 10000
+
+// LazyLoadCache remembers which membership events have already been sent to
+// each device in each room, so that they can be left out of later responses
+// when lazy-loading members without include_redundant_members. If an entry
+// is evicted then the membership events are sent again, which is harmless.
+type LazyLoadCache struct {
+	mu    sync.Mutex
+	cache *lru.Cache // "user ID|device ID|room ID" -> map[member user ID]event ID
+}
+
+// NewLazyLoadCache returns an empty lazy-loading cache.
+func NewLazyLoadCache() (*LazyLoadCache, error) {
+	cache, err := lru.New(LazyLoadCacheMaxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &LazyLoadCache{cache: cache}, nil
+}
+
+func lazyLoadCacheKey(device *userapi.Device, roomID string) string {
+	return device.UserID + "|" + device.ID + "|" + roomID
+}
+
+// isRedundant returns true if the membership event has already been sent to
+// the device in the room.
+func (c *LazyLoadCache) isRedundant(device *userapi.Device, roomID string, ev *gomatrixserverlib.HeaderedEvent) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if members, ok := c.cache.Get(lazyLoadCacheKey(device, roomID)); ok {
+		return members.(map[string]string)[*ev.StateKey()] == ev.EventID()
+	}
+	return false
+}
+
+// store records that the membership events have been sent to the device in
+// the room.
+func (c *LazyLoadCache) store(device *userapi.Device, roomID string, events []*gomatrixserverlib.HeaderedEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := lazyLoadCacheKey(device, roomID)
+	var members map[string]string
+	if existing, ok := c.cache.Get(key); ok {
+		members = existing.(map[string]string)
+	} else {
+		members = make(map[string]string)
+	}
+	for _, ev := range events {
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil {
+			members[*ev.StateKey()] = ev.EventID()
+		}
+	}
+	c.cache.Add(key, members)
+}
+
+// Reset forgets which membership events have been sent to the device in every
+// room, e.g. because the device is starting again with an initial sync.
+func (c *LazyLoadCache) Reset(device *userapi.Device) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prefix := device.UserID + "|" + device.ID + "|"
+	for _, key := range c.cache.Keys() {
+		if k := key.(string); len(k) > len(prefix) && k[:len(prefix)] == prefix {
+			c.cache.Remove(key)
+		}
+	}
+}
+
+// MemberStateFetcher fetches the current membership event of a user in a
+// room, returning nil if there isn't one.
+type MemberStateFetcher func(ctx context.Context, roomID, userID string) (*gomatrixserverlib.HeaderedEvent, error)
+
+// LazyLoadMembers returns the given state events with membership events
+// limited to those of the senders of the timeline events and the syncing
+// user, as described by the lazy_load_members filter option. Membership
+// events for those users which aren't already in the state are fetched.
+// Membership events in the timeline are never removed, and users whose
+// membership is in the timeline don't need it in the state as well.
+//
+// Unless includeRedundant is set, membership events which have already been
+// sent to the device are left out. If cache is nil then nothing is left out.
+func LazyLoadMembers(
+	ctx context.Context, cache *LazyLoadCache, includeRedundant bool,
+	device *userapi.Device, roomID string,
+	timeline, state []*gomatrixserverlib.HeaderedEvent,
+	fetch MemberStateFetcher,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	wanted := map[string]bool{
+		device.UserID: true,
+	}
+	inTimeline := make(map[string]bool)
+	for _, ev := range timeline {
+		wanted[ev.Sender()] = true
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil {
+			inTimeline[*ev.StateKey()] = true
+		}
+	}
+
+	filtered := make([]*gomatrixserverlib.HeaderedEvent, 0, len(state))
+	found := make(map[string]bool)
+	for _, ev := range state {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			filtered = append(filtered, ev)
+			continue
+		}
+		userID := *ev.StateKey()
+		if !wanted[userID] {
+			continue
+		}
+		found[userID] = true
+		if !includeRedundant && cache != nil && cache.isRedundant(device, roomID, ev) {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+
+	for userID := range wanted {
+		if found[userID] || inTimeline[userID] {
+			continue
+		}
+		ev, err := fetch(ctx, roomID, userID)
+		if err != nil {
+			return nil, fmt.Errorf("fetch: %w", err)
+		}
+		if ev == nil {
+			continue
+		}
+		if !includeRedundant && cache != nil && cache.isRedundant(device, roomID, ev) {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+
+	if cache != nil {
+		cache.store(device, roomID, filtered)
+		cache.store(device, roomID, timeline)
+	}
+	return filtered, nil
+}
@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"testing"
+
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const lazyLoadRoomID = "!lazyload:localhost"
+
+func mustCreateLazyLoadEvent(t *testing.T, eventID, eventType, sender string, stateKey *string) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	stateKeyJSON := ""
+	if stateKey != nil {
+		stateKeyJSON = fmt.Sprintf(`"state_key":%q,`, *stateKey)
+	}
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(fmt.Sprintf(
+		`{"event_id":%q,"type":%q,"sender":%q,"room_id":%q,%s"content":{"membership":"join"},"depth":1,"origin_server_ts":0,"prev_events":[],"auth_events":[]}`,
+		eventID, eventType, sender, lazyLoadRoomID, stateKeyJSON,
+	)), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func mustCreateMemberEvent(t *testing.T, eventID, userID string) *gomatrixserverlib.HeaderedEvent {
+	return mustCreateLazyLoadEvent(t, eventID, gomatrixserverlib.MRoomMember, userID, &userID)
+}
+
+func lazyLoadEventIDs(events []*gomatrixserverlib.HeaderedEvent) []string {
+	eventIDs := make([]string, 0, len(events))
+	for _, ev := range events {
+		eventIDs = append(eventIDs, ev.EventID())
+	}
+	sort.Strings(eventIDs)
+	return eventIDs
+}
+
+func TestLazyLoadMembers(t *testing.T) {
+	ctx := context.Background()
+	alice := &userapi.Device{UserID: "@alice:localhost", ID: "ALICE1"}
+	aliceOther := &userapi.Device{UserID: "@alice:localhost", ID: "ALICE2"}
+	empty := ""
+
+	members := map[string]*gomatrixserverlib.HeaderedEvent{
+		"@alice:localhost":   mustCreateMemberEvent(t, "$alice:localhost", "@alice:localhost"),
+		"@bob:localhost":     mustCreateMemberEvent(t, "$bob:localhost", "@bob:localhost"),
+		"@charlie:localhost": mustCreateMemberEvent(t, "$charlie:localhost", "@charlie:localhost"),
+	}
+	fetched := 0
+	fetch := func(ctx context.Context, roomID, userID string) (*gomatrixserverlib.HeaderedEvent, error) {
+		fetched++
+		return members[userID], nil
+	}
+	name := mustCreateLazyLoadEvent(t, "$name:localhost", "m.room.name", "@alice:localhost", &empty)
+	timeline := []*gomatrixserverlib.HeaderedEvent{
+		mustCreateLazyLoadEvent(t, "$msg1:localhost", "m.room.message", "@bob:localhost", nil),
+		// dave's membership changes within the timeline
+		mustCreateMemberEvent(t, "$dave:localhost", "@dave:localhost"),
+	}
+	cache, err := NewLazyLoadCache()
+	if err != nil {
+		t.Fatalf("NewLazyLoadCache failed: %s", err)
+	}
+
+	// Charlie isn't in the timeline, so their membership is removed from the
+	// state. Alice and Bob are fetched, Dave is already in the timeline.
+	state, err := LazyLoadMembers(ctx, cache, false, alice, lazyLoadRoomID, timeline, []*gomatrixserverlib.HeaderedEvent{
+		name, members["@charlie:localhost"],
+	}, fetch)
+	if err != nil {
+		t.Fatalf("LazyLoadMembers failed: %s", err)
+	}
+	want := []string{"$alice:localhost", "$bob:localhost", "$name:localhost"}
+	if got := lazyLoadEventIDs(state); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("first sync: got %v, want %v", got, want)
+	}
+	if fetched != 2 {
+		t.Errorf("first sync: fetched %d membership events, want 2", fetched)
+	}
+
+	// The same device has already seen those membership events.
+	state, err = LazyLoadMembers(ctx, cache, false, alice, lazyLoadRoomID, timeline, nil, fetch)
+	if err != nil {
+		t.Fatalf("LazyLoadMembers failed: %s", err)
+	}
+	if got := lazyLoadEventIDs(state); len(got) != 0 {
+		t.Errorf("repeated sync: got %v, want no events", got)
+	}
+
+	// Unless they are asked for explicitly.
+	state, err = LazyLoadMembers(ctx, cache, true, alice, lazyLoadRoomID, timeline, nil, fetch)
+	if err != nil {
+		t.Fatalf("LazyLoadMembers failed: %s", err)
+	}
+	want = []string{"$alice:localhost", "$bob:localhost"}
+	if got := lazyLoadEventIDs(state); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("include_redundant_members: got %v, want %v", got, want)
+	}
+
+	// Another device of the same user hasn't seen them.
+	state, err = LazyLoadMembers(ctx, cache, false, aliceOther, lazyLoadRoomID, timeline, nil, fetch)
+	if err != nil {
+		t.Fatalf("LazyLoadMembers failed: %s", err)
+	}
+	if got := lazyLoadEventIDs(state); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("other device: got %v, want %v", got, want)
+	}
+
+	// After a reset the device gets them again.
+	cache.Reset(alice)
+	state, err = LazyLoadMembers(ctx, cache, false, alice, lazyLoadRoomID, timeline, nil, fetch)
+	if err != nil {
+		t.Fatalf("LazyLoadMembers failed: %s", err)
+	}
+	if got := lazyLoadEventIDs(state); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("after reset: got %v, want %v", got, want)
+	}
+}
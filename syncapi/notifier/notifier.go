@@ -131,7 +131,7 @@ func (n *Notifier) OnNewAccountData(
 	defer n.streamLock.Unlock()
 
 	n.currPos.ApplyUpdates(posUpdate)
-	n.wakeupUsers([]string{userID}, nil, posUpdate)
+	n.wakeupUsers([]string{userID}, nil, n.currPos)
 }
 
 func (n *Notifier) OnNewPeek(
@@ -197,6 +197,18 @@ func (n *Notifier) OnNewReceipt(
 	n.wakeupUsers(n.joinedUsers(roomID), nil, n.currPos)
 }
 
+// OnNewPresence updates the current position and wakes up the user and
+// everyone who shares a room with them.
+func (n *Notifier) OnNewPresence(
+	posUpdate types.StreamingToken, userID string,
+) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	n.currPos.ApplyUpdates(posUpdate)
+	n.wakeupUsers(n.sharedUsers(userID), nil, n.currPos)
+}
+
 func (n *Notifier) OnNewKeyChange(
 	posUpdate types.StreamingToken, wakeUserID, keyChangeUserID string,
 ) {
@@ -389,6 +401,22 @@ func (n *Notifier) joinedUsers(roomID string) (userIDs []string) {
 }
 
 // Not thread-safe: must be called on the OnNewEvent goroutine only
+// sharedUsers returns the user and the users who are joined to any of the
+// rooms that the user is joined to.
+func (n *Notifier) sharedUsers(userID string) []string {
+	shared := userIDSet{}
+	shared.add(userID)
+	for _, users := range n.roomIDToJoinedUsers {
+		if !users[userID] {
+			continue
+		}
+		for otherUserID := range users {
+			shared.add(otherUserID)
+		}
+	}
+	return shared.values()
+}
+
 func (n *Notifier) addPeekingDevice(roomID, userID, deviceID string) {
 	if _, ok := n.roomIDToPeekingDevices[roomID]; !ok {
 		n.roomIDToPeekingDevices[roomID] = make(peekingDeviceSet)
@@ -32,6 +32,7 @@ var (
 	randomMessageEvent  gomatrixserverlib.HeaderedEvent
 	aliceInviteBobEvent gomatrixserverlib.HeaderedEvent
 	bobLeaveEvent       gomatrixserverlib.HeaderedEvent
+	bobJoinEvent        gomatrixserverlib.HeaderedEvent
 	syncPositionVeryOld = types.StreamingToken{PDUPosition: 5}
 	syncPositionBefore  = types.StreamingToken{PDUPosition: 11}
 	syncPositionAfter   = types.StreamingToken{PDUPosition: 12}
@@ -97,6 +98,22 @@ func init() {
 	if err != nil {
 		panic(err)
 	}
+	err = json.Unmarshal([]byte(`{
+		"_room_version": "1",
+		"type": "m.room.member",
+		"state_key": "`+bob+`",
+		"content": {
+			"membership": "join"
+		},
+		"sender": "`+bob+`",
+		"room_id": "`+roomID+`",
+		"origin": "localhost",
+		"origin_server_ts": 12345,
+		"event_id": "$bobJoinEvent:localhost"
+	}`), &bobJoinEvent)
+	if err != nil {
+		panic(err)
+	}
 }
 
 func mustEqualPositions(t *testing.T, got, want types.StreamingToken) {
@@ -127,7 +144,7 @@ func TestNewEventAndJoinedToRoom(t *testing.T) {
 	go func() {
 		pos, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionBefore))
 		if err != nil {
-			t.Errorf("TestNewEventAndJoinedToRoom error: %w", err)
+			t.Errorf("TestNewEventAndJoinedToRoom error: %v", err)
 		}
 		mustEqualPositions(t, pos, syncPositionAfter)
 		wg.Done()
@@ -141,6 +158,69 @@ func TestNewEventAndJoinedToRoom(t *testing.T) {
 	wg.Wait()
 }
 
+// Test that a user who joins a room while syncing is woken for its events.
+func TestNewEventAfterJoiningMidSync(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	n.setUsersJoinedToRooms(map[string][]string{
+		roomID: {alice},
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	joined := make(chan struct{})
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionBefore))
+		if err != nil {
+			t.Errorf("TestNewEventAfterJoiningMidSync error: %v", err)
+		}
+		mustEqualPositions(t, pos, syncPositionAfter)
+		close(joined)
+
+		// The next sync is woken by an event in the room just joined.
+		pos, err = waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionAfter))
+		if err != nil {
+			t.Errorf("TestNewEventAfterJoiningMidSync error: %v", err)
+		}
+		mustEqualPositions(t, pos, syncPositionAfter2)
+		wg.Done()
+	}()
+
+	stream := lockedFetchUserStream(n, bob, bobDev)
+	waitForBlocking(stream, 1)
+	n.OnNewEvent(&bobJoinEvent, "", nil, syncPositionAfter)
+
+	<-joined
+	waitForBlocking(stream, 1)
+	n.OnNewEvent(&randomMessageEvent, "", nil, syncPositionAfter2)
+
+	wg.Wait()
+}
+
+// Test that account data wakes up the user with the full sync position.
+func TestNewAccountDataWakeup(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	accountDataPos := types.StreamingToken{AccountDataPosition: 1}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(alice, aliceDev, syncPositionBefore))
+		if err != nil {
+			t.Errorf("TestNewAccountDataWakeup error: %v", err)
+		}
+		want := syncPositionBefore
+		want.ApplyUpdates(accountDataPos)
+		mustEqualPositions(t, pos, want)
+		wg.Done()
+	}()
+
+	stream := lockedFetchUserStream(n, alice, aliceDev)
+	waitForBlocking(stream, 1)
+	n.OnNewAccountData(alice, accountDataPos)
+
+	wg.Wait()
+}
+
 func TestCorrectStream(t *testing.T) {
 	n := NewNotifier(syncPositionBefore)
 	stream := lockedFetchUserStream(n, bob, bobDev)
@@ -190,7 +270,7 @@ func TestNewInviteEventForUser(t *testing.T) {
 	go func() {
 		pos, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionBefore))
 		if err != nil {
-			t.Errorf("TestNewInviteEventForUser error: %w", err)
+			t.Errorf("TestNewInviteEventForUser error: %v", err)
 		}
 		mustEqualPositions(t, pos, syncPositionAfter)
 		wg.Done()
@@ -246,7 +326,7 @@ func TestMultipleRequestWakeup(t *testing.T) {
 	poll := func() {
 		pos, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionBefore))
 		if err != nil {
-			t.Errorf("TestMultipleRequestWakeup error: %w", err)
+			t.Errorf("TestMultipleRequestWakeup error: %v", err)
 		}
 		mustEqualPositions(t, pos, syncPositionAfter)
 		wg.Done()
@@ -284,7 +364,7 @@ func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	go func() {
 		pos, err := waitForEvents(n, newTestSyncRequest(bob, bobDev, syncPositionBefore))
 		if err != nil {
-			t.Errorf("TestNewEventAndWasPreviouslyJoinedToRoom error: %w", err)
+			t.Errorf("TestNewEventAndWasPreviouslyJoinedToRoom error: %v", err)
 		}
 		mustEqualPositions(t, pos, syncPositionAfter)
 		leaveWG.Done()
@@ -301,7 +381,7 @@ func TestNewEventAndWasPreviouslyJoinedToRoom(t *testing.T) {
 	go func() {
 		pos, err := waitForEvents(n, newTestSyncRequest(alice, aliceDev, syncPositionAfter))
 		if err != nil {
-			t.Errorf("TestNewEventAndWasPreviouslyJoinedToRoom error: %w", err)
+			t.Errorf("TestNewEventAndWasPreviouslyJoinedToRoom error: %v", err)
 		}
 		mustEqualPositions(t, pos, syncPositionAfter2)
 		aliceWG.Done()
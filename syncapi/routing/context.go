@@ -0,0 +1,210 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultContextLimit = 10
+	maxContextLimit     = 100
+)
+
+type contextResponse struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	Event        gomatrixserverlib.ClientEvent   `json:"event"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	State        []gomatrixserverlib.ClientEvent `json:"state"`
+}
+
+// Context implements GET /rooms/{roomID}/context/{eventID}, which returns the
+// event along with up to limit of the events which the user can see around
+// it, half of them before the event, and the state of the room at the last
+// event returned.
+func Context(
+	req *http.Request, device *userapi.Device, syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+	roomID, eventID string,
+) util.JSONResponse {
+	ctx := req.Context()
+
+	limit := defaultContextLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a non-negative integer"),
+			}
+		}
+		if limit > maxContextLimit {
+			limit = maxContextLimit
+		}
+	}
+
+	events, err := syncDB.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return notFound
+	}
+	ev := events[0]
+
+	isInRoom := false
+	memberEvent, err := syncDB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.GetStateEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	if memberEvent != nil {
+		membership, _ := memberEvent.Membership()
+		isInRoom = membership == gomatrixserverlib.Join
+	}
+	visible, err := api.IsEventVisibleTo(ctx, rsAPI, device.UserID, isInRoom, ev)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("api.IsEventVisibleTo failed")
+		return jsonerror.InternalServerError()
+	}
+	if !visible {
+		return notFound
+	}
+
+	around, err := visibleEventsAround(ctx, syncDB, rsAPI, device.UserID, isInRoom, ev, limit/2, limit-limit/2)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("visibleEventsAround failed")
+		return jsonerror.InternalServerError()
+	}
+
+	lastEvent := ev
+	if len(around.after) > 0 {
+		lastEvent = around.after[len(around.after)-1]
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err = rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{lastEvent.EventID()},
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryStateAfterEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	allEvents := append([]*gomatrixserverlib.HeaderedEvent{ev}, around.before...)
+	allEvents = append(allEvents, around.after...)
+	if err = syncDB.BundleAggregations(ctx, device.UserID, allEvents); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.BundleAggregations failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: contextResponse{
+			Start:        around.start.String(),
+			End:          around.end.String(),
+			Event:        gomatrixserverlib.HeaderedToClientEvent(ev, gomatrixserverlib.FormatAll),
+			EventsBefore: gomatrixserverlib.HeaderedToClientEvents(around.before, gomatrixserverlib.FormatAll),
+			EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(around.after, gomatrixserverlib.FormatAll),
+			State:        gomatrixserverlib.HeaderedToClientEvents(stateRes.StateEvents, gomatrixserverlib.FormatAll),
+		},
+	}
+}
+
+// eventsAround holds the events around an event, and the tokens from which
+// to paginate further in either direction.
+type eventsAround struct {
+	before, after []*gomatrixserverlib.HeaderedEvent
+	start, end    types.TopologyToken
+}
+
+// visibleEventsAround returns up to beforeLimit of the events before the
+// event, latest first, and up to afterLimit of the events after it, earliest
+// first, leaving out any which the user can't see.
+func visibleEventsAround(
+	ctx context.Context, syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+	userID string, isInRoom bool, ev *gomatrixserverlib.HeaderedEvent, beforeLimit, afterLimit int,
+) (*eventsAround, error) {
+	pos, err := syncDB.EventPositionInTopology(ctx, ev.EventID())
+	if err != nil {
+		return nil, fmt.Errorf("syncDB.EventPositionInTopology: %w", err)
+	}
+	maxPos, err := syncDB.MaxTopologicalPosition(ctx, ev.RoomID())
+	if err != nil {
+		return nil, fmt.Errorf("syncDB.MaxTopologicalPosition: %w", err)
+	}
+	// The ranges include the event itself, so ask for one more event.
+	before, err := syncDB.GetEventsInTopologicalRange(ctx, &pos, &types.TopologyToken{}, ev.RoomID(), beforeLimit+1, true)
+	if err != nil {
+		return nil, fmt.Errorf("syncDB.GetEventsInTopologicalRange: %w", err)
+	}
+	after, err := syncDB.GetEventsInTopologicalRange(ctx, &pos, &maxPos, ev.RoomID(), afterLimit+1, false)
+	if err != nil {
+		return nil, fmt.Errorf("syncDB.GetEventsInTopologicalRange: %w", err)
+	}
+
+	res := &eventsAround{
+		before: []*gomatrixserverlib.HeaderedEvent{},
+		after:  []*gomatrixserverlib.HeaderedEvent{},
+		start:  pos,
+		end:    pos,
+	}
+	for _, aroundEvents := range []struct {
+		events []types.StreamEvent
+		limit  int
+		chunk  *[]*gomatrixserverlib.HeaderedEvent
+		token  *types.TopologyToken
+	}{
+		{before, beforeLimit, &res.before, &res.start},
+		{after, afterLimit, &res.after, &res.end},
+	} {
+		for _, aroundEvent := range syncDB.StreamEventsToEvents(nil, aroundEvents.events) {
+			if aroundEvent.EventID() == ev.EventID() || len(*aroundEvents.chunk) >= aroundEvents.limit {
+				continue
+			}
+			visible, err := api.IsEventVisibleTo(ctx, rsAPI, userID, isInRoom, aroundEvent)
+			if err != nil {
+				return nil, err
+			}
+			if !visible {
+				continue
+			}
+			*aroundEvents.chunk = append(*aroundEvents.chunk, aroundEvent)
+			if *aroundEvents.token, err = syncDB.EventPositionInTopology(ctx, aroundEvent.EventID()); err != nil {
+				return nil, fmt.Errorf("syncDB.EventPositionInTopology: %w", err)
+			}
+		}
+	}
+	// Tokens refer to the position before the event going backwards, as
+	// they do for /messages.
+	res.start.Decrement()
+	return res, nil
+}
@@ -0,0 +1,126 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/test"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testRoomID = "!room:localhost"
+	testAlice  = "@alice:localhost"
+	testBob    = "@bob:localhost"
+)
+
+var testRoom = test.NewRoom(testRoomID)
+
+// testSyncDB serves a single room, in which the events have no neighbours.
+type testSyncDB struct {
+	storage.Database
+	events      map[string]*gomatrixserverlib.HeaderedEvent
+	memberships map[string]*gomatrixserverlib.HeaderedEvent
+}
+
+func (db *testSyncDB) Events(ctx context.Context, eventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	var events []*gomatrixserverlib.HeaderedEvent
+	for _, eventID := range eventIDs {
+		if ev, ok := db.events[eventID]; ok {
+			events = append(events, ev)
+		}
+	}
+	return events, nil
+}
+
+func (db *testSyncDB) GetStateEvent(ctx context.Context, roomID, evType, stateKey string) (*gomatrixserverlib.HeaderedEvent, error) {
+	if evType != gomatrixserverlib.MRoomMember {
+		return nil, nil
+	}
+	return db.memberships[stateKey], nil
+}
+
+func (db *testSyncDB) EventPositionInTopology(ctx context.Context, eventID string) (types.TopologyToken, error) {
+	return types.TopologyToken{Depth: 1, PDUPosition: 1}, nil
+}
+
+func (db *testSyncDB) MaxTopologicalPosition(ctx context.Context, roomID string) (types.TopologyToken, error) {
+	return types.TopologyToken{Depth: 1, PDUPosition: 1}, nil
+}
+
+func (db *testSyncDB) GetEventsInTopologicalRange(
+	ctx context.Context, from, to *types.TopologyToken, roomID string, limit int, backwardOrdering bool,
+) ([]types.StreamEvent, error) {
+	return nil, nil
+}
+
+func (db *testSyncDB) StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []*gomatrixserverlib.HeaderedEvent {
+	return nil
+}
+
+func (db *testSyncDB) BundleAggregations(ctx context.Context, userID string, events []*gomatrixserverlib.HeaderedEvent) error {
+	return nil
+}
+
+// testRoomserverAPI returns the same state before every event.
+type testRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	state []*gomatrixserverlib.HeaderedEvent
+}
+
+func (r *testRoomserverAPI) QueryStateAfterEvents(
+	ctx context.Context, req *api.QueryStateAfterEventsRequest, res *api.QueryStateAfterEventsResponse,
+) error {
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	res.StateEvents = []*gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range r.state {
+		if len(req.StateToFetch) == 0 {
+			res.StateEvents = append(res.StateEvents, ev)
+			continue
+		}
+		for _, tuple := range req.StateToFetch {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				res.StateEvents = append(res.StateEvents, ev)
+			}
+		}
+	}
+	return nil
+}
+
+func TestContextRequiresMembership(t *testing.T) {
+	emptyStateKey := ""
+	visibility := testRoom.CreateEvent(t, testAlice, gomatrixserverlib.MRoomHistoryVisibility, &emptyStateKey, map[string]string{"history_visibility": "shared"})
+	message := testRoom.CreateEvent(t, testAlice, "m.room.message", nil, map[string]string{"body": "hello"})
+	aliceJoin := testRoom.CreateMemberEvent(t, testAlice, gomatrixserverlib.Join)
+	syncDB := &testSyncDB{
+		events: map[string]*gomatrixserverlib.HeaderedEvent{
+			message.EventID(): message,
+		},
+		memberships: map[string]*gomatrixserverlib.HeaderedEvent{
+			testAlice: aliceJoin,
+			testBob:   testRoom.CreateMemberEvent(t, testBob, gomatrixserverlib.Leave),
+		},
+	}
+	rsAPI := &testRoomserverAPI{
+		state: []*gomatrixserverlib.HeaderedEvent{visibility, aliceJoin},
+	}
+
+	for userID, wantCode := range map[string]int{
+		testAlice:            http.StatusOK,
+		testBob:              http.StatusNotFound,
+		"@charlie:localhost": http.StatusNotFound,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/context/"+message.EventID(), nil)
+		res := Context(req, &userapi.Device{UserID: userID}, syncDB, rsAPI, testRoomID, message.EventID())
+		if res.Code != wantCode {
+			t.Errorf("%s: got status %d, want %d", userID, res.Code, wantCode)
+		}
+	}
+}
@@ -15,6 +15,7 @@
 package routing
 
 import (
+	"database/sql"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
@@ -45,14 +46,14 @@ func GetFilter(
 	}
 
 	filter, err := syncDB.GetFilter(req.Context(), localpart, filterID)
-	if err != nil {
-		//TODO better error handling. This error message is *probably* right,
-		// but if there are obscure db errors, this will also be returned,
-		// even though it is not correct.
+	if err == sql.ErrNoRows {
 		return util.JSONResponse{
-			Code: http.StatusBadRequest,
+			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("No such filter"),
 		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.GetFilter failed")
+		return jsonerror.InternalServerError()
 	}
 
 	return util.JSONResponse{
@@ -105,6 +106,11 @@ func PutFilter(
 	if !limitRes.Exists() {
 		util.GetLogger(req.Context()).Infof("missing timeline limit, using default")
 		filter.Room.Timeline.Limit = sync.DefaultTimelineLimit
+	} else if filter.Room.Timeline.Limit < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Invalid filter: room.timeline.limit must not be negative"),
+		}
 	}
 
 	// Validate generates a user-friendly error
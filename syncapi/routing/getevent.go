@@ -0,0 +1,131 @@
+// Copyright 2019 Alex Chen
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetEvent implements GET /_matrix/client/r0/rooms/{roomId}/event/{eventId}
+// https://matrix.org/docs/spec/client_server/r0.4.0.html#get-matrix-client-r0-rooms-roomid-event-eventid
+//
+// The same error is returned whether the event doesn't exist or the history
+// visibility of the room doesn't allow the user to see it, so that the
+// existence of events isn't leaked. Application services can also see events
+// which were sent while one of the users they are interested in was joined.
+func GetEvent(
+	req *http.Request,
+	device *userapi.Device,
+	roomID string,
+	eventID string,
+	cfg *config.SyncAPI,
+	syncDB storage.Database,
+	rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+	}
+	events, err := syncDB.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return notFound
+	}
+	requestedEvent := events[0]
+
+	isInRoom := false
+	memberEvent, err := syncDB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.GetStateEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	if memberEvent != nil {
+		membership, _ := memberEvent.Membership()
+		isInRoom = membership == gomatrixserverlib.Join
+	}
+	visible, err := api.IsEventVisibleTo(ctx, rsAPI, device.UserID, isInRoom, requestedEvent)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("api.IsEventVisibleTo failed")
+		return jsonerror.InternalServerError()
+	}
+	if !visible && device.AppserviceID != "" {
+		for i := range cfg.Derived.ApplicationServices {
+			if as := &cfg.Derived.ApplicationServices[i]; as.ID == device.AppserviceID {
+				visible, err = isEventVisibleToAppservice(ctx, rsAPI, as, requestedEvent)
+				if err != nil {
+					util.GetLogger(ctx).WithError(err).Error("isEventVisibleToAppservice failed")
+					return jsonerror.InternalServerError()
+				}
+				break
+			}
+		}
+	}
+	if !visible {
+		return notFound
+	}
+
+	if err = syncDB.BundleAggregations(ctx, device.UserID, events); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.BundleAggregations failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: gomatrixserverlib.HeaderedToClientEvent(requestedEvent, gomatrixserverlib.FormatAll),
+	}
+}
+
+// isEventVisibleToAppservice returns whether any of the users which the
+// application service is interested in were joined to the room when the event
+// was sent.
+func isEventVisibleToAppservice(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, as *config.ApplicationService, ev *gomatrixserverlib.HeaderedEvent,
+) (bool, error) {
+	var queryRes api.QueryStateAfterEventsResponse
+	if err := rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       ev.RoomID(),
+		PrevEventIDs: ev.PrevEventIDs(),
+	}, &queryRes); err != nil {
+		return false, fmt.Errorf("rsAPI.QueryStateAfterEvents: %w", err)
+	}
+	if !queryRes.RoomExists || !queryRes.PrevEventsExist {
+		return false, nil
+	}
+	for _, stateEvent := range queryRes.StateEvents {
+		if stateEvent.Type() != gomatrixserverlib.MRoomMember || stateEvent.StateKey() == nil {
+			continue
+		}
+		if !as.IsInterestedInUserID(*stateEvent.StateKey()) {
+			continue
+		}
+		if membership, _ := stateEvent.Membership(); membership == gomatrixserverlib.Join {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,68 @@
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestGetEventAppservice(t *testing.T) {
+	emptyStateKey := ""
+	bridgedUser := "@_bridge_bob:localhost"
+	visibility := testRoom.CreateEvent(t, testAlice, gomatrixserverlib.MRoomHistoryVisibility, &emptyStateKey, map[string]string{"history_visibility": "joined"})
+	message := testRoom.CreateEvent(t, testAlice, "m.room.message", nil, map[string]string{"body": "hello"})
+	syncDB := &testSyncDB{
+		events: map[string]*gomatrixserverlib.HeaderedEvent{
+			message.EventID(): message,
+		},
+		memberships: map[string]*gomatrixserverlib.HeaderedEvent{},
+	}
+	rsAPI := &testRoomserverAPI{
+		state: []*gomatrixserverlib.HeaderedEvent{
+			visibility,
+			testRoom.CreateMemberEvent(t, testAlice, gomatrixserverlib.Join),
+			testRoom.CreateMemberEvent(t, bridgedUser, gomatrixserverlib.Join),
+		},
+	}
+	cfg := &config.SyncAPI{
+		Derived: &config.Derived{
+			ApplicationServices: []config.ApplicationService{
+				{
+					ID: "bridge",
+					NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+						"users": {{Regex: "@_bridge_.*", RegexpObject: regexp.MustCompile("@_bridge_.*")}},
+					},
+				},
+				{
+					ID: "other",
+					NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+						"users": {{Regex: "@_other_.*", RegexpObject: regexp.MustCompile("@_other_.*")}},
+					},
+				},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		device   *userapi.Device
+		wantCode int
+	}{
+		{"joined user", &userapi.Device{UserID: testAlice}, http.StatusOK},
+		{"interested appservice", &userapi.Device{UserID: "@bridge:localhost", AppserviceID: "bridge"}, http.StatusOK},
+		{"uninterested appservice", &userapi.Device{UserID: "@other:localhost", AppserviceID: "other"}, http.StatusNotFound},
+		{"unknown appservice", &userapi.Device{UserID: "@unknown:localhost", AppserviceID: "unknown"}, http.StatusNotFound},
+		{"user not in room", &userapi.Device{UserID: testBob}, http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/rooms/"+testRoomID+"/event/"+message.EventID(), nil)
+		res := GetEvent(req, tc.device, testRoomID, message.EventID(), cfg, syncDB, rsAPI)
+		if res.Code != tc.wantCode {
+			t.Errorf("%s: got status %d, want %d", tc.name, res.Code, tc.wantCode)
+		}
+	}
+}
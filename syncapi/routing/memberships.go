@@ -0,0 +1,179 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type getMembershipResponse struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+}
+
+var validMemberships = map[string]bool{
+	gomatrixserverlib.Join:   true,
+	gomatrixserverlib.Invite: true,
+	gomatrixserverlib.Leave:  true,
+	gomatrixserverlib.Ban:    true,
+}
+
+// GetMemberships implements GET /rooms/{roomId}/members
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-rooms-roomid-members
+//
+// If the at parameter is given, the memberships are returned as they were at
+// that sync token, as long as the user was joined to the room then. Otherwise
+// they are the current memberships, or the memberships when the user left the
+// room if they are no longer in it.
+func GetMemberships(
+	req *http.Request, device *userapi.Device, roomID string,
+	syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	query := req.URL.Query()
+	membership, notMembership := query.Get("membership"), query.Get("not_membership")
+	for _, m := range []string{membership, notMembership} {
+		if m != "" && !validMemberships[m] {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Unknown membership " + m),
+			}
+		}
+	}
+
+	var events []gomatrixserverlib.ClientEvent
+	if at := query.Get("at"); at != "" {
+		var resErr *util.JSONResponse
+		events, resErr = membershipsAtToken(req, device, roomID, at, syncDB, rsAPI)
+		if resErr != nil {
+			return *resErr
+		}
+	} else {
+		var queryRes api.QueryMembershipsForRoomResponse
+		if err := rsAPI.QueryMembershipsForRoom(req.Context(), &api.QueryMembershipsForRoomRequest{
+			RoomID: roomID,
+			Sender: device.UserID,
+		}, &queryRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryMembershipsForRoom failed")
+			return jsonerror.InternalServerError()
+		}
+		if !queryRes.HasBeenInRoom {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+			}
+		}
+		events = queryRes.JoinEvents
+	}
+
+	res := getMembershipResponse{Chunk: []gomatrixserverlib.ClientEvent{}}
+	for _, ev := range events {
+		var content struct {
+			Membership string `json:"membership"`
+		}
+		if err := json.Unmarshal(ev.Content, &content); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("failed to unmarshal membership event content")
+			return jsonerror.InternalServerError()
+		}
+		if membership != "" && content.Membership != membership {
+			continue
+		}
+		if notMembership != "" && content.Membership == notMembership {
+			continue
+		}
+		res.Chunk = append(res.Chunk, ev)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// membershipsAtToken returns the membership events in the state of the room
+// at the sync or pagination token. The state is resolved by the roomserver
+// after the last event in the room at the token, and the user must have been
+// joined to the room in it.
+func membershipsAtToken(
+	req *http.Request, device *userapi.Device, roomID, at string,
+	syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+) ([]gomatrixserverlib.ClientEvent, *util.JSONResponse) {
+	var pos types.StreamPosition
+	if topologyToken, err := types.NewTopologyTokenFromString(at); err == nil {
+		pos = topologyToken.PDUPosition
+	} else if streamToken, err := types.NewStreamTokenFromString(at); err == nil {
+		pos = streamToken.PDUPosition
+	} else {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Invalid at parameter: " + err.Error()),
+		}
+	}
+
+	forbidden := &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("You weren't a member of the room at that point."),
+	}
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.Limit = 1
+	lastEvents, _, err := syncDB.RecentEvents(
+		req.Context(), roomID, types.Range{From: pos, To: 0, Backwards: true}, &filter, true, false,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.RecentEvents failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if len(lastEvents) == 0 {
+		// The room didn't exist yet, or at least not as far as we know.
+		return nil, forbidden
+	}
+
+	var stateRes api.QueryStateAfterEventsResponse
+	if err = rsAPI.QueryStateAfterEvents(req.Context(), &api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{lastEvents[0].EventID()},
+	}, &stateRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryStateAfterEvents failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	if !stateRes.RoomExists || !stateRes.PrevEventsExist {
+		return nil, forbidden
+	}
+
+	var memberships []*gomatrixserverlib.HeaderedEvent
+	wasJoined := false
+	for _, ev := range stateRes.StateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		if *ev.StateKey() == device.UserID {
+			membership, err := ev.Membership()
+			wasJoined = err == nil && membership == gomatrixserverlib.Join
+		}
+		memberships = append(memberships, ev)
+	}
+	if !wasJoined {
+		return nil, forbidden
+	}
+	return gomatrixserverlib.HeaderedToClientEvents(memberships, gomatrixserverlib.FormatAll), nil
+}
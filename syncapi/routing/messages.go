@@ -16,6 +16,7 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
@@ -24,6 +25,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/sync"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -47,6 +49,8 @@ type messagesReq struct {
 	wasToProvided    bool
 	limit            int
 	backwardOrdering bool
+	filter           gomatrixserverlib.RoomEventFilter
+	lazyLoadCache    *internal.LazyLoadCache
 }
 
 type messagesResp struct {
@@ -54,6 +58,7 @@ type messagesResp struct {
 	StartStream string                          `json:"start_stream,omitempty"` // NOTSPEC: so clients can hit /messages then immediately /sync with a latest sync token
 	End         string                          `json:"end"`
 	Chunk       []gomatrixserverlib.ClientEvent `json:"chunk"`
+	State       []gomatrixserverlib.ClientEvent `json:"state,omitempty"`
 }
 
 const defaultMessagesLimit = 10
@@ -65,6 +70,7 @@ func OnIncomingMessagesRequest(
 	req *http.Request, db storage.Database, roomID string, device *userapi.Device,
 	federation *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
+	userAPI userapi.UserInternalAPI,
 	cfg *config.SyncAPI,
 	srp *sync.RequestPool,
 ) util.JSONResponse {
@@ -155,7 +161,17 @@ func OnIncomingMessagesRequest(
 			}
 		}
 	}
-	// TODO: Implement filtering (#587)
+	// TODO: Implement the rest of filtering (#587). Only lazy-loading of
+	// members is supported for now.
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	if s := req.URL.Query().Get("filter"); s != "" {
+		if err = json.Unmarshal([]byte(s), &filter); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("filter could not be parsed: " + err.Error()),
+			}
+		}
+	}
 
 	// Check the room ID's format.
 	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
@@ -179,13 +195,34 @@ func OnIncomingMessagesRequest(
 		limit:            limit,
 		backwardOrdering: backwardOrdering,
 		device:           device,
+		filter:           filter,
+		lazyLoadCache:    srp.LazyLoadCache(),
 	}
 
-	clientEvents, start, end, err := mReq.retrieveEvents()
+	events, start, end, err := mReq.retrieveEvents()
 	if err != nil {
 		util.GetLogger(req.Context()).WithError(err).Error("mreq.retrieveEvents failed")
 		return jsonerror.InternalServerError()
 	}
+	ignoredUsers, err := internal.IgnoredUsers(req.Context(), userAPI, device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("internal.IgnoredUsers failed")
+		return jsonerror.InternalServerError()
+	}
+	events = ignoredUsers.FilterEvents(events)
+	if err = db.BundleAggregations(req.Context(), device.UserID, events); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("db.BundleAggregations failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var state []gomatrixserverlib.ClientEvent
+	if filter.LazyLoadMembers {
+		state, err = mReq.lazyLoadMembers(events)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("mreq.lazyLoadMembers failed")
+			return jsonerror.InternalServerError()
+		}
+	}
 
 	util.GetLogger(req.Context()).WithFields(logrus.Fields{
 		"from":         from.String(),
@@ -197,9 +234,10 @@ func OnIncomingMessagesRequest(
 	}).Info("Responding")
 
 	res := messagesResp{
-		Chunk: clientEvents,
+		Chunk: gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
 		Start: start.String(),
 		End:   end.String(),
+		State: state,
 	}
 	if emptyFromSupplied {
 		res.StartStream = fromStream.String()
@@ -212,6 +250,21 @@ func OnIncomingMessagesRequest(
 	}
 }
 
+// lazyLoadMembers returns the membership events of the senders of the given
+// events, for when the filter has lazy_load_members set.
+func (r *messagesReq) lazyLoadMembers(events []*gomatrixserverlib.HeaderedEvent) ([]gomatrixserverlib.ClientEvent, error) {
+	state, err := internal.LazyLoadMembers(
+		r.ctx, r.lazyLoadCache, r.filter.IncludeRedundantMembers, r.device, r.roomID, events, nil,
+		func(ctx context.Context, roomID, userID string) (*gomatrixserverlib.HeaderedEvent, error) {
+			return r.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, userID)
+		},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("internal.LazyLoadMembers: %w", err)
+	}
+	return gomatrixserverlib.HeaderedToClientEvents(state, gomatrixserverlib.FormatAll), nil
+}
+
 func checkIsRoomForgotten(ctx context.Context, roomID, userID string, rsAPI api.RoomserverInternalAPI) (bool, error) {
 	req := api.QueryMembershipForUserRequest{
 		RoomID: roomID,
@@ -231,7 +284,7 @@ func checkIsRoomForgotten(ctx context.Context, roomID, userID string, rsAPI api.
 // Returns an error if there was an issue talking to the database or with the
 // remote homeserver.
 func (r *messagesReq) retrieveEvents() (
-	clientEvents []gomatrixserverlib.ClientEvent, start,
+	events []*gomatrixserverlib.HeaderedEvent, start,
 	end types.TopologyToken, err error,
 ) {
 	eventFilter := gomatrixserverlib.DefaultRoomEventFilter()
@@ -254,7 +307,6 @@ func (r *messagesReq) retrieveEvents() (
 		return
 	}
 
-	var events []*gomatrixserverlib.HeaderedEvent
 	util.GetLogger(r.ctx).WithField("start", start).WithField("end", end).Infof("Fetched %d events locally", len(streamEvents))
 
 	// There can be two reasons for streamEvents to be empty: either we've
@@ -272,7 +324,7 @@ func (r *messagesReq) retrieveEvents() (
 
 	// If we didn't get any event, we don't need to proceed any further.
 	if len(events) == 0 {
-		return []gomatrixserverlib.ClientEvent{}, *r.from, *r.to, nil
+		return []*gomatrixserverlib.HeaderedEvent{}, *r.from, *r.to, nil
 	}
 
 	// Get the position of the first and the last event in the room's topology.
@@ -297,12 +349,10 @@ func (r *messagesReq) retrieveEvents() (
 	}
 	events = r.filterHistoryVisible(events)
 	if len(events) == 0 {
-		return []gomatrixserverlib.ClientEvent{}, *r.from, *r.to, nil
+		return []*gomatrixserverlib.HeaderedEvent{}, *r.from, *r.to, nil
 	}
 
-	// Convert all of the events into client events.
-	clientEvents = gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)
-	return clientEvents, start, end, err
+	return events, start, end, err
 }
 
 func (r *messagesReq) filterHistoryVisible(events []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
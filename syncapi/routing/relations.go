@@ -0,0 +1,166 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultRelationsLimit = 5
+	maxRelationsLimit     = 50
+)
+
+type relationsResponse struct {
+	Chunk     []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch string                          `json:"next_batch,omitempty"`
+	PrevBatch string                          `json:"prev_batch,omitempty"`
+}
+
+// GetRelations implements GET /rooms/{roomID}/relations/{eventID}, optionally
+// followed by /{relType} and /{eventType}, which returns the events relating
+// to the event, newest first unless dir=f is given. The from and to tokens
+// are stream positions.
+// See: https://github.com/matrix-org/matrix-doc/pull/2675
+func GetRelations(
+	req *http.Request, device *userapi.Device, syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+	roomID, eventID, relType, eventType string,
+) util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+
+	limit := defaultRelationsLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxRelationsLimit {
+			limit = maxRelationsLimit
+		}
+	}
+	backwards := true
+	switch query.Get("dir") {
+	case "", "b":
+	case "f":
+		backwards = false
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("dir must be one of b or f"),
+		}
+	}
+
+	latest, err := syncDB.MaxStreamPositionForPDUs(ctx)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.MaxStreamPositionForPDUs failed")
+		return jsonerror.InternalServerError()
+	}
+	r := types.Range{Backwards: backwards}
+	if backwards {
+		r.From = latest
+	}
+	for _, param := range []struct {
+		name string
+		pos  *types.StreamPosition
+	}{
+		{"from", &r.From},
+		{"to", &r.To},
+	} {
+		if s := query.Get(param.name); s != "" {
+			pos, err := strconv.ParseInt(s, 10, 64)
+			if err != nil || pos < 0 {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue(param.name + " is invalid"),
+				}
+			}
+			*param.pos = types.StreamPosition(pos)
+		}
+	}
+	if !backwards && query.Get("to") == "" {
+		r.To = latest
+	}
+
+	// Only members of the room who can see the event can see what relates to it.
+	events, err := syncDB.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return notFound
+	}
+	memberEvent, err := syncDB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.GetStateEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	if memberEvent == nil {
+		return notFound
+	}
+	if membership, _ := memberEvent.Membership(); membership != gomatrixserverlib.Join {
+		return notFound
+	}
+	visible, err := api.IsEventVisibleTo(ctx, rsAPI, device.UserID, true, events[0])
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("api.IsEventVisibleTo failed")
+		return jsonerror.InternalServerError()
+	}
+	if !visible {
+		return notFound
+	}
+
+	related, err := syncDB.RelatedEvents(ctx, eventID, relType, eventType, r, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.RelatedEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	res := relationsResponse{
+		Chunk: gomatrixserverlib.HeaderedToClientEvents(syncDB.StreamEventsToEvents(nil, related), gomatrixserverlib.FormatAll),
+	}
+	if query.Get("from") != "" {
+		res.PrevBatch = query.Get("from")
+	}
+	if len(related) == limit {
+		// Ranges exclude their low position and include their high one, so
+		// going backwards continues from just before the last event.
+		next := related[len(related)-1].StreamPosition
+		if backwards {
+			next--
+		}
+		res.NextBatch = strconv.FormatInt(int64(next), 10)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
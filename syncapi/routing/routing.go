@@ -40,18 +40,37 @@ func Setup(
 	cfg *config.SyncAPI,
 ) {
 	r0mux := csMux.PathPrefix("/r0").Subrouter()
+	unstableMux := csMux.PathPrefix("/unstable").Subrouter()
 
 	// TODO: Add AS support for all handlers below.
 	r0mux.Handle("/sync", httputil.MakeAuthAPI("sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		return srp.OnIncomingSyncRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
+	if cfg.MSCs != nil && cfg.MSCs.Enabled("msc3575") {
+		unstableMux.Handle("/org.matrix.msc3575/sync", httputil.MakeAuthAPI("sliding_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return srp.OnIncomingSlidingSyncRequest(req, device)
+		})).Methods(http.MethodPost, http.MethodOptions)
+	}
+
+	r0mux.Handle("/initialSync", httputil.MakeAuthAPI("initial_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return srp.OnIncomingInitialSyncRequest(req, device)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/initialSync", httputil.MakeAuthAPI("rooms_initial_sync", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return srp.OnIncomingRoomInitialSyncRequest(req, device, vars["roomID"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
 	r0mux.Handle("/rooms/{roomID}/messages", httputil.MakeAuthAPI("room_messages", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], device, federation, rsAPI, cfg, srp)
+		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], device, federation, rsAPI, userAPI, cfg, srp)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
 	r0mux.Handle("/user/{userId}/filter",
@@ -74,6 +93,65 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
 
+	r0mux.Handle("/rooms/{roomID}/event/{eventID}",
+		httputil.MakeAuthAPI("rooms_get_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetEvent(req, device, vars["roomID"], vars["eventID"], cfg, syncDB, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/members",
+		httputil.MakeAuthAPI("rooms_members", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return GetMemberships(req, device, vars["roomID"], syncDB, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/context/{eventID}",
+		httputil.MakeAuthAPI("context", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return Context(req, device, syncDB, rsAPI, vars["roomID"], vars["eventID"])
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	getRelations := httputil.MakeAuthAPI("relations", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return GetRelations(req, device, syncDB, rsAPI, vars["roomID"], vars["eventID"], vars["relType"], vars["eventType"])
+	})
+	// Relations are still referred to by clients under /unstable, so register them on both.
+	for _, m := range []*mux.Router{r0mux, unstableMux} {
+		m.Handle("/rooms/{roomID}/relations/{eventID}", getRelations).Methods(http.MethodGet, http.MethodOptions)
+		m.Handle("/rooms/{roomID}/relations/{eventID}/{relType}", getRelations).Methods(http.MethodGet, http.MethodOptions)
+		m.Handle("/rooms/{roomID}/relations/{eventID}/{relType}/{eventType}", getRelations).Methods(http.MethodGet, http.MethodOptions)
+	}
+
+	getThreads := httputil.MakeAuthAPI("threads", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return GetThreads(req, device, syncDB, rsAPI, vars["roomID"])
+	})
+	for _, m := range []*mux.Router{r0mux, unstableMux} {
+		m.Handle("/rooms/{roomID}/threads", getThreads).Methods(http.MethodGet, http.MethodOptions)
+	}
+
+	r0mux.Handle("/search", httputil.MakeAuthAPI("search", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+		return Search(req, device, syncDB, rsAPI)
+	})).Methods(http.MethodPost, http.MethodOptions)
+
 	r0mux.Handle("/keys/changes", httputil.MakeAuthAPI("keys_changes", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 		return srp.OnIncomingKeyChangeRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
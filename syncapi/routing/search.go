@@ -0,0 +1,350 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultSearchLimit        = 10
+	maxSearchLimit            = 50
+	defaultSearchContextLimit = 5
+)
+
+type searchRequest struct {
+	SearchCategories struct {
+		RoomEvents *searchCriteria `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type searchCriteria struct {
+	SearchTerm   string                            `json:"search_term"`
+	Keys         []string                          `json:"keys"`
+	Filter       gomatrixserverlib.RoomEventFilter `json:"filter"`
+	OrderBy      string                            `json:"order_by"`
+	EventContext *searchEventContext               `json:"event_context"`
+	IncludeState bool                              `json:"include_state"`
+}
+
+type searchEventContext struct {
+	BeforeLimit    *int `json:"before_limit"`
+	AfterLimit     *int `json:"after_limit"`
+	IncludeProfile bool `json:"include_profile"`
+}
+
+type searchResponse struct {
+	SearchCategories searchResponseCategories `json:"search_categories"`
+}
+
+type searchResponseCategories struct {
+	RoomEvents *searchRoomEventsResponse `json:"room_events,omitempty"`
+}
+
+type searchRoomEventsResponse struct {
+	Count      int                                        `json:"count"`
+	Highlights []string                                   `json:"highlights"`
+	Results    []searchResult                             `json:"results"`
+	State      map[string][]gomatrixserverlib.ClientEvent `json:"state,omitempty"`
+	NextBatch  string                                     `json:"next_batch,omitempty"`
+}
+
+type searchResult struct {
+	Rank    float64                       `json:"rank"`
+	Result  gomatrixserverlib.ClientEvent `json:"result"`
+	Context *searchResultContext          `json:"context,omitempty"`
+}
+
+type searchResultContext struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	ProfileInfo  map[string]searchProfile        `json:"profile_info,omitempty"`
+}
+
+type searchProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// Search implements POST /search. Only the events in rooms which the user is
+// joined to are searched, and those from before the user could see the room's
+// history are left out.
+// See: https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-search
+func Search(
+	req *http.Request, device *userapi.Device, syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	var body searchRequest
+	defer req.Body.Close() // nolint:errcheck
+	reqBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be read. " + err.Error()),
+		}
+	}
+	if err = json.Unmarshal(reqBody, &body); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	criteria := body.SearchCategories.RoomEvents
+	if criteria == nil {
+		// Room events are the only category which can be searched.
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: searchResponse{},
+		}
+	}
+	if resErr := validateSearchCriteria(criteria); resErr != nil {
+		return *resErr
+	}
+
+	offset := 0
+	if nextBatch := req.URL.Query().Get("next_batch"); nextBatch != "" {
+		if offset, err = strconv.Atoi(nextBatch); err != nil || offset < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("next_batch is invalid"),
+			}
+		}
+	}
+	limit := criteria.Filter.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	} else if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	roomIDs, err := searchableRooms(ctx, syncDB, device.UserID, &criteria.Filter)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("searchableRooms failed")
+		return jsonerror.InternalServerError()
+	}
+	matches, count, err := syncDB.SearchEvents(
+		ctx, criteria.SearchTerm, roomIDs, criteria.Keys, criteria.OrderBy == "rank", limit, offset,
+	)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.SearchEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	eventIDs := make([]string, len(matches))
+	for i, match := range matches {
+		eventIDs[i] = match.EventID
+	}
+	events, err := syncDB.Events(ctx, eventIDs)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	eventsByID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(events))
+	for _, ev := range events {
+		eventsByID[ev.EventID()] = ev
+	}
+
+	res := &searchRoomEventsResponse{
+		Count:      count,
+		Highlights: types.SearchTerms(criteria.SearchTerm),
+		Results:    []searchResult{},
+	}
+	for _, match := range matches {
+		ev, ok := eventsByID[match.EventID]
+		if !ok {
+			continue
+		}
+		visible, err := api.IsEventVisibleTo(ctx, rsAPI, device.UserID, true, ev)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("api.IsEventVisibleTo failed")
+			return jsonerror.InternalServerError()
+		}
+		if !visible {
+			continue
+		}
+		result := searchResult{
+			Rank:   match.Rank,
+			Result: gomatrixserverlib.HeaderedToClientEvent(ev, gomatrixserverlib.FormatAll),
+		}
+		if criteria.EventContext != nil {
+			if result.Context, err = searchContext(ctx, syncDB, rsAPI, device.UserID, ev, criteria.EventContext); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("searchContext failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+		res.Results = append(res.Results, result)
+	}
+	if len(matches) == limit && offset+limit < count {
+		res.NextBatch = strconv.Itoa(offset + limit)
+	}
+
+	if criteria.IncludeState {
+		res.State = make(map[string][]gomatrixserverlib.ClientEvent)
+		for _, result := range res.Results {
+			if _, ok := res.State[result.Result.RoomID]; ok {
+				continue
+			}
+			stateEvents, err := syncDB.GetStateEventsForRoom(ctx, result.Result.RoomID, &gomatrixserverlib.StateFilter{
+				Limit: math.MaxInt32,
+			})
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("syncDB.GetStateEventsForRoom failed")
+				return jsonerror.InternalServerError()
+			}
+			res.State[result.Result.RoomID] = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatAll)
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: searchResponse{
+			SearchCategories: searchResponseCategories{
+				RoomEvents: res,
+			},
+		},
+	}
+}
+
+// validateSearchCriteria checks the search criteria given by the client and
+// fills in the defaults of any which are missing.
+func validateSearchCriteria(criteria *searchCriteria) *util.JSONResponse {
+	if criteria.SearchTerm == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingParam("Missing search_term"),
+		}
+	}
+	if len(criteria.Keys) == 0 {
+		for key := range types.SearchKeys {
+			criteria.Keys = append(criteria.Keys, key)
+		}
+		sort.Strings(criteria.Keys)
+	}
+	for _, key := range criteria.Keys {
+		if _, ok := types.SearchKeys[key]; !ok {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidParam(fmt.Sprintf("Unknown search key %q", key)),
+			}
+		}
+	}
+	switch criteria.OrderBy {
+	case "":
+		criteria.OrderBy = "rank"
+	case "rank", "recent":
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidParam("order_by must be one of rank or recent"),
+		}
+	}
+	return nil
+}
+
+// searchableRooms returns the rooms which the user is joined to, limited to
+// those which the filter allows.
+func searchableRooms(
+	ctx context.Context, syncDB storage.Database, userID string, filter *gomatrixserverlib.RoomEventFilter,
+) ([]string, error) {
+	joinedRoomIDs, err := syncDB.RoomIDsWithMembership(ctx, userID, gomatrixserverlib.Join)
+	if err != nil {
+		return nil, fmt.Errorf("syncDB.RoomIDsWithMembership: %w", err)
+	}
+	notRooms := make(map[string]bool, len(filter.NotRooms))
+	for _, roomID := range filter.NotRooms {
+		notRooms[roomID] = true
+	}
+	rooms := make(map[string]bool, len(filter.Rooms))
+	for _, roomID := range filter.Rooms {
+		rooms[roomID] = true
+	}
+	roomIDs := make([]string, 0, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		if notRooms[roomID] || (len(rooms) > 0 && !rooms[roomID]) {
+			continue
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, nil
+}
+
+// searchContext returns the visible events around a search result, and the
+// profiles of their senders if requested.
+func searchContext(
+	ctx context.Context, syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+	userID string, ev *gomatrixserverlib.HeaderedEvent, eventContext *searchEventContext,
+) (*searchResultContext, error) {
+	beforeLimit, afterLimit := defaultSearchContextLimit, defaultSearchContextLimit
+	if eventContext.BeforeLimit != nil {
+		beforeLimit = *eventContext.BeforeLimit
+	}
+	if eventContext.AfterLimit != nil {
+		afterLimit = *eventContext.AfterLimit
+	}
+
+	// Only rooms which the user is joined to are searched.
+	around, err := visibleEventsAround(ctx, syncDB, rsAPI, userID, true, ev, beforeLimit, afterLimit)
+	if err != nil {
+		return nil, err
+	}
+	res := &searchResultContext{
+		Start:        around.start.String(),
+		End:          around.end.String(),
+		EventsBefore: gomatrixserverlib.HeaderedToClientEvents(around.before, gomatrixserverlib.FormatAll),
+		EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(around.after, gomatrixserverlib.FormatAll),
+	}
+
+	if eventContext.IncludeProfile {
+		senders := map[string]bool{ev.Sender(): true}
+		for _, contextEvent := range append(around.before, around.after...) {
+			senders[contextEvent.Sender()] = true
+		}
+		res.ProfileInfo = make(map[string]searchProfile, len(senders))
+		for sender := range senders {
+			memberEvent, err := syncDB.GetStateEvent(ctx, ev.RoomID(), gomatrixserverlib.MRoomMember, sender)
+			if err != nil {
+				return nil, fmt.Errorf("syncDB.GetStateEvent: %w", err)
+			}
+			if memberEvent == nil {
+				continue
+			}
+			var content gomatrixserverlib.MemberContent
+			if err = json.Unmarshal(memberEvent.Content(), &content); err != nil {
+				continue
+			}
+			res.ProfileInfo[sender] = searchProfile{
+				DisplayName: content.DisplayName,
+				AvatarURL:   content.AvatarURL,
+			}
+		}
+	}
+	return res, nil
+}
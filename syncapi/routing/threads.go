@@ -0,0 +1,157 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultThreadsLimit = 5
+	maxThreadsLimit     = 50
+)
+
+type threadsResponse struct {
+	Chunk     []gomatrixserverlib.ClientEvent `json:"chunk"`
+	NextBatch string                          `json:"next_batch,omitempty"`
+}
+
+// GetThreads implements GET /rooms/{roomID}/threads, which returns the root
+// events of the threads in the room, most recently active first, with their
+// thread summaries bundled. include=participated only returns the threads
+// which the user started or replied to. The from token is a stream position.
+// See: https://github.com/matrix-org/matrix-doc/pull/3856
+func GetThreads(
+	req *http.Request, device *userapi.Device, syncDB storage.Database, rsAPI api.RoomserverInternalAPI,
+	roomID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	query := req.URL.Query()
+
+	limit := defaultThreadsLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+		if limit > maxThreadsLimit {
+			limit = maxThreadsLimit
+		}
+	}
+	var participant string
+	switch query.Get("include") {
+	case "", "all":
+	case "participated":
+		participant = device.UserID
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("include must be one of all or participated"),
+		}
+	}
+	from := types.StreamPosition(math.MaxInt64)
+	if s := query.Get("from"); s != "" {
+		pos, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || pos < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("from is invalid"),
+			}
+		}
+		from = types.StreamPosition(pos)
+	}
+
+	memberEvent, err := syncDB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, device.UserID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.GetStateEvent failed")
+		return jsonerror.InternalServerError()
+	}
+	if memberEvent == nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room"),
+		}
+	}
+	if membership, _ := memberEvent.Membership(); membership != gomatrixserverlib.Join {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room"),
+		}
+	}
+
+	threads, err := syncDB.RoomThreads(ctx, roomID, participant, from, limit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.RoomThreads failed")
+		return jsonerror.InternalServerError()
+	}
+	rootEventIDs := make([]string, len(threads))
+	for i := range threads {
+		rootEventIDs[i] = threads[i].RootEventID
+	}
+	roots, err := syncDB.Events(ctx, rootEventIDs)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	rootsByID := make(map[string]*gomatrixserverlib.HeaderedEvent, len(roots))
+	for _, root := range roots {
+		rootsByID[root.EventID()] = root
+	}
+	// Return the roots in the order of their threads' activity, leaving out
+	// any which haven't been received or which the user can't see.
+	visibleRoots := make([]*gomatrixserverlib.HeaderedEvent, 0, len(roots))
+	for _, thread := range threads {
+		root, ok := rootsByID[thread.RootEventID]
+		if !ok {
+			continue
+		}
+		visible, err := api.IsEventVisibleTo(ctx, rsAPI, device.UserID, true, root)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("api.IsEventVisibleTo failed")
+			return jsonerror.InternalServerError()
+		}
+		if visible {
+			visibleRoots = append(visibleRoots, root)
+		}
+	}
+	if err = syncDB.BundleAggregations(ctx, device.UserID, visibleRoots); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("syncDB.BundleAggregations failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := threadsResponse{
+		Chunk: gomatrixserverlib.HeaderedToClientEvents(visibleRoots, gomatrixserverlib.FormatAll),
+	}
+	if len(threads) == limit {
+		res.NextBatch = strconv.FormatInt(int64(threads[len(threads)-1].LatestStreamPos), 10)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
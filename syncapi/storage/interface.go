@@ -34,6 +34,7 @@ type Database interface {
 	MaxStreamPositionForInvites(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForAccountData(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForSendToDeviceMessages(ctx context.Context) (types.StreamPosition, error)
+	MaxStreamPositionForPresence(ctx context.Context) (types.StreamPosition, error)
 
 	CurrentState(ctx context.Context, roomID string, stateFilterPart *gomatrixserverlib.StateFilter, excludeEventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error)
 	GetStateDeltasForFullStateSync(ctx context.Context, device *userapi.Device, r types.Range, userID string, stateFilter *gomatrixserverlib.StateFilter) ([]types.StateDelta, []string, error)
@@ -48,6 +49,9 @@ type Database interface {
 	InviteEventsInRange(ctx context.Context, targetUserID string, r types.Range) (map[string]*gomatrixserverlib.HeaderedEvent, map[string]*gomatrixserverlib.HeaderedEvent, error)
 	PeeksInRange(ctx context.Context, userID, deviceID string, r types.Range) (peeks []types.Peek, err error)
 	RoomReceiptsAfter(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []eduAPI.OutputReceiptEvent, error)
+	// PresenceInRange returns the latest presence of every user whose presence
+	// changed in the range, and the position of the latest change.
+	PresenceInRange(ctx context.Context, r types.Range) (types.StreamPosition, []userapi.Presence, error)
 
 	// AllJoinedUsersInRooms returns a map of room ID to a list of all joined user IDs.
 	AllJoinedUsersInRooms(ctx context.Context) (map[string][]string, error)
@@ -67,6 +71,9 @@ type Database interface {
 	// PurgeRoomState completely purges room state from the sync API. This is done when
 	// receiving an output event that completely resets the state.
 	PurgeRoomState(ctx context.Context, roomID string) error
+	// PurgeEvents removes timeline events which the roomserver has purged because of the room's retention policy,
+	// so that they are no longer returned by sync, /messages, search or relations. State is left as it is.
+	PurgeEvents(ctx context.Context, eventIDs []string) error
 	// GetStateEvent returns the Matrix state event of a given type for a given room with a given state key
 	// If no event could be found, returns nil
 	// If there was an issue during the retrieval, returns an error
@@ -79,8 +86,10 @@ type Database interface {
 	// updated between two given positions
 	// Returns a map following the format data[roomID] = []dataTypes
 	// If no data is retrieved, returns an empty map
+	// Also returns the position up to which data was returned, which is before
+	// the end of the range if there was more data than the filter's limit
 	// If there was an issue with the retrieval, returns an error
-	GetAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataFilterPart *gomatrixserverlib.EventFilter) (map[string][]string, error)
+	GetAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataFilterPart *gomatrixserverlib.EventFilter) (map[string][]string, types.StreamPosition, error)
 	// UpsertAccountData keeps track of new or updated account data, by saving the type
 	// of the new/updated data, and the user ID and room ID the data is related to (empty)
 	// room ID means the data isn't specific to any room)
@@ -119,13 +128,16 @@ type Database interface {
 	// added to the unsigned section of the output event.
 	StreamEventsToEvents(device *userapi.Device, in []types.StreamEvent) []*gomatrixserverlib.HeaderedEvent
 	// SendToDeviceUpdatesForSync returns a list of send-to-device updates. It returns the
-	// relevant events within the given ranges for the supplied user ID and device ID.
+	// relevant events within the given ranges for the supplied user ID and device ID,
+	// oldest first. If there are more than tables.SendToDeviceMessagesLimit then the
+	// returned position is that of the last event returned, so that the rest are
+	// sent next time.
 	SendToDeviceUpdatesForSync(ctx context.Context, userID, deviceID string, from, to types.StreamPosition) (pos types.StreamPosition, events []types.SendToDeviceEvent, err error)
 	// StoreNewSendForDeviceMessage stores a new send-to-device event for a user's device.
 	StoreNewSendForDeviceMessage(ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent) (types.StreamPosition, error)
-	// CleanSendToDeviceUpdates removes all send-to-device messages BEFORE the specified
-	// from position, preventing the send-to-device table from growing indefinitely.
-	CleanSendToDeviceUpdates(ctx context.Context, userID, deviceID string, before types.StreamPosition) (err error)
+	// CleanSendToDeviceUpdates removes all send-to-device messages up to and including
+	// the specified position, which the device has acknowledged by syncing from it.
+	CleanSendToDeviceUpdates(ctx context.Context, userID, deviceID string, acknowledged types.StreamPosition) (err error)
 	// GetFilter looks up the filter associated with a given local user and filter ID.
 	// Returns a filter structure. Otherwise returns an error if no such filter exists
 	// or if there was an error talking to the database.
@@ -136,8 +148,41 @@ type Database interface {
 	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
-	// StoreReceipt stores new receipt events
+	// StoreReceipt stores new receipt events. Returns a position of 0 if the
+	// user's receipt was already for the same event, as nothing has changed.
 	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
 	// GetRoomReceipts gets all receipts for a given roomID
 	GetRoomReceipts(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) ([]eduAPI.OutputReceiptEvent, error)
+	// StorePresence stores the latest presence of a user and returns its new
+	// stream position.
+	StorePresence(ctx context.Context, presence *userapi.Presence) (pos types.StreamPosition, err error)
+	// StoreNotification records that the event at the stream position
+	// notified the user.
+	StoreNotification(ctx context.Context, userID, roomID string, pos types.StreamPosition, highlight bool) error
+	// ClearNotifications removes the user's notifications in the room for
+	// events up to and including the stream position, e.g. when the user
+	// sends a read receipt.
+	ClearNotifications(ctx context.Context, userID, roomID string, pos types.StreamPosition) error
+	// NotificationCounts returns the user's unread notification counts, keyed
+	// by room ID. Rooms without unread notifications are not included.
+	NotificationCounts(ctx context.Context, userID string) (map[string]types.NotificationCounts, error)
+	// SearchEvents returns up to limit events in the given rooms whose given
+	// keys match the full-text search, skipping the first offset, along with
+	// the total number of matching events.
+	SearchEvents(ctx context.Context, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int) ([]types.SearchResult, int, error)
+	// ReindexSearch rebuilds the full-text search index of the room from
+	// the events which are already stored.
+	ReindexSearch(ctx context.Context, roomID string) error
+	// RelatedEvents returns up to limit events in the range which relate to
+	// the event, optionally only those of the given relation and event types
+	// if they aren't empty.
+	RelatedEvents(ctx context.Context, relatesTo, relType, eventType string, r types.Range, limit int) ([]types.StreamEvent, error)
+	// BundleAggregations adds the aggregations of the events which relate to
+	// the given events, e.g. reaction counts, the latest edit and thread
+	// summaries for the user, to their unsigned m.relations key.
+	BundleAggregations(ctx context.Context, userID string, events []*gomatrixserverlib.HeaderedEvent) error
+	// RoomThreads returns up to limit threads in the room whose latest event
+	// is before the position, most recently active first, optionally only
+	// those which the participant started or replied to.
+	RoomThreads(ctx context.Context, roomID, participant string, before types.StreamPosition, limit int) ([]types.Thread, error)
 }
@@ -57,7 +57,7 @@ const insertAccountDataSQL = "" +
 	" RETURNING id"
 
 const selectAccountDataInRangeSQL = "" +
-	"SELECT room_id, type FROM syncapi_account_data_type" +
+	"SELECT id, room_id, type FROM syncapi_account_data_type" +
 	" WHERE user_id = $1 AND id > $2 AND id <= $3" +
 	" AND ( $4::text[] IS NULL OR     type LIKE ANY($4)  )" +
 	" AND ( $5::text[] IS NULL OR NOT(type LIKE ANY($5)) )" +
@@ -103,7 +103,7 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	userID string,
 	r types.Range,
 	accountDataEventFilter *gomatrixserverlib.EventFilter,
-) (data map[string][]string, err error) {
+) (data map[string][]string, pos types.StreamPosition, err error) {
 	data = make(map[string][]string)
 
 	rows, err := s.selectAccountDataInRangeStmt.QueryContext(ctx, userID, r.Low(), r.High(),
@@ -116,21 +116,22 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "selectAccountDataInRange: rows.close() failed")
 
+	var entries int
 	for rows.Next() {
 		var dataType string
 		var roomID string
 
-		if err = rows.Scan(&roomID, &dataType); err != nil {
+		if err = rows.Scan(&pos, &roomID, &dataType); err != nil {
 			return
 		}
-
-		if len(data[roomID]) > 0 {
-			data[roomID] = append(data[roomID], dataType)
-		} else {
-			data[roomID] = []string{dataType}
-		}
+		data[roomID] = append(data[roomID], dataType)
+		entries++
+	}
+	// If the limit wasn't reached then everything in the range was returned.
+	if entries == 0 || entries < accountDataEventFilter.Limit {
+		pos = r.High()
 	}
-	return data, rows.Err()
+	return data, pos, rows.Err()
 }
 
 func (s *accountDataStatements) SelectMaxAccountDataID(
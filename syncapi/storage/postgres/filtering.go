@@ -20,7 +20,9 @@ import (
 
 // filterConvertWildcardToSQL converts wildcards as defined in
 // https://matrix.org/docs/spec/client_server/r0.3.0.html#post-matrix-client-r0-user-userid-filter
-// to SQL wildcards that can be used with LIKE()
+// to SQL wildcards that can be used with LIKE(). Any characters which LIKE
+// treats specially are escaped so that they only match themselves, e.g. the
+// "_" in "m.room.power_levels".
 func filterConvertTypeWildcardToSQL(values []string) []string {
 	if values == nil {
 		// Return nil instead of []string{} so IS NULL can work correctly when
@@ -30,7 +32,9 @@ func filterConvertTypeWildcardToSQL(values []string) []string {
 
 	ret := make([]string, len(values))
 	for i := range values {
-		ret[i] = strings.Replace(values[i], "*", "%", -1)
+		ret[i] = likeEscaper.Replace(values[i])
 	}
 	return ret
 }
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%")
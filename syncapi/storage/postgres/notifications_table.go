@@ -0,0 +1,110 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const notificationsSchema = `
+-- Stores the events which notified local users, until the users read them
+CREATE TABLE IF NOT EXISTS syncapi_notifications (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	-- The stream position of the event which notified the user
+	stream_pos BIGINT NOT NULL,
+	-- Whether the event was highlighted for the user
+	highlight BOOLEAN NOT NULL,
+	UNIQUE (user_id, room_id, stream_pos)
+);
+`
+
+const insertNotificationSQL = "" +
+	"INSERT INTO syncapi_notifications (user_id, room_id, stream_pos, highlight)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteNotificationsUpToSQL = "" +
+	"DELETE FROM syncapi_notifications" +
+	" WHERE user_id = $1 AND room_id = $2 AND stream_pos <= $3"
+
+const selectNotificationCountsSQL = "" +
+	"SELECT room_id, COUNT(*), SUM(CASE WHEN highlight THEN 1 ELSE 0 END) FROM syncapi_notifications" +
+	" WHERE user_id = $1 GROUP BY room_id"
+
+type notificationsStatements struct {
+	insertNotificationStmt       *sql.Stmt
+	deleteNotificationsUpToStmt  *sql.Stmt
+	selectNotificationCountsStmt *sql.Stmt
+}
+
+func NewPostgresNotificationsTable(db *sql.DB) (tables.Notifications, error) {
+	_, err := db.Exec(notificationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &notificationsStatements{}
+	if s.insertNotificationStmt, err = db.Prepare(insertNotificationSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertNotification statement: %w", err)
+	}
+	if s.deleteNotificationsUpToStmt, err = db.Prepare(deleteNotificationsUpToSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteNotificationsUpTo statement: %w", err)
+	}
+	if s.selectNotificationCountsStmt, err = db.Prepare(selectNotificationCountsSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectNotificationCounts statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *notificationsStatements) InsertNotification(
+	ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition, highlight bool,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertNotificationStmt).ExecContext(ctx, userID, roomID, pos, highlight)
+	return err
+}
+
+func (s *notificationsStatements) DeleteNotificationsUpTo(
+	ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteNotificationsUpToStmt).ExecContext(ctx, userID, roomID, pos)
+	return err
+}
+
+func (s *notificationsStatements) SelectNotificationCounts(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (map[string]types.NotificationCounts, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectNotificationCountsStmt).QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectNotificationCounts: rows.close() failed")
+	result := make(map[string]types.NotificationCounts)
+	for rows.Next() {
+		var roomID string
+		var counts types.NotificationCounts
+		if err = rows.Scan(&roomID, &counts.NotificationCount, &counts.HighlightCount); err != nil {
+			return nil, err
+		}
+		result[roomID] = counts
+	}
+	return result, rows.Err()
+}
@@ -76,6 +76,9 @@ const selectMaxPositionInTopologySQL = "" +
 const deleteTopologyForRoomSQL = "" +
 	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
 
+const deleteEventFromTopologySQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE event_id = $1"
+
 type outputRoomEventsTopologyStatements struct {
 	insertEventInTopologyStmt       *sql.Stmt
 	selectEventIDsInRangeASCStmt    *sql.Stmt
@@ -83,6 +86,7 @@ type outputRoomEventsTopologyStatements struct {
 	selectPositionInTopologyStmt    *sql.Stmt
 	selectMaxPositionInTopologyStmt *sql.Stmt
 	deleteTopologyForRoomStmt       *sql.Stmt
+	deleteEventFromTopologyStmt     *sql.Stmt
 }
 
 func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
@@ -109,6 +113,9 @@ func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if s.deleteTopologyForRoomStmt, err = db.Prepare(deleteTopologyForRoomSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteEventFromTopologyStmt, err = db.Prepare(deleteEventFromTopologySQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -183,3 +190,10 @@ func (s *outputRoomEventsTopologyStatements) DeleteTopologyForRoom(
 	_, err = sqlutil.TxStmt(txn, s.deleteTopologyForRoomStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+func (s *outputRoomEventsTopologyStatements) DeleteEventFromTopology(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteEventFromTopologyStmt).ExecContext(ctx, eventID)
+	return err
+}
@@ -52,6 +52,7 @@ const upsertReceipt = "" +
 	" VALUES ($1, $2, $3, $4, $5)" +
 	" ON CONFLICT (room_id, receipt_type, user_id)" +
 	" DO UPDATE SET id = nextval('syncapi_receipt_id'), event_id = $4, receipt_ts = $5" +
+	" WHERE syncapi_receipts.event_id <> $4" +
 	" RETURNING id"
 
 const selectRoomReceipts = "" +
@@ -92,6 +93,10 @@ func NewPostgresReceiptsTable(db *sql.DB) (tables.Receipts, error) {
 func (r *receiptStatements) UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error) {
 	stmt := sqlutil.TxStmt(txn, r.upsertReceipt)
 	err = stmt.QueryRowContext(ctx, roomId, receiptType, userId, eventId, timestamp).Scan(&pos)
+	if err == sql.ErrNoRows {
+		// The receipt was already for this event, so nothing was updated.
+		return 0, nil
+	}
 	return
 }
 
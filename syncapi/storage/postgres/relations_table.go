@@ -0,0 +1,201 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const relationsSchema = `
+-- Stores the relationships of events to earlier events, e.g. reactions and edits
+CREATE TABLE IF NOT EXISTS syncapi_relations (
+	event_id TEXT NOT NULL PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	event_type TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	origin_server_ts BIGINT NOT NULL,
+	-- The stream position of the event
+	stream_pos BIGINT NOT NULL,
+	-- The type of the relationship, e.g. m.annotation
+	rel_type TEXT NOT NULL,
+	-- The ID of the event which this event relates to
+	relates_to TEXT NOT NULL,
+	-- The aggregation key of an annotation, e.g. the emoji of a reaction
+	aggregation_key TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS syncapi_relations_relates_to_idx ON syncapi_relations(relates_to, stream_pos);
+`
+
+const insertRelationSQL = "" +
+	"INSERT INTO syncapi_relations (event_id, room_id, event_type, sender, origin_server_ts, stream_pos, rel_type, relates_to, aggregation_key)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteRelationSQL = "" +
+	"DELETE FROM syncapi_relations WHERE event_id = $1"
+
+const selectRelationsSQL = "" +
+	"SELECT event_id, room_id, event_type, sender, origin_server_ts, stream_pos, rel_type, relates_to, aggregation_key" +
+	" FROM syncapi_relations"
+
+const selectRelationsInRangeASCSQL = "" + selectRelationsSQL +
+	" WHERE relates_to = $1 AND ($2 = '' OR rel_type = $2) AND ($3 = '' OR event_type = $3)" +
+	" AND stream_pos > $4 AND stream_pos <= $5" +
+	" ORDER BY stream_pos ASC LIMIT $6"
+
+const selectRelationsInRangeDESCSQL = "" + selectRelationsSQL +
+	" WHERE relates_to = $1 AND ($2 = '' OR rel_type = $2) AND ($3 = '' OR event_type = $3)" +
+	" AND stream_pos > $4 AND stream_pos <= $5" +
+	" ORDER BY stream_pos DESC LIMIT $6"
+
+const selectRelationsForEventsSQL = "" + selectRelationsSQL +
+	" WHERE relates_to = ANY($1) ORDER BY stream_pos ASC"
+
+const selectRelationSQL = "" + selectRelationsSQL +
+	" WHERE event_id = $1"
+
+const selectRelationCountSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_relations WHERE relates_to = $1 AND rel_type = $2"
+
+type relationsStatements struct {
+	insertRelationStmt             *sql.Stmt
+	deleteRelationStmt             *sql.Stmt
+	selectRelationsInRangeASCStmt  *sql.Stmt
+	selectRelationsInRangeDESCStmt *sql.Stmt
+	selectRelationStmt             *sql.Stmt
+	selectRelationCountStmt        *sql.Stmt
+	selectRelationsForEventsStmt   *sql.Stmt
+}
+
+func NewPostgresRelationsTable(db *sql.DB) (tables.Relations, error) {
+	_, err := db.Exec(relationsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &relationsStatements{}
+	if s.insertRelationStmt, err = db.Prepare(insertRelationSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertRelation statement: %w", err)
+	}
+	if s.deleteRelationStmt, err = db.Prepare(deleteRelationSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteRelation statement: %w", err)
+	}
+	if s.selectRelationsInRangeASCStmt, err = db.Prepare(selectRelationsInRangeASCSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRelationsInRangeASC statement: %w", err)
+	}
+	if s.selectRelationsInRangeDESCStmt, err = db.Prepare(selectRelationsInRangeDESCSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRelationsInRangeDESC statement: %w", err)
+	}
+	if s.selectRelationStmt, err = db.Prepare(selectRelationSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRelation statement: %w", err)
+	}
+	if s.selectRelationCountStmt, err = db.Prepare(selectRelationCountSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRelationCount statement: %w", err)
+	}
+	if s.selectRelationsForEventsStmt, err = db.Prepare(selectRelationsForEventsSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectRelationsForEvents statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *relationsStatements) InsertRelation(
+	ctx context.Context, txn *sql.Tx, relation *types.Relation,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertRelationStmt).ExecContext(
+		ctx, relation.EventID, relation.RoomID, relation.EventType, relation.Sender, relation.OriginServerTS,
+		relation.StreamPos, relation.RelType, relation.RelatesTo, relation.Key,
+	)
+	return err
+}
+
+func (s *relationsStatements) DeleteRelation(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteRelationStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *relationsStatements) SelectRelationsInRange(
+	ctx context.Context, txn *sql.Tx, relatesTo, relType, eventType string, r types.Range, limit int,
+) ([]types.Relation, error) {
+	stmt := s.selectRelationsInRangeASCStmt
+	if r.Backwards {
+		stmt = s.selectRelationsInRangeDESCStmt
+	}
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(ctx, relatesTo, relType, eventType, r.Low(), r.High(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRelationsInRange: rows.close() failed")
+	return rowsToRelations(rows)
+}
+
+func (s *relationsStatements) SelectRelationsForEvents(
+	ctx context.Context, txn *sql.Tx, eventIDs []string,
+) ([]types.Relation, error) {
+	if len(eventIDs) == 0 {
+		return nil, nil
+	}
+	rows, err := sqlutil.TxStmt(txn, s.selectRelationsForEventsStmt).QueryContext(ctx, pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRelationsForEvents: rows.close() failed")
+	return rowsToRelations(rows)
+}
+
+func (s *relationsStatements) SelectRelation(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (*types.Relation, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRelationStmt).QueryContext(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectRelation: rows.close() failed")
+	relations, err := rowsToRelations(rows)
+	if err != nil || len(relations) == 0 {
+		return nil, err
+	}
+	return &relations[0], nil
+}
+
+func (s *relationsStatements) SelectRelationCount(
+	ctx context.Context, txn *sql.Tx, relatesTo, relType string,
+) (count int, err error) {
+	err = sqlutil.TxStmt(txn, s.selectRelationCountStmt).QueryRowContext(ctx, relatesTo, relType).Scan(&count)
+	return
+}
+
+func rowsToRelations(rows *sql.Rows) ([]types.Relation, error) {
+	var relations []types.Relation
+	for rows.Next() {
+		var r types.Relation
+		if err := rows.Scan(
+			&r.EventID, &r.RoomID, &r.EventType, &r.Sender, &r.OriginServerTS,
+			&r.StreamPos, &r.RelType, &r.RelatesTo, &r.Key,
+		); err != nil {
+			return nil, err
+		}
+		relations = append(relations, r)
+	}
+	return relations, rows.Err()
+}
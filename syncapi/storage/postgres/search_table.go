@@ -0,0 +1,144 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const searchSchema = `
+-- Stores the full-text search index of events
+CREATE TABLE IF NOT EXISTS syncapi_search (
+	event_id TEXT NOT NULL PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	-- The key of the event which was indexed, e.g. content.body
+	key TEXT NOT NULL,
+	-- The stream position of the event
+	stream_pos BIGINT NOT NULL,
+	vector TSVECTOR NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_vector_idx ON syncapi_search USING GIN (vector);
+CREATE INDEX IF NOT EXISTS syncapi_search_room_id_idx ON syncapi_search(room_id);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search (event_id, room_id, key, stream_pos, vector)" +
+	" VALUES ($1, $2, $3, $4, to_tsvector('english', $5))" +
+	" ON CONFLICT DO NOTHING"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search WHERE event_id = $1"
+
+const deleteSearchEventsForRoomSQL = "" +
+	"DELETE FROM syncapi_search WHERE room_id = $1"
+
+const selectSearchByRankSQL = "" +
+	"SELECT event_id, room_id, stream_pos, ts_rank_cd(vector, query) AS rank, COUNT(*) OVER ()" +
+	" FROM syncapi_search, plainto_tsquery('english', $1) query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY rank DESC, stream_pos DESC LIMIT $4 OFFSET $5"
+
+const selectSearchByRecentSQL = "" +
+	"SELECT event_id, room_id, stream_pos, ts_rank_cd(vector, query) AS rank, COUNT(*) OVER ()" +
+	" FROM syncapi_search, plainto_tsquery('english', $1) query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY stream_pos DESC LIMIT $4 OFFSET $5"
+
+type searchStatements struct {
+	insertSearchEventStmt         *sql.Stmt
+	deleteSearchEventStmt         *sql.Stmt
+	deleteSearchEventsForRoomStmt *sql.Stmt
+	selectSearchByRankStmt        *sql.Stmt
+	selectSearchByRecentStmt      *sql.Stmt
+}
+
+func NewPostgresSearchTable(db *sql.DB) (tables.Search, error) {
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &searchStatements{}
+	if s.insertSearchEventStmt, err = db.Prepare(insertSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertSearchEvent statement: %w", err)
+	}
+	if s.deleteSearchEventStmt, err = db.Prepare(deleteSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchEvent statement: %w", err)
+	}
+	if s.deleteSearchEventsForRoomStmt, err = db.Prepare(deleteSearchEventsForRoomSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchEventsForRoom statement: %w", err)
+	}
+	if s.selectSearchByRankStmt, err = db.Prepare(selectSearchByRankSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectSearchByRank statement: %w", err)
+	}
+	if s.selectSearchByRecentStmt, err = db.Prepare(selectSearchByRecentSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectSearchByRecent statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx, pos types.StreamPosition, eventID, roomID, key, value string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertSearchEventStmt).ExecContext(ctx, eventID, roomID, key, pos, value)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteSearchEventStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEventsForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteSearchEventsForRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *searchStatements) SelectSearch(
+	ctx context.Context, txn *sql.Tx, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	stmt := s.selectSearchByRecentStmt
+	if orderByRank {
+		stmt = s.selectSearchByRankStmt
+	}
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(
+		ctx, searchTerm, pq.StringArray(roomIDs), pq.StringArray(keys), limit, offset,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectSearch: rows.close() failed")
+	var results []types.SearchResult
+	var count int
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.RoomID, &result.StreamPos, &result.Rank, &count); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
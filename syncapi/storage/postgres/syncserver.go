@@ -90,6 +90,26 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 	if err != nil {
 		return nil, err
 	}
+	presence, err := NewPostgresPresenceTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	notifications, err := NewPostgresNotificationsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	search, err := NewPostgresSearchTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	relations, err := NewPostgresRelationsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	threads, err := NewPostgresThreadsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadFixSequences(m)
 	deltas.LoadRemoveSendToDeviceSentColumn(m)
@@ -110,6 +130,11 @@ func NewDatabase(dbProperties *config.DatabaseOptions) (*SyncServerDatasource, e
 		SendToDevice:        sendToDevice,
 		Receipts:            receipts,
 		Memberships:         memberships,
+		Presence:            presence,
+		Notifications:       notifications,
+		Search:              search,
+		Relations:           relations,
+		Threads:             threads,
 	}
 	return &d, nil
 }
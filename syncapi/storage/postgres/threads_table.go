@@ -0,0 +1,119 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const threadsSchema = `
+-- Stores the latest event of each thread, so that threads can be listed by activity
+CREATE TABLE IF NOT EXISTS syncapi_threads (
+	root_event_id TEXT NOT NULL PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	-- The sender of the root event, or empty if it isn't known
+	root_sender TEXT NOT NULL,
+	latest_event_id TEXT NOT NULL,
+	-- The stream position of the latest event in the thread
+	latest_stream_pos BIGINT NOT NULL,
+	-- The number of events in the thread, excluding the root
+	count BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_threads_room_id_idx ON syncapi_threads(room_id, latest_stream_pos);
+`
+
+const upsertThreadSQL = "" +
+	"INSERT INTO syncapi_threads (root_event_id, room_id, root_sender, latest_event_id, latest_stream_pos, count)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (root_event_id) DO UPDATE SET latest_event_id = $4, latest_stream_pos = $5, count = $6," +
+	" root_sender = CASE WHEN syncapi_threads.root_sender = '' THEN $3 ELSE syncapi_threads.root_sender END"
+
+const deleteThreadSQL = "" +
+	"DELETE FROM syncapi_threads WHERE root_event_id = $1"
+
+const selectThreadsSQL = "" +
+	"SELECT root_event_id, room_id, root_sender, latest_event_id, latest_stream_pos, count FROM syncapi_threads t" +
+	" WHERE room_id = $1 AND latest_stream_pos < $2 AND ($3 = '' OR root_sender = $3 OR EXISTS (" +
+	"SELECT 1 FROM syncapi_relations r WHERE r.relates_to = t.root_event_id AND r.rel_type = 'm.thread' AND r.sender = $3" +
+	")) ORDER BY latest_stream_pos DESC LIMIT $4"
+
+type threadsStatements struct {
+	upsertThreadStmt  *sql.Stmt
+	deleteThreadStmt  *sql.Stmt
+	selectThreadsStmt *sql.Stmt
+}
+
+func NewPostgresThreadsTable(db *sql.DB) (tables.Threads, error) {
+	_, err := db.Exec(threadsSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &threadsStatements{}
+	if s.upsertThreadStmt, err = db.Prepare(upsertThreadSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertThread statement: %w", err)
+	}
+	if s.deleteThreadStmt, err = db.Prepare(deleteThreadSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteThread statement: %w", err)
+	}
+	if s.selectThreadsStmt, err = db.Prepare(selectThreadsSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectThreads statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *threadsStatements) UpsertThread(
+	ctx context.Context, txn *sql.Tx, thread *types.Thread,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertThreadStmt).ExecContext(
+		ctx, thread.RootEventID, thread.RoomID, thread.RootSender, thread.LatestEventID, thread.LatestStreamPos, thread.Count,
+	)
+	return err
+}
+
+func (s *threadsStatements) DeleteThread(
+	ctx context.Context, txn *sql.Tx, rootEventID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteThreadStmt).ExecContext(ctx, rootEventID)
+	return err
+}
+
+func (s *threadsStatements) SelectThreads(
+	ctx context.Context, txn *sql.Tx, roomID, participant string, before types.StreamPosition, limit int,
+) ([]types.Thread, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectThreadsStmt).QueryContext(ctx, roomID, before, participant, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectThreads: rows.close() failed")
+	var threads []types.Thread
+	for rows.Next() {
+		var thread types.Thread
+		if err = rows.Scan(
+			&thread.RootEventID, &thread.RoomID, &thread.RootSender,
+			&thread.LatestEventID, &thread.LatestStreamPos, &thread.Count,
+		); err != nil {
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+	return threads, rows.Err()
+}
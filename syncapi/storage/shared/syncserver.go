@@ -19,6 +19,9 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
 
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -31,6 +34,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
 	log "github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // Database is a temporary struct until we have made syncserver.go the same for both pq/sqlite
@@ -49,6 +53,11 @@ type Database struct {
 	Filter              tables.Filter
 	Receipts            tables.Receipts
 	Memberships         tables.Memberships
+	Presence            tables.Presence
+	Notifications       tables.Notifications
+	Search              tables.Search
+	Relations           tables.Relations
+	Threads             tables.Threads
 }
 
 func (d *Database) readOnlySnapshot(ctx context.Context) (*sql.Tx, error) {
@@ -103,6 +112,14 @@ func (d *Database) MaxStreamPositionForAccountData(ctx context.Context) (types.S
 	return types.StreamPosition(id), nil
 }
 
+func (d *Database) MaxStreamPositionForPresence(ctx context.Context) (types.StreamPosition, error) {
+	id, err := d.Presence.SelectMaxPresenceID(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("d.Presence.SelectMaxPresenceID: %w", err)
+	}
+	return types.StreamPosition(id), nil
+}
+
 func (d *Database) CurrentState(ctx context.Context, roomID string, stateFilterPart *gomatrixserverlib.StateFilter, excludeEventIDs []string) ([]*gomatrixserverlib.HeaderedEvent, error) {
 	return d.CurrentRoomState.SelectCurrentState(ctx, nil, roomID, stateFilterPart, excludeEventIDs)
 }
@@ -131,6 +148,10 @@ func (d *Database) RoomReceiptsAfter(ctx context.Context, roomIDs []string, stre
 	return d.Receipts.SelectRoomReceiptsAfter(ctx, roomIDs, streamPos)
 }
 
+func (d *Database) PresenceInRange(ctx context.Context, r types.Range) (types.StreamPosition, []userapi.Presence, error) {
+	return d.Presence.SelectPresenceInRange(ctx, nil, r)
+}
+
 // Events lookups a list of event by their event ID.
 // Returns a list of events matching the requested IDs found in the database.
 // If an event is not found in the database then it will be omitted from the list.
@@ -275,11 +296,13 @@ func (d *Database) DeletePeeks(
 // updated between two given positions
 // Returns a map following the format data[roomID] = []dataTypes
 // If no data is retrieved, returns an empty map
+// Also returns the position up to which data was returned, which is before
+// the end of the range if there was more data than the filter's limit
 // If there was an issue with the retrieval, returns an error
 func (d *Database) GetAccountDataInRange(
 	ctx context.Context, userID string, r types.Range,
 	accountDataFilterPart *gomatrixserverlib.EventFilter,
-) (map[string][]string, error) {
+) (map[string][]string, types.StreamPosition, error) {
 	return d.AccountData.SelectAccountDataInRange(ctx, userID, r, accountDataFilterPart)
 }
 
@@ -368,6 +391,28 @@ func (d *Database) PurgeRoomState(
 	})
 }
 
+func (d *Database) PurgeEvents(
+	ctx context.Context, eventIDs []string,
+) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		for _, eventID := range eventIDs {
+			if err := d.OutputEvents.DeleteEvent(ctx, txn, eventID); err != nil {
+				return fmt.Errorf("d.OutputEvents.DeleteEvent: %w", err)
+			}
+			if err := d.Topology.DeleteEventFromTopology(ctx, txn, eventID); err != nil {
+				return fmt.Errorf("d.Topology.DeleteEventFromTopology: %w", err)
+			}
+			if err := d.Search.DeleteSearchEvent(ctx, txn, eventID); err != nil {
+				return fmt.Errorf("d.Search.DeleteSearchEvent: %w", err)
+			}
+			if err := d.Relations.DeleteRelation(ctx, txn, eventID); err != nil {
+				return fmt.Errorf("d.Relations.DeleteRelation: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
 func (d *Database) WriteEvent(
 	ctx context.Context,
 	ev *gomatrixserverlib.HeaderedEvent,
@@ -393,6 +438,20 @@ func (d *Database) WriteEvent(
 			return fmt.Errorf("d.handleBackwardExtremities: %w", err)
 		}
 
+		if err = d.indexEventForSearch(ctx, txn, ev.Unwrap(), pos); err != nil {
+			return fmt.Errorf("d.indexEventForSearch: %w", err)
+		}
+		if relation := relationFromEvent(ev.Unwrap(), pos); relation != nil {
+			if err = d.Relations.InsertRelation(ctx, txn, relation); err != nil {
+				return fmt.Errorf("d.Relations.InsertRelation: %w", err)
+			}
+			if relation.RelType == types.RelTypeThread {
+				if err = d.updateThread(ctx, txn, relation.RoomID, relation.RelatesTo); err != nil {
+					return fmt.Errorf("d.updateThread: %w", err)
+				}
+			}
+		}
+
 		if len(addStateEvents) == 0 && len(removeStateEventIDs) == 0 {
 			// Nothing to do, the event may have just been a message event.
 			return nil
@@ -541,7 +600,26 @@ func (d *Database) RedactEvent(ctx context.Context, redactedEventID string, reda
 
 	newEvent := ev.Headered(redactedBecause.RoomVersion)
 	err = d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
-		return d.OutputEvents.UpdateEventJSON(ctx, newEvent)
+		if err = d.OutputEvents.UpdateEventJSON(ctx, newEvent); err != nil {
+			return err
+		}
+		// The redacted content mustn't be found by searches, and a redacted
+		// event no longer relates to anything, e.g. a redacted reaction
+		// isn't counted.
+		if err = d.Search.DeleteSearchEvent(ctx, txn, redactedEventID); err != nil {
+			return err
+		}
+		relation, err := d.Relations.SelectRelation(ctx, txn, redactedEventID)
+		if err != nil || relation == nil {
+			return err
+		}
+		if err = d.Relations.DeleteRelation(ctx, txn, redactedEventID); err != nil {
+			return err
+		}
+		if relation.RelType == types.RelTypeThread {
+			return d.updateThread(ctx, txn, relation.RoomID, relation.RelatesTo)
+		}
+		return nil
 	})
 	return err
 }
@@ -919,10 +997,10 @@ func (d *Database) SendToDeviceUpdatesForSync(
 
 func (d *Database) CleanSendToDeviceUpdates(
 	ctx context.Context,
-	userID, deviceID string, before types.StreamPosition,
+	userID, deviceID string, acknowledged types.StreamPosition,
 ) (err error) {
 	if err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, userID, deviceID, before)
+		return d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, userID, deviceID, acknowledged)
 	}); err != nil {
 		logrus.WithError(err).Errorf("Failed to clean up old send-to-device messages for user %q device %q", userID, deviceID)
 		return err
@@ -956,3 +1034,363 @@ func (d *Database) GetRoomReceipts(ctx context.Context, roomIDs []string, stream
 	_, receipts, err := d.Receipts.SelectRoomReceiptsAfter(ctx, roomIDs, streamPos)
 	return receipts, err
 }
+
+// StorePresence stores the latest presence of a user
+func (d *Database) StorePresence(ctx context.Context, presence *userapi.Presence) (pos types.StreamPosition, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		pos, err = d.Presence.UpsertPresence(ctx, txn, presence)
+		return err
+	})
+	return
+}
+
+// StoreNotification records that the event at the stream position notified
+// the user.
+func (d *Database) StoreNotification(ctx context.Context, userID, roomID string, pos types.StreamPosition, highlight bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Notifications.InsertNotification(ctx, txn, userID, roomID, pos, highlight)
+	})
+}
+
+// ClearNotifications removes the user's notifications in the room for events
+// up to and including the stream position.
+func (d *Database) ClearNotifications(ctx context.Context, userID, roomID string, pos types.StreamPosition) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Notifications.DeleteNotificationsUpTo(ctx, txn, userID, roomID, pos)
+	})
+}
+
+// NotificationCounts returns the user's unread notification counts, keyed by
+// room ID. Rooms without unread notifications are not included.
+func (d *Database) NotificationCounts(ctx context.Context, userID string) (map[string]types.NotificationCounts, error) {
+	return d.Notifications.SelectNotificationCounts(ctx, nil, userID)
+}
+
+// indexEventForSearch adds the searchable key of the event to the full-text
+// search index, if it has one.
+func (d *Database) indexEventForSearch(ctx context.Context, txn *sql.Tx, ev *gomatrixserverlib.Event, pos types.StreamPosition) error {
+	for key, eventType := range types.SearchKeys {
+		if ev.Type() != eventType {
+			continue
+		}
+		value := gjson.GetBytes(ev.Content(), strings.TrimPrefix(key, "content.")).Str
+		if value == "" {
+			return nil
+		}
+		return d.Search.InsertSearchEvent(ctx, txn, pos, ev.EventID(), ev.RoomID(), key, value)
+	}
+	return nil
+}
+
+// SearchEvents returns the events in the rooms which match the full-text
+// search, along with the total number of matching events.
+func (d *Database) SearchEvents(
+	ctx context.Context, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	return d.Search.SelectSearch(ctx, nil, searchTerm, roomIDs, keys, orderByRank, limit, offset)
+}
+
+// ReindexSearch rebuilds the full-text search index of the room from the
+// events which are already stored, e.g. those which were stored before
+// search was supported.
+func (d *Database) ReindexSearch(ctx context.Context, roomID string) error {
+	eventTypes := make([]string, 0, len(types.SearchKeys))
+	for _, eventType := range types.SearchKeys {
+		eventTypes = append(eventTypes, eventType)
+	}
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.Search.DeleteSearchEventsForRoom(ctx, txn, roomID); err != nil {
+			return fmt.Errorf("d.Search.DeleteSearchEventsForRoom: %w", err)
+		}
+		maxID, err := d.OutputEvents.SelectMaxEventID(ctx, txn)
+		if err != nil {
+			return fmt.Errorf("d.OutputEvents.SelectMaxEventID: %w", err)
+		}
+		filter := &gomatrixserverlib.RoomEventFilter{
+			Limit: 100,
+			Types: eventTypes,
+		}
+		// Work backwards through the room, a batch of events at a time.
+		r := types.Range{From: types.StreamPosition(maxID), To: 0, Backwards: true}
+		for {
+			events, limited, err := d.OutputEvents.SelectRecentEvents(ctx, txn, roomID, r, filter, false, false)
+			if err != nil {
+				return fmt.Errorf("d.OutputEvents.SelectRecentEvents: %w", err)
+			}
+			for _, ev := range events {
+				if err = d.indexEventForSearch(ctx, txn, ev.Unwrap(), ev.StreamPosition); err != nil {
+					return fmt.Errorf("d.indexEventForSearch: %w", err)
+				}
+			}
+			if !limited || len(events) == 0 {
+				return nil
+			}
+			r.From = events[len(events)-1].StreamPosition - 1
+		}
+	})
+}
+
+// relationFromEvent returns the relationship of the event to an earlier event
+// in the room, or nil if it doesn't have one.
+func relationFromEvent(ev *gomatrixserverlib.Event, pos types.StreamPosition) *types.Relation {
+	relatesTo := gjson.GetBytes(ev.Content(), `m\.relates_to`)
+	relType, eventID := relatesTo.Get("rel_type").Str, relatesTo.Get("event_id").Str
+	if relType == "" || eventID == "" {
+		return nil
+	}
+	return &types.Relation{
+		EventID:        ev.EventID(),
+		RoomID:         ev.RoomID(),
+		EventType:      ev.Type(),
+		Sender:         ev.Sender(),
+		OriginServerTS: ev.OriginServerTS(),
+		StreamPos:      pos,
+		RelType:        relType,
+		RelatesTo:      eventID,
+		Key:            relatesTo.Get("key").Str,
+	}
+}
+
+// updateThread updates the latest event and the number of events of the
+// thread with the given root, or removes the thread if it no longer has any.
+func (d *Database) updateThread(ctx context.Context, txn *sql.Tx, roomID, rootEventID string) error {
+	count, err := d.Relations.SelectRelationCount(ctx, txn, rootEventID, types.RelTypeThread)
+	if err != nil {
+		return fmt.Errorf("d.Relations.SelectRelationCount: %w", err)
+	}
+	if count == 0 {
+		return d.Threads.DeleteThread(ctx, txn, rootEventID)
+	}
+	latest, err := d.Relations.SelectRelationsInRange(ctx, txn, rootEventID, types.RelTypeThread, "", types.Range{
+		From:      types.StreamPosition(math.MaxInt64),
+		Backwards: true,
+	}, 1)
+	if err != nil {
+		return fmt.Errorf("d.Relations.SelectRelationsInRange: %w", err)
+	}
+	if len(latest) == 0 {
+		return nil
+	}
+	// The root may not have been received yet, in which case the sender is
+	// filled in by a later update.
+	var rootSender string
+	roots, err := d.OutputEvents.SelectEvents(ctx, txn, []string{rootEventID})
+	if err != nil {
+		return fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+	}
+	if len(roots) > 0 {
+		rootSender = roots[0].Sender()
+	}
+	return d.Threads.UpsertThread(ctx, txn, &types.Thread{
+		RoomID:          roomID,
+		RootEventID:     rootEventID,
+		RootSender:      rootSender,
+		LatestEventID:   latest[0].EventID,
+		LatestStreamPos: latest[0].StreamPos,
+		Count:           count,
+	})
+}
+
+// RoomThreads returns up to limit threads in the room whose latest event is before
+// the position, most recently active first. If participant isn't empty then
+// only the threads which the user started or replied to are returned.
+func (d *Database) RoomThreads(
+	ctx context.Context, roomID, participant string, before types.StreamPosition, limit int,
+) ([]types.Thread, error) {
+	return d.Threads.SelectThreads(ctx, nil, roomID, participant, before, limit)
+}
+
+// RelatedEvents returns up to limit events in the range which relate to the
+// event, optionally only those of the given relation and event types.
+func (d *Database) RelatedEvents(
+	ctx context.Context, relatesTo, relType, eventType string, r types.Range, limit int,
+) ([]types.StreamEvent, error) {
+	relations, err := d.Relations.SelectRelationsInRange(ctx, nil, relatesTo, relType, eventType, r, limit)
+	if err != nil {
+		return nil, fmt.Errorf("d.Relations.SelectRelationsInRange: %w", err)
+	}
+	eventIDs := make([]string, len(relations))
+	for i := range relations {
+		eventIDs[i] = relations[i].EventID
+	}
+	events, err := d.OutputEvents.SelectEvents(ctx, nil, eventIDs)
+	if err != nil {
+		return nil, fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+	}
+	// Return the events in the same order as the relations.
+	eventsByID := make(map[string]types.StreamEvent, len(events))
+	for _, ev := range events {
+		eventsByID[ev.EventID()] = ev
+	}
+	result := make([]types.StreamEvent, 0, len(events))
+	for _, eventID := range eventIDs {
+		if ev, ok := eventsByID[eventID]; ok {
+			result = append(result, ev)
+		}
+	}
+	return result, nil
+}
+
+type bundledRelations struct {
+	Annotations *bundledAnnotations `json:"m.annotation,omitempty"`
+	References  *bundledReferences  `json:"m.reference,omitempty"`
+	Replace     *bundledReplace     `json:"m.replace,omitempty"`
+	Thread      *bundledThread      `json:"m.thread,omitempty"`
+}
+
+type bundledAnnotations struct {
+	Chunk []bundledAnnotation `json:"chunk"`
+}
+
+type bundledAnnotation struct {
+	Type  string `json:"type"`
+	Key   string `json:"key"`
+	Count int    `json:"count"`
+}
+
+type bundledReferences struct {
+	Chunk []bundledReference `json:"chunk"`
+}
+
+type bundledReference struct {
+	EventID string `json:"event_id"`
+}
+
+type bundledReplace struct {
+	EventID        string                      `json:"event_id"`
+	OriginServerTS gomatrixserverlib.Timestamp `json:"origin_server_ts"`
+	Sender         string                      `json:"sender"`
+}
+
+type bundledThread struct {
+	LatestEvent             *gomatrixserverlib.ClientEvent `json:"latest_event"`
+	Count                   int                            `json:"count"`
+	CurrentUserParticipated bool                           `json:"current_user_participated"`
+	latestEventID           string
+}
+
+// BundleAggregations adds the aggregations of the events which relate to
+// each of the events to their unsigned m.relations key: the number of
+// each annotation, the IDs of references, the latest edit and a summary of
+// the thread, if the event is the root of one, from the point of view of the
+// user.
+func (d *Database) BundleAggregations(ctx context.Context, userID string, events []*gomatrixserverlib.HeaderedEvent) error {
+	if len(events) == 0 {
+		return nil
+	}
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	relations, err := d.Relations.SelectRelationsForEvents(ctx, nil, eventIDs)
+	if err != nil {
+		return fmt.Errorf("d.Relations.SelectRelationsForEvents: %w", err)
+	}
+	if len(relations) == 0 {
+		return nil
+	}
+	relationsByEvent := make(map[string][]types.Relation)
+	for _, relation := range relations {
+		relationsByEvent[relation.RelatesTo] = append(relationsByEvent[relation.RelatesTo], relation)
+	}
+	for _, ev := range events {
+		related, ok := relationsByEvent[ev.EventID()]
+		if !ok {
+			continue
+		}
+		bundled := aggregateRelations(ev, userID, related)
+		if bundled == (bundledRelations{}) {
+			continue
+		}
+		if bundled.Thread != nil {
+			latest, err := d.OutputEvents.SelectEvents(ctx, nil, []string{bundled.Thread.latestEventID})
+			if err != nil {
+				return fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+			}
+			if len(latest) > 0 {
+				clientEvent := gomatrixserverlib.HeaderedToClientEvent(latest[0].HeaderedEvent, gomatrixserverlib.FormatAll)
+				bundled.Thread.LatestEvent = &clientEvent
+			}
+		}
+		if err = ev.SetUnsignedField("m\\.relations", bundled); err != nil {
+			return fmt.Errorf("ev.SetUnsignedField: %w", err)
+		}
+	}
+	return nil
+}
+
+// aggregateRelations aggregates the relations to the event. An annotation is
+// only counted once per sender, and only edits by the sender of the event
+// replace it, the latest of which is the one with the highest timestamp, or
+// event ID if the timestamps are the same. The latest event of a thread is
+// the one with the highest stream position, and the user participated in it
+// if they sent the root or any event in it.
+func aggregateRelations(ev *gomatrixserverlib.HeaderedEvent, userID string, relations []types.Relation) (bundled bundledRelations) {
+	type annotation struct{ eventType, key string }
+	annotators := make(map[annotation]map[string]bool)
+	var annotations []annotation
+	var replace *types.Relation
+	for i, relation := range relations {
+		if relation.RoomID != ev.RoomID() {
+			continue
+		}
+		switch relation.RelType {
+		case types.RelTypeAnnotation:
+			if relation.Key == "" {
+				continue
+			}
+			a := annotation{relation.EventType, relation.Key}
+			if annotators[a] == nil {
+				annotators[a] = make(map[string]bool)
+				annotations = append(annotations, a)
+			}
+			annotators[a][relation.Sender] = true
+		case types.RelTypeReference:
+			if bundled.References == nil {
+				bundled.References = &bundledReferences{}
+			}
+			bundled.References.Chunk = append(bundled.References.Chunk, bundledReference{relation.EventID})
+		case types.RelTypeReplace:
+			if relation.Sender != ev.Sender() {
+				continue
+			}
+			if replace == nil || relation.OriginServerTS > replace.OriginServerTS ||
+				(relation.OriginServerTS == replace.OriginServerTS && relation.EventID > replace.EventID) {
+				replace = &relations[i]
+			}
+		case types.RelTypeThread:
+			if bundled.Thread == nil {
+				bundled.Thread = &bundledThread{
+					CurrentUserParticipated: ev.Sender() == userID,
+				}
+			}
+			bundled.Thread.Count++
+			bundled.Thread.latestEventID = relation.EventID
+			if relation.Sender == userID {
+				bundled.Thread.CurrentUserParticipated = true
+			}
+		}
+	}
+	if len(annotations) > 0 {
+		bundled.Annotations = &bundledAnnotations{}
+		for _, a := range annotations {
+			bundled.Annotations.Chunk = append(bundled.Annotations.Chunk, bundledAnnotation{
+				Type:  a.eventType,
+				Key:   a.key,
+				Count: len(annotators[a]),
+			})
+		}
+		// The most popular annotations come first.
+		sort.SliceStable(bundled.Annotations.Chunk, func(i, j int) bool {
+			return bundled.Annotations.Chunk[i].Count > bundled.Annotations.Chunk[j].Count
+		})
+	}
+	if replace != nil {
+		bundled.Replace = &bundledReplace{
+			EventID:        replace.EventID,
+			OriginServerTS: replace.OriginServerTS,
+			Sender:         replace.Sender,
+		}
+	}
+	return bundled
+}
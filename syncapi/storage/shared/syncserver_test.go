@@ -0,0 +1,60 @@
+package shared
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestAggregateRelations(t *testing.T) {
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"event_id": "$original",
+		"room_id": "!room:localhost",
+		"sender": "@alice:localhost",
+		"type": "m.room.message",
+		"content": {"msgtype": "m.text", "body": "hello"},
+		"origin_server_ts": 1,
+		"depth": 1,
+		"auth_events": [],
+		"prev_events": []
+	}`), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to make event: %s", err)
+	}
+	relation := func(eventID, sender, relType, key string, ts gomatrixserverlib.Timestamp) types.Relation {
+		return types.Relation{
+			EventID: eventID, RoomID: "!room:localhost", EventType: "m.reaction", Sender: sender,
+			OriginServerTS: ts, RelType: relType, RelatesTo: "$original", Key: key,
+		}
+	}
+	bundled := aggregateRelations(ev.Headered(gomatrixserverlib.RoomVersionV1), "@charlie:localhost", []types.Relation{
+		relation("$r1", "@bob:localhost", types.RelTypeAnnotation, "👎", 2),
+		relation("$r2", "@bob:localhost", types.RelTypeAnnotation, "👍", 2),
+		relation("$r3", "@charlie:localhost", types.RelTypeAnnotation, "👍", 2),
+		// A second identical reaction from the same user isn't counted.
+		relation("$r4", "@charlie:localhost", types.RelTypeAnnotation, "👍", 3),
+		relation("$ref", "@bob:localhost", types.RelTypeReference, "", 3),
+		// Only the latest edit of the sender replaces the event.
+		relation("$e1", "@alice:localhost", types.RelTypeReplace, "", 5),
+		relation("$e2", "@alice:localhost", types.RelTypeReplace, "", 4),
+		relation("$e3", "@bob:localhost", types.RelTypeReplace, "", 6),
+		relation("$t1", "@charlie:localhost", types.RelTypeThread, "", 7),
+		relation("$t2", "@bob:localhost", types.RelTypeThread, "", 8),
+	})
+	got, err := json.Marshal(bundled)
+	if err != nil {
+		t.Fatalf("failed to marshal bundled relations: %s", err)
+	}
+	want := `{"m.annotation":{"chunk":[{"type":"m.reaction","key":"👍","count":2},{"type":"m.reaction","key":"👎","count":1}]},` +
+		`"m.reference":{"chunk":[{"event_id":"$ref"}]},` +
+		`"m.replace":{"event_id":"$e1","origin_server_ts":5,"sender":"@alice:localhost"},` +
+		`"m.thread":{"latest_event":null,"count":2,"current_user_participated":true}}`
+	if string(got) != want {
+		t.Errorf("got bundled relations %s, want %s", got, want)
+	}
+	if bundled.Thread.latestEventID != "$t2" {
+		t.Errorf("got latest thread event %s, want $t2", bundled.Thread.latestEventID)
+	}
+}
@@ -18,6 +18,7 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -42,19 +43,18 @@ const insertAccountDataSQL = "" +
 	" SET id = $5"
 
 const selectAccountDataInRangeSQL = "" +
-	"SELECT room_id, type FROM syncapi_account_data_type" +
-	" WHERE user_id = $1 AND id > $2 AND id <= $3" +
-	" ORDER BY id ASC"
+	"SELECT id, room_id, type FROM syncapi_account_data_type" +
+	" WHERE user_id = $1 AND id > $2 AND id <= $3"
+	// WHERE, ORDER BY and LIMIT are appended by prepareWithFilters
 
 const selectMaxAccountDataIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_account_data_type"
 
 type accountDataStatements struct {
-	db                           *sql.DB
-	streamIDStatements           *streamIDStatements
-	insertAccountDataStmt        *sql.Stmt
-	selectMaxAccountDataIDStmt   *sql.Stmt
-	selectAccountDataInRangeStmt *sql.Stmt
+	db                         *sql.DB
+	streamIDStatements         *streamIDStatements
+	insertAccountDataStmt      *sql.Stmt
+	selectMaxAccountDataIDStmt *sql.Stmt
 }
 
 func NewSqliteAccountDataTable(db *sql.DB, streamID *streamIDStatements) (tables.AccountData, error) {
@@ -72,9 +72,6 @@ func NewSqliteAccountDataTable(db *sql.DB, streamID *streamIDStatements) (tables
 	if s.selectMaxAccountDataIDStmt, err = db.Prepare(selectMaxAccountDataIDSQL); err != nil {
 		return nil, err
 	}
-	if s.selectAccountDataInRangeStmt, err = db.Prepare(selectAccountDataInRangeSQL); err != nil {
-		return nil, err
-	}
 	return s, nil
 }
 
@@ -95,53 +92,45 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 	userID string,
 	r types.Range,
 	accountDataFilterPart *gomatrixserverlib.EventFilter,
-) (data map[string][]string, err error) {
+) (data map[string][]string, pos types.StreamPosition, err error) {
 	data = make(map[string][]string)
 
-	rows, err := s.selectAccountDataInRangeStmt.QueryContext(ctx, userID, r.Low(), r.High())
+	stmt, params, err := prepareWithFilters(
+		s.db, nil, selectAccountDataInRangeSQL,
+		[]interface{}{
+			userID, r.Low(), r.High(),
+		},
+		nil, nil,
+		accountDataFilterPart.Types, accountDataFilterPart.NotTypes,
+		nil, accountDataFilterPart.Limit, FilterOrderAsc,
+	)
+	if err != nil {
+		return nil, 0, fmt.Errorf("s.prepareWithFilters: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "selectAccountDataInRange: stmt.close() failed")
+
+	rows, err := stmt.QueryContext(ctx, params...)
 	if err != nil {
 		return
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "selectAccountDataInRange: rows.close() failed")
 
 	var entries int
-
 	for rows.Next() {
 		var dataType string
 		var roomID string
 
-		if err = rows.Scan(&roomID, &dataType); err != nil {
+		if err = rows.Scan(&pos, &roomID, &dataType); err != nil {
 			return
 		}
-
-		// check if we should add this by looking at the filter.
-		// It would be nice if we could do this in SQL-land, but the mix of variadic
-		// and positional parameters makes the query annoyingly hard to do, it's easier
-		// and clearer to do it in Go-land. If there are no filters for [not]types then
-		// this gets skipped.
-		for _, includeType := range accountDataFilterPart.Types {
-			if includeType != dataType { // TODO: wildcard support
-				continue
-			}
-		}
-		for _, excludeType := range accountDataFilterPart.NotTypes {
-			if excludeType == dataType { // TODO: wildcard support
-				continue
-			}
-		}
-
-		if len(data[roomID]) > 0 {
-			data[roomID] = append(data[roomID], dataType)
-		} else {
-			data[roomID] = []string{dataType}
-		}
+		data[roomID] = append(data[roomID], dataType)
 		entries++
-		if entries >= accountDataFilterPart.Limit {
-			break
-		}
 	}
-
-	return data, nil
+	// If the limit wasn't reached then everything in the range was returned.
+	if entries == 0 || entries < accountDataFilterPart.Limit {
+		pos = r.High()
+	}
+	return data, pos, rows.Err()
 }
 
 func (s *accountDataStatements) SelectMaxAccountDataID(
@@ -0,0 +1,83 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestSelectAccountDataInRange(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open(sqlutil.SQLiteDriverName(), ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint:errcheck
+	var streamID streamIDStatements
+	if err = streamID.prepare(db); err != nil {
+		t.Fatalf("failed to prepare stream IDs: %s", err)
+	}
+	table, err := NewSqliteAccountDataTable(db, &streamID)
+	if err != nil {
+		t.Fatalf("failed to create account data table: %s", err)
+	}
+
+	const userID = "@alice:localhost"
+	for _, data := range []struct{ roomID, dataType string }{
+		{"", "m.push_rules"},
+		{"!room:localhost", "m.tag"},
+		{"", "im.vector.setting"},
+		{"!room:localhost", "m.fully_read"},
+	} {
+		if _, err = table.InsertAccountData(ctx, nil, userID, data.roomID, data.dataType); err != nil {
+			t.Fatalf("InsertAccountData failed: %s", err)
+		}
+	}
+	if _, err = table.InsertAccountData(ctx, nil, "@bob:localhost", "", "m.push_rules"); err != nil {
+		t.Fatalf("InsertAccountData failed: %s", err)
+	}
+
+	r := types.Range{From: 0, To: 10}
+	for _, tc := range []struct {
+		name    string
+		filter  gomatrixserverlib.EventFilter
+		want    map[string][]string
+		wantPos types.StreamPosition
+	}{
+		{
+			name:    "everything",
+			filter:  gomatrixserverlib.EventFilter{Limit: 10},
+			want:    map[string][]string{"": {"m.push_rules", "im.vector.setting"}, "!room:localhost": {"m.tag", "m.fully_read"}},
+			wantPos: 10,
+		},
+		{
+			name:    "limited",
+			filter:  gomatrixserverlib.EventFilter{Limit: 2},
+			want:    map[string][]string{"": {"m.push_rules"}, "!room:localhost": {"m.tag"}},
+			wantPos: 2,
+		},
+		{
+			name:    "type wildcard",
+			filter:  gomatrixserverlib.EventFilter{Limit: 10, Types: []string{"m.*"}, NotTypes: []string{"m.tag"}},
+			want:    map[string][]string{"": {"m.push_rules"}, "!room:localhost": {"m.fully_read"}},
+			wantPos: 10,
+		},
+	} {
+		filter := tc.filter
+		data, pos, err := table.SelectAccountDataInRange(ctx, userID, r, &filter)
+		if err != nil {
+			t.Fatalf("%s: SelectAccountDataInRange failed: %s", tc.name, err)
+		}
+		if !reflect.DeepEqual(data, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, data, tc.want)
+		}
+		if pos != tc.wantPos {
+			t.Errorf("%s: got position %d, want %d", tc.name, pos, tc.wantPos)
+		}
+	}
+}
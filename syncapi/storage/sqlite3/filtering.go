@@ -3,6 +3,7 @@ package sqlite3
 import (
 	"database/sql"
 	"fmt"
+	"strings"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 )
@@ -42,14 +43,14 @@ func prepareWithFilters(
 		}
 	}
 	if count := len(types); count > 0 {
-		query += " AND type IN " + sqlutil.QueryVariadicOffset(count, offset)
-		for _, v := range types {
+		query += " AND (" + filterTypeGlobClause(count, offset) + ")"
+		for _, v := range filterConvertTypeWildcardToGlob(types) {
 			params, offset = append(params, v), offset+1
 		}
 	}
 	if count := len(nottypes); count > 0 {
-		query += " AND type NOT IN " + sqlutil.QueryVariadicOffset(count, offset)
-		for _, v := range nottypes {
+		query += " AND NOT (" + filterTypeGlobClause(count, offset) + ")"
+		for _, v := range filterConvertTypeWildcardToGlob(nottypes) {
 			params, offset = append(params, v), offset+1
 		}
 	}
@@ -80,3 +81,28 @@ func prepareWithFilters(
 	}
 	return stmt, params, nil
 }
+
+// filterTypeGlobClause returns an SQL condition which matches the type column
+// against any of count GLOB patterns, numbered from offset+1.
+func filterTypeGlobClause(count, offset int) string {
+	clauses := make([]string, count)
+	for i := range clauses {
+		clauses[i] = fmt.Sprintf("type GLOB $%d", offset+i+1)
+	}
+	return strings.Join(clauses, " OR ")
+}
+
+// filterConvertTypeWildcardToGlob converts wildcards as defined in
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#post-matrix-client-r0-user-userid-filter
+// to patterns that can be used with GLOB. GLOB is used rather than LIKE as
+// it is case-sensitive, like event types are. Any other characters which
+// GLOB treats specially are escaped so that they only match themselves.
+func filterConvertTypeWildcardToGlob(values []string) []string {
+	ret := make([]string, len(values))
+	for i := range values {
+		ret[i] = globEscaper.Replace(values[i])
+	}
+	return ret
+}
+
+var globEscaper = strings.NewReplacer("?", "[?]", "[", "[[]")
@@ -0,0 +1,87 @@
+package sqlite3
+
+import (
+	"database/sql"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func TestPrepareWithFiltersTypeWildcards(t *testing.T) {
+	db, err := sql.Open(sqlutil.SQLiteDriverName(), ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint:errcheck
+	if _, err = db.Exec("CREATE TABLE events (id INTEGER PRIMARY KEY, type TEXT NOT NULL)"); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	for _, eventType := range []string{
+		"m.room.message", "m.room.member", "m.room.power_levels", "m.room.powerXlevels",
+		"M.ROOM.MESSAGE", "m.reaction", "org.example[1]", "org.example?",
+	} {
+		if _, err = db.Exec("INSERT INTO events (type) VALUES ($1)", eventType); err != nil {
+			t.Fatalf("failed to insert event: %s", err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		types    []string
+		nottypes []string
+		want     []string
+	}{
+		{
+			name:  "wildcard types",
+			types: []string{"m.room.*"},
+			want:  []string{"m.room.member", "m.room.message", "m.room.powerXlevels", "m.room.power_levels"},
+		},
+		{
+			name:     "wildcard not_types",
+			nottypes: []string{"m.room.*"},
+			want:     []string{"M.ROOM.MESSAGE", "m.reaction", "org.example?", "org.example[1]"},
+		},
+		{
+			name:     "types and not_types",
+			types:    []string{"m.*"},
+			nottypes: []string{"m.room.member", "m.reaction"},
+			want:     []string{"m.room.message", "m.room.powerXlevels", "m.room.power_levels"},
+		},
+		{
+			name:  "special characters match literally",
+			types: []string{"m.room.power_levels", "org.example[1]", "org.example?"},
+			want:  []string{"m.room.power_levels", "org.example?", "org.example[1]"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stmt, params, err := prepareWithFilters(
+				db, nil, "SELECT type FROM events WHERE id > $1", []interface{}{0},
+				nil, nil, tc.types, tc.nottypes, nil, 100, FilterOrderAsc,
+			)
+			if err != nil {
+				t.Fatalf("prepareWithFilters failed: %s", err)
+			}
+			defer stmt.Close() // nolint:errcheck
+			rows, err := stmt.Query(params...)
+			if err != nil {
+				t.Fatalf("query failed: %s", err)
+			}
+			defer rows.Close() // nolint:errcheck
+			var got []string
+			for rows.Next() {
+				var eventType string
+				if err = rows.Scan(&eventType); err != nil {
+					t.Fatalf("scan failed: %s", err)
+				}
+				got = append(got, eventType)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func TestNotificationCounts(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open(sqlutil.SQLiteDriverName(), ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint:errcheck
+	table, err := NewSqliteNotificationsTable(db)
+	if err != nil {
+		t.Fatalf("failed to create notifications table: %s", err)
+	}
+
+	userID, room1, room2 := "@alice:localhost", "!room1:localhost", "!room2:localhost"
+	for i, highlight := range []bool{false, true, false} {
+		if err = table.InsertNotification(ctx, nil, userID, room1, types.StreamPosition(i+1), highlight); err != nil {
+			t.Fatalf("InsertNotification failed: %s", err)
+		}
+	}
+	if err = table.InsertNotification(ctx, nil, userID, room2, 4, true); err != nil {
+		t.Fatalf("InsertNotification failed: %s", err)
+	}
+
+	counts, err := table.SelectNotificationCounts(ctx, nil, userID)
+	if err != nil {
+		t.Fatalf("SelectNotificationCounts failed: %s", err)
+	}
+	if got, want := counts[room1], (types.NotificationCounts{NotificationCount: 3, HighlightCount: 1}); got != want {
+		t.Errorf("got counts %+v for room 1, want %+v", got, want)
+	}
+
+	// Reading up to the highlighted event clears it and everything before it.
+	if err = table.DeleteNotificationsUpTo(ctx, nil, userID, room1, 2); err != nil {
+		t.Fatalf("DeleteNotificationsUpTo failed: %s", err)
+	}
+	counts, err = table.SelectNotificationCounts(ctx, nil, userID)
+	if err != nil {
+		t.Fatalf("SelectNotificationCounts failed: %s", err)
+	}
+	if got, want := counts[room1], (types.NotificationCounts{NotificationCount: 1}); got != want {
+		t.Errorf("got counts %+v for room 1, want %+v", got, want)
+	}
+	if got, want := counts[room2], (types.NotificationCounts{NotificationCount: 1, HighlightCount: 1}); got != want {
+		t.Errorf("got counts %+v for room 2, want %+v", got, want)
+	}
+}
@@ -90,6 +90,9 @@ const selectStateInRangeSQL = "" +
 const deleteEventsForRoomSQL = "" +
 	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
 
+const deleteEventSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE event_id = $1"
+
 type outputRoomEventsStatements struct {
 	db                      *sql.DB
 	streamIDStatements      *streamIDStatements
@@ -98,6 +101,7 @@ type outputRoomEventsStatements struct {
 	selectMaxEventIDStmt    *sql.Stmt
 	updateEventJSONStmt     *sql.Stmt
 	deleteEventsForRoomStmt *sql.Stmt
+	deleteEventStmt         *sql.Stmt
 }
 
 func NewSqliteEventsTable(db *sql.DB, streamID *streamIDStatements) (tables.Events, error) {
@@ -124,6 +128,9 @@ func NewSqliteEventsTable(db *sql.DB, streamID *streamIDStatements) (tables.Even
 	if s.deleteEventsForRoomStmt, err = db.Prepare(deleteEventsForRoomSQL); err != nil {
 		return nil, err
 	}
+	if s.deleteEventStmt, err = db.Prepare(deleteEventSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -424,6 +431,13 @@ func (s *outputRoomEventsStatements) DeleteEventsForRoom(
 	return err
 }
 
+func (s *outputRoomEventsStatements) DeleteEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) (err error) {
+	_, err = sqlutil.TxStmt(txn, s.deleteEventStmt).ExecContext(ctx, eventID)
+	return err
+}
+
 func rowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
 	var result []types.StreamEvent
 	for rows.Next() {
@@ -0,0 +1,134 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+)
+
+const presenceSchema = `
+-- Stores the latest presence of users
+CREATE TABLE IF NOT EXISTS syncapi_presence (
+	-- The ID
+	id BIGINT NOT NULL,
+	user_id TEXT NOT NULL PRIMARY KEY,
+	presence TEXT NOT NULL,
+	status_msg TEXT,
+	last_active_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_presence_id_idx ON syncapi_presence(id);
+`
+
+const upsertPresenceSQL = "" +
+	"INSERT INTO syncapi_presence (id, user_id, presence, status_msg, last_active_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (user_id)" +
+	" DO UPDATE SET id = $1, presence = $3, status_msg = $4, last_active_ts = $5"
+
+const selectPresenceInRangeSQL = "" +
+	"SELECT id, user_id, presence, status_msg, last_active_ts FROM syncapi_presence" +
+	" WHERE id > $1 AND id <= $2"
+
+const selectMaxPresenceIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_presence"
+
+type presenceStatements struct {
+	streamIDStatements        *streamIDStatements
+	upsertPresenceStmt        *sql.Stmt
+	selectPresenceInRangeStmt *sql.Stmt
+	selectMaxPresenceIDStmt   *sql.Stmt
+}
+
+func NewSqlitePresenceTable(db *sql.DB, streamID *streamIDStatements) (tables.Presence, error) {
+	_, err := db.Exec(presenceSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &presenceStatements{
+		streamIDStatements: streamID,
+	}
+	if s.upsertPresenceStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare upsertPresence statement: %w", err)
+	}
+	if s.selectPresenceInRangeStmt, err = db.Prepare(selectPresenceInRangeSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectPresenceInRange statement: %w", err)
+	}
+	if s.selectMaxPresenceIDStmt, err = db.Prepare(selectMaxPresenceIDSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare selectMaxPresenceID statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *presenceStatements) UpsertPresence(
+	ctx context.Context, txn *sql.Tx, presence *userapi.Presence,
+) (pos types.StreamPosition, err error) {
+	pos, err = s.streamIDStatements.nextPresenceID(ctx, txn)
+	if err != nil {
+		return
+	}
+	stmt := sqlutil.TxStmt(txn, s.upsertPresenceStmt)
+	_, err = stmt.ExecContext(
+		ctx, pos, presence.UserID, presence.Presence, presence.StatusMsg, presence.LastActiveTS,
+	)
+	return
+}
+
+func (s *presenceStatements) SelectPresenceInRange(
+	ctx context.Context, txn *sql.Tx, r types.Range,
+) (types.StreamPosition, []userapi.Presence, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectPresenceInRangeStmt).QueryContext(ctx, r.Low(), r.High())
+	if err != nil {
+		return 0, nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectPresenceInRange: rows.close() failed")
+	lastPos := r.Low()
+	var result []userapi.Presence
+	for rows.Next() {
+		var id types.StreamPosition
+		var p userapi.Presence
+		var statusMsg sql.NullString
+		if err = rows.Scan(&id, &p.UserID, &p.Presence, &statusMsg, &p.LastActiveTS); err != nil {
+			return 0, nil, err
+		}
+		if statusMsg.Valid {
+			p.StatusMsg = &statusMsg.String
+		}
+		result = append(result, p)
+		if id > lastPos {
+			lastPos = id
+		}
+	}
+	return lastPos, result, rows.Err()
+}
+
+func (s *presenceStatements) SelectMaxPresenceID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxPresenceIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -48,7 +48,8 @@ const upsertReceipt = "" +
 	" (id, room_id, receipt_type, user_id, event_id, receipt_ts)" +
 	" VALUES ($1, $2, $3, $4, $5, $6)" +
 	" ON CONFLICT (room_id, receipt_type, user_id)" +
-	" DO UPDATE SET id = $7, event_id = $8, receipt_ts = $9"
+	" DO UPDATE SET id = $7, event_id = $8, receipt_ts = $9" +
+	" WHERE syncapi_receipts.event_id <> $8"
 
 const selectRoomReceipts = "" +
 	"SELECT id, room_id, receipt_type, user_id, event_id, receipt_ts" +
@@ -94,7 +95,16 @@ func (r *receiptStatements) UpsertReceipt(ctx context.Context, txn *sql.Tx, room
 		return
 	}
 	stmt := sqlutil.TxStmt(txn, r.upsertReceipt)
-	_, err = stmt.ExecContext(ctx, pos, roomId, receiptType, userId, eventId, timestamp, pos, eventId, timestamp)
+	res, err := stmt.ExecContext(ctx, pos, roomId, receiptType, userId, eventId, timestamp, pos, eventId, timestamp)
+	if err != nil {
+		return 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		// The receipt was already for this event, so nothing was updated.
+		return 0, nil
+	}
 	return
 }
 
@@ -0,0 +1,57 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+func TestUpsertReceiptDeduplicates(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open(sqlutil.SQLiteDriverName(), ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint:errcheck
+	streamID := &streamIDStatements{}
+	if err = streamID.prepare(db); err != nil {
+		t.Fatalf("failed to prepare stream ID table: %s", err)
+	}
+	table, err := NewSqliteReceiptsTable(db, streamID)
+	if err != nil {
+		t.Fatalf("failed to create receipts table: %s", err)
+	}
+
+	roomID, userID := "!room:localhost", "@alice:localhost"
+	first, err := table.UpsertReceipt(ctx, nil, roomID, "m.read", userID, "$event1:localhost", 1)
+	if err != nil {
+		t.Fatalf("UpsertReceipt failed: %s", err)
+	}
+	if first == 0 {
+		t.Fatalf("new receipt got position 0")
+	}
+	again, err := table.UpsertReceipt(ctx, nil, roomID, "m.read", userID, "$event1:localhost", 2)
+	if err != nil {
+		t.Fatalf("UpsertReceipt failed: %s", err)
+	}
+	if again != 0 {
+		t.Errorf("repeated receipt got position %d, want 0", again)
+	}
+	moved, err := table.UpsertReceipt(ctx, nil, roomID, "m.read", userID, "$event2:localhost", 3)
+	if err != nil {
+		t.Fatalf("UpsertReceipt failed: %s", err)
+	}
+	if moved <= first {
+		t.Errorf("moved receipt got position %d, want greater than %d", moved, first)
+	}
+
+	lastPos, receipts, err := table.SelectRoomReceiptsAfter(ctx, []string{roomID}, first)
+	if err != nil {
+		t.Fatalf("SelectRoomReceiptsAfter failed: %s", err)
+	}
+	if lastPos != moved || len(receipts) != 1 || receipts[0].EventID != "$event2:localhost" {
+		t.Errorf("got position %d and receipts %+v, want only the receipt for $event2 at %d", lastPos, receipts, moved)
+	}
+}
@@ -0,0 +1,66 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func TestRelations(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open(sqlutil.SQLiteDriverName(), ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint:errcheck
+	table, err := NewSqliteRelationsTable(db)
+	if err != nil {
+		t.Fatalf("failed to create relations table: %s", err)
+	}
+
+	for i, r := range []types.Relation{
+		{EventID: "$1", EventType: "m.reaction", RelType: types.RelTypeAnnotation, RelatesTo: "$a", Key: "👍"},
+		{EventID: "$2", EventType: "m.room.message", RelType: types.RelTypeReplace, RelatesTo: "$a"},
+		{EventID: "$3", EventType: "m.reaction", RelType: types.RelTypeAnnotation, RelatesTo: "$a", Key: "👎"},
+		{EventID: "$4", EventType: "m.reaction", RelType: types.RelTypeAnnotation, RelatesTo: "$b", Key: "👍"},
+	} {
+		r.RoomID, r.Sender, r.StreamPos = "!room:localhost", "@alice:localhost", types.StreamPosition(i+1)
+		if err = table.InsertRelation(ctx, nil, &r); err != nil {
+			t.Fatalf("InsertRelation failed: %s", err)
+		}
+	}
+
+	assertEventIDs := func(relations []types.Relation, want ...string) {
+		t.Helper()
+		if len(relations) != len(want) {
+			t.Fatalf("got %d relations, want %v", len(relations), want)
+		}
+		for i := range relations {
+			if relations[i].EventID != want[i] {
+				t.Fatalf("got relation %d %s, want %v", i, relations[i].EventID, want)
+			}
+		}
+	}
+	relations, err := table.SelectRelationsInRange(ctx, nil, "$a", "", "", types.Range{From: 10, Backwards: true}, 10)
+	if err != nil {
+		t.Fatalf("SelectRelationsInRange failed: %s", err)
+	}
+	assertEventIDs(relations, "$3", "$2", "$1")
+	relations, err = table.SelectRelationsInRange(ctx, nil, "$a", types.RelTypeAnnotation, "m.reaction", types.Range{From: 1, To: 10}, 1)
+	if err != nil {
+		t.Fatalf("SelectRelationsInRange failed: %s", err)
+	}
+	assertEventIDs(relations, "$3")
+
+	if err = table.DeleteRelation(ctx, nil, "$3"); err != nil {
+		t.Fatalf("DeleteRelation failed: %s", err)
+	}
+	relations, err = table.SelectRelationsForEvents(ctx, nil, []string{"$a", "$b"})
+	if err != nil {
+		t.Fatalf("SelectRelationsForEvents failed: %s", err)
+	}
+	assertEventIDs(relations, "$1", "$2", "$4")
+}
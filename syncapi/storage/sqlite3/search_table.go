@@ -0,0 +1,207 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+// The full-text index is an FTS4 table, as FTS5 isn't built into go-sqlite3
+// by default. Its docid is the ID of the event in syncapi_search_events.
+const searchSchema = `
+-- Stores the events which are in the full-text search index
+CREATE TABLE IF NOT EXISTS syncapi_search_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	event_id TEXT NOT NULL UNIQUE,
+	room_id TEXT NOT NULL,
+	-- The key of the event which was indexed, e.g. content.body
+	key TEXT NOT NULL,
+	-- The stream position of the event
+	stream_pos BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_events_room_id_idx ON syncapi_search_events(room_id);
+CREATE VIRTUAL TABLE IF NOT EXISTS syncapi_search USING fts4(value, tokenize=porter);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search_events (event_id, room_id, key, stream_pos)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT DO NOTHING"
+
+const insertSearchValueSQL = "" +
+	"INSERT INTO syncapi_search (docid, value) VALUES ($1, $2)"
+
+const deleteSearchValueSQL = "" +
+	"DELETE FROM syncapi_search WHERE docid IN (SELECT id FROM syncapi_search_events WHERE event_id = $1)"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search_events WHERE event_id = $1"
+
+const deleteSearchValuesForRoomSQL = "" +
+	"DELETE FROM syncapi_search WHERE docid IN (SELECT id FROM syncapi_search_events WHERE room_id = $1)"
+
+const deleteSearchEventsForRoomSQL = "" +
+	"DELETE FROM syncapi_search_events WHERE room_id = $1"
+
+// The rank of a match is the number of times that the search terms appear in
+// it, which is the number of offsets, each of which is four integers. The
+// offsets have to be found in a subquery, as they can't be used alongside
+// the count.
+const selectSearchSQL = "" +
+	"SELECT e.event_id, e.room_id, e.stream_pos, m.rank, COUNT(*) OVER ()" +
+	" FROM (" +
+	"SELECT docid, (LENGTH(offsets(syncapi_search)) - LENGTH(REPLACE(offsets(syncapi_search), ' ', '')) + 1) / 4 AS rank" +
+	" FROM syncapi_search WHERE syncapi_search MATCH $1" +
+	") m JOIN syncapi_search_events e ON e.id = m.docid" +
+	" WHERE e.room_id IN ($2) AND e.key IN ($3)"
+
+const orderSearchByRankSQL = " ORDER BY m.rank DESC, e.stream_pos DESC"
+
+const orderSearchByRecentSQL = " ORDER BY e.stream_pos DESC"
+
+type searchStatements struct {
+	db                            *sql.DB
+	insertSearchEventStmt         *sql.Stmt
+	insertSearchValueStmt         *sql.Stmt
+	deleteSearchValueStmt         *sql.Stmt
+	deleteSearchEventStmt         *sql.Stmt
+	deleteSearchValuesForRoomStmt *sql.Stmt
+	deleteSearchEventsForRoomStmt *sql.Stmt
+}
+
+func NewSqliteSearchTable(db *sql.DB) (tables.Search, error) {
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	s := &searchStatements{
+		db: db,
+	}
+	if s.insertSearchEventStmt, err = db.Prepare(insertSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertSearchEvent statement: %w", err)
+	}
+	if s.insertSearchValueStmt, err = db.Prepare(insertSearchValueSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare insertSearchValue statement: %w", err)
+	}
+	if s.deleteSearchValueStmt, err = db.Prepare(deleteSearchValueSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchValue statement: %w", err)
+	}
+	if s.deleteSearchEventStmt, err = db.Prepare(deleteSearchEventSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchEvent statement: %w", err)
+	}
+	if s.deleteSearchValuesForRoomStmt, err = db.Prepare(deleteSearchValuesForRoomSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchValuesForRoom statement: %w", err)
+	}
+	if s.deleteSearchEventsForRoomStmt, err = db.Prepare(deleteSearchEventsForRoomSQL); err != nil {
+		return nil, fmt.Errorf("unable to prepare deleteSearchEventsForRoom statement: %w", err)
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx, pos types.StreamPosition, eventID, roomID, key, value string,
+) error {
+	res, err := sqlutil.TxStmt(txn, s.insertSearchEventStmt).ExecContext(ctx, eventID, roomID, key, pos)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		// The event has already been indexed.
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertSearchValueStmt).ExecContext(ctx, id, value)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	if _, err := sqlutil.TxStmt(txn, s.deleteSearchValueStmt).ExecContext(ctx, eventID); err != nil {
+		return err
+	}
+	_, err := sqlutil.TxStmt(txn, s.deleteSearchEventStmt).ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEventsForRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	if _, err := sqlutil.TxStmt(txn, s.deleteSearchValuesForRoomStmt).ExecContext(ctx, roomID); err != nil {
+		return err
+	}
+	_, err := sqlutil.TxStmt(txn, s.deleteSearchEventsForRoomStmt).ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *searchStatements) SelectSearch(
+	ctx context.Context, txn *sql.Tx, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	// Only look up the words of the search, so that it can't be mistaken
+	// for the full-text query syntax. Every word has to match.
+	terms := types.SearchTerms(searchTerm)
+	if len(terms) == 0 || len(roomIDs) == 0 || len(keys) == 0 {
+		return nil, 0, nil
+	}
+	query := strings.Replace(selectSearchSQL, "($2)", sqlutil.QueryVariadicOffset(len(roomIDs), 1), 1)
+	query = strings.Replace(query, "($3)", sqlutil.QueryVariadicOffset(len(keys), 1+len(roomIDs)), 1)
+	if orderByRank {
+		query += orderSearchByRankSQL
+	} else {
+		query += orderSearchByRecentSQL
+	}
+	params := make([]interface{}, 0, 3+len(roomIDs)+len(keys))
+	params = append(params, strings.Join(terms, " "))
+	for _, roomID := range roomIDs {
+		params = append(params, roomID)
+	}
+	for _, key := range keys {
+		params = append(params, key)
+	}
+	query += fmt.Sprintf(" LIMIT $%d OFFSET $%d", len(params)+1, len(params)+2)
+	params = append(params, limit, offset)
+
+	stmt, err := s.db.Prepare(query)
+	if err != nil {
+		return nil, 0, fmt.Errorf("s.db.Prepare: %w", err)
+	}
+	defer internal.CloseAndLogIfError(ctx, stmt, "SelectSearch: stmt.close() failed")
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(ctx, params...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectSearch: rows.close() failed")
+	var results []types.SearchResult
+	var count int
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.RoomID, &result.StreamPos, &result.Rank, &count); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
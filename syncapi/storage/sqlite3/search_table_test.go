@@ -0,0 +1,93 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open(sqlutil.SQLiteDriverName(), ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint:errcheck
+	table, err := NewSqliteSearchTable(db)
+	if err != nil {
+		t.Fatalf("failed to create search table: %s", err)
+	}
+
+	room1, room2 := "!room1:localhost", "!room2:localhost"
+	for i, ev := range []struct {
+		eventID, roomID, key, value string
+	}{
+		{"$1", room1, "content.body", "Hello world"},
+		{"$2", room1, "content.body", "hello hello, is anyone (still) there?"},
+		{"$3", room1, "content.topic", "Saying hello"},
+		{"$4", room2, "content.body", "hello from the other room"},
+		{"$5", room1, "content.body", "goodbye"},
+	} {
+		if err = table.InsertSearchEvent(ctx, nil, types.StreamPosition(i+1), ev.eventID, ev.roomID, ev.key, ev.value); err != nil {
+			t.Fatalf("InsertSearchEvent failed: %s", err)
+		}
+	}
+	// Indexing an event again does nothing.
+	if err = table.InsertSearchEvent(ctx, nil, 1, "$1", room1, "content.body", "Hello world"); err != nil {
+		t.Fatalf("InsertSearchEvent failed: %s", err)
+	}
+
+	search := func(term string, orderByRank bool, limit, offset int) ([]string, int) {
+		t.Helper()
+		results, count, err := table.SelectSearch(ctx, nil, term, []string{room1}, []string{"content.body"}, orderByRank, limit, offset)
+		if err != nil {
+			t.Fatalf("SelectSearch failed: %s", err)
+		}
+		eventIDs := make([]string, len(results))
+		for i := range results {
+			eventIDs[i] = results[i].EventID
+		}
+		return eventIDs, count
+	}
+	assertResults := func(got []string, count int, wantCount int, want ...string) {
+		t.Helper()
+		if count != wantCount {
+			t.Errorf("got count %d, want %d", count, wantCount)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("got results %v, want %v", got, want)
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("got results %v, want %v", got, want)
+			}
+		}
+	}
+
+	got, count := search("HELLO", false, 10, 0)
+	assertResults(got, count, 2, "$2", "$1")
+	got, count = search("hello", true, 10, 0)
+	assertResults(got, count, 2, "$2", "$1")
+	got, count = search("hello world", true, 10, 0)
+	assertResults(got, count, 1, "$1")
+	got, count = search("hello", false, 1, 1)
+	assertResults(got, count, 2, "$1")
+	// Query syntax in the search term is ignored.
+	got, count = search(`"still" OR goodbye*`, false, 10, 0)
+	assertResults(got, count, 0)
+
+	if err = table.DeleteSearchEvent(ctx, nil, "$2"); err != nil {
+		t.Fatalf("DeleteSearchEvent failed: %s", err)
+	}
+	got, count = search("hello", false, 10, 0)
+	assertResults(got, count, 1, "$1")
+
+	if err = table.DeleteSearchEventsForRoom(ctx, nil, room1); err != nil {
+		t.Fatalf("DeleteSearchEventsForRoom failed: %s", err)
+	}
+	got, count = search("hello", false, 10, 0)
+	assertResults(got, count, 0)
+}
@@ -0,0 +1,65 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func TestSelectSendToDeviceMessages(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open(sqlutil.SQLiteDriverName(), ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint:errcheck
+	table, err := NewSqliteSendToDeviceTable(db)
+	if err != nil {
+		t.Fatalf("failed to create send-to-device table: %s", err)
+	}
+
+	userID, deviceID := "@alice:localhost", "ALICE"
+	var last types.StreamPosition
+	for i := 0; i < tables.SendToDeviceMessagesLimit+1; i++ {
+		content := fmt.Sprintf(`{"sender":"@bob:localhost","type":"m.test","content":{"n":%d}}`, i)
+		if last, err = table.InsertSendToDeviceMessage(ctx, nil, userID, deviceID, content); err != nil {
+			t.Fatalf("InsertSendToDeviceMessage failed: %s", err)
+		}
+	}
+	to := last + 10
+
+	// The first sync gets as many messages as allowed, oldest first.
+	pos, events, err := table.SelectSendToDeviceMessages(ctx, nil, userID, deviceID, 0, to)
+	if err != nil {
+		t.Fatalf("SelectSendToDeviceMessages failed: %s", err)
+	}
+	if len(events) != tables.SendToDeviceMessagesLimit {
+		t.Fatalf("got %d messages, want %d", len(events), tables.SendToDeviceMessagesLimit)
+	}
+	if string(events[0].Content) != `{"n":0}` {
+		t.Errorf("first message has content %s, want the oldest", events[0].Content)
+	}
+	if pos != events[len(events)-1].ID {
+		t.Errorf("got position %d, want the position of the last message %d", pos, events[len(events)-1].ID)
+	}
+
+	// Syncing from that position acknowledges those messages.
+	if err = table.DeleteSendToDeviceMessages(ctx, nil, userID, deviceID, pos); err != nil {
+		t.Fatalf("DeleteSendToDeviceMessages failed: %s", err)
+	}
+	pos, events, err = table.SelectSendToDeviceMessages(ctx, nil, userID, deviceID, 0, to)
+	if err != nil {
+		t.Fatalf("SelectSendToDeviceMessages failed: %s", err)
+	}
+	if len(events) != 1 || events[0].ID != last {
+		t.Fatalf("got %+v, want only the last message", events)
+	}
+	if pos != to {
+		t.Errorf("got position %d, want %d as there are no more messages", pos, to)
+	}
+}
@@ -103,6 +103,26 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 	if err != nil {
 		return err
 	}
+	presence, err := NewSqlitePresenceTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	notifications, err := NewSqliteNotificationsTable(d.db)
+	if err != nil {
+		return err
+	}
+	search, err := NewSqliteSearchTable(d.db)
+	if err != nil {
+		return err
+	}
+	relations, err := NewSqliteRelationsTable(d.db)
+	if err != nil {
+		return err
+	}
+	threads, err := NewSqliteThreadsTable(d.db)
+	if err != nil {
+		return err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadFixSequences(m)
 	deltas.LoadRemoveSendToDeviceSentColumn(m)
@@ -123,6 +143,11 @@ func (d *SyncServerDatasource) prepare(dbProperties *config.DatabaseOptions) (er
 		SendToDevice:        sendToDevice,
 		Receipts:            receipts,
 		Memberships:         memberships,
+		Presence:            presence,
+		Notifications:       notifications,
+		Search:              search,
+		Relations:           relations,
+		Threads:             threads,
 	}
 	return nil
 }
@@ -0,0 +1,81 @@
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+func TestThreads(t *testing.T) {
+	ctx := context.Background()
+	db, err := sql.Open(sqlutil.SQLiteDriverName(), ":memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint:errcheck
+	relations, err := NewSqliteRelationsTable(db)
+	if err != nil {
+		t.Fatalf("failed to create relations table: %s", err)
+	}
+	table, err := NewSqliteThreadsTable(db)
+	if err != nil {
+		t.Fatalf("failed to create threads table: %s", err)
+	}
+
+	const roomID = "!room:localhost"
+	if err = relations.InsertRelation(ctx, nil, &types.Relation{
+		EventID: "$reply", RoomID: roomID, EventType: "m.room.message", Sender: "@bob:localhost",
+		StreamPos: 3, RelType: types.RelTypeThread, RelatesTo: "$root1",
+	}); err != nil {
+		t.Fatalf("InsertRelation failed: %s", err)
+	}
+	for _, thread := range []types.Thread{
+		// The sender of the first root isn't known yet, and is filled in by the next update.
+		{RoomID: roomID, RootEventID: "$root1", LatestEventID: "$reply", LatestStreamPos: 3, Count: 1},
+		{RoomID: roomID, RootEventID: "$root1", RootSender: "@alice:localhost", LatestEventID: "$reply", LatestStreamPos: 3, Count: 1},
+		{RoomID: roomID, RootEventID: "$root2", RootSender: "@charlie:localhost", LatestEventID: "$other", LatestStreamPos: 5, Count: 2},
+	} {
+		if err = table.UpsertThread(ctx, nil, &thread); err != nil {
+			t.Fatalf("UpsertThread failed: %s", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		participant string
+		before      types.StreamPosition
+		want        []string
+	}{
+		{"", 10, []string{"$root2", "$root1"}},
+		{"", 5, []string{"$root1"}},
+		{"@alice:localhost", 10, []string{"$root1"}},
+		{"@bob:localhost", 10, []string{"$root1"}},
+		{"@dave:localhost", 10, nil},
+	} {
+		threads, err := table.SelectThreads(ctx, nil, roomID, tc.participant, tc.before, 10)
+		if err != nil {
+			t.Fatalf("SelectThreads failed: %s", err)
+		}
+		if len(threads) != len(tc.want) {
+			t.Fatalf("got %d threads for %q before %d, want %v", len(threads), tc.participant, tc.before, tc.want)
+		}
+		for i := range threads {
+			if threads[i].RootEventID != tc.want[i] {
+				t.Fatalf("got thread %d %s for %q, want %v", i, threads[i].RootEventID, tc.participant, tc.want)
+			}
+		}
+	}
+
+	if err = table.DeleteThread(ctx, nil, "$root2"); err != nil {
+		t.Fatalf("DeleteThread failed: %s", err)
+	}
+	threads, err := table.SelectThreads(ctx, nil, roomID, "", 10, 10)
+	if err != nil {
+		t.Fatalf("SelectThreads failed: %s", err)
+	}
+	if len(threads) != 1 || threads[0].RootEventID != "$root1" {
+		t.Fatalf("got threads %+v after deleting, want $root1", threads)
+	}
+}
@@ -21,13 +21,15 @@ import (
 	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type AccountData interface {
 	InsertAccountData(ctx context.Context, txn *sql.Tx, userID, roomID, dataType string) (pos types.StreamPosition, err error)
-	// SelectAccountDataInRange returns a map of room ID to a list of `dataType`.
-	SelectAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataEventFilter *gomatrixserverlib.EventFilter) (data map[string][]string, err error)
+	// SelectAccountDataInRange returns a map of room ID to a list of `dataType`, and the position
+	// up to which data was returned, which is before the end of the range if the limit was reached.
+	SelectAccountDataInRange(ctx context.Context, userID string, r types.Range, accountDataEventFilter *gomatrixserverlib.EventFilter) (data map[string][]string, pos types.StreamPosition, err error)
 	SelectMaxAccountDataID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
@@ -63,6 +65,8 @@ type Events interface {
 	UpdateEventJSON(ctx context.Context, event *gomatrixserverlib.HeaderedEvent) error
 	// DeleteEventsForRoom removes all event information for a room. This should only be done when removing the room entirely.
 	DeleteEventsForRoom(ctx context.Context, txn *sql.Tx, roomID string) (err error)
+	// DeleteEvent removes a single event, e.g. when it has been purged because of the room's retention policy.
+	DeleteEvent(ctx context.Context, txn *sql.Tx, eventID string) (err error)
 }
 
 // Topology keeps track of the depths and stream positions for all events.
@@ -82,6 +86,8 @@ type Topology interface {
 	SelectMaxPositionInTopology(ctx context.Context, txn *sql.Tx, roomID string) (depth types.StreamPosition, spos types.StreamPosition, err error)
 	// DeleteTopologyForRoom removes all topological information for a room. This should only be done when removing the room entirely.
 	DeleteTopologyForRoom(ctx context.Context, txn *sql.Tx, roomID string) (err error)
+	// DeleteEventFromTopology removes a single event from the topology of its room.
+	DeleteEventFromTopology(ctx context.Context, txn *sql.Tx, eventID string) (err error)
 }
 
 type CurrentRoomState interface {
@@ -145,6 +151,10 @@ type BackwardsExtremities interface {
 // the recorded one, we drop the entry from the DB as it's "sent". If the
 // sync parameter isn't later then we will keep including the updates in the
 // sync response, as the client is seemingly trying to repeat the same /sync.
+// SendToDeviceMessagesLimit is the most send-to-device messages that are
+// selected at once. If there are more then the rest are sent in later syncs.
+const SendToDeviceMessagesLimit = 100
+
 type SendToDevice interface {
 	InsertSendToDeviceMessage(ctx context.Context, txn *sql.Tx, userID, deviceID, content string) (pos types.StreamPosition, err error)
 	SelectSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, from, to types.StreamPosition) (lastPos types.StreamPosition, events []types.SendToDeviceEvent, err error)
@@ -158,11 +168,83 @@ type Filter interface {
 }
 
 type Receipts interface {
+	// UpsertReceipt stores the receipt and returns its new stream position. If
+	// the user's receipt of this type was already for the same event then
+	// nothing is changed and the returned position is 0.
 	UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId string, timestamp gomatrixserverlib.Timestamp) (pos types.StreamPosition, err error)
 	SelectRoomReceiptsAfter(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []eduAPI.OutputReceiptEvent, error)
 	SelectMaxReceiptID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
+type Presence interface {
+	// UpsertPresence stores the latest presence of the user and returns its
+	// new stream position.
+	UpsertPresence(ctx context.Context, txn *sql.Tx, presence *userapi.Presence) (pos types.StreamPosition, err error)
+	// SelectPresenceInRange returns the latest presence of every user whose
+	// presence changed in the range, and the position of the latest change.
+	SelectPresenceInRange(ctx context.Context, txn *sql.Tx, r types.Range) (types.StreamPosition, []userapi.Presence, error)
+	SelectMaxPresenceID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+type Notifications interface {
+	// InsertNotification records that the event at the stream position
+	// notified the user.
+	InsertNotification(ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition, highlight bool) error
+	// DeleteNotificationsUpTo removes the user's notifications in the room
+	// for events up to and including the stream position.
+	DeleteNotificationsUpTo(ctx context.Context, txn *sql.Tx, userID, roomID string, pos types.StreamPosition) error
+	// SelectNotificationCounts returns the user's notification counts for
+	// every room in which they have unread notifications.
+	SelectNotificationCounts(ctx context.Context, txn *sql.Tx, userID string) (map[string]types.NotificationCounts, error)
+}
+
+type Search interface {
+	// InsertSearchEvent indexes the value of the key of the event, e.g. the
+	// body of a message. Indexing an event more than once does nothing.
+	InsertSearchEvent(ctx context.Context, txn *sql.Tx, pos types.StreamPosition, eventID, roomID, key, value string) error
+	// DeleteSearchEvent removes the event from the index, e.g. when it is redacted.
+	DeleteSearchEvent(ctx context.Context, txn *sql.Tx, eventID string) error
+	// DeleteSearchEventsForRoom removes all of the events in the room from the index.
+	DeleteSearchEventsForRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	// SelectSearch returns up to limit events in the given rooms whose given
+	// keys match the search term, skipping the first offset, along with the
+	// total number of matching events. Results are ordered by rank if
+	// orderByRank is true, otherwise the most recent events come first.
+	SelectSearch(ctx context.Context, txn *sql.Tx, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int) (results []types.SearchResult, count int, err error)
+}
+
+type Relations interface {
+	// InsertRelation records the relationship of an event to an earlier
+	// event. Inserting the relation of an event more than once does nothing.
+	InsertRelation(ctx context.Context, txn *sql.Tx, relation *types.Relation) error
+	// DeleteRelation removes the relation of the event, e.g. when it is redacted.
+	DeleteRelation(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SelectRelationsInRange returns up to limit relations to the event in
+	// the range, optionally only those of the given relation and event types
+	// if they aren't empty. Relations are ordered from the latest if the
+	// range is backwards, otherwise from the earliest.
+	SelectRelationsInRange(ctx context.Context, txn *sql.Tx, relatesTo, relType, eventType string, r types.Range, limit int) ([]types.Relation, error)
+	// SelectRelationsForEvents returns all of the relations to the given events.
+	SelectRelationsForEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.Relation, error)
+	// SelectRelation returns the relation of the event, or nil if it doesn't have one.
+	SelectRelation(ctx context.Context, txn *sql.Tx, eventID string) (*types.Relation, error)
+	// SelectRelationCount returns the number of relations of the type to the event.
+	SelectRelationCount(ctx context.Context, txn *sql.Tx, relatesTo, relType string) (int, error)
+}
+
+type Threads interface {
+	// UpsertThread stores the latest event and count of the thread. The
+	// sender of the root event is kept once it is known.
+	UpsertThread(ctx context.Context, txn *sql.Tx, thread *types.Thread) error
+	// DeleteThread removes the thread, e.g. when its only event is redacted.
+	DeleteThread(ctx context.Context, txn *sql.Tx, rootEventID string) error
+	// SelectThreads returns up to limit threads in the room whose latest
+	// events are before the stream position, latest first. If participant
+	// isn't empty then only threads which they sent the root of or an event
+	// in are returned.
+	SelectThreads(ctx context.Context, txn *sql.Tx, roomID, participant string, before types.StreamPosition, limit int) ([]types.Thread, error)
+}
+
 type Memberships interface {
 	UpsertMembership(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, streamPos, topologicalPos types.StreamPosition) error
 	SelectMembership(ctx context.Context, txn *sql.Tx, roomID, userID, memberships []string) (eventID string, streamPos, topologyPos types.StreamPosition, err error)
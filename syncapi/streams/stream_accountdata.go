@@ -74,30 +74,31 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 	}
 	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
 
-	dataTypes, err := p.DB.GetAccountDataInRange(
+	dataTypes, pos, err := p.DB.GetAccountDataInRange(
 		ctx, req.Device.UserID, r, &accountDataFilter,
 	)
 	if err != nil {
 		req.Log.WithError(err).Error("p.DB.GetAccountDataInRange failed")
 		return from
 	}
+	if len(dataTypes) == 0 {
+		return pos
+	}
+
+	// Request the current data for all of the changed types at once.
+	dataReq := userapi.QueryAccountDataRequest{
+		UserID: req.Device.UserID,
+	}
+	dataRes := userapi.QueryAccountDataResponse{}
+	if err = p.userAPI.QueryAccountData(ctx, &dataReq, &dataRes); err != nil {
+		req.Log.WithError(err).Error("p.userAPI.QueryAccountData failed")
+		return from
+	}
 
 	// Iterate over the rooms
 	for roomID, dataTypes := range dataTypes {
-		// Request the missing data from the database
-		for _, dataType := range dataTypes {
-			dataReq := userapi.QueryAccountDataRequest{
-				UserID:   req.Device.UserID,
-				RoomID:   roomID,
-				DataType: dataType,
-			}
-			dataRes := userapi.QueryAccountDataResponse{}
-			err = p.userAPI.QueryAccountData(ctx, &dataReq, &dataRes)
-			if err != nil {
-				req.Log.WithError(err).Error("p.userAPI.QueryAccountData failed")
-				continue
-			}
-			if roomID == "" {
+		if roomID == "" {
+			for _, dataType := range dataTypes {
 				if globalData, ok := dataRes.GlobalAccountData[dataType]; ok {
 					req.Response.AccountData.Events = append(
 						req.Response.AccountData.Events,
@@ -107,24 +108,32 @@ func (p *AccountDataStreamProvider) IncrementalSync(
 						},
 					)
 				}
-			} else {
-				if roomData, ok := dataRes.RoomAccountData[roomID][dataType]; ok {
-					joinData := *types.NewJoinResponse()
-					if existing, ok := req.Response.Rooms.Join[roomID]; ok {
-						joinData = existing
-					}
-					joinData.AccountData.Events = append(
-						joinData.AccountData.Events,
-						gomatrixserverlib.ClientEvent{
-							Type:    dataType,
-							Content: gomatrixserverlib.RawJSON(roomData),
-						},
-					)
-					req.Response.Rooms.Join[roomID] = joinData
-				}
 			}
+			continue
+		}
+		// Room account data, e.g. tags, is only sent for joined rooms.
+		if req.Rooms[roomID] != gomatrixserverlib.Join {
+			continue
+		}
+		var events []gomatrixserverlib.ClientEvent
+		for _, dataType := range dataTypes {
+			if roomData, ok := dataRes.RoomAccountData[roomID][dataType]; ok {
+				events = append(events, gomatrixserverlib.ClientEvent{
+					Type:    dataType,
+					Content: gomatrixserverlib.RawJSON(roomData),
+				})
+			}
+		}
+		if len(events) == 0 {
+			continue
+		}
+		joinData := *types.NewJoinResponse()
+		if existing, ok := req.Response.Rooms.Join[roomID]; ok {
+			joinData = existing
 		}
+		joinData.AccountData.Events = append(joinData.AccountData.Events, events...)
+		req.Response.Rooms.Join[roomID] = joinData
 	}
 
-	return to
+	return pos
 }
@@ -49,6 +49,9 @@ func (p *InviteStreamProvider) IncrementalSync(
 	}
 
 	for roomID, inviteEvent := range invites {
+		if req.IgnoredUsers.IsIgnored(inviteEvent.Sender()) {
+			continue
+		}
 		ir := types.NewInviteResponse(inviteEvent)
 		req.Response.Rooms.Invite[roomID] = *ir
 	}
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -23,8 +24,9 @@ const PDU_STREAM_QUEUESIZE = PDU_STREAM_WORKERS * 8
 type PDUStreamProvider struct {
 	StreamProvider
 
-	tasks   chan func()
-	workers atomic.Int32
+	tasks         chan func()
+	workers       atomic.Int32
+	lazyLoadCache *internal.LazyLoadCache
 }
 
 func (p *PDUStreamProvider) worker() {
@@ -87,6 +89,10 @@ func (p *PDUStreamProvider) CompleteSync(
 	stateFilter := req.Filter.Room.State
 	eventFilter := req.Filter.Room.Timeline
 
+	// The device is starting from scratch, so it doesn't have any of the
+	// membership events that we might have sent to it before.
+	p.lazyLoadCache.Reset(req.Device)
+
 	// Build up a /sync response. Add joined rooms.
 	var reqMutex sync.Mutex
 	var reqWaitGroup sync.WaitGroup
@@ -98,7 +104,7 @@ func (p *PDUStreamProvider) CompleteSync(
 
 			var jr *types.JoinResponse
 			jr, err = p.getJoinResponseForCompleteSync(
-				ctx, roomID, r, &stateFilter, &eventFilter, req.WantFullState, req.Device,
+				ctx, roomID, r, &stateFilter, &eventFilter, req.WantFullState, req.IgnoredUsers, req.Device,
 			)
 			if err != nil {
 				req.Log.WithError(err).Error("p.getJoinResponseForCompleteSync failed")
@@ -114,7 +120,10 @@ func (p *PDUStreamProvider) CompleteSync(
 
 	reqWaitGroup.Wait()
 
-	// Add peeked rooms.
+	// Add peeked rooms. Guests only see the rooms which they have joined.
+	if req.Device.AccountType == userapi.AccountTypeGuest {
+		return to
+	}
 	peeks, err := p.DB.PeeksInRange(ctx, req.Device.UserID, req.Device.ID, r)
 	if err != nil {
 		req.Log.WithError(err).Error("p.DB.PeeksInRange failed")
@@ -124,7 +133,7 @@ func (p *PDUStreamProvider) CompleteSync(
 		if !peek.Deleted {
 			var jr *types.JoinResponse
 			jr, err = p.getJoinResponseForCompleteSync(
-				ctx, peek.RoomID, r, &stateFilter, &eventFilter, req.WantFullState, req.Device,
+				ctx, peek.RoomID, r, &stateFilter, &eventFilter, req.WantFullState, req.IgnoredUsers, req.Device,
 			)
 			if err != nil {
 				req.Log.WithError(err).Error("p.getJoinResponseForCompleteSync failed")
@@ -173,7 +182,11 @@ func (p *PDUStreamProvider) IncrementalSync(
 	}
 
 	for _, delta := range stateDeltas {
-		if err = p.addRoomDeltaToResponse(ctx, req.Device, r, delta, &eventFilter, req.Response); err != nil {
+		// Guests only see the rooms which they have joined.
+		if delta.Membership == gomatrixserverlib.Peek && req.Device.AccountType == userapi.AccountTypeGuest {
+			continue
+		}
+		if err = p.addRoomDeltaToResponse(ctx, req.Device, r, delta, &stateFilter, &eventFilter, req.WantFullState, req.IgnoredUsers, req.Response); err != nil {
 			req.Log.WithError(err).Error("d.addRoomDeltaToResponse failed")
 			return newPos
 		}
@@ -187,7 +200,10 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 	device *userapi.Device,
 	r types.Range,
 	delta types.StateDelta,
+	stateFilter *gomatrixserverlib.StateFilter,
 	eventFilter *gomatrixserverlib.RoomEventFilter,
+	wantFullState bool,
+	ignoredUsers *types.IgnoredUsers,
 	res *types.Response,
 ) error {
 	if delta.MembershipPos > 0 && delta.Membership == gomatrixserverlib.Leave {
@@ -206,8 +222,20 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 	if err != nil {
 		return err
 	}
-	recentEvents := p.DB.StreamEventsToEvents(device, recentStreamEvents)
+	recentEvents := ignoredUsers.FilterEvents(p.DB.StreamEventsToEvents(device, recentStreamEvents))
+	if err = p.DB.BundleAggregations(ctx, device.UserID, recentEvents); err != nil {
+		return err
+	}
 	delta.StateEvents = removeDuplicates(delta.StateEvents, recentEvents) // roll back
+	if stateFilter.LazyLoadMembers {
+		delta.StateEvents, err = p.lazyLoadMembers(
+			ctx, device, delta.RoomID, stateFilter.IncludeRedundantMembers || wantFullState,
+			recentEvents, delta.StateEvents,
+		)
+		if err != nil {
+			return err
+		}
+	}
 	prevBatch, err := p.DB.GetBackwardTopologyPos(ctx, recentStreamEvents)
 	if err != nil {
 		return err
@@ -260,6 +288,7 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	stateFilter *gomatrixserverlib.StateFilter,
 	eventFilter *gomatrixserverlib.RoomEventFilter,
 	wantFullState bool,
+	ignoredUsers *types.IgnoredUsers,
 	device *userapi.Device,
 ) (jr *types.JoinResponse, err error) {
 	// TODO: When filters are added, we may need to call this multiple times to get enough events.
@@ -282,7 +311,15 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 		}
 	}
 
-	stateEvents, err := p.DB.CurrentState(ctx, roomID, stateFilter, excludingEventIDs)
+	// When lazy-loading members, only the membership events of the timeline
+	// senders are wanted, so don't fetch the rest of them in the first place.
+	currentStateFilter := *stateFilter
+	if stateFilter.LazyLoadMembers {
+		currentStateFilter.NotTypes = append(
+			append([]string{}, stateFilter.NotTypes...), gomatrixserverlib.MRoomMember,
+		)
+	}
+	stateEvents, err := p.DB.CurrentState(ctx, roomID, &currentStateFilter, excludingEventIDs)
 	if err != nil {
 		return
 	}
@@ -333,8 +370,20 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	// We don't include a device here as we don't need to send down
 	// transaction IDs for complete syncs, but we do it anyway because Sytest demands it for:
 	// "Can sync a room with a message with a transaction id" - which does a complete sync to check.
-	recentEvents := p.DB.StreamEventsToEvents(device, recentStreamEvents)
+	recentEvents := ignoredUsers.FilterEvents(p.DB.StreamEventsToEvents(device, recentStreamEvents))
+	if err = p.DB.BundleAggregations(ctx, device.UserID, recentEvents); err != nil {
+		return
+	}
 	stateEvents = removeDuplicates(stateEvents, recentEvents)
+	if stateFilter.LazyLoadMembers {
+		stateEvents, err = p.lazyLoadMembers(
+			ctx, device, roomID, stateFilter.IncludeRedundantMembers || wantFullState,
+			recentEvents, stateEvents,
+		)
+		if err != nil {
+			return
+		}
+	}
 	jr = types.NewJoinResponse()
 	jr.Timeline.PrevBatch = prevBatch
 	jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
@@ -343,6 +392,18 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	return jr, nil
 }
 
+func (p *PDUStreamProvider) lazyLoadMembers(
+	ctx context.Context, device *userapi.Device, roomID string, includeRedundant bool,
+	timeline, state []*gomatrixserverlib.HeaderedEvent,
+) ([]*gomatrixserverlib.HeaderedEvent, error) {
+	return internal.LazyLoadMembers(
+		ctx, p.lazyLoadCache, includeRedundant, device, roomID, timeline, state,
+		func(ctx context.Context, roomID, userID string) (*gomatrixserverlib.HeaderedEvent, error) {
+			return p.DB.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, userID)
+		},
+	)
+}
+
 func removeDuplicates(stateEvents, recentEvents []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
 	for _, recentEv := range recentEvents {
 		if recentEv.StateKey() == nil {
@@ -0,0 +1,76 @@
+package streams
+
+import (
+	"context"
+	"encoding/json"
+
+	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type PresenceStreamProvider struct {
+	StreamProvider
+	rsAPI rsapi.RoomserverInternalAPI
+}
+
+func (p *PresenceStreamProvider) Setup() {
+	p.StreamProvider.Setup()
+
+	id, err := p.DB.MaxStreamPositionForPresence(context.Background())
+	if err != nil {
+		panic(err)
+	}
+	p.latest = id
+}
+
+func (p *PresenceStreamProvider) CompleteSync(
+	ctx context.Context,
+	req *types.SyncRequest,
+) types.StreamPosition {
+	return p.IncrementalSync(ctx, req, 0, p.LatestPosition(ctx))
+}
+
+func (p *PresenceStreamProvider) IncrementalSync(
+	ctx context.Context,
+	req *types.SyncRequest,
+	from, to types.StreamPosition,
+) types.StreamPosition {
+	lastPos, presences, err := p.DB.PresenceInRange(ctx, types.Range{From: from, To: to})
+	if err != nil {
+		req.Log.WithError(err).Error("p.DB.PresenceInRange failed")
+		return from
+	}
+	if len(presences) == 0 {
+		return to
+	}
+
+	// Only send the presence of users who share a room with the syncing user.
+	var sharedUsersRes rsapi.QuerySharedUsersResponse
+	if err = p.rsAPI.QuerySharedUsers(ctx, &rsapi.QuerySharedUsersRequest{
+		UserID: req.Device.UserID,
+	}, &sharedUsersRes); err != nil {
+		req.Log.WithError(err).Error("p.rsAPI.QuerySharedUsers failed")
+		return from
+	}
+
+	for i := range presences {
+		presence := &presences[i]
+		if presence.UserID != req.Device.UserID && sharedUsersRes.UserIDsToCount[presence.UserID] == 0 {
+			continue
+		}
+		content, err := json.Marshal(presence.Content())
+		if err != nil {
+			req.Log.WithError(err).Error("json.Marshal failed")
+			return from
+		}
+		req.Response.Presence.Events = append(req.Response.Presence.Events, gomatrixserverlib.ClientEvent{
+			Type:    userapi.MPresence,
+			Sender:  presence.UserID,
+			Content: content,
+		})
+	}
+
+	return lastPos
+}
@@ -55,6 +55,10 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 	// Group receipts by room, so we can create one ClientEvent for every room
 	receiptsByRoom := make(map[string][]eduAPI.OutputReceiptEvent)
 	for _, receipt := range receipts {
+		// Private read receipts are only sent to the user who set them.
+		if receipt.Type == "m.read.private" && receipt.UserID != req.Device.UserID {
+			continue
+		}
 		receiptsByRoom[receipt.RoomID] = append(receiptsByRoom[receipt.RoomID], receipt)
 	}
 
@@ -63,22 +67,25 @@ func (p *ReceiptStreamProvider) IncrementalSync(
 		if existing, ok := req.Response.Rooms.Join[roomID]; ok {
 			jr = existing
 		}
-		var ok bool
 
 		ev := gomatrixserverlib.ClientEvent{
 			Type:   gomatrixserverlib.MReceipt,
 			RoomID: roomID,
 		}
-		content := make(map[string]eduAPI.ReceiptMRead)
+		// The content is keyed by event ID, then receipt type, then user ID.
+		content := make(map[string]map[string]map[string]eduAPI.ReceiptTS)
 		for _, receipt := range receipts {
-			var read eduAPI.ReceiptMRead
-			if read, ok = content[receipt.EventID]; !ok {
-				read = eduAPI.ReceiptMRead{
-					User: make(map[string]eduAPI.ReceiptTS),
-				}
+			byType, ok := content[receipt.EventID]
+			if !ok {
+				byType = make(map[string]map[string]eduAPI.ReceiptTS)
+				content[receipt.EventID] = byType
+			}
+			byUser, ok := byType[receipt.Type]
+			if !ok {
+				byUser = make(map[string]eduAPI.ReceiptTS)
+				byType[receipt.Type] = byUser
 			}
-			read.User[receipt.UserID] = eduAPI.ReceiptTS{TS: receipt.Timestamp}
-			content[receipt.EventID] = read
+			byUser[receipt.UserID] = eduAPI.ReceiptTS{TS: receipt.Timestamp}
 		}
 		ev.Content, err = json.Marshal(content)
 		if err != nil {
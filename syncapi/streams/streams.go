@@ -6,6 +6,7 @@ import (
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	rsapi "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	userapi "github.com/matrix-org/dendrite/userapi/api"
@@ -18,7 +19,9 @@ type Streams struct {
 	InviteStreamProvider       types.StreamProvider
 	SendToDeviceStreamProvider types.StreamProvider
 	AccountDataStreamProvider  types.StreamProvider
+	PresenceStreamProvider     types.StreamProvider
 	DeviceListStreamProvider   types.PartitionedStreamProvider
+	LazyLoadCache              *internal.LazyLoadCache
 }
 
 func NewSyncStreamProviders(
@@ -26,9 +29,14 @@ func NewSyncStreamProviders(
 	rsAPI rsapi.RoomserverInternalAPI, keyAPI keyapi.KeyInternalAPI,
 	eduCache *cache.EDUCache,
 ) *Streams {
+	lazyLoadCache, err := internal.NewLazyLoadCache()
+	if err != nil {
+		panic(err)
+	}
 	streams := &Streams{
 		PDUStreamProvider: &PDUStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
+			lazyLoadCache:  lazyLoadCache,
 		},
 		TypingStreamProvider: &TypingStreamProvider{
 			StreamProvider: StreamProvider{DB: d},
@@ -47,11 +55,16 @@ func NewSyncStreamProviders(
 			StreamProvider: StreamProvider{DB: d},
 			userAPI:        userAPI,
 		},
+		PresenceStreamProvider: &PresenceStreamProvider{
+			StreamProvider: StreamProvider{DB: d},
+			rsAPI:          rsAPI,
+		},
 		DeviceListStreamProvider: &DeviceListStreamProvider{
 			PartitionedStreamProvider: PartitionedStreamProvider{DB: d},
 			rsAPI:                     rsAPI,
 			keyAPI:                    keyAPI,
 		},
+		LazyLoadCache: lazyLoadCache,
 	}
 
 	streams.PDUStreamProvider.Setup()
@@ -60,6 +73,7 @@ func NewSyncStreamProviders(
 	streams.InviteStreamProvider.Setup()
 	streams.SendToDeviceStreamProvider.Setup()
 	streams.AccountDataStreamProvider.Setup()
+	streams.PresenceStreamProvider.Setup()
 	streams.DeviceListStreamProvider.Setup()
 
 	return streams
@@ -69,10 +83,11 @@ func (s *Streams) Latest(ctx context.Context) types.StreamingToken {
 	return types.StreamingToken{
 		PDUPosition:          s.PDUStreamProvider.LatestPosition(ctx),
 		TypingPosition:       s.TypingStreamProvider.LatestPosition(ctx),
-		ReceiptPosition:      s.PDUStreamProvider.LatestPosition(ctx),
+		ReceiptPosition:      s.ReceiptStreamProvider.LatestPosition(ctx),
 		InvitePosition:       s.InviteStreamProvider.LatestPosition(ctx),
 		SendToDevicePosition: s.SendToDeviceStreamProvider.LatestPosition(ctx),
 		AccountDataPosition:  s.AccountDataStreamProvider.LatestPosition(ctx),
+		PresencePosition:     s.PresenceStreamProvider.LatestPosition(ctx),
 		DeviceListPosition:   s.DeviceListStreamProvider.LatestPosition(ctx),
 	}
 }
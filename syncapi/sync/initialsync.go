@@ -0,0 +1,386 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/internal"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The number of messages returned for each room if the client doesn't give
+// a limit.
+const defaultInitialSyncLimit = 10
+
+type initialSyncMessages struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+}
+
+type initialSyncRoom struct {
+	RoomID     string `json:"room_id"`
+	Membership string `json:"membership"`
+	Visibility string `json:"visibility"`
+	// Only set for invites, instead of the messages and state.
+	Inviter     string                          `json:"inviter,omitempty"`
+	Invite      *gomatrixserverlib.ClientEvent  `json:"invite,omitempty"`
+	Messages    *initialSyncMessages            `json:"messages,omitempty"`
+	State       []gomatrixserverlib.ClientEvent `json:"state,omitempty"`
+	AccountData []gomatrixserverlib.ClientEvent `json:"account_data"`
+}
+
+type initialSyncResponse struct {
+	End         string                          `json:"end"`
+	Rooms       []initialSyncRoom               `json:"rooms"`
+	Presence    []gomatrixserverlib.ClientEvent `json:"presence"`
+	Receipts    []gomatrixserverlib.ClientEvent `json:"receipts"`
+	AccountData []gomatrixserverlib.ClientEvent `json:"account_data"`
+}
+
+type roomInitialSyncResponse struct {
+	initialSyncRoom
+	Presence []gomatrixserverlib.ClientEvent `json:"presence"`
+	Receipts []gomatrixserverlib.ClientEvent `json:"receipts"`
+}
+
+// initialSyncState is what is needed to build the rooms in the response.
+type initialSyncState struct {
+	device       *userapi.Device
+	pos          types.StreamingToken
+	limit        int
+	ignoredUsers *types.IgnoredUsers
+	accountData  *userapi.QueryAccountDataResponse
+	published    map[string]bool
+}
+
+// OnIncomingInitialSyncRequest implements the legacy GET /initialSync, which
+// returns a snapshot of all of the user's rooms. Rooms which the user has
+// left are only included if archived=true.
+func (rp *RequestPool) OnIncomingInitialSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	ctx := req.Context()
+	limit, resErr := initialSyncLimit(req)
+	if resErr != nil {
+		return *resErr
+	}
+	s, err := rp.newInitialSyncState(ctx, device, limit, "")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.newInitialSyncState failed")
+		return jsonerror.InternalServerError()
+	}
+	res := initialSyncResponse{
+		End:         s.pos.String(),
+		Rooms:       []initialSyncRoom{},
+		AccountData: accountDataEvents(s.accountData.GlobalAccountData, ""),
+	}
+
+	memberships := []string{gomatrixserverlib.Join}
+	if req.URL.Query().Get("archived") == "true" {
+		memberships = append(memberships, gomatrixserverlib.Leave)
+	}
+	var joinedRoomIDs []string
+	for _, membership := range memberships {
+		var roomsRes roomserverAPI.QueryRoomsForUserResponse
+		if err = rp.rsAPI.QueryRoomsForUser(ctx, &roomserverAPI.QueryRoomsForUserRequest{
+			UserID:         device.UserID,
+			WantMembership: membership,
+		}, &roomsRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rp.rsAPI.QueryRoomsForUser failed")
+			return jsonerror.InternalServerError()
+		}
+		for _, roomID := range roomsRes.RoomIDs {
+			room, err := rp.initialSyncRoom(ctx, s, roomID, membership)
+			if err != nil {
+				// The user may have left without ever having joined, e.g. by
+				// rejecting an invite, in which case there is nothing to send.
+				util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Warn("Failed to snapshot room for initial sync")
+				continue
+			}
+			res.Rooms = append(res.Rooms, *room)
+			if membership == gomatrixserverlib.Join {
+				joinedRoomIDs = append(joinedRoomIDs, roomID)
+			}
+		}
+	}
+
+	invites, _, err := rp.db.InviteEventsInRange(ctx, device.UserID, types.Range{From: 0, To: s.pos.InvitePosition})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.db.InviteEventsInRange failed")
+		return jsonerror.InternalServerError()
+	}
+	for roomID, inviteEvent := range invites {
+		if s.ignoredUsers.IsIgnored(inviteEvent.Sender()) {
+			continue
+		}
+		invite := gomatrixserverlib.HeaderedToClientEvent(inviteEvent, gomatrixserverlib.FormatAll)
+		res.Rooms = append(res.Rooms, initialSyncRoom{
+			RoomID:      roomID,
+			Membership:  gomatrixserverlib.Invite,
+			Visibility:  visibility(s.published, roomID),
+			Inviter:     inviteEvent.Sender(),
+			Invite:      &invite,
+			AccountData: accountDataEvents(s.accountData.RoomAccountData[roomID], roomID),
+		})
+	}
+
+	res.Presence, res.Receipts = rp.initialSyncEphemeral(ctx, device, joinedRoomIDs)
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// OnIncomingRoomInitialSyncRequest implements the legacy
+// GET /rooms/{roomID}/initialSync, which returns a snapshot of one room. If
+// the user has left the room, the snapshot is of when they left.
+func (rp *RequestPool) OnIncomingRoomInitialSyncRequest(req *http.Request, device *userapi.Device, roomID string) util.JSONResponse {
+	ctx := req.Context()
+	limit, resErr := initialSyncLimit(req)
+	if resErr != nil {
+		return *resErr
+	}
+	var membershipRes roomserverAPI.QueryMembershipForUserResponse
+	if err := rp.rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.rsAPI.QueryMembershipForUser failed")
+		return jsonerror.InternalServerError()
+	}
+	if membershipRes.Membership != gomatrixserverlib.Join && membershipRes.Membership != gomatrixserverlib.Leave {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+		}
+	}
+
+	s, err := rp.newInitialSyncState(ctx, device, limit, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.newInitialSyncState failed")
+		return jsonerror.InternalServerError()
+	}
+	room, err := rp.initialSyncRoom(ctx, s, roomID, membershipRes.Membership)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.initialSyncRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	res := roomInitialSyncResponse{
+		initialSyncRoom: *room,
+		Presence:        []gomatrixserverlib.ClientEvent{},
+		Receipts:        []gomatrixserverlib.ClientEvent{},
+	}
+	if membershipRes.Membership == gomatrixserverlib.Join {
+		presence, receipts := rp.initialSyncEphemeral(ctx, device, []string{roomID})
+		// Only send the presence of the room's members.
+		members := make(map[string]bool)
+		for _, ev := range room.State {
+			if ev.Type == gomatrixserverlib.MRoomMember && ev.StateKey != nil {
+				members[*ev.StateKey] = true
+			}
+		}
+		for _, ev := range presence {
+			if members[ev.Sender] {
+				res.Presence = append(res.Presence, ev)
+			}
+		}
+		res.Receipts = receipts
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+func initialSyncLimit(req *http.Request) (int, *util.JSONResponse) {
+	s := req.URL.Query().Get("limit")
+	if s == "" {
+		return defaultInitialSyncLimit, nil
+	}
+	limit, err := strconv.Atoi(s)
+	if err != nil || limit < 0 {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("limit must be a non-negative integer"),
+		}
+	}
+	return limit, nil
+}
+
+// newInitialSyncState looks up what is needed to snapshot the user's rooms,
+// or just the given room if roomID is set.
+func (rp *RequestPool) newInitialSyncState(
+	ctx context.Context, device *userapi.Device, limit int, roomID string,
+) (*initialSyncState, error) {
+	s := &initialSyncState{
+		device:      device,
+		pos:         rp.Notifier.CurrentPosition(),
+		limit:       limit,
+		accountData: &userapi.QueryAccountDataResponse{},
+		published:   make(map[string]bool),
+	}
+	var err error
+	if s.ignoredUsers, err = internal.IgnoredUsers(ctx, rp.userAPI, device.UserID); err != nil {
+		return nil, fmt.Errorf("internal.IgnoredUsers: %w", err)
+	}
+	if err = rp.userAPI.QueryAccountData(ctx, &userapi.QueryAccountDataRequest{
+		UserID: device.UserID,
+		RoomID: roomID,
+	}, s.accountData); err != nil {
+		return nil, fmt.Errorf("rp.userAPI.QueryAccountData: %w", err)
+	}
+	var publishedRes roomserverAPI.QueryPublishedRoomsResponse
+	if err = rp.rsAPI.QueryPublishedRooms(ctx, &roomserverAPI.QueryPublishedRoomsRequest{
+		RoomID: roomID,
+	}, &publishedRes); err != nil {
+		return nil, fmt.Errorf("rp.rsAPI.QueryPublishedRooms: %w", err)
+	}
+	for _, publishedRoomID := range publishedRes.RoomIDs {
+		s.published[publishedRoomID] = true
+	}
+	return s, nil
+}
+
+// initialSyncRoom returns the snapshot of a room which the user is joined to
+// or has left. The snapshot of a room which the user has left is of the room
+// as it was when they left.
+func (rp *RequestPool) initialSyncRoom(
+	ctx context.Context, s *initialSyncState, roomID, membership string,
+) (*initialSyncRoom, error) {
+	room := &initialSyncRoom{
+		RoomID:      roomID,
+		Membership:  membership,
+		Visibility:  visibility(s.published, roomID),
+		AccountData: accountDataEvents(s.accountData.RoomAccountData[roomID], roomID),
+	}
+	to, end := s.pos.PDUPosition, s.pos.String()
+	var state []*gomatrixserverlib.HeaderedEvent
+	if membership == gomatrixserverlib.Join {
+		stateFilter := gomatrixserverlib.DefaultStateFilter()
+		var err error
+		if state, err = rp.db.CurrentState(ctx, roomID, &stateFilter, nil); err != nil {
+			return nil, fmt.Errorf("rp.db.CurrentState: %w", err)
+		}
+	} else {
+		var membershipRes roomserverAPI.QueryMembershipForUserResponse
+		if err := rp.rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+			RoomID: roomID,
+			UserID: s.device.UserID,
+		}, &membershipRes); err != nil {
+			return nil, fmt.Errorf("rp.rsAPI.QueryMembershipForUser: %w", err)
+		}
+		depth, streamPos, err := rp.db.PositionInTopology(ctx, membershipRes.EventID)
+		if err != nil {
+			return nil, fmt.Errorf("rp.db.PositionInTopology: %w", err)
+		}
+		to, end = streamPos, types.TopologyToken{Depth: depth, PDUPosition: streamPos}.String()
+		var stateRes roomserverAPI.QueryStateAfterEventsResponse
+		if err = rp.rsAPI.QueryStateAfterEvents(ctx, &roomserverAPI.QueryStateAfterEventsRequest{
+			RoomID:       roomID,
+			PrevEventIDs: []string{membershipRes.EventID},
+		}, &stateRes); err != nil {
+			return nil, fmt.Errorf("rp.rsAPI.QueryStateAfterEvents: %w", err)
+		}
+		state = stateRes.StateEvents
+	}
+	room.State = gomatrixserverlib.HeaderedToClientEvents(state, gomatrixserverlib.FormatAll)
+
+	room.Messages = &initialSyncMessages{
+		Chunk: []gomatrixserverlib.ClientEvent{},
+		Start: end,
+		End:   end,
+	}
+	if s.limit == 0 {
+		return room, nil
+	}
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.Limit = s.limit
+	streamEvents, _, err := rp.db.RecentEvents(ctx, roomID, types.Range{From: to, To: 0, Backwards: true}, &filter, true, true)
+	if err != nil {
+		return nil, fmt.Errorf("rp.db.RecentEvents: %w", err)
+	}
+	if len(streamEvents) > 0 {
+		start, err := rp.db.GetBackwardTopologyPos(ctx, streamEvents)
+		if err != nil {
+			return nil, fmt.Errorf("rp.db.GetBackwardTopologyPos: %w", err)
+		}
+		room.Messages.Start = start.String()
+	}
+	events := s.ignoredUsers.FilterEvents(rp.db.StreamEventsToEvents(s.device, streamEvents))
+	if err = rp.db.BundleAggregations(ctx, s.device.UserID, events); err != nil {
+		return nil, fmt.Errorf("rp.db.BundleAggregations: %w", err)
+	}
+	room.Messages.Chunk = append(room.Messages.Chunk, gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll)...)
+	return room, nil
+}
+
+// initialSyncEphemeral returns the presence of the users who share a room
+// with the user, and the receipts in the joined rooms. These are taken from
+// a complete sync of the presence and receipt streams.
+func (rp *RequestPool) initialSyncEphemeral(
+	ctx context.Context, device *userapi.Device, joinedRoomIDs []string,
+) (presence, receipts []gomatrixserverlib.ClientEvent) {
+	syncReq := &types.SyncRequest{
+		Context:  ctx,
+		Log:      util.GetLogger(ctx),
+		Device:   device,
+		Response: types.NewResponse(),
+		Rooms:    make(map[string]string, len(joinedRoomIDs)),
+	}
+	for _, roomID := range joinedRoomIDs {
+		syncReq.Rooms[roomID] = gomatrixserverlib.Join
+	}
+	rp.streams.PresenceStreamProvider.CompleteSync(ctx, syncReq)
+	rp.streams.ReceiptStreamProvider.CompleteSync(ctx, syncReq)
+
+	presence = append([]gomatrixserverlib.ClientEvent{}, syncReq.Response.Presence.Events...)
+	receipts = []gomatrixserverlib.ClientEvent{}
+	for _, jr := range syncReq.Response.Rooms.Join {
+		for _, ev := range jr.Ephemeral.Events {
+			if ev.Type == gomatrixserverlib.MReceipt {
+				receipts = append(receipts, ev)
+			}
+		}
+	}
+	return presence, receipts
+}
+
+func accountDataEvents(data map[string]json.RawMessage, roomID string) []gomatrixserverlib.ClientEvent {
+	events := make([]gomatrixserverlib.ClientEvent, 0, len(data))
+	for dataType, content := range data {
+		events = append(events, gomatrixserverlib.ClientEvent{
+			Type:    dataType,
+			RoomID:  roomID,
+			Content: gomatrixserverlib.RawJSON(content),
+		})
+	}
+	return events
+}
+
+func visibility(published map[string]bool, roomID string) string {
+	if published[roomID] {
+		return "public"
+	}
+	return "private"
+}
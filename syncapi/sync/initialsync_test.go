@@ -0,0 +1,54 @@
+package sync
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestInitialSyncLimit(t *testing.T) {
+	for query, want := range map[string]int{
+		"":          defaultInitialSyncLimit,
+		"?limit=0":  0,
+		"?limit=25": 25,
+		"?limit=-1": -1,
+		"?limit=x":  -1,
+	} {
+		limit, resErr := initialSyncLimit(httptest.NewRequest(http.MethodGet, "/initialSync"+query, nil))
+		if want < 0 {
+			if resErr == nil || resErr.Code != http.StatusBadRequest {
+				t.Errorf("%q: expected a bad request, got limit %d", query, limit)
+			}
+			continue
+		}
+		if resErr != nil || limit != want {
+			t.Errorf("%q: got limit %d (%v), want %d", query, limit, resErr, want)
+		}
+	}
+}
+
+func TestRoomInitialSyncResponse(t *testing.T) {
+	// The legacy response must always have presence and receipts arrays,
+	// alongside the fields of the room.
+	res := roomInitialSyncResponse{
+		initialSyncRoom: initialSyncRoom{
+			RoomID:      "!room:localhost",
+			Membership:  gomatrixserverlib.Join,
+			Visibility:  visibility(map[string]bool{"!room:localhost": true}, "!room:localhost"),
+			AccountData: accountDataEvents(nil, "!room:localhost"),
+		},
+		Presence: []gomatrixserverlib.ClientEvent{},
+		Receipts: []gomatrixserverlib.ClientEvent{},
+	}
+	j, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"room_id":"!room:localhost","membership":"join","visibility":"public","account_data":[],"presence":[],"receipts":[]}`
+	if string(j) != want {
+		t.Errorf("got %s, want %s", j, want)
+	}
+}
@@ -44,7 +44,6 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 			return nil, err
 		}
 	}
-	// TODO: read from stored filters too
 	filter := gomatrixserverlib.DefaultFilter()
 	filterQuery := req.URL.Query().Get("filter")
 	if filterQuery != "" {
@@ -67,6 +66,9 @@ func newSyncRequest(req *http.Request, device userapi.Device, syncDB storage.Dat
 				filter = *f
 			}
 		}
+		if filter.Room.Timeline.Limit < 0 {
+			return nil, fmt.Errorf("room.timeline.limit must not be negative")
+		}
 	}
 
 	logger := util.GetLogger(req.Context()).WithFields(logrus.Fields{
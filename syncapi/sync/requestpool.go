@@ -17,6 +17,7 @@
 package sync
 
 import (
+	"context"
 	"net"
 	"net/http"
 	"strings"
@@ -47,6 +48,8 @@ type RequestPool struct {
 	lastseen sync.Map
 	streams  *streams.Streams
 	Notifier *notifier.Notifier
+
+	slidingConns slidingSyncConns
 }
 
 // NewRequestPool makes a new RequestPool
@@ -70,6 +73,12 @@ func NewRequestPool(
 	return rp
 }
 
+// LazyLoadCache returns the cache of membership events which have been sent
+// to each device when lazy-loading members.
+func (rp *RequestPool) LazyLoadCache() *internal.LazyLoadCache {
+	return rp.streams.LazyLoadCache
+}
+
 func (rp *RequestPool) cleanLastSeen() {
 	for {
 		rp.lastseen.Range(func(key interface{}, _ interface{}) bool {
@@ -106,6 +115,22 @@ func (rp *RequestPool) updateLastSeen(req *http.Request, device *userapi.Device)
 	lsres := &userapi.PerformLastSeenUpdateResponse{}
 	go rp.userAPI.PerformLastSeenUpdate(req.Context(), lsreq, lsres) // nolint:errcheck
 
+	// Syncing marks the user as online unless the client asks otherwise. A
+	// set_presence of offline means that the presence isn't changed.
+	presence := req.URL.Query().Get("set_presence")
+	if presence == "" {
+		presence = userapi.PresenceOnline
+	}
+	if presence != userapi.PresenceOffline && userapi.ValidPresence(presence) {
+		preq := &userapi.PerformPresenceUpdateRequest{
+			UserID:   device.UserID,
+			Presence: presence,
+		}
+		pres := &userapi.PerformPresenceUpdateResponse{}
+		// The sync request may well finish before the update does.
+		go rp.userAPI.PerformPresenceUpdate(context.Background(), preq, pres) // nolint:errcheck
+	}
+
 	rp.lastseen.Store(device.UserID+device.ID, time.Now())
 }
 
@@ -145,112 +170,51 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			JSON: jsonerror.Unknown(err.Error()),
 		}
 	}
+	syncReq.IgnoredUsers, err = internal.IgnoredUsers(req.Context(), rp.userAPI, device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("internal.IgnoredUsers failed")
+		return jsonerror.InternalServerError()
+	}
 
 	activeSyncRequests.Inc()
 	defer activeSyncRequests.Dec()
 
 	rp.updateLastSeen(req, device)
 
-	waitingSyncRequests.Inc()
-	defer waitingSyncRequests.Dec()
-
-	currentPos := rp.Notifier.CurrentPosition()
-
-	if !rp.shouldReturnImmediately(syncReq, currentPos) {
-		timer := time.NewTimer(syncReq.Timeout) // case of timeout=0 is handled above
-		defer timer.Stop()
-
-		userStreamListener := rp.Notifier.GetListener(*syncReq)
-		defer userStreamListener.Close()
-
-		giveup := func() util.JSONResponse {
-			syncReq.Response.NextBatch = syncReq.Since
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: syncReq.Response,
-			}
-		}
-
-		select {
-		case <-syncReq.Context.Done(): // Caller gave up
-			return giveup()
-
-		case <-timer.C: // Timeout reached
-			return giveup()
-
-		case <-userStreamListener.GetNotifyChannel(syncReq.Since):
-			syncReq.Log.Debugln("Responding to sync after wake-up")
-			currentPos.ApplyUpdates(userStreamListener.GetSyncPosition())
-		}
-	} else {
-		syncReq.Log.Debugln("Responding to sync immediately")
-	}
-
 	if syncReq.Since.IsEmpty() {
 		// Complete sync
-		syncReq.Response.NextBatch = types.StreamingToken{
-			PDUPosition: rp.streams.PDUStreamProvider.CompleteSync(
-				syncReq.Context, syncReq,
-			),
-			TypingPosition: rp.streams.TypingStreamProvider.CompleteSync(
-				syncReq.Context, syncReq,
-			),
-			ReceiptPosition: rp.streams.ReceiptStreamProvider.CompleteSync(
-				syncReq.Context, syncReq,
-			),
-			InvitePosition: rp.streams.InviteStreamProvider.CompleteSync(
-				syncReq.Context, syncReq,
-			),
-			SendToDevicePosition: rp.streams.SendToDeviceStreamProvider.CompleteSync(
-				syncReq.Context, syncReq,
-			),
-			AccountDataPosition: rp.streams.AccountDataStreamProvider.CompleteSync(
-				syncReq.Context, syncReq,
-			),
-			DeviceListPosition: rp.streams.DeviceListStreamProvider.CompleteSync(
-				syncReq.Context, syncReq,
-			),
-		}
+		syncReq.Log.Debugln("Responding to sync immediately")
+		syncReq.Response.NextBatch = rp.completeSync(syncReq)
 	} else {
 		// Incremental sync
-		syncReq.Response.NextBatch = types.StreamingToken{
-			PDUPosition: rp.streams.PDUStreamProvider.IncrementalSync(
-				syncReq.Context, syncReq,
-				syncReq.Since.PDUPosition, currentPos.PDUPosition,
-			),
-			TypingPosition: rp.streams.TypingStreamProvider.IncrementalSync(
-				syncReq.Context, syncReq,
-				syncReq.Since.TypingPosition, currentPos.TypingPosition,
-			),
-			ReceiptPosition: rp.streams.ReceiptStreamProvider.IncrementalSync(
-				syncReq.Context, syncReq,
-				syncReq.Since.ReceiptPosition, currentPos.ReceiptPosition,
-			),
-			InvitePosition: rp.streams.InviteStreamProvider.IncrementalSync(
-				syncReq.Context, syncReq,
-				syncReq.Since.InvitePosition, currentPos.InvitePosition,
-			),
-			SendToDevicePosition: rp.streams.SendToDeviceStreamProvider.IncrementalSync(
-				syncReq.Context, syncReq,
-				syncReq.Since.SendToDevicePosition, currentPos.SendToDevicePosition,
-			),
-			AccountDataPosition: rp.streams.AccountDataStreamProvider.IncrementalSync(
-				syncReq.Context, syncReq,
-				syncReq.Since.AccountDataPosition, currentPos.AccountDataPosition,
-			),
-			DeviceListPosition: rp.streams.DeviceListStreamProvider.IncrementalSync(
-				syncReq.Context, syncReq,
-				syncReq.Since.DeviceListPosition, currentPos.DeviceListPosition,
-			),
-		}
+		rp.waitForIncrementalSync(syncReq)
 	}
 
+	rp.addNotificationCounts(syncReq)
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: syncReq.Response,
 	}
 }
 
+// addNotificationCounts fills in the unread notification counts of every
+// joined room in the response.
+func (rp *RequestPool) addNotificationCounts(syncReq *types.SyncRequest) {
+	if len(syncReq.Response.Rooms.Join) == 0 {
+		return
+	}
+	counts, err := rp.db.NotificationCounts(syncReq.Context, syncReq.Device.UserID)
+	if err != nil {
+		syncReq.Log.WithError(err).Error("rp.db.NotificationCounts failed")
+		return
+	}
+	for roomID, jr := range syncReq.Response.Rooms.Join {
+		jr.UnreadNotifications = counts[roomID]
+		syncReq.Response.Rooms.Join[roomID] = jr
+	}
+}
+
 func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
 	from := req.URL.Query().Get("from")
 	to := req.URL.Query().Get("to")
@@ -300,12 +264,146 @@ func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *use
 	}
 }
 
-// shouldReturnImmediately returns whether the /sync request is an initial sync,
-// or timeout=0, or full_state=true, in any of the cases the request should
-// return immediately.
-func (rp *RequestPool) shouldReturnImmediately(syncReq *types.SyncRequest, currentPos types.StreamingToken) bool {
-	if currentPos.IsAfter(syncReq.Since) || syncReq.Timeout == 0 || syncReq.WantFullState {
-		return true
+// shouldReturnImmediately returns whether the incremental /sync request
+// should return without waiting for new data, which is the case if there is
+// already something to send, or if timeout=0 or full_state=true.
+func (rp *RequestPool) shouldReturnImmediately(syncReq *types.SyncRequest) bool {
+	return !syncReq.Response.IsEmpty() || syncReq.Timeout == 0 || syncReq.WantFullState
+}
+
+// waitForIncrementalSync fills in the response to an incremental /sync
+// request. If there is nothing to send then it blocks until the notifier
+// wakes the device up for new data, e.g. an event in one of the user's rooms
+// or in a room they have just joined, and tries again, until there is
+// something to send or the timeout is reached. After a wake-up only the
+// streams which advanced, according to the position the device was woken
+// with, are read again. If nothing turns up, the response is empty and its
+// next batch token is the position that we last read up to.
+func (rp *RequestPool) waitForIncrementalSync(syncReq *types.SyncRequest) {
+	// Get the listener before the first attempt, so that any update for the
+	// device after the position we read up to will wake us up.
+	userStreamListener := rp.Notifier.GetListener(*syncReq)
+	defer userStreamListener.Close()
+
+	var timer *time.Timer
+	currentPos := rp.Notifier.CurrentPosition()
+	for {
+		syncReq.Response.NextBatch = rp.incrementalSync(syncReq, syncReq.Since, currentPos)
+		if rp.shouldReturnImmediately(syncReq) {
+			return
+		}
+
+		// Nothing to send up to the current position, so next time we only
+		// need to look at what happened after it.
+		syncReq.Since = syncReq.Response.NextBatch
+		if timer == nil {
+			timer = time.NewTimer(syncReq.Timeout)
+			defer timer.Stop()
+		}
+
+		waitingSyncRequests.Inc()
+		select {
+		case <-syncReq.Context.Done(): // Caller gave up
+			waitingSyncRequests.Dec()
+			return
+
+		case <-timer.C: // Timeout reached
+			waitingSyncRequests.Dec()
+			return
+
+		case <-userStreamListener.GetNotifyChannel(currentPos):
+			waitingSyncRequests.Dec()
+			syncReq.Log.Debugln("Responding to sync after wake-up")
+			currentPos.ApplyUpdates(userStreamListener.GetSyncPosition())
+		}
+	}
+}
+
+// completeSync fills in the response to an initial /sync request, returning
+// the next batch token.
+func (rp *RequestPool) completeSync(syncReq *types.SyncRequest) types.StreamingToken {
+	return types.StreamingToken{
+		PDUPosition: rp.streams.PDUStreamProvider.CompleteSync(
+			syncReq.Context, syncReq,
+		),
+		TypingPosition: rp.streams.TypingStreamProvider.CompleteSync(
+			syncReq.Context, syncReq,
+		),
+		ReceiptPosition: rp.streams.ReceiptStreamProvider.CompleteSync(
+			syncReq.Context, syncReq,
+		),
+		InvitePosition: rp.streams.InviteStreamProvider.CompleteSync(
+			syncReq.Context, syncReq,
+		),
+		SendToDevicePosition: rp.streams.SendToDeviceStreamProvider.CompleteSync(
+			syncReq.Context, syncReq,
+		),
+		AccountDataPosition: rp.streams.AccountDataStreamProvider.CompleteSync(
+			syncReq.Context, syncReq,
+		),
+		PresencePosition: rp.streams.PresenceStreamProvider.CompleteSync(
+			syncReq.Context, syncReq,
+		),
+		DeviceListPosition: rp.streams.DeviceListStreamProvider.CompleteSync(
+			syncReq.Context, syncReq,
+		),
+	}
+}
+
+// incrementalSync fills in the response to an incremental /sync request with
+// everything between the given positions, returning the next batch token.
+// Streams whose position hasn't moved have nothing new and aren't read. The
+// device list stream is always read, as it depends on the rooms joined and
+// left in the response and fills in the one-time key counts, and so is the
+// PDU stream for full_state=true, which sends the full state of every room
+// even if nothing happened in it.
+func (rp *RequestPool) incrementalSync(syncReq *types.SyncRequest, since, currentPos types.StreamingToken) types.StreamingToken {
+	next := since
+	if since.PDUPosition != currentPos.PDUPosition || syncReq.WantFullState {
+		next.PDUPosition = rp.streams.PDUStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq,
+			since.PDUPosition, currentPos.PDUPosition,
+		)
+	}
+	if since.TypingPosition != currentPos.TypingPosition {
+		next.TypingPosition = rp.streams.TypingStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq,
+			since.TypingPosition, currentPos.TypingPosition,
+		)
+	}
+	if since.ReceiptPosition != currentPos.ReceiptPosition {
+		next.ReceiptPosition = rp.streams.ReceiptStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq,
+			since.ReceiptPosition, currentPos.ReceiptPosition,
+		)
+	}
+	if since.InvitePosition != currentPos.InvitePosition {
+		next.InvitePosition = rp.streams.InviteStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq,
+			since.InvitePosition, currentPos.InvitePosition,
+		)
 	}
-	return false
+	if since.SendToDevicePosition != currentPos.SendToDevicePosition {
+		next.SendToDevicePosition = rp.streams.SendToDeviceStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq,
+			since.SendToDevicePosition, currentPos.SendToDevicePosition,
+		)
+	}
+	if since.AccountDataPosition != currentPos.AccountDataPosition {
+		next.AccountDataPosition = rp.streams.AccountDataStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq,
+			since.AccountDataPosition, currentPos.AccountDataPosition,
+		)
+	}
+	if since.PresencePosition != currentPos.PresencePosition {
+		next.PresencePosition = rp.streams.PresenceStreamProvider.IncrementalSync(
+			syncReq.Context, syncReq,
+			since.PresencePosition, currentPos.PresencePosition,
+		)
+	}
+	next.DeviceListPosition = rp.streams.DeviceListStreamProvider.IncrementalSync(
+		syncReq.Context, syncReq,
+		since.DeviceListPosition, currentPos.DeviceListPosition,
+	)
+	return next
 }
@@ -0,0 +1,64 @@
+package sync
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/streams"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+type testStreamProvider struct {
+	types.StreamProvider
+	calls int
+}
+
+func (p *testStreamProvider) IncrementalSync(ctx context.Context, req *types.SyncRequest, from, to types.StreamPosition) types.StreamPosition {
+	p.calls++
+	return to
+}
+
+type testPartitionedStreamProvider struct {
+	types.PartitionedStreamProvider
+}
+
+func (p *testPartitionedStreamProvider) IncrementalSync(ctx context.Context, req *types.SyncRequest, from, to types.LogPosition) types.LogPosition {
+	return to
+}
+
+func TestIncrementalSyncFullState(t *testing.T) {
+	pdus := &testStreamProvider{}
+	typing := &testStreamProvider{}
+	rp := &RequestPool{
+		streams: &streams.Streams{
+			PDUStreamProvider:          pdus,
+			TypingStreamProvider:       typing,
+			ReceiptStreamProvider:      &testStreamProvider{},
+			InviteStreamProvider:       &testStreamProvider{},
+			SendToDeviceStreamProvider: &testStreamProvider{},
+			AccountDataStreamProvider:  &testStreamProvider{},
+			PresenceStreamProvider:     &testStreamProvider{},
+			DeviceListStreamProvider:   &testPartitionedStreamProvider{},
+		},
+	}
+	pos := types.StreamingToken{PDUPosition: 5, TypingPosition: 2}
+
+	// Nothing has happened since the since token, so nothing is read.
+	syncReq := &types.SyncRequest{Context: context.Background()}
+	rp.incrementalSync(syncReq, pos, pos)
+	if pdus.calls != 0 || typing.calls != 0 {
+		t.Fatalf("read the PDU stream %d times and typing %d times, want neither", pdus.calls, typing.calls)
+	}
+
+	// full_state=true needs the state of every room, even without new events.
+	syncReq.WantFullState = true
+	if next := rp.incrementalSync(syncReq, pos, pos); next != pos {
+		t.Errorf("got next batch %s, want %s", next.String(), pos.String())
+	}
+	if pdus.calls != 1 {
+		t.Errorf("read the PDU stream %d times for full_state, want 1", pdus.calls)
+	}
+	if typing.calls != 0 {
+		t.Errorf("read the typing stream %d times for full_state, want 0", typing.calls)
+	}
+}
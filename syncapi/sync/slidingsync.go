@@ -0,0 +1,555 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	userapi "github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+)
+
+// slidingSyncConnTimeout is how long the state of a sliding sync connection
+// is kept after it was last used.
+const slidingSyncConnTimeout = 30 * time.Minute
+
+// The sort orders that lists can use. Rooms which compare equal are sorted by
+// room ID, so that windows are stable.
+const (
+	slidingSortByRecency = "by_recency"
+	slidingSortByName    = "by_name"
+)
+
+// slidingSyncRequest is the body of a sliding sync request, as per MSC3575.
+type slidingSyncRequest struct {
+	ConnID            string                       `json:"conn_id"`
+	Lists             map[string]slidingSyncList   `json:"lists"`
+	RoomSubscriptions map[string]slidingRoomConfig `json:"room_subscriptions"`
+	UnsubscribeRooms  []string                     `json:"unsubscribe_rooms"`
+}
+
+// slidingRoomConfig is what to send about each room in a list or
+// subscription. Each required state entry is an event type and state key,
+// either of which may be "*" to match anything.
+type slidingRoomConfig struct {
+	RequiredState [][2]string `json:"required_state"`
+	TimelineLimit int         `json:"timeline_limit"`
+}
+
+// slidingSyncList is a list of the user's joined rooms, sorted, of which only
+// the rooms within the ranges are sent. Ranges are inclusive at both ends.
+type slidingSyncList struct {
+	slidingRoomConfig
+	Ranges [][2]int `json:"ranges"`
+	Sort   []string `json:"sort"`
+}
+
+type slidingSyncResponse struct {
+	Pos        string                             `json:"pos"`
+	Lists      map[string]slidingSyncListResponse `json:"lists"`
+	Rooms      map[string]slidingSyncRoom         `json:"rooms"`
+	Extensions struct{}                           `json:"extensions"`
+}
+
+type slidingSyncListResponse struct {
+	Count int             `json:"count"`
+	Ops   []slidingSyncOp `json:"ops,omitempty"`
+}
+
+// slidingSyncOp replaces the rooms in a range of a list. It is only sent when
+// the rooms in the range have changed since the last response.
+type slidingSyncOp struct {
+	Op      string   `json:"op"`
+	Range   [2]int   `json:"range"`
+	RoomIDs []string `json:"room_ids"`
+}
+
+type slidingSyncRoom struct {
+	Name              string                          `json:"name,omitempty"`
+	RequiredState     []gomatrixserverlib.ClientEvent `json:"required_state,omitempty"`
+	Timeline          []gomatrixserverlib.ClientEvent `json:"timeline,omitempty"`
+	PrevBatch         string                          `json:"prev_batch,omitempty"`
+	Limited           bool                            `json:"limited,omitempty"`
+	Initial           bool                            `json:"initial,omitempty"`
+	NotificationCount int                             `json:"notification_count"`
+	HighlightCount    int                             `json:"highlight_count"`
+}
+
+// slidingRoomSummary is what rooms are sorted by.
+type slidingRoomSummary struct {
+	roomID    string
+	name      string
+	recencyOf types.StreamPosition
+}
+
+// slidingSyncState is what has been sent on a connection, as of one response.
+type slidingSyncState struct {
+	// The room IDs in each range of each list.
+	lists map[string][][]string
+	// The stream position that each room in a list or subscription has been
+	// sent up to. Rooms which drop out of them are forgotten, and are sent
+	// again in full if they come back.
+	rooms         map[string]types.StreamPosition
+	subscriptions map[string]slidingRoomConfig
+}
+
+func newSlidingSyncState() *slidingSyncState {
+	return &slidingSyncState{
+		lists:         map[string][][]string{},
+		rooms:         map[string]types.StreamPosition{},
+		subscriptions: map[string]slidingRoomConfig{},
+	}
+}
+
+func (s *slidingSyncState) clone() *slidingSyncState {
+	c := newSlidingSyncState()
+	for name, ranges := range s.lists {
+		c.lists[name] = ranges
+	}
+	for roomID, pos := range s.rooms {
+		c.rooms[roomID] = pos
+	}
+	for roomID, config := range s.subscriptions {
+		c.subscriptions[roomID] = config
+	}
+	return c
+}
+
+// slidingSyncConn holds the state of a sliding sync connection after each of
+// the last two responses, so that a request can be retried with the same pos
+// if its response was lost.
+type slidingSyncConn struct {
+	pos      int64
+	states   map[int64]*slidingSyncState
+	lastUsed time.Time
+}
+
+// slidingSyncConns holds the sliding sync connections of every device, keyed
+// by user ID, device ID and connection ID.
+type slidingSyncConns struct {
+	mu    sync.Mutex
+	conns map[string]*slidingSyncConn
+}
+
+// load returns a copy of the connection state as of the given pos, or a new
+// state if the pos is empty. Returns false if the pos isn't known.
+func (c *slidingSyncConns) load(key, pos string) (*slidingSyncState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, conn := range c.conns {
+		if time.Since(conn.lastUsed) > slidingSyncConnTimeout {
+			delete(c.conns, k)
+		}
+	}
+	if pos == "" {
+		return newSlidingSyncState(), true
+	}
+	conn, ok := c.conns[key]
+	if !ok {
+		return nil, false
+	}
+	p, err := strconv.ParseInt(pos, 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	state, ok := conn.states[p]
+	if !ok {
+		return nil, false
+	}
+	conn.lastUsed = time.Now()
+	return state.clone(), true
+}
+
+// store saves the connection state and returns the pos which refers to it.
+// A new connection is started if fresh is true.
+func (c *slidingSyncConns) store(key string, state *slidingSyncState, fresh bool) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns == nil {
+		c.conns = map[string]*slidingSyncConn{}
+	}
+	conn, ok := c.conns[key]
+	if !ok || fresh {
+		var pos int64
+		if ok {
+			pos = conn.pos
+		}
+		conn = &slidingSyncConn{pos: pos, states: map[int64]*slidingSyncState{}}
+		c.conns[key] = conn
+	}
+	conn.pos++
+	conn.states[conn.pos] = state
+	delete(conn.states, conn.pos-2)
+	conn.lastUsed = time.Now()
+	return strconv.FormatInt(conn.pos, 10)
+}
+
+// OnIncomingSlidingSyncRequest handles a sliding sync request as per MSC3575.
+// Only the joined rooms are listed. As with /sync, a request which has a pos
+// blocks until there is something to send or the timeout is reached.
+func (rp *RequestPool) OnIncomingSlidingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	var body slidingSyncRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	for name, list := range body.Lists {
+		for _, r := range list.Ranges {
+			if r[0] < 0 || r[1] < r[0] {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("Invalid range in list " + name),
+				}
+			}
+		}
+		for _, s := range list.Sort {
+			if s != slidingSortByRecency && s != slidingSortByName {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("Unsupported sort order " + s),
+				}
+			}
+		}
+	}
+
+	pos := req.URL.Query().Get("pos")
+	connKey := device.UserID + "|" + device.ID + "|" + body.ConnID
+	state, ok := rp.slidingConns.load(connKey, pos)
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MatrixError{ErrCode: "M_UNKNOWN_POS", Err: "Unknown pos"},
+		}
+	}
+	for roomID, config := range body.RoomSubscriptions {
+		state.subscriptions[roomID] = config
+	}
+	for _, roomID := range body.UnsubscribeRooms {
+		delete(state.subscriptions, roomID)
+	}
+
+	ctx := req.Context()
+	logger := util.GetLogger(ctx)
+	timeout := getTimeout(req.URL.Query().Get("timeout"))
+	rp.updateLastSeen(req, device)
+
+	// Get the listener before the first attempt, so that any update for the
+	// device after the position we read up to will wake us up.
+	listener := rp.Notifier.GetListener(types.SyncRequest{Context: ctx, Device: device})
+	defer listener.Close()
+
+	var timer *time.Timer
+	for {
+		currentPos := rp.Notifier.CurrentPosition()
+		res, err := rp.slidingSync(ctx, device, &body, state, currentPos.PDUPosition)
+		if err != nil {
+			logger.WithError(err).Error("rp.slidingSync failed")
+			return jsonerror.InternalServerError()
+		}
+		if pos == "" || timeout == 0 || len(res.Rooms) > 0 || hasSlidingSyncOps(res) {
+			res.Pos = rp.slidingConns.store(connKey, state, pos == "")
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: res,
+			}
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			defer timer.Stop()
+		}
+		select {
+		case <-ctx.Done(): // Caller gave up
+		case <-timer.C: // Timeout reached
+		case <-listener.GetNotifyChannel(currentPos):
+			continue
+		}
+		res.Pos = rp.slidingConns.store(connKey, state, false)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+}
+
+func hasSlidingSyncOps(res *slidingSyncResponse) bool {
+	for _, list := range res.Lists {
+		if len(list.Ops) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// slidingSync works out the response to a sliding sync request, given what
+// has been sent so far, up to the given stream position. The state is updated
+// to include what is in the response.
+// nolint:gocyclo
+func (rp *RequestPool) slidingSync(
+	ctx context.Context, device *userapi.Device, body *slidingSyncRequest,
+	state *slidingSyncState, to types.StreamPosition,
+) (*slidingSyncResponse, error) {
+	res := &slidingSyncResponse{
+		Lists: map[string]slidingSyncListResponse{},
+		Rooms: map[string]slidingSyncRoom{},
+	}
+
+	joinedRoomIDs, err := rp.db.RoomIDsWithMembership(ctx, device.UserID, gomatrixserverlib.Join)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]slidingRoomSummary, 0, len(joinedRoomIDs))
+	joined := make(map[string]slidingRoomSummary, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		summary, err := rp.slidingRoomSummary(ctx, roomID, to)
+		if err != nil {
+			return nil, err
+		}
+		summaries = append(summaries, summary)
+		joined[roomID] = summary
+	}
+
+	// Work out which rooms to send, merging the config of the lists and
+	// subscriptions that each room is in.
+	configs := map[string]slidingRoomConfig{}
+	addConfig := func(roomID string, config slidingRoomConfig) {
+		merged := configs[roomID]
+		if config.TimelineLimit > merged.TimelineLimit {
+			merged.TimelineLimit = config.TimelineLimit
+		}
+		merged.RequiredState = append(merged.RequiredState, config.RequiredState...)
+		configs[roomID] = merged
+	}
+	lists := map[string][][]string{}
+	for name, list := range body.Lists {
+		sortSlidingRooms(summaries, list.Sort)
+		windows := slidingWindows(summaries, list.Ranges)
+		listRes := slidingSyncListResponse{Count: len(summaries)}
+		previous := state.lists[name]
+		for i, window := range windows {
+			for _, roomID := range window {
+				addConfig(roomID, list.slidingRoomConfig)
+			}
+			if i < len(previous) && reflect.DeepEqual(previous[i], window) {
+				continue
+			}
+			listRes.Ops = append(listRes.Ops, slidingSyncOp{
+				Op:      "SYNC",
+				Range:   list.Ranges[i],
+				RoomIDs: window,
+			})
+		}
+		lists[name] = windows
+		res.Lists[name] = listRes
+	}
+	state.lists = lists
+	for roomID, config := range state.subscriptions {
+		if _, ok := joined[roomID]; ok {
+			addConfig(roomID, config)
+		}
+	}
+
+	var counts map[string]types.NotificationCounts
+	for roomID, config := range configs {
+		sentPos, sent := state.rooms[roomID]
+		if sent && joined[roomID].recencyOf <= sentPos {
+			continue
+		}
+		room, err := rp.slidingSyncRoom(ctx, device, roomID, config, sentPos, to, !sent)
+		if err != nil {
+			return nil, err
+		}
+		room.Name = joined[roomID].name
+		if counts == nil {
+			if counts, err = rp.db.NotificationCounts(ctx, device.UserID); err != nil {
+				return nil, err
+			}
+		}
+		room.NotificationCount = counts[roomID].NotificationCount
+		room.HighlightCount = counts[roomID].HighlightCount
+		res.Rooms[roomID] = *room
+	}
+	rooms := make(map[string]types.StreamPosition, len(configs))
+	for roomID := range configs {
+		rooms[roomID] = to
+	}
+	state.rooms = rooms
+	return res, nil
+}
+
+// slidingRoomSummary returns the name of the room and the stream position of
+// its most recent event.
+func (rp *RequestPool) slidingRoomSummary(ctx context.Context, roomID string, to types.StreamPosition) (slidingRoomSummary, error) {
+	summary := slidingRoomSummary{roomID: roomID}
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.Limit = 1
+	recent, _, err := rp.db.RecentEvents(ctx, roomID, types.Range{From: to, To: 0, Backwards: true}, &filter, true, true)
+	if err != nil {
+		return summary, err
+	}
+	if len(recent) > 0 {
+		summary.recencyOf = recent[0].StreamPosition
+	}
+	ev, err := rp.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomName, "")
+	if err != nil {
+		return summary, err
+	}
+	if ev != nil {
+		var content struct {
+			Name string `json:"name"`
+		}
+		if err = json.Unmarshal(ev.Content(), &content); err == nil {
+			summary.name = content.Name
+		}
+	}
+	if summary.name == "" {
+		ev, err = rp.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomCanonicalAlias, "")
+		if err != nil {
+			return summary, err
+		}
+		if ev != nil {
+			var content struct {
+				Alias string `json:"alias"`
+			}
+			if err = json.Unmarshal(ev.Content(), &content); err == nil {
+				summary.name = content.Alias
+			}
+		}
+	}
+	return summary, nil
+}
+
+// slidingSyncRoom returns the room as it is to be sent. An initial room has
+// its required state and most recent events. Otherwise only the events after
+// the position it was last sent up to are sent.
+func (rp *RequestPool) slidingSyncRoom(
+	ctx context.Context, device *userapi.Device, roomID string, config slidingRoomConfig,
+	since, to types.StreamPosition, initial bool,
+) (*slidingSyncRoom, error) {
+	room := &slidingSyncRoom{Initial: initial}
+	r := types.Range{From: since, To: to}
+	if initial {
+		r = types.Range{From: to, To: 0, Backwards: true}
+		stateFilter := gomatrixserverlib.DefaultStateFilter()
+		stateEvents, err := rp.db.CurrentState(ctx, roomID, &stateFilter, nil)
+		if err != nil {
+			return nil, err
+		}
+		var required []*gomatrixserverlib.HeaderedEvent
+		for _, ev := range stateEvents {
+			if matchesRequiredState(config.RequiredState, ev.Type(), *ev.StateKey()) {
+				required = append(required, ev)
+			}
+		}
+		room.RequiredState = gomatrixserverlib.HeaderedToClientEvents(required, gomatrixserverlib.FormatSync)
+	}
+	if config.TimelineLimit <= 0 {
+		return room, nil
+	}
+
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.Limit = config.TimelineLimit
+	recentStreamEvents, limited, err := rp.db.RecentEvents(ctx, roomID, r, &filter, true, true)
+	if err != nil {
+		return nil, err
+	}
+	if initial {
+		// As with /sync, don't send the events from before the user joined.
+		for i := len(recentStreamEvents) - 1; i >= 0; i-- {
+			ev := recentStreamEvents[i]
+			if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKeyEquals(device.UserID) {
+				if membership, _ := ev.Membership(); membership == gomatrixserverlib.Join {
+					recentStreamEvents = recentStreamEvents[i:]
+					limited = false
+					break
+				}
+			}
+		}
+	}
+	if len(recentStreamEvents) > 0 {
+		prevBatch, err := rp.db.GetBackwardTopologyPos(ctx, recentStreamEvents)
+		if err != nil {
+			logrus.WithError(err).WithField("room_id", roomID).Warn("Failed to get prev_batch for sliding sync room")
+		} else {
+			room.PrevBatch = prevBatch.String()
+		}
+	}
+	recentEvents := rp.db.StreamEventsToEvents(device, recentStreamEvents)
+	room.Timeline = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+	room.Limited = limited
+	return room, nil
+}
+
+// sortSlidingRooms sorts the rooms by each of the sort orders in turn,
+// falling back to the room ID. The default is to sort by recency.
+func sortSlidingRooms(rooms []slidingRoomSummary, sortBy []string) {
+	if len(sortBy) == 0 {
+		sortBy = []string{slidingSortByRecency}
+	}
+	sort.SliceStable(rooms, func(i, j int) bool {
+		a, b := rooms[i], rooms[j]
+		for _, s := range sortBy {
+			switch s {
+			case slidingSortByRecency:
+				if a.recencyOf != b.recencyOf {
+					return a.recencyOf > b.recencyOf
+				}
+			case slidingSortByName:
+				// Rooms with names come before those without.
+				an, bn := strings.ToLower(a.name), strings.ToLower(b.name)
+				if an != bn {
+					return bn == "" || (an != "" && an < bn)
+				}
+			}
+		}
+		return a.roomID < b.roomID
+	})
+}
+
+// slidingWindows returns the room IDs within each of the ranges of the sorted
+// rooms. Ranges which go past the end of the list are cut short.
+func slidingWindows(rooms []slidingRoomSummary, ranges [][2]int) [][]string {
+	windows := make([][]string, len(ranges))
+	for i, r := range ranges {
+		windows[i] = []string{}
+		for j := r[0]; j <= r[1] && j < len(rooms); j++ {
+			windows[i] = append(windows[i], rooms[j].roomID)
+		}
+	}
+	return windows
+}
+
+// matchesRequiredState returns true if the state event matches any of the
+// required state entries.
+func matchesRequiredState(required [][2]string, eventType, stateKey string) bool {
+	for _, r := range required {
+		if (r[0] == "*" || r[0] == eventType) && (r[1] == "*" || r[1] == stateKey) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package sync
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSortSlidingRooms(t *testing.T) {
+	rooms := []slidingRoomSummary{
+		{roomID: "!a:localhost", name: "Zebra", recencyOf: 3},
+		{roomID: "!b:localhost", name: "", recencyOf: 5},
+		{roomID: "!c:localhost", name: "apple", recencyOf: 3},
+		{roomID: "!d:localhost", name: "apple", recencyOf: 1},
+	}
+	roomIDs := func() (ids []string) {
+		for _, r := range rooms {
+			ids = append(ids, r.roomID)
+		}
+		return
+	}
+
+	sortSlidingRooms(rooms, nil)
+	if got, want := roomIDs(), []string{"!b:localhost", "!a:localhost", "!c:localhost", "!d:localhost"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("by recency: got %v, want %v", got, want)
+	}
+	sortSlidingRooms(rooms, []string{slidingSortByName, slidingSortByRecency})
+	if got, want := roomIDs(), []string{"!c:localhost", "!d:localhost", "!a:localhost", "!b:localhost"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("by name then recency: got %v, want %v", got, want)
+	}
+
+	windows := slidingWindows(rooms, [][2]int{{0, 1}, {3, 10}, {5, 6}})
+	want := [][]string{{"!c:localhost", "!d:localhost"}, {"!b:localhost"}, {}}
+	if !reflect.DeepEqual(windows, want) {
+		t.Errorf("got windows %v, want %v", windows, want)
+	}
+}
+
+func TestMatchesRequiredState(t *testing.T) {
+	required := [][2]string{{"m.room.avatar", ""}, {"m.room.member", "*"}}
+	for _, tc := range []struct {
+		eventType, stateKey string
+		want                bool
+	}{
+		{"m.room.avatar", "", true},
+		{"m.room.avatar", "other", false},
+		{"m.room.member", "@alice:localhost", true},
+		{"m.room.topic", "", false},
+	} {
+		if got := matchesRequiredState(required, tc.eventType, tc.stateKey); got != tc.want {
+			t.Errorf("%s/%q: got %v, want %v", tc.eventType, tc.stateKey, got, tc.want)
+		}
+	}
+	if !matchesRequiredState([][2]string{{"*", "*"}}, "m.room.topic", "") {
+		t.Errorf("wildcard didn't match")
+	}
+}
+
+func TestSlidingSyncConnsPos(t *testing.T) {
+	var conns slidingSyncConns
+	const key = "@alice:localhost|DEVICE|"
+
+	if _, ok := conns.load(key, "1"); ok {
+		t.Fatalf("loaded a pos which was never handed out")
+	}
+	state, _ := conns.load(key, "")
+	state.rooms["!a:localhost"] = 5
+	pos1 := conns.store(key, state, true)
+
+	// The same pos can be used again, e.g. if the response was lost.
+	for i := 0; i < 2; i++ {
+		state, ok := conns.load(key, pos1)
+		if !ok || state.rooms["!a:localhost"] != 5 {
+			t.Fatalf("failed to resume from pos %s", pos1)
+		}
+		state.rooms["!a:localhost"] = 6
+		conns.store(key, state, false)
+	}
+
+	// Only the state after the last two responses is kept.
+	if _, ok := conns.load(key, pos1); ok {
+		t.Errorf("loaded a pos which should have been forgotten")
+	}
+
+	// Starting again without a pos doesn't reuse the old positions.
+	state, _ = conns.load(key, "")
+	if pos := conns.store(key, state, true); pos == pos1 {
+		t.Errorf("new connection reused pos %s", pos)
+	}
+}
@@ -18,6 +18,7 @@ type SyncRequest struct {
 	Since         StreamingToken
 	Timeout       time.Duration
 	WantFullState bool
+	IgnoredUsers  *IgnoredUsers
 
 	// Updated by the PDU stream.
 	Rooms map[string]string
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -124,6 +125,7 @@ type StreamingToken struct {
 	SendToDevicePosition StreamPosition
 	InvitePosition       StreamPosition
 	AccountDataPosition  StreamPosition
+	PresencePosition     StreamPosition
 	DeviceListPosition   LogPosition
 }
 
@@ -140,10 +142,11 @@ func (s *StreamingToken) UnmarshalText(text []byte) (err error) {
 
 func (t StreamingToken) String() string {
 	posStr := fmt.Sprintf(
-		"s%d_%d_%d_%d_%d_%d",
+		"s%d_%d_%d_%d_%d_%d_%d",
 		t.PDUPosition, t.TypingPosition,
 		t.ReceiptPosition, t.SendToDevicePosition,
 		t.InvitePosition, t.AccountDataPosition,
+		t.PresencePosition,
 	)
 	if dl := t.DeviceListPosition; !dl.IsEmpty() {
 		posStr += fmt.Sprintf(".dl-%d-%d", dl.Partition, dl.Offset)
@@ -166,6 +169,8 @@ func (t *StreamingToken) IsAfter(other StreamingToken) bool {
 		return true
 	case t.AccountDataPosition > other.AccountDataPosition:
 		return true
+	case t.PresencePosition > other.PresencePosition:
+		return true
 	case t.DeviceListPosition.IsAfter(&other.DeviceListPosition):
 		return true
 	}
@@ -173,7 +178,7 @@ func (t *StreamingToken) IsAfter(other StreamingToken) bool {
 }
 
 func (t *StreamingToken) IsEmpty() bool {
-	return t == nil || t.PDUPosition+t.TypingPosition+t.ReceiptPosition+t.SendToDevicePosition+t.InvitePosition+t.AccountDataPosition == 0 && t.DeviceListPosition.IsEmpty()
+	return t == nil || t.PDUPosition+t.TypingPosition+t.ReceiptPosition+t.SendToDevicePosition+t.InvitePosition+t.AccountDataPosition+t.PresencePosition == 0 && t.DeviceListPosition.IsEmpty()
 }
 
 // WithUpdates returns a copy of the StreamingToken with updates applied from another StreamingToken.
@@ -208,6 +213,9 @@ func (t *StreamingToken) ApplyUpdates(other StreamingToken) {
 	if other.AccountDataPosition > t.AccountDataPosition {
 		t.AccountDataPosition = other.AccountDataPosition
 	}
+	if other.PresencePosition > t.PresencePosition {
+		t.PresencePosition = other.PresencePosition
+	}
 	if other.DeviceListPosition.IsAfter(&t.DeviceListPosition) {
 		t.DeviceListPosition = other.DeviceListPosition
 	}
@@ -301,9 +309,11 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 	}
 	categories := strings.Split(tok[1:], ".")
 	parts := strings.Split(categories[0], "_")
-	var positions [6]StreamPosition
+	// Tokens issued before presence was added only have six positions, in
+	// which case the presence position is 0.
+	var positions [7]StreamPosition
 	for i, p := range parts {
-		if i > len(positions) {
+		if i >= len(positions) {
 			break
 		}
 		var pos int
@@ -320,6 +330,7 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 		SendToDevicePosition: positions[3],
 		InvitePosition:       positions[4],
 		AccountDataPosition:  positions[5],
+		PresencePosition:     positions[6],
 	}
 	// dl-0-1234
 	// $log_name-$partition-$offset
@@ -407,11 +418,14 @@ func NewResponse() *Response {
 // to return the response immediately to the client or to wait for more data.
 func (r *Response) IsEmpty() bool {
 	return len(r.Rooms.Join) == 0 &&
+		len(r.Rooms.Peek) == 0 &&
 		len(r.Rooms.Invite) == 0 &&
 		len(r.Rooms.Leave) == 0 &&
 		len(r.AccountData.Events) == 0 &&
 		len(r.Presence.Events) == 0 &&
-		len(r.ToDevice.Events) == 0
+		len(r.ToDevice.Events) == 0 &&
+		len(r.DeviceLists.Changed) == 0 &&
+		len(r.DeviceLists.Left) == 0
 }
 
 // JoinResponse represents a /sync response for a room which is under the 'join' or 'peek' key.
@@ -430,6 +444,80 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
+	UnreadNotifications NotificationCounts `json:"unread_notifications"`
+}
+
+// NotificationCounts are the number of events in a room which notified a
+// user, and how many of those were highlighted, since the user's last read
+// receipt in the room.
+type NotificationCounts struct {
+	HighlightCount    int `json:"highlight_count"`
+	NotificationCount int `json:"notification_count"`
+}
+
+// SearchResult is an event which matched a full-text search.
+type SearchResult struct {
+	EventID   string
+	RoomID    string
+	StreamPos StreamPosition
+	// Rank is how well the event matched the search, where higher is better.
+	// Ranks are only comparable between results of the same search.
+	Rank float64
+}
+
+// Relation is the relationship of an event to an earlier event, given by
+// the m.relates_to key of its content, e.g. a reaction or an edit.
+type Relation struct {
+	EventID        string
+	RoomID         string
+	EventType      string
+	Sender         string
+	OriginServerTS gomatrixserverlib.Timestamp
+	StreamPos      StreamPosition
+	// RelType is the type of the relationship, e.g. m.annotation.
+	RelType string
+	// RelatesTo is the ID of the event which the event relates to.
+	RelatesTo string
+	// Key is the aggregation key of an annotation, e.g. the emoji of a
+	// reaction.
+	Key string
+}
+
+// Well-known types of relations between events.
+const (
+	RelTypeAnnotation = "m.annotation"
+	RelTypeReference  = "m.reference"
+	RelTypeReplace    = "m.replace"
+	RelTypeThread     = "m.thread"
+)
+
+// Thread is a thread of events which relate to its root event with m.thread
+// relations.
+type Thread struct {
+	RoomID      string
+	RootEventID string
+	// RootSender is the sender of the root event, if it is known.
+	RootSender      string
+	LatestEventID   string
+	LatestStreamPos StreamPosition
+	// Count is the number of events in the thread, excluding the root.
+	Count int
+}
+
+// SearchKeys maps the event keys which can be searched to the type of the
+// events which they are indexed from.
+var SearchKeys = map[string]string{
+	"content.body":  "m.room.message",
+	"content.name":  "m.room.name",
+	"content.topic": "m.room.topic",
+}
+
+// SearchTerms splits a search into the words which are looked up in the
+// search index, lowercased and without any punctuation.
+func SearchTerms(search string) []string {
+	return strings.FieldsFunc(strings.ToLower(search), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -509,3 +597,34 @@ type Peek struct {
 	New     bool
 	Deleted bool
 }
+
+// IgnoredUsers is the content of the m.ignored_user_list account data, which
+// lists the users whose events the user doesn't want to see.
+type IgnoredUsers struct {
+	List map[string]interface{} `json:"ignored_users"`
+}
+
+// IsIgnored returns true if the user is on the ignore list.
+func (u *IgnoredUsers) IsIgnored(userID string) bool {
+	if u == nil {
+		return false
+	}
+	_, ok := u.List[userID]
+	return ok
+}
+
+// FilterEvents removes the events sent by ignored users. State events are
+// kept, since the client needs them to know the current state of the room.
+func (u *IgnoredUsers) FilterEvents(events []*gomatrixserverlib.HeaderedEvent) []*gomatrixserverlib.HeaderedEvent {
+	if u == nil || len(u.List) == 0 {
+		return events
+	}
+	filtered := make([]*gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		if ev.StateKey() == nil && u.IsIgnored(ev.Sender()) {
+			continue
+		}
+		filtered = append(filtered, ev)
+	}
+	return filtered
+}
@@ -10,10 +10,14 @@ import (
 
 func TestNewSyncTokenWithLogs(t *testing.T) {
 	tests := map[string]*StreamingToken{
-		"s4_0_0_0_0_0": {
+		"s4_0_0_0_0_0_0": {
 			PDUPosition: 4,
 		},
-		"s4_0_0_0_0_0.dl-0-123": {
+		"s4_0_0_0_0_0_5": {
+			PDUPosition:      4,
+			PresencePosition: 5,
+		},
+		"s4_0_0_0_0_0_0.dl-0-123": {
 			PDUPosition: 4,
 			DeviceListPosition: LogPosition{
 				Partition: 0,
@@ -42,9 +46,9 @@ func TestNewSyncTokenWithLogs(t *testing.T) {
 
 func TestSyncTokens(t *testing.T) {
 	shouldPass := map[string]string{
-		"s4_0_0_0_0_0":        StreamingToken{4, 0, 0, 0, 0, 0, LogPosition{}}.String(),
-		"s3_1_0_0_0_0.dl-1-2": StreamingToken{3, 1, 0, 0, 0, 0, LogPosition{1, 2}}.String(),
-		"s3_1_2_3_5_0":        StreamingToken{3, 1, 2, 3, 5, 0, LogPosition{}}.String(),
+		"s4_0_0_0_0_0_0":        StreamingToken{4, 0, 0, 0, 0, 0, 0, LogPosition{}}.String(),
+		"s3_1_0_0_0_0_0.dl-1-2": StreamingToken{3, 1, 0, 0, 0, 0, 0, LogPosition{1, 2}}.String(),
+		"s3_1_2_3_5_0_6":        StreamingToken{3, 1, 2, 3, 5, 0, 6, LogPosition{}}.String(),
 		"t3_1":                TopologyToken{3, 1}.String(),
 	}
 
@@ -77,6 +81,18 @@ func TestSyncTokens(t *testing.T) {
 	}
 }
 
+func TestNewSyncTokenWithoutPresence(t *testing.T) {
+	// Tokens issued before presence was added have six positions.
+	got, err := NewStreamTokenFromString("s4_1_2_3_5_6.dl-0-123")
+	if err != nil {
+		t.Fatalf("NewStreamTokenFromString failed: %s", err)
+	}
+	want := StreamingToken{4, 1, 2, 3, 5, 6, 0, LogPosition{0, 123}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
 func TestNewInviteResponse(t *testing.T) {
 	event := `{"auth_events":["$SbSsh09j26UAXnjd3RZqf2lyA3Kw2sY_VZJVZQAV9yA","$EwL53onrLwQ5gL8Dv3VrOOCvHiueXu2ovLdzqkNi3lo","$l2wGmz9iAwevBDGpHT_xXLUA5O8BhORxWIGU1cGi1ZM","$GsWFJLXgdlF5HpZeyWkP72tzXYWW3uQ9X28HBuTztHE"],"content":{"avatar_url":"","displayname":"neilalexander","membership":"invite"},"depth":9,"hashes":{"sha256":"8p+Ur4f8vLFX6mkIXhxI0kegPG7X3tWy56QmvBkExAg"},"origin":"matrix.org","origin_server_ts":1602087113066,"prev_events":["$1v-O6tNwhOZcA8bvCYY-Dnj1V2ZDE58lLPxtlV97S28"],"prev_state":[],"room_id":"!XbeXirGWSPXbEaGokF:matrix.org","sender":"@neilalexander:matrix.org","signatures":{"dendrite.neilalexander.dev":{"ed25519:BMJi":"05KQ5lPw0cSFsE4A0x1z7vi/3cc8bG4WHUsFWYkhxvk/XkXMGIYAYkpNThIvSeLfdcHlbm/k10AsBSKH8Uq4DA"},"matrix.org":{"ed25519:a_RXGa":"jeovuHr9E/x0sHbFkdfxDDYV/EyoeLi98douZYqZ02iYddtKhfB7R3WLay/a+D3V3V7IW0FUmPh/A404x5sYCw"}},"state_key":"@neilalexander:dendrite.neilalexander.dev","type":"m.room.member","unsigned":{"age":2512,"invite_room_state":[{"content":{"join_rule":"invite"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.join_rules"},{"content":{"avatar_url":"mxc://matrix.org/BpDaozLwgLnlNStxDxvLzhPr","displayname":"neilalexander","membership":"join"},"sender":"@neilalexander:matrix.org","state_key":"@neilalexander:matrix.org","type":"m.room.member"},{"content":{"name":"Test room"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.name"}]},"_room_version":"5"}`
 	expected := `{"invite_state":{"events":[{"content":{"join_rule":"invite"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.join_rules"},{"content":{"avatar_url":"mxc://matrix.org/BpDaozLwgLnlNStxDxvLzhPr","displayname":"neilalexander","membership":"join"},"sender":"@neilalexander:matrix.org","state_key":"@neilalexander:matrix.org","type":"m.room.member"},{"content":{"name":"Test room"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.name"},{"content":{"avatar_url":"","displayname":"neilalexander","membership":"invite"},"event_id":"$GQmw8e8-26CQv1QuFoHBHpKF1hQj61Flg3kvv_v_XWs","origin_server_ts":1602087113066,"sender":"@neilalexander:matrix.org","state_key":"@neilalexander:dendrite.neilalexander.dev","type":"m.room.member"}]}}`
@@ -96,3 +112,31 @@ func TestNewInviteResponse(t *testing.T) {
 		t.Fatalf("Invite response didn't contain correct info")
 	}
 }
+
+func TestIgnoredUsersFilterEvents(t *testing.T) {
+	var ignored IgnoredUsers
+	if err := json.Unmarshal([]byte(`{"ignored_users":{"@bob:test":{}}}`), &ignored); err != nil {
+		t.Fatal(err)
+	}
+	var events []*gomatrixserverlib.HeaderedEvent
+	for _, js := range []string{
+		`{"type":"m.room.message","event_id":"$1:test","room_id":"!r:test","sender":"@alice:test","content":{"body":"hi"}}`,
+		`{"type":"m.room.message","event_id":"$2:test","room_id":"!r:test","sender":"@bob:test","content":{"body":"hi"}}`,
+		`{"type":"m.room.topic","event_id":"$3:test","room_id":"!r:test","sender":"@bob:test","state_key":"","content":{"topic":"hi"}}`,
+	} {
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(js), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev.Headered(gomatrixserverlib.RoomVersionV1))
+	}
+
+	got := ignored.FilterEvents(events)
+	if len(got) != 2 || got[0].EventID() != "$1:test" || got[1].EventID() != "$3:test" {
+		t.Errorf("unexpected events after filtering: %v", got)
+	}
+	var none *IgnoredUsers
+	if len(none.FilterEvents(events)) != 3 {
+		t.Errorf("nil ignore list filtered events")
+	}
+}
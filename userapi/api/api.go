@@ -17,8 +17,10 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -29,17 +31,33 @@ type UserInternalAPI interface {
 	PerformPasswordUpdate(ctx context.Context, req *PerformPasswordUpdateRequest, res *PerformPasswordUpdateResponse) error
 	PerformDeviceCreation(ctx context.Context, req *PerformDeviceCreationRequest, res *PerformDeviceCreationResponse) error
 	PerformDeviceDeletion(ctx context.Context, req *PerformDeviceDeletionRequest, res *PerformDeviceDeletionResponse) error
+	PerformTokenRefresh(ctx context.Context, req *PerformTokenRefreshRequest, res *PerformTokenRefreshResponse) error
 	PerformLastSeenUpdate(ctx context.Context, req *PerformLastSeenUpdateRequest, res *PerformLastSeenUpdateResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
 	PerformOpenIDTokenCreation(ctx context.Context, req *PerformOpenIDTokenCreationRequest, res *PerformOpenIDTokenCreationResponse) error
+	PerformPresenceUpdate(ctx context.Context, req *PerformPresenceUpdateRequest, res *PerformPresenceUpdateResponse) error
+	PerformKeyBackup(ctx context.Context, req *PerformKeyBackupRequest, res *PerformKeyBackupResponse) error
 	QueryProfile(ctx context.Context, req *QueryProfileRequest, res *QueryProfileResponse) error
 	QueryAccessToken(ctx context.Context, req *QueryAccessTokenRequest, res *QueryAccessTokenResponse) error
 	QueryDevices(ctx context.Context, req *QueryDevicesRequest, res *QueryDevicesResponse) error
+	QueryDeviceConnections(ctx context.Context, req *QueryDeviceConnectionsRequest, res *QueryDeviceConnectionsResponse) error
 	QueryAccountData(ctx context.Context, req *QueryAccountDataRequest, res *QueryAccountDataResponse) error
 	QueryDeviceInfos(ctx context.Context, req *QueryDeviceInfosRequest, res *QueryDeviceInfosResponse) error
 	QuerySearchProfiles(ctx context.Context, req *QuerySearchProfilesRequest, res *QuerySearchProfilesResponse) error
 	QueryOpenIDToken(ctx context.Context, req *QueryOpenIDTokenRequest, res *QueryOpenIDTokenResponse) error
+	PerformLoginTokenCreation(ctx context.Context, req *PerformLoginTokenCreationRequest, res *PerformLoginTokenCreationResponse) error
+	PerformLoginTokenConsumption(ctx context.Context, req *PerformLoginTokenConsumptionRequest, res *PerformLoginTokenConsumptionResponse) error
+	PerformEmailSessionCreation(ctx context.Context, req *PerformEmailSessionCreationRequest, res *PerformEmailSessionCreationResponse) error
+	PerformEmailSessionValidation(ctx context.Context, req *PerformEmailSessionValidationRequest, res *PerformEmailSessionValidationResponse) error
+	PerformEmailSessionConsumption(ctx context.Context, req *PerformEmailSessionConsumptionRequest, res *PerformEmailSessionConsumptionResponse) error
+	QueryPresence(ctx context.Context, req *QueryPresenceRequest, res *QueryPresenceResponse) error
+	QueryKeyBackup(ctx context.Context, req *QueryKeyBackupRequest, res *QueryKeyBackupResponse) error
+	QueryPushRules(ctx context.Context, req *QueryPushRulesRequest, res *QueryPushRulesResponse) error
+	PerformPushRulesPut(ctx context.Context, req *PerformPushRulesPutRequest, res *PerformPushRulesPutResponse) error
+	QueryPushers(ctx context.Context, req *QueryPushersRequest, res *QueryPushersResponse) error
+	PerformPusherSet(ctx context.Context, req *PerformPusherSetRequest, res *PerformPusherSetResponse) error
+	PerformPushNotification(ctx context.Context, req *PerformPushNotificationRequest, res *PerformPushNotificationResponse) error
 }
 
 // InputAccountDataRequest is the request for InputAccountData
@@ -96,12 +114,24 @@ type QueryAccessTokenRequest struct {
 	// optional user ID, valid only if the token is an appservice.
 	// https://matrix.org/docs/spec/application_service/r0.1.2#using-sync-and-events
 	AppServiceUserID string
+	// optional: where the request came from, to record the connections of the
+	// device for /admin/whois.
+	RemoteAddr string
+	UserAgent  string
 }
 
 // QueryAccessTokenResponse is the response for QueryAccessToken
 type QueryAccessTokenResponse struct {
 	Device *Device
 	Err    error // e.g ErrorForbidden
+	// Expired is true if the access token was issued with a refresh token and
+	// has expired, in which case Device is nil.
+	Expired bool
+	// Revoked is true if the access token belonged to a device which was
+	// deleted, or was replaced with another access token, recently. Device is
+	// nil, but the user can log in again without losing their data. It isn't
+	// set if the account has been deactivated.
+	Revoked bool
 }
 
 // QueryAccountDataRequest is the request for QueryAccountData
@@ -128,6 +158,18 @@ type QueryDevicesResponse struct {
 	Devices    []Device
 }
 
+// QueryDeviceConnectionsRequest is the request for QueryDeviceConnections
+type QueryDeviceConnectionsRequest struct {
+	UserID string
+}
+
+// QueryDeviceConnectionsResponse is the response for QueryDeviceConnections
+type QueryDeviceConnectionsResponse struct {
+	// device ID -> connections, most recent first. Connections of deleted
+	// devices are kept until they are pruned.
+	Devices map[string][]DeviceConnection
+}
+
 // QueryProfileRequest is the request for QueryProfile
 type QueryProfileRequest struct {
 	// The user ID to query
@@ -197,6 +239,20 @@ type PerformLastSeenUpdateRequest struct {
 type PerformLastSeenUpdateResponse struct {
 }
 
+// PerformPresenceUpdateRequest is the request for PerformPresenceUpdate.
+type PerformPresenceUpdateRequest struct {
+	UserID    string
+	Presence  string  // required: one of PresenceOnline, PresenceUnavailable or PresenceOffline
+	StatusMsg *string // optional: if nil then the existing status message is kept
+	// The time that the user was last active. If zero then the current time
+	// is used. Set for updates from remote servers.
+	LastActiveTS gomatrixserverlib.Timestamp
+}
+
+// PerformPresenceUpdateResponse is the response for PerformPresenceUpdate.
+type PerformPresenceUpdateResponse struct {
+}
+
 // PerformDeviceCreationRequest is the request for PerformDeviceCreation
 type PerformDeviceCreationRequest struct {
 	Localpart   string
@@ -210,6 +266,9 @@ type PerformDeviceCreationRequest struct {
 	IPAddr string
 	// Useragent for this device
 	UserAgent string
+	// optional: if set, the access token expires and this refresh token can
+	// be used to replace it with PerformTokenRefresh.
+	RefreshToken string
 }
 
 // PerformDeviceCreationResponse is the response for PerformDeviceCreation
@@ -218,9 +277,95 @@ type PerformDeviceCreationResponse struct {
 	Device        *Device
 }
 
+// PerformTokenRefreshRequest is the request for PerformTokenRefresh
+type PerformTokenRefreshRequest struct {
+	RefreshToken string
+	// The tokens to replace the device's access token and the refresh token
+	// with. The old refresh token can't be used again.
+	NewAccessToken  string
+	NewRefreshToken string
+}
+
+// PerformTokenRefreshResponse is the response for PerformTokenRefresh
+type PerformTokenRefreshResponse struct {
+	// Device is nil if the refresh token is unknown, has already been used
+	// or has expired.
+	Device *Device
+}
+
+// QueryPushRulesRequest is the request for QueryPushRules
+type QueryPushRulesRequest struct {
+	UserID string
+}
+
+// QueryPushRulesResponse is the response for QueryPushRules
+type QueryPushRulesResponse struct {
+	// The push rules of the user, which are the default rules if the
+	// user hasn't changed them.
+	RuleSets *pushrules.AccountRuleSets
+}
+
+// PerformPushRulesPutRequest is the request for PerformPushRulesPut
+type PerformPushRulesPutRequest struct {
+	UserID   string
+	RuleSets *pushrules.AccountRuleSets
+}
+
+// PerformPushRulesPutResponse is the response for PerformPushRulesPut
+type PerformPushRulesPutResponse struct {
+}
+
+// QueryPushersRequest is the request for QueryPushers
+type QueryPushersRequest struct {
+	UserID string
+}
+
+// QueryPushersResponse is the response for QueryPushers
+type QueryPushersResponse struct {
+	Pushers []Pusher
+}
+
+// PerformPusherSetRequest is the request for PerformPusherSet. The pusher for
+// the app ID and pushkey is created or replaced, or removed if its kind is
+// empty.
+type PerformPusherSetRequest struct {
+	UserID string
+	Pusher Pusher
+	// If Append is false, pushers for the same app ID and pushkey belonging
+	// to other users are removed.
+	Append bool
+}
+
+// PerformPusherSetResponse is the response for PerformPusherSet
+type PerformPusherSetResponse struct {
+}
+
+// PerformPushNotificationRequest is the request for PerformPushNotification.
+// It is made when an event matches a push rule of the user which notifies.
+type PerformPushNotificationRequest struct {
+	UserID string
+	Event  *gomatrixserverlib.HeaderedEvent
+	// The display name of the event's sender in the room, if they have one
+	SenderDisplayName string
+	// The actions of the push rule which matched, for the tweaks
+	Actions []*pushrules.Action
+	// The number of unread notifications the user has across all rooms,
+	// including this one
+	UnreadCount int
+}
+
+// PerformPushNotificationResponse is the response for PerformPushNotification.
+// The notification is delivered to the pushers of the user in the background,
+// so the response is returned before delivery has finished.
+type PerformPushNotificationResponse struct {
+}
+
 // PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
 type PerformAccountDeactivationRequest struct {
 	Localpart string
+	// Erase the display name and avatar of the user, so that they are
+	// no longer shown to anyone looking up their profile.
+	Erase bool
 }
 
 // PerformAccountDeactivationResponse is the response for PerformAccountDeactivation
@@ -249,6 +394,243 @@ type QueryOpenIDTokenResponse struct {
 	ExpiresAtMS int64
 }
 
+// PerformLoginTokenCreationRequest is the request for PerformLoginTokenCreation
+type PerformLoginTokenCreationRequest struct {
+	UserID string
+}
+
+// PerformLoginTokenCreationResponse is the response for PerformLoginTokenCreation
+type PerformLoginTokenCreationResponse struct {
+	Token       string
+	ExpiresAtMS int64
+}
+
+// PerformLoginTokenConsumptionRequest is the request for PerformLoginTokenConsumption
+type PerformLoginTokenConsumptionRequest struct {
+	Token string
+}
+
+// PerformLoginTokenConsumptionResponse is the response for PerformLoginTokenConsumption
+type PerformLoginTokenConsumptionResponse struct {
+	// The user ID that the token was issued for, or empty if the token
+	// doesn't exist, has expired or has already been used.
+	UserID string
+}
+
+// PerformEmailSessionCreationRequest is the request for PerformEmailSessionCreation
+type PerformEmailSessionCreationRequest struct {
+	ClientSecret string
+	Email        string
+	SendAttempt  int
+	ExpiresAtMS  int64
+}
+
+// PerformEmailSessionCreationResponse is the response for PerformEmailSessionCreation
+type PerformEmailSessionCreationResponse struct {
+	SessionID string
+	Token     string
+	// Whether a validation email should be sent. This is false if the client
+	// retried a send attempt that it had already made.
+	Send bool
+}
+
+// PerformEmailSessionValidationRequest is the request for PerformEmailSessionValidation
+type PerformEmailSessionValidationRequest struct {
+	SessionID    string
+	ClientSecret string
+	Token        string
+}
+
+// PerformEmailSessionValidationResponse is the response for PerformEmailSessionValidation
+type PerformEmailSessionValidationResponse struct {
+	Validated bool
+}
+
+// PerformEmailSessionConsumptionRequest is the request for PerformEmailSessionConsumption
+type PerformEmailSessionConsumptionRequest struct {
+	SessionID    string
+	ClientSecret string
+}
+
+// PerformEmailSessionConsumptionResponse is the response for PerformEmailSessionConsumption
+type PerformEmailSessionConsumptionResponse struct {
+	// The email address that the session validated, or empty if the session
+	// doesn't exist, hasn't been validated or has already been used.
+	Email string
+}
+
+// QueryPresenceRequest is the request for QueryPresence.
+type QueryPresenceRequest struct {
+	UserID string
+}
+
+// QueryPresenceResponse is the response for QueryPresence.
+type QueryPresenceResponse struct {
+	// Exists is false if no presence is known for the user.
+	Exists   bool
+	Presence Presence
+}
+
+// PerformKeyBackupRequest is the request for PerformKeyBackup. Exactly one of
+// the following is done, in this order of precedence:
+//   - if Version is empty, a new backup version is created with the algorithm and auth data
+//   - if DeleteBackup is set, the backup version and all of its keys are deleted
+//   - if Keys is set, the keys are uploaded to the backup version, which must be the latest one
+//   - if DeleteKeys is set, the keys in the room, or only the session if SessionID is also set,
+//     are deleted from the backup version, or all keys if RoomID is empty
+//   - otherwise the auth data of the backup version is replaced, keeping the same algorithm
+type PerformKeyBackupRequest struct {
+	UserID       string
+	Version      string
+	Algorithm    string
+	AuthData     json.RawMessage
+	DeleteBackup bool
+	// Keys to upload as room ID to session ID to key
+	Keys       map[string]map[string]KeyBackupSession
+	DeleteKeys bool
+	RoomID     string
+	SessionID  string
+}
+
+// PerformKeyBackupResponse is the response for PerformKeyBackup
+type PerformKeyBackupResponse struct {
+	// Exists is false if the backup version doesn't exist.
+	Exists bool
+	// BadInput is set if the request can't be carried out, e.g. because the
+	// algorithm of an existing backup version would change.
+	BadInput bool
+	// WrongVersion is set if keys were uploaded to a backup version which isn't
+	// the latest one.
+	WrongVersion bool
+	// Version is the created backup version, or the latest backup version if
+	// WrongVersion is set.
+	Version string
+	// The number of keys in the backup version and its etag, after uploading
+	// or deleting keys.
+	KeyCount int64
+	KeyETag  string
+}
+
+// QueryKeyBackupRequest is the request for QueryKeyBackup
+type QueryKeyBackupRequest struct {
+	UserID string
+	// The backup version, or empty for the latest version
+	Version string
+	// ReturnKeys is set to return the keys in the backup version, optionally
+	// limited to a room or a session in a room.
+	ReturnKeys       bool
+	KeysForRoomID    string
+	KeysForSessionID string
+}
+
+// QueryKeyBackupResponse is the response for QueryKeyBackup
+type QueryKeyBackupResponse struct {
+	// Exists is false if the backup version doesn't exist.
+	Exists    bool
+	Version   string
+	Algorithm string
+	AuthData  json.RawMessage
+	Count     int64
+	ETag      string
+	// Keys as room ID to session ID to key, if ReturnKeys was set
+	Keys map[string]map[string]KeyBackupSession
+}
+
+// KeyBackupVersion is the metadata of a key backup version.
+type KeyBackupVersion struct {
+	Version   string
+	Algorithm string
+	AuthData  json.RawMessage
+	Count     int64
+	ETag      string
+}
+
+// KeyBackupSession is a backed up room key
+// https://matrix.org/docs/spec/client_server/r0.6.1#put-matrix-client-r0-room-keys-keys-roomid-sessionid
+type KeyBackupSession struct {
+	FirstMessageIndex int             `json:"first_message_index"`
+	ForwardedCount    int             `json:"forwarded_count"`
+	IsVerified        bool            `json:"is_verified"`
+	SessionData       json.RawMessage `json:"session_data"`
+}
+
+// ShouldReplaceRoomKey returns true if the new key is better than this one and
+// should replace it in the backup: a verified key beats an unverified one, then
+// the key with the lowest first message index wins, then the key which has been
+// forwarded the fewest times.
+func (k *KeyBackupSession) ShouldReplaceRoomKey(newKey *KeyBackupSession) bool {
+	if newKey.IsVerified != k.IsVerified {
+		return newKey.IsVerified
+	}
+	if newKey.FirstMessageIndex != k.FirstMessageIndex {
+		return newKey.FirstMessageIndex < k.FirstMessageIndex
+	}
+	return newKey.ForwardedCount < k.ForwardedCount
+}
+
+// InternalKeyBackupSession is a backed up room key along with the room and session it is for.
+type InternalKeyBackupSession struct {
+	KeyBackupSession
+	RoomID    string
+	SessionID string
+}
+
+// The presence states of a user.
+const (
+	PresenceOnline      = "online"
+	PresenceUnavailable = "unavailable"
+	PresenceOffline     = "offline"
+)
+
+// Presence is the presence of a user. It is also the format of the messages
+// on the output presence topic.
+type Presence struct {
+	UserID       string                      `json:"user_id"`
+	Presence     string                      `json:"presence"`
+	StatusMsg    *string                     `json:"status_msg,omitempty"`
+	LastActiveTS gomatrixserverlib.Timestamp `json:"last_active_ts"`
+}
+
+// ValidPresence returns true if the presence state is one of the states
+// defined by the spec.
+func ValidPresence(presence string) bool {
+	switch presence {
+	case PresenceOnline, PresenceUnavailable, PresenceOffline:
+		return true
+	}
+	return false
+}
+
+// LastActiveAgo returns how many milliseconds ago the user was last active.
+func (p *Presence) LastActiveAgo() int64 {
+	ago := int64(gomatrixserverlib.AsTimestamp(time.Now()) - p.LastActiveTS)
+	if ago < 0 {
+		return 0
+	}
+	return ago
+}
+
+// The kinds of pusher.
+const (
+	HTTPPusherKind  = "http"
+	EmailPusherKind = "email"
+)
+
+// Pusher is where notifications for a user are delivered to: either a push
+// gateway, or an email address which is the pushkey.
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-pushers
+type Pusher struct {
+	PushKey           string                 `json:"pushkey"`
+	PushKeyTS         int64                  `json:"pushkey_ts,omitempty"`
+	Kind              string                 `json:"kind"`
+	AppID             string                 `json:"app_id"`
+	AppDisplayName    string                 `json:"app_display_name"`
+	DeviceDisplayName string                 `json:"device_display_name"`
+	ProfileTag        string                 `json:"profile_tag,omitempty"`
+	Language          string                 `json:"lang"`
+	Data              map[string]interface{} `json:"data"`
+}
+
 // Device represents a client's device (mobile, web, etc)
 type Device struct {
 	ID     string
@@ -267,6 +649,21 @@ type Device struct {
 	// If the device is for an appservice user,
 	// this is the appservice ID.
 	AppserviceID string
+	// The type of the account which owns this device,
+	// e.g. so that guest restrictions can be applied.
+	AccountType AccountType
+	// When the access token expires, as a unix timestamp (ms resolution), or 0
+	// if it never expires. Only access tokens issued along with a refresh token
+	// expire.
+	AccessTokenExpiresTS int64
+}
+
+// DeviceConnection is an IP address and user agent which a device has
+// connected from.
+type DeviceConnection struct {
+	IP         string
+	UserAgent  string
+	LastSeenTS int64
 }
 
 // Account represents a Matrix account on this home server.
@@ -275,10 +672,62 @@ type Account struct {
 	Localpart    string
 	ServerName   gomatrixserverlib.ServerName
 	AppServiceID string
-	// TODO: Other flags like IsAdmin, IsGuest
+	// Deactivated accounts can't be logged in to
+	Deactivated bool
+	AccountType AccountType
+	// TODO: Other flags like IsAdmin
 	// TODO: Associations (e.g. with application services)
 }
 
+// EmailSession is a session used to validate that a user owns an email address
+type EmailSession struct {
+	SessionID      string
+	ClientSecret   string
+	Email          string
+	Token          string
+	SendAttempt    int
+	Validated      bool
+	FailedAttempts int
+	ExpiresAtMS    int64
+}
+
+// RegistrationToken is a token which allows users to register, on servers
+// which require one (MSC3231)
+type RegistrationToken struct {
+	Token string
+	// How many times the token can be used, or nil if there is no limit
+	UsesAllowed *int32
+	// How many times the token has been used to register
+	Completed int32
+	// When the token expires, as a unix timestamp (ms resolution), or nil if
+	// it doesn't expire
+	ExpiryTime *int64
+}
+
+// EventReport is a report of an event sent by a user to the server admins.
+type EventReport struct {
+	ID      int64
+	RoomID  string
+	EventID string
+	// The user who reported the event
+	UserID string
+	Reason string
+	// The score given to the event, from -100 (most offensive) to 0, or nil
+	// if the user didn't give one
+	Score *int64
+	// The event as it was when it was reported, so that the report is still
+	// useful if the event is later purged
+	EventJSON json.RawMessage
+	// When the event was reported, as a unix timestamp (ms resolution)
+	ReceivedTS int64
+}
+
+// LoginTokenAttributes represents the attributes associated with an issued login token
+type LoginTokenAttributes struct {
+	UserID      string
+	ExpiresAtMS int64
+}
+
 // OpenIDToken represents an OpenID token
 type OpenIDToken struct {
 	Token       string
@@ -332,3 +781,36 @@ const (
 	// AccountTypeGuest indicates this is a guest account
 	AccountTypeGuest AccountType = 2
 )
+
+// MPresence is the type of presence events and EDUs.
+const MPresence = "m.presence"
+
+// PresenceEDU is the content of an m.presence EDU.
+type PresenceEDU struct {
+	Push []PresenceContent `json:"push"`
+}
+
+// currentlyActiveThreshold is how recently an online user must have been
+// active to be reported as currently active.
+const currentlyActiveThreshold = time.Minute
+
+// PresenceContent is the content of an m.presence event sent to clients, and
+// of each entry pushed in an m.presence EDU, which also includes the user ID.
+type PresenceContent struct {
+	UserID          string  `json:"user_id,omitempty"`
+	Presence        string  `json:"presence"`
+	StatusMsg       *string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64   `json:"last_active_ago"`
+	CurrentlyActive bool    `json:"currently_active"`
+}
+
+// Content returns the presence as m.presence content, without the user ID.
+func (p *Presence) Content() PresenceContent {
+	ago := p.LastActiveAgo()
+	return PresenceContent{
+		Presence:        p.Presence,
+		StatusMsg:       p.StatusMsg,
+		LastActiveAgo:   ago,
+		CurrentlyActive: p.Presence == PresenceOnline && ago < currentlyActiveThreshold.Milliseconds(),
+	}
+}
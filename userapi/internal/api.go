@@ -20,9 +20,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
@@ -41,6 +44,19 @@ type UserInternalAPI struct {
 	// AppServices is the list of all registered AS
 	AppServices []config.ApplicationService
 	KeyAPI      keyapi.KeyInternalAPI
+	// Presence is nil if presence is disabled.
+	Presence *PresenceUpdater
+	Pushers  *PushDispatcher
+	// Connections is nil if connections aren't being recorded, e.g. in tests.
+	Connections *ConnectionRecorder
+	// Introspector is nil unless authentication is delegated to an OAuth 2.0
+	// authorization server, in which case it validates access tokens instead
+	// of the device database.
+	Introspector *TokenIntrospector
+	// How long access tokens issued along with refresh tokens are valid for,
+	// and how long the refresh tokens are valid for, or 0 if they never expire.
+	AccessTokenLifetime  time.Duration
+	RefreshTokenLifetime time.Duration
 }
 
 func (a *UserInternalAPI) InputAccountData(ctx context.Context, req *api.InputAccountDataRequest, res *api.InputAccountDataResponse) error {
@@ -117,12 +133,49 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	if err != nil {
 		return err
 	}
+	if req.RefreshToken != "" {
+		accessTokenExpiresTS, refreshTokenExpiresTS := a.tokenExpiry(time.Now())
+		if err = a.DeviceDB.InsertRefreshToken(
+			ctx, req.RefreshToken, dev.AccessToken, req.Localpart, dev.ID, accessTokenExpiresTS, refreshTokenExpiresTS,
+		); err != nil {
+			return err
+		}
+		dev.AccessTokenExpiresTS = accessTokenExpiresTS
+	}
 	res.DeviceCreated = true
 	res.Device = dev
 	// create empty device keys and upload them to trigger device list changes
 	return a.deviceListUpdate(dev.UserID, []string{dev.ID})
 }
 
+// tokenExpiry returns when an access token and refresh token issued now
+// expire, as unix timestamps (ms resolution). The refresh token expiry is 0 if
+// refresh tokens never expire.
+func (a *UserInternalAPI) tokenExpiry(now time.Time) (accessTokenExpiresTS, refreshTokenExpiresTS int64) {
+	accessTokenExpiresTS = int64(gomatrixserverlib.AsTimestamp(now.Add(a.AccessTokenLifetime)))
+	if a.RefreshTokenLifetime > 0 {
+		refreshTokenExpiresTS = int64(gomatrixserverlib.AsTimestamp(now.Add(a.RefreshTokenLifetime)))
+	}
+	return
+}
+
+func (a *UserInternalAPI) PerformTokenRefresh(ctx context.Context, req *api.PerformTokenRefreshRequest, res *api.PerformTokenRefreshResponse) error {
+	now := time.Now()
+	accessTokenExpiresTS, refreshTokenExpiresTS := a.tokenExpiry(now)
+	dev, err := a.DeviceDB.RefreshAccessToken(
+		ctx, req.RefreshToken, req.NewAccessToken, req.NewRefreshToken,
+		int64(gomatrixserverlib.AsTimestamp(now)), accessTokenExpiresTS, refreshTokenExpiresTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	res.Device = dev
+	return nil
+}
+
 func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
 	util.GetLogger(ctx).WithField("user_id", req.UserID).WithField("devices", req.DeviceIDs).Info("PerformDeviceDeletion")
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
@@ -306,6 +359,22 @@ func (a *UserInternalAPI) QueryDevices(ctx context.Context, req *api.QueryDevice
 	return nil
 }
 
+func (a *UserInternalAPI) QueryDeviceConnections(ctx context.Context, req *api.QueryDeviceConnectionsRequest, res *api.QueryDeviceConnectionsResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot query device connections of remote users: got %s want %s", domain, a.ServerName)
+	}
+	connections, err := a.DeviceDB.GetDeviceConnections(ctx, local)
+	if err != nil {
+		return err
+	}
+	res.Devices = connections
+	return nil
+}
+
 func (a *UserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
 	if err != nil {
@@ -343,6 +412,108 @@ func (a *UserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAc
 	return nil
 }
 
+// QueryPushRules returns the push rules of the user. Accounts which were
+// created before we had push rules have an empty rule set, and get the
+// default rules instead.
+func (a *UserInternalAPI) QueryPushRules(ctx context.Context, req *api.QueryPushRulesRequest, res *api.QueryPushRulesResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot query push rules of remote users: got %s want %s", domain, a.ServerName)
+	}
+	data, err := a.AccountDB.GetAccountDataByType(ctx, local, "", pushRulesAccountDataType)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.GetAccountDataByType: %w", err)
+	}
+	var ruleSets pushrules.AccountRuleSets
+	if data != nil {
+		if err = json.Unmarshal(data, &ruleSets); err != nil {
+			return fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+	if ruleSets.Global.IsEmpty() {
+		ruleSets = *pushrules.DefaultAccountRuleSets(local, a.ServerName)
+	}
+	res.RuleSets = &ruleSets
+	return nil
+}
+
+// PerformPushRulesPut replaces the push rules of the user.
+func (a *UserInternalAPI) PerformPushRulesPut(ctx context.Context, req *api.PerformPushRulesPutRequest, res *api.PerformPushRulesPutResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot set push rules of remote users: got %s want %s", domain, a.ServerName)
+	}
+	data, err := json.Marshal(req.RuleSets)
+	if err != nil {
+		return fmt.Errorf("json.Marshal: %w", err)
+	}
+	if err = a.AccountDB.SaveAccountData(ctx, local, "", pushRulesAccountDataType, data); err != nil {
+		return fmt.Errorf("a.AccountDB.SaveAccountData: %w", err)
+	}
+	return nil
+}
+
+// QueryPushers returns the pushers of the user.
+func (a *UserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot query pushers of remote users: got %s want %s", domain, a.ServerName)
+	}
+	res.Pushers, err = a.AccountDB.GetPushers(ctx, local)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.GetPushers: %w", err)
+	}
+	return nil
+}
+
+// PerformPusherSet creates, replaces or removes a pusher of the user.
+func (a *UserInternalAPI) PerformPusherSet(ctx context.Context, req *api.PerformPusherSetRequest, res *api.PerformPusherSetResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot set pushers of remote users: got %s want %s", domain, a.ServerName)
+	}
+	if req.Pusher.Kind == "" {
+		if err = a.AccountDB.RemovePusher(ctx, local, req.Pusher.AppID, req.Pusher.PushKey); err != nil {
+			return fmt.Errorf("a.AccountDB.RemovePusher: %w", err)
+		}
+		return nil
+	}
+	pusher := req.Pusher
+	pusher.PushKeyTS = int64(gomatrixserverlib.AsTimestamp(time.Now()))
+	if err = a.AccountDB.UpsertPusher(ctx, local, &pusher, !req.Append); err != nil {
+		return fmt.Errorf("a.AccountDB.UpsertPusher: %w", err)
+	}
+	return nil
+}
+
+// PerformPushNotification starts delivering a notification to the pushers of
+// the user.
+func (a *UserInternalAPI) PerformPushNotification(ctx context.Context, req *api.PerformPushNotificationRequest, res *api.PerformPushNotificationResponse) error {
+	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return err
+	}
+	if domain != a.ServerName {
+		return fmt.Errorf("cannot notify remote users: got %s want %s", domain, a.ServerName)
+	}
+	if a.Pushers == nil {
+		return nil
+	}
+	return a.Pushers.Notify(ctx, local, req)
+}
+
 func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAccessTokenRequest, res *api.QueryAccessTokenResponse) error {
 	if req.AppServiceUserID != "" {
 		appServiceDevice, err := a.queryAppServiceToken(ctx, req.AccessToken, req.AppServiceUserID)
@@ -350,17 +521,121 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		res.Err = err
 		return nil
 	}
-	device, err := a.DeviceDB.GetDeviceByAccessToken(ctx, req.AccessToken)
+	var device *api.Device
+	var err error
+	if a.Introspector != nil {
+		device, err = a.queryIntrospectedToken(ctx, req.AccessToken)
+		if err != nil || device == nil {
+			return err
+		}
+	} else {
+		device, err = a.DeviceDB.GetDeviceByAccessToken(ctx, req.AccessToken)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				res.Revoked, err = a.isAccessTokenRevoked(ctx, req.AccessToken)
+			}
+			return err
+		}
+		if device.AccessTokenExpiresTS != 0 && device.AccessTokenExpiresTS <= int64(gomatrixserverlib.AsTimestamp(time.Now())) {
+			res.Expired = true
+			return nil
+		}
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		return err
+	}
+	acc, err := a.AccountDB.GetAccountByLocalpart(ctx, localpart)
+	if err != nil {
+		if err == sql.ErrNoRows && a.Introspector != nil {
+			// The authorization server knows about users which we don't.
+			util.GetLogger(ctx).WithField("user_id", device.UserID).Warn("Access token was issued to a user without an account")
 			return nil
 		}
 		return err
 	}
+	device.AccountType = acc.AccountType
 	res.Device = device
+	if a.Connections != nil && req.RemoteAddr != "" {
+		go func() {
+			if err := a.Connections.Record(context.Background(), localpart, device.ID, req.RemoteAddr, req.UserAgent); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("Failed to record device connection")
+			}
+		}()
+	}
 	return nil
 }
 
+// isAccessTokenRevoked returns true if the access token was revoked recently
+// and the user can log in again, so that the client should be soft logged out
+// rather than discarding its data.
+func (a *UserInternalAPI) isAccessTokenRevoked(ctx context.Context, accessToken string) (bool, error) {
+	localpart, err := a.DeviceDB.GetRevokedAccessToken(ctx, accessToken)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	acc, err := a.AccountDB.GetAccountByLocalpart(ctx, localpart)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return !acc.Deactivated, nil
+}
+
+// queryIntrospectedToken returns the device which an access token issued by the
+// authorization server belongs to, or nil if the token isn't active. Devices
+// are created the first time they are seen, so that they can be managed like
+// any other device.
+func (a *UserInternalAPI) queryIntrospectedToken(ctx context.Context, accessToken string) (*api.Device, error) {
+	token, err := a.Introspector.Introspect(ctx, accessToken)
+	if err != nil {
+		return nil, fmt.Errorf("a.Introspector.Introspect: %w", err)
+	}
+	if !token.Active {
+		return nil, nil
+	}
+	localpart := token.Subject
+	if strings.HasPrefix(localpart, "@") {
+		var domain gomatrixserverlib.ServerName
+		localpart, domain, err = gomatrixserverlib.SplitID('@', token.Subject)
+		if err != nil || domain != a.ServerName {
+			util.GetLogger(ctx).WithField("sub", token.Subject).Warn("Access token was issued to a user on another server")
+			return nil, nil
+		}
+	}
+	deviceID := token.DeviceID()
+	if localpart == "" || deviceID == "" {
+		util.GetLogger(ctx).WithField("sub", token.Subject).Warn("Access token isn't scoped to a user and device")
+		return nil, nil
+	}
+
+	device, err := a.DeviceDB.GetDeviceByID(ctx, localpart, deviceID)
+	if err == sql.ErrNoRows {
+		// The device's access token in the database is never used, so make it
+		// one which can't be guessed in case delegated auth is turned off.
+		var placeholder string
+		if placeholder, err = generatePlaceholderToken(); err != nil {
+			return nil, err
+		}
+		var createRes api.PerformDeviceCreationResponse
+		if err = a.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+			Localpart:   localpart,
+			AccessToken: placeholder,
+			DeviceID:    &deviceID,
+		}, &createRes); err != nil {
+			return nil, err
+		}
+		device = createRes.Device
+	} else if err != nil {
+		return nil, err
+	}
+	device.AccessToken = accessToken
+	return device, nil
+}
+
 // Return the appservice 'device' or nil if the token is not an appservice. Returns an error if there was a problem
 // creating a 'device'.
 func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appServiceUserID string) (*api.Device, error) {
@@ -409,10 +684,58 @@ func (a *UserInternalAPI) queryAppServiceToken(ctx context.Context, token, appSe
 }
 
 // PerformAccountDeactivation deactivates the user's account, removing all ability for the user to login again.
+// All of the user's devices, access tokens, keys and 3PID associations are deleted. Leaving the user's rooms
+// is done by the caller, as that needs the roomserver.
 func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *api.PerformAccountDeactivationRequest, res *api.PerformAccountDeactivationResponse) error {
-	err := a.AccountDB.DeactivateAccount(ctx, req.Localpart)
-	res.AccountDeactivated = err == nil
-	return err
+	if err := a.AccountDB.DeactivateAccount(ctx, req.Localpart); err != nil {
+		return fmt.Errorf("a.AccountDB.DeactivateAccount: %w", err)
+	}
+	res.AccountDeactivated = true
+
+	userID := userutil.MakeUserID(req.Localpart, a.ServerName)
+	if err := a.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
+		UserID: userID,
+	}, &api.PerformDeviceDeletionResponse{}); err != nil {
+		return fmt.Errorf("a.PerformDeviceDeletion: %w", err)
+	}
+
+	var keyRes keyapi.PerformDeleteKeysResponse
+	a.KeyAPI.PerformDeleteKeys(ctx, &keyapi.PerformDeleteKeysRequest{
+		UserID: userID,
+	}, &keyRes)
+	if keyRes.Error != nil {
+		return fmt.Errorf("a.KeyAPI.PerformDeleteKeys: %w", keyRes.Error)
+	}
+
+	threepids, err := a.AccountDB.GetThreePIDsForLocalpart(ctx, req.Localpart)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.GetThreePIDsForLocalpart: %w", err)
+	}
+	for _, threepid := range threepids {
+		if err = a.AccountDB.RemoveThreePIDAssociation(ctx, threepid.Address, threepid.Medium); err != nil {
+			return fmt.Errorf("a.AccountDB.RemoveThreePIDAssociation: %w", err)
+		}
+	}
+
+	pushers, err := a.AccountDB.GetPushers(ctx, req.Localpart)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.GetPushers: %w", err)
+	}
+	for _, pusher := range pushers {
+		if err = a.AccountDB.RemovePusher(ctx, req.Localpart, pusher.AppID, pusher.PushKey); err != nil {
+			return fmt.Errorf("a.AccountDB.RemovePusher: %w", err)
+		}
+	}
+
+	if req.Erase {
+		if err = a.AccountDB.SetDisplayName(ctx, req.Localpart, ""); err != nil {
+			return fmt.Errorf("a.AccountDB.SetDisplayName: %w", err)
+		}
+		if err = a.AccountDB.SetAvatarURL(ctx, req.Localpart, ""); err != nil {
+			return fmt.Errorf("a.AccountDB.SetAvatarURL: %w", err)
+		}
+	}
+	return nil
 }
 
 // PerformOpenIDTokenCreation creates a new token that a relying party uses to authenticate a user
@@ -442,3 +765,244 @@ func (a *UserInternalAPI) QueryOpenIDToken(ctx context.Context, req *api.QueryOp
 
 	return nil
 }
+
+// PerformLoginTokenCreation creates a new single-use token that the user can log in with using m.login.token
+func (a *UserInternalAPI) PerformLoginTokenCreation(ctx context.Context, req *api.PerformLoginTokenCreationRequest, res *api.PerformLoginTokenCreationResponse) error {
+	if _, domain, err := gomatrixserverlib.SplitID('@', req.UserID); err != nil {
+		return err
+	} else if domain != a.ServerName {
+		return fmt.Errorf("cannot create a login token for remote user %s", req.UserID)
+	}
+	token := util.RandomString(32)
+	exp, err := a.AccountDB.CreateLoginToken(ctx, token, req.UserID)
+	if err != nil {
+		return err
+	}
+	res.Token = token
+	res.ExpiresAtMS = exp
+	return nil
+}
+
+// PerformLoginTokenConsumption redeems a login token, which can only be done once
+func (a *UserInternalAPI) PerformLoginTokenConsumption(ctx context.Context, req *api.PerformLoginTokenConsumptionRequest, res *api.PerformLoginTokenConsumptionResponse) error {
+	attrs, err := a.AccountDB.ConsumeLoginToken(ctx, req.Token)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// The account may have been deactivated since the token was created.
+	localpart, _, err := gomatrixserverlib.SplitID('@', attrs.UserID)
+	if err != nil {
+		return err
+	}
+	account, err := a.AccountDB.GetAccountByLocalpart(ctx, localpart)
+	if err == sql.ErrNoRows || (err == nil && account.Deactivated) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	res.UserID = attrs.UserID
+	return nil
+}
+
+// pushRulesAccountDataType is the global account data which the push rules
+// of a user are stored in, so that clients see them change in /sync.
+const pushRulesAccountDataType = "m.push_rules"
+
+// maxEmailSessionFailedAttempts is how many incorrect tokens can be submitted
+// for an email validation session before it can no longer be validated.
+const maxEmailSessionFailedAttempts = 5
+
+// PerformEmailSessionCreation creates a session used to validate that the user owns an email address
+func (a *UserInternalAPI) PerformEmailSessionCreation(ctx context.Context, req *api.PerformEmailSessionCreationRequest, res *api.PerformEmailSessionCreationResponse) error {
+	session, send, err := a.AccountDB.CreateEmailSession(ctx, &api.EmailSession{
+		SessionID:    util.RandomString(32),
+		ClientSecret: req.ClientSecret,
+		Email:        req.Email,
+		Token:        util.RandomString(32),
+		SendAttempt:  req.SendAttempt,
+		ExpiresAtMS:  req.ExpiresAtMS,
+	})
+	if err != nil {
+		return err
+	}
+	res.SessionID = session.SessionID
+	res.Token = session.Token
+	res.Send = send
+	return nil
+}
+
+// PerformEmailSessionValidation submits the token that was emailed to the user
+func (a *UserInternalAPI) PerformEmailSessionValidation(ctx context.Context, req *api.PerformEmailSessionValidationRequest, res *api.PerformEmailSessionValidationResponse) error {
+	validated, err := a.AccountDB.ValidateEmailSession(ctx, req.SessionID, req.ClientSecret, req.Token, maxEmailSessionFailedAttempts)
+	if err != nil {
+		return err
+	}
+	res.Validated = validated
+	return nil
+}
+
+// PerformEmailSessionConsumption uses up a validated email session, which can only be done once
+func (a *UserInternalAPI) PerformEmailSessionConsumption(ctx context.Context, req *api.PerformEmailSessionConsumptionRequest, res *api.PerformEmailSessionConsumptionResponse) error {
+	email, err := a.AccountDB.ConsumeEmailSession(ctx, req.SessionID, req.ClientSecret)
+	if err != nil {
+		return err
+	}
+	res.Email = email
+	return nil
+}
+
+func (a *UserInternalAPI) PerformPresenceUpdate(ctx context.Context, req *api.PerformPresenceUpdateRequest, res *api.PerformPresenceUpdateResponse) error {
+	if !api.ValidPresence(req.Presence) {
+		return fmt.Errorf("invalid presence %q", req.Presence)
+	}
+	if a.Presence == nil {
+		// presence is disabled
+		return nil
+	}
+	presence := &api.Presence{
+		UserID:       req.UserID,
+		Presence:     req.Presence,
+		StatusMsg:    req.StatusMsg,
+		LastActiveTS: req.LastActiveTS,
+	}
+	if presence.LastActiveTS == 0 {
+		presence.LastActiveTS = gomatrixserverlib.AsTimestamp(time.Now())
+	}
+	if presence.StatusMsg == nil {
+		existing, err := a.AccountDB.GetPresence(ctx, req.UserID)
+		if err != nil {
+			return fmt.Errorf("a.AccountDB.GetPresence: %w", err)
+		}
+		if existing != nil {
+			presence.StatusMsg = existing.StatusMsg
+		}
+	}
+	return a.Presence.Update(ctx, presence)
+}
+
+func (a *UserInternalAPI) QueryPresence(ctx context.Context, req *api.QueryPresenceRequest, res *api.QueryPresenceResponse) error {
+	if a.Presence == nil {
+		// presence is disabled
+		return nil
+	}
+	presence, err := a.AccountDB.GetPresence(ctx, req.UserID)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.GetPresence: %w", err)
+	}
+	if presence != nil {
+		res.Exists = true
+		res.Presence = *presence
+	}
+	return nil
+}
+
+func (a *UserInternalAPI) PerformKeyBackup(ctx context.Context, req *api.PerformKeyBackupRequest, res *api.PerformKeyBackupResponse) error {
+	// Create a new backup version
+	if req.Version == "" {
+		version, err := a.AccountDB.CreateKeyBackup(ctx, req.UserID, req.Algorithm, req.AuthData)
+		if err != nil {
+			return fmt.Errorf("a.AccountDB.CreateKeyBackup: %w", err)
+		}
+		res.Exists = true
+		res.Version = version
+		return nil
+	}
+
+	// Delete a backup version and all of its keys
+	if req.DeleteBackup {
+		exists, err := a.AccountDB.DeleteKeyBackup(ctx, req.UserID, req.Version)
+		if err != nil {
+			return fmt.Errorf("a.AccountDB.DeleteKeyBackup: %w", err)
+		}
+		res.Exists = exists
+		res.Version = req.Version
+		return nil
+	}
+
+	// Keys can only be uploaded to the latest backup version
+	if req.Keys != nil {
+		latest, err := a.AccountDB.GetKeyBackup(ctx, req.UserID, "")
+		if err != nil {
+			return fmt.Errorf("a.AccountDB.GetKeyBackup: %w", err)
+		}
+		if latest == nil {
+			return nil
+		}
+		res.Exists = true
+		if latest.Version != req.Version {
+			res.WrongVersion = true
+			res.Version = latest.Version
+			return nil
+		}
+		var uploads []api.InternalKeyBackupSession
+		for roomID, sessions := range req.Keys {
+			for sessionID, session := range sessions {
+				uploads = append(uploads, api.InternalKeyBackupSession{
+					KeyBackupSession: session,
+					RoomID:           roomID,
+					SessionID:        sessionID,
+				})
+			}
+		}
+		res.Version = req.Version
+		res.KeyCount, res.KeyETag, err = a.AccountDB.UpsertBackupKeys(ctx, req.UserID, req.Version, uploads)
+		if err != nil {
+			return fmt.Errorf("a.AccountDB.UpsertBackupKeys: %w", err)
+		}
+		return nil
+	}
+
+	backup, err := a.AccountDB.GetKeyBackup(ctx, req.UserID, req.Version)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.GetKeyBackup: %w", err)
+	}
+	if backup == nil {
+		return nil
+	}
+	res.Exists = true
+	res.Version = backup.Version
+
+	// Delete keys from a backup version
+	if req.DeleteKeys {
+		res.KeyCount, res.KeyETag, err = a.AccountDB.DeleteBackupKeys(ctx, req.UserID, req.Version, req.RoomID, req.SessionID)
+		if err != nil {
+			return fmt.Errorf("a.AccountDB.DeleteBackupKeys: %w", err)
+		}
+		return nil
+	}
+
+	// Update the auth data of a backup version, which can't change its algorithm
+	if req.Algorithm != backup.Algorithm {
+		res.BadInput = true
+		return nil
+	}
+	if err = a.AccountDB.UpdateKeyBackupAuthData(ctx, req.UserID, req.Version, req.AuthData); err != nil {
+		return fmt.Errorf("a.AccountDB.UpdateKeyBackupAuthData: %w", err)
+	}
+	return nil
+}
+
+func (a *UserInternalAPI) QueryKeyBackup(ctx context.Context, req *api.QueryKeyBackupRequest, res *api.QueryKeyBackupResponse) error {
+	backup, err := a.AccountDB.GetKeyBackup(ctx, req.UserID, req.Version)
+	if err != nil {
+		return fmt.Errorf("a.AccountDB.GetKeyBackup: %w", err)
+	}
+	if backup == nil {
+		return nil
+	}
+	res.Exists = true
+	res.Version = backup.Version
+	res.Algorithm = backup.Algorithm
+	res.AuthData = backup.AuthData
+	res.Count = backup.Count
+	res.ETag = backup.ETag
+	if req.ReturnKeys {
+		res.Keys, err = a.AccountDB.GetBackupKeys(ctx, req.UserID, backup.Version, req.KeysForRoomID, req.KeysForSessionID)
+		if err != nil {
+			return fmt.Errorf("a.AccountDB.GetBackupKeys: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"github.com/sirupsen/logrus"
+)
+
+// connectionPruneInterval is the time between deleting old connections.
+const connectionPruneInterval = time.Hour
+
+// ConnectionRecorder records the IP addresses and user agents which devices
+// connect from. To avoid a database write on every request, each connection
+// is recorded at most once per update interval.
+type ConnectionRecorder struct {
+	db       devices.Database
+	interval time.Duration
+	maxAge   time.Duration
+
+	mu     sync.Mutex
+	recent map[string]struct{} // connections recorded in the current interval
+}
+
+// NewConnectionRecorder returns a connection recorder. Call Start to begin
+// pruning old connections.
+func NewConnectionRecorder(db devices.Database, interval, maxAge time.Duration) *ConnectionRecorder {
+	return &ConnectionRecorder{
+		db:       db,
+		interval: interval,
+		maxAge:   maxAge,
+		recent:   make(map[string]struct{}),
+	}
+}
+
+// Record stores the connection of a device, unless it has already been
+// recorded in the current update interval. The remote address can include a
+// port, which is ignored.
+func (r *ConnectionRecorder) Record(ctx context.Context, localpart, deviceID, remoteAddr, userAgent string) error {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+	key := localpart + "\x00" + deviceID + "\x00" + ip + "\x00" + userAgent
+	r.mu.Lock()
+	_, recent := r.recent[key]
+	r.recent[key] = struct{}{}
+	r.mu.Unlock()
+	if recent {
+		return nil
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if err := r.db.UpsertDeviceConnection(ctx, localpart, deviceID, ip, userAgent, now); err != nil {
+		return fmt.Errorf("r.db.UpsertDeviceConnection: %w", err)
+	}
+	return nil
+}
+
+// Prune deletes the connections which haven't been seen for longer than the
+// maximum age.
+func (r *ConnectionRecorder) Prune(ctx context.Context, now time.Time) error {
+	before := now.Add(-r.maxAge).UnixNano() / int64(time.Millisecond)
+	if err := r.db.PruneDeviceConnections(ctx, before); err != nil {
+		return fmt.Errorf("r.db.PruneDeviceConnections: %w", err)
+	}
+	return nil
+}
+
+// Start starts a new update interval every interval, and prunes old
+// connections every hour. It never returns.
+func (r *ConnectionRecorder) Start() {
+	var lastPruned time.Time
+	for {
+		if time.Since(lastPruned) >= connectionPruneInterval {
+			if err := r.Prune(context.Background(), time.Now()); err != nil {
+				logrus.WithError(err).Error("Failed to prune old device connections")
+			}
+			lastPruned = time.Now()
+		}
+		time.Sleep(r.interval)
+		r.mu.Lock()
+		r.recent = make(map[string]struct{})
+		r.mu.Unlock()
+	}
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+)
+
+type countingDeviceDB struct {
+	devices.Database
+	upserts int
+}
+
+func (d *countingDeviceDB) UpsertDeviceConnection(ctx context.Context, localpart, deviceID, ipAddr, userAgent string, lastSeenTS int64) error {
+	d.upserts++
+	return d.Database.UpsertDeviceConnection(ctx, localpart, deviceID, ipAddr, userAgent, lastSeenTS)
+}
+
+func TestConnectionRecorder(t *testing.T) {
+	ctx := context.Background()
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, presenceServerName)
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	db := &countingDeviceDB{Database: deviceDB}
+	r := NewConnectionRecorder(db, time.Minute, time.Hour)
+	a := &UserInternalAPI{DeviceDB: db, ServerName: presenceServerName}
+
+	for _, conn := range []struct {
+		deviceID, remoteAddr, userAgent string
+	}{
+		{"PHONE", "10.0.0.1:1234", "Phone"},
+		// a new TCP connection from the same client is the same connection
+		{"PHONE", "10.0.0.1:5678", "Phone"},
+		{"PHONE", "10.0.0.2:1234", "Phone"},
+		{"LAPTOP", "[::1]:1234", "Laptop"},
+	} {
+		if err = r.Record(ctx, "alice", conn.deviceID, conn.remoteAddr, conn.userAgent); err != nil {
+			t.Fatalf("Record failed: %s", err)
+		}
+	}
+	if db.upserts != 3 {
+		t.Errorf("got %d writes, want 3", db.upserts)
+	}
+
+	var res api.QueryDeviceConnectionsResponse
+	if err = a.QueryDeviceConnections(ctx, &api.QueryDeviceConnectionsRequest{
+		UserID: "@alice:" + string(presenceServerName),
+	}, &res); err != nil {
+		t.Fatalf("QueryDeviceConnections failed: %s", err)
+	}
+	ips := make(map[string][]string)
+	for deviceID, connections := range res.Devices {
+		for _, conn := range connections {
+			ips[deviceID] = append(ips[deviceID], conn.IP+" "+conn.UserAgent)
+		}
+	}
+	if len(ips["PHONE"]) != 2 || !reflect.DeepEqual(ips["LAPTOP"], []string{"::1 Laptop"}) {
+		t.Errorf("got connections %v", ips)
+	}
+
+	if err = r.Prune(ctx, time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatalf("Prune failed: %s", err)
+	}
+	res = api.QueryDeviceConnectionsResponse{}
+	if err = a.QueryDeviceConnections(ctx, &api.QueryDeviceConnectionsRequest{
+		UserID: "@alice:" + string(presenceServerName),
+	}, &res); err != nil {
+		t.Fatalf("QueryDeviceConnections failed: %s", err)
+	}
+	if len(res.Devices) != 0 {
+		t.Errorf("got connections %v after pruning, want none", res.Devices)
+	}
+}
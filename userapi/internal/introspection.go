@@ -0,0 +1,162 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/setup/config"
+)
+
+// deviceScopePrefix is the prefix of the scope which tells us which device an
+// access token was issued to, as in MSC2967.
+const deviceScopePrefix = "urn:matrix:org.matrix.msc2967.client:device:"
+
+// IntrospectedToken is what the authorization server told us about an access
+// token.
+type IntrospectedToken struct {
+	Active bool `json:"active"`
+	// The localpart or user ID of the user which the token was issued to.
+	Subject  string `json:"sub"`
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id"`
+	// When the token expires, as a unix timestamp (s resolution), if known.
+	Expiry int64 `json:"exp"`
+}
+
+// DeviceID returns the device which the token was issued to, or "" if it
+// isn't scoped to a device.
+func (t *IntrospectedToken) DeviceID() string {
+	for _, scope := range strings.Fields(t.Scope) {
+		if strings.HasPrefix(scope, deviceScopePrefix) {
+			return strings.TrimPrefix(scope, deviceScopePrefix)
+		}
+	}
+	return ""
+}
+
+// TokenIntrospector validates access tokens which were issued by an OAuth 2.0
+// authorization server by introspecting them (RFC 7662). Results are cached,
+// so that each token is introspected at most once per cache TTL.
+type TokenIntrospector struct {
+	cfg    *config.DelegatedAuth
+	client *http.Client
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	cache     map[string]cachedToken
+	lastSweep time.Time
+}
+
+type cachedToken struct {
+	token   IntrospectedToken
+	expires time.Time
+}
+
+// NewTokenIntrospector returns a token introspector which asks the
+// authorization server in the config.
+func NewTokenIntrospector(cfg *config.DelegatedAuth, client *http.Client) *TokenIntrospector {
+	return &TokenIntrospector{
+		cfg:       cfg,
+		client:    client,
+		ttl:       time.Duration(cfg.CacheTTLMS) * time.Millisecond,
+		cache:     make(map[string]cachedToken),
+		lastSweep: time.Now(),
+	}
+}
+
+// Introspect returns what the authorization server says about the access
+// token, from the cache if it was introspected recently. Tokens which aren't
+// active are cached too, so that retrying with a bad token doesn't make a
+// request every time.
+func (t *TokenIntrospector) Introspect(ctx context.Context, accessToken string) (*IntrospectedToken, error) {
+	now := time.Now()
+	t.mu.Lock()
+	cached, ok := t.cache[accessToken]
+	t.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return &cached.token, nil
+	}
+
+	token, err := t.introspect(ctx, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	expires := now.Add(t.ttl)
+	if token.Active && token.Expiry != 0 {
+		if exp := time.Unix(token.Expiry, 0); exp.Before(expires) {
+			expires = exp
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastSweep) > t.ttl {
+		for k, v := range t.cache {
+			if !now.Before(v.expires) {
+				delete(t.cache, k)
+			}
+		}
+		t.lastSweep = now
+	}
+	t.cache[accessToken] = cachedToken{*token, expires}
+	return token, nil
+}
+
+func (t *TokenIntrospector) introspect(ctx context.Context, accessToken string) (*IntrospectedToken, error) {
+	form := url.Values{
+		"token":           {accessToken},
+		"token_type_hint": {"access_token"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.cfg.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(t.cfg.ClientID), url.QueryEscape(t.cfg.ClientSecret))
+	res, err := t.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("t.client.Do: %w", err)
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned HTTP %d", res.StatusCode)
+	}
+	var token IntrospectedToken
+	if err = json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to decode introspection response: %w", err)
+	}
+	return &token, nil
+}
+
+// generatePlaceholderToken returns a random access token for devices which are
+// only used with tokens from the authorization server.
+func generatePlaceholderToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "delegated_" + base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestQueryAccessTokenDelegated(t *testing.T) {
+	ctx := context.Background()
+	tokens := map[string]IntrospectedToken{
+		"phone":   {Active: true, Subject: "alice", Scope: "openid " + deviceScopePrefix + "PHONE"},
+		"laptop":  {Active: true, Subject: "@alice:localhost", Scope: deviceScopePrefix + "LAPTOP"},
+		"nodev":   {Active: true, Subject: "alice", Scope: "openid"},
+		"remote":  {Active: true, Subject: "@alice:remote", Scope: deviceScopePrefix + "PHONE"},
+		"nobody":  {Active: true, Subject: "bob", Scope: deviceScopePrefix + "PHONE"},
+		"revoked": {Active: false},
+	}
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if id, secret, ok := req.BasicAuth(); !ok || id != "dendrite" || secret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(tokens[req.PostFormValue("token")])
+	}))
+	defer srv.Close()
+
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "localhost", bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS, config.DefaultLoginTokenLifetimeMS)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(t.TempDir(), "devices.db")),
+	}, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(ctx, "alice", "", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	a := &UserInternalAPI{
+		AccountDB:  accountDB,
+		DeviceDB:   deviceDB,
+		ServerName: "localhost",
+		KeyAPI:     &noopKeyAPI{},
+		Introspector: NewTokenIntrospector(&config.DelegatedAuth{
+			Enabled:          true,
+			IntrospectionURL: srv.URL,
+			ClientID:         "dendrite",
+			ClientSecret:     "secret",
+			CacheTTLMS:       60000,
+		}, srv.Client()),
+	}
+	query := func(accessToken string) *api.Device {
+		t.Helper()
+		var res api.QueryAccessTokenResponse
+		if err := a.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: accessToken}, &res); err != nil {
+			t.Fatalf("QueryAccessToken(%s) failed: %s", accessToken, err)
+		}
+		return res.Device
+	}
+
+	for token, deviceID := range map[string]string{"phone": "PHONE", "laptop": "LAPTOP"} {
+		dev := query(token)
+		if dev == nil || dev.UserID != "@alice:localhost" || dev.ID != deviceID || dev.AccessToken != token {
+			t.Errorf("%s: got device %+v, want %s for @alice:localhost", token, dev, deviceID)
+		}
+	}
+	for _, token := range []string{"nodev", "remote", "nobody", "revoked"} {
+		if dev := query(token); dev != nil {
+			t.Errorf("%s: got device %+v, want none", token, dev)
+		}
+	}
+
+	// the devices were created, and the results are cached
+	devs, err := deviceDB.GetDevicesByLocalpart(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetDevicesByLocalpart failed: %s", err)
+	}
+	if len(devs) != 2 {
+		t.Errorf("got %d devices, want 2", len(devs))
+	}
+	atomic.StoreInt32(&requests, 0)
+	if dev := query("phone"); dev == nil || dev.ID != "PHONE" {
+		t.Errorf("got device %+v from the cache, want PHONE", dev)
+	}
+	if dev := query("revoked"); dev != nil {
+		t.Errorf("got device %+v from the cache for a revoked token", dev)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("got %d introspection requests for cached tokens, want 0", n)
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestKeyBackup(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "localhost", bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS, config.DefaultLoginTokenLifetimeMS)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	userAPI := &UserInternalAPI{AccountDB: accountDB}
+	userID := "@alice:localhost"
+	perform := func(req *api.PerformKeyBackupRequest) *api.PerformKeyBackupResponse {
+		t.Helper()
+		req.UserID = userID
+		res := &api.PerformKeyBackupResponse{}
+		if err := userAPI.PerformKeyBackup(ctx, req, res); err != nil {
+			t.Fatalf("PerformKeyBackup failed: %s", err)
+		}
+		return res
+	}
+	query := func(version string) *api.QueryKeyBackupResponse {
+		t.Helper()
+		res := &api.QueryKeyBackupResponse{}
+		if err := userAPI.QueryKeyBackup(ctx, &api.QueryKeyBackupRequest{
+			UserID: userID, Version: version, ReturnKeys: true,
+		}, res); err != nil {
+			t.Fatalf("QueryKeyBackup failed: %s", err)
+		}
+		return res
+	}
+	upload := func(version string, key api.KeyBackupSession) *api.PerformKeyBackupResponse {
+		t.Helper()
+		return perform(&api.PerformKeyBackupRequest{
+			Version: version,
+			Keys: map[string]map[string]api.KeyBackupSession{
+				"!room:localhost": {"session": key},
+			},
+		})
+	}
+
+	authData := json.RawMessage(`{"public_key":"abc"}`)
+	first := perform(&api.PerformKeyBackupRequest{Algorithm: "m.megolm_backup.v1.curve25519-aes-sha2", AuthData: authData})
+	second := perform(&api.PerformKeyBackupRequest{Algorithm: "m.megolm_backup.v1.curve25519-aes-sha2", AuthData: authData})
+	if first.Version == second.Version {
+		t.Fatalf("both backups got version %s", first.Version)
+	}
+	if res := upload(first.Version, api.KeyBackupSession{SessionData: json.RawMessage(`{}`)}); !res.WrongVersion || res.Version != second.Version {
+		t.Fatalf("upload to an old version: got %+v, want the wrong version error with version %s", res, second.Version)
+	}
+
+	res := upload(second.Version, api.KeyBackupSession{FirstMessageIndex: 5, SessionData: json.RawMessage(`"first"`)})
+	if res.KeyCount != 1 {
+		t.Fatalf("got count %d after the first upload, want 1", res.KeyCount)
+	}
+	etag := res.KeyETag
+	// A key which isn't better doesn't replace the existing one or change the etag
+	res = upload(second.Version, api.KeyBackupSession{FirstMessageIndex: 10, SessionData: json.RawMessage(`"worse"`)})
+	if res.KeyETag != etag {
+		t.Errorf("etag changed from %s to %s when no keys were replaced", etag, res.KeyETag)
+	}
+	// A verified key is better, even with a higher first message index
+	res = upload(second.Version, api.KeyBackupSession{FirstMessageIndex: 10, IsVerified: true, SessionData: json.RawMessage(`"verified"`)})
+	if res.KeyETag == etag || res.KeyCount != 1 {
+		t.Errorf("got etag %s and count %d after replacing the key, want a new etag and count 1", res.KeyETag, res.KeyCount)
+	}
+	backup := query(second.Version)
+	if got := string(backup.Keys["!room:localhost"]["session"].SessionData); got != `"verified"` {
+		t.Errorf("got session data %s, want the verified key", got)
+	}
+	if backup.Count != 1 || backup.ETag != res.KeyETag {
+		t.Errorf("got count %d and etag %s in the version info, want 1 and %s", backup.Count, backup.ETag, res.KeyETag)
+	}
+
+	// Changing the algorithm of a version isn't allowed
+	if res = perform(&api.PerformKeyBackupRequest{Version: second.Version, Algorithm: "other", AuthData: authData}); !res.BadInput {
+		t.Errorf("changing the algorithm: got %+v, want bad input", res)
+	}
+
+	// Deleting a version deletes its keys, and the previous version becomes the latest
+	if res = perform(&api.PerformKeyBackupRequest{Version: second.Version, DeleteBackup: true}); !res.Exists {
+		t.Fatalf("deleting the backup: got %+v, want it to exist", res)
+	}
+	if backup = query(second.Version); backup.Exists {
+		t.Errorf("deleted backup still exists: %+v", backup)
+	}
+	if keys, err := accountDB.GetBackupKeys(ctx, userID, second.Version, "", ""); err != nil || len(keys) != 0 {
+		t.Errorf("got keys %v (err %v) for the deleted backup, want none", keys, err)
+	}
+	if backup = query(""); backup.Version != first.Version {
+		t.Errorf("got latest version %s, want %s", backup.Version, first.Version)
+	}
+	// Versions aren't reused after they are deleted
+	third := perform(&api.PerformKeyBackupRequest{Algorithm: "m.megolm_backup.v1.curve25519-aes-sha2", AuthData: authData})
+	if third.Version == second.Version || third.Version == first.Version {
+		t.Errorf("new backup reused version %s", third.Version)
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// minIdleCheckInterval is the shortest time between checks for idle users.
+const minIdleCheckInterval = time.Second
+
+// PresenceUpdater stores presence updates and produces them to the output
+// presence topic. To avoid storms of updates, at most one update is produced
+// per user per aggregation interval: updates made within the interval are
+// combined and the latest one is produced when the interval ends.
+type PresenceUpdater struct {
+	db          accounts.Database
+	serverName  gomatrixserverlib.ServerName
+	producer    sarama.SyncProducer
+	topic       string
+	interval    time.Duration
+	idleTimeout time.Duration
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time     // user ID -> when an update was last produced
+	pending  map[string]*api.Presence // user ID -> update waiting for the interval to end
+}
+
+// NewPresenceUpdater returns a presence updater. Call Start to begin marking
+// idle users as offline.
+func NewPresenceUpdater(
+	db accounts.Database, serverName gomatrixserverlib.ServerName,
+	producer sarama.SyncProducer, topic string,
+	interval, idleTimeout time.Duration,
+) *PresenceUpdater {
+	return &PresenceUpdater{
+		db:          db,
+		serverName:  serverName,
+		producer:    producer,
+		topic:       topic,
+		interval:    interval,
+		idleTimeout: idleTimeout,
+		lastSent:    make(map[string]time.Time),
+		pending:     make(map[string]*api.Presence),
+	}
+}
+
+// Update stores the presence of a user and produces it, subject to the
+// aggregation interval.
+func (u *PresenceUpdater) Update(ctx context.Context, presence *api.Presence) error {
+	if err := u.db.UpsertPresence(ctx, presence); err != nil {
+		return fmt.Errorf("u.db.UpsertPresence: %w", err)
+	}
+	u.schedule(presence)
+	return nil
+}
+
+func (u *PresenceUpdater) schedule(presence *api.Presence) {
+	u.mu.Lock()
+	if _, ok := u.pending[presence.UserID]; ok {
+		// An update is already waiting for the interval to end, so replace it
+		// with this one.
+		u.pending[presence.UserID] = presence
+		u.mu.Unlock()
+		return
+	}
+	since := time.Since(u.lastSent[presence.UserID])
+	if since >= u.interval {
+		u.lastSent[presence.UserID] = time.Now()
+		u.mu.Unlock()
+		u.produce(presence)
+		return
+	}
+	u.pending[presence.UserID] = presence
+	u.mu.Unlock()
+	time.AfterFunc(u.interval-since, func() {
+		u.flush(presence.UserID)
+	})
+}
+
+// flush produces the pending update for the user, if there is one.
+func (u *PresenceUpdater) flush(userID string) {
+	u.mu.Lock()
+	presence, ok := u.pending[userID]
+	if !ok {
+		u.mu.Unlock()
+		return
+	}
+	delete(u.pending, userID)
+	u.lastSent[userID] = time.Now()
+	u.mu.Unlock()
+	u.produce(presence)
+}
+
+func (u *PresenceUpdater) produce(presence *api.Presence) {
+	value, err := json.Marshal(presence)
+	if err != nil {
+		logrus.WithError(err).Error("Failed to marshal presence update")
+		return
+	}
+	if _, _, err = u.producer.SendMessage(&sarama.ProducerMessage{
+		Topic: u.topic,
+		Key:   sarama.StringEncoder(presence.UserID),
+		Value: sarama.ByteEncoder(value),
+	}); err != nil {
+		logrus.WithError(err).WithField("user_id", presence.UserID).Error("Failed to produce presence update")
+	}
+}
+
+// Start marks local users who have been idle for longer than the idle
+// timeout as offline, forever. It should be run in its own goroutine.
+func (u *PresenceUpdater) Start() {
+	checkInterval := u.idleTimeout / 4
+	if checkInterval < minIdleCheckInterval {
+		checkInterval = minIdleCheckInterval
+	}
+	for {
+		time.Sleep(checkInterval)
+		if err := u.markIdleUsersOffline(context.Background()); err != nil {
+			logrus.WithError(err).Warn("Failed to mark idle users as offline")
+		}
+		u.forgetLastSent()
+	}
+}
+
+func (u *PresenceUpdater) markIdleUsersOffline(ctx context.Context) error {
+	before := gomatrixserverlib.AsTimestamp(time.Now().Add(-u.idleTimeout))
+	idle, err := u.db.GetIdlePresence(ctx, before)
+	if err != nil {
+		return fmt.Errorf("u.db.GetIdlePresence: %w", err)
+	}
+	for i := range idle {
+		presence := &idle[i]
+		// Remote servers are responsible for the presence of their own users.
+		if _, domain, err := gomatrixserverlib.SplitID('@', presence.UserID); err != nil || domain != u.serverName {
+			continue
+		}
+		presence.Presence = api.PresenceOffline
+		if err = u.Update(ctx, presence); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forgetLastSent removes the record of when updates were produced for users
+// whose aggregation interval has ended, so that the map doesn't keep growing.
+func (u *PresenceUpdater) forgetLastSent() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for userID, lastSent := range u.lastSent {
+		if _, ok := u.pending[userID]; !ok && time.Since(lastSent) >= u.interval {
+			delete(u.lastSent, userID)
+		}
+	}
+}
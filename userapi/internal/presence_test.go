@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const presenceServerName = gomatrixserverlib.ServerName("example.com")
+
+type testPresenceProducer struct {
+	sarama.SyncProducer
+	mu       sync.Mutex
+	produced []api.Presence
+}
+
+func (p *testPresenceProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	value, err := msg.Value.Encode()
+	if err != nil {
+		return 0, 0, err
+	}
+	var presence api.Presence
+	if err = json.Unmarshal(value, &presence); err != nil {
+		return 0, 0, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.produced = append(p.produced, presence)
+	return 0, 0, nil
+}
+
+func (p *testPresenceProducer) presences() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var presences []string
+	for _, presence := range p.produced {
+		presences = append(presences, presence.UserID+" "+presence.Presence)
+	}
+	return presences
+}
+
+func mustMakePresenceUpdater(t *testing.T, interval, idleTimeout time.Duration) (*PresenceUpdater, *testPresenceProducer) {
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, presenceServerName, bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS, config.DefaultLoginTokenLifetimeMS)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	producer := &testPresenceProducer{}
+	return NewPresenceUpdater(accountDB, presenceServerName, producer, "presence", interval, idleTimeout), producer
+}
+
+func TestPresenceUpdaterAggregates(t *testing.T) {
+	ctx := context.Background()
+	updater, producer := mustMakePresenceUpdater(t, 100*time.Millisecond, time.Minute)
+	alice := "@alice:example.com"
+	now := gomatrixserverlib.AsTimestamp(time.Now())
+
+	for _, presence := range []string{api.PresenceOnline, api.PresenceUnavailable, api.PresenceOffline} {
+		if err := updater.Update(ctx, &api.Presence{UserID: alice, Presence: presence, LastActiveTS: now}); err != nil {
+			t.Fatalf("Update failed: %s", err)
+		}
+	}
+	// The first update is produced straight away, the rest wait for the
+	// interval to end.
+	if got := producer.presences(); len(got) != 1 || got[0] != alice+" online" {
+		t.Fatalf("before the interval ended got %v, want only online", got)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if got := producer.presences(); len(got) != 2 || got[1] != alice+" offline" {
+		t.Fatalf("after the interval ended got %v, want online then offline", got)
+	}
+
+	// The latest presence was stored straight away regardless.
+	stored, err := updater.db.GetPresence(ctx, alice)
+	if err != nil {
+		t.Fatalf("GetPresence failed: %s", err)
+	}
+	if stored == nil || stored.Presence != api.PresenceOffline {
+		t.Errorf("got stored presence %+v, want offline", stored)
+	}
+}
+
+func TestPresenceUpdaterMarksIdleUsersOffline(t *testing.T) {
+	ctx := context.Background()
+	updater, producer := mustMakePresenceUpdater(t, 0, time.Minute)
+	idle := gomatrixserverlib.AsTimestamp(time.Now().Add(-2 * time.Minute))
+	active := gomatrixserverlib.AsTimestamp(time.Now())
+	for _, presence := range []api.Presence{
+		{UserID: "@idle:example.com", Presence: api.PresenceOnline, LastActiveTS: idle},
+		{UserID: "@active:example.com", Presence: api.PresenceOnline, LastActiveTS: active},
+		{UserID: "@remote:other.com", Presence: api.PresenceOnline, LastActiveTS: idle},
+	} {
+		presence := presence
+		if err := updater.db.UpsertPresence(ctx, &presence); err != nil {
+			t.Fatalf("UpsertPresence failed: %s", err)
+		}
+	}
+
+	if err := updater.markIdleUsersOffline(ctx); err != nil {
+		t.Fatalf("markIdleUsersOffline failed: %s", err)
+	}
+	if got := producer.presences(); len(got) != 1 || got[0] != "@idle:example.com offline" {
+		t.Errorf("got %v, want only the idle local user to go offline", got)
+	}
+	for userID, want := range map[string]string{
+		"@idle:example.com":   api.PresenceOffline,
+		"@active:example.com": api.PresenceOnline,
+		"@remote:other.com":   api.PresenceOnline,
+	} {
+		stored, err := updater.db.GetPresence(ctx, userID)
+		if err != nil {
+			t.Fatalf("GetPresence failed: %s", err)
+		}
+		if stored == nil || stored.Presence != want {
+			t.Errorf("%s: got stored presence %+v, want %s", userID, stored, want)
+		}
+	}
+}
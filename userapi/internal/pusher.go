@@ -0,0 +1,230 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/smtp"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// pushTimeout is how long a single attempt to deliver a notification to a
+// pusher can take.
+const pushTimeout = 30 * time.Second
+
+// PushDispatcher delivers notifications to the pushers of users. Each
+// delivery happens in the background, and is retried with exponential
+// backoff until it succeeds or runs out of attempts. Pushers which a push
+// gateway rejects are removed.
+type PushDispatcher struct {
+	db             accounts.Database
+	serverName     gomatrixserverlib.ServerName
+	client         pushgateway.Client
+	email          *config.PushEmail
+	maxAttempts    int
+	initialBackoff time.Duration
+}
+
+// NewPushDispatcher returns a push dispatcher which sends emails using the
+// given options if an SMTP server is set.
+func NewPushDispatcher(
+	db accounts.Database, serverName gomatrixserverlib.ServerName,
+	client pushgateway.Client, cfg *config.Push,
+) *PushDispatcher {
+	return &PushDispatcher{
+		db:             db,
+		serverName:     serverName,
+		client:         client,
+		email:          &cfg.Email,
+		maxAttempts:    cfg.MaxAttempts,
+		initialBackoff: time.Duration(cfg.InitialBackoffMS) * time.Millisecond,
+	}
+}
+
+// EmailEnabled returns true if notifications can be sent to email pushers.
+func (d *PushDispatcher) EmailEnabled() bool {
+	return d.email.SMTPServer != ""
+}
+
+// Notify starts delivering the notification to every pusher of the user.
+func (d *PushDispatcher) Notify(ctx context.Context, localpart string, req *api.PerformPushNotificationRequest) error {
+	pushers, err := d.db.GetPushers(ctx, localpart)
+	if err != nil {
+		return fmt.Errorf("d.db.GetPushers: %w", err)
+	}
+	for i := range pushers {
+		go d.deliver(localpart, &pushers[i], req)
+	}
+	return nil
+}
+
+// deliver tries to send the notification to the pusher until it succeeds,
+// waiting twice as long after each failed attempt.
+func (d *PushDispatcher) deliver(localpart string, pusher *api.Pusher, req *api.PerformPushNotificationRequest) {
+	logger := logrus.WithFields(logrus.Fields{
+		"localpart": localpart,
+		"app_id":    pusher.AppID,
+		"event_id":  req.Event.EventID(),
+	})
+	backoff := d.initialBackoff
+	for attempt := 1; attempt <= d.maxAttempts; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+		rejected, err := d.push(ctx, pusher, req)
+		cancel()
+		if err == nil {
+			if rejected {
+				logger.Info("Push gateway rejected the pushkey, removing pusher")
+				if err = d.db.RemovePusher(context.Background(), localpart, pusher.AppID, pusher.PushKey); err != nil {
+					logger.WithError(err).Error("Failed to remove rejected pusher")
+				}
+			}
+			return
+		}
+		logger.WithError(err).WithField("attempt", attempt).Warn("Failed to deliver notification to pusher")
+		if attempt < d.maxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	logger.Error("Giving up on delivering notification to pusher")
+}
+
+// push makes one attempt at delivering the notification to the pusher, and
+// returns whether the push gateway rejected the pushkey.
+func (d *PushDispatcher) push(ctx context.Context, pusher *api.Pusher, req *api.PerformPushNotificationRequest) (rejected bool, err error) {
+	switch pusher.Kind {
+	case api.HTTPPusherKind:
+		url, _ := pusher.Data["url"].(string)
+		var res pushgateway.NotifyResponse
+		if err = d.client.Notify(ctx, url, &pushgateway.NotifyRequest{
+			Notification: httpNotification(pusher, req),
+		}, &res); err != nil {
+			return false, err
+		}
+		for _, pushKey := range res.Rejected {
+			if pushKey == pusher.PushKey {
+				return true, nil
+			}
+		}
+		return false, nil
+	case api.EmailPusherKind:
+		if !d.EmailEnabled() {
+			return false, nil
+		}
+		return false, d.sendEmail(pusher.PushKey, req)
+	default:
+		return false, nil
+	}
+}
+
+// httpNotification builds the notification for an HTTP pusher. Pushers with
+// the event_id_only format only get the event and room IDs and the counts.
+func httpNotification(pusher *api.Pusher, req *api.PerformPushNotificationRequest) pushgateway.Notification {
+	device := &pushgateway.Device{
+		AppID:     pusher.AppID,
+		PushKey:   pusher.PushKey,
+		PushKeyTS: pusher.PushKeyTS,
+		Data:      make(map[string]interface{}, len(pusher.Data)),
+		Tweaks:    pushTweaks(req.Actions),
+	}
+	for k, v := range pusher.Data {
+		// The URL is for the homeserver, not the push gateway.
+		if k != "url" {
+			device.Data[k] = v
+		}
+	}
+	n := pushgateway.Notification{
+		EventID: req.Event.EventID(),
+		RoomID:  req.Event.RoomID(),
+		Counts:  &pushgateway.Counts{Unread: req.UnreadCount},
+		Devices: []*pushgateway.Device{device},
+	}
+	if format, _ := pusher.Data["format"].(string); format == "event_id_only" {
+		return n
+	}
+	n.Type = req.Event.Type()
+	n.Sender = req.Event.Sender()
+	n.SenderDisplayName = req.SenderDisplayName
+	n.Content = req.Event.Content()
+	n.Prio = pushgateway.LowPrio
+	switch req.Event.Type() {
+	case "m.room.message", "m.room.encrypted", "m.call.invite":
+		n.Prio = pushgateway.HighPrio
+	}
+	if req.Event.Type() == gomatrixserverlib.MRoomMember && req.Event.StateKey() != nil {
+		var content gomatrixserverlib.MemberContent
+		if err := json.Unmarshal(req.Event.Content(), &content); err == nil {
+			n.Membership = content.Membership
+		}
+		n.UserIsTarget = *req.Event.StateKey() == req.UserID
+	}
+	return n
+}
+
+// pushTweaks returns the tweaks set by the actions of a push rule.
+func pushTweaks(actions []*pushrules.Action) map[string]interface{} {
+	tweaks := map[string]interface{}{}
+	for _, a := range actions {
+		if a.Kind != pushrules.SetTweakAction {
+			continue
+		}
+		if a.Value == nil {
+			tweaks[string(a.Tweak)] = true
+		} else {
+			tweaks[string(a.Tweak)] = a.Value
+		}
+	}
+	return tweaks
+}
+
+// sendEmail emails a summary of the notification to the address.
+func (d *PushDispatcher) sendEmail(to string, req *api.PerformPushNotificationRequest) error {
+	sender := req.SenderDisplayName
+	if sender == "" {
+		sender = req.Event.Sender()
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", d.email.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: New activity on %s\r\n", d.serverName)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&msg, "\r\n")
+	fmt.Fprintf(&msg, "You have %d unread notifications on %s.\r\n\r\n", req.UnreadCount, d.serverName)
+	fmt.Fprintf(&msg, "The latest is from %s in %s.\r\n", sender, req.Event.RoomID())
+
+	var auth smtp.Auth
+	if d.email.SMTPUsername != "" {
+		host, _, err := net.SplitHostPort(d.email.SMTPServer)
+		if err != nil {
+			return fmt.Errorf("net.SplitHostPort: %w", err)
+		}
+		auth = smtp.PlainAuth("", d.email.SMTPUsername, d.email.SMTPPassword, host)
+	}
+	return smtp.SendMail(d.email.SMTPServer, auth, d.email.From, []string{to}, msg.Bytes())
+}
@@ -0,0 +1,150 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/pushgateway"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testPushGateway fails the first request, then rejects the pushkey.
+type testPushGateway struct {
+	mu       sync.Mutex
+	requests []pushgateway.NotifyRequest
+}
+
+func (g *testPushGateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var notifyReq pushgateway.NotifyRequest
+	if err := json.NewDecoder(req.Body).Decode(&notifyReq); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	g.mu.Lock()
+	g.requests = append(g.requests, notifyReq)
+	attempt := len(g.requests)
+	g.mu.Unlock()
+	if attempt == 1 {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(pushgateway.NotifyResponse{
+		Rejected: []string{notifyReq.Notification.Devices[0].PushKey},
+	})
+}
+
+func (g *testPushGateway) received() []pushgateway.NotifyRequest {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]pushgateway.NotifyRequest{}, g.requests...)
+}
+
+func mustMakePushEvent(t *testing.T) *gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(`{
+		"room_id": "!room:example.com",
+		"sender": "@bob:example.com",
+		"type": "m.room.message",
+		"content": {"msgtype": "m.text", "body": "hello alice"},
+		"origin_server_ts": 1,
+		"depth": 1,
+		"auth_events": [],
+		"prev_events": []
+	}`), false, gomatrixserverlib.RoomVersionV5)
+	if err != nil {
+		t.Fatalf("failed to make event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV5)
+}
+
+func TestPushDispatcherRetriesAndRemovesRejectedPushers(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, presenceServerName, bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS, config.DefaultLoginTokenLifetimeMS)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	gateway := &testPushGateway{}
+	srv := httptest.NewServer(gateway)
+	defer srv.Close()
+
+	pusher := api.Pusher{
+		PushKey:           "pushkey",
+		Kind:              api.HTTPPusherKind,
+		AppID:             "com.example.app",
+		AppDisplayName:    "Example",
+		DeviceDisplayName: "Phone",
+		Language:          "en",
+		Data: map[string]interface{}{
+			"url":   srv.URL + pushgateway.NotifyPath,
+			"extra": "value",
+		},
+	}
+	if err = accountDB.UpsertPusher(ctx, "alice", &pusher, true); err != nil {
+		t.Fatalf("UpsertPusher failed: %s", err)
+	}
+
+	dispatcher := NewPushDispatcher(accountDB, presenceServerName, pushgateway.NewHTTPClient(), &config.Push{
+		MaxAttempts:      3,
+		InitialBackoffMS: 10,
+	})
+	ev := mustMakePushEvent(t)
+	if err = dispatcher.Notify(ctx, "alice", &api.PerformPushNotificationRequest{
+		UserID:            "@alice:example.com",
+		Event:             ev,
+		SenderDisplayName: "Bob",
+		Actions: []*pushrules.Action{
+			{Kind: pushrules.NotifyAction},
+			{Kind: pushrules.SetTweakAction, Tweak: pushrules.HighlightTweak},
+		},
+		UnreadCount: 2,
+	}); err != nil {
+		t.Fatalf("Notify failed: %s", err)
+	}
+
+	// The first attempt fails, and the retry is rejected, which removes the pusher.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pushers, err := accountDB.GetPushers(ctx, "alice")
+		if err != nil {
+			t.Fatalf("GetPushers failed: %s", err)
+		}
+		if len(pushers) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pusher wasn't removed after being rejected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	requests := gateway.received()
+	if len(requests) != 2 {
+		t.Fatalf("got %d requests to the push gateway, want 2", len(requests))
+	}
+	n := requests[1].Notification
+	if n.EventID != ev.EventID() || n.SenderDisplayName != "Bob" || n.Prio != pushgateway.HighPrio {
+		t.Errorf("got unexpected notification: %+v", n)
+	}
+	if n.Counts == nil || n.Counts.Unread != 2 {
+		t.Errorf("got counts %+v, want 2 unread", n.Counts)
+	}
+	device := n.Devices[0]
+	if _, ok := device.Data["url"]; ok || device.Data["extra"] != "value" {
+		t.Errorf("got device data %v, want the pusher data without the URL", device.Data)
+	}
+	if device.Tweaks["highlight"] != true {
+		t.Errorf("got tweaks %v, want highlight", device.Tweaks)
+	}
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestQueryAccessTokenRevoked(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "localhost", bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS, config.DefaultLoginTokenLifetimeMS)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: config.DataSource("file:" + filepath.Join(t.TempDir(), "devices.db")),
+	}, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	for _, localpart := range []string{"alice", "bob"} {
+		if _, err = accountDB.CreateAccount(ctx, localpart, "foobar", ""); err != nil {
+			t.Fatalf("failed to make account: %s", err)
+		}
+	}
+	a := &UserInternalAPI{
+		AccountDB:  accountDB,
+		DeviceDB:   deviceDB,
+		ServerName: "localhost",
+		KeyAPI:     &noopKeyAPI{},
+	}
+	createDevice := func(localpart, deviceID, accessToken string) {
+		t.Helper()
+		if err := a.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+			Localpart:   localpart,
+			AccessToken: accessToken,
+			DeviceID:    &deviceID,
+		}, &api.PerformDeviceCreationResponse{}); err != nil {
+			t.Fatalf("PerformDeviceCreation failed: %s", err)
+		}
+	}
+	query := func(accessToken string) *api.QueryAccessTokenResponse {
+		t.Helper()
+		var res api.QueryAccessTokenResponse
+		if err := a.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: accessToken}, &res); err != nil {
+			t.Fatalf("QueryAccessToken failed: %s", err)
+		}
+		return &res
+	}
+
+	createDevice("alice", "PHONE", "alice_phone")
+	createDevice("alice", "LAPTOP", "alice_laptop1")
+	createDevice("bob", "PHONE", "bob_phone")
+	if res := query("alice_phone"); res.Device == nil || res.Revoked {
+		t.Fatalf("got %+v for a valid access token", res)
+	}
+
+	// deleting a device, or logging in again with the same device ID, soft logs it out
+	if err = a.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
+		UserID:    "@alice:localhost",
+		DeviceIDs: []string{"PHONE"},
+	}, &api.PerformDeviceDeletionResponse{}); err != nil {
+		t.Fatalf("PerformDeviceDeletion failed: %s", err)
+	}
+	createDevice("alice", "LAPTOP", "alice_laptop2")
+	for _, token := range []string{"alice_phone", "alice_laptop1"} {
+		if res := query(token); res.Device != nil || !res.Revoked {
+			t.Errorf("%s: got %+v, want it to be revoked", token, res)
+		}
+	}
+	if res := query("unknown"); res.Device != nil || res.Revoked {
+		t.Errorf("got %+v for an unknown access token, want it to be unknown", res)
+	}
+
+	// deactivated accounts can't log in again, so they aren't soft logged out
+	if err = a.PerformAccountDeactivation(ctx, &api.PerformAccountDeactivationRequest{
+		Localpart: "bob",
+	}, &api.PerformAccountDeactivationResponse{}); err != nil {
+		t.Fatalf("PerformAccountDeactivation failed: %s", err)
+	}
+	if res := query("bob_phone"); res.Device != nil || res.Revoked {
+		t.Errorf("got %+v for a deactivated account, want it to be unknown", res)
+	}
+}
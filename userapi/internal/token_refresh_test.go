@@ -0,0 +1,129 @@
+package internal
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	keyapi "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/dendrite/userapi/storage/accounts"
+	"github.com/matrix-org/dendrite/userapi/storage/devices"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type noopKeyAPI struct {
+	keyapi.KeyInternalAPI
+}
+
+func (k *noopKeyAPI) PerformUploadKeys(ctx context.Context, req *keyapi.PerformUploadKeysRequest, res *keyapi.PerformUploadKeysResponse) {
+}
+
+func (k *noopKeyAPI) PerformDeleteKeys(ctx context.Context, req *keyapi.PerformDeleteKeysRequest, res *keyapi.PerformDeleteKeysResponse) {
+}
+
+func TestTokenRefresh(t *testing.T) {
+	ctx := context.Background()
+	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, "localhost", bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS, config.DefaultLoginTokenLifetimeMS)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	deviceDB, err := devices.NewDatabase(&config.DatabaseOptions{
+		// devices are deleted with statements prepared on the fly, which
+		// would see a different database if it was in memory
+		ConnectionString: config.DataSource("file:" + filepath.Join(t.TempDir(), "devices.db")),
+	}, "localhost")
+	if err != nil {
+		t.Fatalf("failed to create device DB: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(ctx, "alice", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	a := &UserInternalAPI{
+		AccountDB:           accountDB,
+		DeviceDB:            deviceDB,
+		ServerName:          "localhost",
+		KeyAPI:              &noopKeyAPI{},
+		AccessTokenLifetime: time.Minute,
+	}
+	query := func(accessToken string) *api.QueryAccessTokenResponse {
+		t.Helper()
+		var res api.QueryAccessTokenResponse
+		if err := a.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: accessToken}, &res); err != nil {
+			t.Fatalf("QueryAccessToken failed: %s", err)
+		}
+		return &res
+	}
+	refresh := func(refreshToken, newAccessToken, newRefreshToken string) *api.Device {
+		t.Helper()
+		var res api.PerformTokenRefreshResponse
+		if err := a.PerformTokenRefresh(ctx, &api.PerformTokenRefreshRequest{
+			RefreshToken:    refreshToken,
+			NewAccessToken:  newAccessToken,
+			NewRefreshToken: newRefreshToken,
+		}, &res); err != nil {
+			t.Fatalf("PerformTokenRefresh failed: %s", err)
+		}
+		return res.Device
+	}
+
+	deviceID := "PHONE"
+	var createRes api.PerformDeviceCreationResponse
+	if err = a.PerformDeviceCreation(ctx, &api.PerformDeviceCreationRequest{
+		Localpart:    "alice",
+		AccessToken:  "access1",
+		DeviceID:     &deviceID,
+		RefreshToken: "refresh1",
+	}, &createRes); err != nil {
+		t.Fatalf("PerformDeviceCreation failed: %s", err)
+	}
+	if createRes.Device.AccessTokenExpiresTS == 0 {
+		t.Errorf("access token issued with a refresh token doesn't expire")
+	}
+	if res := query("access1"); res.Device == nil || res.Device.ID != deviceID {
+		t.Fatalf("got %+v for the first access token, want device %s", res, deviceID)
+	}
+
+	dev := refresh("refresh1", "access2", "refresh2")
+	if dev == nil || dev.ID != deviceID || dev.AccessToken != "access2" {
+		t.Fatalf("got device %+v after refreshing, want device %s with the new access token", dev, deviceID)
+	}
+	if res := query("access1"); res.Device != nil || res.Expired {
+		t.Errorf("old access token still works after refreshing: %+v", res)
+	}
+	if res := query("access2"); res.Device == nil || res.Device.ID != deviceID {
+		t.Errorf("got %+v for the new access token, want device %s", res, deviceID)
+	}
+
+	// refresh tokens can only be used once
+	if dev = refresh("refresh1", "access3", "refresh3"); dev != nil {
+		t.Errorf("refresh token was used twice")
+	}
+	if res := query("access3"); res.Device != nil {
+		t.Errorf("reusing the refresh token issued an access token")
+	}
+
+	// expired access tokens are reported as such, so that clients know to refresh them
+	a.AccessTokenLifetime = -time.Minute
+	if dev = refresh("refresh2", "access3", "refresh3"); dev == nil {
+		t.Fatalf("failed to refresh with the new refresh token")
+	}
+	if res := query("access3"); res.Device != nil || !res.Expired {
+		t.Errorf("got %+v for an expired access token, want it to be expired", res)
+	}
+
+	// logging out revokes the refresh token too
+	if err = a.PerformDeviceDeletion(ctx, &api.PerformDeviceDeletionRequest{
+		UserID:    "@alice:localhost",
+		DeviceIDs: []string{deviceID},
+	}, &api.PerformDeviceDeletionResponse{}); err != nil {
+		t.Fatalf("PerformDeviceDeletion failed: %s", err)
+	}
+	if dev = refresh("refresh3", "access4", "refresh4"); dev != nil {
+		t.Errorf("refresh token still works after logging out")
+	}
+}
@@ -28,22 +28,38 @@ import (
 const (
 	InputAccountDataPath = "/userapi/inputAccountData"
 
-	PerformDeviceCreationPath      = "/userapi/performDeviceCreation"
-	PerformAccountCreationPath     = "/userapi/performAccountCreation"
-	PerformPasswordUpdatePath      = "/userapi/performPasswordUpdate"
-	PerformDeviceDeletionPath      = "/userapi/performDeviceDeletion"
-	PerformLastSeenUpdatePath      = "/userapi/performLastSeenUpdate"
-	PerformDeviceUpdatePath        = "/userapi/performDeviceUpdate"
-	PerformAccountDeactivationPath = "/userapi/performAccountDeactivation"
-	PerformOpenIDTokenCreationPath = "/userapi/performOpenIDTokenCreation"
-
-	QueryProfilePath        = "/userapi/queryProfile"
-	QueryAccessTokenPath    = "/userapi/queryAccessToken"
-	QueryDevicesPath        = "/userapi/queryDevices"
-	QueryAccountDataPath    = "/userapi/queryAccountData"
-	QueryDeviceInfosPath    = "/userapi/queryDeviceInfos"
-	QuerySearchProfilesPath = "/userapi/querySearchProfiles"
-	QueryOpenIDTokenPath    = "/userapi/queryOpenIDToken"
+	PerformDeviceCreationPath          = "/userapi/performDeviceCreation"
+	PerformAccountCreationPath         = "/userapi/performAccountCreation"
+	PerformPasswordUpdatePath          = "/userapi/performPasswordUpdate"
+	PerformDeviceDeletionPath          = "/userapi/performDeviceDeletion"
+	PerformTokenRefreshPath            = "/userapi/performTokenRefresh"
+	PerformLastSeenUpdatePath          = "/userapi/performLastSeenUpdate"
+	PerformDeviceUpdatePath            = "/userapi/performDeviceUpdate"
+	PerformAccountDeactivationPath     = "/userapi/performAccountDeactivation"
+	PerformOpenIDTokenCreationPath     = "/userapi/performOpenIDTokenCreation"
+	PerformPresenceUpdatePath          = "/userapi/performPresenceUpdate"
+	PerformKeyBackupPath               = "/userapi/performKeyBackup"
+	PerformLoginTokenCreationPath      = "/userapi/performLoginTokenCreation"
+	PerformLoginTokenConsumptionPath   = "/userapi/performLoginTokenConsumption"
+	PerformEmailSessionCreationPath    = "/userapi/performEmailSessionCreation"
+	PerformEmailSessionValidationPath  = "/userapi/performEmailSessionValidation"
+	PerformEmailSessionConsumptionPath = "/userapi/performEmailSessionConsumption"
+	PerformPushRulesPutPath            = "/userapi/performPushRulesPut"
+	PerformPusherSetPath               = "/userapi/performPusherSet"
+	PerformPushNotificationPath        = "/userapi/performPushNotification"
+
+	QueryProfilePath           = "/userapi/queryProfile"
+	QueryAccessTokenPath       = "/userapi/queryAccessToken"
+	QueryDevicesPath           = "/userapi/queryDevices"
+	QueryDeviceConnectionsPath = "/userapi/queryDeviceConnections"
+	QueryAccountDataPath       = "/userapi/queryAccountData"
+	QueryDeviceInfosPath       = "/userapi/queryDeviceInfos"
+	QuerySearchProfilesPath    = "/userapi/querySearchProfiles"
+	QueryOpenIDTokenPath       = "/userapi/queryOpenIDToken"
+	QueryPresencePath          = "/userapi/queryPresence"
+	QueryKeyBackupPath         = "/userapi/queryKeyBackup"
+	QueryPushRulesPath         = "/userapi/queryPushRules"
+	QueryPushersPath           = "/userapi/queryPushers"
 )
 
 // NewUserAPIClient creates a UserInternalAPI implemented by talking to a HTTP POST API.
@@ -110,6 +126,18 @@ func (h *httpUserInternalAPI) PerformDeviceCreation(
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+func (h *httpUserInternalAPI) PerformTokenRefresh(
+	ctx context.Context,
+	request *api.PerformTokenRefreshRequest,
+	response *api.PerformTokenRefreshResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformTokenRefresh")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformTokenRefreshPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 func (h *httpUserInternalAPI) PerformDeviceDeletion(
 	ctx context.Context,
 	request *api.PerformDeviceDeletionRequest,
@@ -158,6 +186,46 @@ func (h *httpUserInternalAPI) PerformOpenIDTokenCreation(ctx context.Context, re
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+func (h *httpUserInternalAPI) PerformLoginTokenCreation(ctx context.Context, request *api.PerformLoginTokenCreationRequest, response *api.PerformLoginTokenCreationResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformLoginTokenCreation")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformLoginTokenCreationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpUserInternalAPI) PerformLoginTokenConsumption(ctx context.Context, request *api.PerformLoginTokenConsumptionRequest, response *api.PerformLoginTokenConsumptionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformLoginTokenConsumption")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformLoginTokenConsumptionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpUserInternalAPI) PerformEmailSessionCreation(ctx context.Context, request *api.PerformEmailSessionCreationRequest, response *api.PerformEmailSessionCreationResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformEmailSessionCreation")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformEmailSessionCreationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpUserInternalAPI) PerformEmailSessionValidation(ctx context.Context, request *api.PerformEmailSessionValidationRequest, response *api.PerformEmailSessionValidationResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformEmailSessionValidation")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformEmailSessionValidationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+func (h *httpUserInternalAPI) PerformEmailSessionConsumption(ctx context.Context, request *api.PerformEmailSessionConsumptionRequest, response *api.PerformEmailSessionConsumptionResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformEmailSessionConsumption")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformEmailSessionConsumptionPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 func (h *httpUserInternalAPI) QueryProfile(
 	ctx context.Context,
 	request *api.QueryProfileRequest,
@@ -202,6 +270,14 @@ func (h *httpUserInternalAPI) QueryDevices(ctx context.Context, req *api.QueryDe
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
 
+func (h *httpUserInternalAPI) QueryDeviceConnections(ctx context.Context, req *api.QueryDeviceConnectionsRequest, res *api.QueryDeviceConnectionsResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryDeviceConnections")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryDeviceConnectionsPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
 func (h *httpUserInternalAPI) QueryAccountData(ctx context.Context, req *api.QueryAccountDataRequest, res *api.QueryAccountDataResponse) error {
 	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryAccountData")
 	defer span.Finish()
@@ -225,3 +301,75 @@ func (h *httpUserInternalAPI) QueryOpenIDToken(ctx context.Context, req *api.Que
 	apiURL := h.apiURL + QueryOpenIDTokenPath
 	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
 }
+
+func (h *httpUserInternalAPI) PerformPresenceUpdate(ctx context.Context, req *api.PerformPresenceUpdateRequest, res *api.PerformPresenceUpdateResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPresenceUpdate")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPresenceUpdatePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryPresence(ctx context.Context, req *api.QueryPresenceRequest, res *api.QueryPresenceResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryPresence")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryPresencePath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformKeyBackup(ctx context.Context, req *api.PerformKeyBackupRequest, res *api.PerformKeyBackupResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformKeyBackup")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformKeyBackupPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryKeyBackup(ctx context.Context, req *api.QueryKeyBackupRequest, res *api.QueryKeyBackupResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryKeyBackup")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryKeyBackupPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryPushRules(ctx context.Context, req *api.QueryPushRulesRequest, res *api.QueryPushRulesResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryPushRules")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryPushRulesPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformPushRulesPut(ctx context.Context, req *api.PerformPushRulesPutRequest, res *api.PerformPushRulesPutResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPushRulesPut")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPushRulesPutPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) QueryPushers(ctx context.Context, req *api.QueryPushersRequest, res *api.QueryPushersResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryPushers")
+	defer span.Finish()
+
+	apiURL := h.apiURL + QueryPushersPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformPusherSet(ctx context.Context, req *api.PerformPusherSetRequest, res *api.PerformPusherSetResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPusherSet")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPusherSetPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
+
+func (h *httpUserInternalAPI) PerformPushNotification(ctx context.Context, req *api.PerformPushNotificationRequest, res *api.PerformPushNotificationResponse) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformPushNotification")
+	defer span.Finish()
+
+	apiURL := h.apiURL + PerformPushNotificationPath
+	return httputil.PostJSON(ctx, span, h.httpClient, apiURL, req, res)
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
@@ -44,16 +45,97 @@ type Database interface {
 	// Returns an error if there was an issue with the retrieval
 	GetAccountDataByType(ctx context.Context, localpart, roomID, dataType string) (data json.RawMessage, err error)
 	GetNewNumericLocalpart(ctx context.Context) (int64, error)
+	// GetActiveLocalparts returns the localparts of the accounts which haven't been deactivated,
+	// other than those of application services.
+	GetActiveLocalparts(ctx context.Context) ([]string, error)
 	SaveThreePIDAssociation(ctx context.Context, threepid, localpart, medium string) (err error)
 	RemoveThreePIDAssociation(ctx context.Context, threepid string, medium string) (err error)
 	GetLocalpartForThreePID(ctx context.Context, threepid string, medium string) (localpart string, err error)
 	GetThreePIDsForLocalpart(ctx context.Context, localpart string) (threepids []authtypes.ThreePID, err error)
+	// SaveThreePIDIDServer records that the user has bound the 3PID on the identity server.
+	SaveThreePIDIDServer(ctx context.Context, localpart, medium, threepid, idServer string) error
+	// RemoveThreePIDIDServer records that the user has unbound the 3PID from the identity server.
+	RemoveThreePIDIDServer(ctx context.Context, localpart, medium, threepid, idServer string) error
+	// GetThreePIDIDServers returns the identity servers which the user has bound the 3PID on.
+	GetThreePIDIDServers(ctx context.Context, localpart, medium, threepid string) ([]string, error)
+	// SaveExternalID links the user of an external identity provider, such as OIDC or CAS, to the
+	// account which they log into.
+	SaveExternalID(ctx context.Context, authProvider, externalID, localpart string) error
+	// GetLocalpartForExternalID returns the localpart of the account which the user of an external
+	// identity provider logs into, or an empty string if they aren't linked to one.
+	GetLocalpartForExternalID(ctx context.Context, authProvider, externalID string) (localpart string, err error)
 	CheckAccountAvailability(ctx context.Context, localpart string) (bool, error)
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*api.Account, error)
 	SearchProfiles(ctx context.Context, searchString string, limit int) ([]authtypes.Profile, error)
 	DeactivateAccount(ctx context.Context, localpart string) (err error)
 	CreateOpenIDToken(ctx context.Context, token, localpart string) (exp int64, err error)
 	GetOpenIDTokenAttributes(ctx context.Context, token string) (*api.OpenIDTokenAttributes, error)
+	// CreateLoginToken stores a new single-use login token for the user and returns when it expires.
+	CreateLoginToken(ctx context.Context, token, userID string) (exp int64, err error)
+	// ConsumeLoginToken deletes the login token and returns its attributes. Returns sql.ErrNoRows
+	// if the token doesn't exist or has expired. Only one of any concurrent calls can succeed.
+	ConsumeLoginToken(ctx context.Context, token string) (*api.LoginTokenAttributes, error)
+	// CreateEmailSession stores a new email validation session, or returns the client's existing session
+	// for the email address. send is true if a validation email should be sent for the send attempt.
+	CreateEmailSession(ctx context.Context, session *api.EmailSession) (existing *api.EmailSession, send bool, err error)
+	// ValidateEmailSession marks the session as validated if the token is correct and fewer than
+	// maxFailedAttempts incorrect tokens have been submitted.
+	ValidateEmailSession(ctx context.Context, sessionID, clientSecret, token string, maxFailedAttempts int) (validated bool, err error)
+	// ConsumeEmailSession deletes a validated session and returns its email address, or an empty
+	// address if the session doesn't exist or isn't validated.
+	ConsumeEmailSession(ctx context.Context, sessionID, clientSecret string) (email string, err error)
+	// CreateRegistrationToken stores a new registration token, returning false if the token already exists.
+	CreateRegistrationToken(ctx context.Context, token *api.RegistrationToken) (created bool, err error)
+	// GetRegistrationToken returns the registration token, or nil if it doesn't exist.
+	GetRegistrationToken(ctx context.Context, token string) (*api.RegistrationToken, error)
+	GetRegistrationTokens(ctx context.Context) ([]api.RegistrationToken, error)
+	// DeleteRegistrationToken deletes the registration token, returning false if it didn't exist.
+	DeleteRegistrationToken(ctx context.Context, token string) (deleted bool, err error)
+	// UseRegistrationToken atomically counts a registration with the token. Returns false, without counting
+	// it, if the token doesn't exist, has expired or has already been used as many times as it allows.
+	UseRegistrationToken(ctx context.Context, token string, nowMS int64) (used bool, err error)
+	// ReleaseRegistrationToken undoes UseRegistrationToken, e.g. if the account couldn't be created.
+	ReleaseRegistrationToken(ctx context.Context, token string) error
+	UpsertPresence(ctx context.Context, presence *api.Presence) error
+	// GetPresence returns the presence of a user, or nil if it isn't known.
+	GetPresence(ctx context.Context, userID string) (*api.Presence, error)
+	// GetIdlePresence returns the presence of users who aren't offline but
+	// haven't been active since the given time.
+	GetIdlePresence(ctx context.Context, before gomatrixserverlib.Timestamp) ([]api.Presence, error)
+	// UpsertPusher stores the pusher for the user, replacing any pusher they have for the same app ID
+	// and pushkey. If removeOthers is true, pushers for the same app ID and pushkey belonging to other
+	// users are removed.
+	UpsertPusher(ctx context.Context, localpart string, pusher *api.Pusher, removeOthers bool) error
+	// GetPushers returns the pushers of the user.
+	GetPushers(ctx context.Context, localpart string) ([]api.Pusher, error)
+	// RemovePusher removes the user's pusher for the app ID and pushkey, if they have one.
+	RemovePusher(ctx context.Context, localpart, appID, pushKey string) error
+
+	// CreateKeyBackup creates a new key backup version for the user and returns the version.
+	CreateKeyBackup(ctx context.Context, userID, algorithm string, authData json.RawMessage) (version string, err error)
+	// UpdateKeyBackupAuthData replaces the auth data of a key backup version.
+	UpdateKeyBackupAuthData(ctx context.Context, userID, version string, authData json.RawMessage) error
+	// DeleteKeyBackup deletes a key backup version along with all of the keys in it.
+	// Returns false if the version doesn't exist.
+	DeleteKeyBackup(ctx context.Context, userID, version string) (exists bool, err error)
+	// GetKeyBackup returns a key backup version, or the latest version if version is empty.
+	// Returns nil if the version doesn't exist.
+	GetKeyBackup(ctx context.Context, userID, version string) (*api.KeyBackupVersion, error)
+	// UpsertBackupKeys stores the keys in a key backup version, only replacing existing keys
+	// with better ones. Returns the number of keys in the version and its etag.
+	UpsertBackupKeys(ctx context.Context, userID, version string, uploads []api.InternalKeyBackupSession) (count int64, etag string, err error)
+	// GetBackupKeys returns the keys in a key backup version as room ID to session ID to key,
+	// limited to the room if roomID is set, and to the session in the room if sessionID is also set.
+	GetBackupKeys(ctx context.Context, userID, version, roomID, sessionID string) (map[string]map[string]api.KeyBackupSession, error)
+	// DeleteBackupKeys deletes the keys in a key backup version, limited in the same way as
+	// GetBackupKeys. Returns the number of keys left in the version and its etag.
+	DeleteBackupKeys(ctx context.Context, userID, version, roomID, sessionID string) (count int64, etag string, err error)
+
+	// InsertEventReport stores a report of an event and returns its ID.
+	InsertEventReport(ctx context.Context, report *api.EventReport) (id int64, err error)
+	// GetEventReports returns the event reports, newest first unless forwards is true, limited to
+	// the room and reporting user if they are set. Also returns the total number of matching reports.
+	GetEventReports(ctx context.Context, roomID, userID string, from, limit int64, forwards bool) ([]api.EventReport, int64, error)
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
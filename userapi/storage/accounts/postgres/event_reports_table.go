@@ -0,0 +1,135 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const eventReportsSchema = `
+-- Stores the reports of events which users have sent to the server admins.
+CREATE TABLE IF NOT EXISTS userapi_event_reports (
+	id BIGSERIAL PRIMARY KEY,
+	room_id TEXT NOT NULL,
+	event_id TEXT NOT NULL,
+	-- The user who reported the event
+	user_id TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	-- From -100 (most offensive) to 0, or NULL if the user didn't give one
+	score BIGINT,
+	-- The event as it was when it was reported, so that the report survives purges
+	event_json TEXT NOT NULL,
+	received_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS userapi_event_reports_room_id_idx ON userapi_event_reports(room_id);
+CREATE INDEX IF NOT EXISTS userapi_event_reports_user_id_idx ON userapi_event_reports(user_id);
+`
+
+const insertEventReportSQL = "" +
+	"INSERT INTO userapi_event_reports(room_id, event_id, user_id, reason, score, event_json, received_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id"
+
+// An empty room or user ID matches all reports.
+const eventReportsFilterSQL = "" +
+	" WHERE ($1 = '' OR room_id = $1) AND ($2 = '' OR user_id = $2)"
+
+const selectEventReportsSQL = "" +
+	"SELECT id, room_id, event_id, user_id, reason, score, event_json, received_ts FROM userapi_event_reports" +
+	eventReportsFilterSQL + " ORDER BY id DESC LIMIT $3 OFFSET $4"
+
+const selectEventReportsForwardsSQL = "" +
+	"SELECT id, room_id, event_id, user_id, reason, score, event_json, received_ts FROM userapi_event_reports" +
+	eventReportsFilterSQL + " ORDER BY id ASC LIMIT $3 OFFSET $4"
+
+const countEventReportsSQL = "" +
+	"SELECT COUNT(*) FROM userapi_event_reports" + eventReportsFilterSQL
+
+type eventReportsStatements struct {
+	insertEventReportStmt          *sql.Stmt
+	selectEventReportsStmt         *sql.Stmt
+	selectEventReportsForwardsStmt *sql.Stmt
+	countEventReportsStmt          *sql.Stmt
+}
+
+func (s *eventReportsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(eventReportsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertEventReportStmt, err = db.Prepare(insertEventReportSQL); err != nil {
+		return
+	}
+	if s.selectEventReportsStmt, err = db.Prepare(selectEventReportsSQL); err != nil {
+		return
+	}
+	if s.selectEventReportsForwardsStmt, err = db.Prepare(selectEventReportsForwardsSQL); err != nil {
+		return
+	}
+	if s.countEventReportsStmt, err = db.Prepare(countEventReportsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *eventReportsStatements) insertEventReport(
+	ctx context.Context, txn *sql.Tx, report *api.EventReport,
+) (id int64, err error) {
+	err = sqlutil.TxStmt(txn, s.insertEventReportStmt).QueryRowContext(
+		ctx, report.RoomID, report.EventID, report.UserID, report.Reason, report.Score,
+		string(report.EventJSON), report.ReceivedTS,
+	).Scan(&id)
+	return
+}
+
+// selectEventReports returns the reports, newest first unless forwards is
+// true, along with the total number of reports matching the filter.
+func (s *eventReportsStatements) selectEventReports(
+	ctx context.Context, txn *sql.Tx, roomID, userID string, from, limit int64, forwards bool,
+) ([]api.EventReport, int64, error) {
+	var total int64
+	if err := sqlutil.TxStmt(txn, s.countEventReportsStmt).QueryRowContext(ctx, roomID, userID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	stmt := s.selectEventReportsStmt
+	if forwards {
+		stmt = s.selectEventReportsForwardsStmt
+	}
+	rows, err := sqlutil.TxStmt(txn, stmt).QueryContext(ctx, roomID, userID, limit, from)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventReports: rows.close() failed")
+	var reports []api.EventReport
+	for rows.Next() {
+		var r api.EventReport
+		var score sql.NullInt64
+		var eventJSON string
+		if err = rows.Scan(&r.ID, &r.RoomID, &r.EventID, &r.UserID, &r.Reason, &score, &eventJSON, &r.ReceivedTS); err != nil {
+			return nil, 0, err
+		}
+		if score.Valid {
+			r.Score = &score.Int64
+		}
+		r.EventJSON = []byte(eventJSON)
+		reports = append(reports, r)
+	}
+	return reports, total, rows.Err()
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const externalIDsSchema = `
+-- Links the users of external identity providers, such as OIDC or CAS, to
+-- the accounts which they log into.
+CREATE TABLE IF NOT EXISTS account_external_ids (
+	-- The identity provider, e.g. the OIDC issuer or the CAS server URL
+	auth_provider TEXT NOT NULL,
+	-- The ID of the user at the identity provider, e.g. the OIDC subject
+	external_id TEXT NOT NULL,
+	-- The localpart of the Matrix user ID which the user logs into
+	localpart TEXT NOT NULL,
+
+	PRIMARY KEY(auth_provider, external_id)
+);
+
+CREATE INDEX IF NOT EXISTS account_external_ids_localpart ON account_external_ids(localpart);
+`
+
+const selectLocalpartForExternalIDSQL = "" +
+	"SELECT localpart FROM account_external_ids WHERE auth_provider = $1 AND external_id = $2"
+
+const insertExternalIDSQL = "" +
+	"INSERT INTO account_external_ids (auth_provider, external_id, localpart) VALUES ($1, $2, $3)"
+
+type externalIDsStatements struct {
+	selectLocalpartForExternalIDStmt *sql.Stmt
+	insertExternalIDStmt             *sql.Stmt
+}
+
+func (s *externalIDsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(externalIDsSchema)
+	if err != nil {
+		return
+	}
+	if s.selectLocalpartForExternalIDStmt, err = db.Prepare(selectLocalpartForExternalIDSQL); err != nil {
+		return
+	}
+	if s.insertExternalIDStmt, err = db.Prepare(insertExternalIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *externalIDsStatements) selectLocalpartForExternalID(
+	ctx context.Context, txn *sql.Tx, authProvider, externalID string,
+) (localpart string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectLocalpartForExternalIDStmt)
+	err = stmt.QueryRowContext(ctx, authProvider, externalID).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
+
+func (s *externalIDsStatements) insertExternalID(
+	ctx context.Context, txn *sql.Tx, authProvider, externalID, localpart string,
+) (err error) {
+	stmt := sqlutil.TxStmt(txn, s.insertExternalIDStmt)
+	_, err = stmt.ExecContext(ctx, authProvider, externalID, localpart)
+	return err
+}
@@ -0,0 +1,185 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const keyBackupTableSchema = `
+-- The backed up room keys of users, in each key backup version.
+CREATE TABLE IF NOT EXISTS account_e2e_room_keys (
+	user_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	session_id TEXT NOT NULL,
+	-- The key backup version the key belongs to
+	version BIGINT NOT NULL,
+	first_message_index INTEGER NOT NULL,
+	forwarded_count INTEGER NOT NULL,
+	is_verified BOOLEAN NOT NULL,
+	-- The algorithm-specific encrypted session data, as JSON
+	session_data TEXT NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS account_e2e_room_keys_idx ON account_e2e_room_keys(user_id, version, room_id, session_id);
+`
+
+const upsertBackupKeySQL = "" +
+	"INSERT INTO account_e2e_room_keys (user_id, room_id, session_id, version, first_message_index, forwarded_count, is_verified, session_data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
+	" ON CONFLICT (user_id, version, room_id, session_id)" +
+	" DO UPDATE SET first_message_index = $5, forwarded_count = $6, is_verified = $7, session_data = $8"
+
+const countKeysSQL = "" +
+	"SELECT COUNT(*) FROM account_e2e_room_keys WHERE user_id = $1 AND version = $2"
+
+const selectKeysSQL = "" +
+	"SELECT room_id, session_id, first_message_index, forwarded_count, is_verified, session_data FROM account_e2e_room_keys" +
+	" WHERE user_id = $1 AND version = $2"
+
+const selectKeysByRoomIDSQL = "" +
+	"SELECT room_id, session_id, first_message_index, forwarded_count, is_verified, session_data FROM account_e2e_room_keys" +
+	" WHERE user_id = $1 AND version = $2 AND room_id = $3"
+
+const selectKeysByRoomIDAndSessionIDSQL = "" +
+	"SELECT room_id, session_id, first_message_index, forwarded_count, is_verified, session_data FROM account_e2e_room_keys" +
+	" WHERE user_id = $1 AND version = $2 AND room_id = $3 AND session_id = $4"
+
+const deleteKeysSQL = "" +
+	"DELETE FROM account_e2e_room_keys WHERE user_id = $1 AND version = $2"
+
+const deleteKeysByRoomIDSQL = "" +
+	"DELETE FROM account_e2e_room_keys WHERE user_id = $1 AND version = $2 AND room_id = $3"
+
+const deleteKeysByRoomIDAndSessionIDSQL = "" +
+	"DELETE FROM account_e2e_room_keys WHERE user_id = $1 AND version = $2 AND room_id = $3 AND session_id = $4"
+
+type keyBackupStatements struct {
+	upsertBackupKeyStmt                *sql.Stmt
+	countKeysStmt                      *sql.Stmt
+	selectKeysStmt                     *sql.Stmt
+	selectKeysByRoomIDStmt             *sql.Stmt
+	selectKeysByRoomIDAndSessionIDStmt *sql.Stmt
+	deleteKeysStmt                     *sql.Stmt
+	deleteKeysByRoomIDStmt             *sql.Stmt
+	deleteKeysByRoomIDAndSessionIDStmt *sql.Stmt
+}
+
+func (s *keyBackupStatements) prepare(db *sql.DB) (err error) {
+	if _, err = db.Exec(keyBackupTableSchema); err != nil {
+		return
+	}
+	if s.upsertBackupKeyStmt, err = db.Prepare(upsertBackupKeySQL); err != nil {
+		return
+	}
+	if s.countKeysStmt, err = db.Prepare(countKeysSQL); err != nil {
+		return
+	}
+	if s.selectKeysStmt, err = db.Prepare(selectKeysSQL); err != nil {
+		return
+	}
+	if s.selectKeysByRoomIDStmt, err = db.Prepare(selectKeysByRoomIDSQL); err != nil {
+		return
+	}
+	if s.selectKeysByRoomIDAndSessionIDStmt, err = db.Prepare(selectKeysByRoomIDAndSessionIDSQL); err != nil {
+		return
+	}
+	if s.deleteKeysStmt, err = db.Prepare(deleteKeysSQL); err != nil {
+		return
+	}
+	if s.deleteKeysByRoomIDStmt, err = db.Prepare(deleteKeysByRoomIDSQL); err != nil {
+		return
+	}
+	if s.deleteKeysByRoomIDAndSessionIDStmt, err = db.Prepare(deleteKeysByRoomIDAndSessionIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *keyBackupStatements) upsertBackupKey(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, key api.InternalKeyBackupSession,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.upsertBackupKeyStmt).ExecContext(
+		ctx, userID, key.RoomID, key.SessionID, version,
+		key.FirstMessageIndex, key.ForwardedCount, key.IsVerified, string(key.SessionData),
+	)
+	return err
+}
+
+func (s *keyBackupStatements) countKeys(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (count int64, err error) {
+	err = sqlutil.TxStmt(txn, s.countKeysStmt).QueryRowContext(ctx, userID, version).Scan(&count)
+	return
+}
+
+// selectKeys returns the keys in the backup version as room ID to session ID
+// to key, limited to the room if roomID is set, and to the session in the
+// room if sessionID is also set.
+func (s *keyBackupStatements) selectKeys(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, roomID, sessionID string,
+) (map[string]map[string]api.KeyBackupSession, error) {
+	var rows *sql.Rows
+	var err error
+	switch {
+	case roomID == "":
+		rows, err = sqlutil.TxStmt(txn, s.selectKeysStmt).QueryContext(ctx, userID, version)
+	case sessionID == "":
+		rows, err = sqlutil.TxStmt(txn, s.selectKeysByRoomIDStmt).QueryContext(ctx, userID, version, roomID)
+	default:
+		rows, err = sqlutil.TxStmt(txn, s.selectKeysByRoomIDAndSessionIDStmt).QueryContext(ctx, userID, version, roomID, sessionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectKeys: rows.close() failed")
+	result := make(map[string]map[string]api.KeyBackupSession)
+	for rows.Next() {
+		var key api.InternalKeyBackupSession
+		var sessionData string
+		if err = rows.Scan(
+			&key.RoomID, &key.SessionID, &key.FirstMessageIndex, &key.ForwardedCount, &key.IsVerified, &sessionData,
+		); err != nil {
+			return nil, err
+		}
+		key.SessionData = json.RawMessage(sessionData)
+		if result[key.RoomID] == nil {
+			result[key.RoomID] = make(map[string]api.KeyBackupSession)
+		}
+		result[key.RoomID][key.SessionID] = key.KeyBackupSession
+	}
+	return result, rows.Err()
+}
+
+// deleteKeys deletes the keys in the backup version, limited to the room if
+// roomID is set, and to the session in the room if sessionID is also set.
+func (s *keyBackupStatements) deleteKeys(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, roomID, sessionID string,
+) (err error) {
+	switch {
+	case roomID == "":
+		_, err = sqlutil.TxStmt(txn, s.deleteKeysStmt).ExecContext(ctx, userID, version)
+	case sessionID == "":
+		_, err = sqlutil.TxStmt(txn, s.deleteKeysByRoomIDStmt).ExecContext(ctx, userID, version, roomID)
+	default:
+		_, err = sqlutil.TxStmt(txn, s.deleteKeysByRoomIDAndSessionIDStmt).ExecContext(ctx, userID, version, roomID, sessionID)
+	}
+	return
+}
@@ -0,0 +1,162 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const keyBackupVersionTableSchema = `
+-- The key backup versions of users.
+CREATE TABLE IF NOT EXISTS account_e2e_room_keys_versions (
+	user_id TEXT NOT NULL,
+	-- The version, which increases with each new backup
+	version BIGSERIAL PRIMARY KEY,
+	-- The algorithm of the backup, e.g. m.megolm_backup.v1.curve25519-aes-sha2
+	algorithm TEXT NOT NULL,
+	-- The algorithm-specific auth data, as JSON
+	auth_data TEXT NOT NULL,
+	-- Incremented each time keys in the backup change
+	etag BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS account_e2e_room_keys_versions_idx ON account_e2e_room_keys_versions(user_id, version);
+`
+
+const insertKeyBackupSQL = "" +
+	"INSERT INTO account_e2e_room_keys_versions (user_id, algorithm, auth_data, etag) VALUES ($1, $2, $3, 0) RETURNING version"
+
+const updateKeyBackupAuthDataSQL = "" +
+	"UPDATE account_e2e_room_keys_versions SET auth_data = $1 WHERE user_id = $2 AND version = $3"
+
+const updateKeyBackupETagSQL = "" +
+	"UPDATE account_e2e_room_keys_versions SET etag = etag + 1 WHERE user_id = $1 AND version = $2"
+
+const deleteKeyBackupSQL = "" +
+	"DELETE FROM account_e2e_room_keys_versions WHERE user_id = $1 AND version = $2"
+
+const selectKeyBackupSQL = "" +
+	"SELECT algorithm, auth_data, etag FROM account_e2e_room_keys_versions WHERE user_id = $1 AND version = $2"
+
+const selectLatestVersionSQL = "" +
+	"SELECT MAX(version) FROM account_e2e_room_keys_versions WHERE user_id = $1"
+
+type keyBackupVersionStatements struct {
+	insertKeyBackupStmt         *sql.Stmt
+	updateKeyBackupAuthDataStmt *sql.Stmt
+	updateKeyBackupETagStmt     *sql.Stmt
+	deleteKeyBackupStmt         *sql.Stmt
+	selectKeyBackupStmt         *sql.Stmt
+	selectLatestVersionStmt     *sql.Stmt
+}
+
+func (s *keyBackupVersionStatements) prepare(db *sql.DB) (err error) {
+	if _, err = db.Exec(keyBackupVersionTableSchema); err != nil {
+		return
+	}
+	if s.insertKeyBackupStmt, err = db.Prepare(insertKeyBackupSQL); err != nil {
+		return
+	}
+	if s.updateKeyBackupAuthDataStmt, err = db.Prepare(updateKeyBackupAuthDataSQL); err != nil {
+		return
+	}
+	if s.updateKeyBackupETagStmt, err = db.Prepare(updateKeyBackupETagSQL); err != nil {
+		return
+	}
+	if s.deleteKeyBackupStmt, err = db.Prepare(deleteKeyBackupSQL); err != nil {
+		return
+	}
+	if s.selectKeyBackupStmt, err = db.Prepare(selectKeyBackupSQL); err != nil {
+		return
+	}
+	if s.selectLatestVersionStmt, err = db.Prepare(selectLatestVersionSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *keyBackupVersionStatements) insertKeyBackup(
+	ctx context.Context, txn *sql.Tx, userID, algorithm string, authData json.RawMessage,
+) (version string, err error) {
+	var id int64
+	err = sqlutil.TxStmt(txn, s.insertKeyBackupStmt).QueryRowContext(ctx, userID, algorithm, string(authData)).Scan(&id)
+	return strconv.FormatInt(id, 10), err
+}
+
+func (s *keyBackupVersionStatements) updateKeyBackupAuthData(
+	ctx context.Context, txn *sql.Tx, userID string, version int64, authData json.RawMessage,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateKeyBackupAuthDataStmt).ExecContext(ctx, string(authData), userID, version)
+	return err
+}
+
+func (s *keyBackupVersionStatements) updateKeyBackupETag(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateKeyBackupETagStmt).ExecContext(ctx, userID, version)
+	return err
+}
+
+// deleteKeyBackup deletes the backup version, returning false if it didn't exist.
+func (s *keyBackupVersionStatements) deleteKeyBackup(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (bool, error) {
+	result, err := sqlutil.TxStmt(txn, s.deleteKeyBackupStmt).ExecContext(ctx, userID, version)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// selectKeyBackup returns the backup version without its count, or nil if it
+// doesn't exist. The latest version is returned if version is 0.
+func (s *keyBackupVersionStatements) selectKeyBackup(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (*api.KeyBackupVersion, error) {
+	if version == 0 {
+		var latest sql.NullInt64
+		err := sqlutil.TxStmt(txn, s.selectLatestVersionStmt).QueryRowContext(ctx, userID).Scan(&latest)
+		if err != nil {
+			return nil, err
+		}
+		if !latest.Valid {
+			return nil, nil
+		}
+		version = latest.Int64
+	}
+	var authData string
+	var etag int64
+	backup := api.KeyBackupVersion{
+		Version: strconv.FormatInt(version, 10),
+	}
+	err := sqlutil.TxStmt(txn, s.selectKeyBackupStmt).QueryRowContext(ctx, userID, version).Scan(
+		&backup.Algorithm, &authData, &etag,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backup.AuthData = json.RawMessage(authData)
+	backup.ETag = strconv.FormatInt(etag, 10)
+	return &backup, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const threepidIDServersSchema = `
+-- Stores the identity servers which users have bound their third party
+-- identifiers on, so that they can be unbound again later.
+CREATE TABLE IF NOT EXISTS account_threepid_id_servers (
+	-- The localpart of the Matrix user ID which the 3PID is bound to
+	localpart TEXT NOT NULL,
+	-- The 3PID medium
+	medium TEXT NOT NULL,
+	-- The third party identifier
+	threepid TEXT NOT NULL,
+	-- The server name of the identity server
+	id_server TEXT NOT NULL,
+
+	PRIMARY KEY(localpart, medium, threepid, id_server)
+);
+`
+
+const insertThreePIDIDServerSQL = "" +
+	"INSERT INTO account_threepid_id_servers (localpart, medium, threepid, id_server) VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectThreePIDIDServersSQL = "" +
+	"SELECT id_server FROM account_threepid_id_servers WHERE localpart = $1 AND medium = $2 AND threepid = $3"
+
+const deleteThreePIDIDServerSQL = "" +
+	"DELETE FROM account_threepid_id_servers WHERE localpart = $1 AND medium = $2 AND threepid = $3 AND id_server = $4"
+
+type threepidIDServersStatements struct {
+	insertThreePIDIDServerStmt  *sql.Stmt
+	selectThreePIDIDServersStmt *sql.Stmt
+	deleteThreePIDIDServerStmt  *sql.Stmt
+}
+
+func (s *threepidIDServersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(threepidIDServersSchema)
+	if err != nil {
+		return
+	}
+	if s.insertThreePIDIDServerStmt, err = db.Prepare(insertThreePIDIDServerSQL); err != nil {
+		return
+	}
+	if s.selectThreePIDIDServersStmt, err = db.Prepare(selectThreePIDIDServersSQL); err != nil {
+		return
+	}
+	if s.deleteThreePIDIDServerStmt, err = db.Prepare(deleteThreePIDIDServerSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *threepidIDServersStatements) insertThreePIDIDServer(
+	ctx context.Context, txn *sql.Tx, localpart, medium, threepid, idServer string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertThreePIDIDServerStmt).ExecContext(ctx, localpart, medium, threepid, idServer)
+	return err
+}
+
+func (s *threepidIDServersStatements) selectThreePIDIDServers(
+	ctx context.Context, txn *sql.Tx, localpart, medium, threepid string,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectThreePIDIDServersStmt).QueryContext(ctx, localpart, medium, threepid)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectThreePIDIDServers: rows.close() failed")
+	var idServers []string
+	for rows.Next() {
+		var idServer string
+		if err = rows.Scan(&idServer); err != nil {
+			return nil, err
+		}
+		idServers = append(idServers, idServer)
+	}
+	return idServers, rows.Err()
+}
+
+func (s *threepidIDServersStatements) deleteThreePIDIDServer(
+	ctx context.Context, txn *sql.Tx, localpart, medium, threepid, idServer string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteThreePIDIDServerStmt).ExecContext(ctx, localpart, medium, threepid, idServer)
+	return err
+}
@@ -0,0 +1,183 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const emailSessionsSchema = `
+-- Stores the sessions used to validate that users own email addresses,
+-- e.g. before resetting their password.
+CREATE TABLE IF NOT EXISTS userapi_email_sessions (
+	session_id TEXT NOT NULL PRIMARY KEY,
+	-- The secret that the client generated for the session
+	client_secret TEXT NOT NULL,
+	-- The email address being validated
+	email TEXT NOT NULL,
+	-- The token that was emailed to the address
+	token TEXT NOT NULL,
+	-- The highest send_attempt that the client has requested
+	send_attempt BIGINT NOT NULL,
+	-- Whether the token has been submitted
+	validated BOOLEAN NOT NULL DEFAULT FALSE,
+	-- How many times an incorrect token has been submitted
+	failed_attempts BIGINT NOT NULL DEFAULT 0,
+	-- When the session expires, as a unix timestamp (ms resolution).
+	expires_at_ms BIGINT NOT NULL,
+	UNIQUE (client_secret, email)
+);
+`
+
+const insertEmailSessionSQL = "" +
+	"INSERT INTO userapi_email_sessions(session_id, client_secret, email, token, send_attempt, expires_at_ms)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectEmailSessionSQL = "" +
+	"SELECT session_id, client_secret, email, token, send_attempt, validated, failed_attempts, expires_at_ms" +
+	" FROM userapi_email_sessions WHERE session_id = $1"
+
+const selectEmailSessionByClientSecretSQL = "" +
+	"SELECT session_id, client_secret, email, token, send_attempt, validated, failed_attempts, expires_at_ms" +
+	" FROM userapi_email_sessions WHERE client_secret = $1 AND email = $2"
+
+const updateEmailSessionSQL = "" +
+	"UPDATE userapi_email_sessions SET send_attempt = $1, validated = $2 WHERE session_id = $3"
+
+const incrementEmailSessionFailedAttemptsSQL = "" +
+	"UPDATE userapi_email_sessions SET failed_attempts = failed_attempts + 1 WHERE session_id = $1"
+
+const deleteEmailSessionSQL = "" +
+	"DELETE FROM userapi_email_sessions WHERE session_id = $1"
+
+const deleteExpiredEmailSessionsSQL = "" +
+	"DELETE FROM userapi_email_sessions WHERE expires_at_ms <= $1"
+
+type emailSessionsStatements struct {
+	insertEmailSessionStmt                  *sql.Stmt
+	selectEmailSessionStmt                  *sql.Stmt
+	selectEmailSessionByClientSecretStmt    *sql.Stmt
+	updateEmailSessionStmt                  *sql.Stmt
+	incrementEmailSessionFailedAttemptsStmt *sql.Stmt
+	deleteEmailSessionStmt                  *sql.Stmt
+	deleteExpiredEmailSessionsStmt          *sql.Stmt
+}
+
+func (s *emailSessionsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(emailSessionsSchema)
+	if err != nil {
+		return
+	}
+	if s.insertEmailSessionStmt, err = db.Prepare(insertEmailSessionSQL); err != nil {
+		return
+	}
+	if s.selectEmailSessionStmt, err = db.Prepare(selectEmailSessionSQL); err != nil {
+		return
+	}
+	if s.selectEmailSessionByClientSecretStmt, err = db.Prepare(selectEmailSessionByClientSecretSQL); err != nil {
+		return
+	}
+	if s.updateEmailSessionStmt, err = db.Prepare(updateEmailSessionSQL); err != nil {
+		return
+	}
+	if s.incrementEmailSessionFailedAttemptsStmt, err = db.Prepare(incrementEmailSessionFailedAttemptsSQL); err != nil {
+		return
+	}
+	if s.deleteEmailSessionStmt, err = db.Prepare(deleteEmailSessionSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredEmailSessionsStmt, err = db.Prepare(deleteExpiredEmailSessionsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *emailSessionsStatements) insertEmailSession(
+	ctx context.Context, txn *sql.Tx, session *api.EmailSession,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertEmailSessionStmt).ExecContext(
+		ctx, session.SessionID, session.ClientSecret, session.Email, session.Token,
+		session.SendAttempt, session.ExpiresAtMS,
+	)
+	return err
+}
+
+// selectEmailSession returns the session with the given ID, or nil if it
+// doesn't exist.
+func (s *emailSessionsStatements) selectEmailSession(
+	ctx context.Context, txn *sql.Tx, sessionID string,
+) (*api.EmailSession, error) {
+	return scanEmailSession(sqlutil.TxStmt(txn, s.selectEmailSessionStmt).QueryRowContext(ctx, sessionID))
+}
+
+// selectEmailSessionByClientSecret returns the session that the client
+// created for the email address, or nil if it doesn't exist.
+func (s *emailSessionsStatements) selectEmailSessionByClientSecret(
+	ctx context.Context, txn *sql.Tx, clientSecret, email string,
+) (*api.EmailSession, error) {
+	return scanEmailSession(sqlutil.TxStmt(txn, s.selectEmailSessionByClientSecretStmt).QueryRowContext(ctx, clientSecret, email))
+}
+
+func scanEmailSession(row *sql.Row) (*api.EmailSession, error) {
+	var session api.EmailSession
+	err := row.Scan(
+		&session.SessionID, &session.ClientSecret, &session.Email, &session.Token,
+		&session.SendAttempt, &session.Validated, &session.FailedAttempts, &session.ExpiresAtMS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (s *emailSessionsStatements) updateEmailSession(
+	ctx context.Context, txn *sql.Tx, sessionID string, sendAttempt int, validated bool,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.updateEmailSessionStmt).ExecContext(ctx, sendAttempt, validated, sessionID)
+	return err
+}
+
+func (s *emailSessionsStatements) incrementEmailSessionFailedAttempts(
+	ctx context.Context, txn *sql.Tx, sessionID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.incrementEmailSessionFailedAttemptsStmt).ExecContext(ctx, sessionID)
+	return err
+}
+
+// deleteEmailSession deletes the session, returning false if it didn't exist
+// because it had already been deleted.
+func (s *emailSessionsStatements) deleteEmailSession(
+	ctx context.Context, txn *sql.Tx, sessionID string,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteEmailSessionStmt).ExecContext(ctx, sessionID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *emailSessionsStatements) deleteExpiredEmailSessions(
+	ctx context.Context, txn *sql.Tx, nowMS int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteExpiredEmailSessionsStmt).ExecContext(ctx, nowMS)
+	return err
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const loginTokenSchema = `
+-- Stores the single-use login tokens issued for m.login.token.
+CREATE TABLE IF NOT EXISTS userapi_login_tokens (
+	-- The value of the token issued to a user
+	token TEXT NOT NULL PRIMARY KEY,
+	-- The Matrix user ID that the token logs in as
+	user_id TEXT NOT NULL,
+	-- When the token expires, as a unix timestamp (ms resolution).
+	token_expires_at_ms BIGINT NOT NULL
+);
+`
+
+const insertLoginTokenSQL = "" +
+	"INSERT INTO userapi_login_tokens(token, user_id, token_expires_at_ms) VALUES ($1, $2, $3)"
+
+const selectLoginTokenSQL = "" +
+	"SELECT user_id, token_expires_at_ms FROM userapi_login_tokens WHERE token = $1"
+
+const deleteLoginTokenSQL = "" +
+	"DELETE FROM userapi_login_tokens WHERE token = $1"
+
+const deleteExpiredLoginTokensSQL = "" +
+	"DELETE FROM userapi_login_tokens WHERE token_expires_at_ms <= $1"
+
+type loginTokenStatements struct {
+	insertLoginTokenStmt         *sql.Stmt
+	selectLoginTokenStmt         *sql.Stmt
+	deleteLoginTokenStmt         *sql.Stmt
+	deleteExpiredLoginTokensStmt *sql.Stmt
+}
+
+func (s *loginTokenStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(loginTokenSchema)
+	if err != nil {
+		return
+	}
+	if s.insertLoginTokenStmt, err = db.Prepare(insertLoginTokenSQL); err != nil {
+		return
+	}
+	if s.selectLoginTokenStmt, err = db.Prepare(selectLoginTokenSQL); err != nil {
+		return
+	}
+	if s.deleteLoginTokenStmt, err = db.Prepare(deleteLoginTokenSQL); err != nil {
+		return
+	}
+	if s.deleteExpiredLoginTokensStmt, err = db.Prepare(deleteExpiredLoginTokensSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *loginTokenStatements) insertLoginToken(
+	ctx context.Context, txn *sql.Tx, token, userID string, expiresAtMS int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.insertLoginTokenStmt).ExecContext(ctx, token, userID, expiresAtMS)
+	return err
+}
+
+// deleteLoginToken deletes the login token and returns its attributes.
+// Returns sql.ErrNoRows if the token doesn't exist, or if it was deleted by
+// a concurrent redemption of the same token.
+func (s *loginTokenStatements) deleteLoginToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (*api.LoginTokenAttributes, error) {
+	var attrs api.LoginTokenAttributes
+	err := sqlutil.TxStmt(txn, s.selectLoginTokenStmt).QueryRowContext(ctx, token).Scan(
+		&attrs.UserID, &attrs.ExpiresAtMS,
+	)
+	if err != nil {
+		return nil, err
+	}
+	res, err := sqlutil.TxStmt(txn, s.deleteLoginTokenStmt).ExecContext(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &attrs, nil
+}
+
+func (s *loginTokenStatements) deleteExpiredLoginTokens(
+	ctx context.Context, txn *sql.Tx, nowMS int64,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteExpiredLoginTokensStmt).ExecContext(ctx, nowMS)
+	return err
+}
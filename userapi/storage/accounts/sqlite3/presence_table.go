@@ -0,0 +1,120 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const presenceSchema = `
+-- Stores the presence of users.
+CREATE TABLE IF NOT EXISTS account_presence (
+	-- The Matrix user ID of the user
+	user_id TEXT NOT NULL PRIMARY KEY,
+	-- The presence state: online, unavailable or offline
+	presence TEXT NOT NULL,
+	-- The status message set by the user, if any
+	status_msg TEXT,
+	-- When the user was last active, as a unix timestamp (ms resolution)
+	last_active_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS account_presence_last_active_ts_idx ON account_presence(last_active_ts);
+`
+
+const upsertPresenceSQL = "" +
+	"INSERT INTO account_presence (user_id, presence, status_msg, last_active_ts)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (user_id) DO UPDATE SET presence = $2, status_msg = $3, last_active_ts = $4"
+
+const selectPresenceSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts FROM account_presence WHERE user_id = $1"
+
+const selectIdlePresenceSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts FROM account_presence" +
+	" WHERE presence != 'offline' AND last_active_ts < $1"
+
+type presenceStatements struct {
+	upsertPresenceStmt     *sql.Stmt
+	selectPresenceStmt     *sql.Stmt
+	selectIdlePresenceStmt *sql.Stmt
+}
+
+func (s *presenceStatements) prepare(db *sql.DB) (err error) {
+	if _, err = db.Exec(presenceSchema); err != nil {
+		return
+	}
+	if s.upsertPresenceStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return
+	}
+	if s.selectPresenceStmt, err = db.Prepare(selectPresenceSQL); err != nil {
+		return
+	}
+	if s.selectIdlePresenceStmt, err = db.Prepare(selectIdlePresenceSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *presenceStatements) upsertPresence(
+	ctx context.Context, txn *sql.Tx, presence *api.Presence,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertPresenceStmt)
+	_, err := stmt.ExecContext(ctx, presence.UserID, presence.Presence, presence.StatusMsg, presence.LastActiveTS)
+	return err
+}
+
+// selectPresence returns the presence of the user, or nil if it isn't known.
+func (s *presenceStatements) selectPresence(
+	ctx context.Context, userID string,
+) (*api.Presence, error) {
+	var presence api.Presence
+	err := s.selectPresenceStmt.QueryRowContext(ctx, userID).Scan(
+		&presence.UserID, &presence.Presence, &presence.StatusMsg, &presence.LastActiveTS,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &presence, nil
+}
+
+// selectIdlePresence returns the presence of users who aren't offline but
+// haven't been active since the given time.
+func (s *presenceStatements) selectIdlePresence(
+	ctx context.Context, before gomatrixserverlib.Timestamp,
+) ([]api.Presence, error) {
+	rows, err := s.selectIdlePresenceStmt.QueryContext(ctx, before)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectIdlePresence: rows.close() failed")
+	var presences []api.Presence
+	for rows.Next() {
+		var presence api.Presence
+		if err = rows.Scan(&presence.UserID, &presence.Presence, &presence.StatusMsg, &presence.LastActiveTS); err != nil {
+			return nil, err
+		}
+		presences = append(presences, presence)
+	}
+	return presences, rows.Err()
+}
@@ -0,0 +1,148 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const pushersSchema = `
+-- Stores the pushers which notifications for local users are delivered to.
+CREATE TABLE IF NOT EXISTS account_pushers (
+	-- The localpart of the Matrix user ID the pusher belongs to
+	localpart TEXT NOT NULL,
+	-- The kind of pusher: http or email
+	kind TEXT NOT NULL,
+	-- The ID of the application the pusher is for, e.g. com.example.app.ios
+	app_id TEXT NOT NULL,
+	-- The identifier of the device at the push gateway, or the email address
+	pushkey TEXT NOT NULL,
+	-- When the pushkey was last set, as a unix timestamp (ms resolution)
+	pushkey_ts_ms BIGINT NOT NULL,
+	app_display_name TEXT NOT NULL,
+	device_display_name TEXT NOT NULL,
+	profile_tag TEXT NOT NULL,
+	lang TEXT NOT NULL,
+	-- The JSON data of the pusher, e.g. the URL of the push gateway
+	data TEXT NOT NULL,
+
+	PRIMARY KEY(localpart, app_id, pushkey)
+);
+
+CREATE INDEX IF NOT EXISTS account_pushers_app_id_pushkey_idx ON account_pushers(app_id, pushkey);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO account_pushers (localpart, kind, app_id, pushkey, pushkey_ts_ms, app_display_name, device_display_name, profile_tag, lang, data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
+	" ON CONFLICT (localpart, app_id, pushkey) DO UPDATE SET kind = $2, pushkey_ts_ms = $5," +
+	" app_display_name = $6, device_display_name = $7, profile_tag = $8, lang = $9, data = $10"
+
+const selectPushersSQL = "" +
+	"SELECT kind, app_id, pushkey, pushkey_ts_ms, app_display_name, device_display_name, profile_tag, lang, data" +
+	" FROM account_pushers WHERE localpart = $1"
+
+const deletePusherSQL = "" +
+	"DELETE FROM account_pushers WHERE localpart = $1 AND app_id = $2 AND pushkey = $3"
+
+const deletePushersByAppIDAndPushKeySQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2"
+
+type pushersStatements struct {
+	upsertPusherStmt                   *sql.Stmt
+	selectPushersStmt                  *sql.Stmt
+	deletePusherStmt                   *sql.Stmt
+	deletePushersByAppIDAndPushKeyStmt *sql.Stmt
+}
+
+func (s *pushersStatements) prepare(db *sql.DB) (err error) {
+	if _, err = db.Exec(pushersSchema); err != nil {
+		return
+	}
+	if s.upsertPusherStmt, err = db.Prepare(upsertPusherSQL); err != nil {
+		return
+	}
+	if s.selectPushersStmt, err = db.Prepare(selectPushersSQL); err != nil {
+		return
+	}
+	if s.deletePusherStmt, err = db.Prepare(deletePusherSQL); err != nil {
+		return
+	}
+	if s.deletePushersByAppIDAndPushKeyStmt, err = db.Prepare(deletePushersByAppIDAndPushKeySQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pushersStatements) upsertPusher(
+	ctx context.Context, txn *sql.Tx, localpart string, pusher *api.Pusher,
+) error {
+	data, err := json.Marshal(pusher.Data)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmt(txn, s.upsertPusherStmt).ExecContext(
+		ctx, localpart, pusher.Kind, pusher.AppID, pusher.PushKey, pusher.PushKeyTS,
+		pusher.AppDisplayName, pusher.DeviceDisplayName, pusher.ProfileTag, pusher.Language, string(data),
+	)
+	return err
+}
+
+func (s *pushersStatements) selectPushers(
+	ctx context.Context, localpart string,
+) ([]api.Pusher, error) {
+	rows, err := s.selectPushersStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPushers: rows.close() failed")
+
+	pushers := []api.Pusher{}
+	for rows.Next() {
+		var pusher api.Pusher
+		var data string
+		if err = rows.Scan(
+			&pusher.Kind, &pusher.AppID, &pusher.PushKey, &pusher.PushKeyTS,
+			&pusher.AppDisplayName, &pusher.DeviceDisplayName, &pusher.ProfileTag, &pusher.Language, &data,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(data), &pusher.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
+
+func (s *pushersStatements) deletePusher(
+	ctx context.Context, txn *sql.Tx, localpart, appID, pushKey string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePusherStmt).ExecContext(ctx, localpart, appID, pushKey)
+	return err
+}
+
+func (s *pushersStatements) deletePushersByAppIDAndPushKey(
+	ctx context.Context, txn *sql.Tx, appID, pushKey string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.deletePushersByAppIDAndPushKeyStmt).ExecContext(ctx, appID, pushKey)
+	return err
+}
@@ -0,0 +1,190 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const registrationTokensSchema = `
+-- Stores the tokens which allow users to register, when registration requires one.
+CREATE TABLE IF NOT EXISTS userapi_registration_tokens (
+	token TEXT NOT NULL PRIMARY KEY,
+	-- How many times the token can be used, or NULL if there is no limit
+	uses_allowed INTEGER,
+	-- How many times the token has been used to register
+	completed INTEGER NOT NULL DEFAULT 0,
+	-- When the token expires, as a unix timestamp (ms resolution), or NULL if it doesn't
+	expiry_time BIGINT
+);
+`
+
+const insertRegistrationTokenSQL = "" +
+	"INSERT INTO userapi_registration_tokens(token, uses_allowed, expiry_time) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (token) DO NOTHING"
+
+const selectRegistrationTokenSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_time FROM userapi_registration_tokens WHERE token = $1"
+
+const selectRegistrationTokensSQL = "" +
+	"SELECT token, uses_allowed, completed, expiry_time FROM userapi_registration_tokens ORDER BY token"
+
+const deleteRegistrationTokenSQL = "" +
+	"DELETE FROM userapi_registration_tokens WHERE token = $1"
+
+// The conditions are checked by the same statement which uses the token, so
+// that concurrent registrations can't use it more times than it allows.
+const useRegistrationTokenSQL = "" +
+	"UPDATE userapi_registration_tokens SET completed = completed + 1 WHERE token = $1" +
+	" AND (uses_allowed IS NULL OR completed < uses_allowed)" +
+	" AND (expiry_time IS NULL OR expiry_time > $2)"
+
+const releaseRegistrationTokenSQL = "" +
+	"UPDATE userapi_registration_tokens SET completed = completed - 1 WHERE token = $1 AND completed > 0"
+
+type registrationTokensStatements struct {
+	insertRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokenStmt  *sql.Stmt
+	selectRegistrationTokensStmt *sql.Stmt
+	deleteRegistrationTokenStmt  *sql.Stmt
+	useRegistrationTokenStmt     *sql.Stmt
+	releaseRegistrationTokenStmt *sql.Stmt
+}
+
+func (s *registrationTokensStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(registrationTokensSchema)
+	if err != nil {
+		return
+	}
+	if s.insertRegistrationTokenStmt, err = db.Prepare(insertRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokenStmt, err = db.Prepare(selectRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.selectRegistrationTokensStmt, err = db.Prepare(selectRegistrationTokensSQL); err != nil {
+		return
+	}
+	if s.deleteRegistrationTokenStmt, err = db.Prepare(deleteRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.useRegistrationTokenStmt, err = db.Prepare(useRegistrationTokenSQL); err != nil {
+		return
+	}
+	if s.releaseRegistrationTokenStmt, err = db.Prepare(releaseRegistrationTokenSQL); err != nil {
+		return
+	}
+	return
+}
+
+// insertRegistrationToken stores the token, returning false if it already
+// exists.
+func (s *registrationTokensStatements) insertRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token *api.RegistrationToken,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.insertRegistrationTokenStmt).ExecContext(
+		ctx, token.Token, token.UsesAllowed, token.ExpiryTime,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// selectRegistrationToken returns the token, or nil if it doesn't exist.
+func (s *registrationTokensStatements) selectRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (*api.RegistrationToken, error) {
+	t, err := scanRegistrationToken(sqlutil.TxStmt(txn, s.selectRegistrationTokenStmt).QueryRowContext(ctx, token))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return t, err
+}
+
+func (s *registrationTokensStatements) selectRegistrationTokens(
+	ctx context.Context, txn *sql.Tx,
+) ([]api.RegistrationToken, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectRegistrationTokensStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRegistrationTokens: rows.close() failed")
+	var tokens []api.RegistrationToken
+	for rows.Next() {
+		t, err := scanRegistrationToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, *t)
+	}
+	return tokens, rows.Err()
+}
+
+func scanRegistrationToken(row interface{ Scan(...interface{}) error }) (*api.RegistrationToken, error) {
+	var t api.RegistrationToken
+	var usesAllowed sql.NullInt32
+	var expiryTime sql.NullInt64
+	if err := row.Scan(&t.Token, &usesAllowed, &t.Completed, &expiryTime); err != nil {
+		return nil, err
+	}
+	if usesAllowed.Valid {
+		t.UsesAllowed = &usesAllowed.Int32
+	}
+	if expiryTime.Valid {
+		t.ExpiryTime = &expiryTime.Int64
+	}
+	return &t, nil
+}
+
+// deleteRegistrationToken deletes the token, returning false if it didn't
+// exist.
+func (s *registrationTokensStatements) deleteRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.deleteRegistrationTokenStmt).ExecContext(ctx, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// useRegistrationToken counts a use of the token, returning false if it
+// doesn't exist, has expired or has already been used as many times as it
+// allows.
+func (s *registrationTokensStatements) useRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string, nowMS int64,
+) (bool, error) {
+	res, err := sqlutil.TxStmt(txn, s.useRegistrationTokenStmt).ExecContext(ctx, token, nowMS)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *registrationTokensStatements) releaseRegistrationToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.releaseRegistrationTokenStmt).ExecContext(ctx, token)
+	return err
+}
@@ -16,6 +16,7 @@ package sqlite3
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/json"
 	"errors"
@@ -24,6 +25,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/pushrules"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -42,10 +44,21 @@ type Database struct {
 	profiles              profilesStatements
 	accountDatas          accountDataStatements
 	threepids             threepidStatements
+	threepidIDServers     threepidIDServersStatements
+	externalIDs           externalIDsStatements
 	openIDTokens          tokenStatements
+	loginTokens           loginTokenStatements
+	emailSessions         emailSessionsStatements
+	registrationTokens    registrationTokensStatements
+	presence              presenceStatements
+	keyBackupVersions     keyBackupVersionStatements
+	keyBackups            keyBackupStatements
+	pushers               pushersStatements
+	eventReports          eventReportsStatements
 	serverName            gomatrixserverlib.ServerName
 	bcryptCost            int
 	openIDTokenLifetimeMS int64
+	loginTokenLifetimeMS  int64
 
 	accountsMu     sync.Mutex
 	profilesMu     sync.Mutex
@@ -54,7 +67,7 @@ type Database struct {
 }
 
 // NewDatabase creates a new accounts and profiles database
-func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName, bcryptCost int, openIDTokenLifetimeMS int64) (*Database, error) {
+func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserverlib.ServerName, bcryptCost int, openIDTokenLifetimeMS, loginTokenLifetimeMS int64) (*Database, error) {
 	db, err := sqlutil.Open(dbProperties)
 	if err != nil {
 		return nil, err
@@ -65,6 +78,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 		writer:                sqlutil.NewExclusiveWriter(),
 		bcryptCost:            bcryptCost,
 		openIDTokenLifetimeMS: openIDTokenLifetimeMS,
+		loginTokenLifetimeMS:  loginTokenLifetimeMS,
 	}
 
 	// Create tables before executing migrations so we don't fail if the table is missing,
@@ -74,6 +88,7 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadIsActive(m)
+	deltas.LoadAccountType(m)
 	if err = m.RunDeltas(db, dbProperties); err != nil {
 		return nil, err
 	}
@@ -94,9 +109,39 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.threepids.prepare(db); err != nil {
 		return nil, err
 	}
+	if err = d.threepidIDServers.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.externalIDs.prepare(db); err != nil {
+		return nil, err
+	}
 	if err = d.openIDTokens.prepare(db, serverName); err != nil {
 		return nil, err
 	}
+	if err = d.loginTokens.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.emailSessions.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.registrationTokens.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.presence.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.keyBackupVersions.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.keyBackups.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.pushers.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = d.eventReports.prepare(db); err != nil {
+		return nil, err
+	}
 
 	return d, nil
 }
@@ -181,7 +226,7 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *api.Account, er
 			return err
 		}
 		localpart := strconv.FormatInt(numLocalpart, 10)
-		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		acc, err = d.createAccount(ctx, txn, localpart, "", "", api.AccountTypeGuest)
 		return err
 	})
 	return acc, err
@@ -201,7 +246,7 @@ func (d *Database) CreateAccount(
 	defer d.accountDatasMu.Unlock()
 	defer d.accountsMu.Unlock()
 	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
-		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID, api.AccountTypeUser)
 		return err
 	})
 	return
@@ -210,7 +255,7 @@ func (d *Database) CreateAccount(
 // WARNING! This function assumes that the relevant mutexes have already
 // been taken out by the caller (e.g. CreateAccount or CreateGuestAccount).
 func (d *Database) createAccount(
-	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string, accountType api.AccountType,
 ) (*api.Account, error) {
 	var err error
 	var account *api.Account
@@ -222,21 +267,18 @@ func (d *Database) createAccount(
 			return nil, err
 		}
 	}
-	if account, err = d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID); err != nil {
+	if account, err = d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID, accountType); err != nil {
 		return nil, sqlutil.ErrUserExists
 	}
 	if err = d.profiles.insertProfile(ctx, txn, localpart); err != nil {
 		return nil, err
 	}
-	if err = d.accountDatas.insertAccountData(ctx, txn, localpart, "", "m.push_rules", json.RawMessage(`{
-		"global": {
-			"content": [],
-			"override": [],
-			"room": [],
-			"sender": [],
-			"underride": []
-		}
-	}`)); err != nil {
+	pushRuleSets := pushrules.DefaultAccountRuleSets(localpart, d.serverName)
+	prbs, err := json.Marshal(pushRuleSets)
+	if err != nil {
+		return nil, err
+	}
+	if err = d.accountDatas.insertAccountData(ctx, txn, localpart, "", "m.push_rules", json.RawMessage(prbs)); err != nil {
 		return nil, err
 	}
 	return account, nil
@@ -287,6 +329,12 @@ func (d *Database) GetNewNumericLocalpart(
 	return d.accounts.selectNewNumericLocalpart(ctx, nil)
 }
 
+// GetActiveLocalparts returns the localparts of the accounts which haven't
+// been deactivated, other than those of application services.
+func (d *Database) GetActiveLocalparts(ctx context.Context) ([]string, error) {
+	return d.accounts.selectActiveLocalparts(ctx)
+}
+
 func (d *Database) hashPassword(plaintext string) (hash string, err error) {
 	hashBytes, err := bcrypt.GenerateFromPassword([]byte(plaintext), d.bcryptCost)
 	return string(hashBytes), err
@@ -335,6 +383,34 @@ func (d *Database) RemoveThreePIDAssociation(
 	})
 }
 
+// SaveThreePIDIDServer records that the user has bound the third-party identifier
+// on the identity server.
+func (d *Database) SaveThreePIDIDServer(
+	ctx context.Context, localpart, medium, threepid, idServer string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.threepidIDServers.insertThreePIDIDServer(ctx, txn, localpart, medium, threepid, idServer)
+	})
+}
+
+// RemoveThreePIDIDServer records that the user has unbound the third-party
+// identifier from the identity server.
+func (d *Database) RemoveThreePIDIDServer(
+	ctx context.Context, localpart, medium, threepid, idServer string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.threepidIDServers.deleteThreePIDIDServer(ctx, txn, localpart, medium, threepid, idServer)
+	})
+}
+
+// GetThreePIDIDServers returns the identity servers which the user has bound
+// the third-party identifier on.
+func (d *Database) GetThreePIDIDServers(
+	ctx context.Context, localpart, medium, threepid string,
+) ([]string, error) {
+	return d.threepidIDServers.selectThreePIDIDServers(ctx, nil, localpart, medium, threepid)
+}
+
 // GetLocalpartForThreePID looks up the localpart associated with a given third-party
 // identifier.
 // If no association involves the given third-party idenfitier, returns an empty
@@ -346,6 +422,25 @@ func (d *Database) GetLocalpartForThreePID(
 	return d.threepids.selectLocalpartForThreePID(ctx, nil, threepid, medium)
 }
 
+// SaveExternalID links the user of an external identity provider to the
+// account which they log into. The link can't be changed once it is made.
+func (d *Database) SaveExternalID(
+	ctx context.Context, authProvider, externalID, localpart string,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.externalIDs.insertExternalID(ctx, txn, authProvider, externalID, localpart)
+	})
+}
+
+// GetLocalpartForExternalID returns the localpart of the account which the
+// user of an external identity provider logs into, or an empty string if
+// they aren't linked to one.
+func (d *Database) GetLocalpartForExternalID(
+	ctx context.Context, authProvider, externalID string,
+) (localpart string, err error) {
+	return d.externalIDs.selectLocalpartForExternalID(ctx, nil, authProvider, externalID)
+}
+
 // GetThreePIDsForLocalpart looks up the third-party identifiers associated with
 // a given local user.
 // If no association is known for this user, returns an empty slice.
@@ -406,3 +501,390 @@ func (d *Database) GetOpenIDTokenAttributes(
 ) (*api.OpenIDTokenAttributes, error) {
 	return d.openIDTokens.selectOpenIDTokenAtrributes(ctx, token)
 }
+
+// CreateLoginToken persists a new single-use login token for the user, and
+// returns when it expires. Expired tokens are cleaned up at the same time.
+func (d *Database) CreateLoginToken(
+	ctx context.Context,
+	token, userID string,
+) (int64, error) {
+	nowMS := time.Now().UnixNano() / int64(time.Millisecond)
+	expiresAtMS := nowMS + d.loginTokenLifetimeMS
+	err := d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if err := d.loginTokens.deleteExpiredLoginTokens(ctx, txn, nowMS); err != nil {
+			return err
+		}
+		return d.loginTokens.insertLoginToken(ctx, txn, token, userID, expiresAtMS)
+	})
+	return expiresAtMS, err
+}
+
+// ConsumeLoginToken deletes the login token so that it can't be used again,
+// and returns its attributes. Returns sql.ErrNoRows if the token doesn't
+// exist, has already been consumed or has expired.
+func (d *Database) ConsumeLoginToken(
+	ctx context.Context,
+	token string,
+) (attrs *api.LoginTokenAttributes, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		attrs, err = d.loginTokens.deleteLoginToken(ctx, txn, token)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if attrs.ExpiresAtMS <= time.Now().UnixNano()/int64(time.Millisecond) {
+		return nil, sql.ErrNoRows
+	}
+	return attrs, nil
+}
+
+// CreateEmailSession stores a new email validation session. If the client
+// already has a session for the email address then that session is returned
+// instead, and send is true only if the send attempt is higher than before.
+func (d *Database) CreateEmailSession(
+	ctx context.Context, session *api.EmailSession,
+) (existing *api.EmailSession, send bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if err = d.emailSessions.deleteExpiredEmailSessions(ctx, txn, time.Now().UnixNano()/int64(time.Millisecond)); err != nil {
+			return err
+		}
+		existing, err = d.emailSessions.selectEmailSessionByClientSecret(ctx, txn, session.ClientSecret, session.Email)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			existing, send = session, true
+			return d.emailSessions.insertEmailSession(ctx, txn, session)
+		}
+		if session.SendAttempt <= existing.SendAttempt {
+			return nil
+		}
+		existing.SendAttempt, send = session.SendAttempt, true
+		return d.emailSessions.updateEmailSession(ctx, txn, existing.SessionID, existing.SendAttempt, existing.Validated)
+	})
+	return
+}
+
+// ValidateEmailSession marks the email validation session as validated if
+// the token is correct. Once maxFailedAttempts incorrect tokens have been
+// submitted, the session can no longer be validated.
+func (d *Database) ValidateEmailSession(
+	ctx context.Context, sessionID, clientSecret, token string, maxFailedAttempts int,
+) (validated bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		session, err := d.emailSessions.selectEmailSession(ctx, txn, sessionID)
+		if err != nil || session == nil || session.ClientSecret != clientSecret {
+			return err
+		}
+		if session.ExpiresAtMS <= time.Now().UnixNano()/int64(time.Millisecond) {
+			return nil
+		}
+		if session.Validated {
+			validated = true
+			return nil
+		}
+		if session.FailedAttempts >= maxFailedAttempts {
+			return nil
+		}
+		if subtle.ConstantTimeCompare([]byte(session.Token), []byte(token)) != 1 {
+			return d.emailSessions.incrementEmailSessionFailedAttempts(ctx, txn, sessionID)
+		}
+		validated = true
+		return d.emailSessions.updateEmailSession(ctx, txn, sessionID, session.SendAttempt, true)
+	})
+	return
+}
+
+// ConsumeEmailSession deletes a validated email validation session so that it
+// can't be used again, and returns the email address that it validated.
+// Returns an empty address if the session doesn't exist or isn't validated.
+func (d *Database) ConsumeEmailSession(
+	ctx context.Context, sessionID, clientSecret string,
+) (email string, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		session, err := d.emailSessions.selectEmailSession(ctx, txn, sessionID)
+		if err != nil || session == nil || session.ClientSecret != clientSecret || !session.Validated {
+			return err
+		}
+		if session.ExpiresAtMS <= time.Now().UnixNano()/int64(time.Millisecond) {
+			return nil
+		}
+		deleted, err := d.emailSessions.deleteEmailSession(ctx, txn, sessionID)
+		if deleted {
+			email = session.Email
+		}
+		return err
+	})
+	return
+}
+
+// CreateRegistrationToken stores a new registration token, returning false
+// if a token with the same value already exists.
+func (d *Database) CreateRegistrationToken(
+	ctx context.Context, token *api.RegistrationToken,
+) (created bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		created, err = d.registrationTokens.insertRegistrationToken(ctx, txn, token)
+		return err
+	})
+	return
+}
+
+// GetRegistrationToken returns the registration token, or nil if it doesn't
+// exist.
+func (d *Database) GetRegistrationToken(
+	ctx context.Context, token string,
+) (*api.RegistrationToken, error) {
+	return d.registrationTokens.selectRegistrationToken(ctx, nil, token)
+}
+
+// GetRegistrationTokens returns all of the registration tokens.
+func (d *Database) GetRegistrationTokens(ctx context.Context) ([]api.RegistrationToken, error) {
+	return d.registrationTokens.selectRegistrationTokens(ctx, nil)
+}
+
+// DeleteRegistrationToken deletes the registration token, returning false if
+// it didn't exist.
+func (d *Database) DeleteRegistrationToken(
+	ctx context.Context, token string,
+) (deleted bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		deleted, err = d.registrationTokens.deleteRegistrationToken(ctx, txn, token)
+		return err
+	})
+	return
+}
+
+// UseRegistrationToken counts a registration with the token. Returns false,
+// without counting it, if the token doesn't exist, has expired or has already
+// been used as many times as it allows.
+func (d *Database) UseRegistrationToken(
+	ctx context.Context, token string, nowMS int64,
+) (used bool, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		used, err = d.registrationTokens.useRegistrationToken(ctx, txn, token, nowMS)
+		return err
+	})
+	return
+}
+
+// ReleaseRegistrationToken undoes UseRegistrationToken if the registration
+// failed, so that the use isn't counted.
+func (d *Database) ReleaseRegistrationToken(ctx context.Context, token string) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.registrationTokens.releaseRegistrationToken(ctx, txn, token)
+	})
+}
+
+// UpsertPresence stores the presence of a user, replacing any existing presence.
+func (d *Database) UpsertPresence(ctx context.Context, presence *api.Presence) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.presence.upsertPresence(ctx, txn, presence)
+	})
+}
+
+// GetPresence returns the presence of a user, or nil if it isn't known.
+func (d *Database) GetPresence(ctx context.Context, userID string) (*api.Presence, error) {
+	return d.presence.selectPresence(ctx, userID)
+}
+
+// GetIdlePresence returns the presence of users who aren't offline but haven't
+// been active since the given time.
+func (d *Database) GetIdlePresence(ctx context.Context, before gomatrixserverlib.Timestamp) ([]api.Presence, error) {
+	return d.presence.selectIdlePresence(ctx, before)
+}
+
+// UpsertPusher stores the pusher for the user, replacing any pusher they
+// have for the same app ID and pushkey. If removeOthers is true, pushers
+// for the same app ID and pushkey belonging to other users are removed.
+func (d *Database) UpsertPusher(
+	ctx context.Context, localpart string, pusher *api.Pusher, removeOthers bool,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if removeOthers {
+			if err := d.pushers.deletePushersByAppIDAndPushKey(ctx, txn, pusher.AppID, pusher.PushKey); err != nil {
+				return err
+			}
+		}
+		return d.pushers.upsertPusher(ctx, txn, localpart, pusher)
+	})
+}
+
+// GetPushers returns the pushers of the user.
+func (d *Database) GetPushers(ctx context.Context, localpart string) ([]api.Pusher, error) {
+	return d.pushers.selectPushers(ctx, localpart)
+}
+
+// RemovePusher removes the user's pusher for the app ID and pushkey, if
+// they have one.
+func (d *Database) RemovePusher(ctx context.Context, localpart, appID, pushKey string) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.pushers.deletePusher(ctx, txn, localpart, appID, pushKey)
+	})
+}
+
+// keyBackupVersion parses a key backup version. Versions which can't be parsed
+// are returned as 0, which is never a valid version.
+func keyBackupVersion(version string) int64 {
+	v, err := strconv.ParseInt(version, 10, 64)
+	if err != nil || v <= 0 {
+		return 0
+	}
+	return v
+}
+
+// CreateKeyBackup creates a new key backup version for the user and returns the version.
+func (d *Database) CreateKeyBackup(
+	ctx context.Context, userID, algorithm string, authData json.RawMessage,
+) (version string, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		version, err = d.keyBackupVersions.insertKeyBackup(ctx, txn, userID, algorithm, authData)
+		return err
+	})
+	return
+}
+
+// UpdateKeyBackupAuthData replaces the auth data of a key backup version.
+func (d *Database) UpdateKeyBackupAuthData(
+	ctx context.Context, userID, version string, authData json.RawMessage,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.keyBackupVersions.updateKeyBackupAuthData(ctx, txn, userID, keyBackupVersion(version), authData)
+	})
+}
+
+// DeleteKeyBackup deletes a key backup version along with all of the keys in it.
+// Returns false if the version doesn't exist.
+func (d *Database) DeleteKeyBackup(
+	ctx context.Context, userID, version string,
+) (exists bool, err error) {
+	v := keyBackupVersion(version)
+	if v == 0 {
+		return false, nil
+	}
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if err = d.keyBackups.deleteKeys(ctx, txn, userID, v, "", ""); err != nil {
+			return err
+		}
+		exists, err = d.keyBackupVersions.deleteKeyBackup(ctx, txn, userID, v)
+		return err
+	})
+	return
+}
+
+// GetKeyBackup returns a key backup version, or the latest version if version
+// is empty. Returns nil if the version doesn't exist.
+func (d *Database) GetKeyBackup(
+	ctx context.Context, userID, version string,
+) (*api.KeyBackupVersion, error) {
+	var v int64
+	if version != "" {
+		if v = keyBackupVersion(version); v == 0 {
+			return nil, nil
+		}
+	}
+	return d.keyBackupWithCount(ctx, nil, userID, v)
+}
+
+func (d *Database) keyBackupWithCount(
+	ctx context.Context, txn *sql.Tx, userID string, version int64,
+) (*api.KeyBackupVersion, error) {
+	backup, err := d.keyBackupVersions.selectKeyBackup(ctx, txn, userID, version)
+	if err != nil || backup == nil {
+		return nil, err
+	}
+	backup.Count, err = d.keyBackups.countKeys(ctx, txn, userID, keyBackupVersion(backup.Version))
+	if err != nil {
+		return nil, err
+	}
+	return backup, nil
+}
+
+// UpsertBackupKeys stores the keys in a key backup version. Existing keys are
+// only replaced if the new key is better. Returns the number of keys in the
+// version and its etag, which changes if any keys were stored.
+func (d *Database) UpsertBackupKeys(
+	ctx context.Context, userID, version string, uploads []api.InternalKeyBackupSession,
+) (count int64, etag string, err error) {
+	v := keyBackupVersion(version)
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		changed := false
+		for _, upload := range uploads {
+			existing, err := d.keyBackups.selectKeys(ctx, txn, userID, v, upload.RoomID, upload.SessionID)
+			if err != nil {
+				return err
+			}
+			if key, ok := existing[upload.RoomID][upload.SessionID]; ok && !key.ShouldReplaceRoomKey(&upload.KeyBackupSession) {
+				continue
+			}
+			if err = d.keyBackups.upsertBackupKey(ctx, txn, userID, v, upload); err != nil {
+				return err
+			}
+			changed = true
+		}
+		if changed {
+			if err = d.keyBackupVersions.updateKeyBackupETag(ctx, txn, userID, v); err != nil {
+				return err
+			}
+		}
+		backup, err := d.keyBackupWithCount(ctx, txn, userID, v)
+		if err != nil || backup == nil {
+			return err
+		}
+		count, etag = backup.Count, backup.ETag
+		return nil
+	})
+	return
+}
+
+// GetBackupKeys returns the keys in a key backup version as room ID to session
+// ID to key, limited to the room if roomID is set, and to the session in the room
+// if sessionID is also set.
+func (d *Database) GetBackupKeys(
+	ctx context.Context, userID, version, roomID, sessionID string,
+) (map[string]map[string]api.KeyBackupSession, error) {
+	return d.keyBackups.selectKeys(ctx, nil, userID, keyBackupVersion(version), roomID, sessionID)
+}
+
+// DeleteBackupKeys deletes the keys in a key backup version, limited to the room
+// if roomID is set, and to the session in the room if sessionID is also set.
+// Returns the number of keys left in the version and its new etag.
+func (d *Database) DeleteBackupKeys(
+	ctx context.Context, userID, version, roomID, sessionID string,
+) (count int64, etag string, err error) {
+	v := keyBackupVersion(version)
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		if err = d.keyBackups.deleteKeys(ctx, txn, userID, v, roomID, sessionID); err != nil {
+			return err
+		}
+		if err = d.keyBackupVersions.updateKeyBackupETag(ctx, txn, userID, v); err != nil {
+			return err
+		}
+		backup, err := d.keyBackupWithCount(ctx, txn, userID, v)
+		if err != nil || backup == nil {
+			return err
+		}
+		count, etag = backup.Count, backup.ETag
+		return nil
+	})
+	return
+}
+
+// InsertEventReport stores a report of an event and returns its ID.
+func (d *Database) InsertEventReport(ctx context.Context, report *api.EventReport) (id int64, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		id, err = d.eventReports.insertEventReport(ctx, txn, report)
+		return err
+	})
+	return
+}
+
+// GetEventReports returns the event reports, newest first unless forwards is
+// true, limited to the room and reporting user if they are set. The total
+// number of matching reports is also returned, for pagination.
+func (d *Database) GetEventReports(
+	ctx context.Context, roomID, userID string, from, limit int64, forwards bool,
+) ([]api.EventReport, int64, error) {
+	return d.eventReports.selectEventReports(ctx, nil, roomID, userID, from, limit, forwards)
+}
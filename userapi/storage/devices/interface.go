@@ -34,8 +34,25 @@ type Database interface {
 	CreateDevice(ctx context.Context, localpart string, deviceID *string, accessToken string, displayName *string, ipAddr, userAgent string) (dev *api.Device, returnErr error)
 	UpdateDevice(ctx context.Context, localpart, deviceID string, displayName *string) error
 	UpdateDeviceLastSeen(ctx context.Context, localpart, deviceID, ipAddr string) error
+	// UpsertDeviceConnection records that the device has connected from the given IP address
+	// with the given user agent.
+	UpsertDeviceConnection(ctx context.Context, localpart, deviceID, ipAddr, userAgent string, lastSeenTS int64) error
+	// GetDeviceConnections returns the connections of each of the user's devices, most recent first.
+	GetDeviceConnections(ctx context.Context, localpart string) (map[string][]api.DeviceConnection, error)
+	// PruneDeviceConnections deletes the connections which were last seen before the given timestamp.
+	PruneDeviceConnections(ctx context.Context, beforeTS int64) error
+	// InsertRefreshToken stores a refresh token for the device with the given access token. The access
+	// token expires at the given timestamp, and the refresh token expires at the given timestamp unless it is 0.
+	InsertRefreshToken(ctx context.Context, refreshToken, accessToken, localpart, deviceID string, accessTokenExpiresTS, refreshTokenExpiresTS int64) error
+	// RefreshAccessToken replaces the access token and the refresh token of the device which the refresh token
+	// was issued to. Returns sql.ErrNoRows if the refresh token is unknown, has already been used or has expired.
+	RefreshAccessToken(ctx context.Context, refreshToken, newAccessToken, newRefreshToken string, nowTS, accessTokenExpiresTS, refreshTokenExpiresTS int64) (*api.Device, error)
+	// RemoveDevice deletes the device, revoking its access token and refresh token.
 	RemoveDevice(ctx context.Context, deviceID, localpart string) error
 	RemoveDevices(ctx context.Context, localpart string, devices []string) error
 	// RemoveAllDevices deleted all devices for this user. Returns the devices deleted.
 	RemoveAllDevices(ctx context.Context, localpart, exceptDeviceID string) (devices []api.Device, err error)
+	// GetRevokedAccessToken returns the localpart of the user whose access token was recently revoked.
+	// Returns sql.ErrNoRows if the access token wasn't revoked.
+	GetRevokedAccessToken(ctx context.Context, accessToken string) (string, error)
 }
@@ -70,11 +70,13 @@ const insertDeviceSQL = "" +
 	"INSERT INTO device_devices(device_id, localpart, access_token, created_ts, display_name, last_seen_ts, ip, user_agent) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)" +
 	" RETURNING session_id"
 
+// Access tokens only expire if they were issued along with a refresh token.
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT d.session_id, d.device_id, d.localpart, COALESCE(r.access_token_expires_ts, 0) FROM device_devices d" +
+	" LEFT JOIN device_refresh_tokens r ON r.access_token = d.access_token WHERE d.access_token = $1"
 
 const selectDeviceByIDSQL = "" +
-	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
+	"SELECT session_id, display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
 
 const selectDevicesByLocalpartSQL = "" +
 	"SELECT device_id, display_name, last_seen_ts, ip, user_agent FROM device_devices WHERE localpart = $1 AND device_id != $2"
@@ -82,6 +84,9 @@ const selectDevicesByLocalpartSQL = "" +
 const updateDeviceNameSQL = "" +
 	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
 
+const updateDeviceAccessTokenSQL = "" +
+	"UPDATE device_devices SET access_token = $1 WHERE access_token = $2"
+
 const deleteDeviceSQL = "" +
 	"DELETE FROM device_devices WHERE device_id = $1 AND localpart = $2"
 
@@ -104,6 +109,7 @@ type devicesStatements struct {
 	selectDevicesByLocalpartStmt *sql.Stmt
 	selectDevicesByIDStmt        *sql.Stmt
 	updateDeviceNameStmt         *sql.Stmt
+	updateDeviceAccessTokenStmt  *sql.Stmt
 	updateDeviceLastSeenStmt     *sql.Stmt
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
@@ -132,6 +138,9 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if s.updateDeviceNameStmt, err = db.Prepare(updateDeviceNameSQL); err != nil {
 		return
 	}
+	if s.updateDeviceAccessTokenStmt, err = db.Prepare(updateDeviceAccessTokenSQL); err != nil {
+		return
+	}
 	if s.deleteDeviceStmt, err = db.Prepare(deleteDeviceSQL); err != nil {
 		return
 	}
@@ -212,13 +221,27 @@ func (s *devicesStatements) updateDeviceName(
 	return err
 }
 
+// updateDeviceAccessToken replaces the access token of a device, returning
+// false if there is no device with the old access token.
+func (s *devicesStatements) updateDeviceAccessToken(
+	ctx context.Context, txn *sql.Tx, oldAccessToken, newAccessToken string,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.updateDeviceAccessTokenStmt)
+	res, err := stmt.ExecContext(ctx, newAccessToken, oldAccessToken)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
 func (s *devicesStatements) selectDeviceByToken(
 	ctx context.Context, accessToken string,
 ) (*api.Device, error) {
 	var dev api.Device
 	var localpart string
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.AccessTokenExpiresTS)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
@@ -234,7 +257,7 @@ func (s *devicesStatements) selectDeviceByID(
 	var dev api.Device
 	var displayName sql.NullString
 	stmt := s.selectDeviceByIDStmt
-	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&displayName)
+	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&dev.SessionID, &displayName)
 	if err == nil {
 		dev.ID = deviceID
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
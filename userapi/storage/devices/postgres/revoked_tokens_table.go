@@ -0,0 +1,151 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// How long revoked access tokens are remembered for. Clients which use them
+// within this time are told that they have been soft logged out, rather than
+// that their access token was never valid.
+const revokedTokenRetention = 7 * 24 * time.Hour
+
+const revokedTokensSchema = `
+-- Stores the access tokens of devices which have been deleted or have had
+-- their access tokens replaced.
+CREATE TABLE IF NOT EXISTS device_revoked_tokens (
+    access_token TEXT NOT NULL PRIMARY KEY,
+    localpart TEXT NOT NULL,
+    -- When the access token was revoked, as a unix timestamp (ms resolution).
+    revoked_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS device_revoked_tokens_revoked_ts_idx ON device_revoked_tokens(revoked_ts);
+`
+
+const insertRevokedTokenSQL = "" +
+	"INSERT INTO device_revoked_tokens (access_token, localpart, revoked_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (access_token) DO NOTHING"
+
+const insertRevokedDeviceTokenSQL = "" +
+	"INSERT INTO device_revoked_tokens (access_token, localpart, revoked_ts)" +
+	" SELECT access_token, localpart, $1 FROM device_devices WHERE localpart = $2 AND device_id = $3" +
+	" ON CONFLICT (access_token) DO NOTHING"
+
+const insertRevokedDeviceTokensByLocalpartSQL = "" +
+	"INSERT INTO device_revoked_tokens (access_token, localpart, revoked_ts)" +
+	" SELECT access_token, localpart, $1 FROM device_devices WHERE localpart = $2 AND device_id != $3" +
+	" ON CONFLICT (access_token) DO NOTHING"
+
+const selectRevokedTokenSQL = "" +
+	"SELECT localpart FROM device_revoked_tokens WHERE access_token = $1"
+
+const deleteRevokedTokensBeforeSQL = "" +
+	"DELETE FROM device_revoked_tokens WHERE revoked_ts < $1"
+
+type revokedTokensStatements struct {
+	insertRevokedTokenStmt                   *sql.Stmt
+	insertRevokedDeviceTokenStmt             *sql.Stmt
+	insertRevokedDeviceTokensByLocalpartStmt *sql.Stmt
+	selectRevokedTokenStmt                   *sql.Stmt
+	deleteRevokedTokensBeforeStmt            *sql.Stmt
+}
+
+func (s *revokedTokensStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(revokedTokensSchema)
+	return err
+}
+
+func (s *revokedTokensStatements) prepare(db *sql.DB) (err error) {
+	if s.insertRevokedTokenStmt, err = db.Prepare(insertRevokedTokenSQL); err != nil {
+		return
+	}
+	if s.insertRevokedDeviceTokenStmt, err = db.Prepare(insertRevokedDeviceTokenSQL); err != nil {
+		return
+	}
+	if s.insertRevokedDeviceTokensByLocalpartStmt, err = db.Prepare(insertRevokedDeviceTokensByLocalpartSQL); err != nil {
+		return
+	}
+	if s.selectRevokedTokenStmt, err = db.Prepare(selectRevokedTokenSQL); err != nil {
+		return
+	}
+	if s.deleteRevokedTokensBeforeStmt, err = db.Prepare(deleteRevokedTokensBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+// revokeToken remembers that the access token has been revoked.
+func (s *revokedTokensStatements) revokeToken(
+	ctx context.Context, txn *sql.Tx, accessToken, localpart string,
+) error {
+	now := time.Now()
+	stmt := sqlutil.TxStmt(txn, s.insertRevokedTokenStmt)
+	if _, err := stmt.ExecContext(ctx, accessToken, localpart, gomatrixserverlib.AsTimestamp(now)); err != nil {
+		return err
+	}
+	return s.prune(ctx, txn, now)
+}
+
+// revokeDeviceTokens remembers that the access tokens of the devices are being
+// revoked. It must be called before the devices are deleted.
+func (s *revokedTokensStatements) revokeDeviceTokens(
+	ctx context.Context, txn *sql.Tx, localpart string, deviceIDs []string,
+) error {
+	now := time.Now()
+	stmt := sqlutil.TxStmt(txn, s.insertRevokedDeviceTokenStmt)
+	for _, deviceID := range deviceIDs {
+		if _, err := stmt.ExecContext(ctx, gomatrixserverlib.AsTimestamp(now), localpart, deviceID); err != nil {
+			return err
+		}
+	}
+	return s.prune(ctx, txn, now)
+}
+
+// revokeDeviceTokensByLocalpart remembers that the access tokens of all of the
+// user's devices other than the given one are being revoked. It must be called
+// before the devices are deleted.
+func (s *revokedTokensStatements) revokeDeviceTokensByLocalpart(
+	ctx context.Context, txn *sql.Tx, localpart, exceptDeviceID string,
+) error {
+	now := time.Now()
+	stmt := sqlutil.TxStmt(txn, s.insertRevokedDeviceTokensByLocalpartStmt)
+	if _, err := stmt.ExecContext(ctx, gomatrixserverlib.AsTimestamp(now), localpart, exceptDeviceID); err != nil {
+		return err
+	}
+	return s.prune(ctx, txn, now)
+}
+
+// selectRevokedToken returns the localpart of the user whose access token was
+// revoked. Returns sql.ErrNoRows if the access token wasn't revoked recently.
+func (s *revokedTokensStatements) selectRevokedToken(
+	ctx context.Context, accessToken string,
+) (localpart string, err error) {
+	err = s.selectRevokedTokenStmt.QueryRowContext(ctx, accessToken).Scan(&localpart)
+	return
+}
+
+// prune forgets the access tokens which were revoked too long ago to matter.
+func (s *revokedTokensStatements) prune(ctx context.Context, txn *sql.Tx, now time.Time) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteRevokedTokensBeforeStmt)
+	_, err := stmt.ExecContext(ctx, gomatrixserverlib.AsTimestamp(now.Add(-revokedTokenRetention)))
+	return err
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/userapi/api"
+)
+
+const connectionsSchema = `
+-- Stores the IP addresses and user agents which devices have connected from,
+-- so that server admins can look them up with /admin/whois.
+CREATE TABLE IF NOT EXISTS device_connections (
+    localpart TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    ip TEXT NOT NULL,
+    user_agent TEXT NOT NULL,
+    -- When the device last connected from this IP address with this user agent,
+    -- as a unix timestamp (ms resolution).
+    last_seen_ts BIGINT NOT NULL,
+    UNIQUE (localpart, device_id, ip, user_agent)
+);
+
+CREATE INDEX IF NOT EXISTS device_connections_last_seen_ts_idx ON device_connections(last_seen_ts);
+`
+
+const upsertConnectionSQL = "" +
+	"INSERT INTO device_connections (localpart, device_id, ip, user_agent, last_seen_ts) VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (localpart, device_id, ip, user_agent) DO UPDATE SET last_seen_ts = $5"
+
+const selectConnectionsByLocalpartSQL = "" +
+	"SELECT device_id, ip, user_agent, last_seen_ts FROM device_connections WHERE localpart = $1 ORDER BY last_seen_ts DESC"
+
+const deleteConnectionsBeforeSQL = "" +
+	"DELETE FROM device_connections WHERE last_seen_ts < $1"
+
+type connectionsStatements struct {
+	upsertConnectionStmt             *sql.Stmt
+	selectConnectionsByLocalpartStmt *sql.Stmt
+	deleteConnectionsBeforeStmt      *sql.Stmt
+}
+
+func (s *connectionsStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(connectionsSchema)
+	return err
+}
+
+func (s *connectionsStatements) prepare(db *sql.DB) (err error) {
+	if s.upsertConnectionStmt, err = db.Prepare(upsertConnectionSQL); err != nil {
+		return
+	}
+	if s.selectConnectionsByLocalpartStmt, err = db.Prepare(selectConnectionsByLocalpartSQL); err != nil {
+		return
+	}
+	if s.deleteConnectionsBeforeStmt, err = db.Prepare(deleteConnectionsBeforeSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *connectionsStatements) upsertConnection(
+	ctx context.Context, txn *sql.Tx, localpart, deviceID, ip, userAgent string, lastSeenTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.upsertConnectionStmt)
+	_, err := stmt.ExecContext(ctx, localpart, deviceID, ip, userAgent, lastSeenTS)
+	return err
+}
+
+// selectConnectionsByLocalpart returns the connections of each of the user's
+// devices, most recent first.
+func (s *connectionsStatements) selectConnectionsByLocalpart(
+	ctx context.Context, localpart string,
+) (map[string][]api.DeviceConnection, error) {
+	rows, err := s.selectConnectionsByLocalpartStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectConnectionsByLocalpart: rows.close() failed")
+	connections := make(map[string][]api.DeviceConnection)
+	for rows.Next() {
+		var deviceID string
+		var conn api.DeviceConnection
+		if err = rows.Scan(&deviceID, &conn.IP, &conn.UserAgent, &conn.LastSeenTS); err != nil {
+			return nil, err
+		}
+		connections[deviceID] = append(connections[deviceID], conn)
+	}
+	return connections, rows.Err()
+}
+
+func (s *connectionsStatements) deleteConnectionsBefore(
+	ctx context.Context, txn *sql.Tx, beforeTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteConnectionsBeforeStmt)
+	_, err := stmt.ExecContext(ctx, beforeTS)
+	return err
+}
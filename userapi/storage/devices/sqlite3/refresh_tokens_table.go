@@ -0,0 +1,127 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal/sqlutil"
+)
+
+const refreshTokensSchema = `
+-- Stores the refresh tokens of devices which logged in with refresh token support.
+-- Each refresh token can only be used once, to get a new access token and a new
+-- refresh token for the device.
+CREATE TABLE IF NOT EXISTS device_refresh_tokens (
+    refresh_token TEXT NOT NULL PRIMARY KEY,
+    -- The access token which was issued along with the refresh token.
+    access_token TEXT NOT NULL UNIQUE,
+    localpart TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    -- When the access token expires, as a unix timestamp (ms resolution).
+    access_token_expires_ts BIGINT NOT NULL,
+    -- When the refresh token expires, as a unix timestamp (ms resolution),
+    -- or 0 if it never expires.
+    refresh_token_expires_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS device_refresh_tokens_localpart_idx ON device_refresh_tokens(localpart);
+`
+
+const insertRefreshTokenSQL = "" +
+	"INSERT INTO device_refresh_tokens (refresh_token, access_token, localpart, device_id, access_token_expires_ts, refresh_token_expires_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)"
+
+const selectRefreshTokenSQL = "" +
+	"SELECT access_token, localpart, device_id, refresh_token_expires_ts FROM device_refresh_tokens WHERE refresh_token = $1"
+
+const deleteRefreshTokenSQL = "" +
+	"DELETE FROM device_refresh_tokens WHERE refresh_token = $1"
+
+// Refresh tokens are revoked along with their access tokens, so this is run
+// whenever devices are deleted or their access tokens are replaced.
+const deleteOrphanedRefreshTokensSQL = "" +
+	"DELETE FROM device_refresh_tokens WHERE localpart = $1" +
+	" AND access_token NOT IN (SELECT access_token FROM device_devices WHERE localpart = $1)"
+
+type refreshTokensStatements struct {
+	insertRefreshTokenStmt          *sql.Stmt
+	selectRefreshTokenStmt          *sql.Stmt
+	deleteRefreshTokenStmt          *sql.Stmt
+	deleteOrphanedRefreshTokensStmt *sql.Stmt
+}
+
+func (s *refreshTokensStatements) execSchema(db *sql.DB) error {
+	_, err := db.Exec(refreshTokensSchema)
+	return err
+}
+
+func (s *refreshTokensStatements) prepare(db *sql.DB) (err error) {
+	if s.insertRefreshTokenStmt, err = db.Prepare(insertRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.selectRefreshTokenStmt, err = db.Prepare(selectRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.deleteRefreshTokenStmt, err = db.Prepare(deleteRefreshTokenSQL); err != nil {
+		return
+	}
+	if s.deleteOrphanedRefreshTokensStmt, err = db.Prepare(deleteOrphanedRefreshTokensSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *refreshTokensStatements) insertRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken, accessToken, localpart, deviceID string,
+	accessTokenExpiresTS, refreshTokenExpiresTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertRefreshTokenStmt)
+	_, err := stmt.ExecContext(ctx, refreshToken, accessToken, localpart, deviceID, accessTokenExpiresTS, refreshTokenExpiresTS)
+	return err
+}
+
+// selectRefreshToken returns the access token, localpart, device ID and expiry
+// of the refresh token. Returns sql.ErrNoRows if the refresh token is unknown.
+func (s *refreshTokensStatements) selectRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) (accessToken, localpart, deviceID string, refreshTokenExpiresTS int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRefreshTokenStmt)
+	err = stmt.QueryRowContext(ctx, refreshToken).Scan(&accessToken, &localpart, &deviceID, &refreshTokenExpiresTS)
+	return
+}
+
+// deleteRefreshToken deletes the refresh token, returning false if it had
+// already been deleted.
+func (s *refreshTokensStatements) deleteRefreshToken(
+	ctx context.Context, txn *sql.Tx, refreshToken string,
+) (bool, error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteRefreshTokenStmt)
+	res, err := stmt.ExecContext(ctx, refreshToken)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count > 0, err
+}
+
+func (s *refreshTokensStatements) deleteOrphanedRefreshTokens(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteOrphanedRefreshTokensStmt)
+	_, err := stmt.ExecContext(ctx, localpart)
+	return err
+}
@@ -20,6 +20,7 @@ import (
 	"database/sql"
 	"encoding/base64"
 
+	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/dendrite/setup/config"
 	"github.com/matrix-org/dendrite/userapi/api"
@@ -34,9 +35,12 @@ var deviceIDByteLength = 6
 
 // Database represents a device database.
 type Database struct {
-	db      *sql.DB
-	writer  sqlutil.Writer
-	devices devicesStatements
+	db          *sql.DB
+	writer      sqlutil.Writer
+	devices     devicesStatements
+	connections connectionsStatements
+	refresh     refreshTokensStatements
+	revoked     revokedTokensStatements
 }
 
 // NewDatabase creates a new device database
@@ -47,12 +51,24 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	}
 	writer := sqlutil.NewExclusiveWriter()
 	d := devicesStatements{}
+	c := connectionsStatements{}
+	r := refreshTokensStatements{}
+	v := revokedTokensStatements{}
 
 	// Create tables before executing migrations so we don't fail if the table is missing,
 	// and THEN prepare statements so we don't fail due to referencing new columns
 	if err = d.execSchema(db); err != nil {
 		return nil, err
 	}
+	if err = c.execSchema(db); err != nil {
+		return nil, err
+	}
+	if err = r.execSchema(db); err != nil {
+		return nil, err
+	}
+	if err = v.execSchema(db); err != nil {
+		return nil, err
+	}
 	m := sqlutil.NewMigrations()
 	deltas.LoadLastSeenTSIP(m)
 	if err = m.RunDeltas(db, dbProperties); err != nil {
@@ -61,7 +77,16 @@ func NewDatabase(dbProperties *config.DatabaseOptions, serverName gomatrixserver
 	if err = d.prepare(db, writer, serverName); err != nil {
 		return nil, err
 	}
-	return &Database{db, writer, d}, nil
+	if err = c.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = r.prepare(db); err != nil {
+		return nil, err
+	}
+	if err = v.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, writer, d, c, r, v}, nil
 }
 
 // GetDeviceByAccessToken returns the device matching the given access token.
@@ -105,12 +130,18 @@ func (d *Database) CreateDevice(
 		returnErr = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
 			var err error
 			// Revoke existing tokens for this device
+			if err = d.revoked.revokeDeviceTokens(ctx, txn, localpart, []string{*deviceID}); err != nil {
+				return err
+			}
 			if err = d.devices.deleteDevice(ctx, txn, *deviceID, localpart); err != nil {
 				return err
 			}
 
 			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, accessToken, displayName, ipAddr, userAgent)
-			return err
+			if err != nil {
+				return err
+			}
+			return d.refresh.deleteOrphanedRefreshTokens(ctx, txn, localpart)
 		})
 	} else {
 		// We generate device IDs in a loop in case its already taken.
@@ -165,10 +196,13 @@ func (d *Database) RemoveDevice(
 	ctx context.Context, deviceID, localpart string,
 ) error {
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevice(ctx, txn, deviceID, localpart); err != sql.ErrNoRows {
+		if err := d.revoked.revokeDeviceTokens(ctx, txn, localpart, []string{deviceID}); err != nil {
 			return err
 		}
-		return nil
+		if err := d.devices.deleteDevice(ctx, txn, deviceID, localpart); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		return d.refresh.deleteOrphanedRefreshTokens(ctx, txn, localpart)
 	})
 }
 
@@ -180,10 +214,13 @@ func (d *Database) RemoveDevices(
 	ctx context.Context, localpart string, devices []string,
 ) error {
 	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
-		if err := d.devices.deleteDevices(ctx, txn, localpart, devices); err != sql.ErrNoRows {
+		if err := d.revoked.revokeDeviceTokens(ctx, txn, localpart, devices); err != nil {
 			return err
 		}
-		return nil
+		if err := d.devices.deleteDevices(ctx, txn, localpart, devices); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		return d.refresh.deleteOrphanedRefreshTokens(ctx, txn, localpart)
 	})
 }
 
@@ -198,10 +235,13 @@ func (d *Database) RemoveAllDevices(
 		if err != nil {
 			return err
 		}
-		if err := d.devices.deleteDevicesByLocalpart(ctx, txn, localpart, exceptDeviceID); err != sql.ErrNoRows {
+		if err := d.revoked.revokeDeviceTokensByLocalpart(ctx, txn, localpart, exceptDeviceID); err != nil {
 			return err
 		}
-		return nil
+		if err := d.devices.deleteDevicesByLocalpart(ctx, txn, localpart, exceptDeviceID); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		return d.refresh.deleteOrphanedRefreshTokens(ctx, txn, localpart)
 	})
 	return
 }
@@ -212,3 +252,101 @@ func (d *Database) UpdateDeviceLastSeen(ctx context.Context, localpart, deviceID
 		return d.devices.updateDeviceLastSeen(ctx, txn, localpart, deviceID, ipAddr)
 	})
 }
+
+// UpsertDeviceConnection records that the device has connected from the given
+// IP address with the given user agent.
+func (d *Database) UpsertDeviceConnection(
+	ctx context.Context, localpart, deviceID, ipAddr, userAgent string, lastSeenTS int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.connections.upsertConnection(ctx, txn, localpart, deviceID, ipAddr, userAgent, lastSeenTS)
+	})
+}
+
+// GetDeviceConnections returns the connections of each of the user's devices,
+// most recent first.
+func (d *Database) GetDeviceConnections(
+	ctx context.Context, localpart string,
+) (map[string][]api.DeviceConnection, error) {
+	return d.connections.selectConnectionsByLocalpart(ctx, localpart)
+}
+
+// PruneDeviceConnections deletes the connections which were last seen before
+// the given timestamp.
+func (d *Database) PruneDeviceConnections(ctx context.Context, beforeTS int64) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.connections.deleteConnectionsBefore(ctx, txn, beforeTS)
+	})
+}
+
+// InsertRefreshToken stores a refresh token for the device with the given
+// access token. The access token expires at the given timestamp, and the
+// refresh token expires at the given timestamp unless it is 0.
+func (d *Database) InsertRefreshToken(
+	ctx context.Context, refreshToken, accessToken, localpart, deviceID string,
+	accessTokenExpiresTS, refreshTokenExpiresTS int64,
+) error {
+	return d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		return d.refresh.insertRefreshToken(ctx, txn, refreshToken, accessToken, localpart, deviceID, accessTokenExpiresTS, refreshTokenExpiresTS)
+	})
+}
+
+// RefreshAccessToken replaces the access token of the device which the refresh
+// token was issued to, and replaces the refresh token so that it can't be used
+// again. Returns the device with its new access token, or sql.ErrNoRows if the
+// refresh token is unknown, has already been used or has expired.
+func (d *Database) RefreshAccessToken(
+	ctx context.Context, refreshToken, newAccessToken, newRefreshToken string,
+	nowTS, accessTokenExpiresTS, refreshTokenExpiresTS int64,
+) (dev *api.Device, err error) {
+	err = d.writer.Do(d.db, nil, func(txn *sql.Tx) error {
+		accessToken, localpart, deviceID, expiresTS, err := d.refresh.selectRefreshToken(ctx, txn, refreshToken)
+		if err != nil {
+			return err
+		}
+		if expiresTS != 0 && expiresTS <= nowTS {
+			return sql.ErrNoRows
+		}
+		// Another request may have used the refresh token since we selected it,
+		// in which case it's already gone.
+		deleted, err := d.refresh.deleteRefreshToken(ctx, txn, refreshToken)
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return sql.ErrNoRows
+		}
+		updated, err := d.devices.updateDeviceAccessToken(ctx, txn, accessToken, newAccessToken)
+		if err != nil {
+			return err
+		}
+		if !updated {
+			return sql.ErrNoRows
+		}
+		if err = d.revoked.revokeToken(ctx, txn, accessToken, localpart); err != nil {
+			return err
+		}
+		if err = d.refresh.insertRefreshToken(
+			ctx, txn, newRefreshToken, newAccessToken, localpart, deviceID, accessTokenExpiresTS, refreshTokenExpiresTS,
+		); err != nil {
+			return err
+		}
+		dev = &api.Device{
+			ID:                   deviceID,
+			UserID:               userutil.MakeUserID(localpart, d.devices.serverName),
+			AccessToken:          newAccessToken,
+			AccessTokenExpiresTS: accessTokenExpiresTS,
+		}
+		return nil
+	})
+	return
+}
+
+// GetRevokedAccessToken returns the localpart of the user whose access token
+// was recently revoked, because the device was deleted or was given another
+// access token. Returns sql.ErrNoRows if the access token wasn't revoked.
+func (d *Database) GetRevokedAccessToken(
+	ctx context.Context, accessToken string,
+) (string, error) {
+	return d.revoked.selectRevokedToken(ctx, accessToken)
+}
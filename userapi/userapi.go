@@ -15,9 +15,14 @@
 package userapi
 
 import (
+	"net/http"
+	"time"
+
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/internal/pushgateway"
 	keyapi "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/setup/config"
+	"github.com/matrix-org/dendrite/setup/kafka"
 	"github.com/matrix-org/dendrite/userapi/api"
 	"github.com/matrix-org/dendrite/userapi/internal"
 	"github.com/matrix-org/dendrite/userapi/inthttp"
@@ -42,11 +47,46 @@ func NewInternalAPI(
 		logrus.WithError(err).Panicf("failed to connect to device db")
 	}
 
+	var presence *internal.PresenceUpdater
+	if cfg.Presence.Enabled {
+		_, producer := kafka.SetupConsumerProducer(&cfg.Matrix.Kafka)
+		presence = internal.NewPresenceUpdater(
+			accountDB, cfg.Matrix.ServerName, producer,
+			cfg.Matrix.Kafka.TopicFor(config.TopicOutputPresenceEvent),
+			time.Duration(cfg.Presence.AggregationIntervalMS)*time.Millisecond,
+			time.Duration(cfg.Presence.IdleTimeoutMS)*time.Millisecond,
+		)
+		go presence.Start()
+	}
+
+	pushers := internal.NewPushDispatcher(
+		accountDB, cfg.Matrix.ServerName, pushgateway.NewHTTPClient(), &cfg.Push,
+	)
+
+	connections := internal.NewConnectionRecorder(
+		deviceDB,
+		time.Duration(cfg.DeviceConnections.UpdateIntervalMS)*time.Millisecond,
+		time.Duration(cfg.DeviceConnections.MaxAgeMS)*time.Millisecond,
+	)
+	go connections.Start()
+
+	var introspector *internal.TokenIntrospector
+	if cfg.DelegatedAuth.Enabled {
+		introspector = internal.NewTokenIntrospector(&cfg.DelegatedAuth, &http.Client{Timeout: time.Second * 30})
+	}
+
 	return &internal.UserInternalAPI{
-		AccountDB:   accountDB,
-		DeviceDB:    deviceDB,
-		ServerName:  cfg.Matrix.ServerName,
-		AppServices: appServices,
-		KeyAPI:      keyAPI,
+		AccountDB:    accountDB,
+		DeviceDB:     deviceDB,
+		ServerName:   cfg.Matrix.ServerName,
+		AppServices:  appServices,
+		KeyAPI:       keyAPI,
+		Presence:     presence,
+		Pushers:      pushers,
+		Connections:  connections,
+		Introspector: introspector,
+
+		AccessTokenLifetime:  time.Duration(cfg.AccessTokenLifetimeMS) * time.Millisecond,
+		RefreshTokenLifetime: time.Duration(cfg.RefreshTokenLifetimeMS) * time.Millisecond,
 	}
 }
@@ -2,10 +2,13 @@ package userapi_test
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"net/http"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/internal/httputil"
@@ -26,7 +29,7 @@ const (
 func MustMakeInternalAPI(t *testing.T) (api.UserInternalAPI, accounts.Database) {
 	accountDB, err := accounts.NewDatabase(&config.DatabaseOptions{
 		ConnectionString: "file::memory:",
-	}, serverName, bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS)
+	}, serverName, bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS, config.DefaultLoginTokenLifetimeMS)
 	if err != nil {
 		t.Fatalf("failed to create account DB: %s", err)
 	}
@@ -119,3 +122,320 @@ func TestQueryProfile(t *testing.T) {
 		runCases(userAPI)
 	})
 }
+
+func TestLoginToken(t *testing.T) {
+	ctx := context.Background()
+	userAPI, accountDB := MustMakeInternalAPI(t)
+	userID := fmt.Sprintf("@alice:%s", serverName)
+	if _, err := accountDB.CreateAccount(ctx, "alice", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+
+	var createRes api.PerformLoginTokenCreationResponse
+	if err := userAPI.PerformLoginTokenCreation(ctx, &api.PerformLoginTokenCreationRequest{UserID: userID}, &createRes); err != nil {
+		t.Fatalf("PerformLoginTokenCreation failed: %s", err)
+	}
+	if err := userAPI.PerformLoginTokenCreation(ctx, &api.PerformLoginTokenCreationRequest{UserID: "@bob:remote"}, &api.PerformLoginTokenCreationResponse{}); err == nil {
+		t.Errorf("PerformLoginTokenCreation for a remote user succeeded, want error")
+	}
+
+	// Only one of the concurrent redemptions of the token can succeed.
+	var wg sync.WaitGroup
+	userIDs := make([]string, 8)
+	for i := range userIDs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var res api.PerformLoginTokenConsumptionResponse
+			if err := userAPI.PerformLoginTokenConsumption(ctx, &api.PerformLoginTokenConsumptionRequest{Token: createRes.Token}, &res); err != nil {
+				t.Errorf("PerformLoginTokenConsumption failed: %s", err)
+			}
+			userIDs[i] = res.UserID
+		}(i)
+	}
+	wg.Wait()
+	var consumed int
+	for _, got := range userIDs {
+		switch got {
+		case userID:
+			consumed++
+		case "":
+		default:
+			t.Errorf("got user ID %q, want %q", got, userID)
+		}
+	}
+	if consumed != 1 {
+		t.Errorf("login token was consumed %d times, want 1", consumed)
+	}
+
+	// Login tokens can't be used once the account is deactivated.
+	if err := userAPI.PerformLoginTokenCreation(ctx, &api.PerformLoginTokenCreationRequest{UserID: userID}, &createRes); err != nil {
+		t.Fatalf("PerformLoginTokenCreation failed: %s", err)
+	}
+	if err := accountDB.DeactivateAccount(ctx, "alice"); err != nil {
+		t.Fatalf("DeactivateAccount failed: %s", err)
+	}
+	var deactivatedRes api.PerformLoginTokenConsumptionResponse
+	if err := userAPI.PerformLoginTokenConsumption(ctx, &api.PerformLoginTokenConsumptionRequest{Token: createRes.Token}, &deactivatedRes); err != nil {
+		t.Fatalf("PerformLoginTokenConsumption failed: %s", err)
+	}
+	if deactivatedRes.UserID != "" {
+		t.Errorf("login token of a deactivated account was consumed for %q", deactivatedRes.UserID)
+	}
+
+	// Expired login tokens can't be consumed.
+	expiringDB, err := accounts.NewDatabase(&config.DatabaseOptions{
+		ConnectionString: "file::memory:",
+	}, serverName, bcrypt.MinCost, config.DefaultOpenIDTokenLifetimeMS, 0)
+	if err != nil {
+		t.Fatalf("failed to create account DB: %s", err)
+	}
+	if _, err = expiringDB.CreateLoginToken(ctx, "expired", userID); err != nil {
+		t.Fatalf("CreateLoginToken failed: %s", err)
+	}
+	if _, err = expiringDB.ConsumeLoginToken(ctx, "expired"); err != sql.ErrNoRows {
+		t.Errorf("ConsumeLoginToken of an expired token: got %v, want sql.ErrNoRows", err)
+	}
+}
+
+func TestEmailSession(t *testing.T) {
+	ctx := context.Background()
+	userAPI, _ := MustMakeInternalAPI(t)
+	createReq := &api.PerformEmailSessionCreationRequest{
+		ClientSecret: "secret",
+		Email:        "alice@example.com",
+		SendAttempt:  1,
+		ExpiresAtMS:  time.Now().Add(time.Hour).UnixNano() / int64(time.Millisecond),
+	}
+	var createRes api.PerformEmailSessionCreationResponse
+	if err := userAPI.PerformEmailSessionCreation(ctx, createReq, &createRes); err != nil {
+		t.Fatalf("PerformEmailSessionCreation failed: %s", err)
+	}
+	if !createRes.Send {
+		t.Errorf("first send attempt should send an email")
+	}
+
+	// Retrying with the same send attempt returns the same session without
+	// sending another email.
+	var retryRes api.PerformEmailSessionCreationResponse
+	if err := userAPI.PerformEmailSessionCreation(ctx, createReq, &retryRes); err != nil {
+		t.Fatalf("PerformEmailSessionCreation failed: %s", err)
+	}
+	if retryRes.Send || retryRes.SessionID != createRes.SessionID {
+		t.Errorf("retried send attempt: got send=%v sid=%q, want send=false sid=%q", retryRes.Send, retryRes.SessionID, createRes.SessionID)
+	}
+
+	consume := func() string {
+		var res api.PerformEmailSessionConsumptionResponse
+		if err := userAPI.PerformEmailSessionConsumption(ctx, &api.PerformEmailSessionConsumptionRequest{
+			SessionID:    createRes.SessionID,
+			ClientSecret: "secret",
+		}, &res); err != nil {
+			t.Fatalf("PerformEmailSessionConsumption failed: %s", err)
+		}
+		return res.Email
+	}
+	validate := func(token string) bool {
+		var res api.PerformEmailSessionValidationResponse
+		if err := userAPI.PerformEmailSessionValidation(ctx, &api.PerformEmailSessionValidationRequest{
+			SessionID:    createRes.SessionID,
+			ClientSecret: "secret",
+			Token:        token,
+		}, &res); err != nil {
+			t.Fatalf("PerformEmailSessionValidation failed: %s", err)
+		}
+		return res.Validated
+	}
+
+	if email := consume(); email != "" {
+		t.Errorf("unvalidated session was consumed for %q", email)
+	}
+	if validate("wrong") {
+		t.Errorf("session was validated with the wrong token")
+	}
+	if !validate(createRes.Token) {
+		t.Errorf("session wasn't validated with the right token")
+	}
+	if email := consume(); email != createReq.Email {
+		t.Errorf("consumed session: got email %q, want %q", email, createReq.Email)
+	}
+	if email := consume(); email != "" {
+		t.Errorf("session was consumed twice")
+	}
+
+	// Too many wrong tokens stop the session from being validated at all.
+	createReq.ClientSecret = "other"
+	if err := userAPI.PerformEmailSessionCreation(ctx, createReq, &createRes); err != nil {
+		t.Fatalf("PerformEmailSessionCreation failed: %s", err)
+	}
+	for i := 0; i < 5; i++ {
+		var res api.PerformEmailSessionValidationResponse
+		_ = userAPI.PerformEmailSessionValidation(ctx, &api.PerformEmailSessionValidationRequest{
+			SessionID: createRes.SessionID, ClientSecret: "other", Token: "wrong",
+		}, &res)
+	}
+	var res api.PerformEmailSessionValidationResponse
+	if err := userAPI.PerformEmailSessionValidation(ctx, &api.PerformEmailSessionValidationRequest{
+		SessionID: createRes.SessionID, ClientSecret: "other", Token: createRes.Token,
+	}, &res); err != nil {
+		t.Fatalf("PerformEmailSessionValidation failed: %s", err)
+	}
+	if res.Validated {
+		t.Errorf("session was validated after too many failed attempts")
+	}
+}
+
+func TestGuestAccountType(t *testing.T) {
+	ctx := context.Background()
+	_, accountDB := MustMakeInternalAPI(t)
+	guest, err := accountDB.CreateGuestAccount(ctx)
+	if err != nil {
+		t.Fatalf("CreateGuestAccount failed: %s", err)
+	}
+	if _, err = accountDB.CreateAccount(ctx, "alice", "foobar", ""); err != nil {
+		t.Fatalf("failed to make account: %s", err)
+	}
+	for localpart, want := range map[string]api.AccountType{
+		guest.Localpart: api.AccountTypeGuest,
+		"alice":         api.AccountTypeUser,
+	} {
+		acc, err := accountDB.GetAccountByLocalpart(ctx, localpart)
+		if err != nil {
+			t.Fatalf("GetAccountByLocalpart failed: %s", err)
+		}
+		if acc.AccountType != want {
+			t.Errorf("%s: got account type %d, want %d", localpart, acc.AccountType, want)
+		}
+	}
+}
+
+func TestRegistrationTokenUses(t *testing.T) {
+	ctx := context.Background()
+	_, accountDB := MustMakeInternalAPI(t)
+	nowMS := time.Now().UnixNano() / int64(time.Millisecond)
+	usesAllowed := int32(3)
+	expired := nowMS - 1
+	for _, token := range []*api.RegistrationToken{
+		{Token: "limited", UsesAllowed: &usesAllowed},
+		{Token: "expired", ExpiryTime: &expired},
+		{Token: "unlimited"},
+	} {
+		if created, err := accountDB.CreateRegistrationToken(ctx, token); err != nil || !created {
+			t.Fatalf("CreateRegistrationToken(%s): got %v, %v", token.Token, created, err)
+		}
+	}
+	if created, err := accountDB.CreateRegistrationToken(ctx, &api.RegistrationToken{Token: "limited"}); err != nil || created {
+		t.Errorf("created a registration token which already exists: %v, %v", created, err)
+	}
+
+	// concurrent registrations can't use the token more times than it allows
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	used := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := accountDB.UseRegistrationToken(ctx, "limited", nowMS)
+			if err != nil {
+				t.Errorf("UseRegistrationToken failed: %s", err)
+			}
+			if ok {
+				mu.Lock()
+				used++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if used != int(usesAllowed) {
+		t.Errorf("got %d uses of the token, want %d", used, usesAllowed)
+	}
+	token, err := accountDB.GetRegistrationToken(ctx, "limited")
+	if err != nil || token == nil || token.Completed != usesAllowed {
+		t.Fatalf("got token %+v, %v, want %d completed uses", token, err, usesAllowed)
+	}
+
+	// releasing a use allows the token to be used again
+	if err = accountDB.ReleaseRegistrationToken(ctx, "limited"); err != nil {
+		t.Fatalf("ReleaseRegistrationToken failed: %s", err)
+	}
+	for token, want := range map[string]bool{"limited": true, "expired": false, "unlimited": true, "unknown": false} {
+		if ok, err := accountDB.UseRegistrationToken(ctx, token, nowMS); err != nil || ok != want {
+			t.Errorf("UseRegistrationToken(%s): got %v, %v, want %v", token, ok, err, want)
+		}
+	}
+
+	if deleted, err := accountDB.DeleteRegistrationToken(ctx, "unlimited"); err != nil || !deleted {
+		t.Errorf("DeleteRegistrationToken: got %v, %v", deleted, err)
+	}
+	tokens, err := accountDB.GetRegistrationTokens(ctx)
+	if err != nil {
+		t.Fatalf("GetRegistrationTokens failed: %s", err)
+	}
+	if len(tokens) != 2 || tokens[0].Token != "expired" || tokens[1].Token != "limited" {
+		t.Errorf("got tokens %+v, want expired and limited", tokens)
+	}
+}
+
+func TestThreePIDIDServers(t *testing.T) {
+	ctx := context.Background()
+	_, accountDB := MustMakeInternalAPI(t)
+	for _, idServer := range []string{"id1.example.com", "id2.example.com", "id1.example.com"} {
+		if err := accountDB.SaveThreePIDIDServer(ctx, "alice", "email", "alice@example.com", idServer); err != nil {
+			t.Fatalf("SaveThreePIDIDServer failed: %s", err)
+		}
+	}
+	if err := accountDB.SaveThreePIDIDServer(ctx, "bob", "email", "bob@example.com", "id1.example.com"); err != nil {
+		t.Fatalf("SaveThreePIDIDServer failed: %s", err)
+	}
+	if err := accountDB.RemoveThreePIDIDServer(ctx, "alice", "email", "alice@example.com", "id2.example.com"); err != nil {
+		t.Fatalf("RemoveThreePIDIDServer failed: %s", err)
+	}
+	idServers, err := accountDB.GetThreePIDIDServers(ctx, "alice", "email", "alice@example.com")
+	if err != nil {
+		t.Fatalf("GetThreePIDIDServers failed: %s", err)
+	}
+	if len(idServers) != 1 || idServers[0] != "id1.example.com" {
+		t.Errorf("got identity servers %v, want [id1.example.com]", idServers)
+	}
+}
+
+func TestEventReports(t *testing.T) {
+	ctx := context.Background()
+	_, accountDB := MustMakeInternalAPI(t)
+	score := int64(-100)
+	for _, report := range []*api.EventReport{
+		{RoomID: "!a:test", EventID: "$1", UserID: "@alice:test", Reason: "spam", Score: &score},
+		{RoomID: "!a:test", EventID: "$2", UserID: "@bob:test"},
+		{RoomID: "!b:test", EventID: "$3", UserID: "@alice:test"},
+	} {
+		report.EventJSON = []byte(`{"event_id":"` + report.EventID + `"}`)
+		if _, err := accountDB.InsertEventReport(ctx, report); err != nil {
+			t.Fatalf("InsertEventReport failed: %s", err)
+		}
+	}
+
+	reports, total, err := accountDB.GetEventReports(ctx, "", "", 0, 2, false)
+	if err != nil {
+		t.Fatalf("GetEventReports failed: %s", err)
+	}
+	if total != 3 || len(reports) != 2 || reports[0].EventID != "$3" || reports[1].EventID != "$2" {
+		t.Errorf("got %d reports %+v, want the newest 2 of 3", total, reports)
+	}
+	reports, total, err = accountDB.GetEventReports(ctx, "", "@alice:test", 1, 10, true)
+	if err != nil {
+		t.Fatalf("GetEventReports failed: %s", err)
+	}
+	if total != 2 || len(reports) != 1 || reports[0].EventID != "$3" {
+		t.Errorf("got %d reports %+v, want the second of alice's 2 reports", total, reports)
+	}
+	reports, _, err = accountDB.GetEventReports(ctx, "!a:test", "@alice:test", 0, 10, false)
+	if err != nil {
+		t.Fatalf("GetEventReports failed: %s", err)
+	}
+	if len(reports) != 1 || reports[0].Score == nil || *reports[0].Score != score || reports[0].Reason != "spam" ||
+		string(reports[0].EventJSON) != `{"event_id":"$1"}` {
+		t.Errorf("got reports %+v, want the report of $1", reports)
+	}
+}